@@ -25,6 +25,14 @@ type LanguageModelClient interface {
 	// GenerateTokens generates tokens for the given prompt using the specified decoding parameters.
 	// The response is a stream of GeneratedToken messages, each containing a generated token and its score and encoded representation.
 	GenerateTokens(ctx context.Context, in *TokenGenerationRequest, opts ...grpc.CallOption) (LanguageModel_GenerateTokensClient, error)
+	// PauseGeneration pauses a generation of the caller (same API key) between two tokens, keeping its state:
+	// its stream stays open, kept alive by heartbeats, until the generation is resumed or aborted.
+	PauseGeneration(ctx context.Context, in *GenerationControlRequest, opts ...grpc.CallOption) (*GenerationControlResponse, error)
+	// ResumeGeneration resumes a paused generation of the caller.
+	ResumeGeneration(ctx context.Context, in *GenerationControlRequest, opts ...grpc.CallOption) (*GenerationControlResponse, error)
+	// AbortGeneration stops a generation of the caller, paused or not, completing its stream with the tokens
+	// generated so far.
+	AbortGeneration(ctx context.Context, in *GenerationControlRequest, opts ...grpc.CallOption) (*GenerationControlResponse, error)
 }
 
 type languageModelClient struct {
@@ -67,6 +75,33 @@ func (x *languageModelGenerateTokensClient) Recv() (*GeneratedToken, error) {
 	return m, nil
 }
 
+func (c *languageModelClient) PauseGeneration(ctx context.Context, in *GenerationControlRequest, opts ...grpc.CallOption) (*GenerationControlResponse, error) {
+	out := new(GenerationControlResponse)
+	err := c.cc.Invoke(ctx, "/api.LanguageModel/PauseGeneration", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *languageModelClient) ResumeGeneration(ctx context.Context, in *GenerationControlRequest, opts ...grpc.CallOption) (*GenerationControlResponse, error) {
+	out := new(GenerationControlResponse)
+	err := c.cc.Invoke(ctx, "/api.LanguageModel/ResumeGeneration", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *languageModelClient) AbortGeneration(ctx context.Context, in *GenerationControlRequest, opts ...grpc.CallOption) (*GenerationControlResponse, error) {
+	out := new(GenerationControlResponse)
+	err := c.cc.Invoke(ctx, "/api.LanguageModel/AbortGeneration", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LanguageModelServer is the server API for LanguageModel service.
 // All implementations must embed UnimplementedLanguageModelServer
 // for forward compatibility
@@ -74,6 +109,14 @@ type LanguageModelServer interface {
 	// GenerateTokens generates tokens for the given prompt using the specified decoding parameters.
 	// The response is a stream of GeneratedToken messages, each containing a generated token and its score and encoded representation.
 	GenerateTokens(*TokenGenerationRequest, LanguageModel_GenerateTokensServer) error
+	// PauseGeneration pauses a generation of the caller (same API key) between two tokens, keeping its state:
+	// its stream stays open, kept alive by heartbeats, until the generation is resumed or aborted.
+	PauseGeneration(context.Context, *GenerationControlRequest) (*GenerationControlResponse, error)
+	// ResumeGeneration resumes a paused generation of the caller.
+	ResumeGeneration(context.Context, *GenerationControlRequest) (*GenerationControlResponse, error)
+	// AbortGeneration stops a generation of the caller, paused or not, completing its stream with the tokens
+	// generated so far.
+	AbortGeneration(context.Context, *GenerationControlRequest) (*GenerationControlResponse, error)
 	mustEmbedUnimplementedLanguageModelServer()
 }
 
@@ -84,6 +127,15 @@ type UnimplementedLanguageModelServer struct {
 func (UnimplementedLanguageModelServer) GenerateTokens(*TokenGenerationRequest, LanguageModel_GenerateTokensServer) error {
 	return status.Errorf(codes.Unimplemented, "method GenerateTokens not implemented")
 }
+func (UnimplementedLanguageModelServer) PauseGeneration(context.Context, *GenerationControlRequest) (*GenerationControlResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseGeneration not implemented")
+}
+func (UnimplementedLanguageModelServer) ResumeGeneration(context.Context, *GenerationControlRequest) (*GenerationControlResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeGeneration not implemented")
+}
+func (UnimplementedLanguageModelServer) AbortGeneration(context.Context, *GenerationControlRequest) (*GenerationControlResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AbortGeneration not implemented")
+}
 func (UnimplementedLanguageModelServer) mustEmbedUnimplementedLanguageModelServer() {}
 
 // UnsafeLanguageModelServer may be embedded to opt out of forward compatibility for this service.
@@ -118,13 +170,80 @@ func (x *languageModelGenerateTokensServer) Send(m *GeneratedToken) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _LanguageModel_PauseGeneration_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenerationControlRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LanguageModelServer).PauseGeneration(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.LanguageModel/PauseGeneration",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LanguageModelServer).PauseGeneration(ctx, req.(*GenerationControlRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LanguageModel_ResumeGeneration_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenerationControlRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LanguageModelServer).ResumeGeneration(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.LanguageModel/ResumeGeneration",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LanguageModelServer).ResumeGeneration(ctx, req.(*GenerationControlRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LanguageModel_AbortGeneration_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenerationControlRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LanguageModelServer).AbortGeneration(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.LanguageModel/AbortGeneration",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LanguageModelServer).AbortGeneration(ctx, req.(*GenerationControlRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LanguageModel_ServiceDesc is the grpc.ServiceDesc for LanguageModel service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var LanguageModel_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "api.LanguageModel",
 	HandlerType: (*LanguageModelServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PauseGeneration",
+			Handler:    _LanguageModel_PauseGeneration_Handler,
+		},
+		{
+			MethodName: "ResumeGeneration",
+			Handler:    _LanguageModel_ResumeGeneration_Handler,
+		},
+		{
+			MethodName: "AbortGeneration",
+			Handler:    _LanguageModel_AbortGeneration_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "GenerateTokens",
@@ -134,3 +253,323 @@ var LanguageModel_ServiceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "language_model.proto",
 }
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	// GetUsage returns the token usage accounted for each API key.
+	GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageReport, error)
+	// ListGenerations returns the generations being served.
+	ListGenerations(ctx context.Context, in *ListGenerationsRequest, opts ...grpc.CallOption) (*GenerationList, error)
+	// CancelGeneration cancels a generation being served, failing its request.
+	CancelGeneration(ctx context.Context, in *CancelGenerationRequest, opts ...grpc.CallOption) (*CancelGenerationResponse, error)
+	// ListModels returns the models loaded by the server.
+	ListModels(ctx context.Context, in *ListModelsRequest, opts ...grpc.CallOption) (*ModelList, error)
+	// GetConfig returns the effective configuration of the server, without the secrets.
+	GetConfig(ctx context.Context, in *ConfigRequest, opts ...grpc.CallOption) (*ConfigReport, error)
+	// ExportSession returns the state at the end of the last generation of an API key, continued by
+	// its requests with the continue flag, e.g. to move the session to another replica.
+	ExportSession(ctx context.Context, in *ExportSessionRequest, opts ...grpc.CallOption) (*SessionState, error)
+	// ImportSession sets the state at the end of the last generation of an API key, exported by
+	// another replica, which its next request with the continue flag continues.
+	ImportSession(ctx context.Context, in *ImportSessionRequest, opts ...grpc.CallOption) (*ImportSessionResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageReport, error) {
+	out := new(UsageReport)
+	err := c.cc.Invoke(ctx, "/api.Admin/GetUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListGenerations(ctx context.Context, in *ListGenerationsRequest, opts ...grpc.CallOption) (*GenerationList, error) {
+	out := new(GenerationList)
+	err := c.cc.Invoke(ctx, "/api.Admin/ListGenerations", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) CancelGeneration(ctx context.Context, in *CancelGenerationRequest, opts ...grpc.CallOption) (*CancelGenerationResponse, error) {
+	out := new(CancelGenerationResponse)
+	err := c.cc.Invoke(ctx, "/api.Admin/CancelGeneration", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListModels(ctx context.Context, in *ListModelsRequest, opts ...grpc.CallOption) (*ModelList, error) {
+	out := new(ModelList)
+	err := c.cc.Invoke(ctx, "/api.Admin/ListModels", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetConfig(ctx context.Context, in *ConfigRequest, opts ...grpc.CallOption) (*ConfigReport, error) {
+	out := new(ConfigReport)
+	err := c.cc.Invoke(ctx, "/api.Admin/GetConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ExportSession(ctx context.Context, in *ExportSessionRequest, opts ...grpc.CallOption) (*SessionState, error) {
+	out := new(SessionState)
+	err := c.cc.Invoke(ctx, "/api.Admin/ExportSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ImportSession(ctx context.Context, in *ImportSessionRequest, opts ...grpc.CallOption) (*ImportSessionResponse, error) {
+	out := new(ImportSessionResponse)
+	err := c.cc.Invoke(ctx, "/api.Admin/ImportSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	// GetUsage returns the token usage accounted for each API key.
+	GetUsage(context.Context, *UsageRequest) (*UsageReport, error)
+	// ListGenerations returns the generations being served.
+	ListGenerations(context.Context, *ListGenerationsRequest) (*GenerationList, error)
+	// CancelGeneration cancels a generation being served, failing its request.
+	CancelGeneration(context.Context, *CancelGenerationRequest) (*CancelGenerationResponse, error)
+	// ListModels returns the models loaded by the server.
+	ListModels(context.Context, *ListModelsRequest) (*ModelList, error)
+	// GetConfig returns the effective configuration of the server, without the secrets.
+	GetConfig(context.Context, *ConfigRequest) (*ConfigReport, error)
+	// ExportSession returns the state at the end of the last generation of an API key, continued by
+	// its requests with the continue flag, e.g. to move the session to another replica.
+	ExportSession(context.Context, *ExportSessionRequest) (*SessionState, error)
+	// ImportSession sets the state at the end of the last generation of an API key, exported by
+	// another replica, which its next request with the continue flag continues.
+	ImportSession(context.Context, *ImportSessionRequest) (*ImportSessionResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) GetUsage(context.Context, *UsageRequest) (*UsageReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedAdminServer) ListGenerations(context.Context, *ListGenerationsRequest) (*GenerationList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListGenerations not implemented")
+}
+func (UnimplementedAdminServer) CancelGeneration(context.Context, *CancelGenerationRequest) (*CancelGenerationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelGeneration not implemented")
+}
+func (UnimplementedAdminServer) ListModels(context.Context, *ListModelsRequest) (*ModelList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListModels not implemented")
+}
+func (UnimplementedAdminServer) GetConfig(context.Context, *ConfigRequest) (*ConfigReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+func (UnimplementedAdminServer) ExportSession(context.Context, *ExportSessionRequest) (*SessionState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportSession not implemented")
+}
+func (UnimplementedAdminServer) ImportSession(context.Context, *ImportSessionRequest) (*ImportSessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ImportSession not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Admin/GetUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetUsage(ctx, req.(*UsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListGenerations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListGenerationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListGenerations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Admin/ListGenerations",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListGenerations(ctx, req.(*ListGenerationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_CancelGeneration_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelGenerationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).CancelGeneration(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Admin/CancelGeneration",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).CancelGeneration(ctx, req.(*CancelGenerationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListModels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListModelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListModels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Admin/ListModels",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListModels(ctx, req.(*ListModelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Admin/GetConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetConfig(ctx, req.(*ConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ExportSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ExportSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Admin/ExportSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ExportSession(ctx, req.(*ExportSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ImportSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ImportSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.Admin/ImportSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ImportSession(ctx, req.(*ImportSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "api.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetUsage",
+			Handler:    _Admin_GetUsage_Handler,
+		},
+		{
+			MethodName: "ListGenerations",
+			Handler:    _Admin_ListGenerations_Handler,
+		},
+		{
+			MethodName: "CancelGeneration",
+			Handler:    _Admin_CancelGeneration_Handler,
+		},
+		{
+			MethodName: "ListModels",
+			Handler:    _Admin_ListModels_Handler,
+		},
+		{
+			MethodName: "GetConfig",
+			Handler:    _Admin_GetConfig_Handler,
+		},
+		{
+			MethodName: "ExportSession",
+			Handler:    _Admin_ExportSession_Handler,
+		},
+		{
+			MethodName: "ImportSession",
+			Handler:    _Admin_ImportSession_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "language_model.proto",
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package audit implements a structured log of the prompts and completions
+// served, for operators who must retain usage records.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Record is a single entry of the audit log.
+// The Completion is the text sent to the client, after the moderation, the text
+// processors and the post-completion script; the RawCompletion is the text
+// generated by the model, when it differs.
+type Record struct {
+	RequestID        string                  `json:"request_id"`
+	StartedAt        time.Time               `json:"started_at"`
+	FinishedAt       time.Time               `json:"finished_at"`
+	LatencyMs        int64                   `json:"latency_ms"`
+	Prompt           string                  `json:"prompt"`
+	Completion       string                  `json:"completion"`
+	RawCompletion    string                  `json:"raw_completion,omitempty"`
+	Options          decoder.DecodingOptions `json:"options"`
+	PromptTokens     int                     `json:"prompt_tokens"`
+	CompletionTokens int                     `json:"completion_tokens"`
+	Error            string                  `json:"error,omitempty"`
+}
+
+// Redactor modifies a record before it is written, e.g. to remove personal data.
+type Redactor func(r *Record)
+
+// RedactRegexp returns a Redactor that replaces all the matches of re in the
+// prompt and in the completions with repl.
+func RedactRegexp(re *regexp.Regexp, repl string) Redactor {
+	return func(r *Record) {
+		r.Prompt = re.ReplaceAllString(r.Prompt, repl)
+		r.Completion = re.ReplaceAllString(r.Completion, repl)
+		r.RawCompletion = re.ReplaceAllString(r.RawCompletion, repl)
+	}
+}
+
+// Logger is the interface implemented by the audit log backends.
+type Logger interface {
+	// Log writes a record to the audit log.
+	Log(r Record) error
+	// Close releases the resources of the logger.
+	Close() error
+}
+
+// Options contains the settings of the JSONL logger.
+type Options struct {
+	// MaxPromptLen is the maximum number of characters of the prompt to retain.
+	// Zero means no truncation.
+	MaxPromptLen int
+	// Redactors are applied in order to each record, before the truncation.
+	Redactors []Redactor
+}
+
+var _ Logger = &JSONL{}
+
+// JSONL is a Logger that writes one JSON object per line.
+// It is safe for concurrent use.
+type JSONL struct {
+	mu   sync.Mutex
+	w    io.WriteCloser
+	enc  *json.Encoder
+	opts Options
+}
+
+// NewJSONL returns a new JSONL logger writing to w.
+func NewJSONL(w io.WriteCloser, opts Options) *JSONL {
+	return &JSONL{
+		w:    w,
+		enc:  json.NewEncoder(w),
+		opts: opts,
+	}
+}
+
+// OpenJSONL returns a new JSONL logger appending to the given file, which is created if it doesn't exist.
+func OpenJSONL(filename string, opts Options) (*JSONL, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %q: %w", filename, err)
+	}
+	return NewJSONL(f, opts), nil
+}
+
+// Log satisfies the Logger interface.
+func (l *JSONL) Log(r Record) error {
+	for _, redact := range l.opts.Redactors {
+		redact(&r)
+	}
+	r.Prompt = truncate(r.Prompt, l.opts.MaxPromptLen)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(r); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// Close satisfies the Logger interface.
+func (l *JSONL) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// truncate returns the first maxLen characters of s, followed by an ellipsis if s is longer.
+func truncate(s string, maxLen int) string {
+	if maxLen <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= maxLen {
+		return s
+	}
+	return string(runes[:maxLen]) + "…"
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestJSONL_Log(t *testing.T) {
+	buf := nopCloser{new(bytes.Buffer)}
+	l := NewJSONL(buf, Options{
+		MaxPromptLen: 20,
+		Redactors:    []Redactor{RedactRegexp(regexp.MustCompile(`\S+@\S+`), "[email]")},
+	})
+
+	require.NoError(t, l.Log(Record{RequestID: "1", Prompt: "write to joe@example.com now please", Completion: "ok", RawCompletion: "ok joe@example.com"}))
+	require.NoError(t, l.Log(Record{RequestID: "2", Prompt: "short"}))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var r Record
+	require.NoError(t, json.Unmarshal(lines[0], &r))
+	assert.Equal(t, "1", r.RequestID)
+	assert.Equal(t, "write to [email] now…", r.Prompt)
+	assert.Equal(t, "ok", r.Completion)
+	assert.Equal(t, "ok [email]", r.RawCompletion)
+}
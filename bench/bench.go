@@ -0,0 +1,270 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bench measures the inference performance of a model.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat/rand"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/encoder"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+)
+
+// Config contains the parameters of a benchmark run.
+type Config struct {
+	// PromptTokens is the length of the synthetic prompt of each request.
+	PromptTokens int `json:"prompt_tokens"`
+	// GenTokens is the number of tokens generated by each request.
+	GenTokens int `json:"gen_tokens"`
+	// Concurrency is the number of requests running at the same time.
+	Concurrency int `json:"concurrency"`
+	// Requests is the total number of requests. It defaults to Concurrency.
+	Requests int `json:"requests"`
+	// Seed initializes the generator of the synthetic prompts.
+	Seed uint64 `json:"seed"`
+}
+
+// Report is the outcome of a benchmark run, meant to be serialized as JSON
+// and compared across releases.
+type Report struct {
+	Config    Config `json:"config"`
+	GoVersion string `json:"go_version"`
+	NumCPU    int    `json:"num_cpu"`
+	// WallTime is the total duration of the run, in seconds.
+	WallTime float64 `json:"wall_time_s"`
+	// PromptTokensPerSec is the aggregated prompt-encoding throughput.
+	PromptTokensPerSec float64 `json:"prompt_tokens_per_sec"`
+	// GenTokensPerSec is the aggregated generation throughput.
+	GenTokensPerSec float64 `json:"gen_tokens_per_sec"`
+	// TimeToFirstToken is the time between the start of a request and its first generated token.
+	TimeToFirstToken Percentiles `json:"time_to_first_token"`
+	// TokenLatency is the time between two consecutive generated tokens.
+	TokenLatency Percentiles `json:"token_latency"`
+	// RequestLatency is the duration of the whole request.
+	RequestLatency Percentiles `json:"request_latency"`
+	Memory         Memory      `json:"memory"`
+}
+
+// Percentiles summarizes a distribution of durations, in milliseconds.
+type Percentiles struct {
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P90  float64 `json:"p90_ms"`
+	P99  float64 `json:"p99_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+// Memory reports the memory used by the process at the end of the run, in bytes.
+type Memory struct {
+	HeapAlloc  uint64 `json:"heap_alloc_bytes"`
+	HeapSys    uint64 `json:"heap_sys_bytes"`
+	Sys        uint64 `json:"sys_bytes"`
+	TotalAlloc uint64 `json:"total_alloc_bytes"`
+}
+
+// sample collects the measures of a single request.
+type sample struct {
+	encoding  time.Duration
+	firstTok  time.Duration
+	total     time.Duration
+	tokenLats []time.Duration
+	generated int
+}
+
+// Run benchmarks the model with the given configuration.
+func Run(ctx context.Context, m *rwkvlm.Model, conf Config) (Report, error) {
+	if conf.PromptTokens < 1 || conf.GenTokens < 1 {
+		return Report{}, fmt.Errorf("bench: prompt and generated tokens must be positive")
+	}
+	if conf.Concurrency < 1 {
+		conf.Concurrency = 1
+	}
+	if conf.Requests < 1 {
+		conf.Requests = conf.Concurrency
+	}
+
+	prompt := syntheticPrompt(conf.PromptTokens, m.Config.VocabSize, conf.Seed)
+	opts := decoder.DecodingOptions{
+		MaxLen:     conf.GenTokens,
+		MinLen:     conf.GenTokens,
+		EndTokenID: 0,
+		Temp:       1,
+		TopP:       1,
+	}
+
+	samples := make([]sample, conf.Requests)
+	errs := make([]error, conf.Requests)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for w := 0; w < conf.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				samples[i], errs[i] = runOne(ctx, m, prompt, opts)
+			}
+		}()
+	}
+	for i := 0; i < conf.Requests; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	wall := time.Since(start)
+
+	for _, err := range errs {
+		if err != nil {
+			return Report{}, err
+		}
+	}
+	return newReport(conf, wall, samples), nil
+}
+
+// runOne encodes the prompt and generates the tokens of a single request.
+func runOne(ctx context.Context, m *rwkvlm.Model, prompt []int, opts decoder.DecodingOptions) (sample, error) {
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+
+	var s sample
+	start := time.Now()
+	encoded, err := encoder.New(m).Encode(ctx, prompt)
+	if err != nil {
+		return s, err
+	}
+	s.encoding = time.Since(start)
+
+	d, err := decoder.New(m, opts)
+	if err != nil {
+		return s, err
+	}
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.Decode(ctx, nt, encoded.DecoderInput(m, nt), chGen)
+	}()
+
+	last := start
+	for range chGen {
+		now := time.Now()
+		if s.generated == 0 {
+			s.firstTok = now.Sub(start)
+		} else {
+			s.tokenLats = append(s.tokenLats, now.Sub(last))
+		}
+		last = now
+		s.generated++
+	}
+	s.total = time.Since(start)
+	return s, <-errCh
+}
+
+func newReport(conf Config, wall time.Duration, samples []sample) Report {
+	var encoding time.Duration
+	var generated int
+	var ttft, tokenLats, totals []time.Duration
+	for _, s := range samples {
+		encoding += s.encoding
+		generated += s.generated
+		ttft = append(ttft, s.firstTok)
+		tokenLats = append(tokenLats, s.tokenLats...)
+		totals = append(totals, s.total)
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	r := Report{
+		Config:           conf,
+		GoVersion:        runtime.Version(),
+		NumCPU:           runtime.NumCPU(),
+		WallTime:         wall.Seconds(),
+		GenTokensPerSec:  float64(generated) / wall.Seconds(),
+		TimeToFirstToken: percentiles(ttft),
+		TokenLatency:     percentiles(tokenLats),
+		RequestLatency:   percentiles(totals),
+		Memory: Memory{
+			HeapAlloc:  ms.HeapAlloc,
+			HeapSys:    ms.HeapSys,
+			Sys:        ms.Sys,
+			TotalAlloc: ms.TotalAlloc,
+		},
+	}
+	if encoding > 0 {
+		// the encodings run in parallel: the throughput is scaled by the concurrency
+		avg := encoding.Seconds() / float64(len(samples))
+		r.PromptTokensPerSec = float64(conf.PromptTokens*min(conf.Concurrency, len(samples))) / avg
+	}
+	return r
+}
+
+// percentiles summarizes the given durations.
+func percentiles(ds []time.Duration) Percentiles {
+	if len(ds) == 0 {
+		return Percentiles{}
+	}
+	sorted := make([]float64, len(ds))
+	var sum float64
+	for i, d := range ds {
+		sorted[i] = float64(d) / float64(time.Millisecond)
+		sum += sorted[i]
+	}
+	sort.Float64s(sorted)
+	return Percentiles{
+		Mean: sum / float64(len(sorted)),
+		P50:  percentile(sorted, 0.50),
+		P90:  percentile(sorted, 0.90),
+		P99:  percentile(sorted, 0.99),
+		Max:  sorted[len(sorted)-1],
+	}
+}
+
+// percentile returns the p-th percentile of the sorted values, using the nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// syntheticPrompt returns a reproducible sequence of random token IDs.
+// The ID 0 is avoided since it is conventionally the end token.
+func syntheticPrompt(n, vocabSize int, seed uint64) []int {
+	if seed == 0 {
+		seed = 42
+	}
+	rng := rand.NewLockedRand(seed)
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = 1 + rng.Intn(max(vocabSize-1, 1))
+	}
+	return ids
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
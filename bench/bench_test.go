@@ -0,0 +1,35 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentiles(t *testing.T) {
+	var ds []time.Duration
+	for i := 1; i <= 100; i++ {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	p := percentiles(ds)
+	assert.InDelta(t, 50.5, p.Mean, 1e-9)
+	assert.Equal(t, 50.0, p.P50)
+	assert.Equal(t, 90.0, p.P90)
+	assert.Equal(t, 99.0, p.P99)
+	assert.Equal(t, 100.0, p.Max)
+
+	assert.Equal(t, Percentiles{}, percentiles(nil))
+}
+
+func TestSyntheticPrompt(t *testing.T) {
+	a := syntheticPrompt(64, 10, 7)
+	assert.Equal(t, a, syntheticPrompt(64, 10, 7))
+	for _, id := range a {
+		assert.True(t, id >= 1 && id < 10)
+	}
+}
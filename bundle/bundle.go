@@ -0,0 +1,318 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bundle implements the ".vflow" format, packaging a converted model
+// directory (model file, embeddings repository, tokenizer files and configuration)
+// into a single file.
+//
+// A bundle is made of a header, the content of the files one after the other,
+// a JSON index with the position of each file, and a footer locating the index,
+// so that any file can be read without reading the whole bundle:
+//
+//	"VFLOW\x00\x00\x01" | file 1 | ... | file N | index | index offset (uint64) | index size (uint64) | "VFLOWIDX"
+package bundle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Extension is the conventional extension of the bundle files.
+const Extension = ".vflow"
+
+var (
+	headerMagic = []byte("VFLOW\x00\x00\x01")
+	footerMagic = []byte("VFLOWIDX")
+)
+
+const footerSize = 8 + 8 + 8
+
+// ErrNotBundle is returned when opening a file which is not a bundle.
+var ErrNotBundle = errors.New("bundle: not a .vflow file")
+
+// Entry describes a file of the bundle.
+type Entry struct {
+	// Name is the slash-separated path of the file, relative to the model directory.
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+type index struct {
+	Entries []Entry `json:"entries"`
+}
+
+// Writer writes a bundle.
+type Writer struct {
+	w      io.Writer
+	offset int64
+	index  index
+	names  map[string]bool
+}
+
+// NewWriter writes the bundle header to w, and returns a Writer to add the files.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := w.Write(headerMagic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, offset: int64(len(headerMagic)), names: map[string]bool{}}, nil
+}
+
+// Add adds a file with the given name and content.
+func (w *Writer) Add(name string, r io.Reader) error {
+	if w.names[name] {
+		return fmt.Errorf("bundle: duplicated file %q", name)
+	}
+	n, err := io.Copy(w.w, r)
+	if err != nil {
+		return fmt.Errorf("bundle: error writing %q: %w", name, err)
+	}
+	w.names[name] = true
+	w.index.Entries = append(w.index.Entries, Entry{Name: name, Offset: w.offset, Size: n})
+	w.offset += n
+	return nil
+}
+
+// Close writes the index and the footer. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	data, err := json.Marshal(w.index)
+	if err != nil {
+		return err
+	}
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(w.offset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(data)))
+	copy(footer[16:], footerMagic)
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	_, err = w.w.Write(footer)
+	return err
+}
+
+// excluded reports whether the file of the model directory is left out of the
+// bundle: the source checkpoint, and the leftovers of downloads and conversions.
+func excluded(name string) bool {
+	base := filepath.Base(name)
+	return base == "pytorch_model.pt" || strings.HasSuffix(base, ".part") ||
+		strings.HasSuffix(base, ".compact") || strings.HasSuffix(base, ".old")
+}
+
+// Pack writes the bundle of the converted model in modelDir to dst.
+// The links (e.g. into the model cache) are followed.
+func Pack(modelDir, dst string) error {
+	return PackWithOptions(modelDir, dst, PackOptions{})
+}
+
+// PackOptions contains the options for writing a bundle.
+type PackOptions struct {
+	// Key, when not nil, is the key used to encrypt the bundle with AES-GCM
+	// (16, 24 or 32 bytes, see ParseKey).
+	Key []byte
+}
+
+// PackWithOptions is like Pack, with additional options.
+func PackWithOptions(modelDir, dst string, opts PackOptions) (err error) {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			_ = os.Remove(dst)
+		}
+	}()
+	var out io.Writer = f
+	if opts.Key != nil {
+		ew, err := newEncryptWriter(f, opts.Key)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if e := ew.Close(); e != nil && err == nil {
+				err = e
+			}
+		}()
+		out = ew
+	}
+	w, err := NewWriter(out)
+	if err != nil {
+		return err
+	}
+	if err := addDir(w, modelDir, ""); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// addDir adds the files of dir to the bundle, with names prefixed by prefix.
+func addDir(w *Writer, dir, prefix string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := prefix + e.Name()
+		path := filepath.Join(dir, e.Name())
+		if excluded(name) {
+			continue
+		}
+		info, err := os.Stat(path) // follows the links
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := addDir(w, path, name+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := addFile(w, path, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFile(w *Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.Add(name, f)
+}
+
+// Reader reads the files of a bundle.
+type Reader struct {
+	r       io.ReaderAt
+	closer  io.Closer
+	entries map[string]Entry
+}
+
+// Open opens the bundle file. It fails with ErrEncrypted if the bundle is
+// encrypted: use OpenEncrypted instead.
+func Open(path string) (*Reader, error) {
+	return OpenEncrypted(path, nil)
+}
+
+// NewReader reads the index of the bundle of the given size from r.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < int64(len(headerMagic))+footerSize {
+		return nil, ErrNotBundle
+	}
+	header := make([]byte, len(headerMagic))
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	footer := make([]byte, footerSize)
+	if _, err := r.ReadAt(footer, size-footerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header, headerMagic) || !bytes.Equal(footer[16:], footerMagic) {
+		return nil, ErrNotBundle
+	}
+	offset := int64(binary.LittleEndian.Uint64(footer[0:]))
+	length := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if offset < 0 || length < 0 || offset+length > size-footerSize {
+		return nil, fmt.Errorf("bundle: corrupted footer")
+	}
+	var idx index
+	if err := json.NewDecoder(io.NewSectionReader(r, offset, length)).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("bundle: corrupted index: %w", err)
+	}
+	entries := make(map[string]Entry, len(idx.Entries))
+	for _, e := range idx.Entries {
+		if e.Offset < 0 || e.Size < 0 || e.Offset+e.Size > offset {
+			return nil, fmt.Errorf("bundle: corrupted index entry %q", e.Name)
+		}
+		entries[e.Name] = e
+	}
+	return &Reader{r: r, entries: entries}, nil
+}
+
+// IsBundle reports whether the path is a bundle file, possibly encrypted.
+func IsBundle(path string) bool {
+	r, err := Open(path)
+	if errors.Is(err, ErrEncrypted) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// Entries returns the files of the bundle, sorted by name.
+func (r *Reader) Entries() []Entry {
+	entries := make([]Entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Open returns a reader of the named file, which can be read concurrently with the others.
+func (r *Reader) Open(name string) (*io.SectionReader, error) {
+	e, ok := r.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("bundle: %w: %q", fs.ErrNotExist, name)
+	}
+	return io.NewSectionReader(r.r, e.Offset, e.Size), nil
+}
+
+// Extract writes the files of the bundle for which keep returns true (all of them,
+// if keep is nil) to dir.
+func (r *Reader) Extract(dir string, keep func(name string) bool) error {
+	for _, e := range r.Entries() {
+		if keep != nil && !keep(e.Name) {
+			continue
+		}
+		if err := r.extract(e, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reader) extract(e Entry, dir string) error {
+	path := filepath.Join(dir, filepath.FromSlash(e.Name))
+	if !strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+		return fmt.Errorf("bundle: invalid file name %q", e.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(r.r, e.Offset, e.Size)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close closes the bundle file, if opened with Open.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
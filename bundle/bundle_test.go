@@ -0,0 +1,63 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bundle
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackAndExtract(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"config.json":            `{"d_model": 8}`,
+		"spago_model.bin":        "model",
+		"embeddings/store_/0001": "embeddings",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(src, "pytorch_model.pt"), []byte("excluded"), 0644))
+
+	dst := filepath.Join(t.TempDir(), "model"+Extension)
+	require.NoError(t, Pack(src, dst))
+	assert.True(t, IsBundle(dst))
+	assert.False(t, IsBundle(filepath.Join(src, "config.json")))
+
+	r, err := Open(dst)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Len(t, r.Entries(), len(files))
+
+	// partial read
+	sr, err := r.Open("spago_model.bin")
+	require.NoError(t, err)
+	data, err := io.ReadAll(sr)
+	require.NoError(t, err)
+	assert.Equal(t, "model", string(data))
+	_, err = r.Open("pytorch_model.pt")
+	assert.Error(t, err)
+
+	out := t.TempDir()
+	require.NoError(t, r.Extract(out, func(name string) bool { return name != "spago_model.bin" }))
+	assert.NoFileExists(t, filepath.Join(out, "spago_model.bin"))
+	data, err = os.ReadFile(filepath.Join(out, "embeddings", "store_", "0001"))
+	require.NoError(t, err)
+	assert.Equal(t, "embeddings", string(data))
+}
+
+func TestNewReader_NotBundle(t *testing.T) {
+	data := []byte("definitely not a bundle, but long enough to have a footer")
+	_, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.ErrorIs(t, err, ErrNotBundle)
+}
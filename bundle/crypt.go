@@ -0,0 +1,299 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bundle
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// An encrypted bundle is a bundle encrypted with AES-GCM in chunks, so that it can
+// still be read partially:
+//
+//	"VFLOWENC" | version (1 byte) | chunk size (uint32) | nonce prefix (8 bytes) | chunk 1 | ... | chunk N
+//
+// Each chunk is sealed with the nonce prefix followed by the chunk index, and
+// authenticates the header, the chunk index and whether it is the last chunk,
+// so that reordered or truncated chunks are detected.
+
+// EnvKey is the environment variable holding the key of the encrypted bundles,
+// hex or base64 encoded.
+const EnvKey = "VERBAFLOW_BUNDLE_KEY"
+
+var encMagic = []byte("VFLOWENC")
+
+const (
+	encVersion      = 1
+	encHeaderSize   = 8 + 1 + 4 + 8
+	encChunkSize    = 1 << 20
+	noncePrefixSize = 8
+)
+
+// ErrEncrypted is returned by Open for encrypted bundles, which require OpenEncrypted.
+var ErrEncrypted = errors.New("bundle: the bundle is encrypted, a key is required")
+
+// KeyFunc returns the key of an encrypted bundle: 16, 24 or 32 bytes, for
+// AES-128, AES-192 or AES-256. It allows fetching the key from a key management
+// service when the bundle is opened.
+type KeyFunc func() ([]byte, error)
+
+// ParseKey decodes a hex or base64 encoded key.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, errors.New("bundle: the key must be hex or base64 encoded")
+		}
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("bundle: invalid key size %d, must be 16, 24 or 32 bytes", len(key))
+	}
+}
+
+// KeyFromEnv returns a KeyFunc reading the key from the given environment variable.
+func KeyFromEnv(name string) KeyFunc {
+	return func() ([]byte, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil, fmt.Errorf("bundle: the key is not set (environment variable %s)", name)
+		}
+		return ParseKey(v)
+	}
+}
+
+func encHeader(noncePrefix []byte) []byte {
+	h := make([]byte, 0, encHeaderSize)
+	h = append(h, encMagic...)
+	h = append(h, encVersion)
+	h = binary.BigEndian.AppendUint32(h, encChunkSize)
+	return append(h, noncePrefix...)
+}
+
+func chunkNonce(prefix []byte, index uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, prefix...), index)
+}
+
+func chunkAAD(header []byte, index uint32, last bool) []byte {
+	aad := binary.BigEndian.AppendUint32(append([]byte{}, header...), index)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("bundle: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptWriter encrypts the data written to it, chunk by chunk.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint32
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := encHeader(prefix)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	ew.buf = append(ew.buf, p...)
+	// a full chunk is sealed only when more data follows, since the last chunk is marked
+	for len(ew.buf) > encChunkSize {
+		if err := ew.seal(ew.buf[:encChunkSize], false); err != nil {
+			return 0, err
+		}
+		ew.buf = append(ew.buf[:0], ew.buf[encChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (ew *encryptWriter) seal(chunk []byte, last bool) error {
+	nonce := chunkNonce(ew.header[encHeaderSize-noncePrefixSize:], ew.index)
+	sealed := ew.aead.Seal(nil, nonce, chunk, chunkAAD(ew.header, ew.index, last))
+	ew.index++
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (ew *encryptWriter) Close() error {
+	return ew.seal(ew.buf, true)
+}
+
+// decryptReaderAt decrypts an encrypted bundle, chunk by chunk.
+type decryptReaderAt struct {
+	r         io.ReaderAt
+	aead      cipher.AEAD
+	header    []byte
+	numChunks int64
+	size      int64 // size of the plaintext
+
+	mu         sync.Mutex
+	cacheIndex int64
+	cache      []byte
+}
+
+func newDecryptReaderAt(r io.ReaderAt, size int64, key []byte) (*decryptReaderAt, error) {
+	header := make([]byte, encHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, ErrNotBundle
+	}
+	if !bytes.Equal(header[:len(encMagic)], encMagic) {
+		return nil, ErrNotBundle
+	}
+	if header[len(encMagic)] != encVersion || binary.BigEndian.Uint32(header[len(encMagic)+1:]) != encChunkSize {
+		return nil, errors.New("bundle: unsupported encryption format")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealedChunk := int64(encChunkSize + aead.Overhead())
+	body := size - encHeaderSize
+	numChunks := (body + sealedChunk - 1) / sealedChunk
+	lastSize := body - (numChunks-1)*sealedChunk - int64(aead.Overhead())
+	if numChunks == 0 || lastSize < 0 {
+		return nil, errors.New("bundle: truncated encrypted bundle")
+	}
+	return &decryptReaderAt{
+		r:          r,
+		aead:       aead,
+		header:     header,
+		numChunks:  numChunks,
+		size:       (numChunks-1)*encChunkSize + lastSize,
+		cacheIndex: -1,
+	}, nil
+}
+
+// chunk returns the decrypted chunk with the given index.
+func (d *decryptReaderAt) chunk(index int64) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if index == d.cacheIndex {
+		return d.cache, nil
+	}
+	sealedChunk := int64(encChunkSize + d.aead.Overhead())
+	last := index == d.numChunks-1
+	length := sealedChunk
+	if last {
+		length = d.size - index*encChunkSize + int64(d.aead.Overhead())
+	}
+	sealed := make([]byte, length)
+	if _, err := d.r.ReadAt(sealed, encHeaderSize+index*sealedChunk); err != nil {
+		return nil, err
+	}
+	nonce := chunkNonce(d.header[encHeaderSize-noncePrefixSize:], uint32(index))
+	plain, err := d.aead.Open(nil, nonce, sealed, chunkAAD(d.header, uint32(index), last))
+	if err != nil {
+		return nil, errors.New("bundle: decryption failed (wrong key, or corrupted bundle)")
+	}
+	d.cacheIndex, d.cache = index, plain
+	return plain, nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (d *decryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("bundle: negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= d.size {
+			return n, io.EOF
+		}
+		chunk, err := d.chunk(pos / encChunkSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], chunk[pos%encChunkSize:])
+	}
+	return n, nil
+}
+
+// isEncrypted reports whether r starts with the header of an encrypted bundle.
+func isEncrypted(r io.ReaderAt) bool {
+	magic := make([]byte, len(encMagic))
+	_, err := r.ReadAt(magic, 0)
+	return err == nil && bytes.Equal(magic, encMagic)
+}
+
+// OpenEncrypted opens a bundle encrypted with the key returned by keyFunc.
+// Unencrypted bundles are opened as well, without calling keyFunc.
+func OpenEncrypted(path string, keyFunc KeyFunc) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := openFile(f, keyFunc)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func openFile(f *os.File, keyFunc KeyFunc) (*Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var ra io.ReaderAt = f
+	size := info.Size()
+	if isEncrypted(f) {
+		if keyFunc == nil {
+			return nil, ErrEncrypted
+		}
+		key, err := keyFunc()
+		if err != nil {
+			return nil, err
+		}
+		d, err := newDecryptReaderAt(f, size, key)
+		if err != nil {
+			return nil, err
+		}
+		ra, size = d, d.size
+	}
+	r, err := NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	r.closer = f
+	return r, nil
+}
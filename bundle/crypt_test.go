@@ -0,0 +1,68 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bundle
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackWithOptions_Encrypted(t *testing.T) {
+	// larger than a chunk, to exercise the reads across chunks
+	model := make([]byte, 2*encChunkSize+123)
+	rand.New(rand.NewSource(1)).Read(model)
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "spago_model.bin"), model, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "config.json"), []byte(`{"d_model": 8}`), 0644))
+
+	key, err := ParseKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	require.NoError(t, err)
+	dst := filepath.Join(t.TempDir(), "model"+Extension)
+	require.NoError(t, PackWithOptions(src, dst, PackOptions{Key: key}))
+	assert.True(t, IsBundle(dst))
+
+	raw, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte(`"d_model"`)))
+
+	_, err = Open(dst)
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	r, err := OpenEncrypted(dst, func() ([]byte, error) { return key, nil })
+	require.NoError(t, err)
+	defer r.Close()
+	sr, err := r.Open("spago_model.bin")
+	require.NoError(t, err)
+	data, err := io.ReadAll(sr)
+	require.NoError(t, err)
+	assert.Equal(t, model, data)
+
+	wrongKey := bytes.Repeat([]byte{1}, 32)
+	_, err = OpenEncrypted(dst, func() ([]byte, error) { return wrongKey, nil })
+	assert.Error(t, err)
+
+	truncated := filepath.Join(t.TempDir(), "truncated"+Extension)
+	require.NoError(t, os.WriteFile(truncated, raw[:len(raw)-encChunkSize/2], 0644))
+	_, err = OpenEncrypted(truncated, func() ([]byte, error) { return key, nil })
+	assert.Error(t, err)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("AAECAwQFBgcICQoLDA0ODw==")
+	require.NoError(t, err)
+	assert.Len(t, key, 16)
+
+	_, err = ParseKey("0001")
+	assert.Error(t, err)
+	_, err = ParseKey("not a key")
+	assert.Error(t, err)
+}
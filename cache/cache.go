@@ -0,0 +1,75 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cache provides storage for the results of deterministic generations,
+// so that identical requests can be served without running the model again.
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Cache is the interface implemented by the result cache backends.
+type Cache interface {
+	// Get returns the tokens stored for the given key, if any.
+	Get(ctx context.Context, key string) ([]decoder.GeneratedToken, bool, error)
+	// Set stores the tokens for the given key.
+	Set(ctx context.Context, key string, tokens []decoder.GeneratedToken) error
+}
+
+// IsDeterministic reports whether a generation using the given options always
+// produces the same output for the same prompt, so that its result can be cached.
+// Generations using custom logits processors, stages, samplers or token filters are never cached,
+// since they cannot be part of the key, or can be non-deterministic. Neither are
+// DeadlineAware ones, whose length depends on the time budget of the request.
+func IsDeterministic(opts decoder.DecodingOptions) bool {
+	if len(opts.LogitsProcessors) > 0 || opts.Sampler != "" || opts.AcceptToken != nil || opts.DeadlineAware {
+		return false
+	}
+	for _, name := range opts.Pipeline {
+		if !isBuiltinStage(name) {
+			return false
+		}
+	}
+	return !opts.UseSampling || opts.Seed != 0
+}
+
+func isBuiltinStage(name string) bool {
+	for _, builtin := range decoder.DefaultPipeline {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the cache key of a generation request, built from the hash of the
+// prompt and the normalized decoding options (seed included).
+func Key(prompt string, opts decoder.DecodingOptions) string {
+	opts = normalize(opts)
+	h := sha256.New()
+	h.Write([]byte(prompt))
+	h.Write([]byte{0})
+	// DecodingOptions only contains marshalable fields, the error can be ignored.
+	b, _ := json.Marshal(opts)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalize clears the options that don't affect the generated tokens, so that
+// equivalent requests share the same key.
+func normalize(opts decoder.DecodingOptions) decoder.DecodingOptions {
+	if !opts.UseSampling {
+		opts.Temp, opts.TopK, opts.TopP, opts.Seed = 0, 0, 0, 0
+	}
+	if len(opts.StopSequencesIDs) == 0 {
+		opts.StopSequencesIDs = nil
+	}
+	return opts
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+var _ Cache = &LRU{}
+
+// LRU is an in-memory Cache which evicts the least recently used entries
+// once the maximum number of entries is reached.
+// It is safe for concurrent use.
+type LRU struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key    string
+	tokens []decoder.GeneratedToken
+}
+
+// NewLRU returns a new LRU cache holding at most capacity entries.
+func NewLRU(capacity int) *LRU {
+	return &LRU{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get satisfies the Cache interface.
+func (c *LRU) Get(_ context.Context, key string) ([]decoder.GeneratedToken, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).tokens, true, nil
+}
+
+// Set satisfies the Cache interface.
+func (c *LRU) Set(_ context.Context, key string, tokens []decoder.GeneratedToken) error {
+	if c.capacity <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry).tokens = tokens
+		c.ll.MoveToFront(e)
+		return nil
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, tokens: tokens})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+// Len returns the number of entries in the cache.
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
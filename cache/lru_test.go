@@ -0,0 +1,52 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRU_Eviction(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRU(2)
+
+	require.NoError(t, c.Set(ctx, "a", []decoder.GeneratedToken{{TokenID: 1}}))
+	require.NoError(t, c.Set(ctx, "b", []decoder.GeneratedToken{{TokenID: 2}}))
+
+	// touching "a" makes "b" the least recently used entry
+	_, ok, _ := c.Get(ctx, "a")
+	require.True(t, ok)
+
+	require.NoError(t, c.Set(ctx, "c", []decoder.GeneratedToken{{TokenID: 3}}))
+	assert.Equal(t, 2, c.Len())
+
+	_, ok, _ = c.Get(ctx, "b")
+	assert.False(t, ok)
+
+	tokens, ok, _ := c.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, []decoder.GeneratedToken{{TokenID: 1}}, tokens)
+}
+
+func TestKey(t *testing.T) {
+	greedy := decoder.DecodingOptions{MaxLen: 10}
+	assert.Equal(t, Key("hello", greedy), Key("hello", decoder.DecodingOptions{MaxLen: 10, Temp: 0.5, StopSequencesIDs: [][]int{}}))
+	assert.NotEqual(t, Key("hello", greedy), Key("hello!", greedy))
+
+	sampling := decoder.DecodingOptions{MaxLen: 10, UseSampling: true, Seed: 1}
+	assert.NotEqual(t, Key("hello", sampling), Key("hello", decoder.DecodingOptions{MaxLen: 10, UseSampling: true, Seed: 2}))
+}
+
+func TestIsDeterministic(t *testing.T) {
+	assert.True(t, IsDeterministic(decoder.DecodingOptions{}))
+	assert.False(t, IsDeterministic(decoder.DecodingOptions{UseSampling: true}))
+	assert.True(t, IsDeterministic(decoder.DecodingOptions{UseSampling: true, Seed: 42}))
+	assert.False(t, IsDeterministic(decoder.DecodingOptions{DeadlineAware: true}))
+}
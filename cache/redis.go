@@ -0,0 +1,69 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix is prepended to all the keys written to Redis.
+const redisKeyPrefix = "verbaflow:cache:"
+
+var _ Cache = &Redis{}
+
+// Redis is a Cache backed by a Redis server, which can be shared among
+// multiple server instances.
+type Redis struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedis returns a new Redis cache connected to the given address.
+// Entries expire after ttl; a zero ttl means no expiration.
+func NewRedis(addr string, ttl time.Duration) *Redis {
+	return &Redis{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		ttl:    ttl,
+	}
+}
+
+// Get satisfies the Cache interface.
+func (c *Redis) Get(ctx context.Context, key string) ([]decoder.GeneratedToken, bool, error) {
+	b, err := c.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read cache entry: %w", err)
+	}
+	var tokens []decoder.GeneratedToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, false, fmt.Errorf("failed to decode cache entry: %w", err)
+	}
+	return tokens, true, nil
+}
+
+// Set satisfies the Cache interface.
+func (c *Redis) Set(ctx context.Context, key string, tokens []decoder.GeneratedToken) error {
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+	if err := c.client.Set(ctx, redisKeyPrefix+key, b, c.ttl).Err(); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to the Redis server.
+func (c *Redis) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/prompts"
+	"github.com/nlpodyssey/verbaflow/textproc"
+)
+
+// Message is a message of a conversation (see Chat).
+type Message = prompts.Message
+
+// The roles of the messages.
+const (
+	RoleSystem    = prompts.RoleSystem
+	RoleUser      = prompts.RoleUser
+	RoleAssistant = prompts.RoleAssistant
+	RoleInput     = prompts.RoleInput
+)
+
+// DefaultChatFormat is the name of the prompt format of Chat when
+// VerbaFlow.ChatFormat is nil.
+const DefaultChatFormat = "transcript"
+
+// maxChatStates is the number of conversations whose state is kept by Chat.
+const maxChatStates = 16
+
+// Chat generates the reply of the assistant to the messages of a conversation,
+// rendered with the ChatFormat, calling fn, if not nil, with each chunk of the
+// text of the reply as soon as it is available; it returns the whole reply.
+// The reply ends at the stop sequences of the format, which are left out.
+//
+// The state of the model at the end of the reply is kept, for the most recent
+// conversations: the next turn of a conversation, with the same messages followed
+// by the reply and by the new ones, continues from it, encoding only the new
+// messages instead of the whole conversation.
+//
+// The conversations growing beyond the threshold of the ChatHistory policy, if
+// any, are shortened, e.g. restarting them from a summary of the older messages.
+func (vf *VerbaFlow) Chat(ctx context.Context, messages []Message, opts decoder.DecodingOptions, fn func(text string) error) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	format, err := vf.chatFormat()
+	if err != nil {
+		return "", err
+	}
+	prompt, err := vf.chatPrompt(ctx, format, messages, opts)
+	if err != nil {
+		return "", err
+	}
+	stops := make([]string, 0, len(format.Stops)+len(opts.StopRegexps))
+	for _, s := range format.Stops {
+		stops = append(stops, regexp.QuoteMeta(s))
+	}
+	opts.StopRegexps = append(stops, opts.StopRegexps...)
+	var final *Continuation
+	opts.FinalState = func(input decoder.Input) {
+		// the conversations of the models whose state can't be copied are not kept
+		final, _ = vf.NewContinuation(input)
+	}
+
+	from, encoded := vf.chats.lookup(prompt)
+	chGen := vf.generationChannel(opts)
+	errCh := make(chan error, 1)
+	go func() {
+		// free the computational graph after the generation is finished
+		nt := &ag.NodesTracker{}
+		defer graph.ReleaseNodes(nt)
+		if from != nil {
+			errCh <- vf.GenerateContinuation(ctx, nt, from, prompt[len(encoded):], chGen, opts)
+			return
+		}
+		errCh <- vf.Generate(ctx, nt, prompt, chGen, opts)
+	}()
+
+	var raw, reply strings.Builder
+	trim := textproc.TrimStopSequences(format.Stops...)
+	emit := func(text string) error {
+		reply.WriteString(text)
+		if fn == nil || text == "" {
+			return nil
+		}
+		return fn(text)
+	}
+	for gen := range chGen {
+		if gen.TokenID == opts.EndTokenID && opts.SkipEndTokenID {
+			continue
+		}
+		token, err := vf.TokenByID(gen.TokenID)
+		if err != nil {
+			return "", err
+		}
+		raw.WriteString(token)
+		if err := emit(trim.Process(token)); err != nil {
+			return "", err
+		}
+	}
+	if err := <-errCh; err != nil {
+		return "", err
+	}
+	if err := emit(trim.Flush()); err != nil {
+		return "", err
+	}
+	if final != nil {
+		vf.chats.put(prompt+raw.String(), final)
+	}
+	return reply.String(), nil
+}
+
+// chatFormat returns the ChatFormat, or the DefaultChatFormat.
+func (vf *VerbaFlow) chatFormat() (*prompts.Format, error) {
+	if vf.ChatFormat != nil {
+		return vf.ChatFormat, nil
+	}
+	return prompts.LookupFormat(DefaultChatFormat)
+}
+
+// chatStates are the states of the model at the end of the last replies of Chat,
+// by the text of the conversation up to them.
+type chatStates struct {
+	mu     sync.Mutex
+	states []chatState // from the least recently used
+}
+
+type chatState struct {
+	text string
+	c    *Continuation
+}
+
+// lookup returns the state of the longest conversation which the prompt begins
+// with, and its text, or nil.
+func (cs *chatStates) lookup(prompt string) (*Continuation, string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	found := -1
+	for i, s := range cs.states {
+		if strings.HasPrefix(prompt, s.text) && (found < 0 || len(s.text) > len(cs.states[found].text)) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, ""
+	}
+	s := cs.states[found]
+	cs.states = append(append(cs.states[:found], cs.states[found+1:]...), s)
+	return s.c, s.text
+}
+
+// put keeps the state of the conversation, forgetting the least recently used
+// ones beyond maxChatStates.
+func (cs *chatStates) put(text string, c *Continuation) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for i, s := range cs.states {
+		if s.text == text {
+			cs.states = append(cs.states[:i], cs.states[i+1:]...)
+			break
+		}
+	}
+	cs.states = append(cs.states, chatState{text: text, c: c})
+	if n := len(cs.states) - maxChatStates; n > 0 {
+		cs.states = append(cs.states[:0], cs.states[n:]...)
+	}
+}
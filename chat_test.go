@@ -0,0 +1,83 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/prompts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_Chat(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	// the replies of the test tokenizer don't begin with a space, unlike the ones
+	// following the "Assistant:" of the default format
+	format, err := prompts.LookupFormat("chatml")
+	require.NoError(t, err)
+	vf.ChatFormat = format
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1}
+	messages := []Message{{Role: RoleUser, Content: "hello"}}
+
+	const chatPrompt = "<|im_start|>user\nhello<|im_end|>\n<|im_start|>assistant\n"
+	var chunks string
+	reply, err := vf.Chat(context.Background(), messages, opts, func(text string) error {
+		chunks += text
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, reply, 4)
+	assert.Equal(t, reply, chunks)
+	// the reply is the completion of the rendered conversation
+	var expected string
+	require.NoError(t, vf.GenerateText(context.Background(), chatPrompt, opts, func(text string) error {
+		expected += text
+		return nil
+	}))
+	assert.Equal(t, expected, reply)
+
+	// the next turn continues from the state at the end of the reply
+	messages = append(messages, Message{Role: RoleAssistant, Content: reply}, Message{Role: RoleUser, Content: "more"})
+	next, err := format.Render(messages)
+	require.NoError(t, err)
+	from, encoded := vf.chats.lookup(next)
+	require.NotNil(t, from)
+	assert.Equal(t, chatPrompt+reply, encoded)
+	reply, err = vf.Chat(context.Background(), messages, opts, nil)
+	require.NoError(t, err)
+	assert.Len(t, reply, 4)
+
+	// the stop sequences of the format end the reply, and are left out
+	custom := *format
+	stop := expected[len(expected)-1:]
+	custom.Stops = []string{stop}
+	vf.ChatFormat = &custom
+	reply, err = vf.Chat(context.Background(), []Message{{Role: RoleUser, Content: "hello"}}, opts, nil)
+	require.NoError(t, err)
+	assert.Equal(t, expected[:strings.Index(expected, stop)], reply)
+}
+
+func TestChatStates(t *testing.T) {
+	var cs chatStates
+	for i := 0; i < maxChatStates+1; i++ {
+		cs.put(string(rune('a'+i)), &Continuation{})
+	}
+	// the least recently used state is forgotten
+	c, _ := cs.lookup("a")
+	assert.Nil(t, c)
+	c, text := cs.lookup("bcd")
+	assert.NotNil(t, c)
+	assert.Equal(t, "b", text)
+
+	long := &Continuation{}
+	cs.put("bc", long)
+	c, text = cs.lookup("bcd")
+	assert.Same(t, long, c)
+	assert.Equal(t, "bc", text)
+}
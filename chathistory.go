@@ -0,0 +1,267 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/prompts"
+	"github.com/nlpodyssey/verbaflow/textproc"
+)
+
+// HistoryStrategy is how Chat shortens the conversations beyond the threshold of
+// the HistoryPolicy.
+type HistoryStrategy string
+
+const (
+	// HistorySummarize replaces the older messages with a summary written by the
+	// model, restarting the conversation from the system message and the summary.
+	HistorySummarize HistoryStrategy = "summarize"
+	// HistoryTruncate truncates the older messages, from the oldest (see
+	// prompts.Format.Parts), dropping their content for good.
+	HistoryTruncate HistoryStrategy = "truncate"
+)
+
+// Defaults of the HistoryPolicy.
+const (
+	DefaultKeepMessages       = 2
+	DefaultMaxSummaryTokens   = 256
+	DefaultSummaryInstruction = "Summarize the following conversation in a few sentences, keeping the facts, names and decisions needed to continue it."
+)
+
+// summaryHeading introduces the summary in the system message of the shortened
+// conversations.
+const summaryHeading = "Summary of the conversation so far:"
+
+// HistoryPolicy is how Chat keeps the long conversations within a number of
+// tokens of the prompt.
+type HistoryPolicy struct {
+	// Strategy is how the conversations are shortened (default: HistorySummarize).
+	Strategy HistoryStrategy
+	// MaxTokens is the number of tokens of the prompt of a conversation beyond which
+	// it is shortened. If not positive, the conversations are never shortened.
+	MaxTokens int
+	// KeepMessages is the number of the most recent messages which are never
+	// summarized (default: DefaultKeepMessages).
+	KeepMessages int
+	// Instruction asks the model for the summary of the older messages (default:
+	// DefaultSummaryInstruction).
+	Instruction string
+	// MaxSummaryTokens is the maximum length of the summary (default:
+	// DefaultMaxSummaryTokens).
+	MaxSummaryTokens int
+}
+
+func (p *HistoryPolicy) keepMessages() int {
+	if p.KeepMessages > 0 {
+		return p.KeepMessages
+	}
+	return DefaultKeepMessages
+}
+
+func (p *HistoryPolicy) instruction() string {
+	if p.Instruction != "" {
+		return p.Instruction
+	}
+	return DefaultSummaryInstruction
+}
+
+func (p *HistoryPolicy) maxSummaryTokens() int {
+	if p.MaxSummaryTokens > 0 {
+		return p.MaxSummaryTokens
+	}
+	return DefaultMaxSummaryTokens
+}
+
+// chatPrompt returns the prompt of the conversation, shortened according to the
+// ChatHistory when it exceeds its threshold.
+//
+// The summaries are kept: the next turns of a summarized conversation begin with
+// the same summary, so that Chat continues from their state, until the threshold
+// is exceeded again and the summary is extended with the messages since then.
+func (vf *VerbaFlow) chatPrompt(ctx context.Context, format *prompts.Format, messages []Message, opts decoder.DecodingOptions) (string, error) {
+	prompt, err := format.Render(messages)
+	p := vf.ChatHistory
+	if err != nil || p == nil || p.MaxTokens <= 0 {
+		return prompt, err
+	}
+	if ok, err := vf.fitsHistory(prompt); err != nil || ok {
+		return prompt, err
+	}
+	switch p.Strategy {
+	case HistoryTruncate:
+		parts, err := format.Parts(messages)
+		if err != nil {
+			return "", err
+		}
+		return prompts.Fit(vf.Tokenizer, parts, p.MaxTokens)
+	case HistorySummarize, "":
+	default:
+		return "", fmt.Errorf("verbaflow: unknown history strategy %q", p.Strategy)
+	}
+
+	system := 0
+	if len(messages) > 0 && messages[0].Role == RoleSystem {
+		system = 1
+	}
+	end := len(messages) - p.keepMessages()
+	for end > system && messages[end].Role == RoleInput {
+		// an input stays with its instruction
+		end--
+	}
+	if end <= system {
+		// nothing to summarize
+		return prompt, nil
+	}
+	keys := messageKeys(messages[:end])
+	summary, found := vf.summaries.lookup(keys[system+1:])
+	covered := system
+	if found >= 0 {
+		covered += found + 1
+		prompt, err = format.Render(withSummary(format, messages[:system], summary, messages[covered:]))
+		if ok, err := vf.fitsHistory(prompt); err != nil || ok {
+			return prompt, err
+		}
+		if covered == end {
+			// the recent messages alone exceed the threshold
+			return prompt, nil
+		}
+	}
+	summary, err = vf.summarize(ctx, format, summary, messages[covered:end], opts)
+	if err != nil {
+		return "", fmt.Errorf("verbaflow: failed to summarize the conversation: %w", err)
+	}
+	vf.summaries.put(keys[end], summary)
+	return format.Render(withSummary(format, messages[:system], summary, messages[end:]))
+}
+
+// fitsHistory reports whether the prompt is within the threshold of the ChatHistory.
+func (vf *VerbaFlow) fitsHistory(prompt string) (bool, error) {
+	n, err := vf.CountTokens(prompt)
+	if err != nil {
+		return false, err
+	}
+	return n <= vf.ChatHistory.MaxTokens, nil
+}
+
+// summarize asks the model for the summary of the messages, extending the
+// previous summary, if any. The summary is generated greedily, with the end
+// token of opts.
+func (vf *VerbaFlow) summarize(ctx context.Context, format *prompts.Format, previous string, messages []Message, opts decoder.DecodingOptions) (string, error) {
+	p := vf.ChatHistory
+	var sb strings.Builder
+	sb.WriteString(p.instruction())
+	sb.WriteString("\n\n")
+	if previous != "" {
+		fmt.Fprintf(&sb, "%s %s\n", summaryHeading, previous)
+	}
+	for _, m := range messages {
+		fmt.Fprintf(&sb, "%s: %s\n", strings.ToUpper(m.Role[:1])+m.Role[1:], strings.TrimSpace(m.Content))
+	}
+	prompt, err := format.Render([]Message{{Role: RoleUser, Content: sb.String()}})
+	if err != nil {
+		return "", err
+	}
+	stops := make([]string, len(format.Stops))
+	for i, s := range format.Stops {
+		stops[i] = regexp.QuoteMeta(s)
+	}
+	summaryOpts := decoder.DecodingOptions{
+		MaxLen:         p.maxSummaryTokens(),
+		EndTokenID:     opts.EndTokenID,
+		SkipEndTokenID: true,
+		StopRegexps:    stops,
+	}
+	var summary strings.Builder
+	err = vf.GenerateText(ctx, prompt, summaryOpts, func(text string) error {
+		summary.WriteString(text)
+		return nil
+	}, textproc.TrimStopSequences(format.Stops...))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(summary.String()), nil
+}
+
+// withSummary returns the conversation restarting from the system message, or
+// the default one of the format, followed by the summary.
+func withSummary(format *prompts.Format, system []Message, summary string, messages []Message) []Message {
+	content := format.DefaultSystem
+	if len(system) > 0 {
+		content = system[0].Content
+	}
+	if content = strings.TrimSpace(content); content != "" {
+		content += "\n\n"
+	}
+	content += summaryHeading + " " + summary
+	return append([]Message{{Role: RoleSystem, Content: content}}, messages...)
+}
+
+// messageKeys returns the keys identifying the first k messages, for each k from
+// 0 to len(messages).
+func messageKeys(messages []Message) []string {
+	h := sha256.New()
+	keys := make([]string, 0, len(messages)+1)
+	keys = append(keys, hex.EncodeToString(h.Sum(nil)))
+	for _, m := range messages {
+		h.Write([]byte(m.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Content))
+		h.Write([]byte{0})
+		keys = append(keys, hex.EncodeToString(h.Sum(nil)))
+	}
+	return keys
+}
+
+// chatSummaries are the summaries of the conversations of Chat, by the key of the
+// messages they summarize (see messageKeys).
+type chatSummaries struct {
+	mu      sync.Mutex
+	entries []chatSummary // from the least recently used
+}
+
+type chatSummary struct {
+	key, text string
+}
+
+// lookup returns the summary of the last of the candidate keys which has one,
+// with its index, or -1 if none has.
+func (cs *chatSummaries) lookup(keys []string) (string, int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for i := len(keys) - 1; i >= 0; i-- {
+		for j, e := range cs.entries {
+			if e.key == keys[i] {
+				cs.entries = append(append(cs.entries[:j], cs.entries[j+1:]...), e)
+				return e.text, i
+			}
+		}
+	}
+	return "", -1
+}
+
+// put keeps the summary, forgetting the least recently used ones beyond
+// maxChatStates.
+func (cs *chatSummaries) put(key, text string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for i, e := range cs.entries {
+		if e.key == key {
+			cs.entries = append(cs.entries[:i], cs.entries[i+1:]...)
+			break
+		}
+	}
+	cs.entries = append(cs.entries, chatSummary{key: key, text: text})
+	if n := len(cs.entries) - maxChatStates; n > 0 {
+		cs.entries = append(cs.entries[:0], cs.entries[n:]...)
+	}
+}
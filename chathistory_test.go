@@ -0,0 +1,77 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/prompts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_ChatHistory(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	format, err := prompts.LookupFormat("chatml")
+	require.NoError(t, err)
+	vf.ChatFormat = format
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1}
+	messages := []Message{
+		{Role: RoleSystem, Content: "Be brief."},
+		{Role: RoleUser, Content: strings.Repeat("a long question ", 8)},
+		{Role: RoleAssistant, Content: strings.Repeat("a long answer ", 8)},
+		{Role: RoleUser, Content: "more"},
+	}
+	full, err := format.Render(messages)
+	require.NoError(t, err)
+	n, err := vf.CountTokens(full)
+	require.NoError(t, err)
+
+	// within the threshold, the conversation is unchanged
+	vf.ChatHistory = &HistoryPolicy{MaxTokens: n, KeepMessages: 1, MaxSummaryTokens: 3}
+	prompt, err := vf.chatPrompt(context.Background(), format, messages, opts)
+	require.NoError(t, err)
+	assert.Equal(t, full, prompt)
+
+	// beyond it, the older messages are replaced with their summary
+	vf.ChatHistory.MaxTokens = n - 1
+	prompt, err = vf.chatPrompt(context.Background(), format, messages, opts)
+	require.NoError(t, err)
+	summary, found := vf.summaries.lookup(messageKeys(messages)[1:])
+	require.Equal(t, 2, found, "the messages but the last one are summarized")
+	assert.Len(t, summary, 3)
+	want, err := format.Render([]Message{
+		{Role: RoleSystem, Content: "Be brief.\n\n" + summaryHeading + " " + summary},
+		{Role: RoleUser, Content: "more"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, want, prompt)
+
+	// the next turns begin with the same summary
+	reply, err := vf.Chat(context.Background(), messages, opts, nil)
+	require.NoError(t, err)
+	next := append(messages, Message{Role: RoleAssistant, Content: reply}, Message{Role: RoleUser, Content: "again"})
+	prompt, err = vf.chatPrompt(context.Background(), format, next, opts)
+	require.NoError(t, err)
+	_, encoded := vf.chats.lookup(prompt)
+	assert.Equal(t, want+reply, encoded)
+
+	// the truncation drops the beginning of the older messages
+	vf.ChatHistory = &HistoryPolicy{Strategy: HistoryTruncate, MaxTokens: n - 10}
+	prompt, err = vf.chatPrompt(context.Background(), format, messages, opts)
+	require.NoError(t, err)
+	assert.NotContains(t, prompt, "a long question a long question")
+	assert.True(t, strings.HasSuffix(prompt, "more<|im_end|>\n<|im_start|>assistant\n"))
+	tokens, err := vf.CountTokens(prompt)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, tokens, n-10)
+
+	vf.ChatHistory.Strategy = "unknown"
+	_, err = vf.chatPrompt(context.Background(), format, messages, opts)
+	assert.Error(t, err)
+}
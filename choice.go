@@ -0,0 +1,238 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+)
+
+// ChoiceScore is the score of a choice of Choose.
+type ChoiceScore struct {
+	Text string `json:"text"`
+	// LogProb is the log-probability of the tokens of the choice following the
+	// prompt, without the end token: a choice beginning another one is at least
+	// as likely.
+	LogProb float64 `json:"log_prob"`
+}
+
+// ChoiceResult is the result of VerbaFlow.Choose.
+type ChoiceResult struct {
+	// Choice is the chosen string, and Index its position in the choices.
+	Choice string `json:"choice"`
+	Index  int    `json:"index"`
+	// Scores are the scores of all the choices, in their order.
+	Scores []ChoiceScore `json:"scores"`
+}
+
+// Choose generates one of opts.Choices following the prompt, with the output
+// constrained to them (see decoder.DecodingOptions.Choices), and scores all of
+// them, e.g. to classify the prompt. The prompt is encoded once, for both.
+func (vf *VerbaFlow) Choose(ctx context.Context, prompt string, opts decoder.DecodingOptions) (ChoiceResult, error) {
+	if len(opts.Choices) == 0 {
+		return ChoiceResult{}, fmt.Errorf("verbaflow: no choices")
+	}
+	ctx, _ = genid.Ensure(ctx)
+	model, err := vf.model()
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	if opts, err = vf.applyOptions(prompt, opts); err != nil {
+		return ChoiceResult{}, err
+	}
+	trie, err := vf.choiceTrie(opts.Choices)
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	tokens, err := vf.Tokenizer.Tokenize(prompt)
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	if err := vf.CheckPromptLength(len(tokens)); err != nil {
+		return ChoiceResult{}, err
+	}
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	defer release()
+
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+	input, err := vf.encodePrompt(ctx, nt, tokens, opts)
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	result := ChoiceResult{Scores: make([]ChoiceScore, len(opts.Choices))}
+	for i, c := range opts.Choices {
+		result.Scores[i].Text = c
+	}
+	if err := vf.scoreChoices(ctx, nt, model, trie, input, 0, result.Scores); err != nil {
+		return ChoiceResult{}, err
+	}
+
+	// the decoding modifies the state and the logits
+	state, err := vf.cloneState(input.State)
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	d, err := decoder.New(model, opts)
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	chGen := vf.generationChannel(opts)
+	err = d.Decode(ctx, nt, decoder.Input{Logits: input.Logits.Clone(), State: state, Tokens: input.Tokens}, chGen)
+	if err != nil {
+		return ChoiceResult{}, err
+	}
+	node := trie
+	for gen := range chGen {
+		if gen.TokenID == opts.EndTokenID {
+			break
+		}
+		if node = node.children[gen.TokenID]; node == nil {
+			return ChoiceResult{}, fmt.Errorf("verbaflow: the generation left the choices")
+		}
+	}
+	if node.choice < 0 {
+		return ChoiceResult{}, fmt.Errorf("verbaflow: the generation stopped before completing a choice")
+	}
+	result.Index, result.Choice = node.choice, opts.Choices[node.choice]
+	return result, nil
+}
+
+// scoreChoices adds to the scores the log-probabilities of the choices of the
+// subtree of the node, following the input, whose state is not modified.
+func (vf *VerbaFlow) scoreChoices(ctx context.Context, nt *ag.NodesTracker, model decoder.Model, node *choiceNode, input decoder.Input, logProb float64, scores []ChoiceScore) error {
+	if node.choice >= 0 {
+		scores[node.choice].LogProb = logProb
+	}
+	for token, child := range node.children {
+		childLogProb := logProb + decoder.LogProb(input.Logits, token)
+		if len(child.children) == 0 {
+			// the leaves need no encoding
+			scores[child.choice].LogProb = childLogProb
+			continue
+		}
+		state, err := vf.cloneState(input.State)
+		if err != nil {
+			return err
+		}
+		next := decoder.Input{Tokens: append(input.Tokens[:len(input.Tokens):len(input.Tokens)], token)}
+		if next.Logits, next.State, err = model.EncodeNext(ctx, nt, state, token); err != nil {
+			return err
+		}
+		if err := vf.scoreChoices(ctx, nt, model, child, next, childLogProb, scores); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// choiceNode is a node of the trie of the tokenizations of the choices.
+type choiceNode struct {
+	children map[int]*choiceNode
+	// choice is the index of the choice ending at the node, or -1.
+	choice int
+}
+
+// choiceTrie returns the trie of the tokenizations of the choices, which must
+// be different and not empty.
+func (vf *VerbaFlow) choiceTrie(choices []string) (*choiceNode, error) {
+	root := &choiceNode{choice: -1}
+	for i, c := range choices {
+		tokens, err := vf.Tokenizer.Tokenize(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("verbaflow: empty choice %d", i)
+		}
+		node := root
+		for _, token := range tokens {
+			child, ok := node.children[token]
+			if !ok {
+				child = &choiceNode{choice: -1}
+				if node.children == nil {
+					node.children = make(map[int]*choiceNode)
+				}
+				node.children[token] = child
+			}
+			node = child
+		}
+		if node.choice >= 0 {
+			return nil, fmt.Errorf("verbaflow: duplicated choice %q", c)
+		}
+		node.choice = i
+	}
+	return root, nil
+}
+
+// depth returns the number of tokens of the longest choice.
+func (n *choiceNode) depth() int {
+	d := 0
+	for _, child := range n.children {
+		if cd := child.depth() + 1; cd > d {
+			d = cd
+		}
+	}
+	return d
+}
+
+// withChoices returns the options constraining the generation to the choices,
+// if any: the tokens of the generation must follow the trie of the choices,
+// ending with the end token once one is complete.
+func (vf *VerbaFlow) withChoices(opts decoder.DecodingOptions) (decoder.DecodingOptions, error) {
+	if len(opts.Choices) == 0 {
+		return opts, nil
+	}
+	size, err := vf.vocabSize()
+	if err != nil {
+		return opts, err
+	}
+	if opts.EndTokenID < 0 || opts.EndTokenID >= size {
+		return opts, fmt.Errorf("verbaflow: the choices require a valid end token, got %d", opts.EndTokenID)
+	}
+	trie, err := vf.choiceTrie(opts.Choices)
+	if err != nil {
+		return opts, err
+	}
+	if n := trie.depth() + 1; opts.MaxLen < n {
+		opts.MaxLen = n
+	}
+	// the end token can't be delayed
+	opts.MinLen = 0
+	end := opts.EndTokenID
+	processor := decoder.LogitsProcessorFunc(func(step int, inputIDs []int, logits []float32) []float32 {
+		node := trie
+		for _, id := range inputIDs[len(inputIDs)-step:] {
+			if node = node.children[id]; node == nil {
+				break
+			}
+		}
+		allowed := func(id int) bool {
+			if node == nil {
+				return id == end
+			}
+			_, ok := node.children[id]
+			return ok || id == end && node.choice >= 0
+		}
+		negInf := float32(math.Inf(-1))
+		for id := range logits {
+			if !allowed(id) {
+				logits[id] = negInf
+			}
+		}
+		return logits
+	})
+	opts.LogitsProcessors = append(opts.LogitsProcessors[:len(opts.LogitsProcessors):len(opts.LogitsProcessors)], processor)
+	return opts, nil
+}
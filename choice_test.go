@@ -0,0 +1,46 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_Choose(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	choices := []string{"yes", "no", "yeah"}
+	opts := decoder.DecodingOptions{EndTokenID: 0, Choices: choices}
+
+	result, err := vf.Choose(context.Background(), "Is it?", opts)
+	require.NoError(t, err)
+	assert.Equal(t, choices[result.Index], result.Choice)
+	require.Len(t, result.Scores, len(choices))
+	for i, s := range result.Scores {
+		assert.Equal(t, choices[i], s.Text)
+		assert.Less(t, s.LogProb, 0.0)
+		assert.False(t, math.IsInf(s.LogProb, 0))
+	}
+
+	// the generation follows the tokens of a choice, then ends
+	ids := generateIDs(t, vf, "Is it?", opts)
+	require.NotEmpty(t, ids)
+	assert.Equal(t, 0, ids[len(ids)-1])
+	tokens, err := vf.Tokenizer.Tokenize(result.Choice)
+	require.NoError(t, err)
+	assert.Equal(t, tokens, ids[:len(ids)-1], "the greedy generation makes the same choice")
+
+	_, err = vf.Choose(context.Background(), "Is it?", decoder.DecodingOptions{EndTokenID: 0, Choices: []string{"yes", "yes"}})
+	assert.Error(t, err)
+	_, err = vf.Choose(context.Background(), "Is it?", decoder.DecodingOptions{EndTokenID: -1, Choices: choices})
+	assert.Error(t, err)
+	_, err = vf.Choose(context.Background(), "Is it?", decoder.DecodingOptions{EndTokenID: 0})
+	assert.Error(t, err)
+}
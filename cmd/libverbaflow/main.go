@@ -0,0 +1,137 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command libverbaflow is the C ABI of VerbaFlow, built as a shared library, so
+// that applications written in other languages can embed it in-process:
+//
+//	go build -buildmode=c-shared -o libverbaflow.so ./cmd/libverbaflow
+//
+// The build also writes libverbaflow.h, declaring:
+//
+//	vf_model vf_load(char* model_dir, char** err);
+//	int vf_generate_stream(vf_model model, char* prompt, char* options_json,
+//	                       vf_text_callback callback, void* user_data, char** err);
+//	void vf_free(vf_model model);
+//	void vf_free_string(char* s);
+//
+// The errors are returned as strings to be released with vf_free_string.
+// The log level is read from the VERBAFLOW_LOGLEVEL environment variable (default: info).
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// vf_model is the handle of a loaded model; zero is not a valid handle.
+typedef uintptr_t vf_model;
+
+// vf_text_callback receives each chunk of generated text, as a NUL-terminated
+// UTF-8 string valid only during the call. A non-zero return value stops the
+// generation.
+typedef int (*vf_text_callback)(const char* text, void* user_data);
+
+static int vf_call_text_callback(vf_text_callback cb, const char* text, void* user_data) {
+	return cb(text, user_data);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"runtime/cgo"
+	"unsafe"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// errStopped is returned by the callback when the caller stops the generation.
+var errStopped = errors.New("generation stopped by the caller")
+
+func main() {}
+
+func init() {
+	level, err := zerolog.ParseLevel(os.Getenv("VERBAFLOW_LOGLEVEL"))
+	if err != nil || level == zerolog.NoLevel {
+		level = zerolog.InfoLevel
+	}
+	log.Logger = log.Level(level)
+}
+
+//export vf_load
+func vf_load(modelDir *C.char, errOut **C.char) C.vf_model {
+	vf, err := verbaflow.Load(C.GoString(modelDir))
+	if err != nil {
+		setError(errOut, err)
+		return 0
+	}
+	return C.vf_model(cgo.NewHandle(vf))
+}
+
+//export vf_generate_stream
+func vf_generate_stream(model C.vf_model, prompt, optionsJSON *C.char, callback C.vf_text_callback, userData unsafe.Pointer, errOut **C.char) C.int {
+	if model == 0 {
+		setError(errOut, errors.New("invalid model handle"))
+		return -1
+	}
+	vf := cgo.Handle(model).Value().(*verbaflow.VerbaFlow)
+	err := generate(vf, C.GoString(prompt), C.GoString(optionsJSON), func(text string) bool {
+		cText := C.CString(text)
+		defer C.free(unsafe.Pointer(cText))
+		return C.vf_call_text_callback(callback, cText, userData) == 0
+	})
+	if err != nil {
+		setError(errOut, err)
+		return -1
+	}
+	return 0
+}
+
+//export vf_free
+func vf_free(model C.vf_model) {
+	if model == 0 {
+		return
+	}
+	h := cgo.Handle(model)
+	_ = h.Value().(*verbaflow.VerbaFlow).Close()
+	h.Delete()
+}
+
+//export vf_free_string
+func vf_free_string(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// generate generates the text for the prompt with the decoding options in JSON
+// (see decoder.DecodingOptions), calling fn with each chunk of text until it
+// returns false.
+func generate(vf *verbaflow.VerbaFlow, prompt, optionsJSON string, fn func(text string) bool) error {
+	var opts decoder.DecodingOptions
+	if optionsJSON != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &opts); err != nil {
+			return err
+		}
+	}
+	err := vf.GenerateText(context.Background(), prompt, opts, func(text string) error {
+		if !fn(text) {
+			return errStopped
+		}
+		return nil
+	})
+	if errors.Is(err, errStopped) {
+		return nil
+	}
+	return err
+}
+
+func setError(errOut **C.char, err error) {
+	if errOut != nil {
+		*errOut = C.CString(err.Error())
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	vf, err := verbaflow.Load("../../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+
+	var chunks []string
+	err = generate(vf, "the weather", `{"max_len": 16, "temp": 1, "top_p": 1}`, func(text string) bool {
+		chunks = append(chunks, text)
+		return len(chunks) < 3
+	})
+	require.NoError(t, err)
+	assert.Len(t, chunks, 3, "stopped by the callback")
+
+	assert.Error(t, generate(vf, "the weather", `{"max_len":`, func(string) bool { return true }))
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build js && wasm
+
+// Command verbaflow-wasm exposes VerbaFlow to JavaScript, to run the smaller models
+// in the browser. See verbaflow.js for the wrapper loading it.
+//
+//	GOOS=js GOARCH=wasm go build -o verbaflow.wasm ./cmd/verbaflow-wasm
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"syscall/js"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	log.Logger = log.Level(zerolog.InfoLevel)
+	js.Global().Set("verbaflow", js.ValueOf(map[string]any{
+		"load": js.FuncOf(load),
+	}))
+	// keep the exported functions alive
+	select {}
+}
+
+// load(model: Uint8Array, embeddings: Uint8Array, vocab: string, merges: string)
+// returns a Promise resolving to the loaded model.
+func load(_ js.Value, args []js.Value) any {
+	return newPromise(func() (any, error) {
+		if len(args) != 4 {
+			return nil, errors.New("load expects the model, the embeddings, the vocabulary and the merges")
+		}
+		vf, err := verbaflow.LoadFrom(verbaflow.ModelFiles{
+			Model:      bytes.NewReader(bytesFromJS(args[0])),
+			Embeddings: bytes.NewReader(bytesFromJS(args[1])),
+			Vocab:      strings.NewReader(args[2].String()),
+			Merges:     strings.NewReader(args[3].String()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return modelToJS(vf), nil
+	})
+}
+
+// modelToJS returns the JavaScript object of the loaded model.
+func modelToJS(vf *verbaflow.VerbaFlow) js.Value {
+	return js.ValueOf(map[string]any{
+		// generate(prompt: string, options: object, onText?: (text: string) => void)
+		// returns a Promise resolving to the generated text. The options are those of
+		// decoder.DecodingOptions, with the same JSON names (e.g. max_len, use_sampling).
+		"generate": js.FuncOf(func(_ js.Value, args []js.Value) any {
+			return newPromise(func() (any, error) {
+				if len(args) < 2 {
+					return nil, errors.New("generate expects the prompt and the options")
+				}
+				var opts decoder.DecodingOptions
+				jsonOpts := js.Global().Get("JSON").Call("stringify", args[1]).String()
+				if err := json.Unmarshal([]byte(jsonOpts), &opts); err != nil {
+					return nil, err
+				}
+				var onText js.Value
+				if len(args) > 2 && args[2].Type() == js.TypeFunction {
+					onText = args[2]
+				}
+				var sb strings.Builder
+				err := vf.GenerateText(context.Background(), args[0].String(), opts, func(text string) error {
+					sb.WriteString(text)
+					if !onText.IsUndefined() {
+						onText.Invoke(text)
+					}
+					return nil
+				})
+				return sb.String(), err
+			})
+		}),
+		// countTokens(text: string) returns the number of tokens of the text.
+		"countTokens": js.FuncOf(func(_ js.Value, args []js.Value) any {
+			n, err := vf.CountTokens(args[0].String())
+			if err != nil {
+				return js.Global().Get("Error").New(err.Error())
+			}
+			return n
+		}),
+		"close": js.FuncOf(func(js.Value, []js.Value) any {
+			_ = vf.Close()
+			return nil
+		}),
+	})
+}
+
+// newPromise runs fn in a goroutine, returning a Promise settled with its result,
+// since the Go functions called from JavaScript must not block.
+func newPromise(fn func() (any, error)) js.Value {
+	executor := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			result, err := fn()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
+
+func bytesFromJS(v js.Value) []byte {
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+	return b
+}
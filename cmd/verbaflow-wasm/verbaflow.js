@@ -0,0 +1,55 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Thin wrapper around the VerbaFlow WebAssembly module, built with:
+//
+//   GOOS=js GOARCH=wasm go build -o verbaflow.wasm ./cmd/verbaflow-wasm
+//
+// It requires the wasm_exec.js of the same Go version, to be loaded first
+// (from "$(go env GOROOT)/misc/wasm", or "lib/wasm" since Go 1.24).
+//
+// Usage:
+//
+//   const model = await loadVerbaFlow({
+//     wasm: "verbaflow.wasm",
+//     model: "spago_model.bin",
+//     embeddings: "embeddings.bin", // verbaflow repo export <model_dir>
+//     vocab: "vocab.json",
+//     merges: "merges.txt",
+//   });
+//   const text = await model.generate("Q: What is the capital of Italy?\n\nA:",
+//     { max_len: 32, end_token_id: 0, temp: 1, top_p: 1 },
+//     (chunk) => output.textContent += chunk);
+
+async function fetchBytes(url) {
+  const resp = await fetch(url);
+  if (!resp.ok) {
+    throw new Error(`failed to fetch ${url}: ${resp.status}`);
+  }
+  return new Uint8Array(await resp.arrayBuffer());
+}
+
+async function fetchText(url) {
+  const resp = await fetch(url);
+  if (!resp.ok) {
+    throw new Error(`failed to fetch ${url}: ${resp.status}`);
+  }
+  return resp.text();
+}
+
+// loadVerbaFlow starts the WebAssembly module and loads the model from the given URLs.
+export async function loadVerbaFlow({ wasm = "verbaflow.wasm", model, embeddings, vocab, merges }) {
+  if (globalThis.verbaflow === undefined) {
+    const go = new Go();
+    const { instance } = await WebAssembly.instantiateStreaming(fetch(wasm), go.importObject);
+    go.run(instance);
+  }
+  const [modelBytes, embeddingsBytes, vocabText, mergesText] = await Promise.all([
+    fetchBytes(model),
+    fetchBytes(embeddings),
+    fetchText(vocab),
+    fetchText(merges),
+  ]);
+  return globalThis.verbaflow.load(modelBytes, embeddingsBytes, vocabText, mergesText);
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func convertStateCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "convert-state",
+		Usage:     "Convert a state file to the current format, encoding it again if it was encoded by another model",
+		ArgsUsage: "[model_dir] file.state",
+		Action: func(c *cli.Context) error {
+			modelDir, path := c.String("model-dir"), c.Args().First()
+			switch c.Args().Len() {
+			case 1:
+			case 2:
+				modelDir, path = c.Args().Get(0), c.Args().Get(1)
+			default:
+				return fmt.Errorf("expected the state file, optionally preceded by the model directory")
+			}
+			out := c.String("out")
+			if out == "" {
+				out = path
+			}
+			return convertState(c.Context, modelDir, path, out)
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "out",
+				Aliases: []string{"o"},
+				Usage:   "path of the converted state file (default: the state file, replaced)",
+			},
+		},
+	}
+}
+
+// convertState reads the state file in, of any version, writing it to out in
+// the current format; the states of another model are encoded again from their
+// tokens. out is replaced atomically, so it can be the state file itself.
+func convertState(ctx context.Context, modelDir, in, out string) (err error) {
+	vf, err := loadModel(modelDir)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+	r, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	c, encoded, err := vf.ConvertContinuation(ctx, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if err := vf.WriteContinuation(f, c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), out); err != nil {
+		return err
+	}
+	if encoded {
+		log.Info().Msgf("Encoded the %d tokens of %s again with the model into %s", len(c.Tokens()), in, out)
+	} else {
+		log.Info().Msgf("Converted %s into %s", in, out)
+	}
+	return nil
+}
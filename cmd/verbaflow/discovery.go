@@ -0,0 +1,86 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/discovery"
+	"github.com/nlpodyssey/verbaflow/service"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+// discoveryConfig is the registration of the inference server with a discovery endpoint.
+type discoveryConfig struct {
+	url      string
+	instance discovery.Instance
+	interval time.Duration
+}
+
+// newDiscoveryConfig returns the registration with the discovery endpoint at url
+// from the inference command flags, address being the gRPC listening address.
+func newDiscoveryConfig(c *cli.Context, url, address string) (*discoveryConfig, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	in := discovery.Instance{
+		ID:      c.String("instance-id"),
+		Address: c.String("advertise-address"),
+		Model:   modelName(c.String("model-dir")),
+	}
+	if in.ID == "" {
+		in.ID = hostname
+	}
+	if in.Address == "" {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("cannot derive the advertise address from %q: %w", address, err)
+		}
+		in.Address = net.JoinHostPort(hostname, port)
+	}
+	return &discoveryConfig{url: url, instance: in, interval: c.Duration("discovery-interval")}, nil
+}
+
+// startHealth starts serving the health probes on address, if not empty,
+// setting the readiness of the server configuration.
+func startHealth(ctx context.Context, address string, conf *service.Config) {
+	if address == "" {
+		return
+	}
+	conf.Readiness = &service.Readiness{}
+	go func() {
+		if err := service.ServeHealth(ctx, address, conf.Readiness); err != nil {
+			log.Err(err).Msg("health server failed")
+		}
+	}()
+}
+
+// serveDiscovery serves a discovery endpoint on address until the context is done.
+func serveDiscovery(ctx context.Context, address string, ttl time.Duration) error {
+	srv := &http.Server{
+		Addr:              address,
+		Handler:           discovery.NewRegistry(ttl),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Info().Msgf("Discovery endpoint listening on %s", address)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
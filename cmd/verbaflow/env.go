@@ -0,0 +1,52 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// envPrefix is the prefix of the environment variables setting the flags.
+const envPrefix = "VERBAFLOW_"
+
+// envVar returns the environment variable setting the flag with the given name:
+// envPrefix followed by the name in upper case, with underscores in place of
+// the dashes (e.g. VERBAFLOW_OLLAMA_ADDRESS for -ollama-address).
+func envVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setEnvVars makes the flags settable with the environment variables given by
+// envVar, so that the servers can be configured entirely from the environment,
+// as usual for containers. The flags with explicit environment variables keep them.
+func setEnvVars(flags []cli.Flag) {
+	for _, f := range flags {
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			f.EnvVars = withEnvVar(f.EnvVars, f.Name)
+		case *cli.BoolFlag:
+			f.EnvVars = withEnvVar(f.EnvVars, f.Name)
+		case *cli.IntFlag:
+			f.EnvVars = withEnvVar(f.EnvVars, f.Name)
+		case *cli.Uint64Flag:
+			f.EnvVars = withEnvVar(f.EnvVars, f.Name)
+		case *cli.Float64Flag:
+			f.EnvVars = withEnvVar(f.EnvVars, f.Name)
+		case *cli.DurationFlag:
+			f.EnvVars = withEnvVar(f.EnvVars, f.Name)
+		case *cli.StringSliceFlag:
+			f.EnvVars = withEnvVar(f.EnvVars, f.Name)
+		}
+	}
+}
+
+func withEnvVar(envVars []string, name string) []string {
+	if len(envVars) > 0 {
+		return envVars
+	}
+	return []string{envVar(name)}
+}
@@ -6,17 +6,43 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/nlpodyssey/spago/ag"
 	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/audit"
+	"github.com/nlpodyssey/verbaflow/bench"
+	"github.com/nlpodyssey/verbaflow/bundle"
+	"github.com/nlpodyssey/verbaflow/cache"
+	"github.com/nlpodyssey/verbaflow/discovery"
 	"github.com/nlpodyssey/verbaflow/downloader"
+	"github.com/nlpodyssey/verbaflow/eval"
+	"github.com/nlpodyssey/verbaflow/gptneox"
+	"github.com/nlpodyssey/verbaflow/manifest"
+	"github.com/nlpodyssey/verbaflow/modelcache"
+	"github.com/nlpodyssey/verbaflow/moderation"
+	"github.com/nlpodyssey/verbaflow/plugins"
+	"github.com/nlpodyssey/verbaflow/presets"
+	"github.com/nlpodyssey/verbaflow/prompts"
 	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/script"
 	"github.com/nlpodyssey/verbaflow/service"
+	"github.com/nlpodyssey/verbaflow/sessions"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+	"github.com/nlpodyssey/verbaflow/usage"
+	"github.com/nlpodyssey/verbaflow/watermark"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
@@ -39,31 +65,214 @@ func main() {
 				EnvVars: []string{"VERBAFLOW_LOGLEVEL"},
 			},
 			&cli.StringFlag{
-				Name:     "model-dir",
-				Usage:    "directory of the model to operate on",
-				Required: true,
+				Name:  "model-dir",
+				Usage: "directory of the model to operate on (default: the one set with \"models set-default\")",
+			},
+			&cli.BoolFlag{
+				Name:  "ignore-memory-check",
+				Usage: "load the model even if it is not expected to fit in the available memory",
+				Action: func(c *cli.Context, b bool) error {
+					loadOptions.SkipMemoryCheck = b
+					return nil
+				},
+				EnvVars: []string{"VERBAFLOW_IGNORE_MEMORY_CHECK"},
+			},
+			&cli.StringFlag{
+				Name:  "bundle-key",
+				Usage: "key of the encrypted .vflow bundles, hex or base64 encoded (16, 24 or 32 bytes)",
+				Action: func(c *cli.Context, s string) error {
+					key, err := bundle.ParseKey(s)
+					if err != nil {
+						return err
+					}
+					loadOptions.BundleKey = func() ([]byte, error) { return key, nil }
+					return nil
+				},
+				EnvVars: []string{bundle.EnvKey},
+			},
+			&cli.StringFlag{
+				Name:  "verify-key",
+				Usage: "PEM file of the ed25519 public key that must have signed the manifest of the model to load",
+				Action: func(c *cli.Context, s string) error {
+					key, err := manifest.LoadPublicKey(s)
+					if err != nil {
+						return err
+					}
+					loadOptions.VerifyKey = key
+					return nil
+				},
+				EnvVars: []string{"VERBAFLOW_VERIFY_KEY"},
+			},
+			&cli.IntFlag{
+				Name:  "rescale-layer",
+				Usage: "change the rescaling of the converted model: halve the hidden state every n layers, or never if -1",
+				Action: func(c *cli.Context, n int) error {
+					loadOptions.RescaleLayer = n
+					return nil
+				},
+				EnvVars: []string{"VERBAFLOW_RESCALE_LAYER"},
+			},
+			&cli.BoolFlag{
+				Name:  "shared-weights",
+				Usage: "when the model dir is a snapshot, share its weights read-only with the other processes using it, instead of copying them",
+				Action: func(c *cli.Context, b bool) error {
+					loadOptions.SharedWeights = b
+					return nil
+				},
+				EnvVars: []string{"VERBAFLOW_SHARED_WEIGHTS"},
+			},
+			&cli.StringFlag{
+				Name:    "cache-dir",
+				Usage:   "directory of the cache of model files, shared by the model dirs (default: ~/.cache/verbaflow)",
+				EnvVars: []string{modelcache.EnvDir},
+			},
+			&cli.BoolFlag{
+				Name:  "no-cache",
+				Usage: "store the downloaded and converted files in the model dir only, without using the cache",
 			},
 		},
+		Before: resolveModelDir,
 		Commands: []*cli.Command{
+			modelsCommand(),
+			cacheCommand(),
+			repoCommand(),
+			replayCommand(),
+			convertStateCommand(),
+			snapshotCommand(),
+			routerCommand(),
+			manifestCommand(),
+			{
+				Name:  "bundle",
+				Usage: "Package the converted model into a single .vflow file, which can be used as model dir",
+				Action: func(c *cli.Context) error {
+					output := c.String("output")
+					if output == "" {
+						output = filepath.Base(filepath.Clean(c.String("model-dir"))) + bundle.Extension
+					}
+					var opts bundle.PackOptions
+					if c.Bool("encrypt") {
+						if loadOptions.BundleKey == nil {
+							return fmt.Errorf("the key to encrypt the bundle is required (-bundle-key or %s)", bundle.EnvKey)
+						}
+						key, err := loadOptions.BundleKey()
+						if err != nil {
+							return err
+						}
+						opts.Key = key
+					}
+					return bundle.PackWithOptions(c.String("model-dir"), output, opts)
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "encrypt",
+						Usage: "encrypt the bundle with AES-GCM, using the global -bundle-key",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "path of the bundle (default: the name of the model dir, with the .vflow extension)",
+					},
+				},
+			},
 			{
 				Name:  "download",
 				Usage: "Download model to directory",
 				Action: func(c *cli.Context) error {
-					if err := download(c.String("model-dir")); err != nil {
+					opts, err := downloadOptions(c)
+					if err != nil {
+						return err
+					}
+					if err := download(c.String("model-dir"), opts); err != nil {
 						log.Err(err).Send()
 					}
 					return nil
 				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "revision",
+						Usage: "branch, tag or commit to download (alternatively, append @revision to the model dir)",
+					},
+					&cli.StringFlag{
+						Name:  "proxy",
+						Usage: "URL of the proxy to use (default: from the HTTP_PROXY/HTTPS_PROXY environment variables)",
+					},
+					&cli.StringFlag{
+						Name:  "ca-cert",
+						Usage: "PEM file with additional certificate authorities to trust (e.g. of a corporate proxy)",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure-skip-verify",
+						Usage: "do not verify the TLS certificates (insecure, for testing only)",
+					},
+					&cli.DurationFlag{
+						Name:  "connect-timeout",
+						Usage: "maximum time for establishing a connection",
+						Value: 30 * time.Second,
+					},
+					&cli.DurationFlag{
+						Name:  "response-header-timeout",
+						Usage: "maximum time to wait for the response headers (0 for no timeout)",
+					},
+					&cli.IntFlag{
+						Name:  "parallel",
+						Usage: "number of files downloaded concurrently",
+						Value: 4,
+					},
+					&cli.StringFlag{
+						Name:  "max-bandwidth",
+						Usage: "aggregate download rate limit, in bytes per second, with optional K/M/G suffix (e.g. 10M)",
+					},
+				},
 			},
 			{
 				Name:  "convert",
 				Usage: "Convert model in directory",
 				Action: func(c *cli.Context) error {
-					if err := convert(c.String("model-dir")); err != nil {
+					cache, err := openCache(c)
+					if err != nil {
+						return err
+					}
+					if err := convert(c.String("model-dir"), cache, c.Int("rescale-layer")); err != nil {
+						log.Fatal().Err(err).Send()
+					}
+					if err := writeGenerationConfig(c); err != nil {
+						log.Fatal().Err(err).Send()
+					}
+					if err := writeManifest(c.String("model-dir"), c.String("sign-key")); err != nil {
 						log.Fatal().Err(err).Send()
 					}
 					return nil
 				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "sign-key",
+						Usage: "PEM file of the ed25519 private key to sign the manifest of the model with",
+					},
+					&cli.IntFlag{
+						Name:  "rescale-layer",
+						Usage: "halve the hidden state every n layers, or never if -1 (default: the one of config.json)",
+					},
+					&cli.Float64Flag{
+						Name:  "temperature",
+						Usage: "recommended temperature of the model, written to its generation_config.json",
+					},
+					&cli.Float64Flag{
+						Name:  "top-p",
+						Usage: "recommended top-p of the model, written to its generation_config.json",
+					},
+					&cli.IntFlag{
+						Name:  "top-k",
+						Usage: "recommended top-k of the model, written to its generation_config.json",
+					},
+					&cli.IntFlag{
+						Name:  "max-new-tokens",
+						Usage: "recommended maximum number of generated tokens, written to its generation_config.json",
+					},
+					&cli.StringSliceFlag{
+						Name:  "stop",
+						Usage: "recommended stop string of the model, written to its generation_config.json (repeatable)",
+					},
+				},
 			},
 			{
 				Name:  "inference",
@@ -72,10 +281,32 @@ func main() {
 					modelDir := c.String("model-dir")
 					address := c.String("address")
 
-					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, os.Kill)
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
 					defer stop()
 
-					if err := inference(ctx, modelDir, address); err != nil {
+					if dir := c.String("plugins-dir"); dir != "" {
+						ps, err := loadPlugins(dir)
+						if err != nil {
+							return err
+						}
+						defer plugins.Close(ps)
+					}
+
+					conf, err := serverConfig(c)
+					if err != nil {
+						return err
+					}
+					startHealth(ctx, c.String("health-address"), &conf)
+
+					var disc *discoveryConfig
+					if url := c.String("discovery-url"); url != "" {
+						disc, err = newDiscoveryConfig(c, url, address)
+						if err != nil {
+							return err
+						}
+					}
+
+					if err := inference(ctx, modelDir, address, conf, disc, c.Bool("profile")); err != nil {
 						fmt.Print(err)
 						log.Err(err).Send()
 					}
@@ -84,15 +315,483 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "address",
-						Usage:    "The address to listen on for gRPC connections",
+						Aliases:  []string{"addr"},
+						Usage:    "The address to listen on for gRPC connections, or a Unix domain socket as unix:///path/to/socket",
 						Value:    ":50051",
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:  "socket-mode",
+						Usage: "The permissions, in octal, of the Unix domain sockets the servers listen on",
+						Value: fmt.Sprintf("%#o", service.DefaultSocketMode),
+					},
+					&cli.IntFlag{
+						Name:  "cache-size",
+						Usage: "The maximum number of deterministic generations kept in the in-memory cache (0 disables it)",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "cache-redis-addr",
+						Usage: "The address of a Redis server used as cache backend instead of the in-memory one",
+					},
+					&cli.DurationFlag{
+						Name:  "cache-ttl",
+						Usage: "The expiration time of the entries stored in Redis (0 means no expiration)",
+						Value: 24 * time.Hour,
+					},
+					&cli.DurationFlag{
+						Name:  "idempotency-ttl",
+						Usage: "How long a completed generation is replayed to clients retrying with the same idempotency key (0 disables idempotency keys)",
+						Value: 10 * time.Minute,
+					},
+					&cli.IntFlag{
+						Name:  "quota-daily",
+						Usage: "The maximum number of tokens each API key can consume per day (0 means unlimited)",
+					},
+					&cli.IntFlag{
+						Name:  "quota-monthly",
+						Usage: "The maximum number of tokens each API key can consume per month (0 means unlimited)",
+					},
+					&cli.StringSliceFlag{
+						Name:    "api-key",
+						Usage:   "An API key accepted by the server; when none is set, any key is accepted (and the quotas can be eluded by changing key)",
+						EnvVars: []string{"VERBAFLOW_API_KEYS"},
+					},
+					&cli.StringFlag{
+						Name:    "admin-token",
+						Usage:   "The token required to call the Admin service (the service is disabled if empty)",
+						EnvVars: []string{"VERBAFLOW_ADMIN_TOKEN"},
+					},
+					&cli.StringFlag{
+						Name:  "audit-log",
+						Usage: "The JSONL file where each served request is recorded (disabled if empty)",
+					},
+					&cli.StringFlag{
+						Name:  "transcript-dir",
+						Usage: "The directory of the write-ahead transcripts of the sessions, a JSONL file per API key (disabled if empty)",
+					},
+					&cli.StringFlag{
+						Name:  "session-dir",
+						Usage: "The directory storing the sessions of the API keys, their last state and their transcript, continued after a restart or by the servers sharing it",
+					},
+					&cli.StringFlag{
+						Name:  "session-redis-addr",
+						Usage: "The address of a Redis server storing the sessions of the API keys, instead of a directory",
+					},
+					&cli.DurationFlag{
+						Name:  "session-ttl",
+						Usage: "The expiration time of the sessions stored in Redis since their last write (0 means no expiration)",
+						Value: 24 * time.Hour,
+					},
+					&cli.IntFlag{
+						Name:  "audit-max-prompt-len",
+						Usage: "The maximum number of prompt characters retained in the audit log (0 means no truncation)",
+						Value: 2000,
+					},
+					&cli.StringSliceFlag{
+						Name:  "audit-redact",
+						Usage: "A regular expression whose matches are masked in the audit log (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "moderation-pattern",
+						Usage: "A regular expression that trips the content filter on prompts and completions (can be repeated)",
+					},
+					&cli.StringFlag{
+						Name:  "moderation-action",
+						Usage: "The action taken when the content filter trips (block, redact)",
+						Value: "block",
+					},
+					&cli.StringSliceFlag{
+						Name:  "output-processor",
+						Usage: "A text processor applied to the responses, in order (whitespace, fences, tidy, or a plugin filter)",
+					},
+					&cli.StringFlag{
+						Name:    "plugins-dir",
+						Usage:   "directory of the plugin executables providing custom stages, samplers and filters",
+						EnvVars: []string{"VERBAFLOW_PLUGINS_DIR"},
+					},
+					&cli.StringSliceFlag{
+						Name:  "pipeline",
+						Usage: "A sampler stage applied to all the generations, in order (default: the built-in pipeline)",
+					},
+					&cli.StringFlag{
+						Name:  "sampler",
+						Usage: "custom selection of the next token of all the generations, provided by a plugin",
+					},
+					&cli.StringFlag{
+						Name:  "script-pre-prompt",
+						Usage: "expression transforming the prompt (variable: prompt)",
+					},
+					&cli.StringFlag{
+						Name:  "script-accept-token",
+						Usage: "boolean expression accepting each selected token (variables: token, token_id, step, text)",
+					},
+					&cli.StringFlag{
+						Name:  "script-post-completion",
+						Usage: "expression transforming the whole completion, sent at the end (variables: prompt, completion)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "plugin-param",
+						Usage: "parameters of a custom stage or sampler, as name=<JSON> (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "trim-stop",
+						Usage: "A text after which the response is truncated (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "mask-word",
+						Usage: "A word masked with asterisks in the responses (can be repeated)",
+					},
+					&cli.StringFlag{
+						Name:  "health-address",
+						Usage: "The address serving the /healthz and /readyz probes over HTTP, ready once the model is loaded (disabled if empty)",
+					},
+					&cli.StringFlag{
+						Name:  "discovery-url",
+						Usage: "The URL of the discovery endpoint the server registers with (see the discovery command, disabled if empty)",
+					},
+					&cli.StringFlag{
+						Name:  "advertise-address",
+						Usage: "The gRPC address registered with the discovery endpoint (default: the host name, with the port of -address)",
+					},
+					&cli.StringFlag{
+						Name:  "instance-id",
+						Usage: "The ID registered with the discovery endpoint (default: the host name)",
+					},
+					&cli.DurationFlag{
+						Name:  "discovery-interval",
+						Usage: "How often the registration with the discovery endpoint is renewed",
+						Value: 30 * time.Second,
+					},
+					&cli.StringFlag{
+						Name:  "ollama-address",
+						Usage: "The address serving the Ollama-compatible HTTP API (disabled if empty)",
+					},
+					&cli.StringFlag{
+						Name:  "kobold-address",
+						Usage: "The address serving the KoboldAI-compatible HTTP API (disabled if empty)",
+					},
+					&cli.StringFlag{
+						Name:  "debug-address",
+						Usage: "The address serving the pprof and expvar endpoints over HTTP (disabled if empty, do not expose publicly)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "cors-origin",
+						Usage: "An origin allowed to call the HTTP APIs from a browser, or * for any (none by default)",
+					},
+					&cli.StringFlag{
+						Name:  "max-body-size",
+						Usage: "The maximum size of a request, in bytes, with optional K/M/G suffix",
+						Value: "4M",
+					},
+					&cli.DurationFlag{
+						Name:  "read-timeout",
+						Usage: "The maximum duration of the reading of an HTTP request (negative for no limit)",
+						Value: service.DefaultReadTimeout,
+					},
+					&cli.DurationFlag{
+						Name:  "write-timeout",
+						Usage: "The maximum duration of an HTTP response, including the streamed generations (negative for no limit)",
+						Value: service.DefaultWriteTimeout,
+					},
+					&cli.DurationFlag{
+						Name:  "idle-timeout",
+						Usage: "How long an idle HTTP or gRPC connection is kept open (negative for no limit)",
+						Value: service.DefaultIdleTimeout,
+					},
+					&cli.IntFlag{
+						Name:  "max-concurrent-streams",
+						Usage: "The maximum number of concurrent requests of each HTTP API and of streams of each gRPC connection (negative for no limit)",
+						Value: service.DefaultMaxConcurrentStreams,
+					},
+					&cli.DurationFlag{
+						Name:  "heartbeat-interval",
+						Usage: "How long a streamed response can stay idle before a heartbeat is sent (negative to disable)",
+						Value: service.DefaultHeartbeatInterval,
+					},
+					&cli.StringFlag{
+						Name:  "backpressure",
+						Usage: "What a generation does when its client is too slow: block (wait for the client), drop (drop the tokens the client can't keep up with) or cancel (wait, cancelling the generation after the stall timeout)",
+						Value: service.BackpressureBlock.String(),
+					},
+					&cli.IntFlag{
+						Name:  "stream-buffer-size",
+						Usage: "The number of generated tokens buffered for a slow client before the backpressure policy applies",
+						Value: service.DefaultBufferSize,
+					},
+					&cli.DurationFlag{
+						Name:  "stall-timeout",
+						Usage: "How long a client can stall before its generation is cancelled, with --backpressure cancel",
+						Value: service.DefaultStallTimeout,
+					},
+					&cli.DurationFlag{
+						Name:  "pause-timeout",
+						Usage: "How long a generation paused by its client can stay paused before it is aborted",
+						Value: service.DefaultPauseTimeout,
+					},
+					&cli.DurationFlag{
+						Name:  "continuation-ttl",
+						Usage: "How long the last generation of each API key can be continued with the continue flag (negative to disable)",
+						Value: service.DefaultContinuationTTL,
+					},
+					&cli.BoolFlag{
+						Name:  "half-states",
+						Usage: "Keep the states of the continuations and of the presets in float16, in about 60% of the memory",
+					},
+					&cli.StringFlag{
+						Name:  "chat-format",
+						Usage: "The prompt format of the chat messages of the Ollama API (raven, alpaca, vicuna, chatml or transcript)",
+						Value: "transcript",
+					},
+					&cli.StringFlag{
+						Name:  "presets",
+						Usage: "The JSON file of the presets (system prompt, decoding options and state file) selectable by the requests",
+					},
+					&cli.StringFlag{
+						Name:  "preset",
+						Usage: "The name of the preset of the requests selecting none",
+					},
+					&cli.StringFlag{
+						Name:    "watermark-key",
+						Usage:   "The secret key used to watermark the generations (disabled if empty)",
+						EnvVars: []string{"VERBAFLOW_WATERMARK_KEY"},
+					},
+					&cli.Float64Flag{
+						Name:  "watermark-gamma",
+						Usage: "The fraction of the vocabulary in the green list of the watermark",
+						Value: watermark.DefaultGamma,
+					},
+					&cli.Float64Flag{
+						Name:  "watermark-delta",
+						Usage: "The bias added to the logits of the green tokens of the watermark",
+						Value: watermark.DefaultDelta,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Answer the requests with the rendered prompt, its token IDs and the active stop conditions, without running the model",
+					},
+					&cli.BoolFlag{
+						Name:  "profile",
+						Usage: "Record the time spent per layer and per operation, printing a summary at shutdown (slows down the inference)",
+					},
+				},
+			},
+			{
+				Name:  "worker",
+				Usage: "Consume generation jobs from a NATS subject, publishing the streamed results",
+				Action: func(c *cli.Context) error {
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+
+					conf, err := serverConfig(c)
+					if err != nil {
+						return err
+					}
+					startHealth(ctx, c.String("health-address"), &conf)
+					return worker(ctx, c.String("model-dir"), c.String("nats-url"), conf, service.QueueConfig{
+						Subject:     c.String("subject"),
+						Queue:       c.String("queue"),
+						Concurrency: c.Int("concurrency"),
+					})
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "nats-url",
+						Usage:   "The URL of the NATS server",
+						Value:   nats.DefaultURL,
+						EnvVars: []string{"VERBAFLOW_NATS_URL"},
+					},
+					&cli.StringFlag{
+						Name:  "health-address",
+						Usage: "The address serving the /healthz and /readyz probes over HTTP, ready once the model is loaded (disabled if empty)",
+					},
+					&cli.StringFlag{
+						Name:  "subject",
+						Usage: "The subject of the generation jobs",
+						Value: "verbaflow.generate",
+					},
+					&cli.StringFlag{
+						Name:  "queue",
+						Usage: "The queue group shared by the workers, each job being consumed by a single worker",
+						Value: "verbaflow",
+					},
+					&cli.IntFlag{
+						Name:  "concurrency",
+						Usage: "The maximum number of jobs run at the same time",
+						Value: 1,
+					},
+					&cli.StringFlag{
+						Name:  "presets",
+						Usage: "The JSON file of the presets (system prompt, decoding options and state file) selectable by the requests",
+					},
+					&cli.StringFlag{
+						Name:  "preset",
+						Usage: "The name of the preset of the requests selecting none",
+					},
+				},
+			},
+			{
+				Name:  "discovery",
+				Usage: "Serve a discovery endpoint, where the inference servers register themselves",
+				Action: func(c *cli.Context) error {
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					return serveDiscovery(ctx, c.String("address"), c.Duration("ttl"))
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "address",
+						Usage: "The address to listen on for HTTP connections",
+						Value: ":8500",
+					},
+					&cli.DurationFlag{
+						Name:  "ttl",
+						Usage: "How long a registration lasts, unless renewed",
+						Value: 90 * time.Second,
+					},
+				},
+			},
+			{
+				Name:  "detect-watermark",
+				Usage: "Test a text for the watermark, printing a JSON report",
+				Action: func(c *cli.Context) error {
+					return detectWatermark(c.String("model-dir"), c.String("file"), watermark.Config{
+						Key:       watermark.KeyFromSecret(c.String("key")),
+						Gamma:     c.Float64("gamma"),
+						Threshold: c.Float64("threshold"),
+					})
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "key",
+						Usage:    "The secret key used to watermark the generations",
+						EnvVars:  []string{"VERBAFLOW_WATERMARK_KEY"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "The file containing the text to test (standard input if empty)",
+					},
+					&cli.Float64Flag{
+						Name:  "gamma",
+						Usage: "The fraction of the vocabulary in the green list, as used for the generation",
+						Value: watermark.DefaultGamma,
+					},
+					&cli.Float64Flag{
+						Name:  "threshold",
+						Usage: "The z-score above which the text is considered watermarked",
+						Value: watermark.DefaultThreshold,
+					},
+				},
+			},
+			{
+				Name:      "encode-preset",
+				Usage:     "Encode the system prompts of the presets into their state files, continued by the requests instead of encoding them",
+				ArgsUsage: "[preset...]",
+				Action: func(c *cli.Context) error {
+					return encodePresets(c.Context, c.String("model-dir"), c.String("presets"), c.Args().Slice())
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "presets",
+						Usage:    "The JSON file of the presets (all the ones with a state file are encoded if none is named)",
+						Required: true,
+					},
+				},
+			},
+			{
+				Name:  "bench",
+				Usage: "Benchmark the model, printing a JSON report",
+				Action: func(c *cli.Context) error {
+					return benchmark(c.Context, c.String("model-dir"), bench.Config{
+						PromptTokens: c.Int("prompt-tokens"),
+						GenTokens:    c.Int("gen-tokens"),
+						Concurrency:  c.Int("concurrency"),
+						Requests:     c.Int("requests"),
+						Seed:         c.Uint64("seed"),
+					})
+				},
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "prompt-tokens",
+						Usage: "The number of tokens of the synthetic prompt",
+						Value: 512,
+					},
+					&cli.IntFlag{
+						Name:  "gen-tokens",
+						Usage: "The number of tokens generated by each request",
+						Value: 128,
+					},
+					&cli.IntFlag{
+						Name:  "concurrency",
+						Usage: "The number of requests running at the same time",
+						Value: 1,
+					},
+					&cli.IntFlag{
+						Name:  "requests",
+						Usage: "The total number of requests (defaults to the concurrency)",
+					},
+					&cli.Uint64Flag{
+						Name:  "seed",
+						Usage: "The seed of the synthetic prompt generator",
+						Value: 42,
+					},
+				},
+			},
+			{
+				Name:  "eval",
+				Usage: "Evaluate the model on a text corpus (perplexity) or on a benchmark task, printing a JSON report",
+				Action: func(c *cli.Context) error {
+					if name := c.String("task"); name != "" {
+						return evaluateTask(c.Context, c.String("model-dir"), name, c.String("dataset"), eval.TaskOptions{
+							Limit:         c.Int("limit"),
+							LengthPenalty: c.Float64("length-penalty"),
+						})
+					}
+					return evaluate(c.Context, c.String("model-dir"), c.String("dataset"), eval.PerplexityOptions{
+						WindowSize: c.Int("window"),
+						Stride:     c.Int("stride"),
+					})
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "dataset",
+						Usage:    "The plain text file of the corpus (e.g. wikitext-2.txt), or the JSONL file of the task",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "task",
+						Usage: "The benchmark task (" + strings.Join(eval.TaskNames(), ", ") + ")",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "The maximum number of task examples evaluated (0 means all)",
+					},
+					&cli.Float64Flag{
+						Name:  "length-penalty",
+						Usage: "The exponent of the number of tokens the log-likelihoods of the choices are divided by, reported as acc_len (0 disables it)",
+					},
+					&cli.IntFlag{
+						Name:  "window",
+						Usage: "The maximum number of tokens the model sees at once",
+						Value: 1024,
+					},
+					&cli.IntFlag{
+						Name:  "stride",
+						Usage: "The number of tokens the window is moved by at each step (defaults to half the window)",
+					},
 				},
 			},
 		},
 	}
 
+	setEnvVars(app.Flags)
+	for _, cmd := range app.Commands {
+		switch cmd.Name {
+		case "inference", "worker", "discovery":
+			setEnvVars(cmd.Flags)
+		}
+	}
 	if err := app.Run(os.Args); err != nil {
 		log.Fatal().Err(err).Send()
 	}
@@ -107,13 +806,78 @@ func setDebugLevel(debugLevel string) error {
 	return nil
 }
 
-func download(modelDir string) error {
+// loadOptions are the options used to load the model, set by the global flags.
+var loadOptions verbaflow.LoadOptions
+
+func loadModel(modelDir string) (*verbaflow.VerbaFlow, error) {
+	return verbaflow.LoadWithOptions(modelDir, loadOptions)
+}
+
+// downloadOptions builds the downloader options from the download command flags.
+func downloadOptions(c *cli.Context) (downloader.Options, error) {
+	tlsConfig, err := downloader.TLSConfig(c.String("ca-cert"), c.Bool("insecure-skip-verify"))
+	if err != nil {
+		return downloader.Options{}, err
+	}
+	client, err := downloader.NewHTTPClient(downloader.HTTPOptions{
+		Proxy:                 c.String("proxy"),
+		ConnectTimeout:        c.Duration("connect-timeout"),
+		ResponseHeaderTimeout: c.Duration("response-header-timeout"),
+		TLSConfig:             tlsConfig,
+	})
+	if err != nil {
+		return downloader.Options{}, err
+	}
+	maxBandwidth, err := parseByteSize(c.String("max-bandwidth"))
+	if err != nil {
+		return downloader.Options{}, fmt.Errorf("invalid max bandwidth: %w", err)
+	}
+	cache, err := openCache(c)
+	if err != nil {
+		return downloader.Options{}, err
+	}
+	return downloader.Options{
+		Cache:        cache,
+		HTTPClient:   client,
+		Parallelism:  c.Int("parallel"),
+		MaxBandwidth: maxBandwidth,
+		Revision:     c.String("revision"),
+	}, nil
+}
+
+// parseByteSize parses a size in bytes with an optional binary K, M or G suffix.
+// An empty string is 0.
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a valid size", s)
+	}
+	return n * mult, nil
+}
+
+func download(modelDir string, opts downloader.Options) error {
 	log.Debug().Msgf("Downloading model in dir: %s", modelDir)
 	dir, name, err := splitPathAndModelName(modelDir)
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
-	err = downloader.Download(dir, name, false, "")
+	err = downloader.DownloadWithOptions(dir, name, opts)
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
@@ -121,33 +885,570 @@ func download(modelDir string) error {
 	return nil
 }
 
-func convert(modelDir string) error {
+// openCache opens the cache of model files, unless disabled by the global flags.
+func openCache(c *cli.Context) (*modelcache.Cache, error) {
+	if c.Bool("no-cache") {
+		return nil, nil
+	}
+	dir := c.String("cache-dir")
+	if dir == "" {
+		var err error
+		if dir, err = modelcache.DefaultDir(); err != nil {
+			return nil, err
+		}
+	}
+	return modelcache.Open(dir)
+}
+
+// writeGenerationConfig sets the recommended decoding options of the convert
+// flags in the generation_config.json of the model, keeping the other ones.
+// The file is left as is if no flag is set.
+func writeGenerationConfig(c *cli.Context) error {
+	if !c.IsSet("temperature") && !c.IsSet("top-p") && !c.IsSet("top-k") && !c.IsSet("max-new-tokens") && !c.IsSet("stop") {
+		return nil
+	}
+	modelDir := c.String("model-dir")
+	conf, err := verbaflow.LoadGenerationConfig(modelDir)
+	if err != nil {
+		return err
+	}
+	if conf == nil {
+		conf = &verbaflow.GenerationConfig{}
+	}
+	if c.IsSet("temperature") {
+		v := c.Float64("temperature")
+		conf.Temperature = &v
+	}
+	if c.IsSet("top-p") {
+		v := c.Float64("top-p")
+		conf.TopP = &v
+	}
+	if c.IsSet("top-k") {
+		v := c.Int("top-k")
+		conf.TopK = &v
+	}
+	if c.IsSet("max-new-tokens") {
+		v := c.Int("max-new-tokens")
+		conf.MaxNewTokens = &v
+	}
+	if c.IsSet("stop") {
+		conf.StopStrings = c.StringSlice("stop")
+	}
+	return verbaflow.WriteGenerationConfig(modelDir, conf)
+}
+
+// convertedFiles are the files produced by the conversion, stored in the cache.
+var convertedFiles = []string{rwkvlm.DefaultOutputFilename, rwkvlm.DefaultEmbeddingRepoPath}
+
+// convert converts the model in modelDir, overriding its rescaling if rescaleLayer is not zero.
+func convert(modelDir string, cache *modelcache.Cache, rescaleLayer int) error {
 	log.Debug().Msgf("Converting model in dir: %s", modelDir)
+	if gptneox.IsGPTNeoX(modelDir) {
+		return convertGPTNeoX(modelDir, cache)
+	}
+	var key string
+	if cache != nil {
+		hash, err := cache.Hash(filepath.Join(modelDir, rwkvlm.DefaultPyModelFilename))
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		key = hash + "-float32"
+		if rescaleLayer != 0 {
+			key += fmt.Sprintf("-rescale%d", rescaleLayer)
+		}
+		ok, err := cache.LinkConverted(key, modelDir, convertedFiles...)
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		if ok {
+			log.Debug().Msg("Converted model found in cache.")
+			return nil
+		}
+	}
+
 	err := rwkvlm.ConvertPickledModelToRWKVLM[float32](rwkvlm.ConverterConfig{
 		ModelDir:         modelDir,
 		OverwriteIfExist: false,
+		RescaleLayer:     rescaleLayer,
 	})
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
+	if cache != nil {
+		info := modelcache.ConvertedModel{Key: key, Architecture: "rwkv", DType: "float32"}
+		if conf, err := rwkvlm.LoadConfig(filepath.Join(modelDir, "config.json")); err == nil {
+			info.DModel, info.NumHiddenLayers, info.VocabSize = conf.DModel, conf.NumHiddenLayers, conf.VocabSize
+		}
+		if err := cache.PutConverted(info, modelDir, convertedFiles...); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+	log.Debug().Msg("Done.")
+	return nil
+}
+
+// convertGPTNeoX converts the GPT-NeoX model in modelDir.
+func convertGPTNeoX(modelDir string, cache *modelcache.Cache) error {
+	var key string
+	if cache != nil {
+		hash, err := cache.Hash(filepath.Join(modelDir, gptneox.DefaultPyModelFilename))
+		if err != nil {
+			return err
+		}
+		key = hash + "-gpt_neox-float32"
+		ok, err := cache.LinkConverted(key, modelDir, gptneox.DefaultOutputFilename)
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.Debug().Msg("Converted model found in cache.")
+			return nil
+		}
+	}
+	if err := gptneox.Convert[float32](gptneox.ConverterConfig{ModelDir: modelDir}); err != nil {
+		return err
+	}
+	if cache != nil {
+		info := modelcache.ConvertedModel{Key: key, Architecture: gptneox.ModelType, DType: "float32"}
+		if conf, err := gptneox.LoadConfig(filepath.Join(modelDir, "config.json")); err == nil {
+			info.DModel, info.NumHiddenLayers, info.VocabSize = conf.HiddenSize, conf.NumHiddenLayers, conf.VocabSize
+		}
+		if err := cache.PutConverted(info, modelDir, gptneox.DefaultOutputFilename); err != nil {
+			return err
+		}
+	}
 	log.Debug().Msg("Done.")
 	return nil
 }
 
-func inference(ctx context.Context, modelDir string, address string) error {
+// rwkvModel returns the RWKV model of vf, failing for the other backends, not
+// supported by the given command.
+func rwkvModel(vf *verbaflow.VerbaFlow, command string) (*rwkvlm.Model, error) {
+	if vf.Model == nil {
+		return nil, fmt.Errorf("%w: %s requires an RWKV model", verbaflow.ErrUnsupportedArchitecture, command)
+	}
+	return vf.Model, nil
+}
+
+// serverConfig builds the server configuration from the inference command flags.
+func serverConfig(c *cli.Context) (service.Config, error) {
+	conf := service.Config{
+		IdempotencyTTL: c.Duration("idempotency-ttl"),
+		Quota: usage.Quota{
+			Daily:   c.Int("quota-daily"),
+			Monthly: c.Int("quota-monthly"),
+		},
+		APIKeys:           c.StringSlice("api-key"),
+		AdminToken:        c.String("admin-token"),
+		OllamaAddress:     c.String("ollama-address"),
+		KoboldAddress:     c.String("kobold-address"),
+		ModelName:         modelName(c.String("model-dir")),
+		DebugAddress:      c.String("debug-address"),
+		DryRun:            c.Bool("dry-run"),
+		HeartbeatInterval: c.Duration("heartbeat-interval"),
+	}
+	if mode := c.String("socket-mode"); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return conf, fmt.Errorf("invalid socket mode %q", mode)
+		}
+		conf.SocketMode = os.FileMode(m)
+	}
+	policy, err := service.ParseBackpressurePolicy(c.String("backpressure"))
+	if err != nil {
+		return conf, err
+	}
+	conf.Backpressure = service.BackpressureConfig{
+		Policy:       policy,
+		BufferSize:   c.Int("stream-buffer-size"),
+		StallTimeout: c.Duration("stall-timeout"),
+	}
+	conf.PauseTimeout = c.Duration("pause-timeout")
+	conf.ContinuationTTL = c.Duration("continuation-ttl")
+	conf.HalfStates = c.Bool("half-states")
+	if name := c.String("chat-format"); name != "" {
+		if conf.ChatFormat, err = prompts.LookupFormat(name); err != nil {
+			return conf, err
+		}
+	}
+	if dir := c.String("transcript-dir"); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return conf, fmt.Errorf("failed to create the transcript directory: %w", err)
+		}
+		conf.TranscriptDir = dir
+	}
+	switch {
+	case c.String("session-redis-addr") != "":
+		conf.SessionStore = sessions.NewRedis(c.String("session-redis-addr"), c.Duration("session-ttl"))
+	case c.String("session-dir") != "":
+		dir := c.String("session-dir")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return conf, fmt.Errorf("failed to create the session directory: %w", err)
+		}
+		conf.SessionStore = sessions.NewDir(dir)
+	}
+	if path := c.String("presets"); path != "" {
+		if conf.Presets, err = presets.Load(path); err != nil {
+			return conf, err
+		}
+	}
+	if name := c.String("preset"); name != "" {
+		if _, err := conf.Presets.Lookup(name); err != nil {
+			return conf, err
+		}
+		conf.DefaultPreset = name
+	}
+	maxBodyBytes, err := parseByteSize(c.String("max-body-size"))
+	if err != nil {
+		return conf, fmt.Errorf("invalid max body size: %w", err)
+	}
+	conf.Limits = service.LimitsConfig{
+		CORSOrigins:          c.StringSlice("cors-origin"),
+		MaxBodyBytes:         maxBodyBytes,
+		ReadTimeout:          c.Duration("read-timeout"),
+		WriteTimeout:         c.Duration("write-timeout"),
+		IdleTimeout:          c.Duration("idle-timeout"),
+		MaxConcurrentStreams: c.Int("max-concurrent-streams"),
+	}
+	if filename := c.String("audit-log"); filename != "" {
+		opts := audit.Options{MaxPromptLen: c.Int("audit-max-prompt-len")}
+		for _, expr := range c.StringSlice("audit-redact") {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return conf, fmt.Errorf("invalid audit redaction expression %q: %w", expr, err)
+			}
+			opts.Redactors = append(opts.Redactors, audit.RedactRegexp(re, "[REDACTED]"))
+		}
+		l, err := audit.OpenJSONL(filename, opts)
+		if err != nil {
+			return conf, err
+		}
+		conf.AuditLog = l
+	}
+	if exprs := c.StringSlice("moderation-pattern"); len(exprs) > 0 {
+		action, err := moderation.ParseAction(c.String("moderation-action"))
+		if err != nil {
+			return conf, err
+		}
+		patterns := make([]*regexp.Regexp, len(exprs))
+		for i, expr := range exprs {
+			if patterns[i], err = regexp.Compile(expr); err != nil {
+				return conf, fmt.Errorf("invalid moderation pattern %q: %w", expr, err)
+			}
+		}
+		conf.Moderation = moderation.NewPatterns(patterns, action)
+	}
+	if stops := c.StringSlice("trim-stop"); len(stops) > 0 {
+		conf.TextProcessors = append(conf.TextProcessors, func() textproc.Processor {
+			return textproc.TrimStopSequences(stops...)
+		})
+	}
+	if words := c.StringSlice("mask-word"); len(words) > 0 {
+		conf.TextProcessors = append(conf.TextProcessors, func() textproc.Processor {
+			return textproc.MaskWords(words...)
+		})
+	}
+	for _, name := range c.StringSlice("output-processor") {
+		f, err := textproc.FactoryByName(name)
+		if err != nil {
+			return conf, err
+		}
+		conf.TextProcessors = append(conf.TextProcessors, f)
+	}
+	conf.Pipeline, conf.Sampler = c.StringSlice("pipeline"), c.String("sampler")
+	for _, param := range c.StringSlice("plugin-param") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || !json.Valid([]byte(value)) {
+			return conf, fmt.Errorf("invalid plugin parameter %q, expected name=<JSON>", param)
+		}
+		if conf.Params == nil {
+			conf.Params = make(map[string]json.RawMessage)
+		}
+		conf.Params[name] = json.RawMessage(value)
+	}
+	scripts, err := script.Compile(script.Config{
+		PrePrompt:      c.String("script-pre-prompt"),
+		AcceptToken:    c.String("script-accept-token"),
+		PostCompletion: c.String("script-post-completion"),
+	})
+	if err != nil {
+		return conf, err
+	}
+	conf.Scripts = scripts
+	if key := c.String("watermark-key"); key != "" {
+		wm := watermark.Config{
+			Key:   watermark.KeyFromSecret(key),
+			Gamma: c.Float64("watermark-gamma"),
+			Delta: c.Float64("watermark-delta"),
+		}
+		if err := wm.Validate(); err != nil {
+			return conf, err
+		}
+		conf.Watermark = &wm
+	}
+	switch {
+	case c.String("cache-redis-addr") != "":
+		conf.Cache = cache.NewRedis(c.String("cache-redis-addr"), c.Duration("cache-ttl"))
+	case c.Int("cache-size") < 0:
+		return conf, fmt.Errorf("invalid cache size: %d", c.Int("cache-size"))
+	case c.Int("cache-size") > 0:
+		conf.Cache = cache.NewLRU(c.Int("cache-size"))
+	}
+	return conf, nil
+}
+
+// modelName returns the name of the model reported by the HTTP APIs: the
+// base name of the model directory or bundle, without the bundle extension.
+func modelName(modelDir string) string {
+	return strings.TrimSuffix(filepath.Base(strings.TrimRight(modelDir, "/")), bundle.Extension)
+}
+
+// loadPlugins starts and registers the plugins in dir.
+func loadPlugins(dir string) ([]*plugins.Plugin, error) {
+	ps, err := plugins.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ps {
+		if err := p.Register(); err != nil {
+			plugins.Close(ps)
+			return nil, err
+		}
+		log.Info().Str("plugin", p.Description.Name).Strs("stages", p.Description.Stages).
+			Strs("samplers", p.Description.Samplers).Strs("filters", p.Description.Filters).Msg("Plugin registered")
+	}
+	return ps, nil
+}
+
+func inference(ctx context.Context, modelDir string, address string, conf service.Config, disc *discoveryConfig, profile bool) error {
 	log.Debug().Msgf("Starting inference server for model in dir: %s", modelDir)
 	log.Debug().Msgf("Loading model...")
-	vf, err := verbaflow.Load(modelDir)
+	vf, err := loadModel(modelDir)
 	if err != nil {
 		return err
 	}
 	defer vf.Close()
+	vf.HalfStates = conf.HalfStates
+	if err := conf.Presets.LoadStates(vf); err != nil {
+		return err
+	}
+
+	if profile {
+		log.Warn().Msg("Profiling enabled, the inference is slower.")
+		m, err := rwkvModel(vf, "profiling")
+		if err != nil {
+			return err
+		}
+		p := rwkvlm.NewProfile()
+		m.SetProfile(p)
+		// printed once the server is stopped, after the running generations
+		defer func() {
+			fmt.Println("Time spent per operation:")
+			if err := p.WriteSummary(os.Stdout); err != nil {
+				log.Err(err).Msg("failed to write the profile")
+			}
+		}()
+	}
+
+	if conf.AuditLog != nil {
+		defer conf.AuditLog.Close()
+	}
+
+	if disc != nil {
+		// the registration is removed before returning
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		defer func() {
+			cancel()
+			<-done
+		}()
+		go func() {
+			defer close(done)
+			discovery.Register(ctx, disc.url, disc.instance, disc.interval)
+		}()
+	}
 
 	log.Debug().Msgf("Server listening on %s", address)
-	server := service.NewServer(vf)
+	server := service.NewServer(vf, conf)
 	return server.Start(ctx, address)
 }
 
+// worker consumes the generation jobs from the NATS server until the context is done.
+func worker(ctx context.Context, modelDir, natsURL string, conf service.Config, qconf service.QueueConfig) error {
+	vf, err := loadModel(modelDir)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+	if err := conf.Presets.LoadStates(vf); err != nil {
+		return err
+	}
+	if conf.AuditLog != nil {
+		defer conf.AuditLog.Close()
+	}
+
+	nc, err := nats.Connect(natsURL, nats.Name("verbaflow"), nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	// the results published by the last jobs are flushed before closing
+	defer nc.Drain()
+	return service.NewServer(vf, conf).ServeQueue(ctx, service.NATSConn(nc), qconf)
+}
+
+func benchmark(ctx context.Context, modelDir string, conf bench.Config) error {
+	log.Debug().Msgf("Benchmarking model in dir: %s", modelDir)
+	vf, err := loadModel(modelDir)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+
+	m, err := rwkvModel(vf, "the benchmark")
+	if err != nil {
+		return err
+	}
+	report, err := bench.Run(ctx, m, conf)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func evaluate(ctx context.Context, modelDir, dataset string, opts eval.PerplexityOptions) error {
+	log.Debug().Msgf("Evaluating model in dir: %s", modelDir)
+	text, err := os.ReadFile(dataset)
+	if err != nil {
+		return err
+	}
+	vf, err := loadModel(modelDir)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+
+	tokens, err := vf.Tokenizer.Tokenize(string(text))
+	if err != nil {
+		return err
+	}
+	opts.Progress = func(scored, total int) {
+		log.Info().Msgf("Scored %d/%d tokens", scored, total)
+	}
+	m, err := rwkvModel(vf, "the evaluation")
+	if err != nil {
+		return err
+	}
+	result, err := eval.Perplexity(ctx, m, tokens, opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+func evaluateTask(ctx context.Context, modelDir, name, dataset string, opts eval.TaskOptions) error {
+	task, ok := eval.Tasks[name]
+	if !ok {
+		return fmt.Errorf("unknown task %q", name)
+	}
+	f, err := os.Open(dataset)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	examples, err := task.Load(f)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msgf("Evaluating model in dir: %s", modelDir)
+	vf, err := loadModel(modelDir)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+
+	opts.Progress = func(done, total int) {
+		if done%100 == 0 || done == total {
+			log.Info().Msgf("Evaluated %d/%d examples", done, total)
+		}
+	}
+	m, err := rwkvModel(vf, "the evaluation")
+	if err != nil {
+		return err
+	}
+	result, err := eval.RunTask(ctx, m, vf.Tokenizer, task, examples, opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+func detectWatermark(modelDir, filename string, conf watermark.Config) error {
+	var text []byte
+	var err error
+	if filename == "" {
+		text, err = io.ReadAll(os.Stdin)
+	} else {
+		text, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return err
+	}
+	tk, err := tokenizer.Load(modelDir)
+	if err != nil {
+		return err
+	}
+	tokens, err := tk.Tokenize(string(text))
+	if err != nil {
+		return err
+	}
+	result, err := watermark.Detect(conf, tokens)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// encodePresets writes the state files of the named presets, or of all the ones
+// having one.
+func encodePresets(ctx context.Context, modelDir, path string, names []string) error {
+	ps, err := presets.Load(path)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		for _, name := range ps.Names() {
+			if ps[name].StateFile != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	vf, err := loadModel(modelDir)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+	for _, name := range names {
+		p, err := ps.Lookup(name)
+		if err != nil {
+			return err
+		}
+		if err := p.EncodeState(ctx, vf); err != nil {
+			return err
+		}
+		log.Info().Msgf("Encoded the preset %q into %s", name, p.StateFile)
+	}
+	return nil
+}
+
 // splitPathAndModelName separate the models directory from the model name, which format is "organization/model"
 func splitPathAndModelName(path string) (string, string, error) {
 	dirs := strings.Split(strings.TrimSuffix(path, "/"), "/")
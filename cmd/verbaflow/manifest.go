@@ -0,0 +1,108 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/verbaflow/bundle"
+	"github.com/nlpodyssey/verbaflow/manifest"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func manifestCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "manifest",
+		Usage: "Create, sign and verify the manifest of the model files",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "keygen",
+				Usage: "Generate an ed25519 key pair to sign the manifests with",
+				Action: func(c *cli.Context) error {
+					return manifest.GenerateKey(c.String("private"), c.String("public"))
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "private",
+						Usage: "PEM file to write the private key to",
+						Value: "verbaflow.key",
+					},
+					&cli.StringFlag{
+						Name:  "public",
+						Usage: "PEM file to write the public key to",
+						Value: "verbaflow.pub",
+					},
+				},
+			},
+			{
+				Name:      "create",
+				Usage:     "Write the manifest of the model files, signing it if a key is given",
+				ArgsUsage: "[model_dir]",
+				Action: func(c *cli.Context) error {
+					return writeManifest(repoModelDir(c), c.String("sign-key"))
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "sign-key",
+						Usage: "PEM file of the ed25519 private key to sign the manifest with",
+					},
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Check the signature of the manifest and the hashes of the model files (dir or .vflow bundle)",
+				ArgsUsage: "[model_dir]",
+				Action: func(c *cli.Context) error {
+					key, err := manifest.LoadPublicKey(c.String("key"))
+					if err != nil {
+						return err
+					}
+					if err := verifyManifest(repoModelDir(c), key); err != nil {
+						return err
+					}
+					log.Info().Msg("The manifest signature and the model files are valid.")
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "key",
+						Usage:    "PEM file of the ed25519 public key",
+						Required: true,
+					},
+				},
+			},
+		},
+	}
+}
+
+// writeManifest writes the manifest of the model in modelDir, signing it with the
+// private key in signKeyFile, if not empty.
+func writeManifest(modelDir, signKeyFile string) error {
+	if _, err := manifest.Write(modelDir); err != nil {
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+	if signKeyFile == "" {
+		return nil
+	}
+	key, err := manifest.LoadPrivateKey(signKeyFile)
+	if err != nil {
+		return err
+	}
+	return manifest.Sign(modelDir, key)
+}
+
+// verifyManifest verifies the manifest of a model dir or bundle.
+func verifyManifest(modelDir string, key []byte) error {
+	if !bundle.IsBundle(modelDir) {
+		return manifest.Verify(manifest.Dir(modelDir), key)
+	}
+	b, err := bundle.OpenEncrypted(modelDir, loadOptions.BundleKey)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	return manifest.Verify(manifest.Bundle(b), key)
+}
@@ -0,0 +1,275 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nlpodyssey/verbaflow/internal/diskspace"
+	"github.com/nlpodyssey/verbaflow/modelcache"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/urfave/cli/v2"
+)
+
+// settings are the user settings, persisted across runs.
+type settings struct {
+	// DefaultModelDir is the model dir used when --model-dir is omitted.
+	DefaultModelDir string `json:"default_model_dir,omitempty"`
+}
+
+// settingsPath returns the path of the settings file (e.g. ~/.config/verbaflow/settings.json).
+func settingsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "verbaflow", "settings.json"), nil
+}
+
+func loadSettings() (settings, error) {
+	var s settings
+	path, err := settingsPath()
+	if err != nil {
+		return s, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("invalid settings file %q: %w", path, err)
+	}
+	return s, nil
+}
+
+func saveSettings(s settings) error {
+	path, err := settingsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// resolveModelDir sets the --model-dir flag to the default model dir, if omitted.
+// The flag is required by all the commands but "models" and "cache", and by "repo"
+// when the model dir is given as argument.
+func resolveModelDir(c *cli.Context) error {
+	cmd := c.Args().First()
+	if c.String("model-dir") != "" || cmd == "models" || cmd == "cache" || cmd == "discovery" || cmd == "" {
+		return nil
+	}
+	if (cmd == "repo" || cmd == "snapshot") && c.Args().Len() > 2 {
+		// the model dir is given as argument
+		return nil
+	}
+	s, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	if s.DefaultModelDir == "" {
+		return errors.New(`required flag "model-dir" not set, and no default model set with "models set-default"`)
+	}
+	return c.Set("model-dir", s.DefaultModelDir)
+}
+
+func modelsCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "models",
+		Usage: "Manage the models",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "set-default",
+				Usage:     "Set the model dir used when --model-dir is omitted",
+				ArgsUsage: "<dir>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return errors.New("expected exactly one model dir")
+					}
+					dir, err := filepath.Abs(c.Args().First())
+					if err != nil {
+						return err
+					}
+					if _, err := os.Stat(filepath.Join(dir, rwkvlm.DefaultOutputFilename)); err != nil {
+						return fmt.Errorf("%q does not contain a converted model: %w", dir, err)
+					}
+					s, err := loadSettings()
+					if err != nil {
+						return err
+					}
+					s.DefaultModelDir = dir
+					return saveSettings(s)
+				},
+			},
+			{
+				Name:  "ls",
+				Usage: "List the converted models found in the cache",
+				Action: func(c *cli.Context) error {
+					return listModels(c)
+				},
+			},
+			{
+				Name:      "rm",
+				Usage:     "Remove a model dir, and the cached files not used by other model dirs",
+				ArgsUsage: "<dir or org/model>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return errors.New("expected exactly one model")
+					}
+					return removeModel(c, c.Args().First())
+				},
+			},
+		},
+	}
+}
+
+func cacheCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "Manage the cache of model files",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "prune",
+				Usage: "Remove the cached files not used by any model dir",
+				Action: func(c *cli.Context) error {
+					cache, err := requireCache(c)
+					if err != nil {
+						return err
+					}
+					report, err := cache.Prune(c.Int("keep-last"))
+					printReport(report)
+					return err
+				},
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "keep-last",
+						Usage: "number of unused converted models to keep, the most recently used first",
+					},
+				},
+			},
+		},
+	}
+}
+
+func requireCache(c *cli.Context) (*modelcache.Cache, error) {
+	cache, err := openCache(c)
+	if err == nil && cache == nil {
+		err = errors.New("the cache is disabled")
+	}
+	return cache, err
+}
+
+// removeModel removes the model dir, given as a path or as the name of a model
+// dir known to the cache (e.g. "org/model").
+func removeModel(c *cli.Context, name string) error {
+	cache, err := requireCache(c)
+	if err != nil {
+		return err
+	}
+	dir := name
+	if _, err := os.Stat(dir); err != nil {
+		if dir, err = findModelDir(cache, name); err != nil {
+			return err
+		}
+	}
+	report, err := cache.RemoveModelDir(dir)
+	printReport(report)
+	if err != nil {
+		return err
+	}
+	if s, err := loadSettings(); err == nil && s.DefaultModelDir == report.Removed[0] {
+		s.DefaultModelDir = ""
+		return saveSettings(s)
+	}
+	return nil
+}
+
+// findModelDir returns the model dir known to the cache whose path ends with name.
+func findModelDir(cache *modelcache.Cache, name string) (string, error) {
+	dirs, err := cache.ModelDirs()
+	if err != nil {
+		return "", err
+	}
+	suffix := string(filepath.Separator) + filepath.Clean(name)
+	var found []string
+	for _, dir := range dirs {
+		if strings.HasSuffix(dir, suffix) {
+			found = append(found, dir)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("model %q not found", name)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("model %q is ambiguous, specify one of: %s", name, strings.Join(found, ", "))
+	}
+}
+
+func printReport(r modelcache.Report) {
+	for _, path := range r.Removed {
+		fmt.Println("Removed", path)
+	}
+	fmt.Println("Reclaimed", diskspace.FormatBytes(uint64(r.Reclaimed)))
+}
+
+func listModels(c *cli.Context) error {
+	cache, err := requireCache(c)
+	if err != nil {
+		return err
+	}
+	models, err := cache.ConvertedModels()
+	if err != nil {
+		return err
+	}
+	s, err := loadSettings()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tARCHITECTURE\tDTYPE\tLAYERS\tD_MODEL\tVOCAB\tSIZE\tMODEL DIRS")
+	for _, m := range models {
+		dirs := make([]string, len(m.ModelDirs))
+		for i, dir := range m.ModelDirs {
+			dirs[i] = dir
+			if dir == s.DefaultModelDir {
+				dirs[i] += " (default)"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", shortKey(m.Key), m.Architecture, m.DType,
+			m.NumHiddenLayers, m.DModel, m.VocabSize, diskspace.FormatBytes(uint64(m.Size)), strings.Join(dirs, ", "))
+	}
+	return w.Flush()
+}
+
+// shortKey abbreviates the hash in the key of a converted model, as in "0123456789ab-float32".
+func shortKey(key string) string {
+	hash, suffix, _ := strings.Cut(key, "-")
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	if suffix == "" {
+		return hash
+	}
+	return hash + "-" + suffix
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/nlpodyssey/verbaflow/transcript"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func replayCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "replay",
+		Usage:     "Rebuild the state at the end of the session of a transcript, writing it to a state file",
+		ArgsUsage: "[model_dir] transcript.jsonl",
+		Action: func(c *cli.Context) error {
+			modelDir, path := c.String("model-dir"), c.Args().First()
+			switch c.Args().Len() {
+			case 1:
+			case 2:
+				modelDir, path = c.Args().Get(0), c.Args().Get(1)
+			default:
+				return fmt.Errorf("expected the transcript, optionally preceded by the model directory")
+			}
+			return replay(c.Context, modelDir, path, c.String("out"))
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "out",
+				Aliases: []string{"o"},
+				Usage:   "path of the state file",
+				Value:   "session.state",
+			},
+		},
+	}
+}
+
+// replay re-encodes the session of the transcript with the model, writing the
+// state at its end to out, in the format of the state files of the presets.
+func replay(ctx context.Context, modelDir, path, out string) (err error) {
+	entries, err := transcript.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	vf, err := loadModel(modelDir)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+	c, err := transcript.Replay(ctx, vf, entries)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if err := vf.WriteContinuation(f, c); err != nil {
+		return err
+	}
+	log.Info().Msgf("Replayed %d tokens of %s into %s", len(c.Tokens()), path, out)
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/nlpodyssey/verbaflow/manifest"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func repoCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "repo",
+		Usage: "Maintain the embeddings repository of a converted model",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "verify",
+				Usage:     "Check that every token of the vocabulary has a valid embedding, printing a JSON report",
+				ArgsUsage: "[model_dir]",
+				Action: func(c *cli.Context) error {
+					report, err := rwkvlm.VerifyEmbeddings(repoModelDir(c))
+					if err != nil {
+						return err
+					}
+					if err := printJSON(report); err != nil {
+						return err
+					}
+					if !report.OK() {
+						return errors.New("the embeddings repository is damaged: convert the model again")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "compact",
+				Usage:     "Rebuild the key-value store of the embeddings, printing a JSON report",
+				ArgsUsage: "[model_dir]",
+				Action: func(c *cli.Context) error {
+					modelDir := repoModelDir(c)
+					report, err := rwkvlm.CompactEmbeddings(modelDir)
+					if err != nil {
+						return err
+					}
+					if _, err := os.Stat(filepath.Join(modelDir, manifest.Filename)); err == nil {
+						log.Warn().Msg("The manifest no longer matches the compacted repository: run \"manifest create\" again.")
+					}
+					return printJSON(report)
+				},
+			},
+			{
+				Name:      "export",
+				Usage:     "Write the embeddings to a portable file, to load the model without the repository (e.g. in WebAssembly)",
+				ArgsUsage: "[model_dir]",
+				Action: func(c *cli.Context) error {
+					return rwkvlm.ExportEmbeddings(repoModelDir(c), c.String("output"))
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "path of the embeddings file",
+						Value:   rwkvlm.DefaultEmbeddingsFilename,
+					},
+				},
+			},
+		},
+	}
+}
+
+// repoModelDir returns the model dir given as argument, or --model-dir.
+func repoModelDir(c *cli.Context) string {
+	if c.Args().Len() > 0 {
+		return c.Args().First()
+	}
+	return c.String("model-dir")
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/discovery"
+	"github.com/nlpodyssey/verbaflow/routing"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+)
+
+func routerCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "router",
+		Usage: "Serve a gRPC proxy routing the sessions, by API key, to the same replica, moving their states when the replicas change",
+		Action: func(c *cli.Context) error {
+			ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			replicas, url := c.StringSlice("replica"), c.String("discovery-url")
+			if (len(replicas) == 0) == (url == "") {
+				return fmt.Errorf("either --replica or --discovery-url must be set")
+			}
+			return serveRouter(ctx, c.String("address"), c.String("admin-token"), replicas, url, c.Duration("refresh-interval"))
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "address",
+				Usage: "The address to listen on for gRPC connections",
+				Value: ":50050",
+			},
+			&cli.StringSliceFlag{
+				Name:  "replica",
+				Usage: "The gRPC address of a replica of the inference server",
+			},
+			&cli.StringFlag{
+				Name:  "discovery-url",
+				Usage: "The URL of the discovery endpoint listing the replicas, instead of --replica",
+			},
+			&cli.DurationFlag{
+				Name:  "refresh-interval",
+				Usage: "How often the replicas are listed from the discovery endpoint",
+				Value: 10 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				Usage:   "The admin token of the replicas, to move the sessions between them (not moved if empty)",
+				EnvVars: []string{"VERBAFLOW_ADMIN_TOKEN"},
+			},
+		},
+	}
+}
+
+// serveRouter serves the routing proxy on address until the context is done,
+// listing the replicas from the discovery endpoint at url, if not empty.
+func serveRouter(ctx context.Context, address, adminToken string, replicas []string, url string, refresh time.Duration) error {
+	router := routing.NewRouter(adminToken, grpc.WithInsecure())
+	defer router.Close()
+	router.SetReplicas(ctx, replicas)
+	if url != "" {
+		refreshReplicas(ctx, router, url)
+		go func() {
+			ticker := time.NewTicker(refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					refreshReplicas(ctx, router, url)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s := grpc.NewServer()
+	api.RegisterLanguageModelServer(s, routing.NewProxy(router))
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	log.Info().Msgf("Router listening on %s", address)
+	return s.Serve(lis)
+}
+
+// refreshReplicas sets the replicas of the router to the instances listed by
+// the discovery endpoint. The failures are logged, keeping the replicas.
+func refreshReplicas(ctx context.Context, router *routing.Router, url string) {
+	instances, err := discovery.List(ctx, url)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to list the replicas")
+		return
+	}
+	replicas := make([]string, len(instances))
+	for i, in := range instances {
+		replicas[i] = in.Address
+	}
+	router.SetReplicas(ctx, replicas)
+}
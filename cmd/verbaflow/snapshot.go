@@ -0,0 +1,62 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func snapshotCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "snapshot",
+		Usage:     "Write a snapshot of the loaded model, which can be used as model dir to start in seconds",
+		ArgsUsage: "[model_dir] snapshot.bin",
+		Action: func(c *cli.Context) error {
+			modelDir, path := c.String("model-dir"), c.Args().First()
+			switch c.Args().Len() {
+			case 1:
+			case 2:
+				modelDir, path = c.Args().Get(0), c.Args().Get(1)
+			default:
+				return fmt.Errorf("expected the snapshot file, optionally preceded by the model directory")
+			}
+			return writeSnapshot(modelDir, path)
+		},
+	}
+}
+
+// writeSnapshot writes the snapshot of the model in modelDir to path, replaced
+// atomically.
+func writeSnapshot(modelDir, path string) (err error) {
+	start := time.Now()
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if err := verbaflow.WriteSnapshot(f, modelDir, loadOptions); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	log.Info().Msgf("Wrote the snapshot of %s to %s in %s", modelDir, path, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package constraint
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The expressions of the common formats, to be used alone or composed into larger
+// expressions.
+const (
+	// ISODate matches the ISO-8601 calendar dates, YYYY-MM-DD, with the days of each
+	// month; February always has 29 days, the leap years being left out.
+	ISODate = `[0-9]{4}-(?:(?:0[13578]|1[02])-(?:0[1-9]|[12][0-9]|3[01])|(?:0[469]|11)-(?:0[1-9]|[12][0-9]|30)|02-(?:0[1-9]|[12][0-9]))`
+	// ISOTime matches the ISO-8601 times of the day, hh:mm:ss.
+	ISOTime = `(?:[01][0-9]|2[0-3]):[0-5][0-9]:[0-5][0-9]`
+	// ISODateTime matches the ISO-8601 combined dates and times, with an optional
+	// UTC offset, e.g. 2023-05-17T10:30:00Z.
+	ISODateTime = ISODate + `T` + ISOTime + `(?:Z|[+-](?:[01][0-9]|2[0-3]):[0-5][0-9])?`
+)
+
+// Integer returns the expression of the integers, without leading zeros.
+func Integer() string {
+	return `-?(?:0|[1-9][0-9]*)`
+}
+
+// IntegerRange returns the expression of the integers from min to max, both
+// included, without leading zeros.
+func IntegerRange(min, max int64) (string, error) {
+	if min > max {
+		return "", fmt.Errorf("constraint: invalid integer range [%d, %d]", min, max)
+	}
+	var alts []string
+	if min < 0 {
+		// the absolute values, without overflowing on math.MinInt64
+		lo, hi := uint64(1), uint64(-(min+1))+1
+		if max < 0 {
+			lo = uint64(-(max + 1)) + 1
+		}
+		alts = append(alts, "-"+group(uintRange(lo, hi)))
+	}
+	if max >= 0 {
+		lo := uint64(0)
+		if min > 0 {
+			lo = uint64(min)
+		}
+		alts = append(alts, uintRange(lo, uint64(max)))
+	}
+	return group(strings.Join(alts, "|")), nil
+}
+
+// Decimal returns the expression of the fixed-point decimal numbers with the given
+// number of digits after the decimal point, e.g. -12.50 with 2; with no digits,
+// it is the one of the integers.
+func Decimal(digits int) string {
+	if digits <= 0 {
+		return Integer()
+	}
+	return Integer() + `\.` + repeatDigit(digits)
+}
+
+// uintRange returns the expression of the non-negative integers from lo to hi,
+// as the alternation of the ranges of the numbers of each length.
+func uintRange(lo, hi uint64) string {
+	var alts []string
+	for {
+		s := strconv.FormatUint(lo, 10)
+		// the last number with the length of lo
+		last := hi
+		if n := len(s); n < len(strconv.FormatUint(hi, 10)) {
+			last = pow10(n) - 1
+		}
+		alts = append(alts, fixedRange(s, strconv.FormatUint(last, 10)))
+		if last == hi {
+			break
+		}
+		lo = last + 1
+	}
+	return strings.Join(alts, "|")
+}
+
+// fixedRange returns the expression of the strings of digits from lo to hi, of
+// the same length.
+func fixedRange(lo, hi string) string {
+	if lo == "" {
+		return ""
+	}
+	if lo[0] == hi[0] {
+		return lo[:1] + fixedRange(lo[1:], hi[1:])
+	}
+	n := len(lo) - 1
+	var alts []string
+	first, last := lo[0], hi[0]
+	if strings.Trim(lo[1:], "0") != "" {
+		alts = append(alts, lo[:1]+group(fixedRange(lo[1:], strings.Repeat("9", n))))
+		first++
+	}
+	if strings.Trim(hi[1:], "9") != "" {
+		last--
+	}
+	if first <= last {
+		alts = append(alts, digitRange(first, last)+repeatDigit(n))
+	}
+	if last < hi[0] {
+		alts = append(alts, hi[:1]+group(fixedRange(strings.Repeat("0", n), hi[1:])))
+	}
+	return group(strings.Join(alts, "|"))
+}
+
+func digitRange(first, last byte) string {
+	if first == last {
+		return string(first)
+	}
+	return "[" + string(first) + "-" + string(last) + "]"
+}
+
+func repeatDigit(n int) string {
+	switch n {
+	case 0:
+		return ""
+	case 1:
+		return "[0-9]"
+	default:
+		return "[0-9]{" + strconv.Itoa(n) + "}"
+	}
+}
+
+// group encloses the alternations in a non-capturing group.
+func group(re string) string {
+	if !strings.Contains(re, "|") {
+		return re
+	}
+	return "(?:" + re + ")"
+}
+
+func pow10(n int) uint64 {
+	p := uint64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
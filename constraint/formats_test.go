@@ -0,0 +1,60 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package constraint
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntegerRange(t *testing.T) {
+	ranges := [][2]int64{{0, 0}, {0, 9}, {3, 7}, {1, 100}, {17, 1234}, {-15, 15}, {-250, -99}, {100, 199}, {999, 1000}}
+	for _, r := range ranges {
+		pattern, err := IntegerRange(r[0], r[1])
+		require.NoError(t, err)
+		re := regexp.MustCompile("^" + pattern + "$")
+		for n := r[0] - 30; n <= r[1]+30; n++ {
+			assert.Equal(t, n >= r[0] && n <= r[1], re.MatchString(strconv.FormatInt(n, 10)), "%d in %v (%s)", n, r, pattern)
+		}
+		assert.False(t, re.MatchString("0"+strconv.FormatInt(r[1], 10)), "leading zeros")
+	}
+
+	pattern, err := IntegerRange(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	re := regexp.MustCompile("^" + pattern + "$")
+	assert.True(t, re.MatchString(strconv.FormatInt(math.MinInt64, 10)))
+	assert.True(t, re.MatchString(strconv.FormatInt(math.MaxInt64, 10)))
+	assert.False(t, re.MatchString("9223372036854775808"))
+
+	_, err = IntegerRange(2, 1)
+	assert.Error(t, err)
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   []string
+		invalid []string
+	}{
+		{Decimal(2), []string{"0.50", "-12.05", "100.00"}, []string{"1.5", "01.50", "1.500", "1"}},
+		{Decimal(0), []string{"0", "-7", "42"}, []string{"4.2", "007"}},
+		{ISODate, []string{"2023-01-31", "2024-02-29", "1999-11-30"}, []string{"2023-04-31", "2023-13-01", "2023-02-30", "23-01-01"}},
+		{ISODateTime, []string{"2023-05-17T10:30:00Z", "2023-05-17T23:59:59+02:00", "2023-05-17T00:00:00"}, []string{"2023-05-17T24:00:00", "2023-05-17 10:30:00"}},
+	}
+	for _, tt := range tests {
+		re := MustCompile(tt.pattern)
+		for _, s := range tt.valid {
+			assert.True(t, re.Matches(re.Next(re.Start(), s)), "%s matches %s", s, tt.pattern)
+		}
+		for _, s := range tt.invalid {
+			assert.False(t, re.Matches(re.Next(re.Start(), s)), "%s doesn't match %s", s, tt.pattern)
+		}
+	}
+}
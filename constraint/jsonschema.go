@@ -0,0 +1,259 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package constraint
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Schema is the JSON schema of the values of a Go type (see SchemaOf).
+type Schema struct {
+	Type string `json:"type"`
+	// Format is "date-time" for time.Time.
+	Format string `json:"format,omitempty"`
+	// Properties are the fields of the structs, all Required, in their order.
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Minimum              *int64             `json:"minimum,omitempty"`
+	Maximum              *int64             `json:"maximum,omitempty"`
+}
+
+// String returns the schema in JSON.
+func (s *Schema) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// SchemaOf returns the JSON schema of the type of v, following the rules of
+// encoding/json: the fields of the structs are named after their json tag, the
+// unexported ones and the ones tagged "-" are left out, and the embedded structs
+// are flattened. All the fields are required, even the ones tagged "omitempty".
+//
+// The interfaces, the channels, the functions, the recursive types and the types
+// with their own JSON encoding, but time.Time and the encoding.TextMarshaler
+// implementations (encoded as strings), are not supported.
+func SchemaOf(v any) (*Schema, error) {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return nil, fmt.Errorf("constraint: no schema for nil")
+	}
+	return schemaOf(t, make(map[reflect.Type]bool))
+}
+
+func schemaOf(t reflect.Type, visiting map[reflect.Type]bool) (*Schema, error) {
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}, nil
+	}
+	if t.Kind() != reflect.Pointer && t.Implements(jsonMarshalerType) {
+		return nil, fmt.Errorf("constraint: unsupported type %s, with its own JSON encoding", t)
+	}
+	if t.Kind() != reflect.Pointer && (t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType)) {
+		return &Schema{Type: "string"}, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		min, max := intBounds(t)
+		return &Schema{Type: "integer", Minimum: &min, Maximum: &max}, nil
+	case reflect.Int, reflect.Int64:
+		return &Schema{Type: "integer"}, nil
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		min := int64(0)
+		return &Schema{Type: "integer", Minimum: &min}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}, nil
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Pointer:
+		s, err := schemaOf(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		nullable := *s
+		nullable.Nullable = true
+		return &nullable, nil
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// encoded in base64
+			return &Schema{Type: "string"}, nil
+		}
+		items, err := schemaOf(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("constraint: unsupported map key type %s", t.Key())
+		}
+		values, err := schemaOf(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		if visiting[t] {
+			return nil, fmt.Errorf("constraint: unsupported recursive type %s", t)
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		if err := addFields(s, t, visiting); err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("constraint: unsupported type %s", t)
+	}
+}
+
+// addFields adds the fields of the struct type to the properties of s.
+func addFields(s *Schema, t reflect.Type, visiting map[reflect.Type]bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := addFields(s, ft, visiting); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if _, ok := s.Properties[name]; ok {
+			return fmt.Errorf("constraint: duplicated field %q of %s", name, t)
+		}
+		fs, err := schemaOf(f.Type, visiting)
+		if err != nil {
+			return fmt.Errorf("%w (field %s of %s)", err, f.Name, t)
+		}
+		s.Properties[name] = fs
+		s.Required = append(s.Required, name)
+	}
+	return nil
+}
+
+func intBounds(t reflect.Type) (int64, int64) {
+	switch t.Kind() {
+	case reflect.Int8:
+		return math.MinInt8, math.MaxInt8
+	case reflect.Int16:
+		return math.MinInt16, math.MaxInt16
+	case reflect.Int32:
+		return math.MinInt32, math.MaxInt32
+	case reflect.Uint8:
+		return 0, math.MaxUint8
+	case reflect.Uint16:
+		return 0, math.MaxUint16
+	default:
+		return 0, math.MaxUint32
+	}
+}
+
+// The expressions of the JSON values.
+const (
+	jsonString = `"(?:[^"\\\x00-\x1f]|\\["\\/bfnrt]|\\u[0-9a-fA-F]{4})*"`
+	jsonNumber = `-?(?:0|[1-9][0-9]*)(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?`
+	rfc3339    = `"` + ISODate + `T` + ISOTime + `(?:\.[0-9]+)?(?:Z|[+-](?:[01][0-9]|2[0-3]):[0-5][0-9])"`
+)
+
+// Regexp returns the expression of the compact JSON encodings of the values of
+// the schema, without whitespace and with the properties in order.
+func (s *Schema) Regexp() (string, error) {
+	var re string
+	switch s.Type {
+	case "boolean":
+		re = `(?:true|false)`
+	case "integer":
+		switch {
+		case s.Minimum != nil && s.Maximum != nil:
+			var err error
+			if re, err = IntegerRange(*s.Minimum, *s.Maximum); err != nil {
+				return "", err
+			}
+		case s.Minimum != nil && *s.Minimum == 0:
+			re = `(?:0|[1-9][0-9]*)`
+		default:
+			re = Integer()
+		}
+	case "number":
+		re = jsonNumber
+	case "string":
+		re = jsonString
+		if s.Format == "date-time" {
+			re = rfc3339
+		}
+	case "array":
+		items, err := s.Items.Regexp()
+		if err != nil {
+			return "", err
+		}
+		re = `\[(?:` + items + `(?:,` + items + `)*)?\]`
+	case "object":
+		if s.AdditionalProperties != nil {
+			values, err := s.AdditionalProperties.Regexp()
+			if err != nil {
+				return "", err
+			}
+			pair := jsonString + `:` + values
+			re = `\{(?:` + pair + `(?:,` + pair + `)*)?\}`
+			break
+		}
+		var sb strings.Builder
+		sb.WriteString(`\{`)
+		for i, name := range s.Required {
+			value, err := s.Properties[name].Regexp()
+			if err != nil {
+				return "", err
+			}
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			key, _ := json.Marshal(name)
+			sb.WriteString(regexp.QuoteMeta(string(key)))
+			sb.WriteString(":")
+			sb.WriteString(value)
+		}
+		sb.WriteString(`\}`)
+		re = sb.String()
+	default:
+		return "", fmt.Errorf("constraint: unsupported schema type %q", s.Type)
+	}
+	if s.Nullable {
+		re = `(?:null|` + re + `)`
+	}
+	return re, nil
+}
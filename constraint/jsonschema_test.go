@@ -0,0 +1,74 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package constraint
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type base struct {
+	ID uint `json:"id"`
+}
+
+type event struct {
+	base
+	Name    string          `json:"name"`
+	When    time.Time       `json:"when"`
+	Score   float64         `json:"score,omitempty"`
+	Level   int8            `json:"level"`
+	Tags    []string        `json:"tags"`
+	Labels  map[string]bool `json:"labels"`
+	Parent  *base           `json:"parent"`
+	Address net.IP          `json:"address"`
+	Ignored string          `json:"-"`
+	private int
+}
+
+func TestSchemaOf(t *testing.T) {
+	s, err := SchemaOf(event{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id", "name", "when", "score", "level", "tags", "labels", "parent", "address"}, s.Required)
+	assert.Equal(t, "date-time", s.Properties["when"].Format)
+	assert.Equal(t, int64(-128), *s.Properties["level"].Minimum)
+	assert.True(t, s.Properties["parent"].Nullable)
+	assert.Equal(t, "string", s.Properties["address"].Type)
+
+	pattern, err := s.Regexp()
+	require.NoError(t, err)
+	re := MustCompile(pattern)
+	matches := func(v any) bool {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return re.Matches(re.Next(re.Start(), string(b)))
+	}
+	e := event{
+		base:    base{ID: 7},
+		Name:    "a \"quoted\"\nname",
+		When:    time.Date(2023, 5, 17, 10, 30, 0, 0, time.UTC),
+		Score:   -1.5e-3,
+		Level:   -12,
+		Tags:    []string{"x", "y"},
+		Labels:  map[string]bool{"ok": true},
+		Address: net.IPv4(127, 0, 0, 1),
+	}
+	assert.True(t, matches(e))
+	e.Parent, e.Tags, e.Labels = &base{ID: 1}, []string{}, map[string]bool{}
+	assert.True(t, matches(e))
+	assert.False(t, re.Matches(re.Next(re.Start(), `{"id":7}`)))
+
+	type recursive struct {
+		Next *recursive
+	}
+	for _, v := range []any{recursive{}, map[int]string{}, struct{ F func() }{}, nil, json.RawMessage{}} {
+		_, err := SchemaOf(v)
+		assert.Error(t, err, "%T", v)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package constraint
+
+import (
+	"math"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Processor is a decoder.LogitsProcessor constraining the generation to the texts
+// matching a Regexp: at each step, the tokens which can't continue a match are
+// banned, as is the end token until the text matches. The tokens with an empty
+// text or with partial UTF-8 sequences are never allowed.
+//
+// The tokens allowed after each state of the expression are computed once, the
+// first time the state is reached.
+type Processor struct {
+	re    *Regexp
+	texts []string
+	end   int
+
+	mu      sync.Mutex
+	allowed map[string][]bool
+}
+
+var _ decoder.LogitsProcessor = &Processor{}
+
+// NewProcessor returns a Processor, given the texts of the vocabulary and the ID
+// of the end token.
+func NewProcessor(re *Regexp, vocabulary []string, endTokenID int) *Processor {
+	return &Processor{
+		re:      re,
+		texts:   vocabulary,
+		end:     endTokenID,
+		allowed: make(map[string][]bool),
+	}
+}
+
+// Process bans the tokens which can't follow the text generated so far, the last
+// step tokens of inputIDs.
+func (p *Processor) Process(step int, inputIDs []int, logits []float32) []float32 {
+	s := p.re.Start()
+	for _, id := range inputIDs[len(inputIDs)-step:] {
+		if id < 0 || id >= len(p.texts) {
+			s = State{}
+			break
+		}
+		s = p.re.Next(s, p.texts[id])
+	}
+	allowed := p.allowedTokens(s)
+	negInf := float32(math.Inf(-1))
+	for id := range logits {
+		if id >= len(allowed) || !allowed[id] {
+			logits[id] = negInf
+		}
+	}
+	return logits
+}
+
+// allowedTokens returns whether each token can follow the state.
+func (p *Processor) allowedTokens(s State) []bool {
+	key := s.Key()
+	p.mu.Lock()
+	allowed, ok := p.allowed[key]
+	p.mu.Unlock()
+	if ok {
+		return allowed
+	}
+	allowed = make([]bool, len(p.texts))
+	if !s.Dead() {
+		for id, text := range p.texts {
+			if id != p.end && text != "" && validUTF8(text) {
+				allowed[id] = !p.re.Next(s, text).Dead()
+			}
+		}
+	}
+	if p.end >= 0 && p.end < len(allowed) {
+		// once dead, e.g. cut by the maximum length of a previous step, the
+		// generation can only end
+		allowed[p.end] = s.Dead() || p.re.Matches(s)
+	}
+	p.mu.Lock()
+	p.allowed[key] = allowed
+	p.mu.Unlock()
+	return allowed
+}
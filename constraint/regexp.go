@@ -0,0 +1,178 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package constraint constrains the generations to the texts matching a regular
+// expression, masking at each step the tokens which can't continue a match.
+package constraint
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Regexp is a regular expression, in the syntax of the regexp package, matched
+// incrementally against a text, a piece at a time (see State).
+//
+// The whole text must match, as if the expression were enclosed in ^(?:...)$.
+// The word boundaries (\b and \B) are not supported.
+type Regexp struct {
+	pattern string
+	prog    *syntax.Prog
+}
+
+// Compile parses a regular expression.
+func Compile(pattern string) (*Regexp, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("constraint: %w", err)
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("constraint: %w", err)
+	}
+	for _, inst := range prog.Inst {
+		if inst.Op == syntax.InstEmptyWidth && syntax.EmptyOp(inst.Arg)&(syntax.EmptyWordBoundary|syntax.EmptyNoWordBoundary) != 0 {
+			return nil, fmt.Errorf("constraint: word boundaries are not supported: %q", pattern)
+		}
+	}
+	return &Regexp{pattern: pattern, prog: prog}, nil
+}
+
+// MustCompile is like Compile but panics if the expression can't be parsed.
+func MustCompile(pattern string) *Regexp {
+	re, err := Compile(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// String returns the source text of the expression.
+func (re *Regexp) String() string {
+	return re.pattern
+}
+
+// State is the state of the matching of a text: the instructions of the program
+// of the expression reachable after it.
+type State struct {
+	pcs []uint32
+	// context are the empty-width assertions holding at the beginning of the rest
+	// of the text.
+	context syntax.EmptyOp
+}
+
+// Start returns the state of the empty text.
+func (re *Regexp) Start() State {
+	s := State{context: syntax.EmptyBeginText | syntax.EmptyBeginLine}
+	s.pcs = re.add(nil, make(map[uint32]bool), uint32(re.prog.Start), s.context, false)
+	sort.Slice(s.pcs, func(i, j int) bool { return s.pcs[i] < s.pcs[j] })
+	return s
+}
+
+// Dead reports whether no text following the state can match.
+func (s State) Dead() bool {
+	return len(s.pcs) == 0
+}
+
+// Key identifies the state: equal states have equal keys.
+func (s State) Key() string {
+	var sb strings.Builder
+	sb.WriteString(strconv.Itoa(int(s.context)))
+	for _, pc := range s.pcs {
+		sb.WriteByte(',')
+		sb.WriteString(strconv.Itoa(int(pc)))
+	}
+	return sb.String()
+}
+
+// Next returns the state after the text following s, which is dead if the text
+// can't continue a match. The invalid UTF-8 bytes match only utf8.RuneError.
+func (re *Regexp) Next(s State, text string) State {
+	for _, r := range text {
+		if s.Dead() {
+			break
+		}
+		s = re.step(s, r)
+	}
+	return s
+}
+
+// Matches reports whether the text of the state matches the expression.
+func (re *Regexp) Matches(s State) bool {
+	visited := make(map[uint32]bool)
+	var pcs []uint32
+	for _, pc := range s.pcs {
+		pcs = re.add(pcs, visited, pc, s.context, true)
+	}
+	for _, pc := range pcs {
+		if re.prog.Inst[pc].Op == syntax.InstMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// step returns the state after the rune r following s.
+func (re *Regexp) step(s State, r rune) State {
+	next := State{context: syntax.EmptyOpContext(r, -1) & (syntax.EmptyBeginLine | syntax.EmptyBeginText)}
+	visited := make(map[uint32]bool)
+	for _, pc := range s.pcs {
+		inst := &re.prog.Inst[pc]
+		var ok bool
+		switch inst.Op {
+		case syntax.InstRune, syntax.InstRune1:
+			ok = inst.MatchRune(r)
+		case syntax.InstRuneAny:
+			ok = true
+		case syntax.InstRuneAnyNotNL:
+			ok = r != '\n'
+		}
+		if ok {
+			next.pcs = re.add(next.pcs, visited, inst.Out, next.context, false)
+		}
+	}
+	sort.Slice(next.pcs, func(i, j int) bool { return next.pcs[i] < next.pcs[j] })
+	return next
+}
+
+// add adds to pcs the instructions consuming a rune, or matching, reachable from
+// pc in the given context, following the empty-width instructions. Unless at the
+// end of the text, the assertions of the end are kept pending in pcs.
+func (re *Regexp) add(pcs []uint32, visited map[uint32]bool, pc uint32, context syntax.EmptyOp, atEnd bool) []uint32 {
+	if visited[pc] {
+		return pcs
+	}
+	visited[pc] = true
+	inst := &re.prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstFail:
+	case syntax.InstAlt, syntax.InstAltMatch:
+		pcs = re.add(pcs, visited, inst.Out, context, atEnd)
+		pcs = re.add(pcs, visited, inst.Arg, context, atEnd)
+	case syntax.InstNop, syntax.InstCapture:
+		pcs = re.add(pcs, visited, inst.Out, context, atEnd)
+	case syntax.InstEmptyWidth:
+		const end = syntax.EmptyEndText | syntax.EmptyEndLine
+		cond := syntax.EmptyOp(inst.Arg)
+		switch {
+		case atEnd && cond&^(context|end) == 0, cond&^context == 0:
+			pcs = re.add(pcs, visited, inst.Out, context, atEnd)
+		case !atEnd && cond&end != 0 && cond&^(context|end) == 0:
+			pcs = append(pcs, pc)
+		}
+	default:
+		pcs = append(pcs, pc)
+	}
+	return pcs
+}
+
+// validUTF8 reports whether the text of a token can be matched: the tokens with
+// partial UTF-8 sequences are not, their runes being unknown.
+func validUTF8(text string) bool {
+	return utf8.ValidString(text)
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package constraint
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegexp(t *testing.T) {
+	re := MustCompile(`(?:ab|c)+d?$`)
+	tests := []struct {
+		text           string
+		dead, matching bool
+	}{
+		{"", false, false},
+		{"a", false, false},
+		{"ab", false, true},
+		{"abc", false, true},
+		{"abcd", false, true},
+		{"abcdd", true, false},
+		{"ac", true, false},
+		{"x", true, false},
+	}
+	for _, tt := range tests {
+		s := re.Next(re.Start(), tt.text)
+		assert.Equal(t, tt.dead, s.Dead(), tt.text)
+		assert.Equal(t, tt.matching, re.Matches(s), tt.text)
+	}
+
+	// the text can be split anywhere
+	s := re.Next(re.Next(re.Start(), "a"), "bcd")
+	assert.True(t, re.Matches(s))
+	assert.Equal(t, re.Next(re.Start(), "abcd").Key(), s.Key())
+
+	_, err := Compile(`\bword`)
+	assert.Error(t, err)
+	_, err = Compile(`(`)
+	assert.Error(t, err)
+}
+
+func TestProcessor(t *testing.T) {
+	vocabulary := []string{"<end>", "a", "b", "ab", "c", "", "\xe2"}
+	p := NewProcessor(MustCompile(`ab?c`), vocabulary, 0)
+	allowed := func(inputIDs []int, step int) []int {
+		logits := p.Process(step, inputIDs, make([]float32, len(vocabulary)))
+		var ids []int
+		for id, l := range logits {
+			if !math.IsInf(float64(l), -1) {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	// the prompt is not constrained
+	assert.Equal(t, []int{1, 3}, allowed([]int{4, 2}, 0))
+	assert.Equal(t, []int{2, 4}, allowed([]int{4, 2, 1}, 1))
+	assert.Equal(t, []int{4}, allowed([]int{4, 2, 3}, 1))
+	assert.Equal(t, []int{0}, allowed([]int{4, 2, 3, 4}, 2))
+	require.Len(t, p.allowed, 4)
+}
@@ -0,0 +1,360 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/internal/float16"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/verrors"
+)
+
+// Continuation is the state of the model at the end of a generation, from which
+// GenerateContinuation continues it exactly where it stopped, e.g. because of
+// the maximum length, without encoding the text again.
+type Continuation struct {
+	input decoder.Input
+	// halfLogits, when not nil, are the logits in float16, in place of the ones of
+	// the input (see VerbaFlow.HalfStates).
+	halfLogits []uint16
+}
+
+// Tokens returns the tokens followed by the continuation: the prompt and the
+// completion of the generation.
+func (c *Continuation) Tokens() []int {
+	return c.input.Tokens
+}
+
+// logits returns the logits of the input, converted to float32 if they are kept
+// in float16: they must not be modified.
+func (c *Continuation) logits() mat.Matrix {
+	if c.halfLogits != nil {
+		return mat.NewVecDense(float16.ToFloat32s(c.halfLogits))
+	}
+	return c.input.Logits
+}
+
+// decoderInput returns the input of the continuation, with the logits in
+// float32: the state is cloned by the model before its use (see cloneState).
+func (c *Continuation) decoderInput() decoder.Input {
+	return decoder.Input{Logits: c.logits(), State: c.input.State, Tokens: c.input.Tokens}
+}
+
+// NewContinuation returns the continuation of the input passed at the end of a
+// generation to decoder.DecodingOptions.FinalState. Its state is copied, to
+// survive the release of the nodes of the generation: the model must implement
+// decoder.StateCloner. With HalfStates, the state and the logits are kept in
+// float16.
+func (vf *VerbaFlow) NewContinuation(input decoder.Input) (*Continuation, error) {
+	state, err := vf.cloneState(input.State)
+	if err != nil {
+		return nil, err
+	}
+	c := &Continuation{input: decoder.Input{
+		State:  state,
+		Tokens: append([]int(nil), input.Tokens...),
+	}}
+	if err := vf.compact(c, input.Logits.Clone()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// compact sets the logits of the continuation, a copy, converting them and the
+// state of the continuation to float16 with HalfStates.
+func (vf *VerbaFlow) compact(c *Continuation, logits mat.Matrix) error {
+	if !vf.HalfStates {
+		c.input.Logits = logits
+		return nil
+	}
+	c.halfLogits = float16.FromFloat32s(logits.Data().F32())
+	model, err := vf.model()
+	if err != nil {
+		return err
+	}
+	if compactor, ok := model.(decoder.StateCompactor); ok {
+		if c.input.State, err = compactor.CompactState(c.input.State); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneState returns a copy of the state of the model.
+func (vf *VerbaFlow) cloneState(state decoder.State) (decoder.State, error) {
+	model, err := vf.model()
+	if err != nil {
+		return nil, err
+	}
+	cloner, ok := model.(decoder.StateCloner)
+	if !ok {
+		return nil, fmt.Errorf("verbaflow: the generations of %T can't be continued", model)
+	}
+	return cloner.CloneState(state)
+}
+
+// GenerateContinuation is like Generate, but continues the generation of the
+// continuation, after the text, if not empty, which is encoded following it as
+// part of the prompt. The continuation is not modified, it can be continued
+// again; the continuation of this generation is recorded with
+// decoder.DecodingOptions.FinalState, as for Generate.
+func (vf *VerbaFlow) GenerateContinuation(ctx context.Context, nt *ag.NodesTracker, c *Continuation, text string, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
+	ctx, _ = genid.Ensure(ctx)
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	defer release()
+
+	d, input, err := vf.prepareContinuation(ctx, nt, c, text, opts)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	return d.Decode(ctx, nt, input, chGen)
+}
+
+// prepareContinuation returns the decoder of the continuation and its input,
+// after the encoding of the text. A panic is recovered and returned as a
+// *PanicError, like in the decoding.
+func (vf *VerbaFlow) prepareContinuation(ctx context.Context, nt *ag.NodesTracker, c *Continuation, text string, opts decoder.DecodingOptions) (_ *decoder.Decoder, _ decoder.Input, err error) {
+	logger := genid.Logger(ctx)
+	defer func() {
+		if r := recover(); r != nil {
+			pe := verrors.Recovered(r)
+			logger.Error().Str("stack", string(pe.Stack)).Msgf("recovered from panic while preparing the continuation: %v", r)
+			err = pe
+		}
+	}()
+	model, err := vf.model()
+	if err != nil {
+		return nil, decoder.Input{}, err
+	}
+	if opts, err = vf.applyOptions(text, opts); err != nil {
+		return nil, decoder.Input{}, err
+	}
+	d, err := decoder.New(model, opts)
+	if err != nil {
+		return nil, decoder.Input{}, err
+	}
+	state, err := vf.cloneState(c.input.State)
+	if err != nil {
+		return nil, decoder.Input{}, err
+	}
+	input := decoder.Input{
+		Logits: c.logits().Clone(),
+		State:  state,
+		Tokens: c.input.Tokens[:len(c.input.Tokens):len(c.input.Tokens)],
+	}
+	if text == "" {
+		logger.Trace().Msgf("Continuing after %d tokens", len(input.Tokens))
+		return d, input, nil
+	}
+	logger.Trace().Msgf("Continuing after %d tokens, with %q", len(input.Tokens), text)
+	tokens, err := vf.Tokenizer.Tokenize(text)
+	if err != nil {
+		return nil, decoder.Input{}, err
+	}
+	for _, token := range tokens {
+		if input.Logits, input.State, err = model.EncodeNext(ctx, nt, input.State, token); err != nil {
+			return nil, decoder.Input{}, err
+		}
+	}
+	input.Tokens = append(input.Tokens, tokens...)
+	if opts.PromptProgress != nil {
+		opts.PromptProgress(len(tokens), len(tokens))
+	}
+	return d, input, nil
+}
+
+// EncodeContinuation encodes the prompt, without generating, returning the
+// continuation after it, e.g. to save the state of a system prompt once (see
+// WriteContinuation) and continue from it the generations beginning with it.
+func (vf *VerbaFlow) EncodeContinuation(ctx context.Context, prompt string) (*Continuation, error) {
+	tokens, err := vf.Tokenizer.Tokenize(prompt)
+	if err != nil {
+		return nil, err
+	}
+	return vf.EncodeContinuationTokens(ctx, tokens)
+}
+
+// EncodeContinuationTokens is like EncodeContinuation, given the tokens of the
+// prompt, e.g. the ones recorded by a transcript.
+func (vf *VerbaFlow) EncodeContinuationTokens(ctx context.Context, tokens []int) (_ *Continuation, err error) {
+	ctx, _ = genid.Ensure(ctx)
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer func() {
+		if r := recover(); r != nil {
+			err = verrors.Recovered(r)
+		}
+	}()
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("verbaflow: no tokens to encode")
+	}
+	if err := vf.CheckPromptLength(len(tokens)); err != nil {
+		return nil, err
+	}
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+	input, err := vf.encodePrompt(ctx, nt, tokens, decoder.DecodingOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return vf.NewContinuation(input)
+}
+
+// ContinuationVersion is the version of the format of WriteContinuation. The
+// continuations of version 0, predating the versioning, don't record the model
+// which encoded them: ReadContinuation only checks their shape.
+const ContinuationVersion = 1
+
+// continuationData is the encoding of a Continuation (see WriteContinuation).
+type continuationData struct {
+	Version int
+	// Model is the fingerprint of the model which encoded the state, if it has
+	// one (see decoder.StateFingerprinter).
+	Model  string
+	Tokens []int
+	Logits []float32
+	// State is encoded by the model (see decoder.StateMarshaler).
+	State []byte
+}
+
+// WriteContinuation writes the continuation to w, to be read back with
+// ReadContinuation by the same model, even in another process: the model must
+// implement decoder.StateMarshaler.
+func (vf *VerbaFlow) WriteContinuation(w io.Writer, c *Continuation) error {
+	marshaler, err := vf.stateMarshaler()
+	if err != nil {
+		return err
+	}
+	state, err := marshaler.MarshalState(c.input.State)
+	if err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(continuationData{
+		Version: ContinuationVersion,
+		Model:   stateFingerprint(marshaler),
+		Tokens:  c.input.Tokens,
+		Logits:  c.logits().Data().F32(),
+		State:   state,
+	})
+}
+
+// ReadContinuation reads a continuation written by WriteContinuation, of any
+// version up to ContinuationVersion. It fails with ErrStateMismatch if the
+// continuation was encoded by another model, or doesn't match its vocabulary or
+// its shape: ConvertContinuation encodes it again with the model.
+func (vf *VerbaFlow) ReadContinuation(r io.Reader) (*Continuation, error) {
+	data, err := readContinuationData(r)
+	if err != nil {
+		return nil, err
+	}
+	return vf.continuationOf(data)
+}
+
+// readContinuationData decodes a continuation of any supported version.
+func readContinuationData(r io.Reader) (continuationData, error) {
+	var data continuationData
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return data, fmt.Errorf("verbaflow: invalid continuation: %w", err)
+	}
+	if data.Version > ContinuationVersion {
+		return data, fmt.Errorf("verbaflow: the continuation has version %d, newer than the supported %d: upgrade verbaflow to read it", data.Version, ContinuationVersion)
+	}
+	return data, nil
+}
+
+// continuationOf returns the continuation of the data, checking that it matches
+// the model.
+func (vf *VerbaFlow) continuationOf(data continuationData) (*Continuation, error) {
+	marshaler, err := vf.stateMarshaler()
+	if err != nil {
+		return nil, err
+	}
+	if size, err := vf.vocabSize(); err == nil && len(data.Logits) != size {
+		return nil, fmt.Errorf("%w: the continuation has %d logits, the vocabulary of the model %d tokens", ErrStateMismatch, len(data.Logits), size)
+	}
+	state, err := marshaler.UnmarshalState(data.State)
+	if err != nil {
+		return nil, err
+	}
+	// the mismatches of the shape are the most telling, so they are reported first
+	if model := stateFingerprint(marshaler); data.Model != "" && model != "" && data.Model != model {
+		return nil, fmt.Errorf("%w: the continuation was encoded by another model (%s, this one is %s)", ErrStateMismatch, data.Model, model)
+	}
+	c := &Continuation{input: decoder.Input{State: state, Tokens: data.Tokens}}
+	if err := vf.compact(c, mat.NewVecDense(data.Logits)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ConvertContinuation reads a continuation like ReadContinuation, of any
+// supported version, which WriteContinuation writes back in the current one.
+// A continuation encoded by another model, e.g. before an upgrade, is encoded
+// again from its tokens, when they are tokens of the vocabulary of the model:
+// the tokenizer is assumed to be the same, as the continuation doesn't record
+// it. The second result reports whether the continuation was encoded again.
+func (vf *VerbaFlow) ConvertContinuation(ctx context.Context, r io.Reader) (*Continuation, bool, error) {
+	data, err := readContinuationData(r)
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := vf.continuationOf(data)
+	if err == nil || !errors.Is(err, ErrStateMismatch) {
+		return c, false, err
+	}
+	size, sizeErr := vf.vocabSize()
+	if sizeErr != nil {
+		return nil, false, err
+	}
+	for _, id := range data.Tokens {
+		if id < 0 || id >= size {
+			return nil, false, fmt.Errorf("%w, and its token %d is out of the vocabulary of the model", err, id)
+		}
+	}
+	c, err = vf.EncodeContinuationTokens(ctx, data.Tokens)
+	if err != nil {
+		return nil, false, err
+	}
+	return c, true, nil
+}
+
+// stateFingerprint returns the fingerprint of the model, if it has one.
+func stateFingerprint(model decoder.StateMarshaler) string {
+	if f, ok := model.(decoder.StateFingerprinter); ok {
+		return f.StateFingerprint()
+	}
+	return ""
+}
+
+// stateMarshaler returns the model as a decoder.StateMarshaler.
+func (vf *VerbaFlow) stateMarshaler() (decoder.StateMarshaler, error) {
+	model, err := vf.model()
+	if err != nil {
+		return nil, err
+	}
+	marshaler, ok := model.(decoder.StateMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("verbaflow: the states of %T can't be saved", model)
+	}
+	return marshaler, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_GenerateContinuation(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1}
+	expected := generateIDs(t, vf, "hello", opts)
+	require.Len(t, expected, 8)
+
+	var cont *Continuation
+	opts.MaxLen = 5
+	opts.FinalState = func(input decoder.Input) {
+		var err error
+		cont, err = vf.NewContinuation(input)
+		require.NoError(t, err)
+	}
+	nt := &ag.NodesTracker{}
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	require.NoError(t, vf.Generate(context.Background(), nt, "hello", chGen, opts))
+	// the continuation survives the release of the nodes of the generation
+	graph.ReleaseNodes(nt)
+	require.NotNil(t, cont)
+	prompt, err := vf.Tokenizer.Tokenize("hello")
+	require.NoError(t, err)
+	assert.Equal(t, append(prompt, expected[:5]...), cont.Tokens())
+
+	continueIDs := func() []int {
+		opts := decoder.DecodingOptions{MaxLen: 3, EndTokenID: -1}
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, vf.GenerateContinuation(context.Background(), &ag.NodesTracker{}, cont, "", chGen, opts))
+		var ids []int
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+	// the continuation is seamless, and can be continued again
+	assert.Equal(t, expected[5:], continueIDs())
+	assert.Equal(t, expected[5:], continueIDs())
+}
+
+func TestVerbaFlow_WriteContinuation(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1}
+	expected := generateIDs(t, vf, "hello", opts)
+
+	c, err := vf.EncodeContinuation(context.Background(), "hel")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, vf.WriteContinuation(&buf, c))
+	read, err := vf.ReadContinuation(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, c.Tokens(), read.Tokens())
+
+	// the generation continues from the saved state as from the encoded prompt
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	require.NoError(t, vf.GenerateContinuation(context.Background(), &ag.NodesTracker{}, read, "lo", chGen, opts))
+	var ids []int
+	for gen := range chGen {
+		ids = append(ids, gen.TokenID)
+	}
+	assert.Equal(t, expected, ids)
+
+	// the state must match the model
+	other := newTestVerbaFlow(t)
+	other.Model.Config.NumHiddenLayers = 3
+	_, err = other.ReadContinuation(bytes.NewReader(buf.Bytes()))
+	assert.ErrorIs(t, err, ErrStateMismatch)
+	assert.ErrorContains(t, err, "layers")
+	_, err = vf.ReadContinuation(strings.NewReader("garbage"))
+	assert.Error(t, err)
+}
+
+func TestVerbaFlow_ConvertContinuation(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	c, err := vf.EncodeContinuation(context.Background(), "hel")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, vf.WriteContinuation(&buf, c))
+
+	// a model of the same shape, with other weights, doesn't read the state
+	other := newTestVerbaFlow(t)
+	other.Model.LN.W.ReplaceValue(mat.NewVecDense(make([]float32, 8)))
+	_, err = other.ReadContinuation(bytes.NewReader(buf.Bytes()))
+	assert.ErrorIs(t, err, ErrStateMismatch)
+	assert.ErrorContains(t, err, "another model")
+
+	// but encodes its tokens again
+	converted, encoded, err := other.ConvertContinuation(context.Background(), bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.True(t, encoded)
+	assert.Equal(t, c.Tokens(), converted.Tokens())
+	expected, err := other.EncodeContinuation(context.Background(), "hel")
+	require.NoError(t, err)
+	assert.Equal(t, expected.input.Logits.Data().F32(), converted.input.Logits.Data().F32())
+
+	// the same model reads it as it is
+	read, encoded, err := vf.ConvertContinuation(context.Background(), bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.False(t, encoded)
+	assert.Equal(t, c.input.Logits.Data().F32(), read.input.Logits.Data().F32())
+
+	// the continuations of newer versions are rejected
+	buf.Reset()
+	require.NoError(t, gob.NewEncoder(&buf).Encode(continuationData{Version: ContinuationVersion + 1}))
+	_, err = vf.ReadContinuation(bytes.NewReader(buf.Bytes()))
+	assert.ErrorContains(t, err, "upgrade")
+}
+
+func TestVerbaFlow_ReadContinuation_Version0(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	c, err := vf.EncodeContinuation(context.Background(), "hel")
+	require.NoError(t, err)
+
+	// the format predating the versioning: no version, no model, bare layers
+	type layerState struct{ FfnXX, AttXX, AttAA, AttBB, AttPP []float32 }
+	var layers []layerState
+	for _, l := range c.input.State.(rwkv.State) {
+		layers = append(layers, layerState{
+			FfnXX: l.FfnXX.Value().Data().F32(),
+			AttXX: l.AttXX.Value().Data().F32(),
+			AttAA: l.AttAA.Value().Data().F32(),
+			AttBB: l.AttBB.Value().Data().F32(),
+			AttPP: l.AttPP.Value().Data().F32(),
+		})
+	}
+	var state bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&state).Encode(layers))
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(struct {
+		Tokens []int
+		Logits []float32
+		State  []byte
+	}{c.Tokens(), c.input.Logits.Data().F32(), state.Bytes()}))
+
+	read, err := vf.ReadContinuation(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, c.Tokens(), read.Tokens())
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1}
+	var expected, ids []int
+	for _, from := range []*Continuation{c, read} {
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, vf.GenerateContinuation(context.Background(), &ag.NodesTracker{}, from, "lo", chGen, opts))
+		ids = nil
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		if expected == nil {
+			expected = ids
+		}
+	}
+	assert.Equal(t, expected, ids)
+}
+
+func TestVerbaFlow_HalfStates(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	full, err := vf.EncodeContinuation(context.Background(), "hel")
+	require.NoError(t, err)
+	vf.HalfStates = true
+	c, err := vf.EncodeContinuation(context.Background(), "hel")
+	require.NoError(t, err)
+	assert.Nil(t, c.input.Logits)
+	assert.Len(t, c.halfLogits, testVocabSize)
+	assert.IsType(t, rwkv.State{}, full.input.State)
+	assert.NotEqual(t, reflect.TypeOf(rwkv.State{}), reflect.TypeOf(c.input.State))
+	assert.InDeltaSlice(t, full.logits().Data().F32(), c.logits().Data().F32(), 1e-2)
+
+	// the generations continue from the state in float16 as from the full one
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1}
+	generate := func(from *Continuation) []int {
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		require.NoError(t, vf.GenerateContinuation(context.Background(), &ag.NodesTracker{}, from, "lo", chGen, opts))
+		var ids []int
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+	assert.Equal(t, generate(full), generate(c))
+
+	// and they are saved in full
+	var buf bytes.Buffer
+	require.NoError(t, vf.WriteContinuation(&buf, c))
+	vf.HalfStates = false
+	read, err := vf.ReadContinuation(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, c.logits().Data().F32(), read.logits().Data().F32())
+	assert.Equal(t, generate(c), generate(read))
+}
@@ -0,0 +1,49 @@
+module github.com/nlpodyssey/verbaflow/contrib/langchaingo
+
+go 1.22.0
+
+require (
+	github.com/nlpodyssey/verbaflow v0.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.9.0
+	github.com/tmc/langchaingo v0.1.13
+)
+
+require (
+	github.com/cespare/xxhash v1.1.0 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgraph-io/badger/v3 v3.2103.5 // indirect
+	github.com/dgraph-io/ristretto v0.1.1 // indirect
+	github.com/dlclark/regexp2 v1.10.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/glog v1.0.0 // indirect
+	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/google/flatbuffers v23.5.26+incompatible // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.6 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/nlpodyssey/gopickle v0.2.0 // indirect
+	github.com/nlpodyssey/gotokenizers v0.2.0 // indirect
+	github.com/nlpodyssey/rwkv v0.0.0-20230212203924-6a6eeeabd546 // indirect
+	github.com/nlpodyssey/spago v1.1.0 // indirect
+	github.com/nlpodyssey/spago/embeddings/store/diskstore v0.0.0-20230202124145-3cffe41f485c // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pkoukk/tiktoken-go v0.1.6 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rs/zerolog v1.31.0 // indirect
+	go.opencensus.io v0.24.0 // indirect
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sys v0.27.0 // indirect
+	google.golang.org/protobuf v1.34.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/nlpodyssey/verbaflow => ../..
+
+// langchaingo requires a newer spago, which is not compatible with the one
+// used by VerbaFlow; its packages used here don't depend on spago.
+replace github.com/nlpodyssey/spago => github.com/nlpodyssey/spago v1.0.2-0.20230202124145-3cffe41f485c
@@ -0,0 +1,245 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package langchaingo adapts VerbaFlow to the llms.Model interface of
+// langchaingo (github.com/tmc/langchaingo), so that a loaded model can be
+// used by its chains and agents.
+//
+// It is a separate module, since langchaingo requires a newer Go version than
+// VerbaFlow itself.
+package langchaingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// DefaultMaxTokens is the maximum number of generated tokens, when not set
+// by the call options nor by Options.DecodingOptions.
+const DefaultMaxTokens = 256
+
+// Stop reasons reported in the llms.ContentChoice.
+const (
+	StopReasonStop   = "stop"
+	StopReasonLength = "length"
+)
+
+// Options contains the options of the LLM.
+type Options struct {
+	// DecodingOptions are the default decoding options, overridden by the
+	// call options set by the caller.
+	DecodingOptions decoder.DecodingOptions
+	// FormatMessages renders the messages of GenerateContent as the prompt.
+	// If nil, FormatMessages is used.
+	FormatMessages func(messages []llms.MessageContent) (string, error)
+}
+
+// LLM is an llms.Model backed by a VerbaFlow model.
+type LLM struct {
+	vf   *verbaflow.VerbaFlow
+	opts Options
+}
+
+var _ llms.Model = (*LLM)(nil)
+
+// New returns an LLM generating with the given model, which is not closed by the LLM.
+func New(vf *verbaflow.VerbaFlow, opts Options) *LLM {
+	if opts.FormatMessages == nil {
+		opts.FormatMessages = FormatMessages
+	}
+	return &LLM{vf: vf, opts: opts}
+}
+
+// Call generates the completion of a single prompt, passed to the model as is.
+func (l *LLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, l, prompt, options...)
+}
+
+// GenerateContent generates the completion of the messages, rendered as a
+// prompt with Options.FormatMessages. The text is streamed to the
+// StreamingFunc of the call options, if any.
+func (l *LLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	callOpts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&callOpts)
+	}
+	if callOpts.CandidateCount > 1 || callOpts.N > 1 {
+		return nil, errors.New("langchaingo: multiple candidates are not supported")
+	}
+	if len(callOpts.Tools) > 0 || len(callOpts.Functions) > 0 {
+		return nil, errors.New("langchaingo: tools are not supported")
+	}
+
+	prompt, err := l.opts.FormatMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+	opts := l.decodingOptions(callOpts)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stops := &stopWatcher{stops: callOpts.StopWords, cancel: cancel}
+	processors := []textproc.Processor{stops}
+	if len(callOpts.StopWords) > 0 {
+		processors = append(processors, textproc.TrimStopSequences(callOpts.StopWords...))
+	}
+
+	var sb strings.Builder
+	tokens := 0
+	err = l.vf.GenerateText(ctx, prompt, opts, func(text string) error {
+		sb.WriteString(text)
+		if callOpts.StreamingFunc != nil {
+			return callOpts.StreamingFunc(ctx, []byte(text))
+		}
+		return nil
+	}, append([]textproc.Processor{tokenCounter{&tokens}}, processors...)...)
+	if err != nil && !(stops.stopped && errors.Is(err, context.Canceled)) {
+		return nil, err
+	}
+
+	reason := StopReasonStop
+	if !stops.stopped && tokens >= opts.MaxLen {
+		reason = StopReasonLength
+	}
+	return &llms.ContentResponse{
+		Choices: []*llms.ContentChoice{{
+			Content:    sb.String(),
+			StopReason: reason,
+			GenerationInfo: map[string]any{
+				"CompletionTokens": tokens,
+			},
+		}},
+	}, nil
+}
+
+// decodingOptions returns the default decoding options, overridden by the
+// call options.
+func (l *LLM) decodingOptions(callOpts llms.CallOptions) decoder.DecodingOptions {
+	opts := l.opts.DecodingOptions
+	switch {
+	case callOpts.MaxTokens > 0:
+		opts.MaxLen = callOpts.MaxTokens
+	case callOpts.MaxLength > 0:
+		opts.MaxLen = callOpts.MaxLength
+	case opts.MaxLen == 0:
+		opts.MaxLen = DefaultMaxTokens
+	}
+	if callOpts.MinLength > 0 {
+		opts.MinLen = callOpts.MinLength
+	}
+	if callOpts.Temperature > 0 {
+		opts.Temp = callOpts.Temperature
+		opts.UseSampling = true
+	}
+	if callOpts.TopK > 0 {
+		opts.TopK = callOpts.TopK
+	}
+	if callOpts.TopP > 0 {
+		opts.TopP = callOpts.TopP
+	}
+	if opts.UseSampling && opts.TopP == 0 {
+		opts.TopP = 1
+	}
+	if callOpts.RepetitionPenalty > 0 {
+		opts.RepetitionPenalty = callOpts.RepetitionPenalty
+	}
+	if callOpts.Seed != 0 {
+		opts.Seed = uint64(callOpts.Seed)
+	}
+	return opts
+}
+
+// FormatMessages is the default rendering of the messages as a prompt.
+// A single human message is used as is; otherwise, the messages are rendered
+// as a transcript ("System: ...", "Human: ...", "AI: ..."), ending with "AI:"
+// for the model to complete.
+func FormatMessages(messages []llms.MessageContent) (string, error) {
+	if len(messages) == 1 && messages[0].Role == llms.ChatMessageTypeHuman {
+		return messageText(messages[0])
+	}
+	var sb strings.Builder
+	for _, m := range messages {
+		text, err := messageText(m)
+		if err != nil {
+			return "", err
+		}
+		role, err := roleName(m.Role)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", role, text)
+	}
+	sb.WriteString("AI:")
+	return sb.String(), nil
+}
+
+func roleName(role llms.ChatMessageType) (string, error) {
+	switch role {
+	case llms.ChatMessageTypeSystem:
+		return "System", nil
+	case llms.ChatMessageTypeHuman, llms.ChatMessageTypeGeneric:
+		return "Human", nil
+	case llms.ChatMessageTypeAI:
+		return "AI", nil
+	default:
+		return "", fmt.Errorf("langchaingo: unsupported message role %q", role)
+	}
+}
+
+func messageText(m llms.MessageContent) (string, error) {
+	var sb strings.Builder
+	for _, part := range m.Parts {
+		text, ok := part.(llms.TextContent)
+		if !ok {
+			return "", fmt.Errorf("langchaingo: unsupported message part %T", part)
+		}
+		sb.WriteString(text.Text)
+	}
+	return sb.String(), nil
+}
+
+// stopWatcher is a pass-through textproc.Processor which stops the generation,
+// by canceling its context, as soon as one of the stop words is generated.
+type stopWatcher struct {
+	stops   []string
+	cancel  context.CancelFunc
+	text    strings.Builder
+	stopped bool
+}
+
+func (w *stopWatcher) Process(chunk string) string {
+	if w.stopped || len(w.stops) == 0 {
+		return chunk
+	}
+	w.text.WriteString(chunk)
+	for _, stop := range w.stops {
+		if strings.Contains(w.text.String(), stop) {
+			w.stopped = true
+			w.cancel()
+			break
+		}
+	}
+	return chunk
+}
+
+func (w *stopWatcher) Flush() string { return "" }
+
+// tokenCounter is a pass-through textproc.Processor counting the generated tokens.
+type tokenCounter struct {
+	n *int
+}
+
+func (c tokenCounter) Process(chunk string) string {
+	*c.n++
+	return chunk
+}
+
+func (c tokenCounter) Flush() string { return "" }
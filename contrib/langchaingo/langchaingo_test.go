@@ -0,0 +1,59 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package langchaingo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestLLM(t *testing.T) {
+	vf, err := verbaflow.Load("../../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	llm := New(vf, Options{})
+	ctx := context.Background()
+
+	// greedy decoding, see testdata/tiny-rwkv-golden.json
+	text, err := llm.Call(ctx, "the weather", llms.WithMaxTokens(6))
+	require.NoError(t, err)
+	assert.Equal(t, "&ėĻ&ėĻ", text)
+
+	var chunks []string
+	resp, err := llm.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "the weather"),
+	}, llms.WithStopWords([]string{"Ļ"}), llms.WithStreamingFunc(func(_ context.Context, chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	}))
+	require.NoError(t, err)
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "&ė", resp.Choices[0].Content)
+	assert.Equal(t, StopReasonStop, resp.Choices[0].StopReason)
+	assert.Equal(t, []string{"&", "ė"}, chunks)
+
+	_, err = llm.Call(ctx, "the weather", llms.WithN(2))
+	assert.Error(t, err)
+}
+
+func TestFormatMessages(t *testing.T) {
+	prompt, err := FormatMessages([]llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, "Be brief."),
+		llms.TextParts(llms.ChatMessageTypeHuman, "Hi!"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "System: Be brief.\nHuman: Hi!\nAI:", prompt)
+
+	_, err = FormatMessages([]llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeTool, "{}"),
+		llms.TextParts(llms.ChatMessageTypeHuman, "Hi!"),
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+// ahoCorasick is an Aho-Corasick automaton, matching a set of patterns against a
+// stream of symbols, such as token IDs or bytes, one symbol at a time: the cost
+// of each step is constant (amortized), whatever the number of patterns.
+type ahoCorasick[T comparable] struct {
+	// nodes are the nodes of the trie of the patterns, the root first.
+	nodes []acNode[T]
+}
+
+type acNode[T comparable] struct {
+	next map[T]int
+	// fail is the node of the longest proper suffix of the path of the node which
+	// is a path of the trie.
+	fail int
+	// matches are the indices of the patterns ending at the node: its own and the
+	// ones of its suffixes.
+	matches []int
+}
+
+// newAhoCorasick returns the automaton of the patterns; the empty ones are
+// ignored.
+func newAhoCorasick[T comparable](patterns [][]T) *ahoCorasick[T] {
+	a := &ahoCorasick[T]{nodes: []acNode[T]{{}}}
+	for i, p := range patterns {
+		if len(p) == 0 {
+			continue
+		}
+		n := 0
+		for _, sym := range p {
+			next, ok := a.nodes[n].next[sym]
+			if !ok {
+				next = len(a.nodes)
+				a.nodes = append(a.nodes, acNode[T]{})
+				if a.nodes[n].next == nil {
+					a.nodes[n].next = make(map[T]int)
+				}
+				a.nodes[n].next[sym] = next
+			}
+			n = next
+		}
+		if len(a.nodes[n].matches) == 0 {
+			a.nodes[n].matches = []int{i}
+		}
+	}
+
+	// the fail links, in breadth-first order: the ones of the shallower nodes are
+	// set first
+	queue := []int{0}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for sym, child := range a.nodes[n].next {
+			queue = append(queue, child)
+			if n == 0 {
+				continue
+			}
+			f := a.nodes[n].fail
+			for {
+				if next, ok := a.nodes[f].next[sym]; ok {
+					a.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = a.nodes[f].fail
+			}
+			if suffix := a.nodes[a.nodes[child].fail].matches; len(suffix) > 0 {
+				a.nodes[child].matches = append(a.nodes[child].matches[:len(a.nodes[child].matches):len(a.nodes[child].matches)], suffix...)
+			}
+		}
+	}
+	return a
+}
+
+// step returns the state following the given one with the symbol, and the
+// indices of the patterns ending with the symbol, from the longest. The initial
+// state is 0.
+func (a *ahoCorasick[T]) step(state int, sym T) (int, []int) {
+	for {
+		if next, ok := a.nodes[state].next[sym]; ok {
+			return next, a.nodes[next].matches
+		}
+		if state == 0 {
+			return 0, nil
+		}
+		state = a.nodes[state].fail
+	}
+}
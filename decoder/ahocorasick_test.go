@@ -0,0 +1,80 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAhoCorasick(t *testing.T) {
+	patterns := [][]byte{[]byte("he"), []byte("she"), []byte("his"), []byte("hers"), nil}
+	a := newAhoCorasick(patterns)
+	var ends []int
+	state := 0
+	for i, c := range []byte("ushers") {
+		var found []int
+		state, found = a.step(state, c)
+		for range found {
+			ends = append(ends, i)
+		}
+	}
+	// "she" and "he" end at 3, "hers" at 5
+	assert.Equal(t, []int{3, 3, 5}, ends)
+
+	// the same matches as the naive comparison
+	rng := rand.New(rand.NewSource(1))
+	var seqs [][]int
+	for i := 0; i < 40; i++ {
+		seq := make([]int, 1+rng.Intn(4))
+		for j := range seq {
+			seq[j] = rng.Intn(3)
+		}
+		seqs = append(seqs, seq)
+	}
+	ac := newAhoCorasick(seqs)
+	var stream []int
+	state = 0
+	for i := 0; i < 200; i++ {
+		stream = append(stream, rng.Intn(3))
+		var found []int
+		state, found = ac.step(state, stream[len(stream)-1])
+		var want []int
+		for k, seq := range seqs {
+			if endsWith(stream, seq) && firstIndex(seqs, seq) == k {
+				want = append(want, k)
+			}
+		}
+		got := append([]int(nil), found...)
+		sort.Ints(got)
+		assert.Equal(t, want, got, "step %d", i)
+	}
+}
+
+func endsWith(s, suffix []int) bool {
+	if len(s) < len(suffix) {
+		return false
+	}
+	for i := range suffix {
+		if s[len(s)-len(suffix)+i] != suffix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// firstIndex returns the index of the first sequence equal to seq: the automaton
+// reports the duplicated patterns once.
+func firstIndex(seqs [][]int, seq []int) int {
+	for i, s := range seqs {
+		if len(s) == len(seq) && endsWith(s, seq) {
+			return i
+		}
+	}
+	return -1
+}
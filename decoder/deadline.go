@@ -0,0 +1,99 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// deadlineWarmup is the number of steps timed before the generation is capped
+	// by the deadline of the context.
+	deadlineWarmup = 4
+	// deadlineGrace is the number of tokens before the estimated cap from which the
+	// generation stops at the first end of a sentence.
+	deadlineGrace = 16
+)
+
+// deadlineBudget caps the generation to the tokens which can be generated before
+// the deadline of the context, at the rate of the steps so far
+// (see DecodingOptions.DeadlineAware).
+type deadlineBudget struct {
+	deadline  time.Time
+	start     time.Time
+	now       func() time.Time
+	tokenText func(int) (string, error)
+	log       *zerolog.Logger
+}
+
+// newDeadlineBudget returns the budget of the generation, or nil if
+// opts.DeadlineAware is not set or the context has no deadline.
+func newDeadlineBudget(ctx context.Context, opts DecodingOptions, now func() time.Time) *deadlineBudget {
+	if !opts.DeadlineAware {
+		return nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	return &deadlineBudget{
+		deadline:  deadline,
+		start:     now(),
+		now:       now,
+		tokenText: opts.TokenText,
+		log:       genid.Logger(ctx),
+	}
+}
+
+// remaining returns the estimated number of tokens which can still be generated
+// before the deadline, after the given number of steps, keeping the time of a step
+// as a margin to finish the generation; it is -1 during the warmup.
+func (b *deadlineBudget) remaining(generated int) int {
+	if generated < deadlineWarmup {
+		return -1
+	}
+	now := b.now()
+	perToken := now.Sub(b.start) / time.Duration(generated)
+	if perToken <= 0 {
+		return math.MaxInt
+	}
+	left := b.deadline.Sub(now) - perToken
+	if left <= 0 {
+		return 0
+	}
+	return int(left / perToken)
+}
+
+// stop reports whether the generation is to stop after the last token of the
+// sequence: when no other token can be generated before the deadline, or at the
+// end of a sentence when the deadline is close.
+func (b *deadlineBudget) stop(sequence []int) (bool, error) {
+	n := b.remaining(len(sequence))
+	switch {
+	case n < 0 || n > deadlineGrace:
+		return false, nil
+	case n == 0:
+		b.log.Trace().Msgf("Reached the deadline after %d tokens", len(sequence))
+		return true, nil
+	case b.tokenText == nil:
+		return false, nil
+	}
+	text, err := b.tokenText(sequence[len(sequence)-1])
+	if err != nil {
+		return false, err
+	}
+	text = strings.TrimRight(text, " ")
+	if text != "" && strings.ContainsRune(".!?\n", rune(text[len(text)-1])) {
+		b.log.Trace().Msgf("Ended a sentence close to the deadline, after %d tokens", len(sequence))
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowModel is a fakeModel taking a second of the clock to encode each token.
+type slowModel struct {
+	fakeModel
+	clock *time.Time
+}
+
+func (m slowModel) EncodeNext(ctx context.Context, nt *ag.NodesTracker, state State, token int) (mat.Matrix, State, error) {
+	*m.clock = m.clock.Add(time.Second)
+	return m.fakeModel.EncodeNext(ctx, nt, state, token)
+}
+
+func TestDecoder_DeadlineAware(t *testing.T) {
+	decode := func(opts DecodingOptions) []int {
+		clock := time.Now()
+		m := slowModel{fakeModel: fakeModel{vocabSize: 64}, clock: &clock}
+		d, err := New(m, opts)
+		require.NoError(t, err)
+		d.now = func() time.Time { return clock }
+		// the deadline is 10 seconds of the clock after the beginning
+		ctx, cancel := context.WithDeadline(context.Background(), clock.Add(10*time.Second))
+		defer cancel()
+		chGen := make(chan GeneratedToken, opts.MaxLen)
+		input := Input{Logits: m.logits(0), State: []int{0}, Tokens: []int{0}}
+		require.NoError(t, d.Decode(ctx, &ag.NodesTracker{}, input, chGen))
+		var ids []int
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+	opts := DecodingOptions{MaxLen: 40, EndTokenID: 0, TopP: 1, Temp: 1}
+
+	assert.Len(t, decode(opts), 40, "the deadline is ignored")
+
+	opts.DeadlineAware = true
+	assert.Len(t, decode(opts), 10, "the last token ends right before the deadline")
+
+	// close to the deadline, the generation stops at the end of a sentence
+	opts.TokenText = func(id int) (string, error) {
+		if id%6 == 0 {
+			return ". ", nil
+		}
+		return "x", nil
+	}
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, decode(opts))
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	now := time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer cancel()
+	opts := DecodingOptions{DeadlineAware: true}
+	clock := func() time.Time { return now }
+
+	assert.Nil(t, newDeadlineBudget(context.Background(), opts, clock), "no deadline")
+	assert.Nil(t, newDeadlineBudget(ctx, DecodingOptions{}, clock), "not enabled")
+
+	b := newDeadlineBudget(ctx, opts, clock)
+	require.NotNil(t, b)
+	assert.Equal(t, -1, b.remaining(deadlineWarmup-1))
+	now = now.Add(10 * time.Second)
+	// a second per token: 50 seconds left, less one as a margin
+	assert.Equal(t, 49, b.remaining(10))
+}
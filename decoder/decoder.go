@@ -6,26 +6,36 @@ package decoder
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
-	"reflect"
+	"time"
 
 	"github.com/nlpodyssey/rwkv"
 	"github.com/nlpodyssey/spago/ag"
 	"github.com/nlpodyssey/spago/mat"
 	"github.com/nlpodyssey/spago/mat/float"
-	"github.com/nlpodyssey/verbaflow/encoder"
-	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/verrors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var floatNegInf = float.Interface(math.Inf(-1))
 
 type Decoder struct {
-	model              *rwkvlm.Model
-	applyOutputControl OutputDiversityControlFunc
-	applySelection     OutputSelectionFunc
-	opts               DecodingOptions
+	model          Model
+	pipeline       Pipeline
+	applySelection OutputSelectionFunc
+	opts           DecodingOptions
+	// checkFinite enables the numeric checks of the logits and of the state.
+	checkFinite bool
+	// stops matches DecodingOptions.StopRegexps, when not nil.
+	stops *stopMatcher
+	// now returns the current time, for DecodingOptions.DeadlineAware.
+	now func() time.Time
+	// log is the logger of the generation being decoded (see genid.Logger).
+	log *zerolog.Logger
 }
 
 // DecodingOptions contains the options for the conditional text generation.
@@ -36,18 +46,130 @@ type DecodingOptions struct {
 	MinLen int `json:"min_len" yaml:"min_len"`
 	// StopSequencesIDs is a list of token ids that if generated, the generation process will stop.
 	StopSequencesIDs [][]int `json:"stop_sequences_ids" yaml:"stop_sequences_ids"`
+	// StopRegexps are regular expressions stopping the generation as soon as the
+	// generated text matches them, e.g. `\n\n#{1,3} ` to stop at the next markdown
+	// heading. The text is matched incrementally: after each token, the text of the
+	// token preceded by at most StopLookbehind bytes is matched, and the matches must
+	// end in the token. The matching text is part of the generation. They require
+	// TokenText.
+	StopRegexps []string `json:"stop_regexps,omitempty" yaml:"stop_regexps,omitempty"`
+	// StopLookbehind is the number of bytes of the text generated before each token
+	// matched against StopRegexps (default: DefaultStopLookbehind).
+	StopLookbehind int `json:"stop_lookbehind,omitempty" yaml:"stop_lookbehind,omitempty"`
+	// TokenText returns the text of a token, to match StopRegexps and to end the
+	// sentences with DeadlineAware. VerbaFlow sets it with its tokenizer when nil.
+	TokenText func(tokenID int) (string, error) `json:"-" yaml:"-"`
 	// EndTokenID is the end-of-sequence token (default: 0).
 	EndTokenID int `json:"end_token_id" yaml:"end_token_id"`
 	// SkipEndTokenID when true, the end token is not added to the generated sequence.
 	SkipEndTokenID bool `json:"skip_end_token_id" yaml:"skip_end_token_id"`
 	// Temperature is the temperature used to control the randomness of the generated text.
+	// It is ignored when TempSchedule or AdaptiveTemp is set.
 	Temp float64 `json:"temp" yaml:"temp"`
+	// TempSchedule, when not nil, varies the temperature over the course of the generation.
+	TempSchedule *TempSchedule `json:"temp_schedule,omitempty" yaml:"temp_schedule,omitempty"`
+	// AdaptiveTemp, when not nil, sets the temperature of each step according to the
+	// entropy of the predicted distribution.
+	AdaptiveTemp *AdaptiveTemp `json:"adaptive_temp,omitempty" yaml:"adaptive_temp,omitempty"`
 	// TopK is the number of tokens to consider when sampling the next token.
 	TopK int `json:"top_k" yaml:"top_k"`
 	// TopP is the cumulative probability of the tokens to consider when sampling the next token.
 	TopP float64 `json:"top_p" yaml:"top_p"`
+	// RepetitionPenalty, when greater than 1, makes the tokens already generated less likely.
+	RepetitionPenalty float64 `json:"repetition_penalty,omitempty" yaml:"repetition_penalty,omitempty"`
+	// BannedTokenIDs are the tokens that are never generated.
+	BannedTokenIDs []int `json:"banned_token_ids,omitempty" yaml:"banned_token_ids,omitempty"`
+	// LogitsProcessors are custom processors applied in order to the logits of each step,
+	// at the position of the "logits_processors" stage of the Pipeline.
+	LogitsProcessors []LogitsProcessor `json:"-" yaml:"-"`
+	// Script keeps the generation in a writing system (latin, cyrillic, greek, arabic,
+	// hebrew or cjk), penalizing the tokens of the other ones, or in the one of the
+	// prompt with "auto" (see the language package). It is applied by VerbaFlow, as
+	// one of the LogitsProcessors.
+	Script string `json:"script,omitempty" yaml:"script,omitempty"`
+	// ScriptPenalty is subtracted from the logits of the tokens of the other scripts
+	// than Script; when zero, they are banned.
+	ScriptPenalty float64 `json:"script_penalty,omitempty" yaml:"script_penalty,omitempty"`
+	// NoEmoji bans the tokens of the emoji (see the tokenmask package). Like the
+	// following masks, it is applied by VerbaFlow, adding to BannedTokenIDs.
+	NoEmoji bool `json:"no_emoji,omitempty" yaml:"no_emoji,omitempty"`
+	// PrintableOnly bans the tokens with control or other non-printable characters,
+	// except for the newlines and the tabs.
+	PrintableOnly bool `json:"printable_only,omitempty" yaml:"printable_only,omitempty"`
+	// ASCIIOnly bans the tokens with non-ASCII characters.
+	ASCIIOnly bool `json:"ascii_only,omitempty" yaml:"ascii_only,omitempty"`
+	// Regexp, when not empty, constrains the whole generation to the texts matching
+	// the regular expression, followed by the end token (see the constraint
+	// package). It is applied by VerbaFlow.
+	Regexp string `json:"regexp,omitempty" yaml:"regexp,omitempty"`
+	// Choices, when not empty, constrain the whole generation to exactly one of
+	// them, followed by the end token. They are applied by VerbaFlow, which
+	// tokenizes them (see VerbaFlow.Choose).
+	Choices []string `json:"choices,omitempty" yaml:"choices,omitempty"`
+	// AcceptToken, when not nil, is called with each selected token: if it returns false,
+	// the token is banned and the next one is selected from the remaining candidates.
+	AcceptToken TokenFilter `json:"-" yaml:"-"`
+	// Pipeline is the ordered list of the sampler stages applied to the logits before
+	// the selection of the next token (see StageNames). When empty, DefaultPipeline is used.
+	// Stages missing from the list are not applied, even if configured.
+	Pipeline []string `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 	// UseSampling uses sampling to generate the next token.
+	// When false, greedy decoding is used: the most probable token is selected at
+	// each step, with ties broken in favor of the lowest token ID, so that the same
+	// prompt always produces the same output. It fails on NaN or +Inf logits.
 	UseSampling bool `json:"use_sampling" yaml:"use_sampling"`
+	// Sampler is the name of a custom selection of the next token (see RegisterSampler),
+	// used in place of the greedy decoding or of the multinomial sampling.
+	Sampler string `json:"sampler,omitempty" yaml:"sampler,omitempty"`
+	// Params contains the parameters of the custom stages and samplers, by name.
+	Params map[string]json.RawMessage `json:"params,omitempty" yaml:"params,omitempty"`
+	// RecordTiming enables the measurement of the time spent generating each token,
+	// reported in GeneratedToken.Timing.
+	RecordTiming bool `json:"record_timing,omitempty" yaml:"record_timing,omitempty"`
+	// CheckFinite enables the checks for NaN and infinite values in the logits and in
+	// the RWKV state at each step, failing with a *NonFiniteError which reports the
+	// layer and the step. They are meant to diagnose corrupted or badly quantized
+	// weights, which otherwise result in gibberish.
+	CheckFinite bool `json:"check_finite,omitempty" yaml:"check_finite,omitempty"`
+	// ClampLogits, when positive, is the fallback for the non-finite logits: instead
+	// of failing, the logits are clamped to [-ClampLogits, ClampLogits], the NaN
+	// becoming -ClampLogits. It enables the numeric checks.
+	ClampLogits float64 `json:"clamp_logits,omitempty" yaml:"clamp_logits,omitempty"`
+	// TraceStateNorms logs the L2 norm of each tensor of the RWKV state of each layer
+	// at each step, at the trace level (see StateNorms), to diagnose the saturation
+	// of the state in the very long generations.
+	TraceStateNorms bool `json:"trace_state_norms,omitempty" yaml:"trace_state_norms,omitempty"`
+	// PromptChunkSize is the number of prompt tokens encoded at a time, between which
+	// the cancellation of the context is checked (default: rwkvlm.DefaultEncodeChunkSize).
+	PromptChunkSize int `json:"prompt_chunk_size,omitempty" yaml:"prompt_chunk_size,omitempty"`
+	// PromptProgress, when not nil, is called after each chunk of the prompt is
+	// encoded, with the number of tokens encoded so far and the total, e.g. to show
+	// a progress bar.
+	PromptProgress func(encoded, total int) `json:"-" yaml:"-"`
+	// FinalState, when not nil, is called at the end of a successful decoding with
+	// the input continuing the generation: the state after the generated tokens
+	// (the end token excluded), the logits of the next token, and the tokens of the
+	// prompt followed by the generated ones. Its state and logits are released with
+	// the nodes of the decoding, unless cloned (see StateCloner).
+	FinalState func(Input) `json:"-" yaml:"-"`
+	// SequentialPrompt encodes the prompt one token after the other, with the
+	// recurrent formulation of RWKV, instead of the faster parallel one.
+	SequentialPrompt bool `json:"sequential_prompt,omitempty" yaml:"sequential_prompt,omitempty"`
+	// EnsemblePooling is the pooling of the predictions of the prompt variants decoded
+	// together (see Ensemble), PoolMean (default) or PoolMax.
+	EnsemblePooling string `json:"ensemble_pooling,omitempty" yaml:"ensemble_pooling,omitempty"`
+	// LengthPenalty is the exponent alpha of the length normalization of the scores
+	// reported to the clients, SumNegLogProbs / length^alpha (see NormalizeScore):
+	// 0 (default) reports the raw sums, 1 the average per token.
+	LengthPenalty float64 `json:"length_penalty,omitempty" yaml:"length_penalty,omitempty"`
+	// DeadlineAware caps the generation to the tokens which can be generated before
+	// the deadline of the context, estimated from the time of the first steps, so
+	// that it ends before being aborted: close to the deadline, it stops at the
+	// first end of a sentence, if TokenText is set. It has no effect without a deadline.
+	DeadlineAware bool `json:"deadline_aware,omitempty" yaml:"deadline_aware,omitempty"`
+	// Seed initializes the random generator used for sampling, making the generation reproducible.
+	// When zero (default), the shared non-deterministic generator is used.
+	Seed uint64 `json:"seed" yaml:"seed"`
 }
 
 // GeneratedToken is the result of a single step of the decoder.
@@ -56,78 +178,227 @@ type GeneratedToken struct {
 	TokenID int
 	// SumNegLogProbs is the sum of the negative log probabilities up to the current step.
 	SumNegLogProbs float64
+	// Timing is the time spent generating the token, when DecodingOptions.RecordTiming is true.
+	Timing *TokenTiming `json:"-"`
 }
 
-func New(m *rwkvlm.Model, opts DecodingOptions) (*Decoder, error) {
-	dc, err := OutputDiversityControl(opts.Temp, opts.TopK, opts.TopP)
+// TokenTiming is the breakdown of the time spent generating a token.
+//
+// Embedding and Encoder refer to the forward pass producing the hidden state the token
+// is predicted from: that of the prompt for the first token, and that of the previous
+// token afterwards.
+type TokenTiming struct {
+	// Embedding is the time spent looking up the embeddings in the store.
+	Embedding time.Duration
+	// Encoder is the time spent running the RWKV layers.
+	Encoder time.Duration
+	// Head is the time spent computing the logits (final layer-norm and LM head).
+	Head time.Duration
+	// Sampling is the time spent processing the logits and selecting the token.
+	Sampling time.Duration
+	// Detokenize is the time spent decoding the token text. It is measured by
+	// the consumers of the generated tokens, and zero when reported by the decoder.
+	Detokenize time.Duration
+}
+
+// New returns a Decoder generating the tokens with the given model.
+func New(m Model, opts DecodingOptions) (*Decoder, error) {
+	p, err := NewPipeline(opts)
+	if err != nil {
+		return nil, err
+	}
+	selection := OutputSelection(opts.UseSampling, opts.Seed)
+	if opts.Sampler != "" {
+		if selection, err = newSampler(opts); err != nil {
+			return nil, err
+		}
+	}
+	stops, err := newStopMatcher(opts)
 	if err != nil {
 		return nil, err
 	}
 	return &Decoder{
-		model:              m,
-		opts:               opts,
-		applyOutputControl: dc,
-		applySelection:     OutputSelection(opts.UseSampling),
+		model:          m,
+		opts:           opts,
+		pipeline:       p,
+		applySelection: selection,
+		checkFinite:    numericChecks(opts),
+		stops:          stops,
+		now:            time.Now,
 	}, nil
 }
 
-func (d *Decoder) Decode(ctx context.Context, nt *ag.NodesTracker, input encoder.Result, chGen chan GeneratedToken) error {
+// Decode generates the tokens following the encoded input, sending them to chGen,
+// which is closed when Decode returns. If the context is done before the end of
+// the generation, it fails with verrors.ErrDecodingAborted.
+//
+// A panic during the decoding is recovered and returned as a *verrors.PanicError,
+// not to affect the other generations of the process.
+func (d *Decoder) Decode(ctx context.Context, nt *ag.NodesTracker, input Input, chGen chan GeneratedToken) (err error) {
 	defer close(chGen)
+	d.log = genid.Logger(ctx)
+	defer func() {
+		if r := recover(); r != nil {
+			pe := verrors.Recovered(r)
+			d.log.Error().Str("stack", string(pe.Stack)).Msgf("recovered from panic during the decoding: %v", r)
+			err = pe
+		}
+	}()
 
-	x, s := input.Encoding, input.State
-	if x == nil || s == nil {
-		return fmt.Errorf("invalid input: hidden representation and state are required")
+	logits, s := input.Logits, input.State
+	if logits == nil || s == nil {
+		return fmt.Errorf("invalid input: logits and state are required")
 	}
 
+	if d.stops != nil {
+		d.stops.reset(d.log)
+	}
+	budget := newDeadlineBudget(ctx, d.opts, d.now)
 	var sequence []int
 	var sumNegLogProbs float64
+	var timing *TokenTiming
+	if d.opts.RecordTiming {
+		timing = &TokenTiming{}
+		*timing = input.Timing
+	}
 
 Loop:
 	for i := 0; ; i++ {
 		select {
 		case <-ctx.Done():
-			log.Trace().Msgf("Generation cancelled after %d steps due to context cancellation", i)
-			break Loop
+			return d.aborted(ctx, i, s)
 		default:
-			tokenID, tokenScore, err := d.generateToken(ctx, x, i, nt)
+			if rs, ok := s.(rwkv.State); ok {
+				if d.checkFinite {
+					if err := d.checkState(len(sequence), rs); err != nil {
+						return err
+					}
+				}
+				if d.opts.TraceStateNorms {
+					d.traceStateNorms(len(sequence), rs)
+				}
+			}
+			tokenID, tokenScore, err := d.generateToken(logits, input.Tokens, sequence, timing)
 			if err != nil {
 				return err
 			}
 			sequence = append(sequence, tokenID)
 			sumNegLogProbs -= math.Log(tokenScore)
 
-			chGen <- GeneratedToken{
+			select {
+			case chGen <- GeneratedToken{
 				TokenID:        tokenID,
 				SumNegLogProbs: sumNegLogProbs,
+				Timing:         timing,
+			}:
+			case <-ctx.Done():
+				// the consumer may have stopped reading
+				return d.aborted(ctx, i, s)
+			}
+			if timing != nil {
+				timing = &TokenTiming{}
 			}
 
-			if d.checkStopConditions(sequence) {
+			stop, err := d.checkStopConditions(sequence)
+			if err != nil {
+				return err
+			}
+			if !stop && budget != nil {
+				if stop, err = budget.stop(sequence); err != nil {
+					return err
+				}
+			}
+			if stop {
 				break Loop
 			}
 
-			// update the hidden representation `x` with the result of encoding the last generated token,
-			// which is used as input for the next iteration of the loop.
-			x, err = d.encode(ctx, nt, tokenID, s)
+			// the logits of the next iteration of the loop follow the last generated token
+			logits, s, err = d.encode(ctx, nt, tokenID, s, timing)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	log.Trace().Msgf("[%.2f] Generated token IDs: %v", sumNegLogProbs, sequence)
+	d.log.Trace().Msgf("[%.2f] Generated token IDs: %v", sumNegLogProbs, sequence)
 
+	if d.opts.FinalState != nil {
+		return d.finalState(ctx, nt, input, sequence, logits, s)
+	}
 	return nil
 }
 
-// generateToken performs a single step of the decoding process.
-// It returns the selected output token ID and its score.
-func (d *Decoder) generateToken(_ context.Context, x ag.Node, seqLen int, nt *ag.NodesTracker) (int, float64, error) {
-	logits := nt.TrackNode(d.model.Predict(x))
-	candidates, err := d.applyOutputControl(d.adjustLogits(logits.Value(), seqLen))
+// finalState passes to DecodingOptions.FinalState the input following the
+// generated sequence, given the logits and the state before its last token.
+func (d *Decoder) finalState(ctx context.Context, nt *ag.NodesTracker, input Input, sequence []int, logits mat.Matrix, s State) error {
+	tokens := append(input.Tokens[:len(input.Tokens):len(input.Tokens)], sequence...)
+	if last := sequence[len(sequence)-1]; last == d.opts.EndTokenID {
+		// the next token follows the text, not the end token
+		tokens = tokens[:len(tokens)-1]
+	} else {
+		var err error
+		if logits, s, err = d.encode(ctx, nt, last, s, nil); err != nil {
+			return err
+		}
+	}
+	d.opts.FinalState(Input{Logits: logits, State: s, Tokens: tokens})
+	return nil
+}
+
+// generateToken performs a single step of the decoding process, given the logits, the
+// prompt and the tokens generated so far. It returns the selected output token ID and its score.
+// If timing is not nil, the time spent is recorded there.
+func (d *Decoder) generateToken(logits mat.Matrix, prompt, sequence []int, timing *TokenTiming) (int, float64, error) {
+	start := time.Now()
+	if d.checkFinite {
+		var err error
+		if logits, err = d.checkLogits(len(sequence), logits); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	info := StepInfo{Step: len(sequence), Sequence: sequence, Prompt: prompt}
+	candidates, err := d.pipeline.Apply(info, d.adjustLogits(logits, len(sequence)))
 	if err != nil {
 		return 0, 0, err
 	}
-	return d.applySelection(candidates)
+	tokenID, score, err := d.selectToken(info, candidates)
+	if timing != nil {
+		timing.Sampling = time.Since(start)
+	}
+	return tokenID, score, err
+}
+
+// maxRejections is the maximum number of tokens rejected by DecodingOptions.AcceptToken
+// at each step, after which the generation fails.
+const maxRejections = 100
+
+// TokenFilter accepts or rejects the token selected at the given step.
+type TokenFilter func(info StepInfo, tokenID int) (bool, error)
+
+// selectToken selects the next token among the candidates, excluding the ones
+// rejected by DecodingOptions.AcceptToken.
+func (d *Decoder) selectToken(info StepInfo, candidates mat.Matrix) (int, float64, error) {
+	tokenID, score, err := d.applySelection(candidates)
+	if err != nil || d.opts.AcceptToken == nil {
+		return tokenID, score, err
+	}
+	for i := 0; ; i++ {
+		ok, err := d.opts.AcceptToken(info, tokenID)
+		if err != nil || ok {
+			return tokenID, score, err
+		}
+		if i == maxRejections {
+			return 0, 0, fmt.Errorf("no acceptable token after %d rejections", maxRejections)
+		}
+		if i == 0 {
+			candidates = candidates.Clone()
+		}
+		candidates.SetVecScalar(tokenID, floatNegInf)
+		if tokenID, score, err = d.applySelection(candidates); err != nil {
+			return 0, 0, err
+		}
+	}
 }
 
 // adjustLogits checks if the sequence is too short and if so, set the logits of the end token to a very low value.
@@ -135,62 +406,77 @@ func (d *Decoder) adjustLogits(logits mat.Matrix, sequenceLength int) mat.Matrix
 	if sequenceLength >= d.opts.MinLen {
 		return logits
 	}
-	log.Trace().Msgf("Sequence too short (%d), setting end token (%d) logits to -inf", sequenceLength, d.opts.EndTokenID)
+	d.logger().Trace().Msgf("Sequence too short (%d), setting end token (%d) logits to -inf", sequenceLength, d.opts.EndTokenID)
 	logits.SetVecScalar(d.opts.EndTokenID, floatNegInf)
 	return logits
 }
 
-func (d *Decoder) checkStopConditions(sequence []int) bool {
+func (d *Decoder) checkStopConditions(sequence []int) (bool, error) {
 	if len(sequence) >= d.opts.MaxLen {
-		log.Trace().Msgf("Reached max length (%d)", d.opts.MaxLen)
-		return true
+		d.logger().Trace().Msgf("Reached max length (%d)", d.opts.MaxLen)
+		return true, nil
 	}
 	last := sequence[len(sequence)-1]
 	if last == d.opts.EndTokenID {
-		log.Trace().Msgf("Reached end token (%d)", d.opts.EndTokenID)
-		return true
+		d.logger().Trace().Msgf("Reached end token (%d)", d.opts.EndTokenID)
+		return true, nil
 	}
-	if len(sequence) >= d.opts.MinLen && hasStopSequence(sequence, d.opts.StopSequencesIDs) {
-		return true
+	if d.stops != nil {
+		// the stops are matched at each step, to keep their state up to date
+		matched, err := d.stops.next(last)
+		if err != nil {
+			return false, err
+		}
+		if matched && len(sequence) >= d.opts.MinLen {
+			return true, nil
+		}
 	}
-	return false
+	return false, nil
 }
 
-func hasStopSequence(sequence []int, stopSequences [][]int) bool {
-	for _, stopSeq := range stopSequences {
-		if len(sequence) < len(stopSeq) {
-			continue
-		}
-
-		if reflect.DeepEqual(stopSeq, sequence[len(sequence)-len(stopSeq):]) {
-			log.Trace().Msgf("Reached stop sequence %v", stopSeq)
-			return true
-		}
+// logger returns the logger of the generation being decoded, or the global
+// logger outside of Decode.
+func (d *Decoder) logger() *zerolog.Logger {
+	if d.log == nil {
+		return &log.Logger
 	}
-	return false
+	return d.log
 }
 
-func (d *Decoder) encode(ctx context.Context, nt *ag.NodesTracker, tokenID int, state rwkv.State) (ag.Node, error) {
-	x, s := d.model.Encode(ctx, state, tokenID)
-	nt.TrackNodes(waitForNodes(extractNodesToRelease(x, s))...)
-	return x, nil
+// aborted returns the error of a decoding cancelled by ctx after the given steps,
+// once the computation of the state s is over.
+func (d *Decoder) aborted(ctx context.Context, steps int, s State) error {
+	d.log.Trace().Msgf("Generation cancelled after %d steps due to context cancellation", steps)
+	waitState(s)
+	return fmt.Errorf("%w after %d tokens: %w", verrors.ErrDecodingAborted, steps, ctx.Err())
 }
 
-// waitForNodes waits for the nodes to be computed.
-// It is used to ensure that the nodes are computed before releasing them.
-func waitForNodes(nodes []ag.Node) []ag.Node {
-	for _, n := range nodes {
-		n.Value()
+// waitState waits for the values of the RWKV state to be computed, so that the
+// operators of an aborted generation are not running anymore when Decode returns,
+// and the caller can release the graph.
+func waitState(s State) {
+	rs, ok := s.(rwkv.State)
+	if !ok {
+		return
+	}
+	for _, layer := range rs {
+		for _, t := range stateTensors(layer) {
+			ag.WaitForValue(t.node)
+		}
 	}
-	return nodes
 }
 
-// extractNodesToRelease extracts the nodes to release from the states.
-// It also considers the explicit x node.
-func extractNodesToRelease(x ag.Node, s rwkv.State) []ag.Node {
-	nodes := []ag.Node{x}
-	for _, layer := range s {
-		nodes = append(nodes, layer.FfnXX, layer.AttXX, layer.AttAA, layer.AttBB, layer.AttPP)
+// encode encodes the token with the model, returning the logits of the next one.
+// If timing is not nil, the time spent is recorded there.
+func (d *Decoder) encode(ctx context.Context, nt *ag.NodesTracker, tokenID int, state State, timing *TokenTiming) (mat.Matrix, State, error) {
+	if timing == nil {
+		return d.model.EncodeNext(ctx, nt, state, tokenID)
+	}
+	if m, ok := d.model.(TimedModel); ok {
+		return m.EncodeNextTimed(ctx, nt, state, tokenID, timing)
 	}
-	return nodes
+	start := time.Now()
+	logits, s, err := d.model.EncodeNext(ctx, nt, state, tokenID)
+	timing.Encoder = time.Since(start)
+	return logits, s, err
 }
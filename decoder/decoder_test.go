@@ -0,0 +1,79 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeModel predicts the token following the last one, in a vocabulary of
+// vocabSize tokens, its state being the tokens encoded so far.
+type fakeModel struct {
+	vocabSize int
+}
+
+func (m fakeModel) logits(token int) mat.Matrix {
+	logits := make([]float32, m.vocabSize)
+	logits[(token+1)%m.vocabSize] = 10
+	return mat.NewVecDense(logits)
+}
+
+func (m fakeModel) EncodeNext(_ context.Context, _ *ag.NodesTracker, state State, token int) (mat.Matrix, State, error) {
+	return m.logits(token), append(state.([]int), token), nil
+}
+
+func decodeAll(t *testing.T, m Model, opts DecodingOptions, input Input) []GeneratedToken {
+	t.Helper()
+	d, err := New(m, opts)
+	require.NoError(t, err)
+	chGen := make(chan GeneratedToken, opts.MaxLen)
+	require.NoError(t, d.Decode(context.Background(), &ag.NodesTracker{}, input, chGen))
+	var generated []GeneratedToken
+	for gen := range chGen {
+		generated = append(generated, gen)
+	}
+	return generated
+}
+
+func TestDecoder_FakeModel(t *testing.T) {
+	m := fakeModel{vocabSize: 8}
+	input := Input{Logits: m.logits(2), State: []int{1, 2}, Tokens: []int{1, 2}}
+	opts := DecodingOptions{MaxLen: 4, EndTokenID: 0, TopP: 1, Temp: 1}
+
+	ids := func(generated []GeneratedToken) []int {
+		var ids []int
+		for _, gen := range generated {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+	assert.Equal(t, []int{3, 4, 5, 6}, ids(decodeAll(t, m, opts, input)))
+
+	opts.MaxLen = 10
+	assert.Equal(t, []int{3, 4, 5, 6, 7, 0}, ids(decodeAll(t, m, opts, input)))
+
+	opts.StopSequencesIDs = [][]int{{4, 5}}
+	assert.Equal(t, []int{3, 4, 5}, ids(decodeAll(t, m, opts, input)))
+
+	opts.RecordTiming = true
+	generated := decodeAll(t, m, opts, input)
+	require.NotNil(t, generated[1].Timing)
+	// the time spent by the models other than TimedModel is reported as encoder time
+	assert.Zero(t, generated[1].Timing.Embedding)
+	assert.Zero(t, generated[1].Timing.Head)
+}
+
+func TestDecoder_InvalidInput(t *testing.T) {
+	d, err := New(fakeModel{vocabSize: 8}, DecodingOptions{MaxLen: 4, TopP: 1, Temp: 1})
+	require.NoError(t, err)
+	err = d.Decode(context.Background(), &ag.NodesTracker{}, Input{}, make(chan GeneratedToken, 4))
+	assert.EqualError(t, err, "invalid input: logits and state are required")
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+)
+
+// The poolings of the log-probabilities of the prompts of an Ensemble.
+const (
+	// PoolMean averages the log-probabilities, i.e. the next token is predicted
+	// from the normalized geometric mean of the distributions.
+	PoolMean = "mean"
+	// PoolMax takes the maximum log-probability of each token, favoring the tokens
+	// any of the prompts is confident about.
+	PoolMax = "max"
+)
+
+// Ensemble is a Model decoding multiple variants of the same prompt at once
+// (mixture of prompts): it keeps a state of the underlying model per prompt,
+// encodes each generated token in all of them, and combines their predictions
+// with the pooling of their log-probabilities. It usually improves the answers
+// of the small models, which are sensitive to the wording of the prompt, at the
+// cost of an encoding per prompt.
+type Ensemble struct {
+	model   Model
+	pooling string
+}
+
+// NewEnsemble returns an Ensemble of the given model, combining the predictions
+// with the given pooling, PoolMean (default, if empty) or PoolMax.
+func NewEnsemble(m Model, pooling string) (*Ensemble, error) {
+	switch pooling {
+	case "":
+		pooling = PoolMean
+	case PoolMean, PoolMax:
+	default:
+		return nil, fmt.Errorf("unknown ensemble pooling %q", pooling)
+	}
+	return &Ensemble{model: m, pooling: pooling}, nil
+}
+
+// ensembleState is the state of an Ensemble, with a state per prompt.
+type ensembleState []State
+
+// Input returns the input of the decoding following the inputs of the prompts:
+// its logits are the pooled ones, and its tokens those of the first prompt.
+func (e *Ensemble) Input(inputs []Input) (Input, error) {
+	if len(inputs) == 0 {
+		return Input{}, fmt.Errorf("ensemble: no prompts")
+	}
+	s := make(ensembleState, len(inputs))
+	logits := make([]mat.Matrix, len(inputs))
+	var timing TokenTiming
+	for i, in := range inputs {
+		s[i], logits[i] = in.State, in.Logits
+		timing.Embedding += in.Timing.Embedding
+		timing.Encoder += in.Timing.Encoder
+		timing.Head += in.Timing.Head
+	}
+	return Input{
+		Logits: e.pool(logits),
+		State:  s,
+		Tokens: inputs[0].Tokens,
+		Timing: timing,
+	}, nil
+}
+
+// EncodeNext implements Model, encoding the token in the state of each prompt.
+func (e *Ensemble) EncodeNext(ctx context.Context, nt *ag.NodesTracker, state State, token int) (mat.Matrix, State, error) {
+	s, ok := state.(ensembleState)
+	if !ok {
+		return nil, nil, fmt.Errorf("ensemble: invalid state of type %T", state)
+	}
+	next := make(ensembleState, len(s))
+	logits := make([]mat.Matrix, len(s))
+	for i, ps := range s {
+		var err error
+		if logits[i], next[i], err = e.model.EncodeNext(ctx, nt, ps, token); err != nil {
+			return nil, nil, err
+		}
+	}
+	return e.pool(logits), next, nil
+}
+
+// pool returns the pooling of the log-probabilities of the given logits.
+func (e *Ensemble) pool(logits []mat.Matrix) mat.Matrix {
+	out := logSoftmax(logits[0].Data().F64())
+	for _, l := range logits[1:] {
+		for j, v := range logSoftmax(l.Data().F64()) {
+			if e.pooling == PoolMax {
+				out[j] = math.Max(out[j], v)
+			} else {
+				out[j] += v
+			}
+		}
+	}
+	if e.pooling == PoolMean {
+		for j := range out {
+			out[j] /= float64(len(logits))
+		}
+	}
+	return logits[0].NewVec(float.SliceInterface(out))
+}
+
+func logSoftmax(x []float64) []float64 {
+	maxValue := math.Inf(-1)
+	for _, v := range x {
+		maxValue = math.Max(maxValue, v)
+	}
+	var sum float64
+	for _, v := range x {
+		sum += math.Exp(v - maxValue)
+	}
+	logZ := maxValue + math.Log(sum)
+	out := make([]float64, len(x))
+	for i, v := range x {
+		out[i] = v - logZ
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shiftState is the state of shiftModel, standing for a prompt variant.
+type shiftState struct {
+	shift      int
+	confidence float32
+}
+
+// shiftModel predicts the token shift positions after the last one, with the
+// confidence of the state, in a vocabulary of vocabSize tokens.
+type shiftModel struct {
+	vocabSize int
+}
+
+func (m shiftModel) logits(s shiftState, token int) mat.Matrix {
+	logits := make([]float32, m.vocabSize)
+	logits[(token+s.shift)%m.vocabSize] = s.confidence
+	return mat.NewVecDense(logits)
+}
+
+func (m shiftModel) EncodeNext(_ context.Context, _ *ag.NodesTracker, state State, token int) (mat.Matrix, State, error) {
+	s := state.(shiftState)
+	return m.logits(s, token), s, nil
+}
+
+func TestEnsemble(t *testing.T) {
+	m := shiftModel{vocabSize: 8}
+	// a confident prompt, outvoted by the two others
+	states := []shiftState{{shift: 1, confidence: 12}, {shift: 2, confidence: 10}, {shift: 2, confidence: 10}}
+	inputs := make([]Input, len(states))
+	for i, s := range states {
+		inputs[i] = Input{Logits: m.logits(s, 2), State: s, Tokens: []int{i, 2}}
+	}
+	opts := DecodingOptions{MaxLen: 3, EndTokenID: -1, TopP: 1, Temp: 1}
+
+	for pooling, want := range map[string][]int{
+		"":       {4, 6, 0},
+		PoolMean: {4, 6, 0},
+		PoolMax:  {3, 4, 5},
+	} {
+		e, err := NewEnsemble(m, pooling)
+		require.NoError(t, err)
+		input, err := e.Input(inputs)
+		require.NoError(t, err)
+		assert.Equal(t, []int{0, 2}, input.Tokens)
+
+		var ids []int
+		for _, gen := range decodeAll(t, e, opts, input) {
+			ids = append(ids, gen.TokenID)
+		}
+		assert.Equal(t, want, ids, pooling)
+	}
+
+	_, err := NewEnsemble(m, "median")
+	assert.EqualError(t, err, `unknown ensemble pooling "median"`)
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// SinkPolicy is what a Sink does when it is full, its consumer being slower than
+// the generation.
+type SinkPolicy int
+
+const (
+	// SinkBlock pauses the generation until the consumer catches up: the other
+	// sinks are paused too.
+	SinkBlock SinkPolicy = iota
+	// SinkDrop drops the tokens the consumer can't keep up with, counting them.
+	SinkDrop
+	// SinkDetach detaches the sink from the generation, closing it, so that a
+	// consumer which stalled doesn't affect the others.
+	SinkDetach
+)
+
+func (p SinkPolicy) String() string {
+	switch p {
+	case SinkBlock:
+		return "block"
+	case SinkDrop:
+		return "drop"
+	case SinkDetach:
+		return "detach"
+	default:
+		return fmt.Sprintf("SinkPolicy(%d)", int(p))
+	}
+}
+
+// Sink is a consumer of the tokens of a generation, one of many attached to it
+// by FanOut, e.g. to stream it to a client while writing it to a file. Each sink
+// has its own buffer and policy.
+type Sink struct {
+	ch       chan GeneratedToken
+	policy   SinkPolicy
+	dropped  atomic.Int64
+	detached atomic.Bool
+}
+
+// NewSink returns a sink buffering up to size tokens, applying the policy when
+// the buffer is full.
+func NewSink(size int, policy SinkPolicy) *Sink {
+	if size < 0 {
+		size = 0
+	}
+	return &Sink{ch: make(chan GeneratedToken, size), policy: policy}
+}
+
+// C returns the channel of the tokens, closed at the end of the generation, or
+// when the sink is detached.
+func (s *Sink) C() <-chan GeneratedToken {
+	return s.ch
+}
+
+// Dropped returns the number of tokens dropped by the SinkDrop policy so far.
+func (s *Sink) Dropped() int {
+	return int(s.dropped.Load())
+}
+
+// Detached reports whether the sink was detached by the SinkDetach policy.
+func (s *Sink) Detached() bool {
+	return s.detached.Load()
+}
+
+// offer sends the token without blocking, applying the policy if the buffer is
+// full. It reports whether the sink must be waited for, with SinkBlock.
+func (s *Sink) offer(gen GeneratedToken) bool {
+	select {
+	case s.ch <- gen:
+		return false
+	default:
+	}
+	switch s.policy {
+	case SinkDrop:
+		s.dropped.Add(1)
+	case SinkDetach:
+		s.detached.Store(true)
+		close(s.ch)
+	default:
+		return true
+	}
+	return false
+}
+
+// FanOut returns the channel to pass to Decoder.Decode to send the tokens of the
+// generation to all the sinks: the tokens are offered to all of them first, then
+// the generation waits for the SinkBlock ones which are full. The sinks are
+// closed when the channel is. Once the context is done, the tokens are
+// discarded, so that the decoder never blocks.
+func FanOut(ctx context.Context, size int, sinks ...*Sink) chan GeneratedToken {
+	in := make(chan GeneratedToken, size)
+	go func() {
+		defer func() {
+			for _, s := range sinks {
+				if !s.Detached() {
+					close(s.ch)
+				}
+			}
+		}()
+		var waiting []*Sink
+		for gen := range in {
+			if ctx.Err() != nil {
+				continue
+			}
+			waiting = waiting[:0]
+			for _, s := range sinks {
+				if !s.Detached() && s.offer(gen) {
+					waiting = append(waiting, s)
+				}
+			}
+			for _, s := range waiting {
+				select {
+				case s.ch <- gen:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+	return in
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanOut(t *testing.T) {
+	m := fakeModel{vocabSize: 8}
+	input := Input{Logits: m.logits(0), State: []int{0}, Tokens: []int{0}}
+	d, err := New(m, DecodingOptions{MaxLen: 10, EndTokenID: 0, TopP: 1, Temp: 1})
+	require.NoError(t, err)
+
+	block := NewSink(0, SinkBlock)
+	drop := NewSink(2, SinkDrop)
+	detach := NewSink(1, SinkDetach)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.Decode(context.Background(), &ag.NodesTracker{}, input, FanOut(context.Background(), 0, block, drop, detach))
+	}()
+	ids := func(s *Sink) []int {
+		var ids []int
+		for gen := range s.C() {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+	// the blocking sink, read as the tokens are generated, receives them all
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 0}, ids(block))
+	require.NoError(t, <-errCh)
+	// the others, never read during the generation, have kept what they could
+	assert.Equal(t, []int{1, 2}, ids(drop))
+	assert.Equal(t, 6, drop.Dropped())
+	assert.Equal(t, []int{1}, ids(detach))
+	assert.True(t, detach.Detached())
+	assert.False(t, block.Detached())
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+)
+
+// NonFiniteError is the error returned by the numeric checks (see
+// DecodingOptions.CheckFinite) when a tensor contains NaN or infinite values,
+// typically because of corrupted or badly quantized weights.
+type NonFiniteError struct {
+	// Step is the decoding step, i.e. the number of tokens generated so far.
+	Step int
+	// Layer is the index of the layer of the state, or -1 for the logits.
+	Layer int
+	// Tensor is the name of the tensor, e.g. "logits" or "att_pp".
+	Tensor string
+	// Index is the index of the first non-finite value of the tensor.
+	Index int
+	// Value is the first non-finite value of the tensor.
+	Value float64
+}
+
+func (e *NonFiniteError) Error() string {
+	if e.Layer < 0 {
+		return fmt.Sprintf("non-finite value %v at index %d of the %s at step %d", e.Value, e.Index, e.Tensor, e.Step)
+	}
+	return fmt.Sprintf("non-finite value %v at index %d of the %s state of layer %d at step %d", e.Value, e.Index, e.Tensor, e.Layer, e.Step)
+}
+
+// numericChecks reports whether the numeric checks are enabled, by CheckFinite
+// or by ClampLogits.
+func numericChecks(opts DecodingOptions) bool {
+	return opts.CheckFinite || opts.ClampLogits > 0
+}
+
+// checkState fails with a *NonFiniteError if the RWKV state has NaN or infinite values.
+func (d *Decoder) checkState(step int, s rwkv.State) error {
+	for i, layer := range s {
+		for _, t := range stateTensors(layer) {
+			if index, value, ok := findNonFinite(t.node.Value()); ok {
+				return &NonFiniteError{Step: step, Layer: i, Tensor: t.name, Index: index, Value: value}
+			}
+		}
+	}
+	return nil
+}
+
+type stateTensor struct {
+	name string
+	node ag.Node
+}
+
+// stateTensors returns the tensors of the state of a layer, with their names.
+func stateTensors(layer *rwkv.LayerState) []stateTensor {
+	return []stateTensor{
+		{"ffn_xx", layer.FfnXX},
+		{"att_xx", layer.AttXX},
+		{"att_aa", layer.AttAA},
+		{"att_bb", layer.AttBB},
+		{"att_pp", layer.AttPP},
+	}
+}
+
+// checkLogits fails with a *NonFiniteError if the logits have NaN or infinite
+// values, unless DecodingOptions.ClampLogits is set: then, the logits are clamped.
+func (d *Decoder) checkLogits(step int, logits mat.Matrix) (mat.Matrix, error) {
+	index, value, ok := findNonFinite(logits)
+	if !ok {
+		return logits, nil
+	}
+	err := &NonFiniteError{Step: step, Layer: -1, Tensor: "logits", Index: index, Value: value}
+	if d.opts.ClampLogits <= 0 {
+		return nil, err
+	}
+	d.logger().Warn().Err(err).Msgf("clamping the logits to ±%g", d.opts.ClampLogits)
+	return clampLogits(logits, d.opts.ClampLogits), nil
+}
+
+// findNonFinite returns the index and the value of the first NaN or infinite
+// value of m, if any.
+func findNonFinite(m mat.Matrix) (int, float64, bool) {
+	for i, v := range m.Data().F64() {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return i, v, true
+		}
+	}
+	return 0, 0, false
+}
+
+// clampLogits returns a copy of the logits clamped to [-limit, limit], with
+// the NaN values replaced by -limit.
+func clampLogits(logits mat.Matrix, limit float64) mat.Matrix {
+	data := logits.Data().F64()
+	clamped := make([]float64, len(data))
+	for i, v := range data {
+		switch {
+		case math.IsNaN(v) || v < -limit:
+			clamped[i] = -limit
+		case v > limit:
+			clamped[i] = limit
+		default:
+			clamped[i] = v
+		}
+	}
+	return logits.NewVec(float.SliceInterface(clamped))
+}
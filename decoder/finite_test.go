@@ -0,0 +1,66 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoder_CheckLogits(t *testing.T) {
+	d := &Decoder{opts: DecodingOptions{CheckFinite: true}}
+
+	logits := mat.NewVecDense([]float32{1, 2, 3})
+	checked, err := d.checkLogits(0, logits)
+	require.NoError(t, err)
+	assert.Same(t, logits, checked)
+
+	logits = mat.NewVecDense([]float32{1, float32(math.Inf(1)), float32(math.NaN()), -50})
+	_, err = d.checkLogits(3, logits)
+	var nfErr *NonFiniteError
+	require.ErrorAs(t, err, &nfErr)
+	assert.Equal(t, NonFiniteError{Step: 3, Layer: -1, Tensor: "logits", Index: 1, Value: math.Inf(1)}, *nfErr)
+
+	d.opts.ClampLogits = 30
+	checked, err = d.checkLogits(3, logits)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{1, 30, -30, -30}, checked.Data().F32())
+}
+
+func TestDecoder_CheckState(t *testing.T) {
+	d := &Decoder{opts: DecodingOptions{CheckFinite: true}}
+	s := rwkv.NewState(rwkv.Config{DModel: 2, NumLayers: 2})
+	require.NoError(t, d.checkState(0, s))
+
+	s[1].AttAA = ag.Var(mat.NewVecDense([]float32{0, float32(math.NaN())}))
+	err := d.checkState(5, s)
+	var nfErr *NonFiniteError
+	require.ErrorAs(t, err, &nfErr)
+	assert.Equal(t, 1, nfErr.Layer)
+	assert.Equal(t, "att_aa", nfErr.Tensor)
+	assert.Equal(t, 5, nfErr.Step)
+	assert.EqualError(t, err, "non-finite value NaN at index 1 of the att_aa state of layer 1 at step 5")
+}
+
+func TestNew_NumericChecks(t *testing.T) {
+	// the log level does not enable the checks, which are off by default
+	d, err := New(fakeModel{vocabSize: 8}, DecodingOptions{MaxLen: 4, TopP: 1, Temp: 1})
+	require.NoError(t, err)
+	assert.False(t, d.checkFinite)
+
+	d, err = New(fakeModel{vocabSize: 8}, DecodingOptions{MaxLen: 4, TopP: 1, Temp: 1, CheckFinite: true})
+	require.NoError(t, err)
+	assert.True(t, d.checkFinite)
+
+	d, err = New(fakeModel{vocabSize: 8}, DecodingOptions{MaxLen: 4, TopP: 1, Temp: 1, ClampLogits: 30})
+	require.NoError(t, err)
+	assert.True(t, d.checkFinite)
+}
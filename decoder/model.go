@@ -0,0 +1,80 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+)
+
+// Model is the language model driven by the Decoder. It is implemented by
+// rwkvlm.Model, and can be implemented by other backends, or faked in the tests.
+type Model interface {
+	// EncodeNext encodes the token following the given state, returning the
+	// logits of the next token and the state after the token. The nodes of the
+	// computational graph are tracked in nt, released at the end of the generation.
+	EncodeNext(ctx context.Context, nt *ag.NodesTracker, state State, token int) (mat.Matrix, State, error)
+}
+
+// TimedModel is a Model reporting the breakdown of the time spent in EncodeNext,
+// used with DecodingOptions.RecordTiming. For the other models, the time is all
+// reported as TokenTiming.Encoder.
+type TimedModel interface {
+	Model
+	// EncodeNextTimed is EncodeNext, recording the time spent in the Embedding,
+	// Encoder and Head fields of timing, if not nil.
+	EncodeNextTimed(ctx context.Context, nt *ag.NodesTracker, state State, token int, timing *TokenTiming) (mat.Matrix, State, error)
+}
+
+// State is the state of a Model after a sequence of tokens, opaque to the
+// Decoder, e.g. the rwkv.State of the RWKV models.
+type State = any
+
+// StateCloner is implemented by the Models whose states can be cloned, e.g. to
+// continue a generation after the release of the nodes of the decoding.
+type StateCloner interface {
+	// CloneState returns a copy of the state, sharing no node with it.
+	CloneState(State) (State, error)
+}
+
+// StateMarshaler is implemented by the Models whose states can be saved, e.g. to
+// a file, and restored by the same model, even in another process.
+type StateMarshaler interface {
+	// MarshalState returns the encoding of the state.
+	MarshalState(State) ([]byte, error)
+	// UnmarshalState returns the state encoded by MarshalState.
+	UnmarshalState([]byte) (State, error)
+}
+
+// StateCompactor is implemented by the StateCloner Models whose states can be
+// kept in less memory, e.g. in float16, between the generations.
+type StateCompactor interface {
+	// CompactState returns a copy of the state in less memory, which is only
+	// cloned and marshaled: CloneState returns it in full, for the computation.
+	CompactState(State) (State, error)
+}
+
+// StateFingerprinter is implemented by the StateMarshaler Models which identify
+// themselves in the saved states, so that a state isn't restored by another
+// model of the same shape, where it would silently produce garbage.
+type StateFingerprinter interface {
+	// StateFingerprint returns the identity of the model, equal for the same
+	// weights.
+	StateFingerprint() string
+}
+
+// Input is the starting point of the decoding, after the prompt.
+type Input struct {
+	// Logits are the logits of the first token to generate.
+	Logits mat.Matrix
+	// State is the state of the model after the prompt.
+	State State
+	// Tokens are the token IDs of the prompt.
+	Tokens []int
+	// Timing is the time spent encoding the prompt, reported with the first token.
+	Timing TokenTiming
+}
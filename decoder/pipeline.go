@@ -0,0 +1,241 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/rs/zerolog/log"
+)
+
+// StepInfo describes the decoding step a Stage is applied to.
+type StepInfo struct {
+	// Step is the index of the token being generated (0-based).
+	Step int
+	// Sequence contains the IDs of the tokens generated so far.
+	Sequence []int
+	// Prompt contains the IDs of the prompt tokens.
+	Prompt []int
+}
+
+// Stage is a step of the sampler pipeline, transforming the logits of the next token
+// before the selection.
+type Stage interface {
+	Apply(info StepInfo, logits mat.Matrix) (mat.Matrix, error)
+}
+
+// StageFunc is an adapter to use ordinary functions as a Stage.
+type StageFunc func(info StepInfo, logits mat.Matrix) (mat.Matrix, error)
+
+// Apply calls f(info, logits).
+func (f StageFunc) Apply(info StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+	return f(info, logits)
+}
+
+// StageFactory builds a Stage from the decoding options.
+// It returns a nil Stage if the stage has no effect with the given options.
+type StageFactory func(opts DecodingOptions) (Stage, error)
+
+// Names of the built-in stages.
+const (
+	StageRepetitionPenalty = "repetition_penalty"
+	StageBans              = "bans"
+	StageLogitsProcessors  = "logits_processors"
+	StageTopK              = "top_k"
+	StageTopP              = "top_p"
+	StageTemperature       = "temperature"
+)
+
+// DefaultPipeline is the order of the stages used when DecodingOptions.Pipeline is empty.
+// The temperature precedes the top-k and top-p filters, so that these operate on the
+// tempered distribution.
+var DefaultPipeline = []string{StageRepetitionPenalty, StageBans, StageLogitsProcessors, StageTemperature, StageTopK, StageTopP}
+
+var (
+	stagesMu sync.RWMutex
+	stages   = map[string]StageFactory{
+		StageRepetitionPenalty: repetitionPenaltyStage,
+		StageBans:              bansStage,
+		StageLogitsProcessors:  logitsProcessorsStage,
+		StageTopK:              topKStage,
+		StageTopP:              topPStage,
+		StageTemperature:       temperatureStage,
+	}
+)
+
+// RegisterStage makes a custom stage available by name to DecodingOptions.Pipeline.
+// It panics if the name is already registered.
+func RegisterStage(name string, factory StageFactory) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+	if _, exists := stages[name]; exists {
+		panic(fmt.Sprintf("decoder: stage %q already registered", name))
+	}
+	stages[name] = factory
+}
+
+// StageNames returns the sorted names of the registered stages.
+func StageNames() []string {
+	stagesMu.RLock()
+	defer stagesMu.RUnlock()
+	names := make([]string, 0, len(stages))
+	for name := range stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline is an ordered sequence of stages.
+type Pipeline []Stage
+
+// NewPipeline builds the pipeline described by opts.Pipeline, or by DefaultPipeline
+// if empty. A stage can appear at most once.
+func NewPipeline(opts DecodingOptions) (Pipeline, error) {
+	names := opts.Pipeline
+	if len(names) == 0 {
+		names = DefaultPipeline
+	}
+
+	stagesMu.RLock()
+	defer stagesMu.RUnlock()
+
+	seen := make(map[string]bool, len(names))
+	p := make(Pipeline, 0, len(names))
+	for _, name := range names {
+		factory, ok := stages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sampler stage %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicated sampler stage %q", name)
+		}
+		seen[name] = true
+		stage, err := factory(opts)
+		if err != nil {
+			return nil, err
+		}
+		if stage != nil {
+			log.Trace().Str("stage", name).Msg("Adding sampler stage")
+			p = append(p, stage)
+		}
+	}
+	return p, nil
+}
+
+// Apply applies the stages in order.
+func (p Pipeline) Apply(info StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+	var err error
+	for _, stage := range p {
+		if logits, err = stage.Apply(info, logits); err != nil {
+			return nil, err
+		}
+	}
+	return logits, nil
+}
+
+// fromControlFunc adapts an OutputDiversityControlFunc, which does not depend on the step.
+func fromControlFunc(f OutputDiversityControlFunc) Stage {
+	return StageFunc(func(_ StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+		return f(logits)
+	})
+}
+
+func repetitionPenaltyStage(opts DecodingOptions) (Stage, error) {
+	penalty := opts.RepetitionPenalty
+	if penalty < 0 {
+		return nil, fmt.Errorf("invalid repetition penalty value: %f. Must be >= 0", penalty)
+	}
+	if penalty == 0 || penalty == 1 {
+		return nil, nil
+	}
+	return StageFunc(func(info StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+		if len(info.Sequence) == 0 {
+			return logits, nil
+		}
+		out := logits.Clone()
+		seen := make(map[int]bool, len(info.Sequence))
+		for _, id := range info.Sequence {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			// as in CTRL: the positive logits are divided and the negative ones multiplied,
+			// so that the repeated tokens always become less likely
+			v := out.ScalarAtVec(id).F64()
+			if v > 0 {
+				v /= penalty
+			} else {
+				v *= penalty
+			}
+			out.SetVecScalar(id, float.Interface(v))
+		}
+		return out, nil
+	}), nil
+}
+
+func bansStage(opts DecodingOptions) (Stage, error) {
+	if len(opts.BannedTokenIDs) == 0 {
+		return nil, nil
+	}
+	banned := append([]int(nil), opts.BannedTokenIDs...)
+	return StageFunc(func(_ StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+		out := logits.Clone()
+		for _, id := range banned {
+			if id >= 0 && id < out.Size() {
+				out.SetVecScalar(id, floatNegInf)
+			}
+		}
+		return out, nil
+	}), nil
+}
+
+func topKStage(opts DecodingOptions) (Stage, error) {
+	if opts.TopK < 0 {
+		return nil, fmt.Errorf("invalid topK value: %d. Must be >= 0", opts.TopK)
+	}
+	if opts.TopK == 0 {
+		return nil, nil
+	}
+	return fromControlFunc(TopKFunc(opts.TopK, math.Inf(-1))), nil
+}
+
+func topPStage(opts DecodingOptions) (Stage, error) {
+	if opts.TopP < 0 || opts.TopP > 1 {
+		return nil, fmt.Errorf("invalid topP value: %f. Must be between 0 and 1", opts.TopP)
+	}
+	if opts.TopP == 1 {
+		return nil, nil
+	}
+	return fromControlFunc(TopPFunc(opts.TopP, math.Inf(-1), 1)), nil
+}
+
+func temperatureStage(opts DecodingOptions) (Stage, error) {
+	dt, err := dynamicTemperature(opts)
+	if err != nil {
+		return nil, err
+	}
+	if dt != nil {
+		return StageFunc(func(info StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+			return dt(logits, info.Step), nil
+		}), nil
+	}
+	if err := validateTemp("temperature", opts.Temp); err != nil {
+		return nil, err
+	}
+	if opts.Temp == 1 {
+		return nil, nil
+	}
+	temp := opts.Temp
+	if temp == 0 {
+		temp = 0.01 // avoid division by zero
+	}
+	return fromControlFunc(TemperatureFunc(temp)), nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPipeline(t *testing.T) {
+	t.Run("skips the stages without effect", func(t *testing.T) {
+		p, err := NewPipeline(DecodingOptions{Temp: 1, TopP: 1})
+		require.NoError(t, err)
+		assert.Empty(t, p)
+	})
+
+	t.Run("rejects unknown and duplicated stages", func(t *testing.T) {
+		_, err := NewPipeline(DecodingOptions{Pipeline: []string{"foo"}})
+		assert.Error(t, err)
+		_, err = NewPipeline(DecodingOptions{Pipeline: []string{StageBans, StageBans}})
+		assert.Error(t, err)
+	})
+
+	t.Run("validates the options of the stages", func(t *testing.T) {
+		_, err := NewPipeline(DecodingOptions{Temp: 1, TopP: 1.5})
+		assert.Error(t, err)
+		_, err = NewPipeline(DecodingOptions{Temp: 1, TopP: 1, RepetitionPenalty: -1})
+		assert.Error(t, err)
+	})
+}
+
+func TestPipeline_Apply(t *testing.T) {
+	info := StepInfo{Step: 2, Sequence: []int{0, 0}}
+
+	t.Run("penalties and bans", func(t *testing.T) {
+		p, err := NewPipeline(DecodingOptions{
+			Temp:              1,
+			TopP:              1,
+			RepetitionPenalty: 2,
+			BannedTokenIDs:    []int{3},
+		})
+		require.NoError(t, err)
+		out, err := p.Apply(info, mat.NewVecDense([]float64{4, -1, 2, 5}))
+		require.NoError(t, err)
+		assert.Equal(t, []float64{2, -1, 2, math.Inf(-1)}, out.Data().F64())
+	})
+
+	t.Run("order matters", func(t *testing.T) {
+		logits := mat.NewVecDense([]float64{3, 2, 1})
+		opts := DecodingOptions{Temp: 0.5, TopP: 1, BannedTokenIDs: []int{0}}
+
+		opts.Pipeline = []string{StageTemperature, StageBans}
+		p, err := NewPipeline(opts)
+		require.NoError(t, err)
+		out, err := p.Apply(info, logits)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{math.Inf(-1), 4, 2}, out.Data().F64())
+
+		opts.Pipeline = []string{StageBans}
+		p, err = NewPipeline(opts)
+		require.NoError(t, err)
+		out, err = p.Apply(info, logits)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{math.Inf(-1), 2, 1}, out.Data().F64())
+	})
+
+	t.Run("custom stages", func(t *testing.T) {
+		RegisterStage("test_boost_last", func(DecodingOptions) (Stage, error) {
+			return StageFunc(func(info StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+				out := logits.Clone()
+				last := logits.Size() - 1
+				out.SetVecScalar(last, float.Interface(float64(info.Step)))
+				return out, nil
+			}), nil
+		})
+		assert.Contains(t, StageNames(), "test_boost_last")
+		assert.Panics(t, func() { RegisterStage("test_boost_last", nil) })
+
+		p, err := NewPipeline(DecodingOptions{Pipeline: []string{"test_boost_last"}})
+		require.NoError(t, err)
+		out, err := p.Apply(info, mat.NewVecDense([]float64{0, 0, 0}))
+		require.NoError(t, err)
+		assert.Equal(t, []float64{0, 0, 2}, out.Data().F64())
+	})
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+)
+
+// LogitsProcessor lets library users constrain the generation without modifying
+// the decoder, e.g. to enforce rhyme schemes or indentation rules.
+//
+// Process receives the step (0-based), the IDs of the prompt followed by the tokens
+// generated so far, and the logits of the next token, one per vocabulary entry.
+// It returns the modified logits, which must have the same length; the input slice
+// can be modified in place and returned. Setting a logit to -Inf bans the token.
+type LogitsProcessor interface {
+	Process(step int, inputIDs []int, logits []float32) []float32
+}
+
+// LogitsProcessorFunc is an adapter to use ordinary functions as a LogitsProcessor.
+type LogitsProcessorFunc func(step int, inputIDs []int, logits []float32) []float32
+
+// Process calls f(step, inputIDs, logits).
+func (f LogitsProcessorFunc) Process(step int, inputIDs []int, logits []float32) []float32 {
+	return f(step, inputIDs, logits)
+}
+
+func logitsProcessorsStage(opts DecodingOptions) (Stage, error) {
+	if len(opts.LogitsProcessors) == 0 {
+		return nil, nil
+	}
+	processors := append([]LogitsProcessor(nil), opts.LogitsProcessors...)
+	return StageFunc(func(info StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+		inputIDs := make([]int, 0, len(info.Prompt)+len(info.Sequence))
+		inputIDs = append(append(inputIDs, info.Prompt...), info.Sequence...)
+
+		data := logits.Data().F32()
+		size := len(data)
+		for _, p := range processors {
+			if data = p.Process(info.Step, inputIDs, data); len(data) != size {
+				return nil, fmt.Errorf("logits processor returned %d logits, expected %d", len(data), size)
+			}
+		}
+		return logits.NewVec(float.SliceInterface(data)), nil
+	}), nil
+}
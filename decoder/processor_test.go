@@ -0,0 +1,50 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogitsProcessors(t *testing.T) {
+	var gotStep int
+	var gotInput []int
+	banOdd := LogitsProcessorFunc(func(step int, inputIDs []int, logits []float32) []float32 {
+		gotStep, gotInput = step, inputIDs
+		for i := 1; i < len(logits); i += 2 {
+			logits[i] = float32(math.Inf(-1))
+		}
+		return logits
+	})
+	double := LogitsProcessorFunc(func(_ int, _ []int, logits []float32) []float32 {
+		for i := range logits {
+			logits[i] *= 2
+		}
+		return logits
+	})
+
+	p, err := NewPipeline(DecodingOptions{Temp: 1, TopP: 1, LogitsProcessors: []LogitsProcessor{banOdd, double}})
+	require.NoError(t, err)
+
+	info := StepInfo{Step: 1, Sequence: []int{7}, Prompt: []int{4, 5}}
+	out, err := p.Apply(info, mat.NewVecDense([]float32{1, 2, 3, 4}))
+	require.NoError(t, err)
+	assert.Equal(t, []float32{2, float32(math.Inf(-1)), 6, float32(math.Inf(-1))}, out.Data().F32())
+	assert.Equal(t, 1, gotStep)
+	assert.Equal(t, []int{4, 5, 7}, gotInput)
+
+	truncate := LogitsProcessorFunc(func(_ int, _ []int, logits []float32) []float32 {
+		return logits[:1]
+	})
+	p, err = NewPipeline(DecodingOptions{Temp: 1, TopP: 1, LogitsProcessors: []LogitsProcessor{truncate}})
+	require.NoError(t, err)
+	_, err = p.Apply(info, mat.NewVecDense([]float32{1, 2}))
+	assert.Error(t, err)
+}
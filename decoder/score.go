@@ -0,0 +1,39 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+// NormalizeScore returns the cumulative score of a sequence of the given length,
+// e.g. the sum of the negative log-probabilities of its tokens, normalized by the
+// length to the power of alpha (length penalty): 0 leaves the score unchanged, 1
+// averages it over the tokens. Since each token adds to the negative
+// log-probability, the raw sums favor the short sequences, which alpha values
+// around 0.6-1 compensate for when comparing sequences of different lengths.
+func NormalizeScore(sum float64, length int, alpha float64) float64 {
+	if alpha == 0 || length <= 0 {
+		return sum
+	}
+	return sum / math.Pow(float64(length), alpha)
+}
+
+// LogProb returns the log-probability of the token according to the logits of a
+// step, i.e. its log-softmax, e.g. to score a given continuation of a prompt.
+func LogProb(logits mat.Matrix, tokenID int) float64 {
+	data := logits.Data().F64()
+	maxLogit := math.Inf(-1)
+	for _, v := range data {
+		maxLogit = math.Max(maxLogit, v)
+	}
+	var sum float64
+	for _, v := range data {
+		sum += math.Exp(v - maxLogit)
+	}
+	return data[tokenID] - maxLogit - math.Log(sum)
+}
@@ -0,0 +1,31 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeScore(t *testing.T) {
+	assert.Equal(t, 6.0, NormalizeScore(6, 4, 0))
+	assert.Equal(t, 1.5, NormalizeScore(6, 4, 1))
+	assert.Equal(t, 3.0, NormalizeScore(6, 4, 0.5))
+	assert.Equal(t, 6.0, NormalizeScore(6, 0, 1))
+
+	// with the normalization, the longer sequence with the more likely tokens wins
+	short, long := 2.0, 3.0
+	assert.Less(t, short, long)
+	assert.Greater(t, NormalizeScore(short, 2, 1), NormalizeScore(long, 6, 1))
+}
+
+func TestLogProb(t *testing.T) {
+	logits := mat.NewVecDense([]float32{0, float32(math.Log(3))})
+	assert.InDelta(t, math.Log(0.25), LogProb(logits, 0), 1e-6)
+	assert.InDelta(t, math.Log(0.75), LogProb(logits, 1), 1e-6)
+}
@@ -6,6 +6,9 @@ package decoder
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"sync"
 
 	"github.com/nlpodyssey/spago/mat"
 	"github.com/nlpodyssey/spago/mat/rand"
@@ -14,27 +17,101 @@ import (
 
 type OutputSelectionFunc func(logits mat.Matrix) (int, float64, error)
 
-func OutputSelection(sampling bool) OutputSelectionFunc {
+// SamplerFactory builds a custom selection of the next token from the decoding options.
+type SamplerFactory func(opts DecodingOptions) (OutputSelectionFunc, error)
+
+var (
+	samplersMu sync.RWMutex
+	samplers   = map[string]SamplerFactory{}
+)
+
+// RegisterSampler makes a custom selection of the next token available by name to
+// DecodingOptions.Sampler. It panics if the name is already registered.
+func RegisterSampler(name string, factory SamplerFactory) {
+	samplersMu.Lock()
+	defer samplersMu.Unlock()
+	if _, exists := samplers[name]; exists {
+		panic(fmt.Sprintf("decoder: sampler %q already registered", name))
+	}
+	samplers[name] = factory
+}
+
+// SamplerNames returns the sorted names of the registered samplers.
+func SamplerNames() []string {
+	samplersMu.RLock()
+	defer samplersMu.RUnlock()
+	names := make([]string, 0, len(samplers))
+	for name := range samplers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newSampler(opts DecodingOptions) (OutputSelectionFunc, error) {
+	samplersMu.RLock()
+	factory, ok := samplers[opts.Sampler]
+	samplersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sampler %q", opts.Sampler)
+	}
+	return factory(opts)
+}
+
+func OutputSelection(sampling bool, seed uint64) OutputSelectionFunc {
 	if sampling {
 		log.Trace().Msg("using multinomial sampling")
-		return MultinomialSampling()
+		return MultinomialSampling(seed)
 	}
 	log.Trace().Msg("using greedy decoding")
 	return GreedyDecoding()
 }
 
+// GreedyDecoding returns a function that selects the most probable token.
+// The selection is fully deterministic: no random generator is involved, and ties
+// are broken in favor of the lowest token ID. The arg-max is computed on the logits
+// rather than on the probabilities, so that distinct logits are never turned into
+// ties by the rounding of the softmax.
 func GreedyDecoding() OutputSelectionFunc {
 	return func(logits mat.Matrix) (int, float64, error) {
+		id, err := argmax(logits.Data().F64())
+		if err != nil {
+			return 0, 0, err
+		}
 		probs := logits.Softmax()
-		argmax := probs.ArgMax()
-		return argmax, probs.ScalarAtVec(argmax).F64(), nil
+		return id, probs.ScalarAtVec(id).F64(), nil
 	}
 }
 
-func MultinomialSampling() OutputSelectionFunc {
+// argmax returns the index of the greatest value, failing if a value is NaN or
+// +Inf, from which no score can be computed (-Inf is the logit of the masked
+// tokens). Ties are broken in favor of the lowest index.
+func argmax(data []float64) (int, error) {
+	maxIndex := -1
+	for i, v := range data {
+		if math.IsNaN(v) || math.IsInf(v, 1) {
+			return 0, fmt.Errorf("non-finite logit %v at index %d", v, i)
+		}
+		if maxIndex < 0 || v > data[maxIndex] {
+			maxIndex = i
+		}
+	}
+	if maxIndex < 0 || math.IsInf(data[maxIndex], -1) {
+		return 0, fmt.Errorf("no selectable token: all the logits are -Inf")
+	}
+	return maxIndex, nil
+}
+
+// MultinomialSampling returns a function that samples the next token from the
+// probability distribution. A non-zero seed makes the sampling reproducible.
+func MultinomialSampling(seed uint64) OutputSelectionFunc {
+	random := rand.Float[float64]
+	if seed != 0 {
+		random = rand.NewLockedRand(seed).Float64
+	}
 	return func(logits mat.Matrix) (int, float64, error) {
 		probs := logits.Softmax()
-		samples, err := multinomial(probs, 1)
+		samples, err := multinomial(probs, 1, random)
 		if err != nil {
 			return 0, 0, err
 		}
@@ -43,7 +120,7 @@ func MultinomialSampling() OutputSelectionFunc {
 }
 
 // multinomial extracts the next indices from a multinomial probability distribution.
-func multinomial(input mat.Matrix, numSamples int) ([]int, error) {
+func multinomial(input mat.Matrix, numSamples int, random func() float64) ([]int, error) {
 	if numSamples > input.Size() {
 		return nil, fmt.Errorf("numSamples (%d) must be less than or equal to the size of the input (%d)", numSamples, input.Size())
 	}
@@ -53,7 +130,7 @@ func multinomial(input mat.Matrix, numSamples int) ([]int, error) {
 
 	data := input.Data().F64()
 	for len(samples) < numSamples {
-		p := rand.Float[float64]()
+		p := random()
 
 		for i, value := range data {
 			p -= value
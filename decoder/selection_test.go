@@ -0,0 +1,77 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGreedyDecoding(t *testing.T) {
+	greedy := GreedyDecoding()
+
+	t.Run("selects the greatest logit", func(t *testing.T) {
+		id, score, err := greedy(mat.NewVecDense([]float64{0.1, 2, -1, 0.5}))
+		require.NoError(t, err)
+		assert.Equal(t, 1, id)
+		assert.Greater(t, score, 0.5)
+	})
+
+	t.Run("breaks ties in favor of the lowest ID", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			id, score, err := greedy(mat.NewVecDense([]float64{1, 3, 0, 3, 3}))
+			require.NoError(t, err)
+			assert.Equal(t, 1, id)
+			assert.InDelta(t, score, 1.0/3, 0.05)
+		}
+	})
+
+	t.Run("distinguishes nearly equal logits", func(t *testing.T) {
+		id, _, err := greedy(mat.NewVecDense([]float32{-100, -90, 20, 20.000002}))
+		require.NoError(t, err)
+		assert.Equal(t, 3, id)
+	})
+
+	t.Run("skips the masked tokens", func(t *testing.T) {
+		id, score, err := greedy(mat.NewVecDense([]float64{math.Inf(-1), -1, 4, math.Inf(-1)}))
+		require.NoError(t, err)
+		assert.Equal(t, 2, id)
+		assert.False(t, math.IsNaN(score))
+	})
+
+	t.Run("fails on non-finite logits", func(t *testing.T) {
+		for _, v := range []float64{math.NaN(), math.Inf(1)} {
+			_, _, err := greedy(mat.NewVecDense([]float64{-1, v, 4}))
+			assert.Error(t, err, v)
+		}
+	})
+
+	t.Run("fails without selectable tokens", func(t *testing.T) {
+		_, _, err := greedy(mat.NewVecDense([]float64{math.Inf(-1), math.Inf(-1)}))
+		assert.Error(t, err)
+	})
+}
+
+func TestDecoder_SelectToken_AcceptToken(t *testing.T) {
+	d := &Decoder{
+		opts: DecodingOptions{AcceptToken: func(_ StepInfo, tokenID int) (bool, error) {
+			return tokenID != 2, nil
+		}},
+		applySelection: GreedyDecoding(),
+	}
+	logits := mat.NewVecDense([]float64{1, 2, 3})
+	id, _, err := d.selectToken(StepInfo{}, logits)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+	assert.Equal(t, 3.0, logits.ScalarAtVec(2).F64(), "the candidates are not modified")
+
+	d.opts.AcceptToken = func(StepInfo, int) (bool, error) { return false, nil }
+	_, _, err = d.selectToken(StepInfo{}, logits)
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"math"
+
+	"github.com/nlpodyssey/rwkv"
+)
+
+// StateNorms returns the L2 norm of each tensor of the RWKV state, by name
+// (e.g. "att_aa") and by layer.
+//
+// The norms growing steadily during a very long generation reveal the
+// saturation of the state, which eventually degenerates the output.
+func StateNorms(s rwkv.State) map[string][]float64 {
+	norms := make(map[string][]float64)
+	for _, layer := range s {
+		for _, t := range stateTensors(layer) {
+			norms[t.name] = append(norms[t.name], l2Norm(t.node.Value().Data().F64()))
+		}
+	}
+	return norms
+}
+
+func l2Norm(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+// traceStateNorms logs the StateNorms at the given step, at the trace level.
+func (d *Decoder) traceStateNorms(step int, s rwkv.State) {
+	e := d.logger().Trace()
+	if !e.Enabled() {
+		return
+	}
+	e = e.Int("step", step)
+	if len(s) > 0 {
+		norms := StateNorms(s)
+		for _, t := range stateTensors(s[0]) {
+			e = e.Floats64(t.name, norms[t.name])
+		}
+	}
+	e.Msg("state norms")
+}
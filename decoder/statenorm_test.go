@@ -0,0 +1,54 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateNorms(t *testing.T) {
+	s := rwkv.NewState(rwkv.Config{DModel: 2, NumLayers: 2})
+	s[1].AttAA = ag.Var(mat.NewVecDense([]float32{3, 4}))
+
+	norms := StateNorms(s)
+	assert.Len(t, norms, 5)
+	assert.Equal(t, []float64{0, 5}, norms["att_aa"])
+	assert.Equal(t, []float64{0, 0}, norms["ffn_xx"])
+}
+
+func TestDecoder_TraceStateNorms(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l zerolog.Logger, level zerolog.Level) {
+		log.Logger = l
+		zerolog.SetGlobalLevel(level)
+	}(log.Logger, zerolog.GlobalLevel())
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+
+	s := rwkv.NewState(rwkv.Config{DModel: 2, NumLayers: 2})
+	s[0].FfnXX = ag.Var(mat.NewVecDense([]float32{6, 8}))
+	d := &Decoder{opts: DecodingOptions{TraceStateNorms: true}}
+	d.traceStateNorms(7, s)
+
+	var entry struct {
+		Step    int       `json:"step"`
+		FfnXX   []float64 `json:"ffn_xx"`
+		Message string    `json:"message"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, 7, entry.Step)
+	assert.Equal(t, []float64{10, 0}, entry.FfnXX)
+	assert.Equal(t, "state norms", entry.Message)
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultStopLookbehind is the default number of bytes of the text generated before
+// each token the stop regular expressions are matched against (see
+// DecodingOptions.StopLookbehind).
+const DefaultStopLookbehind = 256
+
+// stopMatcher matches the stop conditions against the end of the generation,
+// one token at a time: the stop sequences of token IDs and the stop regular
+// expressions, against the text of the tokens.
+//
+// The stop sequences, and the regular expressions which are literal strings, are
+// matched by Aho-Corasick automata built once per request, so the cost of each
+// step doesn't grow with their number; the other regular expressions are matched
+// against a window of the text.
+type stopMatcher struct {
+	idSeqs   [][]int
+	ids      *ahoCorasick[int]
+	idsState int
+	// literals are the regular expressions matched by the automaton of the texts.
+	literals    []*regexp.Regexp
+	literalLens []int
+	texts       *ahoCorasick[byte]
+	textsState  int
+
+	res        []*regexp.Regexp
+	tokenText  func(tokenID int) (string, error)
+	lookbehind int
+	// window is the end of the generated text, at most lookbehind bytes between the tokens.
+	window string
+	// log is the logger of the generation, set by Decode.
+	log *zerolog.Logger
+}
+
+// newStopMatcher returns the matcher of the stop sequences and regular
+// expressions of the options, or nil if there are none.
+func newStopMatcher(opts DecodingOptions) (*stopMatcher, error) {
+	if len(opts.StopRegexps) == 0 && len(opts.StopSequencesIDs) == 0 {
+		return nil, nil
+	}
+	if len(opts.StopRegexps) > 0 && opts.TokenText == nil {
+		return nil, fmt.Errorf("stop regular expressions require the text of the tokens (TokenText)")
+	}
+	m := &stopMatcher{tokenText: opts.TokenText, lookbehind: opts.StopLookbehind}
+	if m.lookbehind <= 0 {
+		m.lookbehind = DefaultStopLookbehind
+	}
+	if len(opts.StopSequencesIDs) > 0 {
+		m.idSeqs = opts.StopSequencesIDs
+		m.ids = newAhoCorasick(opts.StopSequencesIDs)
+	}
+	var literals [][]byte
+	for _, expr := range opts.StopRegexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop regular expression %q: %w", expr, err)
+		}
+		if prefix, complete := re.LiteralPrefix(); complete && prefix != "" {
+			m.literals = append(m.literals, re)
+			m.literalLens = append(m.literalLens, len(prefix))
+			literals = append(literals, []byte(prefix))
+			continue
+		}
+		m.res = append(m.res, re)
+	}
+	if len(literals) > 0 {
+		m.texts = newAhoCorasick(literals)
+	}
+	return m, nil
+}
+
+// reset prepares the matcher for a new generation.
+func (m *stopMatcher) reset(log *zerolog.Logger) {
+	m.idsState, m.textsState = 0, 0
+	m.window = ""
+	m.log = log
+}
+
+// next matches the token, reporting whether a stop sequence ends with it, or one
+// of the regular expressions matches text ending in it. The matches ending before
+// the token were already reported, so that each one stops the generation only once.
+func (m *stopMatcher) next(tokenID int) (bool, error) {
+	matched := false
+	if m.ids != nil {
+		var found []int
+		if m.idsState, found = m.ids.step(m.idsState, tokenID); len(found) > 0 {
+			m.logger().Trace().Msgf("Reached stop sequence %v", m.idSeqs[found[0]])
+			matched = true
+		}
+	}
+	if m.texts == nil && len(m.res) == 0 {
+		return matched, nil
+	}
+	text, err := m.tokenText(tokenID)
+	if err != nil {
+		return false, err
+	}
+	if m.texts != nil {
+		for i := 0; i < len(text); i++ {
+			var found []int
+			m.textsState, found = m.texts.step(m.textsState, text[i])
+			for _, j := range found {
+				// the text before the token is matched up to the lookbehind
+				if !matched && m.literalLens[j]-(i+1) <= m.lookbehind {
+					m.logger().Trace().Msgf("Reached stop regular expression %q", m.literals[j])
+					matched = true
+				}
+			}
+		}
+	}
+	if len(m.res) == 0 {
+		return matched, nil
+	}
+	prev := len(m.window)
+	m.window += text
+	for _, re := range m.res {
+		if !matched && matchEndsAfter(re, m.window, prev) {
+			m.logger().Trace().Msgf("Reached stop regular expression %q", re)
+			matched = true
+		}
+	}
+	m.trim()
+	return matched, nil
+}
+
+// matchEndsAfter reports whether re matches a text ending after the offset pos of s.
+// The search restarts after the beginning of each match, so that the matches
+// overlapping the previous ones are found too.
+func matchEndsAfter(re *regexp.Regexp, s string, pos int) bool {
+	for start := 0; start <= len(s); {
+		loc := re.FindStringIndex(s[start:])
+		if loc == nil {
+			return false
+		}
+		if start+loc[1] > pos {
+			return true
+		}
+		start += loc[0] + 1
+		for start < len(s) && !utf8.RuneStart(s[start]) {
+			start++
+		}
+	}
+	return false
+}
+
+// trim discards the beginning of the window exceeding the lookbehind, at a rune boundary.
+func (m *stopMatcher) trim() {
+	cut := len(m.window) - m.lookbehind
+	if cut <= 0 {
+		return
+	}
+	for cut < len(m.window) && !utf8.RuneStart(m.window[cut]) {
+		cut++
+	}
+	m.window = m.window[cut:]
+}
+
+func (m *stopMatcher) logger() *zerolog.Logger {
+	if m.log == nil {
+		return &log.Logger
+	}
+	return m.log
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoder_StopRegexps(t *testing.T) {
+	m := fakeModel{vocabSize: 8}
+	newInput := func() Input {
+		return Input{Logits: m.logits(0), State: []int{0}, Tokens: []int{0}}
+	}
+	// the tokens 1..7 are "a", "\n", "\n", "#", "#", " ", "b"
+	texts := []string{"", "a", "\n", "\n", "#", "#", " ", "b"}
+	tokenText := func(id int) (string, error) { return texts[id], nil }
+	ids := func(opts DecodingOptions) []int {
+		var ids []int
+		for _, gen := range decodeAll(t, m, opts, newInput()) {
+			ids = append(ids, gen.TokenID)
+		}
+		return ids
+	}
+	opts := DecodingOptions{MaxLen: 10, EndTokenID: 0, TopP: 1, Temp: 1, TokenText: tokenText}
+
+	opts.StopRegexps = []string{`\n\n#{1,3} `}
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, ids(opts))
+
+	// the matches ending before the minimum length don't stop the generation
+	opts.StopRegexps = []string{`a\n`}
+	opts.MinLen = 3
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 0}, ids(opts))
+	opts.MinLen = 0
+	assert.Equal(t, []int{1, 2}, ids(opts))
+
+	// the text before the lookbehind is not matched
+	opts.StopRegexps = []string{`a\n\n#`}
+	opts.StopLookbehind = 2
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 0}, ids(opts))
+	opts.StopLookbehind = 3
+	assert.Equal(t, []int{1, 2, 3, 4}, ids(opts))
+
+	opts.StopRegexps = []string{`(`}
+	_, err := New(m, opts)
+	assert.ErrorContains(t, err, "invalid stop regular expression")
+
+	opts.StopRegexps = []string{`a`}
+	opts.TokenText = nil
+	_, err = New(m, opts)
+	assert.Error(t, err)
+
+	opts.TokenText = func(int) (string, error) { return "", fmt.Errorf("unknown token") }
+	d, err := New(m, opts)
+	require.NoError(t, err)
+	chGen := make(chan GeneratedToken, opts.MaxLen)
+	assert.EqualError(t, d.Decode(context.Background(), nil, newInput(), chGen), "unknown token")
+}
+
+func TestMatchEndsAfter(t *testing.T) {
+	re := regexp.MustCompile(`aa`)
+	// the match ending in the new text overlaps the previous one
+	assert.True(t, matchEndsAfter(re, "aaa", 2))
+	assert.False(t, matchEndsAfter(re, "aab", 2))
+	assert.False(t, matchEndsAfter(re, "", 0))
+}
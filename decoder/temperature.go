@@ -0,0 +1,154 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+// TempSchedule varies the temperature over the course of the generation:
+// the first Delay tokens use Start, then the temperature moves linearly to End
+// over RampSteps tokens, and stays at End afterwards.
+type TempSchedule struct {
+	// Start is the temperature of the first tokens.
+	Start float64 `json:"start" yaml:"start"`
+	// End is the temperature reached at the end of the ramp.
+	End float64 `json:"end" yaml:"end"`
+	// Delay is the number of tokens generated at the Start temperature.
+	Delay int `json:"delay" yaml:"delay"`
+	// RampSteps is the number of tokens over which the temperature goes from Start to End.
+	// Zero means an immediate switch to End after Delay tokens.
+	RampSteps int `json:"ramp_steps" yaml:"ramp_steps"`
+}
+
+// AdaptiveTemp makes the temperature depend on the entropy of the predicted distribution:
+// confident predictions (low entropy) use a temperature close to Min, uncertain ones
+// a temperature close to Max.
+type AdaptiveTemp struct {
+	// Min is the temperature used when the distribution has zero entropy.
+	Min float64 `json:"min" yaml:"min"`
+	// Max is the temperature used when the distribution is uniform.
+	Max float64 `json:"max" yaml:"max"`
+	// Exponent shapes the curve from Min to Max (default: 1, linear in the normalized entropy).
+	Exponent float64 `json:"exponent" yaml:"exponent"`
+}
+
+// At returns the temperature of the given step (0-based).
+func (s TempSchedule) At(step int) float64 {
+	switch {
+	case step < s.Delay:
+		return s.Start
+	case step >= s.Delay+s.RampSteps:
+		return s.End
+	default:
+		progress := float64(step-s.Delay) / float64(s.RampSteps)
+		return s.Start + (s.End-s.Start)*progress
+	}
+}
+
+// For returns the temperature for the given logits.
+func (a AdaptiveTemp) For(logits []float64) float64 {
+	exponent := a.Exponent
+	if exponent == 0 {
+		exponent = 1
+	}
+	return a.Min + (a.Max-a.Min)*math.Pow(normalizedEntropy(logits), exponent)
+}
+
+// normalizedEntropy returns the entropy of the softmax of the logits, divided by
+// the maximum entropy, so that the result is in [0, 1].
+func normalizedEntropy(logits []float64) float64 {
+	if len(logits) < 2 {
+		return 0
+	}
+	maxLogit := math.Inf(-1)
+	for _, v := range logits {
+		maxLogit = math.Max(maxLogit, v)
+	}
+	var sum float64
+	for _, v := range logits {
+		sum += math.Exp(v - maxLogit)
+	}
+	var entropy float64
+	for _, v := range logits {
+		if p := math.Exp(v-maxLogit) / sum; p > 0 {
+			entropy -= p * math.Log(p)
+		}
+	}
+	return math.Min(entropy/math.Log(float64(len(logits))), 1)
+}
+
+func validateTemp(name string, temp float64) error {
+	if temp < 0 || temp > 1 {
+		return fmt.Errorf("invalid %s value: %f. Must be between 0 and 1", name, temp)
+	}
+	return nil
+}
+
+func (s *TempSchedule) validate() error {
+	if err := validateTemp("schedule start temperature", s.Start); err != nil {
+		return err
+	}
+	if err := validateTemp("schedule end temperature", s.End); err != nil {
+		return err
+	}
+	if s.Delay < 0 || s.RampSteps < 0 {
+		return fmt.Errorf("invalid temperature schedule: delay and ramp steps must be >= 0")
+	}
+	return nil
+}
+
+func (a *AdaptiveTemp) validate() error {
+	if err := validateTemp("adaptive min temperature", a.Min); err != nil {
+		return err
+	}
+	if err := validateTemp("adaptive max temperature", a.Max); err != nil {
+		return err
+	}
+	if a.Min > a.Max {
+		return fmt.Errorf("invalid adaptive temperature: min (%f) greater than max (%f)", a.Min, a.Max)
+	}
+	if a.Exponent < 0 {
+		return fmt.Errorf("invalid adaptive temperature exponent: %f. Must be >= 0", a.Exponent)
+	}
+	return nil
+}
+
+// dynamicTemperature returns the function applying the temperature of each step,
+// or nil if the temperature is constant.
+func dynamicTemperature(opts DecodingOptions) (func(logits mat.Matrix, step int) mat.Matrix, error) {
+	var tempAt func(logits mat.Matrix, step int) float64
+	switch {
+	case opts.TempSchedule != nil && opts.AdaptiveTemp != nil:
+		return nil, fmt.Errorf("temperature schedule and adaptive temperature are mutually exclusive")
+	case opts.TempSchedule != nil:
+		if err := opts.TempSchedule.validate(); err != nil {
+			return nil, err
+		}
+		schedule := *opts.TempSchedule
+		tempAt = func(_ mat.Matrix, step int) float64 { return schedule.At(step) }
+	case opts.AdaptiveTemp != nil:
+		if err := opts.AdaptiveTemp.validate(); err != nil {
+			return nil, err
+		}
+		adaptive := *opts.AdaptiveTemp
+		tempAt = func(logits mat.Matrix, _ int) float64 { return adaptive.For(logits.Data().F64()) }
+	default:
+		return nil, nil
+	}
+	return func(logits mat.Matrix, step int) mat.Matrix {
+		temp := tempAt(logits, step)
+		if temp == 0 {
+			temp = 0.01 // avoid division by zero
+		}
+		if temp == 1 {
+			return logits
+		}
+		return logits.ProdScalar(1 / temp)
+	}, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package decoder
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTempSchedule_At(t *testing.T) {
+	s := TempSchedule{Start: 0.3, End: 1, Delay: 2, RampSteps: 7}
+	assert.Equal(t, 0.3, s.At(0))
+	assert.Equal(t, 0.3, s.At(2))
+	assert.InDelta(t, 0.4, s.At(3), 1e-9)
+	assert.InDelta(t, 0.9, s.At(8), 1e-9)
+	assert.Equal(t, 1.0, s.At(9))
+	assert.Equal(t, 1.0, s.At(100))
+
+	immediate := TempSchedule{Start: 0.5, End: 0.8, Delay: 3}
+	assert.Equal(t, 0.5, immediate.At(2))
+	assert.Equal(t, 0.8, immediate.At(3))
+}
+
+func TestAdaptiveTemp_For(t *testing.T) {
+	a := AdaptiveTemp{Min: 0.2, Max: 1}
+	assert.InDelta(t, 1.0, a.For([]float64{1, 1, 1, 1}), 1e-9)
+	assert.InDelta(t, 0.2, a.For([]float64{0, -1000, -1000}), 1e-9)
+
+	mid := a.For([]float64{2, 1, 0})
+	assert.Greater(t, mid, 0.2)
+	assert.Less(t, mid, 1.0)
+}
+
+func TestDynamicTemperature(t *testing.T) {
+	_, err := dynamicTemperature(DecodingOptions{TempSchedule: &TempSchedule{}, AdaptiveTemp: &AdaptiveTemp{}})
+	assert.Error(t, err)
+	_, err = dynamicTemperature(DecodingOptions{TempSchedule: &TempSchedule{Start: 2}})
+	assert.Error(t, err)
+	_, err = dynamicTemperature(DecodingOptions{AdaptiveTemp: &AdaptiveTemp{Min: 1, Max: 0.5}})
+	assert.Error(t, err)
+
+	fn, err := dynamicTemperature(DecodingOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, fn)
+
+	fn, err = dynamicTemperature(DecodingOptions{TempSchedule: &TempSchedule{Start: 0.5, End: 1, RampSteps: 1}})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{2, 4}, fn(mat.NewVecDense([]float64{1, 2}), 0).Data().F64())
+	assert.Equal(t, []float64{1, 2}, fn(mat.NewVecDense([]float64{1, 2}), 1).Data().F64())
+}
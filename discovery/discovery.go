@@ -0,0 +1,176 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package discovery implements a minimal service discovery over HTTP: the
+// inference servers register themselves with a Registry, renewing the
+// registration periodically, and the clients list the live instances.
+//
+// The Registry API is:
+//
+//	PUT    /instances/{id}  registers or renews the instance in the JSON body
+//	DELETE /instances/{id}  deregisters the instance
+//	GET    /instances       lists the live instances
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Instance is a registered inference server.
+type Instance struct {
+	// ID identifies the instance, e.g. the pod name.
+	ID string `json:"id"`
+	// Address is the gRPC address of the instance, reachable by the clients.
+	Address string `json:"address"`
+	// Model is the name of the served model.
+	Model string `json:"model,omitempty"`
+	// Expires is when the registration expires, unless renewed. It is set by the Registry.
+	Expires time.Time `json:"expires"`
+}
+
+// Registry is the http.Handler of the discovery endpoint, keeping the
+// registered instances in memory.
+type Registry struct {
+	ttl       time.Duration
+	now       func() time.Time
+	mu        sync.Mutex
+	instances map[string]Instance
+}
+
+// NewRegistry returns a Registry where the registrations expire after ttl,
+// unless renewed.
+func NewRegistry(ttl time.Duration) *Registry {
+	return &Registry{ttl: ttl, now: time.Now, instances: make(map[string]Instance)}
+}
+
+// Instances returns the live instances, sorted by ID.
+func (r *Registry) Instances() []Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	list := make([]Instance, 0, len(r.instances))
+	for id, in := range r.instances {
+		if now.After(in.Expires) {
+			delete(r.instances, id)
+			continue
+		}
+		list = append(list, in)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/instances" && req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.Instances())
+		return
+	}
+	id, ok := strings.CutPrefix(req.URL.Path, "/instances/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		var in Instance
+		if err := json.NewDecoder(req.Body).Decode(&in); err != nil || in.Address == "" {
+			http.Error(w, "invalid instance", http.StatusBadRequest)
+			return
+		}
+		in.ID = id
+		r.mu.Lock()
+		in.Expires = r.now().Add(r.ttl)
+		r.instances[id] = in
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		r.mu.Lock()
+		delete(r.instances, id)
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Register registers the instance with the registry at registryURL, renewing
+// the registration every interval, until the context is done; then, the
+// instance is deregistered. The failures are logged and retried at the next
+// renewal, so that the registry can be started after the instances.
+func Register(ctx context.Context, registryURL string, in Instance, interval time.Duration) {
+	url := strings.TrimSuffix(registryURL, "/") + "/instances/" + in.ID
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := send(ctx, http.MethodPut, url, in); err != nil {
+			log.Warn().Err(err).Msg("failed to register with the discovery endpoint")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// the context is done, deregister with a fresh one
+			deregCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := send(deregCtx, http.MethodDelete, url, nil); err != nil {
+				log.Warn().Err(err).Msg("failed to deregister from the discovery endpoint")
+			}
+			return
+		}
+	}
+}
+
+// List returns the live instances registered with the registry at registryURL.
+func List(ctx context.Context, registryURL string) ([]Instance, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(registryURL, "/")+"/instances", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s", resp.Status)
+	}
+	var list []Instance
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func send(ctx context.Context, method, url string, body any) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("discovery: %s %s: %s", method, url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry(time.Minute)
+	now := time.Now()
+	reg.now = func() time.Time { return now }
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Register(ctx, srv.URL, Instance{ID: "pod-1", Address: "10.0.0.1:50051", Model: "rwkv"}, time.Hour)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return len(reg.Instances()) == 1 }, time.Second, time.Millisecond)
+
+	list, err := List(context.Background(), srv.URL)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "pod-1", list[0].ID)
+	assert.Equal(t, "10.0.0.1:50051", list[0].Address)
+	assert.Equal(t, "rwkv", list[0].Model)
+
+	cancel()
+	<-done
+	assert.Empty(t, reg.Instances(), "deregistered")
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/instances/pod-2", strings.NewReader(`{"address": "10.0.0.2:50051"}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Len(t, reg.Instances(), 1)
+	now = now.Add(2 * time.Minute)
+	assert.Empty(t, reg.Instances(), "expired")
+
+	req, err = http.NewRequest(http.MethodPut, srv.URL+"/instances/pod-3", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// HTTPOptions contains the settings of the HTTP client built by NewHTTPClient.
+type HTTPOptions struct {
+	// Proxy is the URL of the proxy to use. If empty, the proxy is taken from the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy string
+	// ConnectTimeout is the maximum time for establishing a connection (default: 30s).
+	ConnectTimeout time.Duration
+	// ResponseHeaderTimeout is the maximum time to wait for the response headers
+	// after sending a request (default: no timeout). The download of the body is
+	// never limited, since model files can take a long time to download.
+	ResponseHeaderTimeout time.Duration
+	// TLSConfig, when not nil, is the TLS configuration, e.g. trusting the
+	// certificate authority of a corporate proxy (see TLSConfig).
+	TLSConfig *tls.Config
+}
+
+// NewHTTPClient builds an HTTP client for the downloads.
+func NewHTTPClient(opts HTTPOptions) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %#v: %w", opts.Proxy, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	connectTimeout := opts.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = 30 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// TLSConfig returns a TLS configuration trusting the certificate authorities in
+// the PEM file caFile, in addition to the system ones. If caFile is empty, only
+// the system ones are trusted. If insecureSkipVerify is true, the certificates
+// are not verified at all: use it only for testing.
+func TLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile == "" {
+		return conf, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file %#v: %w", caFile, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in CA file %#v", caFile)
+	}
+	conf.RootCAs = pool
+	return conf, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPOptions{Proxy: proxy.URL})
+	require.NoError(t, err)
+
+	d := newTestDownloader(t, "http://models.example")
+	d.httpClient = client
+	require.NoError(t, d.downloadFile("config.json"))
+	assert.Equal(t, []string{"http://models.example/org/model/resolve/main/config.json"}, proxied)
+}
+
+func TestNewHTTPClient_InvalidProxy(t *testing.T) {
+	_, err := NewHTTPClient(HTTPOptions{Proxy: "://"})
+	assert.Error(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	conf, err := TLSConfig("", true)
+	require.NoError(t, err)
+	assert.True(t, conf.InsecureSkipVerify)
+
+	_, err = TLSConfig("missing.pem", false)
+	assert.Error(t, err)
+}
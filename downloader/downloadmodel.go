@@ -5,19 +5,29 @@
 package downloader
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/nlpodyssey/verbaflow/internal/diskspace"
+	"github.com/nlpodyssey/verbaflow/modelcache"
+	"github.com/nlpodyssey/verbaflow/verrors"
 	"github.com/rs/zerolog/log"
 )
 
 const (
+	huggingFaceEndpoint = "https://huggingface.co"
 	// Hugging Face repository URL, in the format:
-	// "https://huggingface.co/{model_id}/resolve/{revision}/{filename}"
-	huggingFaceCoPrefix = "https://huggingface.co/%s/resolve/%s/%s"
+	// "{endpoint}/{model_id}/resolve/{revision}/{filename}"
+	huggingFaceCoPrefix = "%s/%s/resolve/%s/%s"
+	// Hugging Face API URL listing the files of a repository, in the format:
+	// "{endpoint}/api/models/{model_id}/tree/{revision}"
+	huggingFaceTreePrefix = "%s/api/models/%s/tree/%s"
 	// Default revision name for fetching model from Hugging Face repository
 	defaultRevision = "main"
 )
@@ -27,6 +37,39 @@ var modelsFiles = []string{
 	"config.json", "pytorch_model.pt", "vocab.json", "merges.txt",
 }
 
+// gptNeoXFiles contains the set of files to download for the GPT-NeoX models
+// (see the gptneox package), in the layout of the Hugging Face repositories.
+var gptNeoXFiles = []string{
+	"config.json", "pytorch_model.bin", "tokenizer.json",
+}
+
+// optionalFiles are downloaded too when the repository has them: the decoding
+// options recommended for the model (see verbaflow.GenerationConfig).
+var optionalFiles = []string{"generation_config.json"}
+
+// Options contains the options for downloading a model.
+type Options struct {
+	// OverwriteIfExists forces the download of the files that already exist.
+	OverwriteIfExists bool
+	// AccessToken, when not empty, is used to access private repositories.
+	AccessToken string
+	// Retry is the policy for retrying the failed downloads (default: DefaultRetryPolicy).
+	Retry *RetryPolicy
+	// HTTPClient, when not nil, is the client used for the requests (see NewHTTPClient).
+	// By default, a client honoring the proxy environment variables is used.
+	HTTPClient *http.Client
+	// Parallelism is the number of files downloaded concurrently (default: 1).
+	Parallelism int
+	// MaxBandwidth, when positive, limits the aggregate download rate, in bytes per second.
+	MaxBandwidth int64
+	// Revision is the branch, tag or commit to download (default: "main").
+	// It can also be specified in the model name, as in "org/model@v2".
+	Revision string
+	// Cache, when not nil, stores the downloaded files, which are replaced by links
+	// into it; the files already in the cache are linked without downloading them.
+	Cache *modelcache.Cache
+}
+
 // Download downloads a supported pre-trained model from huggingface.co
 // repositories.
 //
@@ -38,33 +81,132 @@ var modelsFiles = []string{
 // the flag is otherwise set to true, existing files will be forcefully
 // downloaded and overwritten.
 func Download(modelsDir, modelName string, overwriteIfExists bool, accessToken string) error {
+	return DownloadWithOptions(modelsDir, modelName, Options{
+		OverwriteIfExists: overwriteIfExists,
+		AccessToken:       accessToken,
+	})
+}
+
+// DownloadWithOptions is like Download, with additional options.
+//
+// The revision is resolved to a commit hash, from which all the files are
+// downloaded; the commit is recorded in the RevisionFilename file of the model
+// directory, so that the exact version of the model can be reproduced.
+//
+// Each file is first downloaded to a ".part" file, renamed once complete.
+// Failed downloads are retried according to opts.Retry, resuming the partial
+// file if the server supports range requests; a partial file left by a
+// failed run is resumed by the next one.
+func DownloadWithOptions(modelsDir, modelName string, opts Options) error {
+	repo, revision := ParseModelName(modelName)
+	if opts.Revision != "" {
+		if revision != "" && revision != opts.Revision {
+			return fmt.Errorf("conflicting revisions %#v and %#v for model %#v", revision, opts.Revision, repo)
+		}
+		revision = opts.Revision
+	}
+	if revision == "" {
+		revision = defaultRevision
+	}
+	retry := DefaultRetryPolicy
+	if opts.Retry != nil {
+		retry = *opts.Retry
+	}
+	var limiter *bandwidthLimiter
+	if opts.MaxBandwidth > 0 {
+		limiter = newBandwidthLimiter(opts.MaxBandwidth)
+	}
 	return downloader{
+		endpoint:         huggingFaceEndpoint,
 		modelPath:        filepath.Join(modelsDir, modelName),
-		modelName:        modelName,
-		overwriteIfExist: overwriteIfExists,
-		accessToken:      accessToken,
+		modelName:        repo,
+		revision:         revision,
+		overwriteIfExist: opts.OverwriteIfExists,
+		accessToken:      opts.AccessToken,
+		retry:            retry,
+		httpClient:       opts.HTTPClient,
+		parallelism:      opts.Parallelism,
+		limiter:          limiter,
+		cache:            opts.Cache,
 	}.download()
 }
 
 // downloader is a helper struct for downloading a model.
 type downloader struct {
+	endpoint         string
 	modelPath        string
 	modelName        string
+	revision         string
 	accessToken      string
 	overwriteIfExist bool
+	retry            RetryPolicy
+	httpClient       *http.Client
+	parallelism      int
+	limiter          *bandwidthLimiter
+	cache            *modelcache.Cache
+	// files describes the files of the repository, when known.
+	files map[string]remoteFile
 }
 
 func (d downloader) download() error {
 	if err := d.ensureModelPath(); err != nil {
 		return err
 	}
-	for _, filename := range modelsFiles {
-		if err := d.downloadFile(filename); err != nil {
-			return err
-		}
+	commit, err := d.resolveRevision()
+	if err != nil {
+		return err
 	}
-	return nil
+	if err := d.checkRevision(commit); err != nil {
+		return err
+	}
+	rev := Revision{Repo: d.modelName, Revision: d.revision, Commit: commit}
+	log.Debug().Str("revision", d.revision).Str("commit", commit).Msg("resolved model revision")
+	// all the files are downloaded from the same commit, even if the branch moves meanwhile
+	d.revision = commit
 
+	if d.files, err = d.remoteFiles(); err != nil {
+		log.Warn().Err(err).Msg("unable to retrieve the list of the model files, skipping the disk space check")
+	}
+	if err := d.checkFiles(); err != nil {
+		return err
+	}
+	if err := d.checkDiskSpace(); err != nil {
+		return err
+	}
+	if err := d.downloadFiles(d.fileSet()); err != nil {
+		return err
+	}
+	return d.writeRevision(rev)
+}
+
+// downloadFiles downloads the given files, up to d.parallelism at a time.
+// It returns the first error encountered, after the ongoing downloads are over.
+func (d downloader) downloadFiles(names []string) error {
+	parallelism := d.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+	errs := make(chan error, len(names))
+	var wg sync.WaitGroup
+	for _, name := range names {
+		sem <- struct{}{}
+		if len(errs) > 0 {
+			// do not start new downloads after a failure
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			if err := d.downloadFile(name); err != nil {
+				errs <- err
+			}
+		}(name)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
 }
 
 func (d downloader) ensureModelPath() error {
@@ -77,29 +219,183 @@ func (d downloader) ensureModelPath() error {
 	return nil
 }
 
-func (d downloader) downloadFile(name string) (err error) {
+// fileSet returns the files to download: the GPT-NeoX ones if the repository
+// has them, but not the RWKV ones, or the RWKV ones otherwise, in particular
+// when the files of the repository are unknown; followed by the optional files
+// the repository has.
+func (d downloader) fileSet() []string {
+	names := modelsFiles
+	if d.files != nil && d.missingFile(modelsFiles) != "" && d.missingFile(gptNeoXFiles) == "" {
+		names = gptNeoXFiles
+	}
+	for _, name := range optionalFiles {
+		if _, ok := d.files[name]; ok {
+			names = append(names[:len(names):len(names)], name)
+		}
+	}
+	return names
+}
+
+// missingFile returns the first of the given files missing from the repository,
+// or an empty string.
+func (d downloader) missingFile(names []string) string {
+	for _, name := range names {
+		if _, ok := d.files[name]; !ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkFiles fails with verrors.ErrUnsupportedArchitecture if the repository
+// lacks any of the files to download, as for the models other than RWKV and
+// GPT-NeoX. The check is skipped if the files of the repository are unknown.
+func (d downloader) checkFiles() error {
+	if d.files == nil {
+		return nil
+	}
+	if name := d.missingFile(d.fileSet()); name != "" {
+		return fmt.Errorf("%w: the repository %#v has no %s", verrors.ErrUnsupportedArchitecture, d.modelName, name)
+	}
+	return nil
+}
+
+// checkDiskSpace fails if the files still to be downloaded don't fit in the
+// model path. The check is skipped if their size is unknown.
+func (d downloader) checkDiskSpace() error {
+	if d.files == nil {
+		return nil
+	}
+	var required uint64
+	for _, name := range d.fileSet() {
+		if d.skipFile(filepath.Join(d.modelPath, name)) || d.cachedBlob(name) != "" {
+			continue
+		}
+		required += d.files[name].size
+	}
+	return diskspace.Check(d.modelPath, required)
+}
+
+// remoteFile describes a file of the repository.
+type remoteFile struct {
+	size uint64
+	// sha256 is the hash of the content, known for the files stored with Git LFS.
+	sha256 string
+}
+
+// remoteFiles returns the files of the repository, by path.
+func (d downloader) remoteFiles() (map[string]remoteFile, error) {
+	url := fmt.Sprintf(huggingFaceTreePrefix, d.endpoint, d.modelName, d.revision)
+	resp, err := d.httpGet(url)
+	if err != nil {
+		return nil, fmt.Errorf("error getting %#v: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%#v responded with %s", url, resp.Status)
+	}
+
+	var entries []struct {
+		Path string `json:"path"`
+		Size uint64 `json:"size"`
+		LFS  *struct {
+			OID  string `json:"oid"`
+			Size uint64 `json:"size"`
+		} `json:"lfs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("error decoding %#v response: %w", url, err)
+	}
+	files := make(map[string]remoteFile, len(entries))
+	for _, e := range entries {
+		f := remoteFile{size: e.Size}
+		if e.LFS != nil {
+			// the size of LFS files refers to their pointer, not to the actual content
+			f.size = e.LFS.Size
+			if modelcache.IsHash(e.LFS.OID) {
+				f.sha256 = e.LFS.OID
+			}
+		}
+		files[e.Path] = f
+	}
+	return files, nil
+}
+
+// cachedBlob returns the hash of the named file if its content is already in the cache.
+func (d downloader) cachedBlob(name string) string {
+	if d.cache == nil {
+		return ""
+	}
+	if hash := d.files[name].sha256; hash != "" && d.cache.HasBlob(hash) {
+		return hash
+	}
+	return ""
+}
+
+// skipFile reports whether the file already exists and must not be downloaded again.
+func (d downloader) skipFile(fPath string) bool {
+	info, err := os.Stat(fPath)
+	return !d.overwriteIfExist && err == nil && !info.IsDir()
+}
+
+func (d downloader) downloadFile(name string) error {
 	fPath := filepath.Join(d.modelPath, name)
-	if info, err := os.Stat(fPath); !d.overwriteIfExist && err == nil && !info.IsDir() {
+	if d.skipFile(fPath) {
 		log.Debug().Str("file", fPath).Msg("model file already exists, skipping download")
 		return nil
 	}
 
+	if hash := d.cachedBlob(name); hash != "" {
+		log.Debug().Str("file", fPath).Msg("model file found in cache, skipping download")
+		return d.cache.LinkBlob(hash, fPath)
+	}
+
 	url := d.bucketURL(name)
+	partPath := fPath + ".part"
 	log.Debug().Str("url", url).Str("destination", fPath).Msg("downloading")
 
-	f, err := os.Create(fPath)
+	err := d.retry.withRetry(func() error {
+		return d.downloadPart(url, partPath)
+	}, func(err error, delay time.Duration) {
+		log.Warn().Err(err).Str("url", url).Msgf("download failed, retrying in %s", delay.Round(time.Millisecond))
+	})
 	if err != nil {
-		return fmt.Errorf("error creating file %#v: %w", fPath, err)
+		return err
 	}
-	defer func() {
-		if e := f.Close(); e != nil && err == nil {
-			err = fmt.Errorf("error closing file %#v: %w", fPath, e)
-		}
-	}()
+	if err := os.Rename(partPath, fPath); err != nil {
+		return fmt.Errorf("error renaming %#v to %#v: %w", partPath, fPath, err)
+	}
+	if d.cache == nil {
+		return nil
+	}
+	hash, err := d.cache.Put(fPath)
+	if err != nil {
+		return fmt.Errorf("error storing %#v in cache: %w", fPath, err)
+	}
+	if expected := d.files[name].sha256; expected != "" && hash != expected {
+		return fmt.Errorf("checksum mismatch for %#v: expected %s, got %s", fPath, expected, hash)
+	}
+	return nil
+}
 
-	resp, err := d.httpGet(url)
+// downloadPart downloads the file at url to partPath, resuming the download from
+// the end of partPath if it already exists and the server supports it.
+func (d downloader) downloadPart(url, partPath string) (err error) {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := d.newRequest(url)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.client().Do(req)
 	if err != nil {
-		return fmt.Errorf("error getting %#v: %w", url, err)
+		return &retryableError{err: fmt.Errorf("error getting %#v: %w", url, err)}
 	}
 	defer func() {
 		if e := resp.Body.Close(); e != nil && err == nil {
@@ -107,22 +403,47 @@ func (d downloader) downloadFile(name string) (err error) {
 		}
 	}()
 
-	if resp.StatusCode != http.StatusOK {
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		log.Debug().Str("url", url).Int64("offset", offset).Msg("resuming download")
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is not a prefix of the remote one: start over
+		if err := os.Remove(partPath); err != nil {
+			return err
+		}
+		return &retryableError{err: fmt.Errorf("%#v responded with %s", url, resp.Status)}
+	case isRetryableStatus(resp.StatusCode):
+		return &retryableError{err: fmt.Errorf("%#v responded with %s", url, resp.Status), after: retryAfter(resp)}
+	default:
 		return fmt.Errorf("%#v responded with %s", url, resp.Status)
 	}
 
+	f, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating file %#v: %w", partPath, err)
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = fmt.Errorf("error closing file %#v: %w", partPath, e)
+		}
+	}()
+
 	prog := newDownloadProgress(int(resp.ContentLength))
 	prog.Start()
 	defer prog.Stop()
 
-	_, err = io.Copy(f, io.TeeReader(resp.Body, prog))
-	if err != nil {
-		return fmt.Errorf("error downloading %#v to %#v: %w", url, fPath, err)
+	if _, err = io.Copy(f, io.TeeReader(d.limiter.reader(resp.Body), prog)); err != nil {
+		// the data written so far is kept, and resumed by the next attempt
+		return &retryableError{err: fmt.Errorf("error downloading %#v to %#v: %w", url, partPath, err)}
 	}
 	return nil
 }
 
-func (d downloader) httpGet(url string) (*http.Response, error) {
+func (d downloader) newRequest(url string) (*http.Request, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -130,9 +451,24 @@ func (d downloader) httpGet(url string) (*http.Response, error) {
 	if d.accessToken != "" {
 		req.Header.Set("Authorization", "Bearer "+d.accessToken)
 	}
-	return http.DefaultClient.Do(req)
+	return req, nil
+}
+
+func (d downloader) client() *http.Client {
+	if d.httpClient != nil {
+		return d.httpClient
+	}
+	return http.DefaultClient
+}
+
+func (d downloader) httpGet(url string) (*http.Response, error) {
+	req, err := d.newRequest(url)
+	if err != nil {
+		return nil, err
+	}
+	return d.client().Do(req)
 }
 
 func (d downloader) bucketURL(fileName string) string {
-	return fmt.Sprintf(huggingFaceCoPrefix, d.modelName, defaultRevision, fileName)
+	return fmt.Sprintf(huggingFaceCoPrefix, d.endpoint, d.modelName, d.revision, fileName)
 }
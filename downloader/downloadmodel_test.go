@@ -0,0 +1,194 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/modelcache"
+	"github.com/nlpodyssey/verbaflow/verrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+func newTestDownloader(t *testing.T, endpoint string) downloader {
+	return downloader{
+		endpoint:  endpoint,
+		modelPath: t.TempDir(),
+		modelName: "org/model",
+		revision:  defaultRevision,
+		retry:     testRetryPolicy,
+	}
+}
+
+func TestDownloadFile_RetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL)
+	require.NoError(t, d.downloadFile("config.json"))
+	assert.Equal(t, int32(3), calls.Load())
+
+	data, err := os.ReadFile(filepath.Join(d.modelPath, "config.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	assert.NoFileExists(t, filepath.Join(d.modelPath, "config.json.part"))
+}
+
+func TestDownloadFile_DoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL)
+	assert.Error(t, d.downloadFile("config.json"))
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestDownloadFile_ResumesPartialFile(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte(content)))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL)
+	partPath := filepath.Join(d.modelPath, "vocab.json.part")
+	require.NoError(t, os.WriteFile(partPath, []byte(content[:42]), 0644))
+
+	require.NoError(t, d.downloadFile("vocab.json"))
+	assert.Equal(t, []string{"bytes=42-"}, ranges)
+
+	data, err := os.ReadFile(filepath.Join(d.modelPath, "vocab.json"))
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, p.backoff(1))
+	assert.Equal(t, 2*time.Second, p.backoff(2))
+	assert.Equal(t, 4*time.Second, p.backoff(3))
+	assert.Equal(t, 5*time.Second, p.backoff(4))
+
+	p.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := p.backoff(1)
+		assert.True(t, d >= 500*time.Millisecond && d <= 1500*time.Millisecond, d)
+	}
+}
+
+func TestDownloadFiles_Parallel(t *testing.T) {
+	var active, maxActive atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL)
+	d.parallelism = 2
+	require.NoError(t, d.downloadFiles(modelsFiles))
+	assert.Equal(t, int32(2), maxActive.Load())
+	for _, name := range modelsFiles {
+		assert.FileExists(t, filepath.Join(d.modelPath, name))
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	l := newBandwidthLimiter(1000)
+	start := time.Now()
+	// the first second of traffic is a burst, the following 500 bytes take half a second
+	n, err := io.Copy(io.Discard, l.reader(bytes.NewReader(make([]byte, 1500))))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1500), n)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestDownloadFile_Cache(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write([]byte("weights"))
+	}))
+	defer srv.Close()
+
+	cache, err := modelcache.Open(t.TempDir())
+	require.NoError(t, err)
+
+	d := newTestDownloader(t, srv.URL)
+	d.cache = cache
+	require.NoError(t, d.downloadFile("pytorch_model.pt"))
+	hash, err := cache.Hash(filepath.Join(d.modelPath, "pytorch_model.pt"))
+	require.NoError(t, err)
+	assert.True(t, cache.HasBlob(hash))
+
+	// another model dir with the same file links it from the cache, without downloading it
+	other := newTestDownloader(t, srv.URL)
+	other.cache = cache
+	other.files = map[string]remoteFile{"pytorch_model.pt": {size: 7, sha256: hash}}
+	require.NoError(t, other.downloadFile("pytorch_model.pt"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	data, err := os.ReadFile(filepath.Join(other.modelPath, "pytorch_model.pt"))
+	require.NoError(t, err)
+	assert.Equal(t, "weights", string(data))
+}
+
+func TestCheckFiles_UnsupportedArchitecture(t *testing.T) {
+	d := newTestDownloader(t, "")
+	require.NoError(t, d.checkFiles(), "unknown files")
+
+	d.files = map[string]remoteFile{"config.json": {}, "model.safetensors": {}, "tokenizer.json": {}}
+	assert.ErrorIs(t, d.checkFiles(), verrors.ErrUnsupportedArchitecture)
+
+	d.files = make(map[string]remoteFile)
+	for _, name := range modelsFiles {
+		d.files[name] = remoteFile{}
+	}
+	assert.NoError(t, d.checkFiles())
+	assert.Equal(t, modelsFiles, d.fileSet())
+
+	d.files = make(map[string]remoteFile)
+	for _, name := range gptNeoXFiles {
+		d.files[name] = remoteFile{}
+	}
+	assert.NoError(t, d.checkFiles())
+	assert.Equal(t, gptNeoXFiles, d.fileSet())
+
+	d.files["generation_config.json"] = remoteFile{}
+	assert.Equal(t, append(gptNeoXFiles, "generation_config.json"), d.fileSet())
+}
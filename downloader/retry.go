@@ -0,0 +1,112 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed downloads are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts for each file, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry; it doubles at each further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the delay that is randomized (between 0 and 1),
+	// to avoid retrying in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the policy used when none is specified.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+	Jitter:         0.2,
+}
+
+// backoff returns the delay before the given retry (1-based).
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// retryableError is an error that can be resolved by trying again.
+type retryableError struct {
+	err error
+	// after, when positive, is the delay requested by the server (Retry-After header).
+	after time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// isRetryableStatus reports whether the request may succeed if repeated:
+// the server is throttling (429) or has a temporary failure (5xx).
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryAfter parses the Retry-After header, expressed in seconds or as a date.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// withRetry calls fn until it succeeds, fails with a non-retryable error,
+// or the maximum number of attempts is reached.
+func (p RetryPolicy) withRetry(fn func() error, onRetry func(err error, delay time.Duration)) error {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var re *retryableError
+		if !errors.As(err, &re) || attempt >= attempts {
+			return err
+		}
+		delay := p.backoff(attempt)
+		if re.after > delay {
+			delay = re.after
+		}
+		if onRetry != nil {
+			onRetry(err, delay)
+		}
+		time.Sleep(delay)
+	}
+}
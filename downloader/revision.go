@@ -0,0 +1,111 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RevisionFilename is the name of the file, in the model directory, recording
+// the revision the model was downloaded from.
+const RevisionFilename = "revision.json"
+
+// huggingFaceRevisionPrefix is the Hugging Face API URL describing a revision, in the format:
+// "{endpoint}/api/models/{model_id}/revision/{revision}"
+const huggingFaceRevisionPrefix = "%s/api/models/%s/revision/%s"
+
+// Revision identifies the exact version of a downloaded model.
+type Revision struct {
+	// Repo is the Hugging Face repository of the model.
+	Repo string `json:"repo"`
+	// Revision is the requested branch, tag or commit.
+	Revision string `json:"revision"`
+	// Commit is the hash of the commit the revision resolved to.
+	Commit string `json:"commit"`
+}
+
+// ParseModelName splits a model name in the form "org/model@revision" into the
+// repository and the revision. The revision is empty if not specified.
+func ParseModelName(name string) (repo, revision string) {
+	if i := strings.LastIndexByte(name, '@'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// ReadRevision reads the revision recorded in the model directory.
+func ReadRevision(modelDir string) (Revision, error) {
+	data, err := os.ReadFile(filepath.Join(modelDir, RevisionFilename))
+	if err != nil {
+		return Revision{}, err
+	}
+	var rev Revision
+	if err := json.Unmarshal(data, &rev); err != nil {
+		return Revision{}, fmt.Errorf("error decoding %#v: %w", RevisionFilename, err)
+	}
+	return rev, nil
+}
+
+// resolveRevision returns the hash of the commit the revision points to.
+func (d downloader) resolveRevision() (string, error) {
+	u := fmt.Sprintf(huggingFaceRevisionPrefix, d.endpoint, d.modelName, url.PathEscape(d.revision))
+	resp, err := d.httpGet(u)
+	if err != nil {
+		return "", fmt.Errorf("error getting %#v: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("revision %#v not found in %#v", d.revision, d.modelName)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%#v responded with %s", u, resp.Status)
+	}
+	var info struct {
+		SHA string `json:"sha"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("error decoding %#v response: %w", u, err)
+	}
+	if info.SHA == "" {
+		return "", fmt.Errorf("%#v responded without a commit hash", u)
+	}
+	return info.SHA, nil
+}
+
+// checkRevision fails if the model directory already contains files downloaded
+// from a different commit, which would be mixed with the new ones.
+func (d downloader) checkRevision(commit string) error {
+	if d.overwriteIfExist {
+		return nil
+	}
+	prev, err := ReadRevision(d.modelPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if prev.Repo != d.modelName || prev.Commit != commit {
+		return fmt.Errorf("%#v contains %s@%s (commit %s), not the requested revision %#v (commit %s): "+
+			"use a different model directory, or overwrite the existing files",
+			d.modelPath, prev.Repo, prev.Revision, prev.Commit, d.revision, commit)
+	}
+	return nil
+}
+
+func (d downloader) writeRevision(rev Revision) error {
+	data, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(d.modelPath, RevisionFilename), append(data, '\n'), 0644)
+}
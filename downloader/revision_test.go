@@ -0,0 +1,65 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseModelName(t *testing.T) {
+	repo, rev := ParseModelName("org/model@v2")
+	assert.Equal(t, "org/model", repo)
+	assert.Equal(t, "v2", rev)
+
+	repo, rev = ParseModelName("org/model")
+	assert.Equal(t, "org/model", repo)
+	assert.Empty(t, rev)
+}
+
+func TestDownload_PinsResolvedCommit(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/api/models/org/model/revision/v2":
+			_, _ = w.Write([]byte(`{"sha": "abc123"}`))
+		case r.URL.Path == "/api/models/org/model/revision/v1":
+			_, _ = w.Write([]byte(`{"sha": "def456"}`))
+		case strings.HasPrefix(r.URL.Path, "/api/models/org/model/revision/"):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasPrefix(r.URL.Path, "/api/"):
+			_, _ = w.Write([]byte(`[{"path": "config.json"}, {"path": "pytorch_model.pt"}, {"path": "vocab.json"}, {"path": "merges.txt"}]`))
+		default:
+			_, _ = w.Write([]byte("data"))
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(t, srv.URL)
+	d.revision = "v2"
+	require.NoError(t, d.download())
+	assert.Contains(t, paths, "/org/model/resolve/abc123/config.json")
+
+	rev, err := ReadRevision(d.modelPath)
+	require.NoError(t, err)
+	assert.Equal(t, Revision{Repo: "org/model", Revision: "v2", Commit: "abc123"}, rev)
+
+	// the directory already contains another commit
+	d.revision = "v1"
+	assert.ErrorContains(t, d.download(), "not the requested revision")
+
+	d.revision = "missing"
+	assert.ErrorContains(t, d.download(), "not found")
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/encoder"
+)
+
+// Embed returns the embedding of the text: the hidden state of the RWKV model
+// after its last token, layer-normalized like before the LM head, with unit
+// length, so that the dot product of two embeddings is their cosine similarity.
+// It requires an RWKV model, and is subject to the limits of SetMaxConcurrency
+// and SetMaxPromptTokens.
+func (vf *VerbaFlow) Embed(ctx context.Context, text string) ([]float64, error) {
+	if vf.Model == nil {
+		if vf.Backend != nil {
+			return nil, fmt.Errorf("verbaflow: embeddings require an RWKV model: %w", ErrUnsupportedArchitecture)
+		}
+		return nil, ErrModelNotLoaded
+	}
+	tokens, err := vf.Tokenizer.Tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("verbaflow: no tokens to embed")
+	}
+	if err := vf.CheckPromptLength(len(tokens)); err != nil {
+		return nil, err
+	}
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	r, err := encoder.New(vf.Model).Encode(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+	x := ag.WaitForValue(vf.Model.LN.Forward(r.Encoding)[0])
+	embedding := append([]float64(nil), x.Value().Data().F64()...)
+	var norm float64
+	for _, v := range embedding {
+		norm += v * v
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for i := range embedding {
+			embedding[i] /= norm
+		}
+	}
+	return embedding, nil
+}
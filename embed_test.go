@@ -0,0 +1,39 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_Embed(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	ctx := context.Background()
+
+	e, err := vf.Embed(ctx, "hello")
+	require.NoError(t, err)
+	require.Len(t, e, vf.Model.Config.DModel)
+	var norm float64
+	for _, v := range e {
+		norm += v * v
+	}
+	assert.InDelta(t, 1, math.Sqrt(norm), 1e-6)
+
+	again, err := vf.Embed(ctx, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, e, again)
+
+	_, err = vf.Embed(ctx, "")
+	assert.Error(t, err)
+
+	vf.SetMaxPromptTokens(2)
+	_, err = vf.Embed(ctx, "hello")
+	assert.ErrorIs(t, err, ErrPromptTooLong)
+}
@@ -6,29 +6,98 @@ package encoder
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/nlpodyssey/rwkv"
 	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
 	"github.com/nlpodyssey/verbaflow/rwkvlm"
 )
 
 type Encoder struct {
 	model *rwkvlm.Model
+	opts  rwkvlm.EncodeOptions
 }
 
 type Result struct {
 	Encoding ag.Node
 	State    rwkv.State
+	// Tokens are the encoded token IDs.
+	Tokens []int
+	// EmbeddingTime is the time spent looking up the embeddings of the tokens.
+	EmbeddingTime time.Duration
+	// EncoderTime is the time spent running the RWKV layers.
+	EncoderTime time.Duration
 }
 
 func New(model *rwkvlm.Model) *Encoder {
 	return &Encoder{model: model}
 }
 
+// NewWithOptions returns an Encoder encoding the tokens in chunks, with the given
+// options (see rwkvlm.Model.EncodeEmbeddingsChunked).
+func NewWithOptions(model *rwkvlm.Model, opts rwkvlm.EncodeOptions) *Encoder {
+	return &Encoder{model: model, opts: opts}
+}
+
+// Encode encodes the tokens in chunks, failing if ctx is done before the end.
 func (e *Encoder) Encode(ctx context.Context, tokens []int) (Result, error) {
-	x, s := e.model.Encode(ctx, nil, tokens...)
+	start := time.Now()
+	xs := e.model.EncodeTokens(ctx, tokens...)
+	embedded := time.Now()
+	x, s, err := e.model.EncodeEmbeddingsChunked(ctx, nil, xs, e.opts)
+	if err != nil {
+		return Result{}, err
+	}
 	return Result{
-		Encoding: ag.WaitForValue(x),
-		State:    s,
+		Encoding:      ag.WaitForValue(x),
+		State:         s,
+		Tokens:        tokens,
+		EmbeddingTime: embedded.Sub(start),
+		EncoderTime:   time.Since(embedded),
 	}, nil
 }
+
+// DecoderInput returns the input of the decoder following the encoded tokens,
+// computing the logits with the model. The nodes are tracked in nt.
+func (r Result) DecoderInput(m *rwkvlm.Model, nt *ag.NodesTracker) decoder.Input {
+	in := m.DecoderInput(nt, r.Encoding, r.State, r.Tokens)
+	in.Timing.Embedding = r.EmbeddingTime
+	in.Timing.Encoder = r.EncoderTime
+	return in
+}
+
+// EncodeBatch encodes multiple sequences of tokens at once, with a single pass of
+// the parallel formulation (see rwkvlm.Model.EncodeBatch), e.g. for the batch and
+// scoring workloads. The times of the results are those of the whole batch.
+func (e *Encoder) EncodeBatch(ctx context.Context, tokens [][]int) ([]Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, t := range tokens {
+		if len(t) == 0 {
+			return nil, fmt.Errorf("encoder: empty sequence %d", i)
+		}
+	}
+	start := time.Now()
+	inputs := make([][]ag.Node, len(tokens))
+	for i, t := range tokens {
+		inputs[i] = e.model.EncodeTokens(ctx, t...)
+	}
+	embedded := time.Now()
+	hs, states := e.model.EncodeBatch(nil, inputs)
+	encoderTime := time.Since(embedded)
+
+	results := make([]Result, len(tokens))
+	for i, t := range tokens {
+		results[i] = Result{
+			Encoding:      hs[i][len(t)-1],
+			State:         states[i],
+			Tokens:        t,
+			EmbeddingTime: embedded.Sub(start),
+			EncoderTime:   encoderTime,
+		}
+	}
+	return results, nil
+}
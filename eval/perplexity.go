@@ -0,0 +1,193 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package eval evaluates the quality of a language model.
+package eval
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+)
+
+// PerplexityOptions contains the options for the perplexity evaluation.
+type PerplexityOptions struct {
+	// WindowSize is the maximum number of tokens the model sees at once (default: 1024).
+	WindowSize int
+	// Stride is the number of tokens the window is moved by at each step (default: WindowSize/2).
+	// The tokens overlapping the previous window are used as context only, without being scored.
+	Stride int
+	// Progress, when not nil, is called after each window with the number of scored tokens.
+	Progress func(scored, total int)
+}
+
+// PerplexityResult is the outcome of a perplexity evaluation.
+type PerplexityResult struct {
+	// Tokens is the number of scored tokens.
+	Tokens int `json:"tokens"`
+	// NegLogLikelihood is the average negative log-likelihood of the scored tokens, in nats.
+	NegLogLikelihood float64 `json:"nll"`
+	// Perplexity is the exponential of NegLogLikelihood.
+	Perplexity float64 `json:"perplexity"`
+	// BitsPerToken is NegLogLikelihood expressed in bits.
+	BitsPerToken float64 `json:"bits_per_token"`
+}
+
+// window is a span [begin, end) of the corpus, whose tokens from target onwards are scored.
+type window struct {
+	begin, target, end int
+}
+
+// Perplexity computes the perplexity of the model on the given tokenized corpus,
+// using sliding windows so that corpora longer than the window can be evaluated.
+func Perplexity(ctx context.Context, m *rwkvlm.Model, tokens []int, opts PerplexityOptions) (PerplexityResult, error) {
+	if len(tokens) < 2 {
+		return PerplexityResult{}, fmt.Errorf("eval: at least two tokens are required to compute the perplexity")
+	}
+	if opts.WindowSize <= 0 {
+		opts.WindowSize = 1024
+	}
+	if opts.Stride <= 0 || opts.Stride > opts.WindowSize {
+		opts.Stride = max(opts.WindowSize/2, 1)
+	}
+
+	var nll float64
+	var scored int
+	for _, w := range slidingWindows(len(tokens), opts.WindowSize, opts.Stride) {
+		if err := ctx.Err(); err != nil {
+			return PerplexityResult{}, err
+		}
+		scores := scoreSequence(ctx, m, tokens[w.begin:w.end], w.target-w.begin)
+		for _, sc := range scores {
+			nll -= sc.logProb
+		}
+		scored += len(scores)
+		if opts.Progress != nil {
+			opts.Progress(scored, len(tokens)-1)
+		}
+	}
+
+	avg := nll / float64(scored)
+	return PerplexityResult{
+		Tokens:           scored,
+		NegLogLikelihood: avg,
+		Perplexity:       math.Exp(avg),
+		BitsPerToken:     avg / math.Ln2,
+	}, nil
+}
+
+// slidingWindows splits a sequence of n tokens into windows of the given size,
+// moved by stride tokens. Each token but the first one is scored exactly once.
+func slidingWindows(n, size, stride int) []window {
+	var ws []window
+	prevEnd := 1 // the first token has no context and cannot be scored
+	for begin := 0; ; begin += stride {
+		end := min(begin+size, n)
+		if end > prevEnd {
+			ws = append(ws, window{begin: begin, target: max(prevEnd, begin+1), end: end})
+			prevEnd = end
+		}
+		if end == n {
+			return ws
+		}
+	}
+}
+
+// tokenScore is the score of a token given the preceding ones.
+type tokenScore struct {
+	// logProb is the log-probability of the token.
+	logProb float64
+	// greedy reports whether the token is the most probable one.
+	greedy bool
+}
+
+// scoreSequence encodes the given tokens from an empty state, and returns the
+// scores of the tokens from index `from` onwards, given the preceding ones.
+func scoreSequence(ctx context.Context, m *rwkvlm.Model, tokens []int, from int) []tokenScore {
+	xs := m.EncodeTokens(ctx, tokens...)
+	h, s := m.Encoder.ForwardSequence(xs, nil)
+	nodes := append([]ag.Node{}, h...)
+	for _, layer := range s {
+		nodes = append(nodes, layer.FfnXX, layer.AttXX, layer.AttAA, layer.AttBB, layer.AttPP)
+	}
+	// the whole sequence must be computed before the graph can be released piecewise
+	for _, n := range nodes {
+		ag.WaitForValue(n)
+	}
+	defer graph.ReleaseGraph(nodes...)
+
+	scores := make([]tokenScore, 0, len(tokens)-from)
+	for i := from; i < len(tokens); i++ {
+		logits := m.Predict(h[i-1])
+		scores = append(scores, score(logits.Value(), tokens[i]))
+		graph.ReleaseGraph(logits)
+	}
+	return scores
+}
+
+// scoreContinuations encodes the prefix, then all the continuations at once,
+// from the state after the prefix (see rwkvlm.Model.EncodeBatch), and returns
+// the scores of the tokens of each continuation.
+func scoreContinuations(ctx context.Context, m *rwkvlm.Model, prefix []int, continuations [][]int) [][]tokenScore {
+	last, s := m.EncodeParallel(nil, m.EncodeTokens(ctx, prefix...))
+	states := make([]rwkv.State, len(continuations))
+	inputs := make([][]ag.Node, len(continuations))
+	for i, tokens := range continuations {
+		states[i] = s
+		inputs[i] = m.EncodeTokens(ctx, tokens...)
+	}
+	hs, _ := m.EncodeBatch(states, inputs)
+
+	scores := make([][]tokenScore, len(continuations))
+	for i, tokens := range continuations {
+		h := last
+		for j, id := range tokens {
+			logits := m.Predict(h)
+			scores[i] = append(scores[i], score(logits.Value(), id))
+			graph.ReleaseGraph(logits)
+			h = hs[i][j]
+		}
+	}
+	return scores
+}
+
+// score returns the score of the given token according to the logits.
+func score(logits mat.Matrix, tokenID int) tokenScore {
+	data := logits.Data().F64()
+	argmax := 0
+	for i, v := range data {
+		if v > data[argmax] {
+			argmax = i
+		}
+	}
+	maxLogit := data[argmax]
+	var sum float64
+	for _, v := range data {
+		sum += math.Exp(v - maxLogit)
+	}
+	return tokenScore{
+		logProb: data[tokenID] - maxLogit - math.Log(sum),
+		greedy:  data[tokenID] == maxLogit,
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eval
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingWindows(t *testing.T) {
+	assert.Equal(t, []window{{0, 1, 5}}, slidingWindows(5, 8, 4))
+	assert.Equal(t, []window{
+		{begin: 0, target: 1, end: 4},
+		{begin: 2, target: 4, end: 6},
+		{begin: 4, target: 6, end: 7},
+	}, slidingWindows(7, 4, 2))
+
+	// every token but the first one is scored exactly once
+	for _, n := range []int{2, 10, 33} {
+		var scored int
+		for _, w := range slidingWindows(n, 8, 3) {
+			scored += w.end - w.target
+		}
+		assert.Equal(t, n-1, scored)
+	}
+}
+
+func TestScore(t *testing.T) {
+	logits := mat.NewVecDense([]float32{1, 1, 1, 1})
+	sc := score(logits, 2)
+	assert.InDelta(t, math.Log(0.25), sc.logProb, 1e-6)
+	assert.True(t, sc.greedy)
+
+	logits = mat.NewVecDense([]float32{0, 3, 1})
+	assert.False(t, score(logits, 2).greedy)
+	assert.True(t, score(logits, 1).greedy)
+}
+
+func TestScoreContinuations(t *testing.T) {
+	m := loadTinyModel(t)
+	ctx := context.Background()
+	prefix := []int{3, 17, 42, 5}
+	continuations := [][]int{{7}, {9, 11, 2}, {42, 42}}
+
+	scores := scoreContinuations(ctx, m, prefix, continuations)
+	require.Len(t, scores, len(continuations))
+	for i, c := range continuations {
+		expected := scoreSequence(ctx, m, append(append([]int{}, prefix...), c...), len(prefix))
+		require.Len(t, scores[i], len(expected))
+		for j := range expected {
+			assert.InDelta(t, expected[j].logProb, scores[i][j].logProb, 1e-4)
+			assert.Equal(t, expected[j].greedy, scores[i][j].greedy)
+		}
+	}
+}
+
+// loadTinyModel loads a copy of the bundled tiny model, with its embeddings.
+func loadTinyModel(t *testing.T) *rwkvlm.Model {
+	t.Helper()
+	src := filepath.Join("..", "testdata", "tiny-rwkv")
+	dir := t.TempDir()
+	err := filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, rel), data, 0644)
+	})
+	require.NoError(t, err)
+
+	m, err := rwkvlm.Load(dir)
+	require.NoError(t, err)
+	repo, err := diskstore.NewRepository(filepath.Join(dir, rwkvlm.DefaultEmbeddingRepoPath), diskstore.ReadOnlyMode)
+	require.NoError(t, err)
+	t.Cleanup(func() { repo.Close() })
+	require.NoError(t, m.ApplyEmbeddings(repo))
+	return m
+}
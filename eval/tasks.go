@@ -0,0 +1,310 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eval
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+)
+
+// Example is a single document of a benchmark, scored by comparing the
+// log-likelihood of each choice as a continuation of the context.
+type Example struct {
+	Context string
+	Choices []string
+	// Label is the index of the correct choice.
+	Label int
+}
+
+// Task is a benchmark that can be run against a model.
+// The prompts and the metrics follow the lm-evaluation-harness conventions,
+// so that the results are comparable with the published ones.
+type Task struct {
+	Name string
+	// Load reads the examples from a JSONL file, in the format of the
+	// corresponding Hugging Face dataset.
+	Load func(r io.Reader) ([]Example, error)
+	// Greedy marks the tasks scored by checking whether the only choice is the
+	// greedy continuation of the context (e.g. LAMBADA), instead of comparing the choices.
+	Greedy bool
+}
+
+// Tasks lists the supported tasks, by name.
+var Tasks = map[string]Task{
+	"lambada":       {Name: "lambada", Load: loadLambada, Greedy: true},
+	"hellaswag":     {Name: "hellaswag", Load: loadHellaSwag},
+	"arc_easy":      {Name: "arc_easy", Load: loadARC},
+	"arc_challenge": {Name: "arc_challenge", Load: loadARC},
+}
+
+// TaskNames returns the sorted names of the supported tasks.
+func TaskNames() []string {
+	names := make([]string, 0, len(Tasks))
+	for name := range Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TaskOptions contains the options for running a task.
+type TaskOptions struct {
+	// Limit, when positive, is the maximum number of examples evaluated.
+	Limit int
+	// Progress, when not nil, is called after each example.
+	Progress func(done, total int)
+	// LengthPenalty, when not zero, adds the "acc_len" metric to the multiple choice
+	// tasks: the accuracy with the log-likelihoods divided by the number of tokens of
+	// the choices to the power of LengthPenalty (see decoder.NormalizeScore).
+	LengthPenalty float64
+}
+
+// TaskResult is the outcome of a task.
+type TaskResult struct {
+	Task     string `json:"task"`
+	Examples int    `json:"examples"`
+	// Metrics are "acc" and "acc_norm" (accuracy with the log-likelihoods normalized
+	// by the length in bytes of the choices) for multiple choice tasks, with "acc_len"
+	// if TaskOptions.LengthPenalty is set, "acc" and "perplexity" for greedy tasks.
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// RunTask evaluates the model on the examples of the given task.
+func RunTask(ctx context.Context, m *rwkvlm.Model, tk tokenizer.Tokenizer, task Task, examples []Example, opts TaskOptions) (TaskResult, error) {
+	if opts.Limit > 0 && opts.Limit < len(examples) {
+		examples = examples[:opts.Limit]
+	}
+	if len(examples) == 0 {
+		return TaskResult{}, fmt.Errorf("eval: no examples for task %q", task.Name)
+	}
+
+	var correct, correctNorm, correctLen int
+	var nll float64
+	for i, ex := range examples {
+		if err := ctx.Err(); err != nil {
+			return TaskResult{}, err
+		}
+		lls, lengths, greedies, err := loglikelihoods(ctx, m, tk, ex.Context, ex.Choices)
+		if err != nil {
+			return TaskResult{}, err
+		}
+		best, bestNorm, bestLen := -1, -1, -1
+		var bestLL, bestLLNorm, bestLLLen float64
+		for j, choice := range ex.Choices {
+			ll, greedy := lls[j], greedies[j]
+			if task.Greedy {
+				nll -= ll
+				if greedy {
+					correct++
+				}
+				continue
+			}
+			if best < 0 || ll > bestLL {
+				best, bestLL = j, ll
+			}
+			if llNorm := ll / float64(len(choice)); bestNorm < 0 || llNorm > bestLLNorm {
+				bestNorm, bestLLNorm = j, llNorm
+			}
+			if llLen := decoder.NormalizeScore(ll, lengths[j], opts.LengthPenalty); bestLen < 0 || llLen > bestLLLen {
+				bestLen, bestLLLen = j, llLen
+			}
+		}
+		if best == ex.Label {
+			correct++
+		}
+		if bestNorm == ex.Label {
+			correctNorm++
+		}
+		if bestLen == ex.Label {
+			correctLen++
+		}
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(examples))
+		}
+	}
+
+	n := float64(len(examples))
+	result := TaskResult{
+		Task:     task.Name,
+		Examples: len(examples),
+		Metrics:  map[string]float64{"acc": float64(correct) / n},
+	}
+	if task.Greedy {
+		result.Metrics["perplexity"] = math.Exp(nll / n)
+	} else {
+		result.Metrics["acc_norm"] = float64(correctNorm) / n
+		if opts.LengthPenalty != 0 {
+			result.Metrics["acc_len"] = float64(correctLen) / n
+		}
+	}
+	return result, nil
+}
+
+// loglikelihoods returns the log-likelihood of each continuation given the context,
+// its number of tokens, and whether the continuation is the greedy one. The context is encoded once, and
+// the continuations together, starting from the state after the context.
+func loglikelihoods(ctx context.Context, m *rwkvlm.Model, tk tokenizer.Tokenizer, prompt string, continuations []string) ([]float64, []int, []bool, error) {
+	contextTokens, err := tk.Tokenize(prompt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	continuationsTokens := make([][]int, len(continuations))
+	for i, continuation := range continuations {
+		if continuationsTokens[i], err = tk.Tokenize(continuation); err != nil {
+			return nil, nil, nil, err
+		}
+		if len(continuationsTokens[i]) == 0 {
+			return nil, nil, nil, fmt.Errorf("eval: empty continuation")
+		}
+	}
+	if len(contextTokens) == 0 {
+		return nil, nil, nil, fmt.Errorf("eval: empty context")
+	}
+
+	lls := make([]float64, len(continuations))
+	lengths := make([]int, len(continuations))
+	greedies := make([]bool, len(continuations))
+	for i, scores := range scoreContinuations(ctx, m, contextTokens, continuationsTokens) {
+		greedies[i] = true
+		lengths[i] = len(scores)
+		for _, sc := range scores {
+			lls[i] += sc.logProb
+			greedies[i] = greedies[i] && sc.greedy
+		}
+	}
+	return lls, lengths, greedies, nil
+}
+
+// readJSONL reads the examples of a task from a JSONL file, converting each document with fn.
+func readJSONL[T any](r io.Reader, fn func(T) (Example, error)) ([]Example, error) {
+	var examples []Example
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var doc T
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			return nil, fmt.Errorf("eval: line %d: %w", line, err)
+		}
+		ex, err := fn(doc)
+		if err != nil {
+			return nil, fmt.Errorf("eval: line %d: %w", line, err)
+		}
+		examples = append(examples, ex)
+	}
+	return examples, scanner.Err()
+}
+
+// loadLambada reads documents like {"text": "..."}: the last word is the one to predict.
+func loadLambada(r io.Reader) ([]Example, error) {
+	return readJSONL(r, func(doc struct {
+		Text string `json:"text"`
+	}) (Example, error) {
+		i := strings.LastIndexByte(doc.Text, ' ')
+		if i < 0 {
+			return Example{}, fmt.Errorf("text without context: %q", doc.Text)
+		}
+		return Example{Context: doc.Text[:i], Choices: []string{doc.Text[i:]}}, nil
+	})
+}
+
+// loadHellaSwag reads documents like {"activity_label": "...", "ctx_a": "...", "ctx_b": "...",
+// "endings": [...], "label": "0"}.
+func loadHellaSwag(r io.Reader) ([]Example, error) {
+	return readJSONL(r, func(doc struct {
+		ActivityLabel string          `json:"activity_label"`
+		CtxA          string          `json:"ctx_a"`
+		CtxB          string          `json:"ctx_b"`
+		Endings       []string        `json:"endings"`
+		Label         json.RawMessage `json:"label"`
+	}) (Example, error) {
+		label, err := parseLabel(doc.Label)
+		if err != nil {
+			return Example{}, err
+		}
+		ex := Example{
+			Context: preprocessHellaSwag(doc.ActivityLabel + ": " + doc.CtxA + " " + capitalize(doc.CtxB)),
+			Label:   label,
+		}
+		for _, ending := range doc.Endings {
+			ex.Choices = append(ex.Choices, " "+preprocessHellaSwag(ending))
+		}
+		return ex, checkLabel(ex)
+	})
+}
+
+// loadARC reads documents like {"question": "...", "choices": {"text": [...], "label": [...]},
+// "answerKey": "A"}.
+func loadARC(r io.Reader) ([]Example, error) {
+	return readJSONL(r, func(doc struct {
+		Question string `json:"question"`
+		Choices  struct {
+			Text  []string `json:"text"`
+			Label []string `json:"label"`
+		} `json:"choices"`
+		AnswerKey string `json:"answerKey"`
+	}) (Example, error) {
+		ex := Example{Context: "Question: " + doc.Question + "\nAnswer:", Label: -1}
+		for i, text := range doc.Choices.Text {
+			ex.Choices = append(ex.Choices, " "+text)
+			if i < len(doc.Choices.Label) && doc.Choices.Label[i] == doc.AnswerKey {
+				ex.Label = i
+			}
+		}
+		return ex, checkLabel(ex)
+	})
+}
+
+// parseLabel parses a label encoded either as a number or as a string.
+func parseLabel(raw json.RawMessage) (int, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return strconv.Atoi(s)
+	}
+	var n int
+	err := json.Unmarshal(raw, &n)
+	return n, err
+}
+
+func checkLabel(ex Example) error {
+	if ex.Label < 0 || ex.Label >= len(ex.Choices) {
+		return fmt.Errorf("invalid label %d for %d choices", ex.Label, len(ex.Choices))
+	}
+	return nil
+}
+
+var hellaSwagBrackets = regexp.MustCompile(`\[.*?\]`)
+
+// preprocessHellaSwag cleans up the WikiHow artifacts of the HellaSwag texts.
+func preprocessHellaSwag(text string) string {
+	text = strings.TrimSpace(text)
+	text = strings.ReplaceAll(text, " [title]", ". ")
+	text = hellaSwagBrackets.ReplaceAllString(text, "")
+	return strings.ReplaceAll(text, "  ", " ")
+}
+
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[size:]
+}
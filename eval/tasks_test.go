@@ -0,0 +1,44 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eval
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadLambada(t *testing.T) {
+	examples, err := loadLambada(strings.NewReader(`{"text": "he opened the door"}` + "\n\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []Example{{Context: "he opened the", Choices: []string{" door"}}}, examples)
+}
+
+func TestLoadHellaSwag(t *testing.T) {
+	doc := `{"activity_label": "Baking cookies", "ctx_a": "A woman mixes flour.", "ctx_b": "she", "endings": ["adds sugar [title] Stir.", "runs away"], "label": "0"}`
+	examples, err := loadHellaSwag(strings.NewReader(doc))
+	require.NoError(t, err)
+	assert.Equal(t, []Example{{
+		Context: "Baking cookies: A woman mixes flour. She",
+		Choices: []string{" adds sugar. Stir.", " runs away"},
+		Label:   0,
+	}}, examples)
+
+	_, err = loadHellaSwag(strings.NewReader(`{"endings": ["a"], "label": 3}`))
+	assert.Error(t, err)
+}
+
+func TestLoadARC(t *testing.T) {
+	doc := `{"question": "What is 2+2?", "choices": {"text": ["3", "4"], "label": ["A", "B"]}, "answerKey": "B"}`
+	examples, err := loadARC(strings.NewReader(doc))
+	require.NoError(t, err)
+	assert.Equal(t, []Example{{
+		Context: "Question: What is 2+2?\nAnswer:",
+		Choices: []string{" 3", " 4"},
+		Label:   1,
+	}}, examples)
+}
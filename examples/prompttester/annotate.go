@@ -0,0 +1,58 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// escape begins the ANSI escape sequences.
+const escape = '\x1b'
+
+// The ANSI escape sequences of the annotations.
+const (
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+	colorDim    = "\x1b[2m"
+	colorReset  = "\x1b[0m"
+)
+
+// The probabilities from which the tokens are colored as confident (green) and
+// uncertain (yellow); the others are red.
+const (
+	confidentProb = 0.8
+	uncertainProb = 0.4
+)
+
+// annotator colors the tokens by their probability, computed from the sums of
+// the negative log-probabilities streamed by the server, which must not be
+// normalized by the length (length_penalty: 0). When the text of a message
+// results from several tokens, their probabilities are multiplied.
+type annotator struct {
+	// logprobs shows the log-probability after each token.
+	logprobs bool
+	last     float32
+}
+
+// annotate returns the token colored by its probability, given the score of the
+// message.
+func (a *annotator) annotate(token string, score float32) string {
+	logProb := float64(a.last - score)
+	a.last = score
+	color := colorRed
+	switch p := math.Exp(logProb); {
+	case p >= confidentProb:
+		color = colorGreen
+	case p >= uncertainProb:
+		color = colorYellow
+	}
+	text := color + token + colorReset
+	if a.logprobs {
+		text += fmt.Sprintf("%s[%.2f]%s", colorDim, logProb, colorReset)
+	}
+	return text
+}
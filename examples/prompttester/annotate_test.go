@@ -0,0 +1,57 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotator(t *testing.T) {
+	type token struct {
+		text  string
+		score float32
+	}
+	for _, tc := range []struct {
+		name     string
+		logprobs bool
+		tokens   []token
+		want     []string
+	}{
+		{
+			name:   "colors",
+			tokens: []token{{"a", 0.1}, {"b", 0.8}, {"c", 3}},
+			want: []string{
+				colorGreen + "a" + colorReset,
+				colorYellow + "b" + colorReset,
+				colorRed + "c" + colorReset,
+			},
+		},
+		{
+			name:     "logprobs",
+			logprobs: true,
+			tokens:   []token{{"a", 0.1}, {"b", 0.8}, {"c", 3}},
+			want: []string{
+				colorGreen + "a" + colorReset + colorDim + "[-0.10]" + colorReset,
+				colorYellow + "b" + colorReset + colorDim + "[-0.70]" + colorReset,
+				colorRed + "c" + colorReset + colorDim + "[-2.20]" + colorReset,
+			},
+		},
+		{
+			name:     "certain token",
+			logprobs: true,
+			tokens:   []token{{"a", 0}},
+			want:     []string{colorGreen + "a" + colorReset + colorDim + "[0.00]" + colorReset},
+		},
+	} {
+		a := &annotator{logprobs: tc.logprobs}
+		var got []string
+		for _, tok := range tc.tokens {
+			got = append(got, a.annotate(tok.text, tok.score))
+		}
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+}
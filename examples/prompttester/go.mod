@@ -5,10 +5,14 @@ go 1.20
 replace github.com/nlpodyssey/verbaflow => ../..
 
 require (
+	github.com/mattn/go-isatty v0.0.17
 	github.com/nlpodyssey/verbaflow v0.0.0-20230203211617-0a0020374374
 	github.com/rs/zerolog v1.29.0
+	github.com/stretchr/testify v1.8.1
 	github.com/urfave/cli/v2 v2.24.3
+	golang.org/x/sys v0.5.0
 	google.golang.org/grpc v1.33.2
+	google.golang.org/protobuf v1.28.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -16,6 +20,7 @@ require (
 	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgraph-io/badger/v3 v3.2103.5 // indirect
 	github.com/dgraph-io/ristretto v0.1.1 // indirect
 	github.com/dlclark/regexp2 v1.8.0 // indirect
@@ -28,19 +33,17 @@ require (
 	github.com/google/flatbuffers v23.1.21+incompatible // indirect
 	github.com/klauspost/compress v1.15.15 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/nlpodyssey/gopickle v0.2.0 // indirect
 	github.com/nlpodyssey/gotokenizers v0.2.0 // indirect
 	github.com/nlpodyssey/rwkv v0.0.0-20230212203924-6a6eeeabd546 // indirect
 	github.com/nlpodyssey/spago v1.0.2-0.20230202124145-3cffe41f485c // indirect
 	github.com/nlpodyssey/spago/embeddings/store/diskstore v0.0.0-20230202124145-3cffe41f485c // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	go.opencensus.io v0.24.0 // indirect
-	golang.org/x/net v0.5.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
-	golang.org/x/text v0.6.0 // indirect
+	golang.org/x/net v0.6.0 // indirect
+	golang.org/x/text v0.7.0 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
 )
@@ -6,26 +6,34 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"text/template"
 
+	"github.com/mattn/go-isatty"
 	"github.com/nlpodyssey/verbaflow"
 	"github.com/nlpodyssey/verbaflow/api"
 	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/prompts"
+	"github.com/nlpodyssey/verbaflow/textproc"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
 	"gopkg.in/yaml.v3"
 )
 
 type pTemplate struct {
 	pt   *template.Template
 	data string // the raw data of the template
+	// format, when not nil, renders the input as a user message instead of the template
+	format *prompts.Format
 }
 
 var defaultPromptTemplate = pTemplate{
@@ -49,7 +57,23 @@ func main() {
 			if err != nil {
 				return fmt.Errorf("error reading prompt template: %w", err)
 			}
-			if err := inference(opts, promptt, c.String("endpoint")); err != nil {
+			if name := c.String("format"); name != "" {
+				if c.IsSet("promptt") {
+					return errors.New("the prompt format and the prompt template are mutually exclusive")
+				}
+				if promptt.format, err = prompts.LookupFormat(name); err != nil {
+					return err
+				}
+			}
+			out := newOutput(os.Stdout, !c.Bool("no-stream"), wrapWidth(c))
+			var ann *annotator
+			if c.Bool("annotate") || c.Bool("logprobs") {
+				ann = &annotator{logprobs: c.Bool("logprobs")}
+				// the probabilities of the tokens are computed from the raw scores
+				opts.LengthPenalty = 0
+			}
+			stops := !c.Bool("no-template-stops")
+			if err := inference(opts, promptt, c.String("endpoint"), out, ann, c.Bool("continue"), stops); err != nil {
 				log.Err(err).Send()
 			}
 			return nil
@@ -79,6 +103,38 @@ func main() {
 				Usage:    `the path to the prompt template file. If not specified, the default template \n\n{{.Text}} will be used`,
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "render the input as a user message with a built-in prompt format (raven, alpaca, vicuna, chatml or transcript), instead of a template",
+			},
+			&cli.BoolFlag{
+				Name:  "wrap",
+				Usage: "wrap the text at the width of the terminal without breaking the words, if the output is a terminal",
+			},
+			&cli.IntFlag{
+				Name:  "width",
+				Usage: "wrap the text at the given number of columns, even if the output is not a terminal",
+			},
+			&cli.BoolFlag{
+				Name:  "annotate",
+				Usage: "color the tokens by their probability: green if confident, yellow if uncertain, red if unlikely",
+			},
+			&cli.BoolFlag{
+				Name:  "logprobs",
+				Usage: "show the log-probability after each token, colored like with --annotate",
+			},
+			&cli.BoolFlag{
+				Name:  "no-stream",
+				Usage: "print only the final completion, instead of each token as soon as it is generated",
+			},
+			&cli.BoolFlag{
+				Name:  "continue",
+				Usage: "continue the last completion where it stopped (e.g. at the maximum length), after the text of the standard input, if any, without the prompt template",
+			},
+			&cli.BoolFlag{
+				Name:  "no-template-stops",
+				Usage: "do not stop the generation at the role markers of the prompt template (e.g. \\nQuestion:), or at the stop sequences of the prompt format",
+			},
 		},
 	}
 
@@ -87,10 +143,27 @@ func main() {
 	}
 }
 
-func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string) error {
+// wrapWidth returns the width at which the output is wrapped, or 0 not to wrap it.
+func wrapWidth(c *cli.Context) int {
+	if w := c.Int("width"); w > 0 {
+		return w
+	}
+	if !c.Bool("wrap") || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return 0
+	}
+	if w := terminalWidth(os.Stdout); w > 0 {
+		return w
+	}
+	if w, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && w > 0 {
+		return w
+	}
+	return 80
+}
+
+func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string, out *output, ann *annotator, cont, templateStops bool) error {
 
 	text, err := inputTextFromStdin()
-	if err != nil {
+	if err != nil && !(cont && err == errNoInput) {
 		return err
 	}
 
@@ -102,22 +175,45 @@ func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string)
 
 	client := api.NewLanguageModelClient(conn)
 
-	log.Trace().Msgf("Building prompt from template: %q", promptt.data)
-	input, err := buildInputPrompt(text, promptt.data)
-	if err != nil {
-		return err
-	}
-	log.Trace().Msgf("Input fields: %+v", input)
-	prompt, err := verbaflow.BuildPromptFromTemplate(input, promptt.pt)
-	if err != nil {
-		return err
+	prompt := text
+	var stops []string
+	switch {
+	case cont:
+		// the input follows the last completion as is
+	case promptt.format != nil:
+		log.Trace().Msgf("Building prompt with the %s format", promptt.format.Name)
+		if prompt, err = promptt.format.Render([]prompts.Message{{Role: prompts.RoleUser, Content: text}}); err != nil {
+			return err
+		}
+		if templateStops {
+			stops = promptt.format.Stops
+		}
+	default:
+		log.Trace().Msgf("Building prompt from template: %q", promptt.data)
+		input, err := buildInputPrompt(text, promptt.data)
+		if err != nil {
+			return err
+		}
+		log.Trace().Msgf("Input fields: %+v", input)
+		if prompt, err = verbaflow.BuildPromptFromTemplate(input, promptt.pt); err != nil {
+			return err
+		}
+		if templateStops {
+			stops = verbaflow.TemplateStops(promptt.pt)
+			log.Trace().Msgf("Stop sequences of the template: %q", stops)
+		}
 	}
 	log.Trace().Msgf("Final prompt: %q", prompt)
 
+	params := decodingOptionsToGRPC(opts)
+	params.StopStrings = stops
 	req := &api.TokenGenerationRequest{
 		Prompt:             prompt,
-		DecodingParameters: decodingOptionsToGRPC(opts),
+		DecodingParameters: params,
+		Continue:           cont,
 	}
+	// the stop sequences end the generation, but are not printed
+	trim := textproc.TrimStopSequences(stops...)
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer stop()
@@ -141,19 +237,47 @@ func inference(opts decoder.DecodingOptions, promptt pTemplate, endpoint string)
 			}
 		}
 
-		fmt.Printf(res.Token)
+		if res.DryRun != nil {
+			// the server runs in dry-run mode
+			b, err := protojson.MarshalOptions{Multiline: true}.Marshal(res.DryRun)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			continue
+		}
+		if res.Warning != "" {
+			log.Warn().Msg(res.Warning)
+			continue
+		}
+		if res.Done != nil {
+			log.Debug().Msgf("Finished (%s) in %dms, %.1f tokens/s.", res.Done.FinishReason, res.Done.ElapsedMs, res.Done.TokensPerSecond)
+		}
+		token := trim.Process(res.Token)
+		if ann != nil && token != "" {
+			token = ann.annotate(token, res.Score)
+		}
+		if err := out.WriteToken(token); err != nil {
+			return err
+		}
+	}
+	if err := out.WriteToken(trim.Flush()); err != nil {
+		return err
 	}
 	log.Debug().Msg("Done.")
-	return nil
+	return out.Close()
 }
 
+// errNoInput is returned by inputTextFromStdin if the standard input is empty.
+var errNoInput = errors.New("no input provided")
+
 func inputTextFromStdin() (string, error) {
 	info, err := os.Stdin.Stat()
 	if err != nil {
 		return "", fmt.Errorf("error getting standard input info: %w", err)
 	}
 	if info.Size() == 0 {
-		return "", fmt.Errorf("no input provided")
+		return "", errNoInput
 	}
 	data, err := io.ReadAll(os.Stdin)
 	if err != nil {
@@ -220,6 +344,14 @@ func promptTemplateFromFile(filepath string) (pTemplate, error) {
 }
 
 func decodingOptionsToGRPC(opts decoder.DecodingOptions) *api.DecodingParameters {
+	var stopSequences []*api.Sequence
+	for _, ids := range opts.StopSequencesIDs {
+		seq := &api.Sequence{Sequence: make([]int32, len(ids))}
+		for i, id := range ids {
+			seq.Sequence[i] = int32(id)
+		}
+		stopSequences = append(stopSequences, seq)
+	}
 	return &api.DecodingParameters{
 		MaxLen:         int32(opts.MaxLen),
 		MinLen:         int32(opts.MinLen),
@@ -229,5 +361,10 @@ func decodingOptionsToGRPC(opts decoder.DecodingOptions) *api.DecodingParameters
 		UseSampling:    opts.UseSampling,
 		EndTokenId:     int32(opts.EndTokenID),
 		SkipEndTokenId: opts.SkipEndTokenID,
+		Seed:           opts.Seed,
+		RecordTiming:   opts.RecordTiming,
+		LengthPenalty:  float32(opts.LengthPenalty),
+		DeadlineAware:  opts.DeadlineAware,
+		StopSequences:  stopSequences,
 	}
 }
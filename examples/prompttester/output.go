@@ -0,0 +1,112 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// output writes the generated text, flushing it after each token, optionally
+// wrapped at a width without breaking the words. The ANSI escape sequences of
+// the annotations have no width.
+type output struct {
+	w *bufio.Writer
+	// stream writes each token as soon as it is received; otherwise, the text is
+	// written at once by Close.
+	stream bool
+	// width is the number of characters of the lines, or 0 not to wrap them.
+	width int
+	col   int
+	// word is the word being received, written once complete when wrapping,
+	// preceded by the spaces.
+	word   []rune
+	spaces []rune
+	// wordWidth is the number of characters of the word, without the escape sequences.
+	wordWidth int
+	inEscape  bool
+	text      strings.Builder
+}
+
+func newOutput(w io.Writer, stream bool, width int) *output {
+	return &output{w: bufio.NewWriter(w), stream: stream, width: width}
+}
+
+// WriteToken writes the text of a token.
+func (o *output) WriteToken(token string) error {
+	if !o.stream {
+		o.text.WriteString(token)
+		return nil
+	}
+	o.write(token)
+	return o.w.Flush()
+}
+
+// Close writes the rest of the text.
+func (o *output) Close() error {
+	if !o.stream {
+		o.write(o.text.String())
+	}
+	o.flushWord()
+	return o.w.Flush()
+}
+
+func (o *output) write(text string) {
+	if o.width <= 0 {
+		o.w.WriteString(text)
+		return
+	}
+	for _, r := range text {
+		o.wrapRune(r)
+	}
+}
+
+func (o *output) wrapRune(r rune) {
+	switch {
+	case o.inEscape || r == escape:
+		// the escape sequences end with a letter; out of the words, they are
+		// written right away
+		o.inEscape = r == escape || !unicode.IsLetter(r)
+		if len(o.word) == 0 {
+			o.w.WriteRune(r)
+		} else {
+			o.word = append(o.word, r)
+		}
+	case r == '\n':
+		o.flushWord()
+		o.spaces = o.spaces[:0]
+		o.w.WriteByte('\n')
+		o.col = 0
+	case unicode.IsSpace(r):
+		o.flushWord()
+		o.spaces = append(o.spaces, r)
+	default:
+		o.word = append(o.word, r)
+		if o.wordWidth++; o.wordWidth >= o.width {
+			// the word is longer than a line, and must be broken
+			o.flushWord()
+		}
+	}
+}
+
+// flushWord writes the pending spaces and word, or the word on a new line if
+// they don't fit the current one.
+func (o *output) flushWord() {
+	if len(o.word) == 0 {
+		return
+	}
+	if o.col > 0 && o.col+len(o.spaces)+o.wordWidth > o.width {
+		o.w.WriteByte('\n')
+		o.col = 0
+	} else {
+		o.w.WriteString(string(o.spaces))
+		o.col += len(o.spaces)
+	}
+	o.w.WriteString(string(o.word))
+	o.col += o.wordWidth
+	o.word, o.spaces, o.wordWidth = o.word[:0], o.spaces[:0], 0
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		width  int
+		tokens []string
+		want   string
+	}{
+		{"no wrapping", 0, []string{"hello", " world"}, "hello world"},
+		{"wrapped words", 10, []string{"hello", " wor", "ld again"}, "hello\nworld\nagain"},
+		{"fitting words", 11, []string{"hello", " wor", "ld"}, "hello world"},
+		{"new lines", 10, []string{"ab\ncd", " ef"}, "ab\ncd ef"},
+		{"long word", 4, []string{"abcd", "efgh"}, "abcd\nefgh"},
+		{"annotation without width", 11, []string{"\x1b[32mhello\x1b[0m", "\x1b[32m world\x1b[0m"}, "\x1b[32mhello\x1b[0m\x1b[32m world\x1b[0m"},
+		{"wrapped annotation", 10, []string{"\x1b[32mhello\x1b[0m", "\x1b[32m world\x1b[0m"}, "\x1b[32mhello\x1b[0m\x1b[32m\nworld\x1b[0m"},
+	} {
+		for _, stream := range []bool{true, false} {
+			var buf strings.Builder
+			o := newOutput(&buf, stream, tc.width)
+			for _, token := range tc.tokens {
+				require.NoError(t, o.WriteToken(token))
+			}
+			require.NoError(t, o.Close())
+			assert.Equal(t, tc.want, buf.String(), "%s (stream: %v)", tc.name, stream)
+		}
+	}
+}
+
+func TestOutput_Stream(t *testing.T) {
+	var buf strings.Builder
+	o := newOutput(&buf, true, 0)
+	require.NoError(t, o.WriteToken("hello"))
+	assert.Equal(t, "hello", buf.String())
+
+	buf.Reset()
+	o = newOutput(&buf, false, 0)
+	require.NoError(t, o.WriteToken("hello"))
+	assert.Empty(t, buf.String())
+	require.NoError(t, o.Close())
+	assert.Equal(t, "hello", buf.String())
+}
@@ -0,0 +1,14 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import "os"
+
+// terminalWidth returns the number of columns of the terminal of f, or 0 if unknown.
+func terminalWidth(*os.File) int {
+	return 0
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow/constraint"
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// DefaultExtractMaxLen is the maximum number of tokens of the JSON generated by
+// Extract.
+const DefaultExtractMaxLen = 512
+
+// Extract generates the JSON of a value of the type pointed to by out following
+// the prompt, and unmarshals it into out, e.g. to extract the fields of a struct
+// from a text. The JSON is constrained to the schema of the type (see
+// constraint.SchemaOf), so it is always valid, unless the generation exceeds
+// DefaultExtractMaxLen tokens. The generation is greedy, ending with the end
+// token 0 (see ExtractWithOptions).
+//
+// The prompt should describe what to extract: the names of the fields are forced
+// by the schema, but the model is more accurate knowing them in advance.
+func (vf *VerbaFlow) Extract(ctx context.Context, prompt string, out any) error {
+	return vf.ExtractWithOptions(ctx, prompt, out, decoder.DecodingOptions{MaxLen: DefaultExtractMaxLen})
+}
+
+// ExtractWithOptions is like Extract, with the given decoding options; their
+// Regexp is replaced with the one of the schema.
+func (vf *VerbaFlow) ExtractWithOptions(ctx context.Context, prompt string, out any, opts decoder.DecodingOptions) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("verbaflow: Extract requires a non-nil pointer, got %T", out)
+	}
+	schema, err := constraint.SchemaOf(v.Elem().Interface())
+	if err != nil {
+		return err
+	}
+	if opts.Regexp, err = schema.Regexp(); err != nil {
+		return err
+	}
+	opts.SkipEndTokenID = true
+	var text strings.Builder
+	err = vf.GenerateText(ctx, prompt, opts, func(s string) error {
+		text.WriteString(s)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(text.String()), out); err != nil {
+		return fmt.Errorf("verbaflow: failed to extract a %s, the generation may have been truncated: %w", v.Elem().Type(), err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonTokenizer is a byteTokenizer whose tokens are the pieces of JSON texts.
+type jsonTokenizer struct {
+	byteTokenizer
+}
+
+var jsonTokens = []string{
+	"", "{", "}", "[", "]", `"`, ":", ",", "0", "1", "2", "3", "4", "5", "6", "7",
+	"8", "9", "-", ".", "a", "b", "c", "name", `":`, "age", "tags", "true", "false", "null", " ", "\"}",
+}
+
+func (jsonTokenizer) ReconstructText(ids []int) (string, error) {
+	var text string
+	for _, id := range ids {
+		text += jsonTokens[id%len(jsonTokens)]
+	}
+	return text, nil
+}
+
+func TestVerbaFlow_Extract(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.Tokenizer = jsonTokenizer{}
+	type person struct {
+		Name string   `json:"name"`
+		Age  uint8    `json:"age"`
+		Tags []string `json:"tags"`
+		Ok   *bool    `json:"c"`
+		skip int
+	}
+	var p person
+	err := vf.ExtractWithOptions(context.Background(), "Extract the person: Bob, 42.", &p, decoder.DecodingOptions{MaxLen: 8})
+	assert.ErrorContains(t, err, "truncated")
+
+	var n struct {
+		Value int8 `json:"a"`
+		Valid bool `json:"b"`
+	}
+	require.NoError(t, vf.Extract(context.Background(), "A number:", &n))
+
+	assert.Error(t, vf.Extract(context.Background(), "A number:", n))
+	var ch chan int
+	assert.Error(t, vf.Extract(context.Background(), "A number:", &ch))
+}
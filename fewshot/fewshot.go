@@ -0,0 +1,200 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fewshot implements a bank of labeled examples, selecting the ones most
+// similar to a query to prepend to the prompt (few-shot prompting).
+package fewshot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Embedder returns the embeddings of the texts, e.g. a verbaflow.VerbaFlow.
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float64, error)
+}
+
+// Example is a labeled example: the expected output for an input.
+type Example struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	// Embedding is the embedding of the input, computed by Store.Add when missing.
+	Embedding []float64 `json:"embedding,omitempty"`
+}
+
+// Store is a bank of examples. It is safe for concurrent use.
+type Store struct {
+	embedder Embedder
+	mu       sync.RWMutex
+	examples []Example
+}
+
+// NewStore returns an empty store, embedding the examples and the queries with
+// the given embedder.
+func NewStore(e Embedder) *Store {
+	return &Store{embedder: e}
+}
+
+// Add adds the examples to the store, embedding the inputs of the ones without
+// an embedding.
+func (s *Store) Add(ctx context.Context, examples ...Example) error {
+	added := make([]Example, len(examples))
+	for i, ex := range examples {
+		if ex.Embedding == nil {
+			var err error
+			if ex.Embedding, err = s.embedder.Embed(ctx, ex.Input); err != nil {
+				return fmt.Errorf("fewshot: failed to embed example %d: %w", i, err)
+			}
+		}
+		added[i] = ex
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.examples = append(s.examples, added...)
+	return nil
+}
+
+// Len returns the number of examples of the store.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.examples)
+}
+
+// Save writes the examples, with their embeddings, as JSON lines.
+func (s *Store) Save(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	enc := json.NewEncoder(w)
+	for _, ex := range s.examples {
+		if err := enc.Encode(ex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load adds the examples read as JSON lines, e.g. written by Save, embedding the
+// ones without an embedding.
+func (s *Store) Load(ctx context.Context, r io.Reader) error {
+	var examples []Example
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var ex Example
+		if err := json.Unmarshal(scanner.Bytes(), &ex); err != nil {
+			return fmt.Errorf("fewshot: line %d: %w", line, err)
+		}
+		examples = append(examples, ex)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return s.Add(ctx, examples...)
+}
+
+// DefaultFormat is the default template of the examples prepended to the prompt.
+const DefaultFormat = "Input: {{.Input}}\nOutput: {{.Output}}\n\n"
+
+// Selection configures the selection of the examples of a prompt, e.g. per
+// prompt template.
+type Selection struct {
+	// K is the maximum number of examples selected (default: 3).
+	K int `json:"k,omitempty" yaml:"k,omitempty"`
+	// MinSimilarity is the minimum cosine similarity of the examples with the query
+	// (default: 0, leaving out the dissimilar ones).
+	MinSimilarity float64 `json:"min_similarity,omitempty" yaml:"min_similarity,omitempty"`
+	// Format is the text/template of each example prepended to the prompt, executed
+	// with the Example (default: DefaultFormat).
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+}
+
+// Scored is an example with its similarity with the query.
+type Scored struct {
+	Example
+	Similarity float64
+}
+
+// Select returns the examples most similar to the query, by decreasing similarity.
+func (s *Store) Select(ctx context.Context, query string, sel Selection) ([]Scored, error) {
+	k := sel.K
+	if k <= 0 {
+		k = 3
+	}
+	q, err := s.embedder.Embed(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("fewshot: failed to embed the query: %w", err)
+	}
+	s.mu.RLock()
+	scored := make([]Scored, 0, len(s.examples))
+	for _, ex := range s.examples {
+		if sim := cosine(q, ex.Embedding); sim >= sel.MinSimilarity {
+			scored = append(scored, Scored{Example: ex, Similarity: sim})
+		}
+	}
+	s.mu.RUnlock()
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Similarity > scored[j].Similarity
+	})
+	if len(scored) > k {
+		scored = scored[:k]
+	}
+	return scored, nil
+}
+
+// Prepend returns the prompt preceded by the examples most similar to the query,
+// formatted with sel.Format. The most similar example is the last one, right
+// before the prompt.
+func (s *Store) Prepend(ctx context.Context, prompt, query string, sel Selection) (string, error) {
+	format := sel.Format
+	if format == "" {
+		format = DefaultFormat
+	}
+	t, err := template.New("example").Parse(format)
+	if err != nil {
+		return "", fmt.Errorf("fewshot: invalid format: %w", err)
+	}
+	selected, err := s.Select(ctx, query, sel)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for i := len(selected) - 1; i >= 0; i-- {
+		if err := t.Execute(&buf, selected[i].Example); err != nil {
+			return "", fmt.Errorf("fewshot: failed to format an example: %w", err)
+		}
+	}
+	buf.WriteString(prompt)
+	return buf.String(), nil
+}
+
+// cosine returns the cosine similarity of the vectors, or -1 if they are not comparable.
+func cosine(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return -1
+	}
+	var dot, na, nb float64
+	for i, v := range a {
+		dot += v * b[i]
+		na += v * v
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return -1
+	}
+	return dot / math.Sqrt(na*nb)
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fewshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// letterEmbedder embeds the texts as the counts of the letters a, b and c.
+type letterEmbedder struct {
+	calls int
+}
+
+func (e *letterEmbedder) Embed(_ context.Context, text string) ([]float64, error) {
+	e.calls++
+	if text == "" {
+		return nil, fmt.Errorf("empty text")
+	}
+	return []float64{
+		float64(strings.Count(text, "a")),
+		float64(strings.Count(text, "b")),
+		float64(strings.Count(text, "c")),
+	}, nil
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	e := &letterEmbedder{}
+	s := NewStore(e)
+	require.NoError(t, s.Add(ctx,
+		Example{Input: "aaa", Output: "A"},
+		Example{Input: "bbb", Output: "B"},
+		Example{Input: "aab", Output: "AB"},
+		Example{Input: "ccc", Output: "C"},
+	))
+	assert.Equal(t, 4, s.Len())
+
+	selected, err := s.Select(ctx, "a", Selection{K: 2})
+	require.NoError(t, err)
+	require.Len(t, selected, 2)
+	assert.Equal(t, "A", selected[0].Output)
+	assert.Equal(t, "AB", selected[1].Output)
+	assert.InDelta(t, 1, selected[0].Similarity, 1e-9)
+
+	// the orthogonal examples are not similar enough
+	selected, err = s.Select(ctx, "a", Selection{K: 5, MinSimilarity: 0.1})
+	require.NoError(t, err)
+	assert.Len(t, selected, 2)
+
+	prompt, err := s.Prepend(ctx, "Input: ab\nOutput:", "ab", Selection{K: 2, Format: "{{.Input}} -> {{.Output}}\n"})
+	require.NoError(t, err)
+	// the most similar example is the closest to the prompt
+	assert.Equal(t, "aaa -> A\naab -> AB\nInput: ab\nOutput:", prompt)
+
+	_, err = s.Prepend(ctx, "", "a", Selection{Format: "{{"})
+	assert.ErrorContains(t, err, "invalid format")
+	_, err = s.Select(ctx, "", Selection{})
+	assert.ErrorContains(t, err, "failed to embed the query")
+
+	// the saved embeddings are not computed again
+	var buf bytes.Buffer
+	require.NoError(t, s.Save(&buf))
+	calls := e.calls
+	loaded := NewStore(e)
+	require.NoError(t, loaded.Load(ctx, &buf))
+	assert.Equal(t, calls, e.calls)
+	assert.Equal(t, 4, loaded.Len())
+
+	assert.ErrorContains(t, loaded.Load(ctx, strings.NewReader("{}\n")), "failed to embed example 0")
+	assert.ErrorContains(t, loaded.Load(ctx, strings.NewReader("x\n")), "line 1")
+}
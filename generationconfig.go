@@ -0,0 +1,146 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// GenerationConfigFilename is the file of a model directory with its
+// GenerationConfig, as in the Hugging Face checkpoints.
+const GenerationConfigFilename = "generation_config.json"
+
+// GenerationConfig contains the decoding options recommended for a model, read
+// by Load from the GenerationConfigFilename of its directory, when present. Its
+// format is the one of the Hugging Face checkpoints, whose other fields are
+// ignored; the unset fields have no recommended value.
+type GenerationConfig struct {
+	// Temperature is the temperature of the sampling.
+	Temperature *float64 `json:"temperature,omitempty"`
+	// TopK is the number of tokens considered when sampling.
+	TopK *int `json:"top_k,omitempty"`
+	// TopP is the cumulative probability of the tokens considered when sampling.
+	TopP *float64 `json:"top_p,omitempty"`
+	// RepetitionPenalty makes the tokens already generated less likely.
+	RepetitionPenalty *float64 `json:"repetition_penalty,omitempty"`
+	// MaxNewTokens is the maximum number of tokens to generate.
+	MaxNewTokens *int `json:"max_new_tokens,omitempty"`
+	// EOSTokenID are the end-of-sequence tokens, a single one or a list: the ones
+	// other than decoder.DecodingOptions.EndTokenID stop the generation too.
+	EOSTokenID TokenIDs `json:"eos_token_id,omitempty"`
+	// StopStrings stop the generation as soon as they are generated, like
+	// decoder.DecodingOptions.StopRegexps matching them literally.
+	StopStrings []string `json:"stop_strings,omitempty"`
+}
+
+// TokenIDs is a list of token IDs, read from JSON as a list or a single number.
+type TokenIDs []int
+
+// UnmarshalJSON reads a list of token IDs, or a single one.
+func (ids *TokenIDs) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] != '[' {
+		var id *int
+		if err := json.Unmarshal(data, &id); err != nil {
+			return err
+		}
+		*ids = nil
+		if id != nil {
+			*ids = TokenIDs{*id}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]int)(ids))
+}
+
+// LoadGenerationConfig reads the GenerationConfigFilename of the model directory.
+// It returns nil, without error, if the model has none.
+func LoadGenerationConfig(modelDir string) (*GenerationConfig, error) {
+	f, err := os.Open(filepath.Join(modelDir, GenerationConfigFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadGenerationConfig(f)
+}
+
+// ReadGenerationConfig reads a GenerationConfig in JSON from r.
+func ReadGenerationConfig(r io.Reader) (*GenerationConfig, error) {
+	var conf GenerationConfig
+	if err := json.NewDecoder(r).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", GenerationConfigFilename, err)
+	}
+	return &conf, nil
+}
+
+// WriteGenerationConfig writes the GenerationConfigFilename of the model directory.
+func WriteGenerationConfig(modelDir string, conf *GenerationConfig) error {
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(modelDir, GenerationConfigFilename), append(data, '\n'), 0o644)
+}
+
+// Defaults returns the options with the recommended values of the fields left
+// to zero: MaxLen, TopK, TopP, RepetitionPenalty, and Temp when sampling, so
+// that a greedy decoding stays greedy. It returns the options unchanged if conf
+// is nil. The stop conditions are added by VerbaFlow (see VerbaFlow.GenerationConfig).
+func (conf *GenerationConfig) Defaults(opts decoder.DecodingOptions) decoder.DecodingOptions {
+	if conf == nil {
+		return opts
+	}
+	if opts.MaxLen == 0 && conf.MaxNewTokens != nil {
+		opts.MaxLen = *conf.MaxNewTokens
+	}
+	if opts.TopK == 0 && conf.TopK != nil {
+		opts.TopK = *conf.TopK
+	}
+	if opts.TopP == 0 && conf.TopP != nil {
+		opts.TopP = *conf.TopP
+	}
+	if opts.RepetitionPenalty == 0 && conf.RepetitionPenalty != nil {
+		opts.RepetitionPenalty = *conf.RepetitionPenalty
+	}
+	if opts.Temp == 0 && opts.UseSampling && conf.Temperature != nil {
+		opts.Temp = *conf.Temperature
+	}
+	return opts
+}
+
+// withStops returns the options with the stop conditions of the configuration:
+// the end-of-sequence tokens other than opts.EndTokenID, and the stop strings.
+func (conf *GenerationConfig) withStops(opts decoder.DecodingOptions) decoder.DecodingOptions {
+	if conf == nil {
+		return opts
+	}
+	var stopIDs [][]int
+	for _, id := range conf.EOSTokenID {
+		if id != opts.EndTokenID {
+			stopIDs = append(stopIDs, []int{id})
+		}
+	}
+	if len(stopIDs) > 0 {
+		opts.StopSequencesIDs = append(stopIDs, opts.StopSequencesIDs...)
+	}
+	if len(conf.StopStrings) > 0 {
+		stops := make([]string, 0, len(conf.StopStrings)+len(opts.StopRegexps))
+		for _, s := range conf.StopStrings {
+			stops = append(stops, regexp.QuoteMeta(s))
+		}
+		opts.StopRegexps = append(stops, opts.StopRegexps...)
+	}
+	return opts
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadGenerationConfig(t *testing.T) {
+	dir := t.TempDir()
+	conf, err := LoadGenerationConfig(dir)
+	require.NoError(t, err)
+	assert.Nil(t, conf)
+
+	data := `{"temperature": 0.7, "top_p": 0.9, "eos_token_id": 2, "stop_strings": ["\nUser:"], "bos_token_id": 1}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, GenerationConfigFilename), []byte(data), 0o644))
+	conf, err = LoadGenerationConfig(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 0.7, *conf.Temperature)
+	assert.Equal(t, 0.9, *conf.TopP)
+	assert.Nil(t, conf.TopK)
+	assert.Equal(t, TokenIDs{2}, conf.EOSTokenID)
+	assert.Equal(t, []string{"\nUser:"}, conf.StopStrings)
+
+	// the written configuration is read back
+	topK := 40
+	conf.TopK = &topK
+	conf.EOSTokenID = TokenIDs{0, 2}
+	require.NoError(t, WriteGenerationConfig(dir, conf))
+	read, err := LoadGenerationConfig(dir)
+	require.NoError(t, err)
+	assert.Equal(t, conf, read)
+
+	_, err = ReadGenerationConfig(strings.NewReader(`{"eos_token_id": "x"}`))
+	assert.Error(t, err)
+}
+
+func TestGenerationConfig_Defaults(t *testing.T) {
+	temp, topP, maxNewTokens := 0.5, 0.8, 16
+	conf := &GenerationConfig{Temperature: &temp, TopP: &topP, MaxNewTokens: &maxNewTokens}
+
+	opts := conf.Defaults(decoder.DecodingOptions{TopP: 0.3, UseSampling: true})
+	assert.Equal(t, 16, opts.MaxLen)
+	assert.Equal(t, 0.5, opts.Temp)
+	assert.Equal(t, 0.3, opts.TopP, "the options set are kept")
+
+	// a greedy decoding stays greedy
+	opts = conf.Defaults(decoder.DecodingOptions{})
+	assert.Zero(t, opts.Temp)
+
+	var none *GenerationConfig
+	assert.Equal(t, decoder.DecodingOptions{MaxLen: 3}, none.Defaults(decoder.DecodingOptions{MaxLen: 3}))
+}
+
+func TestVerbaFlow_GenerationConfig(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1}
+	ids := generateIDs(t, vf, "concurrent", opts)
+	require.Len(t, ids, 8)
+	require.NotEqual(t, ids[0], ids[1])
+
+	// the recommended maximum length is used, and the generation stops at the
+	// end-of-sequence tokens other than the end token of the options
+	maxNewTokens := 8
+	vf.GenerationConfig = &GenerationConfig{MaxNewTokens: &maxNewTokens, EOSTokenID: TokenIDs{-1, ids[1]}}
+	assert.Equal(t, ids[:2], generateIDs(t, vf, "concurrent", decoder.DecodingOptions{EndTokenID: -1}))
+	vf.GenerationConfig.EOSTokenID = nil
+	assert.Equal(t, ids, generateIDs(t, vf, "concurrent", decoder.DecodingOptions{EndTokenID: -1}))
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+
+	"github.com/nlpodyssey/verbaflow/genid"
+)
+
+// NewGenerationID returns a new random ID of a generation.
+func NewGenerationID() string {
+	return genid.New()
+}
+
+// WithGenerationID returns a copy of ctx identifying the generations with the
+// given ID, e.g. the ID of a request of a server, returned to its client. The ID
+// is added to the log lines of the generation, under the "generation_id" field.
+func WithGenerationID(ctx context.Context, id string) context.Context {
+	return genid.With(ctx, id)
+}
+
+// GenerationID returns the ID of the generations of ctx, or an empty string.
+func GenerationID(ctx context.Context) string {
+	return genid.FromContext(ctx)
+}
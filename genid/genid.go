@@ -0,0 +1,72 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package genid identifies the generations, carrying their ID in the context,
+// so that their log lines, stream events and records can be correlated.
+package genid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// LogField is the field of the log lines carrying the ID of the generation.
+const LogField = "generation_id"
+
+type ctxKey struct{}
+
+// value is the value carried by the context.
+type value struct {
+	id     string
+	logger zerolog.Logger
+}
+
+// New returns a new random ID.
+func New() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return "gen-" + hex.EncodeToString(b[:])
+}
+
+// With returns a copy of ctx carrying the ID, and the logger adding it to the
+// log lines (see Logger).
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, &value{
+		id:     id,
+		logger: log.With().Str(LogField, id).Logger(),
+	})
+}
+
+// Ensure returns ctx and its ID, if it carries one, or a copy of ctx carrying a
+// new ID.
+func Ensure(ctx context.Context) (context.Context, string) {
+	if id := FromContext(ctx); id != "" {
+		return ctx, id
+	}
+	id := New()
+	return With(ctx, id), id
+}
+
+// FromContext returns the ID carried by ctx, or an empty string.
+func FromContext(ctx context.Context) string {
+	if v, ok := ctx.Value(ctxKey{}).(*value); ok {
+		return v.id
+	}
+	return ""
+}
+
+// Logger returns the logger of the generation of ctx, adding its ID to the log
+// lines, or the global logger if ctx carries no ID.
+func Logger(ctx context.Context) *zerolog.Logger {
+	if v, ok := ctx.Value(ctxKey{}).(*value); ok {
+		return &v.logger
+	}
+	return &log.Logger
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package genid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsure(t *testing.T) {
+	ctx, id := Ensure(context.Background())
+	assert.Regexp(t, `^gen-[0-9a-f]{24}$`, id)
+	assert.Equal(t, id, FromContext(ctx))
+
+	same, sameID := Ensure(ctx)
+	assert.Equal(t, id, sameID)
+	assert.Equal(t, ctx, same)
+
+	assert.NotEqual(t, id, New())
+	assert.Empty(t, FromContext(context.Background()))
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = prev }()
+
+	ctx := With(context.Background(), "gen-1")
+	Logger(ctx).Info().Msg("hello")
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "gen-1", line[LogField])
+
+	buf.Reset()
+	Logger(context.Background()).Info().Msg("hello")
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.NotContains(t, buf.String(), LogField)
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package verbaflow
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/bundle"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+const (
+	// tinyModelDir contains a tiny randomly initialized model, see testdata/gentiny.
+	tinyModelDir = "testdata/tiny-rwkv"
+	goldenFile   = "testdata/tiny-rwkv-golden.json"
+)
+
+type goldenCase struct {
+	Prompt   string `json:"prompt"`
+	TokenIDs []int  `json:"token_ids"`
+	Text     string `json:"text"`
+}
+
+// TestGolden_GreedyDecoding checks that the greedy generations of the tiny model
+// do not change. Run with -update to regenerate the golden file after an
+// intentional change of the numerical behavior.
+func TestGolden_GreedyDecoding(t *testing.T) {
+	vf, err := Load(tinyModelDir)
+	require.NoError(t, err)
+	defer vf.Close()
+
+	prompts := []string{
+		"the weather",
+		"Hello, world!",
+		"in a hole in the ground there lived",
+	}
+	opts := decoder.DecodingOptions{MaxLen: 16, EndTokenID: 0, Temp: 1, TopP: 1}
+
+	var got []goldenCase
+	for _, prompt := range prompts {
+		ids := generateIDs(t, vf, prompt, opts)
+		text, err := vf.Tokenizer.ReconstructText(ids)
+		require.NoError(t, err)
+		got = append(got, goldenCase{Prompt: prompt, TokenIDs: ids, Text: text})
+	}
+
+	if *updateGolden {
+		f, err := os.Create(goldenFile)
+		require.NoError(t, err)
+		enc := json.NewEncoder(f)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		require.NoError(t, enc.Encode(got))
+		require.NoError(t, f.Close())
+	}
+
+	data, err := os.ReadFile(goldenFile)
+	require.NoError(t, err)
+	var want []goldenCase
+	require.NoError(t, json.Unmarshal(data, &want))
+	assert.Equal(t, want, got)
+}
+
+func TestGolden_Bundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiny"+bundle.Extension)
+	require.NoError(t, bundle.Pack(tinyModelDir, path))
+
+	vf, err := Load(path)
+	require.NoError(t, err)
+	tmpDir := vf.tmpDir
+	assert.DirExists(t, tmpDir)
+
+	data, err := os.ReadFile(goldenFile)
+	require.NoError(t, err)
+	var want []goldenCase
+	require.NoError(t, json.Unmarshal(data, &want))
+
+	opts := decoder.DecodingOptions{MaxLen: 16, EndTokenID: 0, Temp: 1, TopP: 1}
+	assert.Equal(t, want[0].TokenIDs, generateIDs(t, vf, want[0].Prompt, opts))
+
+	require.NoError(t, vf.Close())
+	assert.NoDirExists(t, tmpDir)
+}
+
+func TestGolden_LoadFrom(t *testing.T) {
+	embeddings := filepath.Join(t.TempDir(), rwkvlm.DefaultEmbeddingsFilename)
+	require.NoError(t, rwkvlm.ExportEmbeddings(tinyModelDir, embeddings))
+
+	open := func(name string) *os.File {
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	vf, err := LoadFrom(ModelFiles{
+		Model:      open(filepath.Join(tinyModelDir, rwkvlm.DefaultOutputFilename)),
+		Embeddings: open(embeddings),
+		Vocab:      open(filepath.Join(tinyModelDir, "vocab.json")),
+		Merges:     open(filepath.Join(tinyModelDir, "merges.txt")),
+	})
+	require.NoError(t, err)
+	defer vf.Close()
+
+	data, err := os.ReadFile(goldenFile)
+	require.NoError(t, err)
+	var want []goldenCase
+	require.NoError(t, json.Unmarshal(data, &want))
+
+	opts := decoder.DecodingOptions{MaxLen: 16, EndTokenID: 0, Temp: 1, TopP: 1}
+	for _, c := range want {
+		assert.Equal(t, c.TokenIDs, generateIDs(t, vf, c.Prompt, opts))
+	}
+}
+
+func TestGolden_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiny.snapshot")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, WriteSnapshot(f, tinyModelDir, LoadOptions{}))
+	require.NoError(t, f.Close())
+
+	vf, err := Load(path)
+	require.NoError(t, err)
+	defer vf.Close()
+
+	data, err := os.ReadFile(goldenFile)
+	require.NoError(t, err)
+	var want []goldenCase
+	require.NoError(t, json.Unmarshal(data, &want))
+
+	opts := decoder.DecodingOptions{MaxLen: 16, EndTokenID: 0, Temp: 1, TopP: 1}
+	for _, c := range want {
+		assert.Equal(t, c.TokenIDs, generateIDs(t, vf, c.Prompt, opts))
+	}
+
+	snapshot, err := os.ReadFile(path)
+	require.NoError(t, err)
+	truncated := filepath.Join(t.TempDir(), "truncated.snapshot")
+	require.NoError(t, os.WriteFile(truncated, snapshot[:len(snapshot)-1], 0644))
+	_, err = Load(truncated)
+	assert.ErrorContains(t, err, "out of bounds")
+}
+
+func TestGolden_SnapshotShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiny.snapshot")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, WriteSnapshot(f, tinyModelDir, LoadOptions{}))
+	require.NoError(t, f.Close())
+
+	_, err = LoadWithOptions(path, LoadOptions{SharedWeights: true, RescaleLayer: rwkvlm.NoRescale})
+	assert.ErrorContains(t, err, "shared weights")
+
+	data, err := os.ReadFile(goldenFile)
+	require.NoError(t, err)
+	var want []goldenCase
+	require.NoError(t, json.Unmarshal(data, &want))
+
+	opts := decoder.DecodingOptions{MaxLen: 16, EndTokenID: 0, Temp: 1, TopP: 1}
+	// two models on the same weights, as in two processes
+	for i := 0; i < 2; i++ {
+		vf, err := LoadWithOptions(path, LoadOptions{SharedWeights: true})
+		require.NoError(t, err)
+		defer vf.Close()
+		assert.NotNil(t, vf.weights)
+		for _, c := range want {
+			assert.Equal(t, c.TokenIDs, generateIDs(t, vf, c.Prompt, opts))
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package gptneox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/nlpodyssey/gopickle/pytorch"
+	"github.com/nlpodyssey/gopickle/types"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/spago/nn/normalization/layernorm"
+	"github.com/nlpodyssey/verbaflow/internal/diskspace"
+	"github.com/rs/zerolog/log"
+)
+
+type ConverterConfig struct {
+	// The path to the directory where the models will be read from and written to.
+	ModelDir string
+	// The path to the input model file (default "pytorch_model.bin")
+	PyModelFilename string
+	// The path to the output model file (default "spago_model.bin")
+	GoModelFilename string
+	// If true, overwrite the model file if it already exists (default "false")
+	OverwriteIfExist bool
+}
+
+// Convert converts the PyTorch checkpoint of a Hugging Face GPT-NeoX model
+// (GPTNeoXForCausalLM) to a Model, with parameters of type T. It expects the
+// configuration file "config.json" in the same directory as the model file.
+// The checkpoint can be in float32, float16 or bfloat16.
+func Convert[T float.DType](config ConverterConfig) error {
+	if config.PyModelFilename == "" {
+		config.PyModelFilename = DefaultPyModelFilename
+	}
+	if config.GoModelFilename == "" {
+		config.GoModelFilename = DefaultOutputFilename
+	}
+	outFilename := filepath.Join(config.ModelDir, config.GoModelFilename)
+	if !config.OverwriteIfExist && fileExists(outFilename) {
+		log.Debug().Str("model", outFilename).Msg("Model file already exists, skipping conversion")
+		return nil
+	}
+
+	configFilename := filepath.Join(config.ModelDir, "config.json")
+	modelConfig, err := LoadConfig(configFilename)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %q: %w", configFilename, err)
+	}
+	c := &converter[T]{
+		model:       &Model{Config: modelConfig},
+		inFilename:  filepath.Join(config.ModelDir, config.PyModelFilename),
+		outFilename: outFilename,
+	}
+	if err := c.run(); err != nil {
+		return fmt.Errorf("model conversion failed: %w", err)
+	}
+	return nil
+}
+
+func fileExists(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
+
+type converter[T float.DType] struct {
+	model       *Model
+	inFilename  string
+	outFilename string
+	params      map[string]*pytorch.Tensor
+}
+
+func (c *converter[T]) run() error {
+	funcs := []func() error{
+		c.loadTorchModelParams,
+		c.checkDiskSpace,
+		c.convModel,
+		c.dumpModel,
+	}
+	for _, fn := range funcs {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *converter[T]) loadTorchModelParams() error {
+	torchModel, err := pytorch.Load(c.inFilename)
+	if err != nil {
+		return fmt.Errorf("failed to load torch model %q: %w", c.inFilename, err)
+	}
+	od, ok := torchModel.(*types.OrderedDict)
+	if !ok {
+		return fmt.Errorf("failed to read model params: expected %T, actual %T", od, torchModel)
+	}
+	c.params = make(map[string]*pytorch.Tensor, od.Len())
+	for k, item := range od.Map {
+		name, ok := k.(string)
+		if !ok {
+			return fmt.Errorf("failed to read model params: wrong param name type %T", k)
+		}
+		if t, ok := item.Value.(*pytorch.Tensor); ok {
+			c.params[name] = t
+		}
+	}
+	return nil
+}
+
+// checkDiskSpace fails if the converted model is not expected to fit in the output directory.
+func (c *converter[T]) checkDiskSpace() error {
+	var n int
+	for _, t := range c.params {
+		n += tensorDataSize(t)
+	}
+	var zero T
+	return diskspace.Check(filepath.Dir(c.outFilename), uint64(n)*uint64(unsafe.Sizeof(zero)))
+}
+
+func (c *converter[T]) dumpModel() error {
+	return Dump(c.model, c.outFilename)
+}
+
+func (c *converter[T]) convModel() (err error) {
+	conf := c.model.Config
+	d, f, v := conf.HiddenSize, conf.IntermediateSize, conf.VocabSize
+	m := c.model
+	if m.Embeddings, err = c.matrix("gpt_neox.embed_in.weight", v, d); err != nil {
+		return err
+	}
+	if m.Head, err = c.matrix("embed_out.weight", v, d); err != nil {
+		return err
+	}
+	if m.FinalLN, err = c.layerNorm("gpt_neox.final_layer_norm"); err != nil {
+		return err
+	}
+	m.Layers = make([]*Layer, conf.NumHiddenLayers)
+	for i := range m.Layers {
+		p := fmt.Sprintf("gpt_neox.layers.%d.", i)
+		l := &Layer{}
+		if l.InputLN, err = c.layerNorm(p + "input_layernorm"); err != nil {
+			return err
+		}
+		if l.PostAttentionLN, err = c.layerNorm(p + "post_attention_layernorm"); err != nil {
+			return err
+		}
+		for _, w := range []struct {
+			name       string
+			weights    *nn.Param
+			bias       *nn.Param
+			rows, cols int
+		}{
+			{"attention.query_key_value", &l.QKV, &l.QKVBias, 3 * d, d},
+			{"attention.dense", &l.Dense, &l.DenseBias, d, d},
+			{"mlp.dense_h_to_4h", &l.Up, &l.UpBias, f, d},
+			{"mlp.dense_4h_to_h", &l.Down, &l.DownBias, d, f},
+		} {
+			if *w.weights, err = c.matrix(p+w.name+".weight", w.rows, w.cols); err != nil {
+				return err
+			}
+			if *w.bias, err = c.vector(p+w.name+".bias", w.rows); err != nil {
+				return err
+			}
+		}
+		m.Layers[i] = l
+	}
+	return nil
+}
+
+func (c *converter[T]) layerNorm(name string) (*layernorm.Model, error) {
+	w, err := c.vector(name+".weight", c.model.Config.HiddenSize)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.vector(name+".bias", c.model.Config.HiddenSize)
+	if err != nil {
+		return nil, err
+	}
+	return &layernorm.Model{W: w, B: b, Eps: nn.Const[T](T(c.model.Config.LayerNormEps))}, nil
+}
+
+func (c *converter[T]) matrix(name string, rows, cols int) (nn.Param, error) {
+	data, err := c.tensorData(name, rows, cols)
+	if err != nil {
+		return nil, err
+	}
+	return nn.NewParam(mat.NewDense[T](rows, cols, data)), nil
+}
+
+func (c *converter[T]) vector(name string, size int) (nn.Param, error) {
+	data, err := c.tensorData(name, size)
+	if err != nil {
+		return nil, err
+	}
+	return nn.NewParam(mat.NewVecDense[T](data)), nil
+}
+
+// tensorData returns the data of the named parameter, which must have the given size.
+func (c *converter[T]) tensorData(name string, size ...int) ([]T, error) {
+	t, ok := c.params[name]
+	if !ok {
+		return nil, fmt.Errorf("parameter %q not found", name)
+	}
+	if fmt.Sprint(t.Size) != fmt.Sprint(size) {
+		return nil, fmt.Errorf("parameter %q: expected size %v, actual %v", name, size, t.Size)
+	}
+	var data []float32
+	switch st := t.Source.(type) {
+	case *pytorch.FloatStorage:
+		data = st.Data
+	case *pytorch.HalfStorage:
+		data = st.Data
+	case *pytorch.BFloat16Storage:
+		data = st.Data
+	default:
+		return nil, fmt.Errorf("parameter %q: unsupported storage %T", name, t.Source)
+	}
+	n := tensorDataSize(t)
+	return float.SliceValueOf[T](float.SliceInterface(data[t.StorageOffset : t.StorageOffset+n])), nil
+}
+
+func tensorDataSize(t *pytorch.Tensor) int {
+	size := 1
+	for _, v := range t.Size {
+		size *= v
+	}
+	return size
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gptneox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/verrors"
+)
+
+var _ decoder.Model = &Model{}
+
+// DefaultEncodeChunkSize is the number of prompt tokens encoded at a time by
+// EncodePrompt.
+const DefaultEncodeChunkSize = 256
+
+// EncodeNext implements decoder.Model: the state is a *State, which is extended
+// in place. The values are computed without the computational graph, so nothing
+// is tracked in nt.
+func (m *Model) EncodeNext(_ context.Context, _ *ag.NodesTracker, state decoder.State, token int) (mat.Matrix, decoder.State, error) {
+	s, ok := state.(*State)
+	if !ok && state != nil {
+		return nil, nil, fmt.Errorf("gptneox: invalid state of type %T", state)
+	}
+	if s == nil {
+		s = m.NewState()
+	}
+	return m.forward(s, []int{token}), s, nil
+}
+
+// EncodePrompt encodes the tokens of the prompt in chunks of DefaultEncodeChunkSize,
+// returning the input of the decoder after them. The cancellation of ctx is checked
+// between the chunks, after which progress, if not nil, is called with the number
+// of tokens encoded so far and the total.
+// If ctx is done, it fails with an error wrapping verrors.ErrDecodingAborted and
+// the error of the context.
+func (m *Model) EncodePrompt(ctx context.Context, tokens []int, progress func(encoded, total int)) (decoder.Input, error) {
+	if len(tokens) == 0 {
+		return decoder.Input{}, fmt.Errorf("gptneox: empty prompt")
+	}
+	started := time.Now()
+	s := m.NewState()
+	var logits mat.Matrix
+	for start := 0; start < len(tokens); start += DefaultEncodeChunkSize {
+		select {
+		case <-ctx.Done():
+			return decoder.Input{}, fmt.Errorf("%w after encoding %d of %d prompt tokens: %w", verrors.ErrDecodingAborted, start, len(tokens), ctx.Err())
+		default:
+		}
+		end := start + DefaultEncodeChunkSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		logits = m.forward(s, tokens[start:end])
+		if progress != nil {
+			progress(end, len(tokens))
+		}
+	}
+	return decoder.Input{
+		Logits: logits,
+		State:  s,
+		Tokens: tokens,
+		Timing: decoder.TokenTiming{Encoder: time.Since(started)},
+	}, nil
+}
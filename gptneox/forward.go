@@ -0,0 +1,229 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gptneox
+
+import (
+	"math"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/spago/nn/normalization/layernorm"
+)
+
+// State is the state of a Model after a sequence of tokens: the keys and the
+// values of the attention of each layer at each position (the KV cache).
+type State struct {
+	// Len is the number of tokens encoded.
+	Len int
+	// Keys and Values contain, for each layer, the keys (after the rotary
+	// embeddings) and the values of all the heads, HiddenSize per token.
+	Keys, Values [][]float64
+}
+
+// NewState returns the empty state of the model.
+func (m *Model) NewState() *State {
+	return &State{
+		Keys:   make([][]float64, len(m.Layers)),
+		Values: make([][]float64, len(m.Layers)),
+	}
+}
+
+// block is a sequence of vectors, as a matrix with a column per token.
+type block struct {
+	rows, cols int
+	data       []float64
+}
+
+func newBlock(rows, cols int) block {
+	return block{rows: rows, cols: cols, data: make([]float64, rows*cols)}
+}
+
+func (b block) column(c int) []float64 {
+	out := make([]float64, b.rows)
+	for r := range out {
+		out[r] = b.data[r*b.cols+c]
+	}
+	return out
+}
+
+func (b block) add(o block) {
+	for i, v := range o.data {
+		b.data[i] += v
+	}
+}
+
+func values(p nn.Param) []float64 {
+	return p.Value().Data().F64()
+}
+
+// forward encodes the tokens following the state s, which is extended with
+// them, and returns the logits of the token after the last one.
+//
+// The values are computed eagerly, without the computational graph: the
+// projections with a matrix-matrix multiplication for all the tokens, in the
+// data type of the parameters, and the other operations in double precision.
+func (m *Model) forward(s *State, tokens []int) mat.Matrix {
+	x := newBlock(m.Config.HiddenSize, len(tokens))
+	emb := m.Embeddings.Value()
+	for c, id := range tokens {
+		for r, v := range emb.ExtractRow(id).Data().F64() {
+			x.data[r*x.cols+c] = v
+		}
+	}
+	for i, layer := range m.Layers {
+		attn := m.attention(layer, layerNorm(layer.InputLN, x), s.Len, &s.Keys[i], &s.Values[i])
+		if m.Config.UseParallelResidual {
+			x.add(mlp(layer, layerNorm(layer.PostAttentionLN, x)))
+			x.add(attn)
+		} else {
+			x.add(attn)
+			x.add(mlp(layer, layerNorm(layer.PostAttentionLN, x)))
+		}
+	}
+	s.Len += len(tokens)
+
+	last := block{rows: x.rows, cols: 1, data: x.column(x.cols - 1)}
+	h := layerNorm(m.FinalLN, last)
+	head := m.Head.Value()
+	hm := head.NewVec(float.SliceInterface(h.data))
+	defer mat.ReleaseMatrix(hm)
+	return head.Mul(hm)
+}
+
+// attention computes the causal self-attention of the tokens of x, starting at
+// the position pos, appending their keys and values to the ones of the previous
+// positions.
+func (m *Model) attention(layer *Layer, x block, pos int, keys, vals *[]float64) block {
+	c := m.Config
+	d, hs := c.HiddenSize, c.HeadSize()
+	invFreq := rotaryFrequencies(c.RotaryDims(), c.RotaryEmbBase)
+	qkv := linear(layer.QKV, layer.QKVBias, x)
+	queries := make([]float64, x.cols*d)
+	for t := 0; t < x.cols; t++ {
+		q, k, v := queries[t*d:(t+1)*d], make([]float64, d), make([]float64, d)
+		for h := 0; h < c.NumAttentionHeads; h++ {
+			from := h * 3 * hs
+			for j := 0; j < hs; j++ {
+				q[h*hs+j] = qkv.data[(from+j)*qkv.cols+t]
+				k[h*hs+j] = qkv.data[(from+hs+j)*qkv.cols+t]
+				v[h*hs+j] = qkv.data[(from+2*hs+j)*qkv.cols+t]
+			}
+			rotate(q[h*hs:(h+1)*hs], pos+t, invFreq)
+			rotate(k[h*hs:(h+1)*hs], pos+t, invFreq)
+		}
+		*keys = append(*keys, k...)
+		*vals = append(*vals, v...)
+	}
+
+	out := newBlock(d, x.cols)
+	scale := 1 / math.Sqrt(float64(hs))
+	scores := make([]float64, pos+x.cols)
+	for t := 0; t < x.cols; t++ {
+		q := queries[t*d : (t+1)*d]
+		n := pos + t + 1
+		for h := 0; h < c.NumAttentionHeads; h++ {
+			qh := q[h*hs : (h+1)*hs]
+			maxScore := math.Inf(-1)
+			for p := 0; p < n; p++ {
+				kh := (*keys)[p*d+h*hs : p*d+(h+1)*hs]
+				var dot float64
+				for j, e := range qh {
+					dot += e * kh[j]
+				}
+				scores[p] = dot * scale
+				maxScore = math.Max(maxScore, scores[p])
+			}
+			var sum float64
+			for p := 0; p < n; p++ {
+				scores[p] = math.Exp(scores[p] - maxScore)
+				sum += scores[p]
+			}
+			for j := 0; j < hs; j++ {
+				var y float64
+				for p := 0; p < n; p++ {
+					y += scores[p] * (*vals)[p*d+h*hs+j]
+				}
+				out.data[(h*hs+j)*out.cols+t] = y / sum
+			}
+		}
+	}
+	return linear(layer.Dense, layer.DenseBias, out)
+}
+
+// rotaryFrequencies returns the frequencies of the rotary position embeddings
+// of the given number of dimensions.
+func rotaryFrequencies(dims int, base float64) []float64 {
+	out := make([]float64, dims/2)
+	for i := range out {
+		out[i] = 1 / math.Pow(base, float64(2*i)/float64(dims))
+	}
+	return out
+}
+
+// rotate applies the rotary position embeddings at the position pos to the
+// first 2*len(invFreq) dimensions of x, rotating each dimension of the first
+// half together with the corresponding one of the second half.
+func rotate(x []float64, pos int, invFreq []float64) {
+	half := len(invFreq)
+	for i, f := range invFreq {
+		sin, cos := math.Sincos(float64(pos) * f)
+		x1, x2 := x[i], x[i+half]
+		x[i] = x1*cos - x2*sin
+		x[i+half] = x2*cos + x1*sin
+	}
+}
+
+// mlp computes the feed-forward network of the layer.
+func mlp(layer *Layer, x block) block {
+	h := linear(layer.Up, layer.UpBias, x)
+	for i, v := range h.data {
+		h.data[i] = gelu(v)
+	}
+	return linear(layer.Down, layer.DownBias, h)
+}
+
+// gelu is the exact GELU activation, as torch.nn.functional.gelu.
+func gelu(x float64) float64 {
+	return 0.5 * x * (1 + math.Erf(x/math.Sqrt2))
+}
+
+// linear returns w*x + b, with the product in the data type of the weights.
+func linear(w, b nn.Param, x block) block {
+	wm := w.Value()
+	xm := wm.NewMatrix(x.rows, x.cols, float.SliceInterface(x.data))
+	defer mat.ReleaseMatrix(xm)
+	out := block{rows: wm.Rows(), cols: x.cols, data: wm.Mul(xm).Data().F64()}
+	for r, bias := range values(b) {
+		for c := 0; c < out.cols; c++ {
+			out.data[r*out.cols+c] += bias
+		}
+	}
+	return out
+}
+
+// layerNorm normalizes each vector of the block, as layernorm.Model.Forward.
+func layerNorm(ln *layernorm.Model, x block) block {
+	w, b, eps := values(ln.W), values(ln.B), ln.Eps.Value().Scalar().F64()
+	out := newBlock(x.rows, x.cols)
+	n := float64(x.rows)
+	for c := 0; c < x.cols; c++ {
+		var mean, variance float64
+		for r := 0; r < x.rows; r++ {
+			mean += x.data[r*x.cols+c]
+		}
+		mean /= n
+		for r := 0; r < x.rows; r++ {
+			d := x.data[r*x.cols+c] - mean
+			variance += d * d
+		}
+		std := math.Sqrt(variance/n + eps)
+		for r := 0; r < x.rows; r++ {
+			i := r*x.cols + c
+			out.data[i] = (x.data[i]-mean)/std*w[r] + b[r]
+		}
+	}
+	return out
+}
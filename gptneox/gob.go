@@ -0,0 +1,53 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gptneox
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+
+	"github.com/nlpodyssey/spago/nn"
+)
+
+// gobEncode writes the model in chunks, a layer at a time, so that the whole
+// serialized model is never held in memory.
+func gobEncode(obj *Model, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	encoder := gob.NewEncoder(bw)
+
+	chunks := []any{obj.Config, obj.Embeddings.(*nn.BaseParam), obj.FinalLN, obj.Head.(*nn.BaseParam)}
+	for _, layer := range obj.Layers {
+		chunks = append(chunks, layer)
+	}
+	for _, chunk := range chunks {
+		if err := encoder.Encode(chunk); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gobDecoding(r io.Reader) (*Model, error) {
+	obj := &Model{}
+	decoder := gob.NewDecoder(bufio.NewReader(r))
+	var emb, head nn.BaseParam
+	for _, chunk := range []any{&obj.Config, &emb, &obj.FinalLN, &head} {
+		if err := decoder.Decode(chunk); err != nil {
+			return nil, err
+		}
+	}
+	obj.Embeddings, obj.Head = &emb, &head
+	obj.Layers = make([]*Layer, obj.Config.NumHiddenLayers)
+	for i := range obj.Layers {
+		if err := decoder.Decode(&obj.Layers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gptneox implements the GPT-NeoX architecture of EleutherAI, e.g. of the
+// Pythia models, as an alternative backend to RWKV: a Model implements
+// decoder.Model, so that it is driven by the same decoder, and is converted from
+// the checkpoints of the Hugging Face repositories.
+package gptneox
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/spago/nn/normalization/layernorm"
+	"github.com/nlpodyssey/verbaflow/verrors"
+)
+
+const (
+	DefaultPyModelFilename = "pytorch_model.bin"
+	DefaultOutputFilename  = "spago_model.bin"
+
+	// ModelType is the "model_type" of the Hugging Face configurations of the
+	// GPT-NeoX models.
+	ModelType = "gpt_neox"
+)
+
+// The defaults of the Hugging Face configuration, for the missing fields.
+const (
+	defaultRotaryPct     = 0.25
+	defaultRotaryEmbBase = 10000
+	defaultLayerNormEps  = 1e-5
+)
+
+// Config is the configuration of a GPT-NeoX model, read from the "config.json"
+// file of the Hugging Face repositories.
+type Config struct {
+	HiddenSize        int `json:"hidden_size"`
+	NumAttentionHeads int `json:"num_attention_heads"`
+	NumHiddenLayers   int `json:"num_hidden_layers"`
+	IntermediateSize  int `json:"intermediate_size"`
+	VocabSize         int `json:"vocab_size"`
+	// RotaryPct is the fraction of the dimensions of each head rotated by the
+	// rotary position embeddings.
+	RotaryPct     float64 `json:"rotary_pct"`
+	RotaryEmbBase float64 `json:"rotary_emb_base"`
+	LayerNormEps  float64 `json:"layer_norm_eps"`
+	// UseParallelResidual reports whether the attention and the MLP of a layer
+	// are computed from the same input and added together to the residual, as in
+	// the Pythia models, instead of one after the other.
+	UseParallelResidual bool `json:"use_parallel_residual"`
+	// MaxPositionEmbeddings is the context length the model was trained with.
+	MaxPositionEmbeddings int `json:"max_position_embeddings"`
+}
+
+// HeadSize returns the number of dimensions of each attention head.
+func (c Config) HeadSize() int {
+	return c.HiddenSize / c.NumAttentionHeads
+}
+
+// RotaryDims returns the number of dimensions of each head rotated by the
+// rotary position embeddings.
+func (c Config) RotaryDims() int {
+	return int(float64(c.HeadSize()) * c.RotaryPct)
+}
+
+// LoadConfig loads the model configuration from the given JSON file.
+// It fails with verrors.ErrUnsupportedArchitecture if the file describes a
+// model other than GPT-NeoX, or with an activation other than GELU.
+func LoadConfig(filePath string) (Config, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return Config{}, err
+	}
+	var config struct {
+		Config
+		ModelType string `json:"model_type"`
+		HiddenAct string `json:"hidden_act"`
+		// UseParallelResidual is a pointer, to tell the false value from the
+		// missing one, which defaults to true.
+		UseParallelResidual *bool `json:"use_parallel_residual"`
+	}
+	config.RotaryPct = defaultRotaryPct
+	config.RotaryEmbBase = defaultRotaryEmbBase
+	config.LayerNormEps = defaultLayerNormEps
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, err
+	}
+	if config.ModelType != ModelType {
+		return Config{}, fmt.Errorf("%w: %q", verrors.ErrUnsupportedArchitecture, config.ModelType)
+	}
+	if config.HiddenAct != "" && config.HiddenAct != "gelu" {
+		return Config{}, fmt.Errorf("%w: activation %q", verrors.ErrUnsupportedArchitecture, config.HiddenAct)
+	}
+	c := config.Config
+	c.UseParallelResidual = config.UseParallelResidual == nil || *config.UseParallelResidual
+	if c.HiddenSize <= 0 || c.NumAttentionHeads <= 0 || c.HiddenSize%c.NumAttentionHeads != 0 {
+		return Config{}, fmt.Errorf("invalid hidden size %d for %d attention heads", c.HiddenSize, c.NumAttentionHeads)
+	}
+	return c, nil
+}
+
+// IsGPTNeoX reports whether the "config.json" file in the given directory
+// describes a GPT-NeoX model.
+func IsGPTNeoX(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return false
+	}
+	var config struct {
+		ModelType string `json:"model_type"`
+	}
+	return json.Unmarshal(data, &config) == nil && config.ModelType == ModelType
+}
+
+// Model is a GPT-NeoX language model.
+type Model struct {
+	nn.Module
+	Config Config
+	// Embeddings has the embedding of each token in a row.
+	Embeddings nn.Param `spago:"type:weights"`
+	Layers     []*Layer
+	FinalLN    *layernorm.Model
+	// Head is the output projection, with the weights of each token in a row.
+	Head nn.Param `spago:"type:weights"`
+}
+
+// Layer is a layer of the transformer.
+type Layer struct {
+	nn.Module
+	InputLN         *layernorm.Model
+	PostAttentionLN *layernorm.Model
+	// QKV projects the input to the queries, keys and values, interleaved per
+	// head: the rows of each head are its queries, then its keys, then its values.
+	QKV       nn.Param `spago:"type:weights"`
+	QKVBias   nn.Param `spago:"type:biases"`
+	Dense     nn.Param `spago:"type:weights"`
+	DenseBias nn.Param `spago:"type:biases"`
+	// Up and Down are the projections of the MLP, before and after the GELU.
+	Up       nn.Param `spago:"type:weights"`
+	UpBias   nn.Param `spago:"type:biases"`
+	Down     nn.Param `spago:"type:weights"`
+	DownBias nn.Param `spago:"type:biases"`
+}
+
+func init() {
+	gob.Register(&Model{})
+	gob.Register(&Layer{})
+}
+
+// New returns a new model with the given configuration and zero parameters.
+func New[T float.DType](c Config) *Model {
+	d, f, v := c.HiddenSize, c.IntermediateSize, c.VocabSize
+	layers := make([]*Layer, c.NumHiddenLayers)
+	for i := range layers {
+		layers[i] = &Layer{
+			InputLN:         layernorm.New[T](d, c.LayerNormEps),
+			PostAttentionLN: layernorm.New[T](d, c.LayerNormEps),
+			QKV:             nn.NewParam(mat.NewEmptyDense[T](3*d, d)),
+			QKVBias:         nn.NewParam(mat.NewEmptyVecDense[T](3 * d)),
+			Dense:           nn.NewParam(mat.NewEmptyDense[T](d, d)),
+			DenseBias:       nn.NewParam(mat.NewEmptyVecDense[T](d)),
+			Up:              nn.NewParam(mat.NewEmptyDense[T](f, d)),
+			UpBias:          nn.NewParam(mat.NewEmptyVecDense[T](f)),
+			Down:            nn.NewParam(mat.NewEmptyDense[T](d, f)),
+			DownBias:        nn.NewParam(mat.NewEmptyVecDense[T](d)),
+		}
+	}
+	return &Model{
+		Config:     c,
+		Embeddings: nn.NewParam(mat.NewEmptyDense[T](v, d)),
+		Layers:     layers,
+		FinalLN:    layernorm.New[T](d, c.LayerNormEps),
+		Head:       nn.NewParam(mat.NewEmptyDense[T](v, d)),
+	}
+}
+
+// VocabSize returns the number of tokens of the vocabulary of the model.
+func (m *Model) VocabSize() int {
+	return m.Config.VocabSize
+}
+
+// Load loads a converted model from the given directory.
+func Load(dir string) (*Model, error) {
+	f, err := os.Open(filepath.Join(dir, DefaultOutputFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadFrom(f)
+}
+
+// LoadFrom reads a converted model from r, in the format of the model file.
+func LoadFrom(r io.Reader) (*Model, error) {
+	return gobDecoding(r)
+}
+
+// Dump saves the Model to a file.
+func Dump(obj *Model, filename string) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open model dump file %q for writing: %w", filename, err)
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = fmt.Errorf("failed to close model dump file %q: %w", filename, e)
+		}
+	}()
+	if err = gobEncode(obj, f); err != nil {
+		return fmt.Errorf("failed to encode model dump: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package gptneox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/verrors"
+	"github.com/stretchr/testify/require"
+)
+
+// parityDir contains a tiny GPT-NeoX checkpoint, and the outputs of the reference
+// implementation of Hugging Face, see the Python scripts in the directory.
+const parityDir = "testdata/parity"
+
+// parityTolerance is the maximum difference from the reference, computed in
+// double precision, relative to the magnitude of the values above 1.
+const parityTolerance = 1e-4
+
+type parityReference struct {
+	Tokens     []int       `json:"tokens"`
+	Parallel   [][]float64 `json:"parallel"`
+	Sequential [][]float64 `json:"sequential"`
+}
+
+// TestParity converts the checkpoint and compares the logits at each step with
+// the reference outputs, to catch the regressions of the conversion and of the
+// forward pass.
+func TestParity(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(parityDir, "reference.json"))
+	require.NoError(t, err)
+	var ref parityReference
+	require.NoError(t, json.Unmarshal(data, &ref))
+
+	m := convertParityModel(t)
+	ctx := context.Background()
+
+	t.Run("single tokens", func(t *testing.T) {
+		var s decoder.State
+		for step, token := range ref.Tokens {
+			var logits mat.Matrix
+			logits, s, err = m.EncodeNext(ctx, nil, s, token)
+			require.NoError(t, err)
+			assertParity(t, fmt.Sprintf("logits at step %d", step), ref.Parallel[step], logits.Data().F64())
+		}
+		require.Equal(t, len(ref.Tokens), s.(*State).Len)
+	})
+
+	t.Run("prompt", func(t *testing.T) {
+		prefix := 7
+		var progress []int
+		in, err := m.EncodePrompt(ctx, ref.Tokens[:prefix], func(encoded, total int) {
+			require.Equal(t, prefix, total)
+			progress = append(progress, encoded)
+		})
+		require.NoError(t, err)
+		require.Equal(t, []int{prefix}, progress)
+		assertParity(t, "logits of the prompt", ref.Parallel[prefix-1], in.Logits.Data().F64())
+
+		s := in.State
+		for step := prefix; step < len(ref.Tokens); step++ {
+			var logits mat.Matrix
+			logits, s, err = m.EncodeNext(ctx, nil, s, ref.Tokens[step])
+			require.NoError(t, err)
+			assertParity(t, fmt.Sprintf("logits at step %d", step), ref.Parallel[step], logits.Data().F64())
+		}
+	})
+
+	t.Run("aborted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := m.EncodePrompt(ctx, ref.Tokens, nil)
+		require.ErrorIs(t, err, verrors.ErrDecodingAborted)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("sequential residual", func(t *testing.T) {
+		m := convertParityModel(t)
+		m.Config.UseParallelResidual = false
+		in, err := m.EncodePrompt(ctx, ref.Tokens, nil)
+		require.NoError(t, err)
+		last := len(ref.Tokens) - 1
+		assertParity(t, "logits of the sequence", ref.Sequential[last], in.Logits.Data().F64())
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := LoadConfig(filepath.Join(parityDir, "config.json"))
+	require.NoError(t, err)
+	require.Equal(t, 8, c.HeadSize())
+	require.Equal(t, 4, c.RotaryDims())
+	require.True(t, c.UseParallelResidual)
+	require.True(t, IsGPTNeoX(parityDir))
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(filename, []byte(`{"model_type": "rwkv", "d_model": 8}`), 0644))
+	_, err = LoadConfig(filename)
+	require.ErrorIs(t, err, verrors.ErrUnsupportedArchitecture)
+	require.False(t, IsGPTNeoX(dir))
+}
+
+// convertParityModel converts the checkpoint of the parity test, returning the loaded model.
+func convertParityModel(t *testing.T) *Model {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{DefaultPyModelFilename, "config.json"} {
+		data, err := os.ReadFile(filepath.Join(parityDir, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	require.NoError(t, Convert[float32](ConverterConfig{ModelDir: dir}))
+	m, err := Load(dir)
+	require.NoError(t, err)
+	return m
+}
+
+// assertParity checks that the actual values of the named tensor match the expected ones.
+func assertParity(t *testing.T, name string, expected, actual []float64) {
+	t.Helper()
+	require.Len(t, actual, len(expected), name)
+	for i, want := range expected {
+		got := actual[i]
+		if tol := parityTolerance * math.Max(1, math.Abs(want)); math.Abs(got-want) > tol {
+			require.Failf(t, "parity mismatch", "%s, index %d: expected %g, actual %g", name, i, want, got)
+		}
+	}
+}
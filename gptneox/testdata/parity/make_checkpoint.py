@@ -0,0 +1,172 @@
+# Copyright 2023 NLP Odyssey Authors. All rights reserved.
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file.
+
+"""Writes the tiny GPT-NeoX checkpoint of the parity test.
+
+The checkpoint has the parameter names, shapes and buffers of the Hugging Face
+GPTNeoXForCausalLM checkpoints (e.g. Pythia), with random float32 weights, but
+for the output head in float16, and is written in the zip format of torch.save,
+so that it goes through the same conversion as the real models. PyTorch is not
+required: the pickled tensors refer to the torch classes by name.
+
+    python3 make_checkpoint.py && python3 reference.py
+"""
+
+import collections
+import io
+import json
+import pickle
+import random
+import struct
+import sys
+import types
+import zipfile
+
+HIDDEN_SIZE = 16
+NUM_HEADS = 2
+NUM_LAYERS = 3
+INTERMEDIATE_SIZE = 64
+VOCAB_SIZE = 20
+ROTARY_PCT = 0.5
+MAX_POSITIONS = 32
+SEED = 42
+
+# the storage classes, with the struct format of their elements
+STORAGES = {"FloatStorage": "f", "HalfStorage": "e", "BoolStorage": "?"}
+
+
+def _fake_torch():
+    """Returns the stand-ins of the torch storage classes and of
+    torch._utils._rebuild_tensor_v2, registered under their module names so
+    that pickle refers to them as torch does."""
+    torch = types.ModuleType("torch")
+    utils = types.ModuleType("torch._utils")
+    classes = {}
+    for name in STORAGES:
+        cls = type(name, (), {})
+        cls.__module__ = "torch"
+        setattr(torch, name, cls)
+        classes[name] = cls
+
+    def _rebuild_tensor_v2(*args):
+        raise NotImplementedError
+
+    _rebuild_tensor_v2.__module__ = "torch._utils"
+    _rebuild_tensor_v2.__qualname__ = "_rebuild_tensor_v2"
+    torch._utils = utils
+    utils._rebuild_tensor_v2 = _rebuild_tensor_v2
+    sys.modules.setdefault("torch", torch)
+    sys.modules.setdefault("torch._utils", utils)
+    return classes, _rebuild_tensor_v2
+
+
+STORAGE_CLASSES, rebuild_tensor_v2 = _fake_torch()
+
+
+class Storage:
+    def __init__(self, key, kind, values):
+        self.key = key
+        self.kind = kind
+        self.values = values
+
+
+class Tensor:
+    def __init__(self, storage, shape):
+        self.storage = storage
+        self.shape = shape
+
+    def __reduce__(self):
+        stride, n = [], 1
+        for size in reversed(self.shape):
+            stride.insert(0, n)
+            n *= size
+        args = (self.storage, 0, tuple(self.shape), tuple(stride), False, collections.OrderedDict())
+        return rebuild_tensor_v2, args
+
+
+class Pickler(pickle.Pickler):
+    def persistent_id(self, obj):
+        if isinstance(obj, Storage):
+            return ("storage", STORAGE_CLASSES[obj.kind], obj.key, "cpu", len(obj.values))
+        return None
+
+
+def make_params(rng):
+    d, f = HIDDEN_SIZE, INTERMEDIATE_SIZE
+    rot = int(d // NUM_HEADS * ROTARY_PCT)
+    shapes = collections.OrderedDict()
+    shapes["gpt_neox.embed_in.weight"] = ([VOCAB_SIZE, d], -1, 1)
+    for i in range(NUM_LAYERS):
+        p = "gpt_neox.layers.%d." % i
+        for ln in ("input_layernorm", "post_attention_layernorm"):
+            shapes[p + ln + ".weight"] = ([d], 0.8, 1.2)
+            shapes[p + ln + ".bias"] = ([d], -0.1, 0.1)
+        # the buffers of the checkpoints, ignored by the conversion
+        shapes[p + "attention.bias"] = ([1, 1, MAX_POSITIONS, MAX_POSITIONS], None, None)
+        shapes[p + "attention.masked_bias"] = ([], -1e9, -1e9)
+        shapes[p + "attention.rotary_emb.inv_freq"] = ([rot // 2], 0, 1)
+        for name, rows, cols in (
+            ("attention.query_key_value", 3 * d, d),
+            ("attention.dense", d, d),
+            ("mlp.dense_h_to_4h", f, d),
+            ("mlp.dense_4h_to_h", d, f),
+        ):
+            shapes[p + name + ".weight"] = ([rows, cols], -0.5, 0.5)
+            shapes[p + name + ".bias"] = ([rows], -0.1, 0.1)
+    shapes["gpt_neox.final_layer_norm.weight"] = ([d], 0.8, 1.2)
+    shapes["gpt_neox.final_layer_norm.bias"] = ([d], -0.1, 0.1)
+    shapes["embed_out.weight"] = ([VOCAB_SIZE, d], -0.5, 0.5)
+
+    params = collections.OrderedDict()
+    for key, (name, (shape, low, high)) in enumerate(shapes.items()):
+        n = 1
+        for size in shape:
+            n *= size
+        if name.endswith("attention.bias"):
+            kind, values = "BoolStorage", [c <= r for r in range(MAX_POSITIONS) for c in range(MAX_POSITIONS)]
+        elif name == "embed_out.weight":
+            kind, values = "HalfStorage", [rng.uniform(low, high) for _ in range(n)]
+        else:
+            kind, values = "FloatStorage", [rng.uniform(low, high) for _ in range(n)]
+        params[name] = Tensor(Storage(str(key), kind, values), shape)
+    return params
+
+
+def main():
+    params = make_params(random.Random(SEED))
+    with zipfile.ZipFile("pytorch_model.bin", "w") as zf:
+
+        def write(name, data):
+            # a fixed timestamp keeps the file reproducible
+            zf.writestr(zipfile.ZipInfo("archive/" + name, date_time=(2023, 1, 1, 0, 0, 0)), data)
+
+        data = io.BytesIO()
+        Pickler(data, protocol=2).dump(params)
+        write("data.pkl", data.getvalue())
+        for tensor in params.values():
+            st = tensor.storage
+            write("data/" + st.key, struct.pack("<%d%s" % (len(st.values), STORAGES[st.kind]), *st.values))
+        write("version", "3\n")
+    config = {
+        "architectures": ["GPTNeoXForCausalLM"],
+        "model_type": "gpt_neox",
+        "hidden_act": "gelu",
+        "hidden_size": HIDDEN_SIZE,
+        "num_attention_heads": NUM_HEADS,
+        "num_hidden_layers": NUM_LAYERS,
+        "intermediate_size": INTERMEDIATE_SIZE,
+        "vocab_size": VOCAB_SIZE,
+        "rotary_pct": ROTARY_PCT,
+        "rotary_emb_base": 10000,
+        "layer_norm_eps": 1e-5,
+        "max_position_embeddings": MAX_POSITIONS,
+        "use_parallel_residual": True,
+    }
+    with open("config.json", "w") as f:
+        json.dump(config, f, indent=2)
+        f.write("\n")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,159 @@
+# Copyright 2023 NLP Odyssey Authors. All rights reserved.
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file.
+
+"""Records the reference outputs of the parity test.
+
+The forward pass is a transcription of the Hugging Face implementation of
+GPT-NeoX (modeling_gpt_neox.py), in plain Python and in double precision, so
+that it runs without PyTorch. Unlike the Go implementation, it encodes the whole
+sequence at once, with the causal mask instead of the KV cache. For each token of
+TOKENS, it records the logits, in reference.json, with the parallel residual of
+the checkpoint configuration, and with the sequential one.
+
+    python3 make_checkpoint.py && python3 reference.py
+"""
+
+import collections
+import json
+import math
+import pickle
+import struct
+import zipfile
+
+TOKENS = [1, 5, 3, 7, 2, 9, 0, 4, 19, 11, 6, 13]
+
+FORMATS = {"FloatStorage": "f", "HalfStorage": "e", "BoolStorage": "?"}
+
+
+def load_checkpoint(filename):
+    """Loads the tensors of a torch.save zip file as (shape, values) pairs."""
+    zf = zipfile.ZipFile(filename)
+    prefix = zf.namelist()[0].split("/")[0]
+
+    def rebuild_tensor(storage, offset, size, stride, requires_grad, hooks):
+        n = 1
+        for s in size:
+            n *= s
+        return list(size), storage[offset : offset + n]
+
+    class Unpickler(pickle.Unpickler):
+        def find_class(self, module, name):
+            if (module, name) == ("torch._utils", "_rebuild_tensor_v2"):
+                return rebuild_tensor
+            if module == "torch" and name in FORMATS:
+                return name
+            if (module, name) == ("collections", "OrderedDict"):
+                return collections.OrderedDict
+            raise pickle.UnpicklingError("unexpected class %s.%s" % (module, name))
+
+        def persistent_load(self, pid):
+            _, kind, key, _, numel = pid
+            data = zf.read("%s/data/%s" % (prefix, key))
+            return list(struct.unpack("<%d%s" % (numel, FORMATS[kind]), data))
+
+    with zf.open(prefix + "/data.pkl") as f:
+        return Unpickler(f).load()
+
+
+def matrix(shape, values):
+    rows, cols = shape
+    return [values[r * cols : (r + 1) * cols] for r in range(rows)]
+
+
+def linear(w, b, x):
+    return [sum(wi * xi for wi, xi in zip(row, x)) + bias for row, bias in zip(w, b)]
+
+
+def layer_norm(w, b, x, eps):
+    n = len(x)
+    mean = sum(x) / n
+    var = sum((v - mean) ** 2 for v in x) / n
+    return [(v - mean) / math.sqrt(var + eps) * wi + bi for v, wi, bi in zip(x, w, b)]
+
+
+def gelu(x):
+    return 0.5 * x * (1 + math.erf(x / math.sqrt(2)))
+
+
+def rotate_half(x):
+    half = len(x) // 2
+    return [-v for v in x[half:]] + x[:half]
+
+
+class GPTNeoX:
+    def __init__(self, filename, config):
+        self.w = {}
+        for k, (shape, values) in load_checkpoint(filename).items():
+            self.w[k] = matrix(shape, values) if len(shape) == 2 else values
+        self.c = config
+        self.head_size = config["hidden_size"] // config["num_attention_heads"]
+        self.rotary_ndims = int(self.head_size * config["rotary_pct"])
+        dim = self.rotary_ndims
+        self.inv_freq = [1.0 / config["rotary_emb_base"] ** (i / dim) for i in range(0, dim, 2)]
+
+    def rotary(self, x, pos):
+        """apply_rotary_pos_emb, on the rotary dimensions of x."""
+        freqs = [pos * f for f in self.inv_freq]
+        emb = freqs + freqs
+        rot, rest = x[: self.rotary_ndims], x[self.rotary_ndims :]
+        rotated = rotate_half(rot)
+        return [v * math.cos(e) + r * math.sin(e) for v, r, e in zip(rot, rotated, emb)] + rest
+
+    def attention(self, p, xs):
+        hs, nh = self.head_size, self.c["num_attention_heads"]
+        qkv = [linear(self.w[p + "query_key_value.weight"], self.w[p + "query_key_value.bias"], x) for x in xs]
+        out = [[] for _ in xs]
+        for h in range(nh):
+            heads = [v[h * 3 * hs : (h + 1) * 3 * hs] for v in qkv]
+            q = [self.rotary(v[:hs], t) for t, v in enumerate(heads)]
+            k = [self.rotary(v[hs : 2 * hs], t) for t, v in enumerate(heads)]
+            v = [v[2 * hs :] for v in heads]
+            for t in range(len(xs)):
+                scores = [sum(a * b for a, b in zip(q[t], k[s])) / math.sqrt(hs) for s in range(t + 1)]
+                m = max(scores)
+                e = [math.exp(s - m) for s in scores]
+                z = sum(e)
+                out[t] += [sum(e[s] * v[s][j] for s in range(t + 1)) / z for j in range(hs)]
+        return [linear(self.w[p + "dense.weight"], self.w[p + "dense.bias"], o) for o in out]
+
+    def mlp(self, p, x):
+        h = [gelu(v) for v in linear(self.w[p + "dense_h_to_4h.weight"], self.w[p + "dense_h_to_4h.bias"], x)]
+        return linear(self.w[p + "dense_4h_to_h.weight"], self.w[p + "dense_4h_to_h.bias"], h)
+
+    def forward(self, tokens, parallel_residual):
+        eps = self.c["layer_norm_eps"]
+        xs = [list(self.w["gpt_neox.embed_in.weight"][t]) for t in tokens]
+        for i in range(self.c["num_hidden_layers"]):
+            p = "gpt_neox.layers.%d." % i
+            ln1 = [layer_norm(self.w[p + "input_layernorm.weight"], self.w[p + "input_layernorm.bias"], x, eps) for x in xs]
+            attn = self.attention(p + "attention.", ln1)
+            ln2w, ln2b = self.w[p + "post_attention_layernorm.weight"], self.w[p + "post_attention_layernorm.bias"]
+            if parallel_residual:
+                mlp = [self.mlp(p + "mlp.", layer_norm(ln2w, ln2b, x, eps)) for x in xs]
+                xs = [[a + b + c for a, b, c in zip(x, at, ml)] for x, at, ml in zip(xs, attn, mlp)]
+            else:
+                attn = [[a + b for a, b in zip(x, at)] for x, at in zip(xs, attn)]
+                mlp = [self.mlp(p + "mlp.", layer_norm(ln2w, ln2b, x, eps)) for x in attn]
+                xs = [[a + b for a, b in zip(at, ml)] for at, ml in zip(attn, mlp)]
+        w, b = self.w["gpt_neox.final_layer_norm.weight"], self.w["gpt_neox.final_layer_norm.bias"]
+        head = self.w["embed_out.weight"]
+        return [[sum(a * c for a, c in zip(row, layer_norm(w, b, x, eps))) for row in head] for x in xs]
+
+
+def main():
+    with open("config.json") as f:
+        config = json.load(f)
+    model = GPTNeoX("pytorch_model.bin", config)
+    ref = {
+        "tokens": TOKENS,
+        "parallel": model.forward(TOKENS, True),
+        "sequential": model.forward(TOKENS, False),
+    }
+    with open("reference.json", "w") as f:
+        json.dump(ref, f)
+        f.write("\n")
+
+
+if __name__ == "__main__":
+    main()
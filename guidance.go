@@ -0,0 +1,238 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/verrors"
+)
+
+// Program is a guidance-style program: a text written in turns by the program,
+// with Literal, and by the model, with Gen and Select, whose results are kept as
+// named variables. The state of the model follows the text, so that each step
+// encodes only its own tokens.
+//
+// A Program is not safe for concurrent use.
+type Program struct {
+	vf    *VerbaFlow
+	state *Continuation
+	text  strings.Builder
+	vars  map[string]string
+}
+
+// NewProgram returns a program beginning with the prompt, which is encoded.
+func (vf *VerbaFlow) NewProgram(ctx context.Context, prompt string) (*Program, error) {
+	state, err := vf.EncodeContinuation(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	p := &Program{vf: vf, state: state, vars: make(map[string]string)}
+	p.text.WriteString(prompt)
+	return p, nil
+}
+
+// Text returns the text of the program so far.
+func (p *Program) Text() string {
+	return p.text.String()
+}
+
+// Var returns the value of the variable set by Gen or Select.
+func (p *Program) Var(name string) string {
+	return p.vars[name]
+}
+
+// Vars returns the variables set by Gen and Select.
+func (p *Program) Vars() map[string]string {
+	vars := make(map[string]string, len(p.vars))
+	for name, value := range p.vars {
+		vars[name] = value
+	}
+	return vars
+}
+
+// Literal appends the text to the program: its tokens are forced, encoded
+// following the state of the model, without sampling.
+func (p *Program) Literal(ctx context.Context, text string) error {
+	if text == "" {
+		return nil
+	}
+	state, err := p.vf.encodeFollowing(ctx, p.state, text)
+	if err != nil {
+		return err
+	}
+	p.state = state
+	p.text.WriteString(text)
+	return nil
+}
+
+// Gen generates the text following the program, until the end token, the maximum
+// length or one of the stop regexps of opts, setting it as the variable name, if
+// not empty. The text matching the stop regexp is left out of the variable, but
+// kept in the text of the program, which the state of the model follows.
+func (p *Program) Gen(ctx context.Context, name string, opts decoder.DecodingOptions) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stops := make([]*regexp.Regexp, len(opts.StopRegexps))
+	for i, s := range opts.StopRegexps {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return "", fmt.Errorf("verbaflow: invalid stop regexp %q: %w", s, err)
+		}
+		stops[i] = re
+	}
+	var final *Continuation
+	var finalErr error
+	opts.FinalState = func(input decoder.Input) {
+		final, finalErr = p.vf.NewContinuation(input)
+	}
+	chGen := p.vf.generationChannel(opts)
+	errCh := make(chan error, 1)
+	go func() {
+		// free the computational graph after the generation is finished
+		nt := &ag.NodesTracker{}
+		defer graph.ReleaseNodes(nt)
+		errCh <- p.vf.GenerateContinuation(ctx, nt, p.state, "", chGen, opts)
+	}()
+	var text strings.Builder
+	for gen := range chGen {
+		if gen.TokenID == opts.EndTokenID {
+			continue
+		}
+		token, err := p.vf.TokenByID(gen.TokenID)
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(token)
+	}
+	if err := <-errCh; err != nil {
+		return "", err
+	}
+	if finalErr != nil {
+		return "", finalErr
+	}
+	if final != nil {
+		// nil if the generation was empty
+		p.state = final
+	}
+	p.text.WriteString(text.String())
+	value := text.String()
+	for _, re := range stops {
+		if loc := re.FindStringIndex(value); loc != nil {
+			value = value[:loc[0]]
+		}
+	}
+	if name != "" {
+		p.vars[name] = value
+	}
+	return value, nil
+}
+
+// Select appends to the program the most likely of the options following it,
+// setting it as the variable name, if not empty. The options are scored together,
+// walking the trie of their tokens (see VerbaFlow.Choose); the chosen one is then
+// forced, like a Literal.
+func (p *Program) Select(ctx context.Context, name string, options []string) (string, error) {
+	if len(options) == 0 {
+		return "", fmt.Errorf("verbaflow: no options to select")
+	}
+	scores, err := p.vf.scoreFollowing(ctx, p.state, options)
+	if err != nil {
+		return "", err
+	}
+	best := 0
+	for i, s := range scores {
+		if s.LogProb > scores[best].LogProb {
+			best = i
+		}
+	}
+	if err := p.Literal(ctx, options[best]); err != nil {
+		return "", err
+	}
+	if name != "" {
+		p.vars[name] = options[best]
+	}
+	return options[best], nil
+}
+
+// encodeFollowing returns the continuation after the text following c, which is
+// not modified.
+func (vf *VerbaFlow) encodeFollowing(ctx context.Context, c *Continuation, text string) (_ *Continuation, err error) {
+	ctx, _ = genid.Ensure(ctx)
+	model, err := vf.model()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := vf.Tokenizer.Tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer func() {
+		if r := recover(); r != nil {
+			err = verrors.Recovered(r)
+		}
+	}()
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+	state, err := vf.cloneState(c.input.State)
+	if err != nil {
+		return nil, err
+	}
+	input := decoder.Input{Logits: c.logits(), State: state, Tokens: c.input.Tokens}
+	for _, token := range tokens {
+		if input.Logits, input.State, err = model.EncodeNext(ctx, nt, input.State, token); err != nil {
+			return nil, err
+		}
+	}
+	input.Tokens = append(input.Tokens[:len(input.Tokens):len(input.Tokens)], tokens...)
+	return vf.NewContinuation(input)
+}
+
+// scoreFollowing returns the scores of the choices following c, which is not
+// modified.
+func (vf *VerbaFlow) scoreFollowing(ctx context.Context, c *Continuation, choices []string) (_ []ChoiceScore, err error) {
+	ctx, _ = genid.Ensure(ctx)
+	model, err := vf.model()
+	if err != nil {
+		return nil, err
+	}
+	trie, err := vf.choiceTrie(choices)
+	if err != nil {
+		return nil, err
+	}
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer func() {
+		if r := recover(); r != nil {
+			err = verrors.Recovered(r)
+		}
+	}()
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+	scores := make([]ChoiceScore, len(choices))
+	for i, choice := range choices {
+		scores[i].Text = choice
+	}
+	if err := vf.scoreChoices(ctx, nt, model, trie, c.decoderInput(), 0, scores); err != nil {
+		return nil, err
+	}
+	return scores, nil
+}
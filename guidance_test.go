@@ -0,0 +1,50 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgram(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	ctx := context.Background()
+	p, err := vf.NewProgram(ctx, "Q: ")
+	require.NoError(t, err)
+
+	// the literals are encoded as if they were part of the prompt
+	require.NoError(t, p.Literal(ctx, "abc"))
+	want, err := vf.EncodeContinuation(ctx, "Q: abc")
+	require.NoError(t, err)
+	assert.Equal(t, want.Tokens(), p.state.Tokens())
+	assert.InDeltaSlice(t, want.input.Logits.Data().F64(), p.state.input.Logits.Data().F64(), 1e-4)
+
+	value, err := p.Gen(ctx, "answer", decoder.DecodingOptions{MaxLen: 3, EndTokenID: -1})
+	require.NoError(t, err)
+	assert.Len(t, value, 3)
+	assert.Equal(t, value, p.Var("answer"))
+	assert.Len(t, p.state.Tokens(), len("Q: abc")+3)
+
+	// the text matching the stop regexp is left out of the variable
+	value, err = p.Gen(ctx, "", decoder.DecodingOptions{MaxLen: 20, EndTokenID: -1, StopRegexps: []string{"[a-z]{2}"}})
+	require.NoError(t, err)
+	assert.Empty(t, value)
+	assert.Len(t, p.Text(), len("Q: abc")+5)
+
+	text := p.Text()
+	choice, err := p.Select(ctx, "choice", []string{"yes", "no"})
+	require.NoError(t, err)
+	assert.Contains(t, []string{"yes", "no"}, choice)
+	assert.Equal(t, text+choice, p.Text())
+	assert.Equal(t, map[string]string{"answer": p.Var("answer"), "choice": choice}, p.Vars())
+
+	_, err = p.Select(ctx, "", nil)
+	assert.Error(t, err)
+}
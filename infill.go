@@ -0,0 +1,204 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+)
+
+// FillMarker marks the position of the text to generate in the prompts of
+// VerbaFlow.Infill.
+const FillMarker = "<|fill|>"
+
+// DefaultInfillCandidates is the default number of insertions generated by
+// VerbaFlow.Infill.
+const DefaultInfillCandidates = 4
+
+// DefaultScoredSuffixTokens is the default number of tokens of the suffix scored
+// by VerbaFlow.Infill.
+const DefaultScoredSuffixTokens = 32
+
+// suffixStopBytes is the length of the beginning of the suffix stopping the
+// generation of an insertion.
+const suffixStopBytes = 16
+
+// InfillOptions are the options of VerbaFlow.Infill.
+type InfillOptions struct {
+	// Candidates is the number of insertions generated and ranked (default:
+	// DefaultInfillCandidates).
+	Candidates int
+	// ScoredSuffixTokens is the number of tokens at the beginning of the suffix
+	// scored to rank the insertions (default: DefaultScoredSuffixTokens).
+	ScoredSuffixTokens int
+}
+
+// Insertion is a text generated in place of the FillMarker.
+type Insertion struct {
+	Text string `json:"text"`
+	// Score is the average log-probability of the scored tokens of the suffix
+	// following the prefix and the text.
+	Score float64 `json:"score"`
+}
+
+// InfillResult is the result of VerbaFlow.Infill.
+type InfillResult struct {
+	// Text is the prompt with the best insertion in place of the FillMarker.
+	Text string `json:"text"`
+	// Candidates are the insertions by decreasing score.
+	Candidates []Insertion `json:"candidates"`
+}
+
+// Best returns the insertion with the highest score.
+func (r InfillResult) Best() Insertion {
+	return r.Candidates[0]
+}
+
+// Infill generates the text in place of the FillMarker of the prompt
+// (fill-in-the-middle). The candidate insertions are sampled from the text
+// before the marker, like in SelfConsistency, each stopping when it begins to
+// repeat the text after the marker; then they are ranked by the likelihood of the
+// beginning of the suffix following them, which measures how well they join it.
+//
+// The prompt must have a single marker, and some text before it.
+func (vf *VerbaFlow) Infill(ctx context.Context, prompt string, opts decoder.DecodingOptions, fill InfillOptions) (InfillResult, error) {
+	prefix, suffix, err := splitFill(prompt)
+	if err != nil {
+		return InfillResult{}, err
+	}
+	n := fill.Candidates
+	if n <= 0 {
+		n = DefaultInfillCandidates
+	}
+	scored := fill.ScoredSuffixTokens
+	if scored <= 0 {
+		scored = DefaultScoredSuffixTokens
+	}
+	suffixTokens, err := vf.Tokenizer.Tokenize(suffix)
+	if err != nil {
+		return InfillResult{}, err
+	}
+	if len(suffixTokens) > scored {
+		suffixTokens = suffixTokens[:scored]
+	}
+
+	head := suffixHead(suffix)
+	if head != "" {
+		opts.StopRegexps = append(opts.StopRegexps[:len(opts.StopRegexps):len(opts.StopRegexps)], regexp.QuoteMeta(head))
+	}
+	candidates := make([]Insertion, n)
+	for i := range candidates {
+		sopts := opts
+		sopts.UseSampling = true
+		if opts.Seed != 0 {
+			sopts.Seed = opts.Seed + uint64(i)
+		}
+		var sb strings.Builder
+		err := vf.GenerateText(ctx, prefix, sopts, func(text string) error {
+			sb.WriteString(text)
+			return nil
+		})
+		if err != nil {
+			return InfillResult{}, err
+		}
+		text := sb.String()
+		if j := strings.Index(text, head); head != "" && j >= 0 {
+			text = text[:j]
+		}
+		candidates[i].Text = text
+		if candidates[i].Score, err = vf.scoreSuffix(ctx, prefix+text, suffixTokens); err != nil {
+			return InfillResult{}, err
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return InfillResult{
+		Text:       prefix + candidates[0].Text + suffix,
+		Candidates: candidates,
+	}, nil
+}
+
+// splitFill returns the text before and after the FillMarker of the prompt.
+func splitFill(prompt string) (prefix, suffix string, err error) {
+	switch strings.Count(prompt, FillMarker) {
+	case 0:
+		return "", "", fmt.Errorf("verbaflow: the prompt has no %s marker", FillMarker)
+	case 1:
+	default:
+		return "", "", fmt.Errorf("verbaflow: the prompt has more than one %s marker", FillMarker)
+	}
+	prefix, suffix, _ = strings.Cut(prompt, FillMarker)
+	if prefix == "" {
+		return "", "", fmt.Errorf("verbaflow: no text before the %s marker", FillMarker)
+	}
+	return prefix, suffix, nil
+}
+
+// suffixHead returns the beginning of the suffix which stops the generation of
+// the insertions: at most suffixStopBytes of its first line, after the leading
+// spaces, cut at a rune boundary.
+func suffixHead(suffix string) string {
+	head, _, _ := strings.Cut(strings.TrimLeft(suffix, " \t\n"), "\n")
+	if len(head) <= suffixStopBytes {
+		return head
+	}
+	end := suffixStopBytes
+	for end > 0 && !utf8.RuneStart(head[end]) {
+		end--
+	}
+	return head[:end]
+}
+
+// scoreSuffix returns the average log-probability of the tokens of the suffix
+// following the text, encoded as a prompt.
+func (vf *VerbaFlow) scoreSuffix(ctx context.Context, text string, suffix []int) (float64, error) {
+	if len(suffix) == 0 {
+		return 0, nil
+	}
+	model, err := vf.model()
+	if err != nil {
+		return 0, err
+	}
+	tokens, err := vf.Tokenizer.Tokenize(text)
+	if err != nil {
+		return 0, err
+	}
+	if err := vf.CheckPromptLength(len(tokens)); err != nil {
+		return 0, err
+	}
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+	input, err := vf.encodePrompt(ctx, nt, tokens, decoder.DecodingOptions{})
+	if err != nil {
+		return 0, err
+	}
+	logits, state := input.Logits, input.State
+	var sum float64
+	for i, id := range suffix {
+		sum += decoder.LogProb(logits, id)
+		if i == len(suffix)-1 {
+			break
+		}
+		if logits, state, err = model.EncodeNext(ctx, nt, state, id); err != nil {
+			return 0, err
+		}
+	}
+	return sum / float64(len(suffix)), nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_Infill(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 6, EndTokenID: -1, Temp: 1, TopP: 1, Seed: 11}
+
+	r, err := vf.Infill(context.Background(), "abc"+FillMarker+"xyz", opts, InfillOptions{Candidates: 3})
+	require.NoError(t, err)
+	require.Len(t, r.Candidates, 3)
+	for i, c := range r.Candidates {
+		assert.False(t, math.IsNaN(c.Score))
+		assert.LessOrEqual(t, c.Score, 0.0)
+		assert.NotContains(t, c.Text, "xyz")
+		if i > 0 {
+			assert.GreaterOrEqual(t, r.Candidates[i-1].Score, c.Score)
+		}
+	}
+	assert.Equal(t, "abc"+r.Best().Text+"xyz", r.Text)
+
+	for _, prompt := range []string{"abc", FillMarker + "abc", "a" + FillMarker + "b" + FillMarker} {
+		_, err := vf.Infill(context.Background(), prompt, opts, InfillOptions{})
+		assert.Error(t, err, prompt)
+	}
+}
+
+func TestSuffixHead(t *testing.T) {
+	assert.Equal(t, "return x", suffixHead("\n  return x\n}"))
+	assert.Equal(t, "", suffixHead("\n\n"))
+	long := strings.Repeat("é", 10)
+	assert.Equal(t, strings.Repeat("é", 8), suffixHead(long))
+}
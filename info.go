@@ -0,0 +1,48 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/verbaflow/gptneox"
+)
+
+// ModelInfo describes the model of a VerbaFlow and its limits.
+type ModelInfo struct {
+	// Architecture is the model architecture: "rwkv", gptneox.ModelType, or the
+	// Go type of a custom Backend.
+	Architecture string `json:"architecture"`
+	// DModel is the size of the embeddings (zero if unknown).
+	DModel int `json:"d_model"`
+	// NumHiddenLayers is the number of layers (zero if unknown).
+	NumHiddenLayers int `json:"num_hidden_layers"`
+	// VocabSize is the size of the vocabulary (zero if unknown).
+	VocabSize int `json:"vocab_size"`
+	// MaxConcurrency is the limit of SetMaxConcurrency (zero if unlimited).
+	MaxConcurrency int `json:"max_concurrency"`
+	// MaxPromptTokens is the limit of SetMaxPromptTokens (zero if unlimited).
+	MaxPromptTokens int `json:"max_prompt_tokens"`
+}
+
+// Info returns the description of the model and of the limits of the VerbaFlow.
+func (vf *VerbaFlow) Info() ModelInfo {
+	info := ModelInfo{MaxConcurrency: cap(vf.sem), MaxPromptTokens: vf.maxPromptTokens}
+	switch m := vf.Backend.(type) {
+	case nil:
+		if vf.Model != nil {
+			info.Architecture = "rwkv"
+			c := vf.Model.Config
+			info.DModel, info.NumHiddenLayers, info.VocabSize = c.DModel, c.NumHiddenLayers, c.VocabSize
+		}
+	case *gptneox.Model:
+		info.Architecture = gptneox.ModelType
+		c := m.Config
+		info.DModel, info.NumHiddenLayers, info.VocabSize = c.HiddenSize, c.NumHiddenLayers, c.VocabSize
+	default:
+		info.Architecture = fmt.Sprintf("%T", m)
+	}
+	return info
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_Info(t *testing.T) {
+	vf, err := Load("testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	vf.SetMaxConcurrency(2)
+	vf.SetMaxPromptTokens(100)
+
+	info := vf.Info()
+	assert.Equal(t, "rwkv", info.Architecture)
+	assert.Equal(t, vf.Model.Config.VocabSize, info.VocabSize)
+	assert.Equal(t, vf.Model.Config.NumHiddenLayers, info.NumHiddenLayers)
+	assert.Equal(t, 2, info.MaxConcurrency)
+	assert.Equal(t, 100, info.MaxPromptTokens)
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package diskspace checks the free space of a file system before writing
+// large artifacts, so that operations can fail fast instead of dying mid-write.
+package diskspace
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Error is returned by Check when there is not enough free space.
+type Error struct {
+	Path      string
+	Required  uint64
+	Available uint64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("not enough disk space in %q: about %s required, %s available",
+		e.Path, FormatBytes(e.Required), FormatBytes(e.Available))
+}
+
+// Check returns an *Error if the file system containing path has less than
+// required bytes available. The check is skipped if the available space cannot
+// be determined.
+func Check(path string, required uint64) error {
+	available, ok := Available(path)
+	if !ok {
+		log.Debug().Str("path", path).Msg("Unable to determine the available disk space, skipping the check")
+		return nil
+	}
+	log.Debug().Str("path", path).Msgf("Required disk space: %s, available: %s", FormatBytes(required), FormatBytes(available))
+	if required > available {
+		return &Error{Path: path, Required: required, Available: available}
+	}
+	return nil
+}
+
+// FormatBytes formats a size in bytes using binary prefixes (e.g. "1.5 GiB").
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
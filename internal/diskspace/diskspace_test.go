@@ -0,0 +1,32 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diskspace
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, Check(dir, 1))
+
+	if _, ok := Available(dir); !ok {
+		t.Skip("available disk space not supported on this platform")
+	}
+	err := Check(dir, math.MaxUint64)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, dir, e.Path)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", FormatBytes(512))
+	assert.Equal(t, "1.5 KiB", FormatBytes(1536))
+	assert.Equal(t, "2.0 GiB", FormatBytes(2<<30))
+}
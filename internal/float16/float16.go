@@ -0,0 +1,80 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package float16 converts between float32 and the IEEE 754 half-precision
+// floats, stored as uint16, e.g. to keep the states of the sessions in half the
+// memory.
+package float16
+
+import "math"
+
+// FromFloat32 returns the half-precision float nearest to f, rounding the ties
+// to even. The values beyond the range of float16 (±65504) become infinities,
+// and the tiny ones subnormals or zeros.
+func FromFloat32(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	abs := b & 0x7fffffff
+	switch {
+	case abs > 0x7f800000: // NaN
+		return sign | 0x7e00
+	case abs >= 0x477ff000: // 65520, rounded to infinity
+		return sign | 0x7c00
+	case abs < 0x33000000: // below half the smallest subnormal
+		return sign
+	case abs < 0x38800000: // subnormal
+		shift := 126 - abs>>23
+		return sign | roundShift(abs&0x7fffff|0x800000, shift)
+	}
+	return sign | roundShift(abs-112<<23, 13)
+}
+
+// roundShift returns v shifted right, rounding to the nearest, the ties to even.
+func roundShift(v, shift uint32) uint16 {
+	h := v >> shift
+	rem, half := v&(1<<shift-1), uint32(1)<<(shift-1)
+	if rem > half || rem == half && h&1 == 1 {
+		h++
+	}
+	return uint16(h)
+}
+
+// ToFloat32 returns the float32 equal to the half-precision float h.
+func ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+	switch {
+	case exp == 0x1f: // infinity or NaN
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case exp == 0 && mant == 0:
+		return math.Float32frombits(sign)
+	case exp == 0: // subnormal, normalized in float32
+		exp = 113
+		for mant&0x400 == 0 {
+			mant <<= 1
+			exp--
+		}
+		return math.Float32frombits(sign | exp<<23 | (mant&0x3ff)<<13)
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+}
+
+// FromFloat32s returns the half-precision floats nearest to xs (see FromFloat32).
+func FromFloat32s(xs []float32) []uint16 {
+	hs := make([]uint16, len(xs))
+	for i, x := range xs {
+		hs[i] = FromFloat32(x)
+	}
+	return hs
+}
+
+// ToFloat32s returns the float32 values of the half-precision floats.
+func ToFloat32s(hs []uint16) []float32 {
+	xs := make([]float32, len(hs))
+	for i, h := range hs {
+		xs[i] = ToFloat32(h)
+	}
+	return xs
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package float16
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromFloat32(t *testing.T) {
+	tests := []struct {
+		f    float32
+		want uint16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{0.5, 0x3800},
+		{65504, 0x7bff},
+		{65519, 0x7bff},
+		{65520, 0x7c00},
+		{1e10, 0x7c00},
+		{-1e30, 0xfc00},
+		{float32(math.Inf(1)), 0x7c00},
+		{0x1p-14, 0x0400},
+		{0x1p-24, 0x0001},
+		{0x1p-25, 0x0000},
+		{0x1.8p-25, 0x0001},
+		{1 + 0x1p-11, 0x3c00}, // tie, to even
+		{1 + 0x3p-11, 0x3c02}, // tie, to even
+		{1 + 0x1p-10, 0x3c01}, // exact
+		{0.1, 0x2e66},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, FromFloat32(tt.f), "%g", tt.f)
+	}
+	assert.True(t, math.IsNaN(float64(ToFloat32(FromFloat32(float32(math.NaN()))))))
+}
+
+func TestToFloat32(t *testing.T) {
+	// every finite half-precision float converts back to itself
+	for h := 0; h <= 0xffff; h++ {
+		if h&0x7c00 == 0x7c00 && h&0x3ff != 0 {
+			continue // NaN
+		}
+		assert.Equal(t, uint16(h), FromFloat32(ToFloat32(uint16(h))), "%#04x", h)
+	}
+	assert.Equal(t, float32(0x1p-24), ToFloat32(0x0001))
+	assert.Equal(t, float32(65504), ToFloat32(0x7bff))
+	assert.Equal(t, []float32{1, -2}, ToFloat32s(FromFloat32s([]float32{1, -2})))
+}
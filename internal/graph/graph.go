@@ -0,0 +1,32 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package graph releases the computational graphs of the generations, returning
+// the values of their nodes to the matrix pool of spago.
+package graph
+
+import "github.com/nlpodyssey/spago/ag"
+
+// ReleaseNodes releases the nodes tracked by nt, see ReleaseGraph.
+func ReleaseNodes(nt *ag.NodesTracker) {
+	if raceEnabled {
+		return
+	}
+	nt.ReleaseNodes()
+}
+
+// ReleaseGraph releases the graphs of the given nodes with ag.ReleaseGraph, which
+// waits for the value of each node. It must be called once the nodes are not
+// used anymore, e.g. after the decoding is over.
+//
+// The race detector cannot see that the forward goroutine of an operator is
+// over when its value is available, and reports ag.ReleaseGraph clearing the
+// mutex that goroutine unlocks last: the builds with -race leave the graphs to
+// the garbage collector instead.
+func ReleaseGraph(nodes ...ag.Node) {
+	if raceEnabled {
+		return
+	}
+	ag.ReleaseGraph(nodes...)
+}
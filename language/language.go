@@ -0,0 +1,146 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package language keeps the generations in the writing system of the requested
+// language, which the multilingual models tend to switch from unprompted.
+package language
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Script is a writing system.
+type Script string
+
+// The scripts told apart; Unknown is the one of the texts without letters.
+const (
+	Unknown  Script = ""
+	Latin    Script = "latin"
+	Cyrillic Script = "cyrillic"
+	Greek    Script = "greek"
+	Arabic   Script = "arabic"
+	Hebrew   Script = "hebrew"
+	// CJK covers the Chinese characters, the Japanese kana and the Korean hangul.
+	CJK Script = "cjk"
+)
+
+// Auto requests the script of the prompt (see Detect).
+const Auto = "auto"
+
+var scriptTables = []struct {
+	script Script
+	tables []*unicode.RangeTable
+}{
+	{Latin, []*unicode.RangeTable{unicode.Latin}},
+	{Cyrillic, []*unicode.RangeTable{unicode.Cyrillic}},
+	{Greek, []*unicode.RangeTable{unicode.Greek}},
+	{Arabic, []*unicode.RangeTable{unicode.Arabic}},
+	{Hebrew, []*unicode.RangeTable{unicode.Hebrew}},
+	{CJK, []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul}},
+}
+
+// Scripts returns the names of the scripts, in order.
+func Scripts() []string {
+	names := make([]string, len(scriptTables))
+	for i, st := range scriptTables {
+		names[i] = string(st.script)
+	}
+	return names
+}
+
+// ParseScript returns the script with the given name.
+func ParseScript(name string) (Script, error) {
+	for _, st := range scriptTables {
+		if string(st.script) == strings.ToLower(name) {
+			return st.script, nil
+		}
+	}
+	return Unknown, fmt.Errorf("unknown script %q (valid: %s, %s)", name, strings.Join(Scripts(), ", "), Auto)
+}
+
+// ScriptOf returns the script of the letter r, Unknown for the other characters
+// and for the letters of the scripts not told apart.
+func ScriptOf(r rune) Script {
+	if !unicode.IsLetter(r) {
+		return Unknown
+	}
+	for _, st := range scriptTables {
+		if unicode.In(r, st.tables...) {
+			return st.script
+		}
+	}
+	return Unknown
+}
+
+// Detect returns the script of most of the letters of the text, e.g. of a prompt,
+// or Unknown if it has none.
+func Detect(text string) Script {
+	counts := make(map[Script]int)
+	for _, r := range text {
+		if s := ScriptOf(r); s != Unknown {
+			counts[s]++
+		}
+	}
+	best, bestCount := Unknown, 0
+	// the ties are broken in the order of the scripts
+	for _, st := range scriptTables {
+		if n := counts[st.script]; n > bestCount {
+			best, bestCount = st.script, n
+		}
+	}
+	return best
+}
+
+// TokenScripts returns the script of each token, given the texts of the vocabulary:
+// the one of most of its letters, or Unknown for the tokens without letters, such
+// as the punctuation, the digits and the partial UTF-8 sequences.
+func TokenScripts(vocabulary []string) []Script {
+	scripts := make([]Script, len(vocabulary))
+	for i, text := range vocabulary {
+		scripts[i] = Detect(text)
+	}
+	return scripts
+}
+
+// Gate is a decoder.LogitsProcessor keeping the generation in the target script:
+// the logits of the tokens of other scripts are decreased by the penalty, or the
+// tokens are banned if the penalty is not positive. The tokens without letters are
+// not affected.
+type Gate struct {
+	penalty float32
+	// others are the IDs of the tokens of the other scripts, in increasing order.
+	others []int
+}
+
+var _ decoder.LogitsProcessor = &Gate{}
+
+// NewGate returns a Gate for the tokens of the given scripts (see TokenScripts).
+func NewGate(scripts []Script, target Script, penalty float64) *Gate {
+	g := &Gate{penalty: float32(penalty)}
+	if penalty <= 0 {
+		g.penalty = float32(math.Inf(1))
+	}
+	for id, s := range scripts {
+		if s != Unknown && s != target {
+			g.others = append(g.others, id)
+		}
+	}
+	return g
+}
+
+// Process implements decoder.LogitsProcessor.
+func (g *Gate) Process(_ int, _ []int, logits []float32) []float32 {
+	for _, id := range g.others {
+		if id >= len(logits) {
+			break
+		}
+		logits[id] -= g.penalty
+	}
+	return logits
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package language
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetect(t *testing.T) {
+	assert.Equal(t, Latin, Detect("Hello, world!"))
+	assert.Equal(t, Cyrillic, Detect("Привет, мир! (hello)"))
+	assert.Equal(t, CJK, Detect("你好，世界"))
+	assert.Equal(t, CJK, Detect("こんにちは"))
+	assert.Equal(t, Greek, Detect("Γειά σου"))
+	assert.Equal(t, Unknown, Detect("1 + 2 = 3"))
+}
+
+func TestParseScript(t *testing.T) {
+	s, err := ParseScript("Cyrillic")
+	require.NoError(t, err)
+	assert.Equal(t, Cyrillic, s)
+	_, err = ParseScript("klingon")
+	assert.ErrorContains(t, err, `unknown script "klingon"`)
+}
+
+func TestGate(t *testing.T) {
+	scripts := TokenScripts([]string{" the", "при", ",", "\xe4", "世界", "ok"})
+	assert.Equal(t, []Script{Latin, Cyrillic, Unknown, Unknown, CJK, Latin}, scripts)
+
+	logits := []float32{1, 2, 3, 4, 5, 6}
+	assert.Equal(t, []float32{1, -1, 3, 4, 2, 6}, NewGate(scripts, Latin, 3).Process(0, nil, logits))
+
+	inf := float32(math.Inf(-1))
+	logits = []float32{1, 2, 3, 4, 5, 6}
+	assert.Equal(t, []float32{inf, 2, 3, 4, inf, inf}, NewGate(scripts, Cyrillic, 0).Process(0, nil, logits))
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package verbaflow
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
+	"github.com/nlpodyssey/verbaflow/bundle"
+	"github.com/nlpodyssey/verbaflow/gptneox"
+	"github.com/nlpodyssey/verbaflow/manifest"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+)
+
+// LoadOptions contains the options for loading a model.
+type LoadOptions struct {
+	// SkipMemoryCheck disables the check that the model fits in the available memory.
+	SkipMemoryCheck bool
+	// MemoryMargin is the fraction of the available memory that must remain free
+	// after loading the model (default: 0.1).
+	MemoryMargin float64
+	// BundleKey returns the key of an encrypted bundle, e.g. fetching it from a key
+	// management service. If nil, the key is read from the VERBAFLOW_BUNDLE_KEY
+	// environment variable.
+	BundleKey bundle.KeyFunc
+	// VerifyKey, when not nil, is the public key that must have signed the manifest
+	// of the model: the model is not loaded if the signature or any file hash does
+	// not match.
+	VerifyKey ed25519.PublicKey
+	// RescaleLayer, if not zero, changes the rescaling of the converted model
+	// (rwkvlm.NoRescale disables it), see rwkvlm.Model.SetRescaleLayer.
+	RescaleLayer int
+	// SharedWeights, when loading a snapshot (see WriteSnapshot), uses the weights in
+	// place in a read-only mapping of the file, shared by all the processes loading
+	// the same snapshot, instead of copying them in the memory of each process (see
+	// rwkvlm.LoadSnapshotShared). RescaleLayer must be zero: the rescaling is that
+	// of the snapshot. It is ignored when loading a model directory or a bundle.
+	SharedWeights bool
+}
+
+// Load loads a VerbaFlow model from the given directory, with the default options.
+func Load(modelDir string) (*VerbaFlow, error) {
+	return LoadWithOptions(modelDir, LoadOptions{})
+}
+
+// LoadWithOptions loads a VerbaFlow model from the given directory, ".vflow" bundle,
+// or snapshot file (see WriteSnapshot), along with its GenerationConfig, if any. Unless opts.SkipMemoryCheck is true, it
+// fails with an InsufficientMemoryError if the model is not expected to fit in the
+// available memory.
+//
+// A directory with a GPT-NeoX model (see gptneox.IsGPTNeoX) is loaded as the Backend,
+// ignoring opts.RescaleLayer.
+func LoadWithOptions(modelDir string, opts LoadOptions) (*VerbaFlow, error) {
+	if bundle.IsBundle(modelDir) {
+		return loadBundle(modelDir, opts)
+	}
+	if isSnapshot(modelDir) {
+		return loadSnapshot(modelDir, opts)
+	}
+	if opts.VerifyKey != nil {
+		if err := manifest.Verify(manifest.Dir(modelDir), opts.VerifyKey); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.SkipMemoryCheck {
+		if err := checkMemory(modelDir, memoryMargin(opts)); err != nil {
+			return nil, err
+		}
+	}
+	if gptneox.IsGPTNeoX(modelDir) {
+		return loadGPTNeoX(modelDir)
+	}
+	return load(modelDir, opts, func() (*rwkvlm.Model, error) {
+		return rwkvlm.Load(modelDir)
+	})
+}
+
+// loadGPTNeoX loads a converted GPT-NeoX model, and its tokenizer, from modelDir.
+func loadGPTNeoX(modelDir string) (*VerbaFlow, error) {
+	tk, err := tokenizer.Load(modelDir)
+	if err != nil {
+		return nil, err
+	}
+	model, err := gptneox.Load(modelDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, modelNotFound(modelDir)
+		}
+		return nil, err
+	}
+	if err := checkTokenizer(tk, model.VocabSize()); err != nil {
+		return nil, err
+	}
+	genConf, err := LoadGenerationConfig(modelDir)
+	if err != nil {
+		return nil, err
+	}
+	return &VerbaFlow{
+		Backend:          model,
+		Tokenizer:        tk,
+		GenerationConfig: genConf,
+	}, nil
+}
+
+func modelNotFound(modelDir string) error {
+	return fmt.Errorf("%w: unable to find the model file or directory '%s'. Please ensure that the model has been successfully downloaded and converted before trying again", ErrModelNotLoaded, modelDir)
+}
+
+// loadBundle loads a model from a ".vflow" bundle, decrypting it if it is encrypted.
+// The model file is read directly from the bundle, while the other files are extracted to a temporary directory,
+// removed by Close.
+func loadBundle(path string, opts LoadOptions) (_ *VerbaFlow, err error) {
+	keyFunc := opts.BundleKey
+	if keyFunc == nil {
+		keyFunc = bundle.KeyFromEnv(bundle.EnvKey)
+	}
+	b, err := bundle.OpenEncrypted(path, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	if opts.VerifyKey != nil {
+		if err := manifest.Verify(manifest.Bundle(b), opts.VerifyKey); err != nil {
+			return nil, err
+		}
+	}
+	tmpDir, err := os.MkdirTemp("", "verbaflow-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(tmpDir)
+		}
+	}()
+	if err := b.Extract(tmpDir, func(name string) bool { return name != rwkvlm.DefaultOutputFilename }); err != nil {
+		return nil, fmt.Errorf("failed to extract bundle: %w", err)
+	}
+	if !opts.SkipMemoryCheck {
+		if err := checkMemory(tmpDir, memoryMargin(opts)); err != nil {
+			return nil, err
+		}
+	}
+	vf, err := load(tmpDir, opts, func() (*rwkvlm.Model, error) {
+		r, err := b.Open(rwkvlm.DefaultOutputFilename)
+		if err != nil {
+			return nil, err
+		}
+		return rwkvlm.LoadFrom(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	vf.tmpDir = tmpDir
+	return vf, nil
+}
+
+// load loads the model from the files in modelDir, but for the model itself,
+// loaded by loadModel.
+func load(modelDir string, opts LoadOptions, loadModel func() (*rwkvlm.Model, error)) (*VerbaFlow, error) {
+	tk, err := tokenizer.Load(modelDir)
+	if err != nil {
+		return nil, err
+	}
+	genConf, err := LoadGenerationConfig(modelDir)
+	if err != nil {
+		return nil, err
+	}
+	model, err := loadModel()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, modelNotFound(modelDir)
+		}
+		return nil, err
+	}
+	if err := checkTokenizer(tk, model.Config.VocabSize); err != nil {
+		return nil, err
+	}
+	if opts.RescaleLayer != 0 {
+		if err := model.SetRescaleLayer(opts.RescaleLayer); err != nil {
+			return nil, err
+		}
+	}
+	embeddingsRepo, err := diskstore.NewRepository(filepath.Join(modelDir, rwkvlm.DefaultEmbeddingRepoPath), diskstore.ReadOnlyMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embeddings repository: %w", err)
+	}
+	err = model.ApplyEmbeddings(embeddingsRepo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply embeddings: %w", err)
+	}
+	return &VerbaFlow{
+		Model:            model,
+		Tokenizer:        tk,
+		GenerationConfig: genConf,
+		embeddingsRepo:   embeddingsRepo,
+	}, nil
+}
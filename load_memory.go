@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nlpodyssey/spago/embeddings/store/memstore"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+)
+
+// ModelFiles contains the readers of the files of a converted model, for LoadFrom.
+type ModelFiles struct {
+	// Model is the model file (spago_model.bin).
+	Model io.Reader
+	// Embeddings is the portable embeddings file (see rwkvlm.DefaultEmbeddingsFilename),
+	// exported from the embeddings repository with "repo export".
+	Embeddings io.Reader
+	// Vocab is the vocab.json file of the tokenizer.
+	Vocab io.Reader
+	// Merges is the merges.txt file of the tokenizer.
+	Merges io.Reader
+	// GenerationConfig, when not nil, is the GenerationConfigFilename file.
+	GenerationConfig io.Reader
+}
+
+// LoadFrom loads a VerbaFlow model from the given files, keeping the embeddings in
+// memory. Unlike Load, it does not need a file system nor the embeddings repository,
+// and is available in WebAssembly (GOOS=js or wasip1), e.g. to run the smaller models
+// in the browser.
+func LoadFrom(files ModelFiles) (*VerbaFlow, error) {
+	tk, err := tokenizer.LoadFrom(files.Vocab, files.Merges)
+	if err != nil {
+		return nil, err
+	}
+	model, err := rwkvlm.LoadFrom(files.Model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the model: %w", err)
+	}
+	if err := checkTokenizer(tk, model.Config.VocabSize); err != nil {
+		return nil, err
+	}
+	if err := model.ApplyEmbeddings(memstore.NewRepository()); err != nil {
+		return nil, fmt.Errorf("failed to apply embeddings: %w", err)
+	}
+	if err := model.ReadEmbeddings(files.Embeddings); err != nil {
+		return nil, fmt.Errorf("failed to read embeddings: %w", err)
+	}
+	var genConf *GenerationConfig
+	if files.GenerationConfig != nil {
+		if genConf, err = ReadGenerationConfig(files.GenerationConfig); err != nil {
+			return nil, err
+		}
+	}
+	return &VerbaFlow{
+		Model:            model,
+		Tokenizer:        tk,
+		GenerationConfig: genConf,
+	}, nil
+}
+
+// checkTokenizer fails with ErrTokenizerMismatch if the tokenizer can produce
+// token IDs out of the vocabulary of the model. The check is skipped for the
+// tokenizers not reporting the size of their vocabulary.
+func checkTokenizer(tk tokenizer.Tokenizer, modelVocabSize int) error {
+	sizer, ok := tk.(interface{ VocabSize() int })
+	if !ok {
+		return nil
+	}
+	if size := sizer.VocabSize(); size > modelVocabSize {
+		return fmt.Errorf("%w: the vocabulary has %d tokens, the model %d", ErrTokenizerMismatch, size, modelVocabSize)
+	}
+	return nil
+}
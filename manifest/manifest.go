@@ -0,0 +1,278 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package manifest lists the files of a converted model with their hashes, and
+// signs the list with ed25519, so that tampered model files can be detected.
+package manifest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow/bundle"
+)
+
+const (
+	// Filename is the name of the manifest file, in the model directory.
+	Filename = "manifest.json"
+	// SignatureFilename is the name of the file with the signature of the manifest.
+	SignatureFilename = "manifest.sig"
+)
+
+// ErrNoManifest is returned when verifying a model without a manifest.
+var ErrNoManifest = errors.New("manifest: the model has no manifest")
+
+// Manifest lists the files of a model.
+type Manifest struct {
+	Files []File `json:"files"`
+}
+
+// File is a file of the model, with its name relative to the model directory,
+// slash-separated.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Source gives access to the files of a model, whether in a directory or in a bundle.
+type Source interface {
+	// Files returns the names of the files, slash-separated.
+	Files() ([]string, error)
+	Open(name string) (io.ReadCloser, error)
+}
+
+// Dir returns the Source of the files in a model directory; the links (e.g. into
+// the model cache) are followed.
+func Dir(dir string) Source {
+	return dirSource(dir)
+}
+
+type dirSource string
+
+func (d dirSource) Files() ([]string, error) {
+	var names []string
+	err := walk(string(d), "", func(name string) {
+		names = append(names, name)
+	})
+	return names, err
+}
+
+func walk(dir, prefix string, fn func(name string)) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		info, err := os.Stat(path) // follows the links
+		if err != nil {
+			return err
+		}
+		name := prefix + e.Name()
+		if info.IsDir() {
+			if err := walk(path, name+"/", fn); err != nil {
+				return err
+			}
+			continue
+		}
+		fn(name)
+	}
+	return nil
+}
+
+func (d dirSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// Bundle returns the Source of the files in a bundle.
+func Bundle(r *bundle.Reader) Source {
+	return bundleSource{r}
+}
+
+type bundleSource struct {
+	r *bundle.Reader
+}
+
+func (b bundleSource) Files() ([]string, error) {
+	entries := b.r.Entries()
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	return names, nil
+}
+
+func (b bundleSource) Open(name string) (io.ReadCloser, error) {
+	r, err := b.r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(r), nil
+}
+
+// excluded reports whether the file is not part of the manifest: the manifest
+// itself, the original PyTorch model, and the leftovers of interrupted operations.
+func excluded(name string) bool {
+	switch name {
+	case Filename, SignatureFilename, "pytorch_model.pt":
+		return true
+	}
+	for _, ext := range []string{".part", ".compact", ".old"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Create computes the manifest of the model files in src.
+func Create(src Source) (*Manifest, error) {
+	names, err := src.Files()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	m := &Manifest{Files: []File{}}
+	for _, name := range names {
+		if excluded(name) {
+			continue
+		}
+		f, err := hashFile(src, name)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, f)
+	}
+	return m, nil
+}
+
+func hashFile(src Source, name string) (File, error) {
+	r, err := src.Open(name)
+	if err != nil {
+		return File{}, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return File{}, fmt.Errorf("manifest: failed to hash %s: %w", name, err)
+	}
+	return File{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Write creates the manifest of the model in modelDir and writes it to the
+// manifest file. A previous signature, no longer valid, is removed.
+func Write(modelDir string) (*Manifest, error) {
+	m, err := Create(Dir(modelDir))
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(modelDir, Filename), data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(filepath.Join(modelDir, SignatureFilename)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Sign signs the manifest file of the model in modelDir, writing the signature file.
+func Sign(modelDir string, key ed25519.PrivateKey) error {
+	data, err := os.ReadFile(filepath.Join(modelDir, Filename))
+	if os.IsNotExist(err) {
+		return ErrNoManifest
+	}
+	if err != nil {
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return os.WriteFile(filepath.Join(modelDir, SignatureFilename), []byte(sig+"\n"), 0644)
+}
+
+// Verify checks that the manifest of the model in src is signed with the private
+// key of the given public key, and that the model files match the manifest:
+// no file is missing, modified or added.
+func Verify(src Source, key ed25519.PublicKey) error {
+	data, err := readAll(src, Filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNoManifest
+	}
+	if err != nil {
+		return err
+	}
+	sigData, err := readAll(src, SignatureFilename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("manifest: the manifest is not signed")
+	}
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sigData)))
+	if err != nil || !ed25519.Verify(key, data, sig) {
+		return errors.New("manifest: invalid signature")
+	}
+
+	var want Manifest
+	if err := json.Unmarshal(data, &want); err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+	got, err := Create(src)
+	if err != nil {
+		return err
+	}
+	return compare(want, *got)
+}
+
+func readAll(src Source, name string) ([]byte, error) {
+	r, err := src.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// compare returns an error listing the differences between the two manifests.
+func compare(want, got Manifest) error {
+	files := make(map[string]File, len(got.Files))
+	for _, f := range got.Files {
+		files[f.Name] = f
+	}
+	var problems []string
+	for _, w := range want.Files {
+		g, ok := files[w.Name]
+		delete(files, w.Name)
+		switch {
+		case !ok:
+			problems = append(problems, w.Name+" is missing")
+		case g != w:
+			problems = append(problems, w.Name+" was modified")
+		}
+	}
+	for name := range files {
+		problems = append(problems, name+" is not in the manifest")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("manifest: the model files do not match the manifest: %s", strings.Join(problems, ", "))
+}
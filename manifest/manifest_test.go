@@ -0,0 +1,84 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/bundle"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestModel(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json":            `{"d_model": 8}`,
+		"spago_model.bin":        "model",
+		"embeddings/store_/0001": "embeddings",
+		"pytorch_model.pt":       "excluded",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func newTestKeys(t *testing.T) (privateKeyFile, publicKeyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	privateKeyFile, publicKeyFile = filepath.Join(dir, "key.pem"), filepath.Join(dir, "pub.pem")
+	require.NoError(t, GenerateKey(privateKeyFile, publicKeyFile))
+	return privateKeyFile, publicKeyFile
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir := newTestModel(t)
+	privFile, pubFile := newTestKeys(t)
+	priv, err := LoadPrivateKey(privFile)
+	require.NoError(t, err)
+	pub, err := LoadPublicKey(pubFile)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, Verify(Dir(dir), pub), ErrNoManifest)
+
+	m, err := Write(dir)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 3)
+	assert.Equal(t, "config.json", m.Files[0].Name)
+	assert.Equal(t, "embeddings/store_/0001", m.Files[1].Name)
+	assert.Error(t, Verify(Dir(dir), pub), "unsigned")
+
+	require.NoError(t, Sign(dir, priv))
+	assert.NoError(t, Verify(Dir(dir), pub))
+
+	// the bundle includes the manifest
+	path := filepath.Join(t.TempDir(), "model"+bundle.Extension)
+	require.NoError(t, bundle.Pack(dir, path))
+	b, err := bundle.Open(path)
+	require.NoError(t, err)
+	defer b.Close()
+	assert.NoError(t, Verify(Bundle(b), pub))
+
+	_, otherPubFile := newTestKeys(t)
+	otherPub, err := LoadPublicKey(otherPubFile)
+	require.NoError(t, err)
+	assert.EqualError(t, Verify(Dir(dir), otherPub), "manifest: invalid signature")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "spago_model.bin"), []byte("tampered"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "extra.txt"), []byte("extra"), 0644))
+	assert.EqualError(t, Verify(Dir(dir), pub), "manifest: the model files do not match the manifest: extra.txt is not in the manifest, spago_model.bin was modified")
+}
+
+func TestLoadPublicKey_Invalid(t *testing.T) {
+	privFile, _ := newTestKeys(t)
+	_, err := LoadPublicKey(privFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package verbaflow
+
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultMemoryMargin is the fraction of the available memory kept free by default.
+const defaultMemoryMargin = 0.1
+
+// InsufficientMemoryError is returned by LoadWithOptions when the model is not
+// expected to fit in the available memory.
+type InsufficientMemoryError struct {
+	// Required is the estimated memory needed to load the model, in bytes.
+	Required uint64
+	// Available is the memory available in the system, in bytes.
+	Available uint64
+}
+
+func (e *InsufficientMemoryError) Error() string {
+	return fmt.Sprintf("loading the model requires about %s of memory, but only %s is available: "+
+		"free some memory, use a smaller model, or skip the check if the estimate is wrong",
+		formatBytes(e.Required), formatBytes(e.Available))
+}
+
+func memoryMargin(opts LoadOptions) float64 {
+	if opts.MemoryMargin == 0 {
+		return defaultMemoryMargin
+	}
+	return opts.MemoryMargin
+}
+
+// checkMemory compares the estimated memory needed by the model with the available one.
+func checkMemory(modelDir string, margin float64) error {
+	required, err := rwkvlm.EstimateMemory(modelDir, 4) // float32 parameters
+	if err != nil {
+		// the loading will report a clearer error
+		return nil
+	}
+	return checkRequiredMemory(required, margin)
+}
+
+// checkRequiredMemory compares the memory needed by the model with the available one.
+func checkRequiredMemory(required uint64, margin float64) error {
+	available, ok := availableMemory()
+	if !ok {
+		log.Debug().Msg("Unable to determine the available memory, skipping the check")
+		return nil
+	}
+	log.Debug().Msgf("Estimated memory: %s, available: %s", formatBytes(required), formatBytes(available))
+	if float64(required) > float64(available)*(1-margin) {
+		return &InsufficientMemoryError{Required: required, Available: available}
+	}
+	return nil
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
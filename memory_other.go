@@ -0,0 +1,12 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !js && !wasip1
+
+package verbaflow
+
+// availableMemory is not supported on this platform: the memory check is skipped.
+func availableMemory() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,270 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package modelcache implements a content-addressed cache of model files, shared
+// by the model directories, so that the same checkpoint downloaded or converted
+// for multiple projects is stored only once.
+//
+// The cache holds the downloaded files as blobs named after their SHA-256 hash,
+// and the converted models in directories named after the hash of the source
+// checkpoint. The model directories contain symbolic links into the cache.
+package modelcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EnvDir is the environment variable overriding the default cache directory.
+const EnvDir = "VERBAFLOW_CACHE"
+
+// Cache is a content-addressed cache of model files.
+type Cache struct {
+	// Root is the directory of the cache.
+	Root string
+	// mu guards the registry of the model dirs.
+	mu sync.Mutex
+}
+
+// DefaultDir returns the default cache directory: $VERBAFLOW_CACHE if set,
+// otherwise "verbaflow" in the user cache directory (e.g. ~/.cache/verbaflow).
+func DefaultDir() (string, error) {
+	if dir := os.Getenv(EnvDir); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "verbaflow"), nil
+}
+
+// Open returns the cache in the given directory, creating it if needed.
+func Open(root string) (*Cache, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{Root: root}
+	for _, dir := range []string{c.blobsDir(), c.convertedDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating cache directory %#v: %w", dir, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Cache) blobsDir() string {
+	return filepath.Join(c.Root, "blobs", "sha256")
+}
+
+func (c *Cache) convertedDir() string {
+	return filepath.Join(c.Root, "converted")
+}
+
+// BlobPath returns the path of the blob with the given SHA-256 hash (hex encoded).
+func (c *Cache) BlobPath(hash string) string {
+	return filepath.Join(c.blobsDir(), hash)
+}
+
+// HasBlob reports whether the blob with the given hash is in the cache.
+func (c *Cache) HasBlob(hash string) bool {
+	info, err := os.Stat(c.BlobPath(hash))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Hash returns the SHA-256 hash of the file. If the file is a link to a blob of
+// the cache, the hash is taken from the name of the blob without reading it.
+func (c *Cache) Hash(path string) (string, error) {
+	if target, err := os.Readlink(path); err == nil && filepath.Dir(target) == c.blobsDir() {
+		return filepath.Base(target), nil
+	}
+	return hashFile(path)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error hashing %#v: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Put moves the file into the cache, replacing it with a link to the blob.
+// If the cache already contains the same content, the file is just removed.
+// It returns the hash of the file.
+func (c *Cache) Put(path string) (string, error) {
+	if isLink(path) {
+		return c.Hash(path)
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	blob := c.BlobPath(hash)
+	if c.HasBlob(hash) {
+		log.Debug().Str("file", path).Str("blob", blob).Msg("file already in cache, deduplicating")
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	} else if err := move(path, blob); err != nil {
+		return "", err
+	}
+	if err := link(blob, path); err != nil {
+		return "", err
+	}
+	return hash, c.registerModelDir(filepath.Dir(path))
+}
+
+// LinkBlob creates a link to the blob with the given hash at path.
+func (c *Cache) LinkBlob(hash, path string) error {
+	if !c.HasBlob(hash) {
+		return fmt.Errorf("blob %s not found in cache", hash)
+	}
+	if err := link(c.BlobPath(hash), path); err != nil {
+		return err
+	}
+	return c.registerModelDir(filepath.Dir(path))
+}
+
+// ConvertedPath returns the directory of the model converted from the checkpoint
+// identified by key.
+func (c *Cache) ConvertedPath(key string) string {
+	return filepath.Join(c.convertedDir(), key)
+}
+
+// LinkConverted creates, in modelDir, links to the named files of the converted
+// model identified by key. It returns false if the converted model is not in
+// the cache.
+func (c *Cache) LinkConverted(key, modelDir string, names ...string) (bool, error) {
+	dir := c.ConvertedPath(key)
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false, nil
+		}
+	}
+	for _, name := range names {
+		if err := link(filepath.Join(dir, name), filepath.Join(modelDir, name)); err != nil {
+			return false, err
+		}
+	}
+	return true, c.addModelDir(key, modelDir)
+}
+
+// PutConverted moves the named files (or directories) of the model converted in
+// modelDir into the cache, under info.Key, replacing them with links.
+// Files that are already links are left untouched.
+func (c *Cache) PutConverted(info ConvertedModel, modelDir string, names ...string) error {
+	key := info.Key
+	for _, name := range names {
+		if isLink(filepath.Join(modelDir, name)) {
+			return nil
+		}
+	}
+	dir := c.ConvertedPath(key)
+	// the files are first moved to a temporary directory, which is renamed when
+	// complete, so that a partially stored model is never linked
+	tmp, err := os.MkdirTemp(c.convertedDir(), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, name := range names {
+		if err := move(filepath.Join(modelDir, name), filepath.Join(tmp, name)); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	if err := c.writeInfo(info); err != nil {
+		return err
+	}
+	_, err = c.LinkConverted(key, modelDir, names...)
+	return err
+}
+
+// move renames src to dst, falling back to copying regular files across devices.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return err
+	}
+	info, statErr := os.Stat(src)
+	if statErr != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("error moving %#v to cache: %w", src, err)
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// link creates a symbolic link to target at path, replacing any existing file.
+func link(target, path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(abs, path)
+}
+
+func isLink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// IsHash reports whether s looks like a hex-encoded SHA-256 hash.
+func IsHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(strings.ToLower(s))
+	return err == nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modelcache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_Put(t *testing.T) {
+	c, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	a, b := filepath.Join(dirA, "model.pt"), filepath.Join(dirB, "model.pt")
+	require.NoError(t, os.WriteFile(a, []byte("weights"), 0644))
+	require.NoError(t, os.WriteFile(b, []byte("weights"), 0644))
+
+	hashA, err := c.Put(a)
+	require.NoError(t, err)
+	hashB, err := c.Put(b)
+	require.NoError(t, err)
+	assert.Equal(t, hashA, hashB)
+	assert.True(t, IsHash(hashA))
+	assert.True(t, c.HasBlob(hashA))
+
+	// both files are links to the same blob
+	for _, path := range []string{a, b} {
+		target, err := os.Readlink(path)
+		require.NoError(t, err)
+		assert.Equal(t, c.BlobPath(hashA), target)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "weights", string(data))
+	}
+
+	hash, err := c.Hash(a)
+	require.NoError(t, err)
+	assert.Equal(t, hashA, hash)
+}
+
+func TestCache_Converted(t *testing.T) {
+	c, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	dirA, dirB := t.TempDir(), t.TempDir()
+	ok, err := c.LinkConverted("key", dirB, "model.bin", "embeddings")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dirA, "model.bin"), []byte("model"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dirA, "embeddings"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dirA, "embeddings", "data"), []byte("embs"), 0644))
+	require.NoError(t, c.PutConverted(ConvertedModel{Key: "key", Architecture: "rwkv"}, dirA, "model.bin", "embeddings"))
+
+	ok, err = c.LinkConverted("key", dirB, "model.bin", "embeddings")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	for _, dir := range []string{dirA, dirB} {
+		data, err := os.ReadFile(filepath.Join(dir, "embeddings", "data"))
+		require.NoError(t, err)
+		assert.Equal(t, "embs", string(data))
+	}
+
+	models, err := c.ConvertedModels()
+	require.NoError(t, err)
+	require.Len(t, models, 1)
+	assert.Equal(t, "rwkv", models[0].Architecture)
+	assert.Equal(t, []string{dirA, dirB}, models[0].ModelDirs)
+	assert.GreaterOrEqual(t, models[0].Size, int64(len("model")+len("embs")))
+}
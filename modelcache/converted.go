@@ -0,0 +1,127 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modelcache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// infoFilename is the name of the file describing a converted model.
+const infoFilename = "info.json"
+
+// ConvertedModel describes a converted model stored in the cache.
+type ConvertedModel struct {
+	// Key identifies the model: the hash of the source checkpoint and the data type.
+	Key string `json:"key"`
+	// Architecture is the model architecture (e.g. "rwkv").
+	Architecture string `json:"architecture"`
+	// DType is the data type of the parameters (e.g. "float32").
+	DType           string `json:"dtype"`
+	DModel          int    `json:"d_model"`
+	NumHiddenLayers int    `json:"num_hidden_layers"`
+	VocabSize       int    `json:"vocab_size"`
+	// ModelDirs are the model directories linking the model.
+	ModelDirs []string `json:"model_dirs"`
+	// LastUsed is the last time the model was linked by a model dir.
+	LastUsed time.Time `json:"last_used"`
+	// Size is the disk usage of the model, in bytes.
+	Size int64 `json:"-"`
+}
+
+// ConvertedModels returns the converted models stored in the cache, sorted by key.
+func (c *Cache) ConvertedModels() ([]ConvertedModel, error) {
+	entries, err := os.ReadDir(c.convertedDir())
+	if err != nil {
+		return nil, err
+	}
+	var models []ConvertedModel
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		m, err := c.readInfo(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if m.Size, err = dirSize(c.ConvertedPath(e.Name())); err != nil {
+			return nil, err
+		}
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Key < models[j].Key })
+	return models, nil
+}
+
+// readInfo reads the description of the converted model; a model without one
+// is described by its key only.
+func (c *Cache) readInfo(key string) (ConvertedModel, error) {
+	m := ConvertedModel{Key: key}
+	data, err := os.ReadFile(filepath.Join(c.ConvertedPath(key), infoFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, err
+	}
+	m.Key = key
+	return m, nil
+}
+
+func (c *Cache) writeInfo(m ConvertedModel) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(c.ConvertedPath(m.Key), infoFilename), append(data, '\n'), 0644)
+}
+
+// addModelDir records that modelDir links the converted model.
+func (c *Cache) addModelDir(key, modelDir string) error {
+	if err := c.registerModelDir(modelDir); err != nil {
+		return err
+	}
+	m, err := c.readInfo(key)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(modelDir)
+	if err != nil {
+		return err
+	}
+	m.LastUsed = time.Now()
+	for _, dir := range m.ModelDirs {
+		if dir == abs {
+			return c.writeInfo(m)
+		}
+	}
+	m.ModelDirs = append(m.ModelDirs, abs)
+	return c.writeInfo(m)
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modelcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// registryFilename is the name of the file listing the model dirs linking the cache.
+const registryFilename = "model_dirs.json"
+
+// modelFiles are the files identifying a model dir, checked before removing it.
+var modelFiles = []string{"config.json", "pytorch_model.pt", "spago_model.bin"}
+
+// Report describes the outcome of a removal.
+type Report struct {
+	// Removed lists the removed paths.
+	Removed []string `json:"removed"`
+	// Reclaimed is the disk space freed, in bytes.
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+func (r *Report) remove(path string) error {
+	size, err := dirSize(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	r.Removed = append(r.Removed, path)
+	r.Reclaimed += size
+	return nil
+}
+
+// ModelDirs returns the model dirs that have been linked to the cache.
+// Some of them may have been removed meanwhile.
+func (c *Cache) ModelDirs() ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(c.Root, registryFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	err = json.Unmarshal(data, &dirs)
+	return dirs, err
+}
+
+func (c *Cache) writeModelDirs(dirs []string) error {
+	sort.Strings(dirs)
+	data, err := json.MarshalIndent(dirs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(c.Root, registryFilename), append(data, '\n'), 0644)
+}
+
+// registerModelDir records that the model dir links the cache.
+func (c *Cache) registerModelDir(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dirs, err := c.ModelDirs()
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if d == abs {
+			return nil
+		}
+	}
+	return c.writeModelDirs(append(dirs, abs))
+}
+
+// references are the cache entries linked by the model dirs.
+type references struct {
+	blobs     map[string]bool
+	converted map[string]bool
+}
+
+// references returns the cache entries linked by the given model dirs.
+func (c *Cache) references(dirs ...string) (references, error) {
+	refs := references{blobs: map[string]bool{}, converted: map[string]bool{}}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return refs, err
+		}
+		for _, e := range entries {
+			target, err := os.Readlink(filepath.Join(dir, e.Name()))
+			if err != nil {
+				continue
+			}
+			if rel, ok := relative(c.blobsDir(), target); ok {
+				refs.blobs[rel] = true
+			} else if rel, ok := relative(c.convertedDir(), target); ok {
+				refs.converted[strings.Split(rel, string(filepath.Separator))[0]] = true
+			}
+		}
+	}
+	return refs, nil
+}
+
+// relative returns the path of target relative to dir, if inside it.
+func relative(dir, target string) (string, bool) {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return rel, true
+}
+
+// RemoveModelDir removes the model dir, and the cache entries linked by it that
+// are not linked by any other model dir. It refuses to remove a directory that
+// doesn't contain any model file.
+func (c *Cache) RemoveModelDir(dir string) (Report, error) {
+	var report Report
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return report, err
+	}
+	if !isModelDir(abs) {
+		return report, fmt.Errorf("%q is not a model dir", dir)
+	}
+	own, err := c.references(abs)
+	if err != nil {
+		return report, err
+	}
+	if err := report.remove(abs); err != nil {
+		return report, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dirs, err := c.ModelDirs()
+	if err != nil {
+		return report, err
+	}
+	others := dirs[:0]
+	for _, d := range dirs {
+		if d != abs {
+			others = append(others, d)
+		}
+	}
+	if err := c.writeModelDirs(others); err != nil {
+		return report, err
+	}
+	used, err := c.references(others...)
+	if err != nil {
+		return report, err
+	}
+	for key := range own.converted {
+		if !used.converted[key] {
+			if err := report.remove(c.ConvertedPath(key)); err != nil {
+				return report, err
+			}
+		}
+	}
+	for hash := range own.blobs {
+		if !used.blobs[hash] {
+			if err := report.remove(c.BlobPath(hash)); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+func isModelDir(dir string) bool {
+	for _, name := range modelFiles {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune removes the cache entries not linked by any model dir, except the
+// converted models last used by the keepLast most recent conversions, which
+// are kept along with their source checkpoint.
+func (c *Cache) Prune(keepLast int) (Report, error) {
+	var report Report
+	dirs, err := c.ModelDirs()
+	if err != nil {
+		return report, err
+	}
+	used, err := c.references(dirs...)
+	if err != nil {
+		return report, err
+	}
+
+	models, err := c.ConvertedModels()
+	if err != nil {
+		return report, err
+	}
+	var unused []ConvertedModel
+	for _, m := range models {
+		if !used.converted[m.Key] {
+			unused = append(unused, m)
+		}
+	}
+	sort.SliceStable(unused, func(i, j int) bool { return unused[i].LastUsed.After(unused[j].LastUsed) })
+	for i, m := range unused {
+		if i < keepLast {
+			// the source checkpoint is kept along with the converted model
+			used.blobs[m.SourceHash()] = true
+			continue
+		}
+		if err := report.remove(c.ConvertedPath(m.Key)); err != nil {
+			return report, err
+		}
+	}
+
+	blobs, err := os.ReadDir(c.blobsDir())
+	if err != nil {
+		return report, err
+	}
+	for _, b := range blobs {
+		if !used.blobs[b.Name()] {
+			if err := report.remove(c.BlobPath(b.Name())); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// SourceHash returns the hash of the checkpoint the model was converted from.
+func (m ConvertedModel) SourceHash() string {
+	hash, _, _ := strings.Cut(m.Key, "-")
+	return hash
+}
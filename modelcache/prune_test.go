@@ -0,0 +1,82 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modelcache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestModelDir creates a model dir whose checkpoint, with the given content,
+// is stored in the cache and converted.
+func newTestModelDir(t *testing.T, c *Cache, content string) (string, string) {
+	dir := filepath.Join(t.TempDir(), "org", "model")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	pt := filepath.Join(dir, "pytorch_model.pt")
+	require.NoError(t, os.WriteFile(pt, []byte(content), 0644))
+	hash, err := c.Put(pt)
+	require.NoError(t, err)
+
+	key := hash + "-float32"
+	ok, err := c.LinkConverted(key, dir, "spago_model.bin")
+	require.NoError(t, err)
+	if !ok {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "spago_model.bin"), []byte("converted "+content), 0644))
+		require.NoError(t, c.PutConverted(ConvertedModel{Key: key}, dir, "spago_model.bin"))
+	}
+	return dir, key
+}
+
+func TestCache_RemoveModelDir(t *testing.T) {
+	c, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	dirA, key := newTestModelDir(t, c, "weights")
+	dirB, _ := newTestModelDir(t, c, "weights")
+
+	_, err = c.RemoveModelDir(t.TempDir())
+	assert.Error(t, err, "not a model dir")
+
+	// the entries are still linked by the other dir
+	report, err := c.RemoveModelDir(dirA)
+	require.NoError(t, err)
+	assert.Equal(t, []string{dirA}, report.Removed)
+	assert.DirExists(t, c.ConvertedPath(key))
+
+	report, err = c.RemoveModelDir(dirB)
+	require.NoError(t, err)
+	assert.Len(t, report.Removed, 3)
+	assert.GreaterOrEqual(t, report.Reclaimed, int64(len("weights")+len("converted weights")))
+	assert.NoDirExists(t, c.ConvertedPath(key))
+	assert.False(t, c.HasBlob(key[:64]))
+}
+
+func TestCache_Prune(t *testing.T) {
+	c, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	used, usedKey := newTestModelDir(t, c, "used")
+	oldDir, oldKey := newTestModelDir(t, c, "old")
+	newDir, newKey := newTestModelDir(t, c, "new")
+	// the model dirs removed by the user leave unused entries in the cache
+	require.NoError(t, os.RemoveAll(oldDir))
+	require.NoError(t, os.RemoveAll(newDir))
+
+	report, err := c.Prune(1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{c.ConvertedPath(oldKey), c.BlobPath(oldKey[:64])}, report.Removed)
+	assert.DirExists(t, c.ConvertedPath(newKey))
+	assert.True(t, c.HasBlob(newKey[:64]))
+
+	report, err = c.Prune(0)
+	require.NoError(t, err)
+	assert.Len(t, report.Removed, 2)
+	assert.DirExists(t, c.ConvertedPath(usedKey))
+	assert.FileExists(t, filepath.Join(used, "spago_model.bin"))
+}
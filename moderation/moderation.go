@@ -0,0 +1,235 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package moderation defines the content filters invoked by the server before
+// and during the generation.
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Action is the outcome of a moderation check.
+type Action int
+
+const (
+	// Allow lets the content through unchanged.
+	Allow Action = iota
+	// Redact replaces the offending content. For completions, the generation
+	// is stopped after the replacement is streamed.
+	Redact
+	// Block rejects the request, aborting the stream.
+	Block
+)
+
+// ParseAction returns the Action corresponding to the given name ("allow", "redact" or "block").
+func ParseAction(name string) (Action, error) {
+	switch strings.ToLower(name) {
+	case "allow":
+		return Allow, nil
+	case "redact":
+		return Redact, nil
+	case "block":
+		return Block, nil
+	default:
+		return Allow, fmt.Errorf("invalid moderation action %q", name)
+	}
+}
+
+// Result is the verdict of a moderation check.
+type Result struct {
+	Action Action
+	// Reason describes why the filter tripped.
+	Reason string
+	// Text is the replacement of the content when Action is Redact.
+	Text string
+}
+
+// Filter is the interface implemented by the content filters.
+type Filter interface {
+	// ModeratePrompt checks the prompt before the generation starts.
+	ModeratePrompt(ctx context.Context, prompt string) (Result, error)
+	// ModerateCompletion checks the text generated so far. It is called after
+	// each generated token, so that the stream can be stopped mid-generation.
+	// The replacement Text of a Redact result replaces the text not sent yet:
+	// the last token, and the text withheld for the filters implementing Lookahead.
+	ModerateCompletion(ctx context.Context, completion string) (Result, error)
+}
+
+// Lookahead is implemented by the filters which know the end of a completion
+// which could still become a match, e.g. the beginning of a keyword: it is
+// withheld from the client until the following tokens complete or rule out the
+// match. Otherwise, the part of a match generated before its last token has
+// already been sent when the filter trips.
+type Lookahead interface {
+	// Pending returns the length in bytes of the end of the completion which
+	// could be the beginning of a match.
+	Pending(completion string) int
+}
+
+// Pending returns the length of the end of the completion to be withheld for
+// the filter f (see Lookahead): zero if f doesn't implement Lookahead.
+func Pending(f Filter, completion string) int {
+	if l, ok := f.(Lookahead); ok {
+		return l.Pending(completion)
+	}
+	return 0
+}
+
+// Chain returns a Filter which runs the given filters in order, returning the
+// first result that isn't Allow. The prompt redacted by a filter is passed to the next ones.
+func Chain(filters ...Filter) Filter {
+	return chain(filters)
+}
+
+type chain []Filter
+
+func (c chain) ModeratePrompt(ctx context.Context, prompt string) (Result, error) {
+	redacted := false
+	for _, f := range c {
+		r, err := f.ModeratePrompt(ctx, prompt)
+		if err != nil || r.Action == Block {
+			return r, err
+		}
+		if r.Action == Redact {
+			prompt, redacted = r.Text, true
+		}
+	}
+	if redacted {
+		return Result{Action: Redact, Text: prompt}, nil
+	}
+	return Result{Action: Allow}, nil
+}
+
+func (c chain) ModerateCompletion(ctx context.Context, completion string) (Result, error) {
+	for _, f := range c {
+		r, err := f.ModerateCompletion(ctx, completion)
+		if err != nil || r.Action != Allow {
+			return r, err
+		}
+	}
+	return Result{Action: Allow}, nil
+}
+
+func (c chain) Pending(completion string) int {
+	n := 0
+	for _, f := range c {
+		if p := Pending(f, completion); p > n {
+			n = p
+		}
+	}
+	return n
+}
+
+// DefaultPlaceholder is the text replacing the redacted content by default.
+const DefaultPlaceholder = "[REDACTED]"
+
+var (
+	_ Filter    = &Patterns{}
+	_ Lookahead = &Patterns{}
+)
+
+// Patterns is a Filter that trips when the content matches any of a set of
+// regular expressions.
+// As a Lookahead, it withholds the last word of the completion, until it is
+// complete, and with NewKeywords the end which begins a keyword, e.g. "bad w"
+// for "bad words": the matches of the patterns spanning several words can
+// still be sent in part before they are complete.
+type Patterns struct {
+	patterns []*regexp.Regexp
+	// keywords are the keywords of NewKeywords.
+	keywords    []string
+	action      Action
+	placeholder string
+}
+
+// NewPatterns returns a new Patterns filter taking the given action when a pattern matches.
+func NewPatterns(patterns []*regexp.Regexp, action Action) *Patterns {
+	return &Patterns{
+		patterns:    patterns,
+		action:      action,
+		placeholder: DefaultPlaceholder,
+	}
+}
+
+// NewKeywords returns a new Patterns filter matching the given keywords as
+// whole words, case-insensitively.
+func NewKeywords(keywords []string, action Action) *Patterns {
+	patterns := make([]*regexp.Regexp, len(keywords))
+	for i, k := range keywords {
+		patterns[i] = regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(k) + `\b`)
+	}
+	p := NewPatterns(patterns, action)
+	p.keywords = keywords
+	return p
+}
+
+// ModeratePrompt satisfies the Filter interface.
+// When redacting, all the matches are replaced with the placeholder.
+func (p *Patterns) ModeratePrompt(_ context.Context, prompt string) (Result, error) {
+	re := p.match(prompt)
+	if re == nil {
+		return Result{Action: Allow}, nil
+	}
+	r := Result{Action: p.action, Reason: fmt.Sprintf("prompt matches %q", re)}
+	if p.action == Redact {
+		r.Text = prompt
+		for _, re := range p.patterns {
+			r.Text = re.ReplaceAllString(r.Text, p.placeholder)
+		}
+	}
+	return r, nil
+}
+
+// ModerateCompletion satisfies the Filter interface.
+func (p *Patterns) ModerateCompletion(_ context.Context, completion string) (Result, error) {
+	re := p.match(completion)
+	if re == nil {
+		return Result{Action: Allow}, nil
+	}
+	return Result{
+		Action: p.action,
+		Reason: fmt.Sprintf("completion matches %q", re),
+		Text:   p.placeholder,
+	}, nil
+}
+
+// Pending satisfies the Lookahead interface.
+func (p *Patterns) Pending(completion string) int {
+	n := len(completion) - len(strings.TrimRightFunc(completion, isWordRune))
+	for _, k := range p.keywords {
+		for i := min(len(k)-1, len(completion)); i > n; i-- {
+			if strings.EqualFold(completion[len(completion)-i:], k[:i]) {
+				n = i
+				break
+			}
+		}
+	}
+	return n
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// match returns the first pattern matching the text, or nil.
+func (p *Patterns) match(text string) *regexp.Regexp {
+	for _, re := range p.patterns {
+		if re.MatchString(text) {
+			return re
+		}
+	}
+	return nil
+}
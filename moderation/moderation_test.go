@@ -0,0 +1,63 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moderation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeywords(t *testing.T) {
+	ctx := context.Background()
+	f := NewKeywords([]string{"secret"}, Redact)
+
+	r, err := f.ModeratePrompt(ctx, "tell me the Secret code, secretly")
+	require.NoError(t, err)
+	assert.Equal(t, Redact, r.Action)
+	assert.Equal(t, "tell me the [REDACTED] code, secretly", r.Text)
+
+	r, err = f.ModerateCompletion(ctx, "no secrets here")
+	require.NoError(t, err)
+	assert.Equal(t, Allow, r.Action)
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	f := Chain(NewKeywords([]string{"foo"}, Redact), NewKeywords([]string{"bar"}, Block))
+
+	r, err := f.ModeratePrompt(ctx, "foo baz")
+	require.NoError(t, err)
+	assert.Equal(t, Redact, r.Action)
+	assert.Equal(t, "[REDACTED] baz", r.Text)
+
+	r, err = f.ModerateCompletion(ctx, "foo bar")
+	require.NoError(t, err)
+	assert.Equal(t, Redact, r.Action)
+
+	r, err = f.ModerateCompletion(ctx, "bar")
+	require.NoError(t, err)
+	assert.Equal(t, Block, r.Action)
+}
+
+func TestPatterns_Pending(t *testing.T) {
+	f := Chain(NewKeywords([]string{"bad words"}, Block), NewPatterns(nil, Block))
+	for _, tc := range []struct {
+		completion string
+		pending    int
+	}{
+		{"", 0},
+		{"hello ", 0},
+		{"hello wor", 3},
+		{"hello bad", 3},
+		{"hello bad ", 4},
+		{"hello BAD w", 5},
+		{"hello bad x", 1},
+	} {
+		assert.Equal(t, tc.pending, Pending(f, tc.completion), tc.completion)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package plugins lets third parties ship sampler stages, samplers and stream
+// filters as separate executables, discovered from a plugins directory.
+//
+// Each plugin runs as a subprocess for the lifetime of the server. Once registered,
+// its extensions are used by name, like the built-in ones: in
+// decoder.DecodingOptions.Pipeline (stages), decoder.DecodingOptions.Sampler
+// (samplers) and textproc.FactoryByName (filters). Plugins can be written in Go
+// with Serve, or in any language implementing the line-delimited JSON protocol.
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/rs/zerolog/log"
+)
+
+// Plugin is a running plugin process.
+// The calls are serialized: a plugin handles a single request at a time.
+type Plugin struct {
+	Path        string
+	Description Description
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	nextID uint64
+	err    error // set when the process is no longer usable
+}
+
+// maxMessageSize is the maximum size of a message from a plugin.
+const maxMessageSize = 64 << 20
+
+// Start runs the plugin executable and asks for its description.
+func Start(path string) (*Plugin, error) {
+	cmd := exec.Command(path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugins: failed to start %s: %w", path, err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	p := &Plugin{Path: path, cmd: cmd, stdin: stdin, stdout: scanner}
+	if err := p.call(methodDescribe, nil, &p.Description); err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	if p.Description.Name == "" {
+		p.Description.Name = filepath.Base(path)
+	}
+	return p, nil
+}
+
+// Load starts all the executables in dir.
+func Load(dir string) ([]*Plugin, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var plugins []*Plugin
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		p, err := Start(filepath.Join(dir, e.Name()))
+		if err != nil {
+			Close(plugins)
+			return nil, err
+		}
+		log.Debug().Str("plugin", p.Description.Name).Msg("Plugin loaded")
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// Close stops all the given plugins.
+func Close(plugins []*Plugin) {
+	for _, p := range plugins {
+		if err := p.Close(); err != nil {
+			log.Warn().Err(err).Str("plugin", p.Description.Name).Msg("failed to stop the plugin")
+		}
+	}
+}
+
+// Close stops the plugin process.
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = errors.New("plugins: plugin closed")
+	}
+	// closing the input makes the plugin exit
+	_ = p.stdin.Close()
+	err := p.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil
+	}
+	return err
+}
+
+// call sends a request to the plugin and decodes the result in out.
+func (p *Plugin) call(method string, params, out any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	err := p.roundTrip(method, params, out)
+	var remote remoteError
+	if err != nil && !errors.As(err, &remote) {
+		// the stream is out of sync, or the process died
+		p.err = err
+	}
+	return err
+}
+
+type remoteError string
+
+func (e remoteError) Error() string { return string(e) }
+
+func (p *Plugin) roundTrip(method string, params, out any) error {
+	p.nextID++
+	req := request{ID: p.nextID, Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = b
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := p.stdin.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("plugins: %s: %w", p.Path, err)
+	}
+	if !p.stdout.Scan() {
+		if err := p.stdout.Err(); err != nil {
+			return fmt.Errorf("plugins: %s: %w", p.Path, err)
+		}
+		return fmt.Errorf("plugins: %s: the plugin exited", p.Path)
+	}
+	var resp response
+	if err := json.Unmarshal(p.stdout.Bytes(), &resp); err != nil {
+		return fmt.Errorf("plugins: %s: invalid response: %w", p.Path, err)
+	}
+	if resp.ID != req.ID {
+		return fmt.Errorf("plugins: %s: unexpected response ID %d, expected %d", p.Path, resp.ID, req.ID)
+	}
+	if resp.Error != "" {
+		return remoteError(fmt.Sprintf("plugin %s: %s", p.Description.Name, resp.Error))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, out)
+}
+
+// Register makes the extensions of the plugin available by name. It fails if a name
+// is already in use, without registering any extension.
+func (p *Plugin) Register() error {
+	for _, name := range p.Description.Stages {
+		if contains(decoder.StageNames(), name) {
+			return fmt.Errorf("plugins: %s: stage %q already registered", p.Description.Name, name)
+		}
+	}
+	for _, name := range p.Description.Samplers {
+		if contains(decoder.SamplerNames(), name) {
+			return fmt.Errorf("plugins: %s: sampler %q already registered", p.Description.Name, name)
+		}
+	}
+	for _, name := range p.Description.Filters {
+		if _, err := textproc.FactoryByName(name); err == nil {
+			return fmt.Errorf("plugins: %s: filter %q already registered", p.Description.Name, name)
+		}
+	}
+	for _, name := range p.Description.Stages {
+		decoder.RegisterStage(name, p.stageFactory(name))
+	}
+	for _, name := range p.Description.Samplers {
+		decoder.RegisterSampler(name, p.samplerFactory(name))
+	}
+	for _, name := range p.Description.Filters {
+		name := name
+		textproc.Register(name, func() textproc.Processor { return p.newFilter(name) })
+	}
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plugin) stageFactory(name string) decoder.StageFactory {
+	return func(opts decoder.DecodingOptions) (decoder.Stage, error) {
+		params := opts.Params[name]
+		return decoder.StageFunc(func(info decoder.StepInfo, logits mat.Matrix) (mat.Matrix, error) {
+			var res stageResult
+			err := p.call(methodStage, stageParams{
+				Name:     name,
+				Params:   params,
+				Step:     info.Step,
+				Prompt:   info.Prompt,
+				Sequence: info.Sequence,
+				Logits:   logits.Data().F32(),
+			}, &res)
+			if err != nil {
+				return nil, err
+			}
+			if len(res.Logits) != logits.Size() {
+				return nil, fmt.Errorf("plugin stage %q returned %d logits, expected %d", name, len(res.Logits), logits.Size())
+			}
+			return logits.NewVec(float.SliceInterface([]float32(res.Logits))), nil
+		}), nil
+	}
+}
+
+func (p *Plugin) samplerFactory(name string) decoder.SamplerFactory {
+	return func(opts decoder.DecodingOptions) (decoder.OutputSelectionFunc, error) {
+		params := opts.Params[name]
+		return func(logits mat.Matrix) (int, float64, error) {
+			var res sampleResult
+			err := p.call(methodSample, sampleParams{Name: name, Params: params, Logits: logits.Data().F32()}, &res)
+			if err != nil {
+				return 0, 0, err
+			}
+			if res.TokenID < 0 || res.TokenID >= logits.Size() {
+				return 0, 0, fmt.Errorf("plugin sampler %q returned the invalid token ID %d", name, res.TokenID)
+			}
+			return res.TokenID, res.Prob, nil
+		}, nil
+	}
+}
+
+// filter is a stream filter running in the plugin.
+// Since textproc.Processor cannot fail, the errors are logged and the text
+// passes through unfiltered.
+type filter struct {
+	p      *Plugin
+	name   string
+	stream uint64
+	err    error
+}
+
+func (p *Plugin) newFilter(name string) textproc.Processor {
+	f := &filter{p: p, name: name}
+	var res filterResult
+	if f.err = p.call(methodFilterOpen, filterParams{Name: name}, &res); f.err != nil {
+		log.Err(f.err).Str("filter", name).Msg("failed to open the plugin filter")
+	}
+	f.stream = res.Stream
+	return f
+}
+
+func (f *filter) Process(chunk string) string {
+	if f.err != nil {
+		return chunk
+	}
+	var res filterResult
+	if f.err = f.p.call(methodFilterProcess, filterParams{Stream: f.stream, Chunk: chunk}, &res); f.err != nil {
+		log.Err(f.err).Str("filter", f.name).Msg("plugin filter failed")
+		return chunk
+	}
+	return res.Text
+}
+
+func (f *filter) Flush() string {
+	if f.err != nil {
+		return ""
+	}
+	var res filterResult
+	if f.err = f.p.call(methodFilterFlush, filterParams{Stream: f.stream}, &res); f.err != nil {
+		log.Err(f.err).Str("filter", f.name).Msg("plugin filter failed")
+		return ""
+	}
+	return res.Text
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain runs the test binary as a plugin when started by the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("VERBAFLOW_TEST_PLUGIN") == "1" {
+		if err := Serve(testHandler); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+var testHandler = Handler{
+	Name: "test",
+	Stages: map[string]StageFunc{
+		"test_ban_first": func(params json.RawMessage, step int, _, _ []int, logits []float32) ([]float32, error) {
+			if string(params) == `"fail"` {
+				return nil, errors.New("failure requested")
+			}
+			logits[0] = float32(math.Inf(-1))
+			return logits, nil
+		},
+	},
+	Samplers: map[string]SamplerFunc{
+		"test_last": func(_ json.RawMessage, logits []float32) (int, float64, error) {
+			return len(logits) - 1, 1, nil
+		},
+	},
+	Filters: map[string]textproc.Factory{
+		"test_upper": func() textproc.Processor { return &upper{} },
+	},
+}
+
+// upper upper-cases the text, withholding it until the end of the stream.
+type upper struct {
+	strings.Builder
+}
+
+func (u *upper) Process(chunk string) string {
+	u.WriteString(chunk)
+	return ""
+}
+
+func (u *upper) Flush() string {
+	return strings.ToUpper(u.String())
+}
+
+func TestPlugin(t *testing.T) {
+	t.Setenv("VERBAFLOW_TEST_PLUGIN", "1")
+	p, err := Start(os.Args[0])
+	require.NoError(t, err)
+	defer p.Close()
+
+	assert.Equal(t, "test", p.Description.Name)
+	assert.Equal(t, []string{"test_ban_first"}, p.Description.Stages)
+	require.NoError(t, p.Register())
+	assert.Error(t, p.Register(), "names already registered")
+
+	pipeline, err := decoder.NewPipeline(decoder.DecodingOptions{Pipeline: []string{"test_ban_first"}})
+	require.NoError(t, err)
+	logits, err := pipeline.Apply(decoder.StepInfo{}, mat.NewVecDense([]float32{1, 2, 3}))
+	require.NoError(t, err)
+	assert.Equal(t, []float32{float32(math.Inf(-1)), 2, 3}, logits.Data().F32())
+
+	// an error of the plugin does not stop it
+	pipeline, err = decoder.NewPipeline(decoder.DecodingOptions{
+		Pipeline: []string{"test_ban_first"},
+		Params:   map[string]json.RawMessage{"test_ban_first": json.RawMessage(`"fail"`)},
+	})
+	require.NoError(t, err)
+	_, err = pipeline.Apply(decoder.StepInfo{}, mat.NewVecDense([]float32{1, 2, 3}))
+	assert.EqualError(t, err, "plugin test: failure requested")
+
+	selection, err := p.samplerFactory("test_last")(decoder.DecodingOptions{})
+	require.NoError(t, err)
+	id, _, err := selection(mat.NewVecDense([]float32{1, 2, 3}))
+	require.NoError(t, err)
+	assert.Equal(t, 2, id)
+	assert.Contains(t, decoder.SamplerNames(), "test_last")
+
+	factory, err := textproc.FactoryByName("test_upper")
+	require.NoError(t, err)
+	proc := factory()
+	assert.Equal(t, "", proc.Process("hello "))
+	assert.Equal(t, "", proc.Process("world"))
+	assert.Equal(t, "HELLO WORLD", proc.Flush())
+}
+
+func TestLogits_JSON(t *testing.T) {
+	in := Logits{1.5, float32(math.Inf(-1)), 0}
+	b, err := json.Marshal(in)
+	require.NoError(t, err)
+	var out Logits
+	require.NoError(t, json.Unmarshal(b, &out))
+	assert.Equal(t, in, out)
+}
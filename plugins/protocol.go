@@ -0,0 +1,119 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugins
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// The plugins communicate with VerbaFlow over their standard input and output,
+// exchanging one JSON message per line: VerbaFlow sends a request, and waits for
+// the response before sending the next one.
+
+// Methods of the protocol.
+const (
+	methodDescribe      = "describe"
+	methodStage         = "stage"
+	methodSample        = "sample"
+	methodFilterOpen    = "filter.open"
+	methodFilterProcess = "filter.process"
+	methodFilterFlush   = "filter.flush"
+)
+
+type request struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Description lists the extensions provided by a plugin.
+type Description struct {
+	// Name is the name of the plugin.
+	Name string `json:"name"`
+	// Stages are the names of the sampler stages (see decoder.RegisterStage).
+	Stages []string `json:"stages,omitempty"`
+	// Samplers are the names of the selections of the next token (see decoder.RegisterSampler).
+	Samplers []string `json:"samplers,omitempty"`
+	// Filters are the names of the stream filters (see textproc.Register).
+	Filters []string `json:"filters,omitempty"`
+}
+
+type stageParams struct {
+	Name     string          `json:"name"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Step     int             `json:"step"`
+	Prompt   []int           `json:"prompt"`
+	Sequence []int           `json:"sequence"`
+	Logits   Logits          `json:"logits"`
+}
+
+type stageResult struct {
+	Logits Logits `json:"logits"`
+}
+
+type sampleParams struct {
+	Name   string          `json:"name"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Logits Logits          `json:"logits"`
+}
+
+type sampleResult struct {
+	TokenID int     `json:"token_id"`
+	Prob    float64 `json:"prob"`
+}
+
+type filterParams struct {
+	Name   string `json:"name,omitempty"`
+	Stream uint64 `json:"stream,omitempty"`
+	Chunk  string `json:"chunk,omitempty"`
+}
+
+type filterResult struct {
+	Stream uint64 `json:"stream,omitempty"`
+	Text   string `json:"text,omitempty"`
+}
+
+// Logits are encoded in JSON as the base64 of the little-endian float32 values,
+// which preserves the -Inf of the banned tokens.
+type Logits []float32
+
+// MarshalJSON satisfies the json.Marshaler interface.
+func (l Logits) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 4*len(l))
+	for i, v := range l {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return json.Marshal(b)
+}
+
+// UnmarshalJSON satisfies the json.Unmarshaler interface.
+func (l *Logits) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b)%4 != 0 {
+		return errors.New("plugins: invalid logits encoding")
+	}
+	*l = make(Logits, len(b)/4)
+	for i := range *l {
+		(*l)[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return nil
+}
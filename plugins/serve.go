@@ -0,0 +1,126 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nlpodyssey/verbaflow/textproc"
+)
+
+// StageFunc transforms the logits of the next token, as a sampler stage.
+// params are the parameters of the stage in decoder.DecodingOptions.Params, if any.
+type StageFunc func(params json.RawMessage, step int, prompt, sequence []int, logits []float32) ([]float32, error)
+
+// SamplerFunc selects the next token, returning its ID and its probability.
+type SamplerFunc func(params json.RawMessage, logits []float32) (int, float64, error)
+
+// Handler contains the extensions provided by a plugin written in Go.
+type Handler struct {
+	// Name is the name of the plugin.
+	Name     string
+	Stages   map[string]StageFunc
+	Samplers map[string]SamplerFunc
+	Filters  map[string]textproc.Factory
+}
+
+// Serve runs the plugin protocol over the standard input and output, until the
+// input is closed. It is meant to be called by the main function of a plugin.
+func Serve(h Handler) error {
+	return serve(h, os.Stdin, os.Stdout)
+}
+
+func serve(h Handler, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	enc := json.NewEncoder(w)
+	streams := make(map[uint64]textproc.Processor)
+	var nextStream uint64
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return err
+		}
+		result, err := h.handle(req, streams, &nextStream)
+		resp := response{ID: req.ID}
+		if err != nil {
+			resp.Error = err.Error()
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			return err
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (h Handler) handle(req request, streams map[uint64]textproc.Processor, nextStream *uint64) (any, error) {
+	switch req.Method {
+	case methodDescribe:
+		d := Description{Name: h.Name}
+		for name := range h.Stages {
+			d.Stages = append(d.Stages, name)
+		}
+		for name := range h.Samplers {
+			d.Samplers = append(d.Samplers, name)
+		}
+		for name := range h.Filters {
+			d.Filters = append(d.Filters, name)
+		}
+		return d, nil
+	case methodStage:
+		var p stageParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		fn, ok := h.Stages[p.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", p.Name)
+		}
+		logits, err := fn(p.Params, p.Step, p.Prompt, p.Sequence, p.Logits)
+		return stageResult{Logits: logits}, err
+	case methodSample:
+		var p sampleParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		fn, ok := h.Samplers[p.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sampler %q", p.Name)
+		}
+		id, prob, err := fn(p.Params, p.Logits)
+		return sampleResult{TokenID: id, Prob: prob}, err
+	case methodFilterOpen, methodFilterProcess, methodFilterFlush:
+		var p filterParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		if req.Method == methodFilterOpen {
+			factory, ok := h.Filters[p.Name]
+			if !ok {
+				return nil, fmt.Errorf("unknown filter %q", p.Name)
+			}
+			*nextStream++
+			streams[*nextStream] = factory()
+			return filterResult{Stream: *nextStream}, nil
+		}
+		proc, ok := streams[p.Stream]
+		if !ok {
+			return nil, fmt.Errorf("unknown stream %d", p.Stream)
+		}
+		if req.Method == methodFilterProcess {
+			return filterResult{Text: proc.Process(p.Chunk)}, nil
+		}
+		delete(streams, p.Stream)
+		return filterResult{Text: proc.Flush()}, nil
+	default:
+		return nil, fmt.Errorf("unknown method %q", req.Method)
+	}
+}
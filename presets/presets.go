@@ -0,0 +1,226 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package presets defines the named behaviors of the assistant shared by a team:
+// a system prompt, decoding options and, optionally, the state of the model
+// after the system prompt, precomputed to skip its encoding.
+package presets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Preset is a named behavior of the assistant.
+type Preset struct {
+	// Name identifies the preset: it is the key of the preset in the file.
+	Name string `json:"-"`
+	// System is the system prompt preceding the prompt of the requests (see Prefix).
+	System string `json:"system,omitempty"`
+	// Options are the decoding options of the requests, for the ones they leave to
+	// zero, and their stop strings.
+	Options *verbaflow.GenerationConfig `json:"options,omitempty"`
+	// UseSampling makes the requests sample the next token, with the temperature
+	// of the Options.
+	UseSampling bool `json:"use_sampling,omitempty"`
+	// StateFile, when not empty, is the file with the state of the model after the
+	// Prefix (see EncodeState); Load resolves it against the directory of the
+	// presets file.
+	StateFile string `json:"state_file,omitempty"`
+	// State is the state read from the StateFile by Presets.LoadStates: the
+	// requests continue from it, instead of encoding the Prefix.
+	State *verbaflow.Continuation `json:"-"`
+}
+
+// Prefix returns the text preceding the prompt of the requests: the system
+// prompt followed by a blank line, or nothing.
+func (p *Preset) Prefix() string {
+	if p.System == "" {
+		return ""
+	}
+	return p.System + "\n\n"
+}
+
+// Defaults returns the options with the ones of the preset for the fields left
+// to zero (see verbaflow.GenerationConfig.Defaults), stopping at its stop strings.
+func (p *Preset) Defaults(opts decoder.DecodingOptions) decoder.DecodingOptions {
+	if p.UseSampling {
+		opts.UseSampling = true
+	}
+	opts = p.Options.Defaults(opts)
+	if p.Options != nil {
+		for _, s := range p.Options.StopStrings {
+			opts.StopRegexps = append(opts.StopRegexps, regexp.QuoteMeta(s))
+		}
+	}
+	return opts
+}
+
+// GenerationConfig returns the decoding options recommended for the model, with
+// the ones of the preset taking precedence.
+func (p *Preset) GenerationConfig(model *verbaflow.GenerationConfig) *verbaflow.GenerationConfig {
+	if p.Options == nil {
+		return model
+	}
+	if model == nil {
+		return p.Options
+	}
+	conf := *model
+	if p.Options.Temperature != nil {
+		conf.Temperature = p.Options.Temperature
+	}
+	if p.Options.TopK != nil {
+		conf.TopK = p.Options.TopK
+	}
+	if p.Options.TopP != nil {
+		conf.TopP = p.Options.TopP
+	}
+	if p.Options.RepetitionPenalty != nil {
+		conf.RepetitionPenalty = p.Options.RepetitionPenalty
+	}
+	if p.Options.MaxNewTokens != nil {
+		conf.MaxNewTokens = p.Options.MaxNewTokens
+	}
+	conf.EOSTokenID = append(append(verbaflow.TokenIDs(nil), model.EOSTokenID...), p.Options.EOSTokenID...)
+	conf.StopStrings = append(append([]string(nil), model.StopStrings...), p.Options.StopStrings...)
+	return &conf
+}
+
+// EncodeState encodes the Prefix with the model, writing its state to the
+// StateFile.
+func (p *Preset) EncodeState(ctx context.Context, vf *verbaflow.VerbaFlow) (err error) {
+	if p.StateFile == "" {
+		return fmt.Errorf("presets: the preset %q has no state file", p.Name)
+	}
+	if p.System == "" {
+		return fmt.Errorf("presets: the preset %q has no system prompt to encode", p.Name)
+	}
+	c, err := vf.EncodeContinuation(ctx, p.Prefix())
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(p.StateFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	return vf.WriteContinuation(f, c)
+}
+
+// Presets are the presets by name.
+type Presets map[string]*Preset
+
+// Load reads the presets from a JSON file, an object with the presets by name.
+// Their states are read by LoadStates, once the model is loaded.
+func Load(path string) (Presets, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ps, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s)", err, path)
+	}
+	for _, p := range ps {
+		if p.StateFile != "" && !filepath.IsAbs(p.StateFile) {
+			p.StateFile = filepath.Join(filepath.Dir(path), p.StateFile)
+		}
+	}
+	return ps, nil
+}
+
+// Read reads the presets in JSON from r (see Load).
+func Read(r io.Reader) (Presets, error) {
+	var ps Presets
+	if err := json.NewDecoder(r).Decode(&ps); err != nil {
+		return nil, fmt.Errorf("presets: invalid presets: %w", err)
+	}
+	for name, p := range ps {
+		if name == "" || p == nil {
+			return nil, fmt.Errorf("presets: invalid preset %q", name)
+		}
+		p.Name = name
+	}
+	return ps, nil
+}
+
+// LoadStates reads the state files of the presets, checking that they match the
+// system prompts: a system prompt changed since its state was encoded must be
+// encoded again (see Preset.EncodeState).
+func (ps Presets) LoadStates(vf *verbaflow.VerbaFlow) error {
+	for _, name := range ps.Names() {
+		p := ps[name]
+		if p.StateFile == "" {
+			continue
+		}
+		c, err := readState(vf, p.StateFile)
+		if err != nil {
+			return fmt.Errorf("presets: failed to read the state of the preset %q: %w", name, err)
+		}
+		tokens, err := vf.Tokenizer.Tokenize(p.Prefix())
+		if err != nil {
+			return err
+		}
+		if !equalTokens(c.Tokens(), tokens) {
+			return fmt.Errorf("presets: the state of the preset %q doesn't match its system prompt, encode it again", name)
+		}
+		p.State = c
+	}
+	return nil
+}
+
+func readState(vf *verbaflow.VerbaFlow, path string) (*verbaflow.Continuation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vf.ReadContinuation(f)
+}
+
+// Lookup returns the preset with the given name.
+func (ps Presets) Lookup(name string) (*Preset, error) {
+	p, ok := ps[name]
+	if !ok {
+		return nil, fmt.Errorf("presets: unknown preset %q (available: %s)", name, strings.Join(ps.Names(), ", "))
+	}
+	return p, nil
+}
+
+// Names returns the sorted names of the presets.
+func (ps Presets) Names() []string {
+	names := make([]string, 0, len(ps))
+	for name := range ps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equalTokens(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
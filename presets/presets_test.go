@@ -0,0 +1,97 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package presets
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPresets = `{
+	"support": {
+		"system": "You are a support agent.",
+		"options": {"temperature": 0.3, "max_new_tokens": 64, "stop_strings": ["\nUser:"]},
+		"use_sampling": true,
+		"state_file": "support.state"
+	},
+	"plain": {}
+}`
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "presets.json")
+	require.NoError(t, os.WriteFile(path, []byte(testPresets), 0o644))
+	ps, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plain", "support"}, ps.Names())
+
+	p, err := ps.Lookup("support")
+	require.NoError(t, err)
+	assert.Equal(t, "support", p.Name)
+	assert.Equal(t, "You are a support agent.\n\n", p.Prefix())
+	assert.Equal(t, filepath.Join(dir, "support.state"), p.StateFile, "the state file is relative to the presets")
+	assert.Empty(t, ps["plain"].Prefix())
+
+	_, err = ps.Lookup("unknown")
+	assert.ErrorContains(t, err, "plain, support")
+	_, err = Read(strings.NewReader(`{"x": null}`))
+	assert.Error(t, err)
+}
+
+func TestPreset_Defaults(t *testing.T) {
+	ps, err := Read(strings.NewReader(testPresets))
+	require.NoError(t, err)
+	p := ps["support"]
+
+	opts := p.Defaults(decoder.DecodingOptions{MaxLen: 10, StopRegexps: []string{"x"}})
+	assert.True(t, opts.UseSampling)
+	assert.Equal(t, 0.3, opts.Temp)
+	assert.Equal(t, 10, opts.MaxLen, "the options of the request are kept")
+	assert.Equal(t, []string{"x", "\nUser:"}, opts.StopRegexps)
+
+	assert.Equal(t, decoder.DecodingOptions{MaxLen: 10}, ps["plain"].Defaults(decoder.DecodingOptions{MaxLen: 10}))
+
+	// the options of the preset take precedence over the ones of the model
+	topK, maxNewTokens := 40, 128
+	model := &verbaflow.GenerationConfig{TopK: &topK, MaxNewTokens: &maxNewTokens, StopStrings: []string{"</s>"}}
+	conf := p.GenerationConfig(model)
+	assert.Equal(t, 40, *conf.TopK)
+	assert.Equal(t, 64, *conf.MaxNewTokens)
+	assert.Equal(t, 0.3, *conf.Temperature)
+	assert.Equal(t, []string{"</s>", "\nUser:"}, conf.StopStrings)
+	assert.Same(t, model, ps["plain"].GenerationConfig(model))
+}
+
+func TestPresets_LoadStates(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "presets.json")
+	require.NoError(t, os.WriteFile(path, []byte(testPresets), 0o644))
+	ps, err := Load(path)
+	require.NoError(t, err)
+
+	assert.Error(t, ps.LoadStates(vf), "the state file is missing")
+	require.NoError(t, ps["support"].EncodeState(context.Background(), vf))
+	assert.Error(t, ps["plain"].EncodeState(context.Background(), vf))
+	require.NoError(t, ps.LoadStates(vf))
+	tokens, err := vf.Tokenizer.Tokenize(ps["support"].Prefix())
+	require.NoError(t, err)
+	assert.Equal(t, tokens, ps["support"].State.Tokens())
+	assert.Nil(t, ps["plain"].State)
+
+	// the state of a changed system prompt must be encoded again
+	ps["support"].System = "You are a sales agent."
+	assert.ErrorContains(t, ps.LoadStates(vf), "encode it again")
+}
@@ -6,8 +6,15 @@ package verbaflow
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"regexp"
+	"strings"
 	"text/template"
+	"text/template/parse"
+
+	"github.com/nlpodyssey/verbaflow/fewshot"
+	"github.com/nlpodyssey/verbaflow/prompts"
 )
 
 // InputPrompt is the input for the prompt generation.
@@ -15,6 +22,8 @@ type InputPrompt struct {
 	Text           string `json:"text"`
 	Question       string `json:"question,omitempty"`
 	TargetLanguage string `json:"target_language,omitempty"`
+	// Examples are the few-shot examples of the prompt, set by BuildPromptWithExamples.
+	Examples []fewshot.Example `json:"examples,omitempty"`
 }
 
 // BuildPromptFromTemplateFile builds a prompt applying the given input to the template file.
@@ -35,3 +44,92 @@ func BuildPromptFromTemplate(input InputPrompt, pt *template.Template) (string,
 	}
 	return result.String(), nil
 }
+
+// BuildPromptWithExamples builds a prompt applying the given input to the template,
+// after selecting the examples of the store most similar to the question, or to
+// the text if there is no question, with the selection of the template. The
+// template renders them, available as .Examples by decreasing similarity.
+func BuildPromptWithExamples(ctx context.Context, input InputPrompt, pt *template.Template, store *fewshot.Store, sel fewshot.Selection) (string, error) {
+	query := input.Question
+	if query == "" {
+		query = input.Text
+	}
+	selected, err := store.Select(ctx, query, sel)
+	if err != nil {
+		return "", err
+	}
+	input.Examples = make([]fewshot.Example, len(selected))
+	for i, s := range selected {
+		input.Examples[i] = s.Example
+	}
+	return BuildPromptFromTemplate(input, pt)
+}
+
+// FitPrompt assembles the parts into a prompt of at most budget tokens of the
+// model, truncating them as needed (see prompts.Fit). If budget is not positive,
+// the limit set with SetMaxPromptTokens is used.
+func (vf *VerbaFlow) FitPrompt(parts []prompts.Part, budget int) (string, error) {
+	if budget <= 0 {
+		budget = vf.maxPromptTokens
+	}
+	if budget <= 0 {
+		return "", fmt.Errorf("verbaflow: no token budget to fit the prompt in")
+	}
+	return prompts.Fit(vf.Tokenizer, parts, budget)
+}
+
+// roleMarker matches the role markers of a template: the labels, starting with
+// an uppercase letter, which begin a line and end with a colon, like "Question:"
+// or "Q & A:", followed by a space, by an action or by the end of the line.
+var roleMarker = regexp.MustCompile(`(?m)^(\p{Lu}[\p{L}\p{N} &'-]{0,40}):(?:[ \t]|\x00|$)`)
+
+// TemplateStops returns the role markers of the prompt template, like
+// "\nQuestion:" or "\nUser:", in order of appearance: used as stop sequences,
+// e.g. with decoder.DecodingOptions.StopRegexps, they end the generation before
+// the model starts writing the next turn of the prompt by itself.
+func TemplateStops(pt *template.Template) []string {
+	if pt == nil || pt.Tree == nil {
+		return nil
+	}
+	var text strings.Builder
+	templateText(&text, pt.Tree.Root)
+	var stops []string
+	seen := make(map[string]bool)
+	for _, m := range roleMarker.FindAllStringSubmatch(text.String(), -1) {
+		stop := "\n" + m[1] + ":"
+		if !seen[stop] {
+			seen[stop] = true
+			stops = append(stops, stop)
+		}
+	}
+	return stops
+}
+
+// templateText writes the text of the template nodes, with a NUL byte in place
+// of each action, so that the text following an action does not begin a line.
+// The delimiters of the if, range and with actions are left out instead, their
+// branches being usually whole lines.
+func templateText(sb *strings.Builder, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateText(sb, child)
+		}
+	case *parse.TextNode:
+		sb.Write(n.Text)
+	case *parse.IfNode:
+		templateText(sb, n.List)
+		templateText(sb, n.ElseList)
+	case *parse.RangeNode:
+		templateText(sb, n.List)
+		templateText(sb, n.ElseList)
+	case *parse.WithNode:
+		templateText(sb, n.List)
+		templateText(sb, n.ElseList)
+	default:
+		sb.WriteByte(0)
+	}
+}
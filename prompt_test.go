@@ -0,0 +1,43 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateStops(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     []string
+	}{
+		{"no markers", "{{.Text}}", nil},
+		{
+			"question answering",
+			"Answer the question using the given context.\nQuestion: {{.Question}}\nContext: {{.Text}}\nPrecise answer:",
+			[]string{"\nQuestion:", "\nContext:", "\nPrecise answer:"},
+		},
+		{
+			"few-shot examples",
+			"{{range .Examples}}Q & A: {{.Question}}\nA: {{.Answer}}\n\n{{end}}Q & A: {{.Question}}\nA:",
+			[]string{"\nQ & A:", "\nA:"},
+		},
+		{
+			"no markers after actions nor in URLs",
+			"{{.Text}} Note: ignored\nhttps://example.com\nUser: {{.Text}}",
+			[]string{"\nUser:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := template.Must(template.New("").Parse(tt.template))
+			assert.Equal(t, tt.want, TemplateStops(pt))
+		})
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prompts
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The roles of the messages of a conversation.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	// RoleInput is the input of the instruction of the previous user message, e.g.
+	// the text to summarize, in a section of its own in the formats which have one,
+	// like Alpaca, and appended to the user message in the other ones.
+	RoleInput = "input"
+)
+
+// Message is a message of a conversation.
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Turn is how the messages of a role are rendered: their content between the
+// prefix and the suffix.
+type Turn struct {
+	Prefix, Suffix string
+}
+
+// Format is a prompt format of the instruction-tuned models, rendering the
+// messages of a conversation into a prompt ending with the turn of the assistant.
+type Format struct {
+	// Name identifies the format (see LookupFormat).
+	Name string
+	// System, User and Assistant are the turns of the roles.
+	System, User, Assistant Turn
+	// Input is the turn of the RoleInput messages; when zero, they are appended
+	// to the previous user message, on a line of their own.
+	Input Turn
+	// DefaultSystem is the system message of the conversations without one.
+	DefaultSystem string
+	// ReplySpace separates the content of the assistant messages from the prefix,
+	// which does not end with a space: the byte-level BPE tokenizers encode the
+	// space with the first word of the reply, which the model generates.
+	ReplySpace bool
+	// Clean normalizes the content of the messages, e.g. removing the blank lines
+	// which separate the turns. When nil, the surrounding spaces are removed.
+	Clean func(content string) string
+	// Stops are the stop sequences ending the reply of the assistant before the
+	// model writes the next turn by itself.
+	Stops []string
+}
+
+// Parts returns the parts of the prompt of the messages, which Fit can truncate:
+// the system message and the last message are kept, while the other ones are
+// truncated from the oldest. The last part is the beginning of the turn of the
+// assistant, unless the last message is from the assistant, whose reply is then
+// continued.
+func (f *Format) Parts(messages []Message) ([]Part, error) {
+	messages, err := f.merged(messages)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Part
+	if f.DefaultSystem != "" && (len(messages) == 0 || messages[0].Role != RoleSystem) {
+		parts = append(parts, f.part(-1, Message{Role: RoleSystem, Content: f.DefaultSystem}))
+	}
+	for i, m := range messages {
+		parts = append(parts, f.part(i, m))
+	}
+	if n := len(messages); n > 0 && messages[n-1].Role == RoleAssistant {
+		// the reply is continued
+		parts[len(parts)-1].Suffix = ""
+		parts[len(parts)-1].Truncate = TruncateNone
+		return parts, nil
+	}
+	if len(parts) > 0 {
+		parts[len(parts)-1].Truncate = TruncateNone
+	}
+	return append(parts, Part{Name: "reply", Prefix: f.Assistant.Prefix}), nil
+}
+
+// Render returns the prompt of the messages (see Parts).
+func (f *Format) Render(messages []Message) (string, error) {
+	parts, err := f.Parts(messages)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, p := range parts {
+		sb.WriteString(p.Prefix)
+		sb.WriteString(p.Text)
+		sb.WriteString(p.Suffix)
+	}
+	return sb.String(), nil
+}
+
+// merged returns the messages with the inputs appended to the previous user
+// messages, if the format has no input turn, and the contents cleaned.
+func (f *Format) merged(messages []Message) ([]Message, error) {
+	out := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		m.Content = f.clean(m.Content)
+		switch m.Role {
+		case RoleSystem, RoleUser, RoleAssistant:
+		case RoleInput:
+			if f.Input != (Turn{}) {
+				break
+			}
+			if len(out) == 0 || out[len(out)-1].Role != RoleUser {
+				return nil, fmt.Errorf("prompts: the input must follow a user message")
+			}
+			out[len(out)-1].Content += "\n" + m.Content
+			continue
+		default:
+			return nil, fmt.Errorf("prompts: unsupported message role %q", m.Role)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// part returns the part of the i-th message, or of the default system message.
+func (f *Format) part(i int, m Message) Part {
+	// the older messages have the lower priority
+	p := Part{Name: fmt.Sprintf("%s message %d", m.Role, i), Text: m.Content, Priority: i, Truncate: TruncateHead}
+	var turn Turn
+	switch m.Role {
+	case RoleSystem:
+		turn, p.Truncate = f.System, TruncateNone
+		if i < 0 {
+			p.Name = "default system message"
+		}
+	case RoleUser:
+		turn = f.User
+	case RoleAssistant:
+		turn = f.Assistant
+		if f.ReplySpace && m.Content != "" {
+			p.Text = " " + m.Content
+		}
+	case RoleInput:
+		turn = f.Input
+	}
+	p.Prefix, p.Suffix = turn.Prefix, turn.Suffix
+	return p
+}
+
+func (f *Format) clean(content string) string {
+	if f.Clean != nil {
+		return f.Clean(content)
+	}
+	return strings.TrimSpace(content)
+}
+
+// blankLines matches the blank lines, with the line break preceding them.
+var blankLines = regexp.MustCompile(`\n(?:[ \t]*\n)+`)
+
+// collapseBlankLines removes the blank lines and the surrounding spaces, for the
+// formats separating the turns with them.
+func collapseBlankLines(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return blankLines.ReplaceAllString(strings.TrimSpace(content), "\n")
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]*Format{}
+)
+
+func init() {
+	for _, f := range builtinFormats {
+		RegisterFormat(f)
+	}
+}
+
+// builtinFormats are the formats of the common fine-tunes, registered by default.
+var builtinFormats = []*Format{
+	{
+		// the "Question:" and "Answer:" turns of the RWKV Raven models, separated by
+		// blank lines, which are removed from the messages
+		Name:       "raven",
+		System:     Turn{Suffix: "\n\n"},
+		User:       Turn{Prefix: "Question: ", Suffix: "\n\n"},
+		Assistant:  Turn{Prefix: "Answer:", Suffix: "\n\n"},
+		ReplySpace: true,
+		Clean:      collapseBlankLines,
+		Stops:      []string{"\n\n"},
+	},
+	{
+		Name:          "alpaca",
+		System:        Turn{Suffix: "\n\n"},
+		User:          Turn{Prefix: "### Instruction:\n", Suffix: "\n\n"},
+		Input:         Turn{Prefix: "### Input:\n", Suffix: "\n\n"},
+		Assistant:     Turn{Prefix: "### Response:\n", Suffix: "\n\n"},
+		DefaultSystem: "Below is an instruction that describes a task. Write a response that appropriately completes the request.",
+		Stops:         []string{"\n### Instruction:", "\n### Input:", "\n### Response:"},
+	},
+	{
+		// Vicuna v1.1
+		Name:          "vicuna",
+		System:        Turn{Suffix: " "},
+		User:          Turn{Prefix: "USER: ", Suffix: " "},
+		Assistant:     Turn{Prefix: "ASSISTANT:", Suffix: "</s>"},
+		DefaultSystem: "A chat between a curious user and an artificial intelligence assistant. The assistant gives helpful, detailed, and polite answers to the user's questions.",
+		ReplySpace:    true,
+		Stops:         []string{"</s>", "USER:"},
+	},
+	{
+		Name:      "chatml",
+		System:    Turn{Prefix: "<|im_start|>system\n", Suffix: "<|im_end|>\n"},
+		User:      Turn{Prefix: "<|im_start|>user\n", Suffix: "<|im_end|>\n"},
+		Assistant: Turn{Prefix: "<|im_start|>assistant\n", Suffix: "<|im_end|>\n"},
+		Stops:     []string{"<|im_end|>", "<|im_start|>"},
+	},
+	{
+		// a plain transcript, one line per message, for the base models
+		Name:       "transcript",
+		System:     Turn{Prefix: "System: ", Suffix: "\n"},
+		User:       Turn{Prefix: "User: ", Suffix: "\n"},
+		Assistant:  Turn{Prefix: "Assistant:", Suffix: "\n"},
+		ReplySpace: true,
+		Stops:      []string{"\nUser:"},
+	},
+}
+
+// RegisterFormat makes the format available by name to LookupFormat. It panics
+// if the name is already registered.
+func RegisterFormat(f *Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	if _, exists := formats[f.Name]; exists {
+		panic(fmt.Sprintf("prompts: format %q already registered", f.Name))
+	}
+	formats[f.Name] = f
+}
+
+// LookupFormat returns the registered format with the given name: "raven",
+// "alpaca", "vicuna", "chatml" and "transcript" are built in.
+func LookupFormat(name string) (*Format, error) {
+	formatsMu.RLock()
+	f, ok := formats[name]
+	formatsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("prompts: unknown format %q (available: %s)", name, strings.Join(FormatNames(), ", "))
+	}
+	return f, nil
+}
+
+// FormatNames returns the sorted names of the registered formats.
+func FormatNames() []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
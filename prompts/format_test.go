@@ -0,0 +1,83 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prompts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat_Render(t *testing.T) {
+	conversation := []Message{
+		{Role: RoleUser, Content: "Hi!\n\n\nWho are you? "},
+		{Role: RoleAssistant, Content: "A bot."},
+		{Role: RoleUser, Content: "Summarize it."},
+		{Role: RoleInput, Content: "Some text."},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"raven", "Question: Hi!\nWho are you?\n\nAnswer: A bot.\n\nQuestion: Summarize it.\nSome text.\n\nAnswer:"},
+		{"alpaca", "Below is an instruction that describes a task. Write a response that appropriately completes the request.\n\n" +
+			"### Instruction:\nHi!\n\n\nWho are you?\n\n### Response:\nA bot.\n\n" +
+			"### Instruction:\nSummarize it.\n\n### Input:\nSome text.\n\n### Response:\n"},
+		{"vicuna", "A chat between a curious user and an artificial intelligence assistant. The assistant gives helpful, detailed, and polite answers to the user's questions. " +
+			"USER: Hi!\n\n\nWho are you? ASSISTANT: A bot.</s>USER: Summarize it.\nSome text. ASSISTANT:"},
+		{"chatml", "<|im_start|>user\nHi!\n\n\nWho are you?<|im_end|>\n<|im_start|>assistant\nA bot.<|im_end|>\n" +
+			"<|im_start|>user\nSummarize it.\nSome text.<|im_end|>\n<|im_start|>assistant\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			f, err := LookupFormat(tt.format)
+			require.NoError(t, err)
+			prompt, err := f.Render(conversation)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, prompt)
+		})
+	}
+}
+
+func TestFormat_Render_System(t *testing.T) {
+	f, err := LookupFormat("transcript")
+	require.NoError(t, err)
+	prompt, err := f.Render([]Message{{Role: RoleSystem, Content: "Be brief."}, {Role: RoleUser, Content: "Hi"}})
+	require.NoError(t, err)
+	assert.Equal(t, "System: Be brief.\nUser: Hi\nAssistant:", prompt)
+
+	// the reply of the assistant is continued
+	prompt, err = f.Render([]Message{{Role: RoleUser, Content: "Hi"}, {Role: RoleAssistant, Content: "Hello,"}})
+	require.NoError(t, err)
+	assert.Equal(t, "User: Hi\nAssistant: Hello,", prompt)
+
+	_, err = f.Render([]Message{{Role: "tool", Content: "x"}})
+	assert.Error(t, err)
+	_, err = f.Render([]Message{{Role: RoleInput, Content: "x"}})
+	assert.Error(t, err)
+}
+
+func TestFormat_Parts(t *testing.T) {
+	f, err := LookupFormat("transcript")
+	require.NoError(t, err)
+	parts, err := f.Parts([]Message{
+		{Role: RoleSystem, Content: "Be brief."},
+		{Role: RoleUser, Content: "a b c d e f"},
+		{Role: RoleAssistant, Content: "g h"},
+		{Role: RoleUser, Content: "Hi"},
+	})
+	require.NoError(t, err)
+	// the oldest turns are truncated first
+	prompt, err := Fit(runeTokenizer{}, parts, 66)
+	require.NoError(t, err)
+	assert.Equal(t, "System: Be brief.\nUser: c d e f\nAssistant: g h\nUser: Hi\nAssistant:", prompt)
+}
+
+func TestLookupFormat(t *testing.T) {
+	_, err := LookupFormat("unknown")
+	assert.ErrorContains(t, err, "alpaca, chatml, raven, transcript, vicuna")
+	assert.Panics(t, func() { RegisterFormat(&Format{Name: "raven"}) })
+}
@@ -0,0 +1,219 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package prompts helps building the prompts of the generations.
+package prompts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+)
+
+// Truncation is how the text of a Part is shortened to fit the budget.
+type Truncation string
+
+const (
+	// TruncateNone keeps the whole text of the part: Fit fails if it does not fit.
+	TruncateNone Truncation = ""
+	// TruncateHead removes the tokens at the beginning of the text, e.g. the oldest
+	// turns of a conversation.
+	TruncateHead Truncation = "head"
+	// TruncateTail removes the tokens at the end of the text, e.g. of a document
+	// whose beginning matters most.
+	TruncateTail Truncation = "tail"
+	// TruncateMiddle removes the tokens in the middle of the text, keeping as many
+	// at the beginning as at the end.
+	TruncateMiddle Truncation = "middle"
+)
+
+// Part is a section of a prompt, e.g. the system instructions, the context or the
+// question of the user.
+type Part struct {
+	// Name identifies the part in the errors.
+	Name string
+	// Text is the text of the part, which is truncated.
+	Text string
+	// Prefix and Suffix surround the text, e.g. a header and the separator from the
+	// following part. They are never truncated, and are removed with the text when
+	// it is truncated down to nothing.
+	Prefix, Suffix string
+	// Priority orders the truncation of the parts: the ones with the lowest priority
+	// are truncated first, and the later parts first among the ones of the same
+	// priority.
+	Priority int
+	// Truncate is how the part is truncated; its text can be truncated down to
+	// nothing, in which case the part is left out.
+	Truncate Truncation
+}
+
+// maxAttempts is the maximum number of times the parts are truncated further,
+// when the tokenization of the assembled prompt is longer than the sum of the
+// kept tokens, because the tokens at the boundaries of the parts and of the cuts
+// are not the same once the text is joined.
+const maxAttempts = 4
+
+// Fit assembles the parts, in order, into a prompt of at most budget tokens,
+// according to the given tokenizer, truncating the parts by priority as needed.
+// The counts are exact: the assembled prompt is tokenized again to check its
+// length. It fails if the parts which cannot be truncated exceed the budget.
+func Fit(tk tokenizer.Tokenizer, parts []Part, budget int) (string, error) {
+	tokens := make([][]int, len(parts))
+	// affixes is the number of tokens of the prefix and suffix of each part
+	affixes := make([]int, len(parts))
+	total := 0
+	for i, p := range parts {
+		switch p.Truncate {
+		case TruncateNone, TruncateHead, TruncateTail, TruncateMiddle:
+		default:
+			return "", fmt.Errorf("prompts: part %q: unknown truncation %q", p.Name, p.Truncate)
+		}
+		var err error
+		if tokens[i], err = tk.Tokenize(p.Text); err != nil {
+			return "", fmt.Errorf("prompts: part %q: %w", p.Name, err)
+		}
+		for _, affix := range []string{p.Prefix, p.Suffix} {
+			ids, err := tk.Tokenize(affix)
+			if err != nil {
+				return "", fmt.Errorf("prompts: part %q: %w", p.Name, err)
+			}
+			affixes[i] += len(ids)
+		}
+		total += len(tokens[i]) + affixes[i]
+	}
+
+	// the order in which the parts are truncated
+	order := make([]int, len(parts))
+	for i := range order {
+		order[i] = len(parts) - 1 - i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return parts[order[a]].Priority < parts[order[b]].Priority
+	})
+
+	limit := budget
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		keep, err := allot(parts, tokens, affixes, order, total, limit)
+		if err != nil {
+			return "", err
+		}
+		text, err := assemble(tk, parts, tokens, keep)
+		if err != nil {
+			return "", err
+		}
+		ids, err := tk.Tokenize(text)
+		if err != nil {
+			return "", err
+		}
+		if len(ids) <= budget {
+			return text, nil
+		}
+		limit -= len(ids) - budget
+	}
+	return "", fmt.Errorf("prompts: the prompt does not fit in %d tokens", budget)
+}
+
+// allot returns the number of tokens kept of the text of each part, -1 for the
+// parts left out, for a total of at most limit tokens, truncating the parts in the
+// given order.
+func allot(parts []Part, tokens [][]int, affixes, order []int, total, limit int) ([]int, error) {
+	keep := make([]int, len(parts))
+	for i := range tokens {
+		keep[i] = len(tokens[i])
+	}
+	excess := total - limit
+	for _, i := range order {
+		if excess <= 0 {
+			break
+		}
+		if parts[i].Truncate == TruncateNone {
+			continue
+		}
+		if excess < keep[i] {
+			keep[i] -= excess
+			excess = 0
+			break
+		}
+		excess -= keep[i] + affixes[i]
+		keep[i] = -1
+	}
+	if excess > 0 {
+		fixed := 0
+		var names []string
+		for i, p := range parts {
+			if p.Truncate == TruncateNone {
+				fixed += len(tokens[i]) + affixes[i]
+				names = append(names, fmt.Sprintf("%q", p.Name))
+			}
+		}
+		return nil, fmt.Errorf("prompts: the parts which cannot be truncated (%s) have %d tokens, over the budget of %d",
+			strings.Join(names, ", "), fixed, limit)
+	}
+	return keep, nil
+}
+
+// assemble concatenates the parts, keeping the given number of tokens of each one.
+func assemble(tk tokenizer.Tokenizer, parts []Part, tokens [][]int, keep []int) (string, error) {
+	var sb strings.Builder
+	for i, p := range parts {
+		ids, n := tokens[i], keep[i]
+		if n < 0 {
+			continue
+		}
+		sb.WriteString(p.Prefix)
+		if n == len(ids) {
+			sb.WriteString(p.Text)
+			sb.WriteString(p.Suffix)
+			continue
+		}
+		var text string
+		var err error
+		switch p.Truncate {
+		case TruncateHead:
+			text, err = reconstruct(tk, ids[len(ids)-n:])
+		case TruncateTail:
+			text, err = reconstruct(tk, ids[:n])
+		case TruncateMiddle:
+			var head, tail string
+			if head, err = reconstruct(tk, ids[:(n+1)/2]); err == nil {
+				tail, err = reconstruct(tk, ids[len(ids)-n/2:])
+			}
+			text = head + tail
+		}
+		if err != nil {
+			return "", fmt.Errorf("prompts: part %q: %w", p.Name, err)
+		}
+		sb.WriteString(text)
+		sb.WriteString(p.Suffix)
+	}
+	return sb.String(), nil
+}
+
+// reconstruct returns the text of the tokens, without the bytes of the characters
+// split at its ends, which byte-level tokenizers can break across tokens.
+func reconstruct(tk tokenizer.Tokenizer, ids []int) (string, error) {
+	if len(ids) == 0 {
+		return "", nil
+	}
+	text, err := tk.ReconstructText(ids)
+	if err != nil {
+		return "", err
+	}
+	for len(text) > 0 {
+		if r, size := utf8.DecodeRuneInString(text); r != utf8.RuneError || size != 1 {
+			break
+		}
+		text = text[1:]
+	}
+	for len(text) > 0 {
+		if r, size := utf8.DecodeLastRuneInString(text); r != utf8.RuneError || size != 1 {
+			break
+		}
+		text = text[:len(text)-1]
+	}
+	return text, nil
+}
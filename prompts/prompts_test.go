@@ -0,0 +1,94 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prompts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runeTokenizer has a token per rune, and merges "ab" into a single token.
+type runeTokenizer struct{}
+
+const abToken = -1
+
+func (runeTokenizer) Tokenize(text string) ([]int, error) {
+	var ids []int
+	for _, r := range text {
+		if r == 'b' && len(ids) > 0 && ids[len(ids)-1] == 'a' {
+			ids[len(ids)-1] = abToken
+			continue
+		}
+		ids = append(ids, int(r))
+	}
+	return ids, nil
+}
+
+func (runeTokenizer) ReconstructText(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		if id == abToken {
+			sb.WriteString("ab")
+			continue
+		}
+		sb.WriteRune(rune(id))
+	}
+	return sb.String(), nil
+}
+
+func TestFit(t *testing.T) {
+	tk := runeTokenizer{}
+	parts := []Part{
+		{Name: "system", Text: "SYS", Suffix: "|", Priority: 3},
+		{Name: "context", Prefix: "C:", Text: "0123456789", Suffix: "|", Priority: 1, Truncate: TruncateTail},
+		{Name: "history", Text: "hhhhhhHHHH", Suffix: "|", Priority: 2, Truncate: TruncateHead},
+		{Name: "user", Text: "Q?", Priority: 3},
+	}
+
+	for _, tc := range []struct {
+		budget int
+		want   string
+	}{
+		{budget: 100, want: "SYS|C:0123456789|hhhhhhHHHH|Q?"},
+		// the context is truncated first
+		{budget: 21, want: "SYS|C:0|hhhhhhHHHH|Q?"},
+		// the context is left out with its prefix and suffix, then the history is truncated
+		{budget: 20, want: "SYS|hhhhhhHHHH|Q?"},
+		{budget: 16, want: "SYS|hhhhhHHHH|Q?"},
+		{budget: 10, want: "SYS|HHH|Q?"},
+		{budget: 6, want: "SYS|Q?"},
+	} {
+		text, err := Fit(tk, parts, tc.budget)
+		require.NoError(t, err, tc.budget)
+		assert.Equal(t, tc.want, text, tc.budget)
+	}
+
+	_, err := Fit(tk, parts, 5)
+	assert.ErrorContains(t, err, `the parts which cannot be truncated ("system", "user") have 6 tokens`)
+
+	_, err = Fit(tk, []Part{{Name: "x", Truncate: "left"}}, 5)
+	assert.ErrorContains(t, err, `unknown truncation "left"`)
+}
+
+func TestFit_Middle(t *testing.T) {
+	parts := []Part{{Name: "doc", Text: "0123456789", Truncate: TruncateMiddle}}
+	text, err := Fit(runeTokenizer{}, parts, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "01289", text)
+}
+
+func TestFit_Boundaries(t *testing.T) {
+	// "a" and "b" are merged once joined: the length is that of the assembled prompt
+	parts := []Part{
+		{Name: "first", Text: "xxa", Truncate: TruncateHead},
+		{Name: "second", Text: "bxxx", Truncate: TruncateTail},
+	}
+	text, err := Fit(runeTokenizer{}, parts, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "xxabxx", text)
+}
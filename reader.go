@@ -0,0 +1,46 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"io"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/textproc"
+)
+
+// GenerateReader generates a text from the given prompt, returning a reader which yields
+// the decoded UTF-8 text as it is produced. The text goes through the given processors.
+//
+// Reading returns io.EOF when the generation is completed, or the generation error.
+// Closing the reader before the end cancels the generation.
+func (vf *VerbaFlow) GenerateReader(ctx context.Context, prompt string, opts decoder.DecodingOptions, processors ...textproc.Processor) io.ReadCloser {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	go func() {
+		err := vf.GenerateText(ctx, prompt, opts, func(text string) error {
+			_, err := io.WriteString(pw, text)
+			return err
+		}, processors...)
+		// a nil error makes the reader return io.EOF
+		pw.CloseWithError(err)
+	}()
+
+	return &generationReader{PipeReader: pr, cancel: cancel}
+}
+
+// generationReader is the reader returned by GenerateReader.
+type generationReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+// Close cancels the generation and closes the reader.
+func (r *generationReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_GenerateReader(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1, Temp: 1, TopP: 1}
+
+	var expected strings.Builder
+	require.NoError(t, vf.GenerateText(context.Background(), "hello", opts, func(text string) error {
+		expected.WriteString(text)
+		return nil
+	}))
+
+	r := vf.GenerateReader(context.Background(), "hello", opts)
+	text, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected.String(), string(text))
+	// the end of the generation is io.EOF
+	_, err = r.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, r.Close())
+}
+
+func TestVerbaFlow_GenerateReader_Error(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	require.NoError(t, vf.Close())
+
+	r := vf.GenerateReader(context.Background(), "hello", decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1})
+	defer r.Close()
+	_, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestVerbaFlow_GenerateReader_Close(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+
+	r := vf.GenerateReader(context.Background(), "hello", decoder.DecodingOptions{MaxLen: 100000, EndTokenID: -1, Temp: 1, TopP: 1})
+	n, err := r.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.NoError(t, r.Close())
+	_, err = r.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// the generation is cancelled: Close doesn't wait for its 100000 tokens
+	closed := make(chan error, 1)
+	go func() { closed <- vf.Close() }()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the generation was not cancelled")
+	}
+}
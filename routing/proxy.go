@@ -0,0 +1,117 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"google.golang.org/grpc/metadata"
+)
+
+// anonymousKey is the session of the requests without an API key, as for the
+// inference server.
+const anonymousKey = "anonymous"
+
+var _ api.LanguageModelServer = &Proxy{}
+
+// Proxy is a LanguageModel service forwarding each request, with its metadata,
+// to the replica of its session, the API key, chosen by a Router: the requests
+// of a session, including the ones controlling its generations, reach the same
+// replica.
+type Proxy struct {
+	api.UnimplementedLanguageModelServer
+	router *Router
+}
+
+// NewProxy returns a Proxy routing the requests with the router.
+func NewProxy(router *Router) *Proxy {
+	return &Proxy{router: router}
+}
+
+// GenerateTokens implements the GenerateTokens method of the LanguageModel
+// service, forwarding the stream of the replica.
+func (p *Proxy) GenerateTokens(req *api.TokenGenerationRequest, stream api.LanguageModel_GenerateTokensServer) error {
+	ctx, client, err := p.client(stream.Context())
+	if err != nil {
+		return err
+	}
+	upstream, err := client.GenerateTokens(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := upstream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// PauseGeneration implements the PauseGeneration method of the LanguageModel service.
+func (p *Proxy) PauseGeneration(ctx context.Context, req *api.GenerationControlRequest) (*api.GenerationControlResponse, error) {
+	ctx, client, err := p.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.PauseGeneration(ctx, req)
+}
+
+// ResumeGeneration implements the ResumeGeneration method of the LanguageModel service.
+func (p *Proxy) ResumeGeneration(ctx context.Context, req *api.GenerationControlRequest) (*api.GenerationControlResponse, error) {
+	ctx, client, err := p.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.ResumeGeneration(ctx, req)
+}
+
+// AbortGeneration implements the AbortGeneration method of the LanguageModel service.
+func (p *Proxy) AbortGeneration(ctx context.Context, req *api.GenerationControlRequest) (*api.GenerationControlResponse, error) {
+	ctx, client, err := p.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.AbortGeneration(ctx, req)
+}
+
+// client returns the outgoing context of the request, with its metadata, and
+// the client of the replica of its session.
+func (p *Proxy) client(ctx context.Context) (context.Context, api.LanguageModelClient, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	conn, err := p.router.Route(session(md))
+	if err != nil {
+		return nil, nil, err
+	}
+	out := metadata.MD{}
+	for k, v := range md {
+		// the transport headers are set by the outgoing connection
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || k == "content-type" || k == "user-agent" {
+			continue
+		}
+		out[k] = v
+	}
+	return metadata.NewOutgoingContext(ctx, out), api.NewLanguageModelClient(conn), nil
+}
+
+// session returns the API key of the request, as the inference server does.
+func session(md metadata.MD) string {
+	if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		return strings.TrimPrefix(v[0], "Bearer ")
+	}
+	if v := md.Get("x-api-key"); len(v) > 0 && v[0] != "" {
+		return v[0]
+	}
+	return anonymousKey
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package routing routes the sessions, by API key, to the replicas of the
+// inference server consistently, so that the requests continuing a session
+// reach the replica holding its state, moving the states between the replicas
+// when they change.
+package routing
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points of each replica on a Ring.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent hash ring of the replicas: each session belongs to the
+// replica of the first point following its hash, so that adding or removing a
+// replica moves only the sessions of its points.
+type Ring struct {
+	points   []point // sorted by hash
+	replicas []string
+}
+
+type point struct {
+	hash    uint64
+	replica string
+}
+
+// NewRing returns the ring of the replicas, e.g. their addresses, each with
+// vnodes points (default: DefaultVirtualNodes) spreading its sessions evenly.
+// The duplicate replicas are ignored.
+func NewRing(replicas []string, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{}
+	seen := make(map[string]bool, len(replicas))
+	for _, replica := range replicas {
+		if seen[replica] {
+			continue
+		}
+		seen[replica] = true
+		r.replicas = append(r.replicas, replica)
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, point{hash: hash(replica + "#" + strconv.Itoa(i)), replica: replica})
+		}
+	}
+	sort.Strings(r.replicas)
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].replica < r.points[j].replica
+	})
+	return r
+}
+
+// Lookup returns the replica of the session, or an empty string if the ring
+// has no replicas.
+func (r *Ring) Lookup(session string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(session)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].replica
+}
+
+// Replicas returns the sorted replicas of the ring.
+func (r *Ring) Replicas() []string {
+	return append([]string(nil), r.replicas...)
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
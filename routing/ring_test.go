@@ -0,0 +1,49 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package routing
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil, 0).Lookup("key"))
+
+	r := NewRing([]string{"b:1", "a:1", "c:1", "a:1"}, 0)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, r.Replicas())
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		owners[key] = r.Lookup(key)
+		counts[owners[key]]++
+		assert.Equal(t, owners[key], r.Lookup(key), "the lookups are consistent")
+	}
+	for _, n := range counts {
+		assert.InDelta(t, 1000, n, 250, "the sessions are spread evenly")
+	}
+
+	// adding a replica moves only the sessions it takes
+	grown := NewRing([]string{"a:1", "b:1", "c:1", "d:1"}, 0)
+	moved := 0
+	for key, owner := range owners {
+		if o := grown.Lookup(key); o != owner {
+			assert.Equal(t, "d:1", o)
+			moved++
+		}
+	}
+	assert.InDelta(t, 750, moved, 250)
+
+	// removing one moves only its sessions
+	shrunk := NewRing([]string{"a:1", "c:1"}, 0)
+	for key, owner := range owners {
+		if owner != "b:1" {
+			assert.Equal(t, owner, shrunk.Lookup(key))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Router routes the sessions to the replicas of a Ring, by their gRPC
+// addresses. It remembers the replica of the last request of each session,
+// which holds its state: when the replicas change, SetReplicas moves the
+// states of the sessions changing replica with the ExportSession and
+// ImportSession methods of the Admin service of the replicas.
+//
+// The replicas sharing a session store don't need the states to be moved (see
+// the sessions package), only the consistent routing.
+type Router struct {
+	adminToken string
+	dialOpts   []grpc.DialOption
+
+	mu    sync.Mutex
+	ring  *Ring
+	conns map[string]*grpc.ClientConn
+	// owners are the replicas of the last request of each session.
+	owners map[string]string
+}
+
+// NewRouter returns a Router without replicas (see SetReplicas), dialing them
+// with the options, and moving the states with the admin token of the
+// replicas; without it, the states are not moved.
+func NewRouter(adminToken string, opts ...grpc.DialOption) *Router {
+	return &Router{
+		adminToken: adminToken,
+		dialOpts:   opts,
+		ring:       NewRing(nil, 0),
+		conns:      make(map[string]*grpc.ClientConn),
+		owners:     make(map[string]string),
+	}
+}
+
+// Route returns the connection to the replica of the session, recording it
+// as the replica holding its state.
+func (r *Router) Route(session string) (*grpc.ClientConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replica := r.ring.Lookup(session)
+	if replica == "" {
+		return nil, status.Error(codes.Unavailable, "routing: no replicas")
+	}
+	conn, err := r.conn(replica)
+	if err != nil {
+		return nil, err
+	}
+	r.owners[session] = replica
+	return conn, nil
+}
+
+// Replicas returns the sorted replicas.
+func (r *Router) Replicas() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ring.Replicas()
+}
+
+// SetReplicas replaces the replicas, moving the states of the sessions whose
+// replica changes. The requests wait for the states to be moved. The failures
+// are logged: the sessions whose state can't be moved, e.g. because their
+// replica is gone, start over.
+func (r *Router) SetReplicas(ctx context.Context, replicas []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring = NewRing(replicas, 0)
+	for session, from := range r.owners {
+		to := r.ring.Lookup(session)
+		if to == from {
+			continue
+		}
+		delete(r.owners, session)
+		if to == "" || r.adminToken == "" {
+			continue
+		}
+		if err := r.move(ctx, session, from, to); err != nil {
+			log.Warn().Err(err).Str("from", from).Str("to", to).Msg("failed to move the session state")
+			continue
+		}
+		r.owners[session] = to
+	}
+	live := make(map[string]bool)
+	for _, replica := range r.ring.Replicas() {
+		live[replica] = true
+	}
+	for replica, conn := range r.conns {
+		if !live[replica] {
+			_ = conn.Close()
+			delete(r.conns, replica)
+		}
+	}
+}
+
+// move moves the state of the session between the replicas, if any. The state
+// is put back if it can't be imported.
+func (r *Router) move(ctx context.Context, session, from, to string) error {
+	src, err := r.conn(from)
+	if err != nil {
+		return err
+	}
+	dst, err := r.conn(to)
+	if err != nil {
+		return err
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+r.adminToken)
+	state, err := api.NewAdminClient(src).ExportSession(ctx, &api.ExportSessionRequest{ApiKey: session, Forget: true})
+	if status.Code(err) == codes.NotFound {
+		// the last generation didn't end by itself, or expired
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("routing: failed to export the session: %w", err)
+	}
+	_, err = api.NewAdminClient(dst).ImportSession(ctx, &api.ImportSessionRequest{ApiKey: session, State: state.GetState()})
+	if err != nil {
+		_, _ = api.NewAdminClient(src).ImportSession(ctx, &api.ImportSessionRequest{ApiKey: session, State: state.GetState()})
+		return fmt.Errorf("routing: failed to import the session: %w", err)
+	}
+	return nil
+}
+
+// conn returns the connection to the replica, dialing it once.
+func (r *Router) conn(replica string) (*grpc.ClientConn, error) {
+	if conn, ok := r.conns[replica]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(replica, r.dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("routing: failed to dial %s: %w", replica, err)
+	}
+	r.conns[replica] = conn
+	return conn, nil
+}
+
+// Close closes the connections to the replicas.
+func (r *Router) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	for replica, conn := range r.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(r.conns, replica)
+	}
+	return err
+}
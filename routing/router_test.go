@@ -0,0 +1,103 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRouter(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+
+	// two replicas, and the proxy in front of them
+	replicas := []string{"unix://" + filepath.Join(dir, "a.sock"), "unix://" + filepath.Join(dir, "b.sock")}
+	for _, address := range replicas {
+		s := service.NewServer(vf, service.Config{AdminToken: "admin"})
+		go func(address string) { _ = s.Start(ctx, address) }(address)
+	}
+	dialUnix := grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		path, _ := service.SocketPath(address)
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	})
+	router := NewRouter("admin", grpc.WithInsecure(), dialUnix)
+	defer router.Close()
+	router.SetReplicas(ctx, replicas[:1])
+	lis, err := net.Listen("unix", filepath.Join(dir, "proxy.sock"))
+	require.NoError(t, err)
+	proxy := grpc.NewServer()
+	api.RegisterLanguageModelServer(proxy, NewProxy(router))
+	go func() { _ = proxy.Serve(lis) }()
+	defer proxy.Stop()
+
+	conn, err := grpc.Dial("unix://"+filepath.Join(dir, "proxy.sock"), grpc.WithInsecure(), dialUnix)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLanguageModelClient(conn)
+	generate := func(key, prompt string, maxLen int, cont bool) (string, error) {
+		ctx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+key)
+		stream, err := client.GenerateTokens(ctx, &api.TokenGenerationRequest{
+			Prompt:             prompt,
+			DecodingParameters: &api.DecodingParameters{MaxLen: int32(maxLen), EndTokenId: -1},
+			Continue:           cont,
+		}, grpc.WaitForReady(true))
+		if err != nil {
+			return "", err
+		}
+		var text strings.Builder
+		for {
+			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return text.String(), nil
+			}
+			if err != nil {
+				return "", err
+			}
+			text.WriteString(msg.GetToken())
+		}
+	}
+
+	expected, err := generate("other", "the weather", 8, false)
+	require.NoError(t, err)
+	first, err := generate("key", "the weather", 5, false)
+	require.NoError(t, err)
+
+	// the session moves with its replica
+	router.SetReplicas(ctx, replicas[1:])
+	assert.Equal(t, replicas[1:], router.Replicas())
+	second, err := generate("key", "", 3, true)
+	require.NoError(t, err)
+	assert.Equal(t, expected, first+second)
+
+	// the session is gone from the previous replica
+	previous, err := grpc.Dial(replicas[0], grpc.WithInsecure(), dialUnix)
+	require.NoError(t, err)
+	defer previous.Close()
+	admin := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin")
+	_, err = api.NewAdminClient(previous).ExportSession(admin, &api.ExportSessionRequest{ApiKey: "key"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = generate("other", "", 3, true)
+	require.NoError(t, err, "the other sessions move too")
+}
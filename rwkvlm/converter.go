@@ -2,15 +2,17 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build !js && !wasip1
+
 package rwkvlm
 
 import (
 	"fmt"
-	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"unsafe"
 
 	"github.com/nlpodyssey/gopickle/pytorch"
 	"github.com/nlpodyssey/gopickle/types"
@@ -22,17 +24,10 @@ import (
 	"github.com/nlpodyssey/spago/mat/float"
 	"github.com/nlpodyssey/spago/nn"
 	"github.com/nlpodyssey/spago/nn/normalization/layernorm"
+	"github.com/nlpodyssey/verbaflow/internal/diskspace"
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	DefaultPyModelFilename   = "pytorch_model.pt"
-	DefaultOutputFilename    = "spago_model.bin"
-	DefaultEmbeddingRepoPath = "embeddings"
-
-	DefaultLayerNormEps = 1e-5
-)
-
 type ConverterConfig struct {
 	// The path to the directory where the models will be read from and written to.
 	ModelDir string
@@ -44,6 +39,9 @@ type ConverterConfig struct {
 	EmbeddingRepoPath string
 	// If true, overwrite the model file if it already exists (default "false")
 	OverwriteIfExist bool
+	// RescaleLayer overrides the rescaling of the configuration file, if positive;
+	// NoRescale disables it (default: the one of the configuration file).
+	RescaleLayer int
 }
 
 // ConvertPickledModelToRWKVLM converts a PyTorch model to a RWKVLM model.
@@ -71,6 +69,14 @@ func ConvertPickledModelToRWKVLM[T float.DType](config ConverterConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to load config file %q: %w", configFilename, err)
 	}
+	switch {
+	case config.RescaleLayer == NoRescale:
+		modelConfig.RescaleLayer = 0
+	case config.RescaleLayer > 0:
+		modelConfig.RescaleLayer = config.RescaleLayer
+	case config.RescaleLayer < NoRescale:
+		return fmt.Errorf("invalid rescale layer %d", config.RescaleLayer)
+	}
 
 	inFilename := filepath.Join(config.ModelDir, config.PyModelFilename)
 	embRepoPath := filepath.Join(config.ModelDir, config.EmbeddingRepoPath)
@@ -107,6 +113,7 @@ func newConverter[T float.DType](conf Config, inFilename, outFilename, embRepoPa
 func (c *converter[T]) run() error {
 	funcs := []func() error{
 		c.loadTorchModelParams,
+		c.checkDiskSpace,
 		c.convEmbeddings,
 		c.convLinear,
 		c.convRootLayerNorm,
@@ -121,6 +128,21 @@ func (c *converter[T]) run() error {
 	return nil
 }
 
+// diskOverhead accounts for the space used by the embeddings store in addition to the
+// raw data, and for the model file being written while the previous one still exists.
+const diskOverhead = 1.5
+
+// checkDiskSpace fails if the converted model is not expected to fit in the output directory.
+func (c *converter[T]) checkDiskSpace() error {
+	var n int
+	for _, t := range c.params {
+		n += tensorDataSize(t)
+	}
+	var zero T
+	required := float64(n) * float64(unsafe.Sizeof(zero)) * diskOverhead
+	return diskspace.Check(filepath.Dir(c.outFilename), uint64(required))
+}
+
 func (c *converter[T]) dumpModel() (err error) {
 	return Dump(c.model, c.outFilename)
 }
@@ -156,15 +178,61 @@ func (c *converter[T]) convEmbeddings() error {
 		return fmt.Errorf("expected embedding vectors to match configured size %d, actual %d", dm, vecs[0].Size())
 	}
 
+	if c.tiedEmbeddings(embWeight) {
+		log.Info().Msg("The embeddings are tied to the output head, storing them once")
+		c.model.Config.TiedEmbeddings = true
+		delete(c.params, "head.weight")
+		m, err := c.tensorToMatrix(embWeight)
+		if err != nil {
+			return fmt.Errorf("failed to convert tied head-weight/linear: %w", err)
+		}
+		c.model.Linear = nn.NewParam(m)
+	}
+
 	return c.withEmbRepo(func(repo store.Repository) {
 		embs := c.newEmbeddings(repo)
-		for i, vec := range vecs {
-			embs.Tokens.EmbeddingFast(i).ReplaceValue(vec)
+		if !c.model.Config.TiedEmbeddings {
+			for i, vec := range vecs {
+				embs.Tokens.EmbeddingFast(i).ReplaceValue(vec)
+			}
 		}
 		c.model.Embeddings = embs
 	})
 }
 
+// tiedEmbeddings reports whether the output head is tied to the given embeddings:
+// if so configured, if the checkpoint has no head, or if it is equal to the embeddings.
+func (c *converter[T]) tiedEmbeddings(embWeight *pytorch.Tensor) bool {
+	if c.model.Config.TiedEmbeddings {
+		return true
+	}
+	headWeight, ok := c.params["head.weight"]
+	if !ok {
+		return true
+	}
+	if !equalSlices(headWeight.Size, embWeight.Size) {
+		return false
+	}
+	head, err := c.tensorData(headWeight)
+	if err != nil {
+		return false
+	}
+	emb, err := c.tensorData(embWeight)
+	return err == nil && equalSlices(head, emb)
+}
+
+func equalSlices[E comparable](a, b []E) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *converter[T]) newEmbeddings(repo store.Repository) *Embeddings {
 	return NewEmbeddings[T](embeddings.Config{
 		Size:      c.model.Config.DModel,
@@ -191,6 +259,9 @@ func (c *converter[T]) withEmbRepo(fn func(store.Repository)) (err error) {
 }
 
 func (c *converter[T]) convLinear() error {
+	if c.model.Config.TiedEmbeddings {
+		return nil // already converted with the embeddings
+	}
 	headWeight, err := c.params.fetch("head.weight")
 	if err != nil {
 		return err
@@ -230,7 +301,7 @@ func (c *converter[T]) convBlocks() error {
 	conf := rwkv.Config{
 		DModel:       c.model.Config.DModel,
 		NumLayers:    c.model.Config.NumHiddenLayers,
-		RescaleLayer: c.model.Config.RescaleLayer,
+		RescaleLayer: encoderRescaleLayer(c.model.Config),
 	}
 
 	layers := make([]*rwkv.Layer, numBlocks)
@@ -286,7 +357,7 @@ func (c *converter[T]) convBlock(id int, conf rwkv.Config, params paramsMap) (_
 
 func (c *converter[T]) convChanMix(id int, params paramsMap) (*rwkv.ChannelMix, error) {
 	dm := c.model.Config.DModel
-	outScale := math.Pow(2, float64(id/c.model.Config.RescaleLayer))
+	outScale := layerScale(id, c.model.Config.RescaleLayer)
 
 	key, err := c.fetchParamToMatrix(params, "key.weight", [2]int{dm * 4, dm})
 	if err != nil {
@@ -327,7 +398,7 @@ func (c *converter[T]) convChanMix(id int, params paramsMap) (*rwkv.ChannelMix,
 
 func (c *converter[T]) convTimeMix(id int, conf rwkv.Config, params paramsMap) (*rwkv.TimeMix, error) {
 	dm := c.model.Config.DModel
-	outScale := math.Pow(2, float64(id/c.model.Config.RescaleLayer))
+	outScale := layerScale(id, c.model.Config.RescaleLayer)
 
 	key, err := c.fetchParamToMatrix(params, "key.weight", [2]int{dm, dm})
 	if err != nil {
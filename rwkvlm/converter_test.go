@@ -0,0 +1,56 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package rwkvlm
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/gopickle/pytorch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConverter_TiedEmbeddings(t *testing.T) {
+	tensor := func(data ...float32) *pytorch.Tensor {
+		return &pytorch.Tensor{
+			Source: &pytorch.BFloat16Storage{Data: data},
+			Size:   []int{3, 2},
+			Stride: []int{2, 1},
+		}
+	}
+	emb := []float32{1, 2, 3, 4, 5, 6}
+
+	for name, head := range map[string][]float32{
+		"no head":       nil,
+		"equal head":    {1, 2, 3, 4, 5, 6},
+		"distinct head": {1, 2, 3, 4, 5, 7},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newConverter[float32](Config{}, "", "", filepath.Join(t.TempDir(), DefaultEmbeddingRepoPath))
+			c.params = paramsMap{"emb.weight": tensor(emb...)}
+			if head != nil {
+				c.params["head.weight"] = tensor(head...)
+			}
+			require.NoError(t, c.convEmbeddings())
+			require.NoError(t, c.convLinear())
+			assert.Empty(t, c.params)
+
+			if name == "distinct head" {
+				assert.False(t, c.model.Config.TiedEmbeddings)
+				assert.Equal(t, head, c.model.Linear.Value().Data().F32())
+				return
+			}
+			assert.True(t, c.model.Config.TiedEmbeddings)
+			assert.Equal(t, emb, c.model.Linear.Value().Data().F32())
+			x := c.model.EncodeTokens(context.Background(), 1)[0].Value()
+			assert.Equal(t, []int{2, 1}, []int{x.Rows(), x.Columns()})
+			assert.Equal(t, []float32{3, 4}, x.Data().F32())
+		})
+	}
+}
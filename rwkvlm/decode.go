@@ -0,0 +1,285 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/internal/float16"
+	"github.com/nlpodyssey/verbaflow/verrors"
+)
+
+var (
+	_ decoder.TimedModel         = &Model{}
+	_ decoder.StateCloner        = &Model{}
+	_ decoder.StateMarshaler     = &Model{}
+	_ decoder.StateFingerprinter = &Model{}
+	_ decoder.StateCompactor     = &Model{}
+)
+
+// EncodeNext implements decoder.Model: the state is an rwkv.State, which is
+// modified in place.
+func (m *Model) EncodeNext(ctx context.Context, nt *ag.NodesTracker, state decoder.State, token int) (mat.Matrix, decoder.State, error) {
+	return m.EncodeNextTimed(ctx, nt, state, token, nil)
+}
+
+// EncodeNextTimed implements decoder.TimedModel.
+func (m *Model) EncodeNextTimed(ctx context.Context, nt *ag.NodesTracker, state decoder.State, token int, timing *decoder.TokenTiming) (mat.Matrix, decoder.State, error) {
+	s, ok := state.(rwkv.State)
+	if !ok && state != nil {
+		return nil, nil, fmt.Errorf("rwkvlm: invalid state of type %T", state)
+	}
+	start := time.Now()
+	xs := m.EncodeTokens(ctx, token)
+	embedded := time.Now()
+	x, s := m.EncodeEmbeddings(ctx, s, xs)
+	nt.TrackNodes(waitForNodes(extractNodesToRelease(x, s))...)
+	encoded := time.Now()
+	logits := nt.TrackNode(m.Predict(x)).Value()
+	if timing != nil {
+		timing.Embedding = embedded.Sub(start)
+		timing.Encoder = encoded.Sub(embedded)
+		timing.Head = time.Since(encoded)
+	}
+	return logits, s, nil
+}
+
+// CloneState implements decoder.StateCloner, copying the values of the nodes
+// of the rwkv.State, or expanding the ones of a state returned by CompactState.
+func (m *Model) CloneState(state decoder.State) (decoder.State, error) {
+	if h, ok := state.(halfState); ok {
+		return h.expand(), nil
+	}
+	s, ok := state.(rwkv.State)
+	if !ok {
+		return nil, fmt.Errorf("rwkvlm: invalid state of type %T", state)
+	}
+	clone := make(rwkv.State, len(s))
+	for i, layer := range s {
+		clone[i] = &rwkv.LayerState{
+			FfnXX: ag.Var(layer.FfnXX.Value().Clone()),
+			AttXX: ag.Var(layer.AttXX.Value().Clone()),
+			AttAA: ag.Var(layer.AttAA.Value().Clone()),
+			AttBB: ag.Var(layer.AttBB.Value().Clone()),
+			AttPP: ag.Var(layer.AttPP.Value().Clone()),
+		}
+	}
+	return clone, nil
+}
+
+// halfState is a rwkv.State in float16 (see CompactState).
+type halfState []halfLayerState
+
+// halfLayerState are the values of a rwkv.LayerState in float16, but for the
+// maximum exponents AttPP, kept in float32: they begin far beyond the range of
+// float16, and their rounding would be amplified by the exponentials.
+type halfLayerState struct {
+	FfnXX, AttXX, AttAA, AttBB []uint16
+	AttPP                      []float32
+}
+
+// CompactState implements decoder.StateCompactor, converting the rwkv.State to
+// float16, but for its maximum exponents: the state takes about 60% of the
+// memory, e.g. to keep many sessions.
+func (m *Model) CompactState(state decoder.State) (decoder.State, error) {
+	if h, ok := state.(halfState); ok {
+		return h, nil
+	}
+	s, ok := state.(rwkv.State)
+	if !ok {
+		return nil, fmt.Errorf("rwkvlm: invalid state of type %T", state)
+	}
+	h := make(halfState, len(s))
+	for i, layer := range s {
+		h[i] = halfLayerState{
+			FfnXX: float16.FromFloat32s(layer.FfnXX.Value().Data().F32()),
+			AttXX: float16.FromFloat32s(layer.AttXX.Value().Data().F32()),
+			AttAA: float16.FromFloat32s(layer.AttAA.Value().Data().F32()),
+			AttBB: float16.FromFloat32s(layer.AttBB.Value().Data().F32()),
+			AttPP: layer.AttPP.Value().Data().F32(),
+		}
+	}
+	return h, nil
+}
+
+// expand returns the rwkv.State in float32.
+func (h halfState) expand() rwkv.State {
+	s := make(rwkv.State, len(h))
+	for i, layer := range h {
+		s[i] = &rwkv.LayerState{
+			FfnXX: ag.Var(mat.NewVecDense(float16.ToFloat32s(layer.FfnXX))),
+			AttXX: ag.Var(mat.NewVecDense(float16.ToFloat32s(layer.AttXX))),
+			AttAA: ag.Var(mat.NewVecDense(float16.ToFloat32s(layer.AttAA))),
+			AttBB: ag.Var(mat.NewVecDense(float16.ToFloat32s(layer.AttBB))),
+			AttPP: ag.Var(mat.NewVecDense(layer.AttPP)),
+		}
+	}
+	return s
+}
+
+// StateVersion is the version of the format of the states encoded by
+// MarshalState. The states of version 0, predating the versioning, are the bare
+// values of the layers: UnmarshalState still reads them.
+const StateVersion = 1
+
+// stateMagic begins the states of version 1 onwards, telling them from the ones
+// of version 0.
+const stateMagic = "rwkvlm-state\n"
+
+// stateData is a rwkv.State, as encoded by MarshalState after the stateMagic.
+type stateData struct {
+	Version int
+	// DModel and NumLayers are the ones of the model which encoded the state.
+	DModel, NumLayers int
+	Layers            []layerStateData
+}
+
+// layerStateData are the values of a rwkv.LayerState.
+type layerStateData struct {
+	FfnXX, AttXX, AttAA, AttBB, AttPP []float32
+}
+
+// MarshalState implements decoder.StateMarshaler, encoding the values of the
+// nodes of the rwkv.State with gob, in the format of StateVersion. The states
+// returned by CompactState are encoded in full.
+func (m *Model) MarshalState(state decoder.State) ([]byte, error) {
+	if h, ok := state.(halfState); ok {
+		state = h.expand()
+	}
+	s, ok := state.(rwkv.State)
+	if !ok {
+		return nil, fmt.Errorf("rwkvlm: invalid state of type %T", state)
+	}
+	data := stateData{
+		Version:   StateVersion,
+		DModel:    m.Config.DModel,
+		NumLayers: m.Config.NumHiddenLayers,
+		Layers:    make([]layerStateData, len(s)),
+	}
+	for i, layer := range s {
+		data.Layers[i] = layerStateData{
+			FfnXX: layer.FfnXX.Value().Data().F32(),
+			AttXX: layer.AttXX.Value().Data().F32(),
+			AttAA: layer.AttAA.Value().Data().F32(),
+			AttBB: layer.AttBB.Value().Data().F32(),
+			AttPP: layer.AttPP.Value().Data().F32(),
+		}
+	}
+	buf := bytes.NewBufferString(stateMagic)
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalState implements decoder.StateMarshaler, reading the states of any
+// version up to StateVersion. It fails with verrors.ErrStateMismatch if the
+// state doesn't match the number of layers and the size of the model.
+func (m *Model) UnmarshalState(b []byte) (decoder.State, error) {
+	data, err := decodeState(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Layers) != m.Config.NumHiddenLayers {
+		return nil, fmt.Errorf("%w: the state has %d layers, the model %d", verrors.ErrStateMismatch, len(data.Layers), m.Config.NumHiddenLayers)
+	}
+	state := make(rwkv.State, len(data.Layers))
+	for i, layer := range data.Layers {
+		for _, v := range [][]float32{layer.FfnXX, layer.AttXX, layer.AttAA, layer.AttBB, layer.AttPP} {
+			if len(v) != m.Config.DModel {
+				return nil, fmt.Errorf("%w: the state has size %d, the model %d", verrors.ErrStateMismatch, len(v), m.Config.DModel)
+			}
+		}
+		state[i] = &rwkv.LayerState{
+			FfnXX: ag.Var(mat.NewVecDense(layer.FfnXX)),
+			AttXX: ag.Var(mat.NewVecDense(layer.AttXX)),
+			AttAA: ag.Var(mat.NewVecDense(layer.AttAA)),
+			AttBB: ag.Var(mat.NewVecDense(layer.AttBB)),
+			AttPP: ag.Var(mat.NewVecDense(layer.AttPP)),
+		}
+	}
+	return state, nil
+}
+
+// decodeState decodes a state encoded by MarshalState, of any version.
+func decodeState(b []byte) (stateData, error) {
+	var data stateData
+	if !bytes.HasPrefix(b, []byte(stateMagic)) {
+		// version 0
+		err := gob.NewDecoder(bytes.NewReader(b)).Decode(&data.Layers)
+		if err != nil {
+			return data, fmt.Errorf("rwkvlm: invalid state: %w", err)
+		}
+		return data, nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b[len(stateMagic):])).Decode(&data); err != nil {
+		return data, fmt.Errorf("rwkvlm: invalid state: %w", err)
+	}
+	if data.Version > StateVersion {
+		return data, fmt.Errorf("rwkvlm: the state has version %d, newer than the supported %d: upgrade verbaflow to read it", data.Version, StateVersion)
+	}
+	return data, nil
+}
+
+// StateFingerprint implements decoder.StateFingerprinter: it is a hash of the
+// shape of the model and of the weights of its final layer normalization,
+// which differ between the models of the same shape, e.g. fine-tuned ones.
+func (m *Model) StateFingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "rwkv %d %d %d\n", m.Config.DModel, m.Config.NumHiddenLayers, m.Config.VocabSize)
+	var buf [4]byte
+	for _, p := range []nn.Param{m.LN.W, m.LN.B} {
+		for _, v := range p.Value().Data().F32() {
+			binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+			h.Write(buf[:])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// DecoderInput returns the input of the decoder following the encoding x of the
+// last token of the prompt, and the state s after it, computing the logits.
+func (m *Model) DecoderInput(nt *ag.NodesTracker, x ag.Node, s rwkv.State, prompt []int) decoder.Input {
+	start := time.Now()
+	logits := nt.TrackNode(m.Predict(x)).Value()
+	return decoder.Input{
+		Logits: logits,
+		State:  s,
+		Tokens: prompt,
+		Timing: decoder.TokenTiming{Head: time.Since(start)},
+	}
+}
+
+// waitForNodes waits for the nodes to be computed.
+// It is used to ensure that the nodes are computed before releasing them.
+func waitForNodes(nodes []ag.Node) []ag.Node {
+	for _, n := range nodes {
+		n.Value()
+	}
+	return nodes
+}
+
+// extractNodesToRelease extracts the nodes to release from the states.
+// It also considers the explicit x node.
+func extractNodesToRelease(x ag.Node, s rwkv.State) []ag.Node {
+	nodes := []ag.Node{x}
+	for _, layer := range s {
+		nodes = append(nodes, layer.FfnXX, layer.AttXX, layer.AttAA, layer.AttBB, layer.AttPP)
+	}
+	return nodes
+}
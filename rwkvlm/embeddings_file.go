@@ -0,0 +1,92 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	emb "github.com/nlpodyssey/spago/embeddings"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/verrors"
+)
+
+// DefaultEmbeddingsFilename is the default name of the portable embeddings file,
+// which allows using the model without the embeddings repository, e.g. in WebAssembly.
+//
+// The file contains the magic bytes, the vocabulary size and the embedding size
+// (uint32), followed by the embeddings of all the tokens, in order, as little-endian
+// float32 values.
+const DefaultEmbeddingsFilename = "embeddings.bin"
+
+var embeddingsFileMagic = []byte("VFEMB\x00\x00\x01")
+
+// writeEmbeddings writes the embeddings of the vocabulary of the model to w, in the
+// format of the portable embeddings file.
+func writeEmbeddings(w io.Writer, m *Model, tokens *emb.Model[int]) error {
+	vocabSize, dModel := m.Config.VocabSize, m.Config.DModel
+	bw := bufio.NewWriter(w)
+	header := append([]byte{}, embeddingsFileMagic...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(vocabSize))
+	header = binary.LittleEndian.AppendUint32(header, uint32(dModel))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	buf := make([]byte, 4*dModel)
+	for id := 0; id < vocabSize; id++ {
+		e, ok := m.tokenEmbedding(tokens, id)
+		if !ok {
+			return fmt.Errorf("missing embedding for token %d", id)
+		}
+		data := e.Data().F32()
+		if len(data) != dModel {
+			return fmt.Errorf("invalid embedding size for token %d: %d, expected %d", id, len(data), dModel)
+		}
+		for i, v := range data {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadEmbeddings reads the portable embeddings file from r, storing the embeddings
+// in the repository applied to the model with ApplyEmbeddings, typically in memory.
+// If the embeddings are tied, only the header is checked, since the embeddings are
+// extracted from the output head.
+func (m *Model) ReadEmbeddings(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(embeddingsFileMagic)+8)
+	if _, err := io.ReadFull(br, header); err != nil || !bytes.Equal(header[:len(embeddingsFileMagic)], embeddingsFileMagic) {
+		return errors.New("not a portable embeddings file")
+	}
+	vocabSize := int(binary.LittleEndian.Uint32(header[len(embeddingsFileMagic):]))
+	dModel := int(binary.LittleEndian.Uint32(header[len(embeddingsFileMagic)+4:]))
+	if vocabSize != m.Config.VocabSize || dModel != m.Config.DModel {
+		return fmt.Errorf("%w: the embeddings (%d x %d) do not match the model (%d x %d)", verrors.ErrTokenizerMismatch, vocabSize, dModel, m.Config.VocabSize, m.Config.DModel)
+	}
+	if m.Config.TiedEmbeddings {
+		return nil
+	}
+	buf := make([]byte, 4*dModel)
+	for id := 0; id < vocabSize; id++ {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return fmt.Errorf("failed to read the embedding of token %d: %w", id, err)
+		}
+		data := make([]float32, dModel)
+		for i := range data {
+			data[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+		}
+		m.Embeddings.Tokens.EmbeddingFast(id).ReplaceValue(mat.NewVecDense(data))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// gobDecodingOverhead accounts for the serialized data held in memory while the
+// model is decoded, in addition to the decoded parameters.
+const gobDecodingOverhead = 2
+
+// NumResidentParams returns the number of parameters kept in memory by a model with
+// this configuration. The embeddings are excluded, since they are read from the
+// on-disk store. It returns 0 if the configuration is incomplete.
+func (c Config) NumResidentParams() int64 {
+	d, l, v := int64(c.DModel), int64(c.NumHiddenLayers), int64(c.VocabSize)
+	if d == 0 || l == 0 || v == 0 {
+		return 0
+	}
+	// Each layer has two layer-norms (4D), the time-mix (4 D×D matrices, 5 vectors)
+	// and the channel-mix (key 4D×D, value D×4D, receptance D×D, 2 vectors).
+	perLayer := 4*d + (4*d*d + 5*d) + (9*d*d + 2*d)
+	// The final layer-norm and the LM head.
+	return l*perLayer + 2*d + v*d
+}
+
+// EstimateMemory estimates the peak memory (in bytes) needed to load the model in
+// the given directory, for parameters of bytesPerParam bytes each (4 for float32).
+//
+// The estimate is based on the "config.json" file when it is complete, and on the
+// size of the converted model file otherwise.
+func EstimateMemory(dir string, bytesPerParam int) (uint64, error) {
+	if conf, err := LoadConfig(filepath.Join(dir, "config.json")); err == nil {
+		if n := conf.NumResidentParams(); n > 0 {
+			return uint64(n) * uint64(bytesPerParam) * gobDecodingOverhead, nil
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, DefaultOutputFilename))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()) * gobDecodingOverhead, nil
+}
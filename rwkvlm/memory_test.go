@@ -0,0 +1,76 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/verrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_NumResidentParams(t *testing.T) {
+	assert.Zero(t, Config{DModel: 8}.NumResidentParams())
+
+	c := Config{DModel: 2, NumHiddenLayers: 1, VocabSize: 10}
+	// per layer: 8 (norms) + 16+10 (time-mix) + 36+4 (channel-mix); plus 4 (norm) and 20 (head)
+	assert.Equal(t, int64(98), c.NumResidentParams())
+}
+
+func TestEstimateMemory(t *testing.T) {
+	dir := t.TempDir()
+	_, err := EstimateMemory(dir, 4)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultOutputFilename), make([]byte, 100), 0o644))
+	n, err := EstimateMemory(dir, 4)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), n)
+
+	conf := `{"d_model": 2, "num_hidden_layers": 1, "vocab_size": 10}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(conf), 0o644))
+	n, err = EstimateMemory(dir, 4)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(98*4*2), n)
+}
+
+func TestLoadConfig_UnsupportedArchitecture(t *testing.T) {
+	dir := t.TempDir()
+	for conf, supported := range map[string]bool{
+		`{"d_model": 2, "num_hidden_layers": 1, "vocab_size": 10}`:                       true,
+		`{"model_type": "rwkv", "d_model": 2, "num_hidden_layers": 1, "vocab_size": 10}`: true,
+		`{"model_type": "llama", "hidden_size": 2, "num_hidden_layers": 1}`:              false,
+		`{"model_type": "rwkv"}`: true,
+	} {
+		filename := filepath.Join(dir, "config.json")
+		require.NoError(t, os.WriteFile(filename, []byte(conf), 0o644))
+		_, err := LoadConfig(filename)
+		if supported {
+			assert.NoError(t, err, conf)
+		} else {
+			assert.ErrorIs(t, err, verrors.ErrUnsupportedArchitecture, conf)
+		}
+	}
+}
+
+func TestLoadConfig_RescaleLayer(t *testing.T) {
+	dir := t.TempDir()
+	for conf, expected := range map[string]int{
+		`{"d_model": 2}`:                     DefaultRescaleLayer,
+		`{"d_model": 2, "rescale_layer": 3}`: 3,
+		`{"d_model": 2, "rescale_layer": 0}`: 0,
+		`{"d_model": 2, "rescale_every": 4}`: 4,
+		`{"d_model": 2, "rescale_every": 0}`: 0,
+	} {
+		filename := filepath.Join(dir, "config.json")
+		require.NoError(t, os.WriteFile(filename, []byte(conf), 0o644))
+		config, err := LoadConfig(filename)
+		require.NoError(t, err, conf)
+		assert.Equal(t, expected, config.RescaleLayer, conf)
+	}
+}
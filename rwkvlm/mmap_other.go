@@ -0,0 +1,21 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin
+
+package rwkvlm
+
+import "os"
+
+// mapped reports whether mapFile maps the files in memory, rather than reading them.
+const mapped = false
+
+// mapFile reads the file at path in memory, where mapping it is not supported.
+func mapFile(path string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
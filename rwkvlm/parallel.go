@@ -0,0 +1,289 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"math"
+	"time"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/float"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/spago/nn/normalization/layernorm"
+)
+
+// EncodeParallel encodes the input like EncodeEmbeddings, but with the parallel
+// (GPT-like) formulation of RWKV: the projections of all the tokens are computed
+// at once, with a matrix-matrix multiplication per weight, instead of one
+// matrix-vector multiplication per token. Only the WKV attention, which is
+// element-wise, is computed with a scan over the sequence, as the official CUDA
+// kernel does. It returns the encoding of the last token and the recurrent state
+// after the input, to continue with EncodeEmbeddings.
+//
+// The element-wise operations are computed in double precision, and the values
+// are computed eagerly, without the computational graph.
+func (m *Model) EncodeParallel(s rwkv.State, xs []ag.Node) (ag.Node, rwkv.State) {
+	hs, states := m.EncodeBatch([]rwkv.State{s}, [][]ag.Node{xs})
+	return hs[0][len(xs)-1], states[0]
+}
+
+// EncodeBatch encodes multiple inputs at once with the parallel formulation (see
+// EncodeParallel), stacking their tokens so that each projection is a single
+// matrix-matrix multiplication for the whole batch. It returns the encodings of
+// all the tokens of each input, and the state after each input.
+//
+// states contains the initial state of each input, nil for the empty state, and
+// can be nil itself. Unlike EncodeEmbeddings, it does not modify them, so that
+// the same state can be continued with multiple inputs, e.g. the choices of a
+// question after the encoding of the question. Every input must have at least
+// one token.
+func (m *Model) EncodeBatch(states []rwkv.State, inputs [][]ag.Node) ([][]ag.Node, []rwkv.State) {
+	out := make([]rwkv.State, len(inputs))
+	for i := range out {
+		var s rwkv.State
+		if i < len(states) {
+			s = states[i]
+		}
+		if len(s) == 0 {
+			s = rwkv.NewState(m.Encoder.Config)
+		}
+		out[i] = make(rwkv.State, len(s))
+		for j, ls := range s {
+			cp := *ls
+			out[i][j] = &cp
+		}
+	}
+
+	x := stackSeq(inputs)
+	layerStates := make([]*rwkv.LayerState, len(inputs))
+	for i, layer := range m.Encoder.Layers {
+		for j, s := range out {
+			layerStates[j] = s[i]
+		}
+		x = m.forwardLayerParallel(layer, x, layerStates)
+		if (i+1)%m.Encoder.Config.RescaleLayer == 0 {
+			for j := range x.data {
+				x.data[j] *= 0.5
+			}
+		}
+	}
+
+	hs := make([][]ag.Node, len(inputs))
+	for i, in := range inputs {
+		hs[i] = make([]ag.Node, len(in))
+		for t := range in {
+			hs[i][t] = newVar(m.Linear, x.column(x.starts[i]+t))
+		}
+	}
+	return hs, out
+}
+
+// seq is a batch of sequences of vectors, as a matrix with a column per token:
+// the sequences are consecutive, starting at the given columns.
+type seq struct {
+	rows, cols int
+	data       []float64
+	starts     []int
+}
+
+func (s seq) like() seq {
+	return seq{rows: s.rows, cols: s.cols, data: make([]float64, s.rows*s.cols), starts: s.starts}
+}
+
+// segments calls fn with the span of columns of each sequence.
+func (s seq) segments(fn func(i, from, to int)) {
+	for i, from := range s.starts {
+		to := s.cols
+		if i+1 < len(s.starts) {
+			to = s.starts[i+1]
+		}
+		fn(i, from, to)
+	}
+}
+
+// stackSeq returns the batch of the sequences of the values of the inputs.
+func stackSeq(inputs [][]ag.Node) seq {
+	s := seq{starts: make([]int, len(inputs))}
+	for i, in := range inputs {
+		s.starts[i] = s.cols
+		s.cols += len(in)
+	}
+	c := 0
+	for _, in := range inputs {
+		for _, x := range in {
+			v := x.Value().Data().F64()
+			if s.data == nil {
+				s.rows = len(v)
+				s.data = make([]float64, s.rows*s.cols)
+			}
+			for r, e := range v {
+				s.data[r*s.cols+c] = e
+			}
+			c++
+		}
+	}
+	return s
+}
+
+func (s seq) column(c int) []float64 {
+	out := make([]float64, s.rows)
+	for r := range out {
+		out[r] = s.data[r*s.cols+c]
+	}
+	return out
+}
+
+// newVar returns a variable of the same data type of the parameter.
+func newVar(like nn.Param, data []float64) ag.Node {
+	return ag.Var(like.Value().NewVec(float.SliceInterface(data)))
+}
+
+func values(n ag.Node) []float64 {
+	return n.Value().Data().F64()
+}
+
+// mul returns the product of the weights w and the sequence.
+func mul(w nn.Param, x seq) seq {
+	wm := w.Value()
+	xm := wm.NewMatrix(x.rows, x.cols, float.SliceInterface(x.data))
+	defer mat.ReleaseMatrix(xm)
+	out := wm.Mul(xm)
+	return seq{rows: out.Rows(), cols: x.cols, data: out.Data().F64(), starts: x.starts}
+}
+
+// layerNorm normalizes each vector of the sequence, as layernorm.Model.Forward.
+func layerNorm(ln *layernorm.Model, x seq) seq {
+	w, b, eps := values(ln.W), values(ln.B), ln.Eps.Value().Scalar().F64()
+	out := x.like()
+	n := float64(x.rows)
+	for c := 0; c < x.cols; c++ {
+		var mean, variance float64
+		for r := 0; r < x.rows; r++ {
+			mean += x.data[r*x.cols+c]
+		}
+		mean /= n
+		for r := 0; r < x.rows; r++ {
+			d := x.data[r*x.cols+c] - mean
+			variance += d * d
+		}
+		std := math.Sqrt(variance/n + eps)
+		for r := 0; r < x.rows; r++ {
+			i := r*x.cols + c
+			out.data[i] = (x.data[i]-mean)/std*w[r] + b[r]
+		}
+	}
+	return out
+}
+
+// timeShift mixes each vector of the sequences with the previous one, prevs being
+// the ones before the first of each sequence: coef*x + (1-coef)*previous.
+func timeShift(x seq, prevs [][]float64, coef ag.Node) seq {
+	mix := values(coef)
+	out := x.like()
+	x.segments(func(i, from, to int) {
+		for r := 0; r < x.rows; r++ {
+			p := prevs[i][r]
+			for c := from; c < to; c++ {
+				j := r*x.cols + c
+				out.data[j] = mix[r]*x.data[j] + (1-mix[r])*p
+				p = x.data[j]
+			}
+		}
+	})
+	return out
+}
+
+func (m *Model) forwardLayerParallel(layer *rwkv.Layer, x seq, states []*rwkv.LayerState) seq {
+	timed := func(op string, fn func() seq) seq {
+		if m.profile == nil {
+			return fn()
+		}
+		defer m.profile.record(layer.ID, op, x.cols, time.Now())
+		return fn()
+	}
+	if layer.ID == 0 {
+		x = timed(OpLayerNorm, func() seq { return layerNorm(layer.LN0, x) })
+	}
+	residual := func(y seq) {
+		for i := range x.data {
+			x.data[i] += y.data[i]
+		}
+	}
+	h := timed(OpLayerNorm, func() seq { return layerNorm(layer.LN1, x) })
+	residual(timed(OpTimeMix, func() seq { return timeMixParallel(layer.TimeMix, h, states) }))
+	h = timed(OpLayerNorm, func() seq { return layerNorm(layer.LN2, x) })
+	residual(timed(OpChannelMix, func() seq { return channelMixParallel(layer.ChanMix, h, states) }))
+	return x
+}
+
+func timeMixParallel(m *rwkv.TimeMix, x seq, states []*rwkv.LayerState) seq {
+	prevs := make([][]float64, len(states))
+	for i, s := range states {
+		prevs[i] = values(s.AttXX)
+	}
+	k := mul(m.Key, timeShift(x, prevs, m.TimeMixK))
+	v := mul(m.Value, timeShift(x, prevs, m.TimeMixV))
+	r := mul(m.Receptance, timeShift(x, prevs, m.TimeMixR))
+
+	first, decay := values(m.TimeFirst), values(m.TimeDecay)
+	out := x.like()
+	x.segments(func(i, from, to int) {
+		state := states[i]
+		// copied, since the values may be shared with other states
+		aa := append([]float64(nil), values(state.AttAA)...)
+		bb := append([]float64(nil), values(state.AttBB)...)
+		pp := append([]float64(nil), values(state.AttPP)...)
+		for d := 0; d < x.rows; d++ {
+			a, b, p := aa[d], bb[d], pp[d]
+			for t := from; t < to; t++ {
+				j := d*x.cols + t
+				kt, vt := k.data[j], v.data[j]
+
+				ww := first[d] + kt
+				q := math.Max(p, ww)
+				e1, e2 := math.Exp(p-q), math.Exp(ww-q)
+				out.data[j] = sigmoid(r.data[j]) * (e1*a + e2*vt) / (e1*b + e2)
+
+				ww = p + decay[d]
+				q = math.Max(ww, kt)
+				e1, e2 = math.Exp(ww-q), math.Exp(kt-q)
+				a, b, p = e1*a+e2*vt, e1*b+e2, q
+			}
+			aa[d], bb[d], pp[d] = a, b, p
+		}
+		state.AttXX = newVar(m.Key, x.column(to-1))
+		state.AttAA = newVar(m.Key, aa)
+		state.AttBB = newVar(m.Key, bb)
+		state.AttPP = newVar(m.Key, pp)
+	})
+	return mul(m.Output, out)
+}
+
+func channelMixParallel(m *rwkv.ChannelMix, x seq, states []*rwkv.LayerState) seq {
+	prevs := make([][]float64, len(states))
+	for i, s := range states {
+		prevs[i] = values(s.FfnXX)
+	}
+	k := mul(m.Key, timeShift(x, prevs, m.TimeMixK))
+	for i, e := range k.data {
+		e = math.Max(e, 0)
+		k.data[i] = e * e
+	}
+	kv := mul(m.Value, k)
+	r := mul(m.Receptance, timeShift(x, prevs, m.TimeMixR))
+	for i := range kv.data {
+		kv.data[i] *= sigmoid(r.data[i])
+	}
+	x.segments(func(i, _, to int) {
+		states[i].FfnXX = newVar(m.Key, x.column(to-1))
+	})
+	return kv
+}
+
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
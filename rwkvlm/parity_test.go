@@ -0,0 +1,228 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package rwkvlm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
+	"github.com/nlpodyssey/verbaflow/verrors"
+	"github.com/stretchr/testify/require"
+)
+
+// parityDir contains a tiny RWKV-4 checkpoint, and the outputs of the reference
+// implementation of the official one, see the Python scripts in the directory.
+const parityDir = "testdata/parity"
+
+// parityTolerance is the maximum difference from the reference, computed in
+// double precision, relative to the magnitude of the values above 1.
+const parityTolerance = 1e-4
+
+type parityReference struct {
+	Tokens []int `json:"tokens"`
+	Steps  []struct {
+		Layers [][]float64 `json:"layers"`
+		Logits []float64   `json:"logits"`
+	} `json:"steps"`
+}
+
+// TestParity converts the checkpoint and compares the hidden state after each
+// layer and the logits at each step with the reference outputs, to catch the
+// regressions of the conversion and of the forward pass.
+func TestParity(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(parityDir, "reference.json"))
+	require.NoError(t, err)
+	var ref parityReference
+	require.NoError(t, json.Unmarshal(data, &ref))
+
+	m := convertParityModel(t, 0)
+	ctx := context.Background()
+	rescale := m.Config.RescaleLayer
+
+	t.Run("per layer", func(t *testing.T) {
+		s := rwkv.NewState(m.Encoder.Config)
+		for step, token := range ref.Tokens {
+			x := m.EncodeTokens(ctx, token)[0]
+			for i, layer := range m.Encoder.Layers {
+				x = layer.ForwardSingle(x, s[i])
+				if (i+1)%rescale == 0 {
+					x = ag.ProdScalar(x, ag.Scalar(0.5))
+				}
+				// the converted weights are scaled down every RescaleLayer layers
+				scale := math.Pow(2, float64((i+1)/rescale))
+				assertParity(t, fmt.Sprintf("layer %d at step %d", i, step), ref.Steps[step].Layers[i], x.Value().Data().F64(), scale)
+			}
+			assertParity(t, fmt.Sprintf("logits at step %d", step), ref.Steps[step].Logits, m.Predict(x).Value().Data().F64(), 1)
+		}
+	})
+
+	t.Run("single tokens", func(t *testing.T) {
+		var s rwkv.State
+		for step, token := range ref.Tokens {
+			var x ag.Node
+			x, s = m.Encode(ctx, s, token)
+			assertParity(t, fmt.Sprintf("logits at step %d", step), ref.Steps[step].Logits, m.Predict(x).Value().Data().F64(), 1)
+		}
+	})
+
+	t.Run("sequence", func(t *testing.T) {
+		x, _ := m.Encode(ctx, nil, ref.Tokens...)
+		last := len(ref.Tokens) - 1
+		assertParity(t, "logits of the sequence", ref.Steps[last].Logits, m.Predict(x).Value().Data().F64(), 1)
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		// the state after the parallel encoding of the prefix is used to continue
+		prefix := 6
+		x, s := m.EncodeParallel(nil, m.EncodeTokens(ctx, ref.Tokens[:prefix]...))
+		assertParity(t, "logits of the prefix", ref.Steps[prefix-1].Logits, m.Predict(x).Value().Data().F64(), 1)
+		for step := prefix; step < len(ref.Tokens); step++ {
+			x, s = m.Encode(ctx, s, ref.Tokens[step])
+			assertParity(t, fmt.Sprintf("logits at step %d", step), ref.Steps[step].Logits, m.Predict(x).Value().Data().F64(), 1)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		lengths := []int{4, 1, len(ref.Tokens)}
+		inputs := make([][]ag.Node, len(lengths))
+		for i, n := range lengths {
+			inputs[i] = m.EncodeTokens(ctx, ref.Tokens[:n]...)
+		}
+		hs, states := m.EncodeBatch(nil, inputs)
+		for i, n := range lengths {
+			for step := 0; step < n; step++ {
+				assertParity(t, fmt.Sprintf("logits of input %d at step %d", i, step), ref.Steps[step].Logits, m.Predict(hs[i][step]).Value().Data().F64(), 1)
+			}
+		}
+
+		// the same state continued with two inputs
+		rest := m.EncodeTokens(ctx, ref.Tokens[4:]...)
+		hs, _ = m.EncodeBatch([]rwkv.State{states[0], states[0]}, [][]ag.Node{rest[:2], rest})
+		assertParity(t, "logits of the first continuation", ref.Steps[5].Logits, m.Predict(hs[0][1]).Value().Data().F64(), 1)
+		assertParity(t, "logits of the second continuation", ref.Steps[len(ref.Tokens)-1].Logits, m.Predict(hs[1][len(rest)-1]).Value().Data().F64(), 1)
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		last := len(ref.Tokens) - 1
+		for _, size := range []int{1, 3, len(ref.Tokens)} {
+			var progress []int
+			x, _, err := m.EncodeChunked(ctx, nil, ref.Tokens, EncodeOptions{
+				ChunkSize: size,
+				Progress: func(encoded, total int) {
+					require.Equal(t, len(ref.Tokens), total)
+					progress = append(progress, encoded)
+				},
+			})
+			require.NoError(t, err)
+			assertParity(t, fmt.Sprintf("logits in chunks of %d", size), ref.Steps[last].Logits, m.Predict(x).Value().Data().F64(), 1)
+			require.Len(t, progress, (len(ref.Tokens)+size-1)/size)
+			require.Equal(t, len(ref.Tokens), progress[len(progress)-1])
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		_, _, err := m.EncodeChunked(ctx, nil, ref.Tokens, EncodeOptions{
+			ChunkSize: 4,
+			Progress:  func(int, int) { cancel() },
+		})
+		require.ErrorIs(t, err, verrors.ErrDecodingAborted)
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorContains(t, err, "after encoding 4 of 10 prompt tokens")
+	})
+
+	t.Run("profiled", func(t *testing.T) {
+		p := NewProfile()
+		m.SetProfile(p)
+		defer m.SetProfile(nil)
+
+		last := len(ref.Tokens) - 1
+		x, s := m.Encode(ctx, nil, ref.Tokens[:last]...)
+		x, _ = m.Encode(ctx, s, ref.Tokens[last])
+		assertParity(t, "profiled logits", ref.Steps[last].Logits, m.Predict(x).Value().Data().F64(), 1)
+		x, _ = m.EncodeParallel(nil, m.EncodeTokens(ctx, ref.Tokens...))
+		assertParity(t, "profiled parallel logits", ref.Steps[last].Logits, m.Predict(x).Value().Data().F64(), 1)
+
+		require.Equal(t, OpStats{Calls: 3, Tokens: 2 * len(ref.Tokens)}, withoutTime(p.Op(OpEmbeddings)))
+		require.Equal(t, OpStats{Calls: 2, Tokens: 2}, withoutTime(p.Op(OpHead)))
+		for i := range m.Encoder.Layers {
+			// a call per token, plus the parallel one
+			require.Equal(t, OpStats{Calls: len(ref.Tokens) + 1, Tokens: 2 * len(ref.Tokens)}, withoutTime(p.Layer(i, OpTimeMix)))
+			require.Equal(t, OpStats{Calls: len(ref.Tokens) + 1, Tokens: 2 * len(ref.Tokens)}, withoutTime(p.Layer(i, OpChannelMix)))
+		}
+		var summary strings.Builder
+		require.NoError(t, p.WriteSummary(&summary))
+		for _, op := range opClasses {
+			require.Contains(t, summary.String(), op)
+		}
+		require.Contains(t, summary.String(), "Channel-mix")
+	})
+
+	// the rescaling must not change the predictions, whether set at the conversion or later,
+	// but for the epsilon of the layer normalization, noticeable when halving at every layer
+	for _, rescaleLayer := range []int{NoRescale, 3, 5} {
+		t.Run(fmt.Sprintf("rescale layer %d", rescaleLayer), func(t *testing.T) {
+			for name, m := range map[string]*Model{
+				"converted": convertParityModel(t, rescaleLayer),
+				"set":       convertParityModel(t, 0),
+			} {
+				if name == "set" {
+					require.NoError(t, m.SetRescaleLayer(rescaleLayer))
+				}
+				x, _ := m.Encode(ctx, nil, ref.Tokens...)
+				last := len(ref.Tokens) - 1
+				assertParity(t, name+" logits of the sequence", ref.Steps[last].Logits, m.Predict(x).Value().Data().F64(), 1)
+			}
+		})
+	}
+}
+
+func withoutTime(s OpStats) OpStats {
+	s.Total = 0
+	return s
+}
+
+// convertParityModel converts the checkpoint of the parity test with the given
+// ConverterConfig.RescaleLayer, returning the loaded model.
+func convertParityModel(t *testing.T, rescaleLayer int) *Model {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{DefaultPyModelFilename, "config.json"} {
+		data, err := os.ReadFile(filepath.Join(parityDir, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	require.NoError(t, ConvertPickledModelToRWKVLM[float32](ConverterConfig{ModelDir: dir, RescaleLayer: rescaleLayer}))
+
+	m, err := Load(dir)
+	require.NoError(t, err)
+	repo, err := diskstore.NewRepository(filepath.Join(dir, DefaultEmbeddingRepoPath), diskstore.ReadOnlyMode)
+	require.NoError(t, err)
+	t.Cleanup(func() { repo.Close() })
+	require.NoError(t, m.ApplyEmbeddings(repo))
+	return m
+}
+
+// assertParity checks that the actual values of the named tensor, multiplied by
+// scale, match the expected ones.
+func assertParity(t *testing.T, name string, expected, actual []float64, scale float64) {
+	t.Helper()
+	require.Len(t, actual, len(expected), name)
+	for i, want := range expected {
+		got := actual[i] * scale
+		if tol := parityTolerance * math.Max(1, math.Abs(want)); math.Abs(got-want) > tol {
+			require.Failf(t, "parity mismatch", "%s, index %d: expected %g, actual %g", name, i, want, got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nlpodyssey/rwkv"
+	"github.com/nlpodyssey/spago/ag"
+)
+
+// The operation classes recorded by a Profile.
+const (
+	OpEmbeddings = "embeddings"
+	OpLayerNorm  = "layer-norm"
+	OpTimeMix    = "time-mix"
+	OpChannelMix = "channel-mix"
+	OpHead       = "head"
+)
+
+// opClasses are the operation classes, in the order of the forward pass.
+var opClasses = []string{OpEmbeddings, OpLayerNorm, OpTimeMix, OpChannelMix, OpHead}
+
+// noLayer is the layer of the operations outside the RWKV layers.
+const noLayer = -1
+
+// OpStats is the time spent in an operation class.
+type OpStats struct {
+	// Calls is the number of times the operation was computed.
+	Calls int
+	// Tokens is the number of tokens processed, more than Calls for the
+	// operations computed on sequences.
+	Tokens int
+	// Total is the time spent.
+	Total time.Duration
+}
+
+func (s *OpStats) add(o OpStats) {
+	s.Calls += o.Calls
+	s.Tokens += o.Tokens
+	s.Total += o.Total
+}
+
+// PerToken returns the mean time spent per token.
+func (s OpStats) PerToken() time.Duration {
+	if s.Tokens == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Tokens)
+}
+
+type profileKey struct {
+	layer int
+	op    string
+}
+
+// Profile records the time spent per layer and per operation class by a model
+// it is set to with SetProfile. It can be shared by concurrent generations.
+//
+// The operations of the computational graph run asynchronously: to time them,
+// the profiled model waits for each one to be computed, which makes the
+// inference slower, the more the smaller the model.
+type Profile struct {
+	mu  sync.Mutex
+	ops map[profileKey]*OpStats
+}
+
+// NewProfile returns a new empty Profile.
+func NewProfile() *Profile {
+	return &Profile{ops: make(map[profileKey]*OpStats)}
+}
+
+// SetProfile makes the model record the time spent in its operations in p, or
+// stops the recording if p is nil. It must be called before any inference starts.
+func (m *Model) SetProfile(p *Profile) {
+	m.profile = p
+}
+
+func (p *Profile) record(layer int, op string, tokens int, start time.Time) {
+	elapsed := time.Since(start)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.ops[profileKey{layer, op}]
+	if !ok {
+		s = &OpStats{}
+		p.ops[profileKey{layer, op}] = s
+	}
+	s.add(OpStats{Calls: 1, Tokens: tokens, Total: elapsed})
+}
+
+// Op returns the time spent in the operation class, in all the layers.
+func (p *Profile) Op(op string) OpStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var s OpStats
+	for k, v := range p.ops {
+		if k.op == op {
+			s.add(*v)
+		}
+	}
+	return s
+}
+
+// Layer returns the time spent in the operation class in the layer with the given ID.
+func (p *Profile) Layer(id int, op string) OpStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.ops[profileKey{id, op}]; ok {
+		return *s
+	}
+	return OpStats{}
+}
+
+// layers returns the number of layers recorded.
+func (p *Profile) layers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for k := range p.ops {
+		if k.layer+1 > n {
+			n = k.layer + 1
+		}
+	}
+	return n
+}
+
+// WriteSummary writes the tables of the time spent per operation class and per layer.
+func (p *Profile) WriteSummary(w io.Writer) error {
+	var total time.Duration
+	for _, op := range opClasses {
+		total += p.Op(op).Total
+	}
+	share := func(d time.Duration) string {
+		if total == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(d)/float64(total))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Operation\tCalls\tTokens\tTotal\tPer token\tShare\t")
+	for _, op := range opClasses {
+		s := p.Op(op)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t\n", op, s.Calls, s.Tokens, s.Total, s.PerToken(), share(s.Total))
+	}
+	fmt.Fprintf(tw, "total\t\t\t%s\t\t\t\n", total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Layer\tLayer-norm\tTime-mix\tChannel-mix\tTotal\tShare\t")
+	for i := 0; i < p.layers(); i++ {
+		var layer time.Duration
+		row := fmt.Sprint(i)
+		for _, op := range []string{OpLayerNorm, OpTimeMix, OpChannelMix} {
+			d := p.Layer(i, op).Total
+			layer += d
+			row += "\t" + d.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\n", row, layer, share(layer))
+	}
+	return tw.Flush()
+}
+
+// forwardProfiled is rwkv.Model.ForwardSingle, or ForwardSequence token after
+// token, recording the time spent in each operation of the layers.
+func (m *Model) forwardProfiled(s rwkv.State, xs []ag.Node) (ag.Node, rwkv.State) {
+	if len(s) == 0 {
+		s = rwkv.NewState(m.Encoder.Config)
+	}
+	timed := func(layer int, op string, fn func() ag.Node) ag.Node {
+		start := time.Now()
+		y := ag.WaitForValue(fn())
+		m.profile.record(layer, op, 1, start)
+		return y
+	}
+
+	var x ag.Node
+	for _, x = range xs {
+		for i, layer := range m.Encoder.Layers {
+			state := s[i]
+			if layer.ID == 0 {
+				x = timed(i, OpLayerNorm, func() ag.Node { return layer.LN0.Forward(x)[0] })
+			}
+			h := timed(i, OpLayerNorm, func() ag.Node { return layer.LN1.Forward(x)[0] })
+			h = timed(i, OpTimeMix, func() ag.Node { return layer.TimeMix.ForwardSingle(h, state) })
+			x = ag.Add(x, h)
+			h = timed(i, OpLayerNorm, func() ag.Node { return layer.LN2.Forward(x)[0] })
+			h = timed(i, OpChannelMix, func() ag.Node { return layer.ChanMix.ForwardSingle(h, state) })
+			x = ag.Add(x, h)
+
+			if (i+1)%m.Encoder.Config.RescaleLayer == 0 {
+				x = ag.ProdScalar(x, ag.Scalar(0.5))
+			}
+		}
+	}
+	return x, s
+}
@@ -0,0 +1,256 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package rwkvlm
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+
+	emb "github.com/nlpodyssey/spago/embeddings"
+	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
+	"github.com/rs/zerolog/log"
+)
+
+// EmbeddingsReport describes the state of the embeddings repository of a model.
+type EmbeddingsReport struct {
+	// VocabSize is the number of embeddings expected.
+	VocabSize int `json:"vocab_size"`
+	// Entries is the number of keys in the store.
+	Entries int `json:"entries"`
+	// Missing lists the token IDs without an embedding.
+	Missing []int `json:"missing,omitempty"`
+	// Invalid lists the token IDs whose embedding is unreadable, of the wrong
+	// size, or containing non-finite values.
+	Invalid []int `json:"invalid,omitempty"`
+	// Size is the disk usage of the repository, in bytes.
+	Size int64 `json:"size"`
+}
+
+// OK reports whether all the embeddings are present and valid.
+func (r EmbeddingsReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Invalid) == 0
+}
+
+// CompactionReport describes the outcome of the compaction of an embeddings repository.
+type CompactionReport struct {
+	// Entries is the number of embeddings copied.
+	Entries int `json:"entries"`
+	// SizeBefore and SizeAfter are the disk usage of the repository, in bytes.
+	SizeBefore int64 `json:"size_before"`
+	SizeAfter  int64 `json:"size_after"`
+}
+
+// VerifyEmbeddings checks that the embeddings repository of the converted model
+// in dir contains a valid embedding for every token of the vocabulary.
+func VerifyEmbeddings(dir string) (report EmbeddingsReport, err error) {
+	m, repoPath, err := loadForRepo(dir)
+	if err != nil {
+		return report, err
+	}
+	err = withEmbeddings(m, repoPath, func(tokens *emb.Model[int]) (err error) {
+		report, err = verifyEmbeddings(m, tokens)
+		return err
+	})
+	if err == nil {
+		report.Size, err = dirSize(repoPath)
+	}
+	return report, err
+}
+
+// loadForRepo loads the converted model in dir, and returns the path of its
+// embeddings repository, following the links.
+func loadForRepo(dir string) (*Model, string, error) {
+	m, err := Load(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	repoPath, err := filepath.EvalSymlinks(filepath.Join(dir, DefaultEmbeddingRepoPath))
+	return m, repoPath, err
+}
+
+// withEmbeddings calls fn with the token embeddings of the model, read from the
+// repository in repoPath.
+func withEmbeddings(m *Model, repoPath string, fn func(tokens *emb.Model[int]) error) error {
+	repo, err := diskstore.NewRepository(repoPath, diskstore.ReadOnlyMode)
+	if err != nil {
+		return fmt.Errorf("failed to open embeddings repository: %w", err)
+	}
+	defer repo.Close()
+	if err := m.ApplyEmbeddings(repo); err != nil {
+		return fmt.Errorf("failed to apply embeddings: %w", err)
+	}
+	return fn(m.Embeddings.Tokens)
+}
+
+func verifyEmbeddings(m *Model, tokens *emb.Model[int]) (EmbeddingsReport, error) {
+	report := EmbeddingsReport{VocabSize: m.Config.VocabSize}
+	var err error
+	if report.Entries, err = tokens.Store.KeysCount(); err != nil {
+		return report, err
+	}
+	if m.Config.TiedEmbeddings {
+		// the embeddings are the rows of the output head, the store is empty
+		return report, nil
+	}
+	for id := 0; id < m.Config.VocabSize; id++ {
+		switch checkEmbedding(tokens, id, m.Config.DModel) {
+		case errMissing:
+			report.Missing = append(report.Missing, id)
+		case errInvalid:
+			report.Invalid = append(report.Invalid, id)
+		}
+	}
+	return report, nil
+}
+
+type embeddingError int
+
+const (
+	noError embeddingError = iota
+	errMissing
+	errInvalid
+)
+
+// checkEmbedding checks the embedding of the token, recovering from the panics
+// of the store on corrupted data.
+func checkEmbedding(tokens *emb.Model[int], id, size int) (result embeddingError) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debug().Int("id", id).Msgf("unreadable embedding: %v", r)
+			result = errInvalid
+		}
+	}()
+	e, ok := tokens.Embedding(id)
+	if !ok {
+		return errMissing
+	}
+	v := e.Value()
+	if v == nil {
+		return errMissing
+	}
+	if v.Size() != size {
+		return errInvalid
+	}
+	for _, x := range v.Data().F64() {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return errInvalid
+		}
+	}
+	return noError
+}
+
+// CompactEmbeddings rebuilds the embeddings repository of the converted model in
+// dir, copying the embeddings of the vocabulary to a new key-value store which
+// then replaces the old one. It fails if any embedding is missing or invalid.
+//
+// If the repository is a link (e.g. into the model cache), its target is compacted.
+func CompactEmbeddings(dir string) (report CompactionReport, err error) {
+	m, repoPath, err := loadForRepo(dir)
+	if err != nil {
+		return report, err
+	}
+	if report.SizeBefore, err = dirSize(repoPath); err != nil {
+		return report, err
+	}
+
+	tmpPath := repoPath + ".compact"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return report, err
+	}
+	err = withEmbeddings(m, repoPath, func(tokens *emb.Model[int]) error {
+		verification, err := verifyEmbeddings(m, tokens)
+		if err != nil {
+			return err
+		}
+		if !verification.OK() {
+			return fmt.Errorf("the embeddings repository is damaged (%d missing, %d invalid): convert the model again",
+				len(verification.Missing), len(verification.Invalid))
+		}
+		report.Entries, err = copyEmbeddings(m, tokens, tmpPath)
+		return err
+	})
+	if err != nil {
+		_ = os.RemoveAll(tmpPath)
+		return report, err
+	}
+
+	oldPath := repoPath + ".old"
+	if err := os.Rename(repoPath, oldPath); err != nil {
+		return report, err
+	}
+	if err := os.Rename(tmpPath, repoPath); err != nil {
+		return report, err
+	}
+	if err := os.RemoveAll(oldPath); err != nil {
+		return report, err
+	}
+	report.SizeAfter, err = dirSize(repoPath)
+	return report, err
+}
+
+// ExportEmbeddings writes the embeddings of the converted model in dir to the
+// portable embeddings file dst (see DefaultEmbeddingsFilename).
+func ExportEmbeddings(dir, dst string) (err error) {
+	m, repoPath, err := loadForRepo(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	return withEmbeddings(m, repoPath, func(tokens *emb.Model[int]) error {
+		return writeEmbeddings(f, m, tokens)
+	})
+}
+
+// copyEmbeddings copies the embeddings of the vocabulary to a new repository in
+// dst, returning the number of embeddings copied.
+func copyEmbeddings(m *Model, tokens *emb.Model[int], dst string) (_ int, err error) {
+	repo, err := diskstore.NewRepository(dst, diskstore.ReadWriteMode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create embeddings repository: %w", err)
+	}
+	defer func() {
+		if e := repo.Close(); e != nil && err == nil {
+			err = fmt.Errorf("failed to close embeddings repository: %w", e)
+		}
+	}()
+	if m.Config.TiedEmbeddings {
+		return 0, nil
+	}
+	// the data type only matters for the zero embedding, which is not used
+	embs := NewEmbeddings[float32](tokens.Config, repo)
+	for id := 0; id < m.Config.VocabSize; id++ {
+		embs.Tokens.EmbeddingFast(id).ReplaceValue(tokens.EmbeddingFast(id).Value())
+	}
+	return m.Config.VocabSize, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package rwkvlm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyTinyModel copies the bundled tiny model to a temporary directory.
+func copyTinyModel(t *testing.T) string {
+	t.Helper()
+	src := filepath.Join("..", "testdata", "tiny-rwkv")
+	dst := t.TempDir()
+	err := filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+	require.NoError(t, err)
+	return dst
+}
+
+func TestVerifyAndCompactEmbeddings(t *testing.T) {
+	dir := copyTinyModel(t)
+
+	report, err := VerifyEmbeddings(dir)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, report.VocabSize, report.Entries)
+
+	compaction, err := CompactEmbeddings(dir)
+	require.NoError(t, err)
+	assert.Equal(t, report.VocabSize, compaction.Entries)
+	assert.Positive(t, compaction.SizeAfter)
+
+	report, err = VerifyEmbeddings(dir)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The hidden state of RWKV grows with the depth of the model, overflowing the
+// fp16 range in the larger models: the official implementation halves it every
+// RescaleLayer layers, dividing the output weights of the layers accordingly,
+// which leaves the predictions unchanged.
+const (
+	// DefaultRescaleLayer is the rescaling used when the checkpoint does not
+	// specify it, the same as the official implementation for fp16.
+	DefaultRescaleLayer = 6
+	// NoRescale disables the rescaling, as the RescaleLayer option of the
+	// conversion or of SetRescaleLayer.
+	NoRescale = -1
+)
+
+// layerScale returns the factor by which the output weights of the layer with
+// the given ID are divided, for the given rescaling (disabled if not positive).
+func layerScale(id, rescaleLayer int) float64 {
+	if rescaleLayer <= 0 {
+		return 1
+	}
+	return math.Pow(2, float64(id/rescaleLayer))
+}
+
+// encoderRescaleLayer returns the RescaleLayer of the RWKV encoder for the model
+// configuration. The encoder always rescales, so the rescaling is disabled with
+// a value greater than the number of layers.
+func encoderRescaleLayer(c Config) int {
+	if c.RescaleLayer <= 0 {
+		return c.NumHiddenLayers + 1
+	}
+	return c.RescaleLayer
+}
+
+// SetRescaleLayer changes the rescaling of the model, adjusting its weights so
+// that the predictions do not change, e.g. to disable it (NoRescale) for a model
+// converted with rescaling, which is only needed with fp16. It fails if the
+// weights are shared, see LoadSnapshotShared.
+func (m *Model) SetRescaleLayer(n int) error {
+	if n < NoRescale {
+		return fmt.Errorf("invalid rescale layer %d", n)
+	}
+	if m.sharedWeights {
+		return errors.New("unable to change the rescaling of shared read-only weights: write the snapshot with the rescale layer instead")
+	}
+	if n == NoRescale {
+		n = 0
+	}
+	old := m.Config.RescaleLayer
+	for _, layer := range m.Encoder.Layers {
+		f := layerScale(layer.ID, old) / layerScale(layer.ID, n)
+		if f != 1 {
+			layer.TimeMix.Output.Value().ProdScalarInPlace(f)
+			layer.ChanMix.Value.Value().ProdScalarInPlace(f)
+		}
+	}
+	m.Config.RescaleLayer = n
+	m.Encoder.Config.RescaleLayer = encoderRescaleLayer(m.Config)
+	for _, layer := range m.Encoder.Layers {
+		layer.TimeMix.Config.RescaleLayer = m.Encoder.Config.RescaleLayer
+	}
+	return nil
+}
@@ -9,21 +9,38 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/nlpodyssey/rwkv"
 	"github.com/nlpodyssey/spago/ag"
 	"github.com/nlpodyssey/spago/embeddings"
 	"github.com/nlpodyssey/spago/embeddings/store"
-	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
 	"github.com/nlpodyssey/spago/mat"
 	"github.com/nlpodyssey/spago/mat/float"
 	"github.com/nlpodyssey/spago/nn"
 	"github.com/nlpodyssey/spago/nn/normalization/layernorm"
+	"github.com/nlpodyssey/verbaflow/verrors"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	DefaultPyModelFilename   = "pytorch_model.pt"
+	DefaultOutputFilename    = "spago_model.bin"
+	DefaultEmbeddingRepoPath = "embeddings"
+
+	DefaultLayerNormEps = 1e-5
+)
+
+// Model is the RWKV language model.
+//
+// The inference (Encode, Predict, and the like) never modifies the weights, nor the
+// embeddings, which are only written when loading or converting the model, and by
+// SetRescaleLayer: the same Model can be used by concurrent generations, and its
+// weights can be shared read-only by several processes (see LoadSnapshotShared).
 type Model struct {
 	nn.Module
 	Embeddings *Embeddings
@@ -31,6 +48,11 @@ type Model struct {
 	LN         *layernorm.Model
 	Linear     nn.Param `spago:"type:weights"`
 	Config     Config
+	// profile, if not nil, records the time spent in the operations (see SetProfile).
+	profile *Profile
+	// sharedWeights reports whether the weights are in a read-only mapping of a
+	// snapshot, see LoadSnapshotShared.
+	sharedWeights bool
 }
 
 type Config struct {
@@ -48,24 +70,55 @@ type Config struct {
 	//
 	// When converting a torch model, it can be left zero, letting the
 	// process deduce the value automatically.
-	VocabSize           int    `json:"vocab_size"`
+	VocabSize int `json:"vocab_size"`
+	// RescaleLayer is the number of layers after which the hidden state is halved
+	// (see DefaultRescaleLayer); zero means no rescaling.
+	//
+	// LoadConfig reads it from the "rescale_layer" or "rescale_every" field of the
+	// checkpoint configuration, defaulting to DefaultRescaleLayer.
 	RescaleLayer        int    `json:"rescale_layer"`
 	EmbeddingsStoreName string `json:"embeddings_store_name"`
+	// TiedEmbeddings reports whether the token embeddings are the rows of the
+	// output head (Linear), in which case they are not in the embeddings store.
+	//
+	// When converting a torch model, it is also set if the checkpoint has no head,
+	// or if the head is equal to the embeddings.
+	TiedEmbeddings bool `json:"tie_word_embeddings"`
 }
 
+// LoadConfig loads the model configuration from the given JSON file.
+// It fails with verrors.ErrUnsupportedArchitecture if the file describes a
+// model other than RWKV.
 func LoadConfig(filePath string) (Config, error) {
-	file, err := os.Open(filePath)
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return Config{}, err
 	}
-	defer file.Close()
 
-	var config Config
-	jsonDecoder := json.NewDecoder(file)
-	if err := jsonDecoder.Decode(&config); err != nil {
+	var config struct {
+		Config
+		// ModelType is the architecture, in the Hugging Face configurations.
+		ModelType string `json:"model_type"`
+		// RescaleLayer and RescaleEvery (Hugging Face) are pointers, to tell
+		// the disabled rescaling from the missing one.
+		RescaleLayer *int `json:"rescale_layer"`
+		RescaleEvery *int `json:"rescale_every"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
 		return Config{}, err
 	}
-	return config, nil
+	if config.ModelType != "" && !strings.EqualFold(config.ModelType, "rwkv") {
+		return Config{}, fmt.Errorf("%w: %q", verrors.ErrUnsupportedArchitecture, config.ModelType)
+	}
+	switch {
+	case config.RescaleLayer != nil:
+		config.Config.RescaleLayer = *config.RescaleLayer
+	case config.RescaleEvery != nil:
+		config.Config.RescaleLayer = *config.RescaleEvery
+	default:
+		config.Config.RescaleLayer = DefaultRescaleLayer
+	}
+	return config.Config, nil
 }
 
 func init() {
@@ -78,7 +131,7 @@ func New[T float.DType](c Config, repo store.Repository) *Model {
 		Encoder: rwkv.New[T](rwkv.Config{
 			DModel:       c.DModel,
 			NumLayers:    c.NumHiddenLayers,
-			RescaleLayer: c.RescaleLayer,
+			RescaleLayer: encoderRescaleLayer(c),
 		}),
 		LN:     layernorm.New[T](c.DModel, 1e-6),
 		Linear: nn.NewParam(mat.NewEmptyDense[T](c.VocabSize, c.DModel)),
@@ -99,6 +152,11 @@ func Load(dir string) (*Model, error) {
 	return m, nil
 }
 
+// LoadFrom reads a converted model from r, in the format of the model file.
+func LoadFrom(r io.Reader) (*Model, error) {
+	return gobDecoding(r)
+}
+
 // Dump saves the Model to a file.
 // See gobEncode for further details.
 func Dump(obj *Model, filename string) error {
@@ -118,7 +176,7 @@ func Dump(obj *Model, filename string) error {
 }
 
 // ApplyEmbeddings sets the embeddings of the model.
-func (m *Model) ApplyEmbeddings(repo *diskstore.Repository) (err error) {
+func (m *Model) ApplyEmbeddings(repo store.Repository) (err error) {
 	nn.Apply(m, func(model nn.Model, name string) {
 		switch em := model.(type) {
 		case *embeddings.Model[[]byte], *embeddings.Model[int], *embeddings.Model[string]:
@@ -134,18 +192,48 @@ func (m *Model) ApplyEmbeddings(repo *diskstore.Repository) (err error) {
 
 // Encode performs EncodeTokens and EncodeEmbeddings.
 func (m *Model) Encode(ctx context.Context, s rwkv.State, tokens ...int) (ag.Node, rwkv.State) {
-	return m.EncodeEmbeddings(ctx, s, m.Embeddings.Encode(tokens))
+	return m.EncodeEmbeddings(ctx, s, m.EncodeTokens(ctx, tokens...))
 }
 
 // EncodeTokens returns the embeddings of the given tokens.
+// If the embeddings are tied, they are extracted from the rows of the output head.
 func (m *Model) EncodeTokens(_ context.Context, tokens ...int) []ag.Node {
-	return m.Embeddings.Encode(tokens)
+	if m.profile != nil {
+		defer m.profile.record(noLayer, OpEmbeddings, len(tokens), time.Now())
+	}
+	if !m.Config.TiedEmbeddings {
+		return m.Embeddings.Encode(tokens)
+	}
+	xs := make([]ag.Node, len(tokens))
+	for i, id := range tokens {
+		xs[i] = ag.Var(m.Linear.Value().ExtractRow(id).T())
+	}
+	return xs
+}
+
+// tokenEmbedding returns the embedding of the token, read from tokens, or from
+// the output head if the embeddings are tied.
+func (m *Model) tokenEmbedding(tokens *embeddings.Model[int], id int) (mat.Matrix, bool) {
+	if m.Config.TiedEmbeddings {
+		if id < 0 || id >= m.Linear.Value().Rows() {
+			return nil, false
+		}
+		return m.Linear.Value().ExtractRow(id).T(), true
+	}
+	e, ok := tokens.Embedding(id)
+	if !ok {
+		return nil, false
+	}
+	return e.Value(), true
 }
 
 // EncodeEmbeddings returns the encoding of the given input considering the last state.
 // At least one token is required, otherwise can panic.
 // If the input is a sequence, the last state is returned.
 func (m *Model) EncodeEmbeddings(_ context.Context, s rwkv.State, xs []ag.Node) (ag.Node, rwkv.State) {
+	if m.profile != nil {
+		return m.forwardProfiled(s, xs)
+	}
 	if len(xs) == 1 {
 		return m.Encoder.ForwardSingle(xs[0], s)
 	}
@@ -156,7 +244,71 @@ func (m *Model) EncodeEmbeddings(_ context.Context, s rwkv.State, xs []ag.Node)
 	return h[len(h)-1], s
 }
 
+// DefaultEncodeChunkSize is the default EncodeOptions.ChunkSize.
+const DefaultEncodeChunkSize = 256
+
+// EncodeOptions are the options of EncodeChunked and EncodeEmbeddingsChunked.
+type EncodeOptions struct {
+	// ChunkSize is the number of tokens encoded at a time (default: DefaultEncodeChunkSize).
+	ChunkSize int
+	// Progress, when not nil, is called after each chunk with the number of tokens
+	// encoded so far, and the total.
+	Progress func(encoded, total int)
+	// Sequential encodes the tokens one after the other with the recurrent
+	// formulation (EncodeEmbeddings), instead of the parallel one (EncodeParallel).
+	Sequential bool
+}
+
+// EncodeChunked performs EncodeTokens and EncodeEmbeddingsChunked.
+func (m *Model) EncodeChunked(ctx context.Context, s rwkv.State, tokens []int, opts EncodeOptions) (ag.Node, rwkv.State, error) {
+	return m.EncodeEmbeddingsChunked(ctx, s, m.EncodeTokens(ctx, tokens...), opts)
+}
+
+// EncodeEmbeddingsChunked is like EncodeEmbeddings, but encodes the input in chunks
+// of opts.ChunkSize tokens, with EncodeParallel unless opts.Sequential is true,
+// waiting for each one to be computed, so that the cancellation of ctx is checked,
+// and the progress reported, between them.
+// If ctx is done, it fails with an error wrapping verrors.ErrDecodingAborted and
+// the error of the context.
+func (m *Model) EncodeEmbeddingsChunked(ctx context.Context, s rwkv.State, xs []ag.Node, opts EncodeOptions) (ag.Node, rwkv.State, error) {
+	size := opts.ChunkSize
+	if size <= 0 {
+		size = DefaultEncodeChunkSize
+	}
+	var x ag.Node
+	for start := 0; start < len(xs); start += size {
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("%w after encoding %d of %d prompt tokens: %w", verrors.ErrDecodingAborted, start, len(xs), ctx.Err())
+		default:
+		}
+		end := start + size
+		if end > len(xs) {
+			end = len(xs)
+		}
+		if opts.Sequential || end-start == 1 {
+			x, s = m.EncodeEmbeddings(ctx, s, xs[start:end])
+			ag.WaitForValue(x)
+		} else {
+			x, s = m.EncodeParallel(s, xs[start:end])
+		}
+		if opts.Progress != nil {
+			opts.Progress(end, len(xs))
+		}
+	}
+	return x, s, nil
+}
+
 // Predict returns the prediction logits of the next token.
 func (m *Model) Predict(x ag.Node) ag.Node {
+	if m.profile != nil {
+		start := time.Now()
+		x = ag.WaitForValue(m.LN.Forward(x)[0])
+		m.profile.record(noLayer, OpLayerNorm, 1, start)
+		start = time.Now()
+		y := ag.WaitForValue(ag.Mul(m.Linear, x))
+		m.profile.record(noLayer, OpHead, 1, start)
+		return y
+	}
 	return ag.Mul(m.Linear, m.LN.Forward(x)[0])
 }
@@ -0,0 +1,52 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"unsafe"
+
+	"github.com/nlpodyssey/spago/mat"
+)
+
+// denseLayout mirrors the layout of mat.Dense, whose fields are not exported,
+// to build matrices on the memory of a snapshot without copying it.
+type denseLayout struct {
+	rows  int
+	cols  int
+	flags byte
+	data  []float32
+}
+
+// canShare reports whether the tensors of the snapshots can be used in place:
+// the values must be stored with the byte order of the host (little-endian),
+// and denseLayout must match mat.Dense, which is checked on a sample matrix
+// (failing, e.g., after an upgrade of spago). Otherwise, the tensors are copied.
+var canShare = func() bool {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) != 1 {
+		return false
+	}
+	d := mat.NewDense[float32](2, 3, make([]float32, 6))
+	l := (*denseLayout)(unsafe.Pointer(d))
+	return unsafe.Sizeof(*d) == unsafe.Sizeof(*l) &&
+		l.rows == 2 && l.cols == 3 && len(l.data) == 6 &&
+		&l.data[0] == &d.Data().F32()[0]
+}()
+
+// sharedDense returns a rows×cols matrix whose values are the little-endian
+// float32 values in b, which is used in place, so it must be aligned to 4 bytes
+// and never modified while the matrix is in use. The matrix does not come from
+// the pool of spago, so mat.ReleaseMatrix panics instead of recycling it.
+func sharedDense(b []byte, rows, cols int) *mat.Dense[float32] {
+	d := new(mat.Dense[float32])
+	l := (*denseLayout)(unsafe.Pointer(d))
+	l.rows, l.cols = rows, cols
+	if n := rows * cols; n > 0 {
+		l.data = unsafe.Slice((*float32)(unsafe.Pointer(&b[0])), n)
+	} else {
+		l.data = []float32{}
+	}
+	return d
+}
@@ -0,0 +1,341 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rwkvlm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/nlpodyssey/spago/embeddings/store/memstore"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/nn"
+)
+
+// SnapshotVersion is the version of the snapshot files written by WriteSnapshot.
+const SnapshotVersion = 1
+
+// A snapshot file contains the magic bytes, the length of the JSON header (uint64)
+// and the header, followed by the tensors of the model as little-endian float32
+// values. The tensors start at a multiple of snapshotPageSize, each one at a
+// multiple of snapshotTensorAlignment, so that they can be used in place once
+// the file is mapped in memory.
+var snapshotMagic = []byte("VFSNAP\x00\x01")
+
+const (
+	snapshotPageSize        = 4096
+	snapshotTensorAlignment = 64
+	// snapshotEmbeddings is the name of the tensor with the token embeddings,
+	// one per row.
+	snapshotEmbeddings = "embeddings"
+)
+
+type snapshotHeader struct {
+	Version int              `json:"version"`
+	Config  Config           `json:"config"`
+	Tensors []snapshotTensor `json:"tensors"`
+	// Files are the other files of the model, such as the tokenizer.
+	Files map[string][]byte `json:"files,omitempty"`
+}
+
+type snapshotTensor struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+	Cols int    `json:"cols"`
+	// Offset is the position of the tensor from the start of the tensors.
+	Offset int64 `json:"offset"`
+}
+
+func (t snapshotTensor) size() int64 {
+	return 4 * int64(t.Rows) * int64(t.Cols)
+}
+
+type namedParam struct {
+	name  string
+	param nn.Param
+}
+
+// snapshotParams returns the parameters of the model, but for the token embeddings,
+// in the order of the snapshot.
+func snapshotParams(m *Model) []namedParam {
+	params := []namedParam{{"head", m.Linear}}
+	nn.ForEachParam(m.LN, func(p nn.Param, name string, _ nn.ParamsType) {
+		params = append(params, namedParam{"ln." + name, p})
+	})
+	for i, layer := range m.Encoder.Layers {
+		nn.ForEachParam(layer, func(p nn.Param, name string, _ nn.ParamsType) {
+			params = append(params, namedParam{fmt.Sprintf("layers.%d.%s", i, name), p})
+		})
+	}
+	return params
+}
+
+// IsSnapshot reports whether r starts with the magic bytes of a snapshot file.
+func IsSnapshot(r io.Reader) bool {
+	magic := make([]byte, len(snapshotMagic))
+	_, err := io.ReadFull(r, magic)
+	return err == nil && bytes.Equal(magic, snapshotMagic)
+}
+
+// WriteSnapshot writes to w the snapshot of the loaded model, with its embeddings
+// applied, and the given files (e.g. the tokenizer), read back by LoadSnapshot.
+//
+// Unlike the model file, the snapshot contains the weights as they are in memory,
+// along with the embeddings of all the tokens, so that loading it is mostly copying.
+func WriteSnapshot(w io.Writer, m *Model, files map[string][]byte) error {
+	params := snapshotParams(m)
+	h := snapshotHeader{Version: SnapshotVersion, Config: m.Config, Files: files}
+	var offset int64
+	addTensor := func(name string, rows, cols int) {
+		t := snapshotTensor{Name: name, Rows: rows, Cols: cols, Offset: offset}
+		h.Tensors = append(h.Tensors, t)
+		offset = alignOffset(offset+t.size(), snapshotTensorAlignment)
+	}
+	for _, p := range params {
+		addTensor(p.name, p.param.Value().Rows(), p.param.Value().Columns())
+	}
+	if !m.Config.TiedEmbeddings {
+		addTensor(snapshotEmbeddings, m.Config.VocabSize, m.Config.DModel)
+	}
+	header, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	bw := &snapshotWriter{w: bufio.NewWriter(w)}
+	bw.write(snapshotMagic)
+	bw.write(binary.LittleEndian.AppendUint64(nil, uint64(len(header))))
+	bw.write(header)
+	bw.pad(snapshotPageSize)
+	start := bw.n
+	for i, p := range params {
+		bw.padTo(start + h.Tensors[i].Offset)
+		bw.writeFloat32s(p.param.Value().Data().F32())
+	}
+	if !m.Config.TiedEmbeddings {
+		bw.padTo(start + h.Tensors[len(params)].Offset)
+		for id := 0; id < m.Config.VocabSize && bw.err == nil; id++ {
+			e, ok := m.tokenEmbedding(m.Embeddings.Tokens, id)
+			if !ok {
+				return fmt.Errorf("missing embedding for token %d", id)
+			}
+			data := e.Data().F32()
+			if len(data) != m.Config.DModel {
+				return fmt.Errorf("invalid embedding size for token %d: %d, expected %d", id, len(data), m.Config.DModel)
+			}
+			bw.writeFloat32s(data)
+		}
+	}
+	if bw.err != nil {
+		return bw.err
+	}
+	return bw.w.Flush()
+}
+
+// LoadSnapshot loads the model from the snapshot file written by WriteSnapshot,
+// mapping it in memory where supported, and returns it along with the files
+// stored in the snapshot. The embeddings are kept in memory.
+func LoadSnapshot(path string) (_ *Model, _ map[string][]byte, err error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if e := unmap(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	return readSnapshot(data, false)
+}
+
+// LoadSnapshotShared is like LoadSnapshot, but the weights and the embeddings are
+// used in place in the mapping of the file, instead of being copied in the memory
+// of the process: the processes loading the same snapshot share the memory of the
+// weights, through the page cache. The mapping is read-only and private (copy-on-write),
+// so an attempt to modify the weights crashes the process instead of changing them
+// for the others, or in the file; SetRescaleLayer fails.
+//
+// The returned closer releases the mapping: the model must not be used afterwards.
+// Where the weights can not be shared (e.g. on big-endian hosts, or if the file can
+// not be mapped in memory), they are copied as by LoadSnapshot.
+func LoadSnapshotShared(path string) (*Model, map[string][]byte, io.Closer, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	shared := canShare && mapped
+	m, files, err := readSnapshot(data, shared)
+	if err != nil || !shared {
+		if e := unmap(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return m, files, closerFunc(func() error { return nil }), nil
+	}
+	return m, files, closerFunc(unmap), nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// readSnapshot decodes the snapshot in data, copying the tensors to the model,
+// unless shared is true: then they are used in place, and data must stay
+// unchanged as long as the model is in use.
+func readSnapshot(data []byte, shared bool) (*Model, map[string][]byte, error) {
+	h, tensors, err := readSnapshotHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := New[float32](h.Config, memstore.NewRepository())
+	params := snapshotParams(m)
+	expected := len(params)
+	if !h.Config.TiedEmbeddings {
+		expected++
+	}
+	if len(h.Tensors) != expected {
+		return nil, nil, fmt.Errorf("rwkvlm: invalid snapshot: %d tensors, the model has %d", len(h.Tensors), expected)
+	}
+	tensorData := func(t snapshotTensor, rows, cols int) ([]byte, error) {
+		if t.Rows != rows || t.Cols != cols {
+			return nil, fmt.Errorf("rwkvlm: invalid snapshot: tensor %s is %dx%d, expected %dx%d", t.Name, t.Rows, t.Cols, rows, cols)
+		}
+		if t.Offset < 0 || t.Offset%snapshotTensorAlignment != 0 || t.Offset+t.size() > int64(len(tensors)) {
+			return nil, fmt.Errorf("rwkvlm: invalid snapshot: tensor %s out of bounds", t.Name)
+		}
+		return tensors[t.Offset : t.Offset+t.size()], nil
+	}
+
+	for i, p := range params {
+		t := h.Tensors[i]
+		if t.Name != p.name {
+			return nil, nil, fmt.Errorf("rwkvlm: invalid snapshot: tensor %s, expected %s", t.Name, p.name)
+		}
+		value := p.param.Value()
+		b, err := tensorData(t, value.Rows(), value.Columns())
+		if err != nil {
+			return nil, nil, err
+		}
+		if shared {
+			p.param.ReplaceValue(sharedDense(b, t.Rows, t.Cols))
+		} else {
+			decodeFloat32s(value.Data().F32(), b)
+		}
+	}
+	if !h.Config.TiedEmbeddings {
+		dModel := h.Config.DModel
+		b, err := tensorData(h.Tensors[len(params)], h.Config.VocabSize, dModel)
+		if err != nil {
+			return nil, nil, err
+		}
+		for id := 0; id < h.Config.VocabSize; id++ {
+			var e *mat.Dense[float32]
+			if shared {
+				e = sharedDense(b[4*id*dModel:], dModel, 1)
+			} else {
+				e = mat.NewEmptyVecDense[float32](dModel)
+				decodeFloat32s(e.Data().F32(), b[4*id*dModel:])
+			}
+			m.Embeddings.Tokens.EmbeddingFast(id).ReplaceValue(e)
+		}
+	}
+	m.sharedWeights = shared
+	return m, h.Files, nil
+}
+
+// readSnapshotHeader decodes the header of the snapshot in data, returning it
+// along with the section of the tensors.
+func readSnapshotHeader(data []byte) (snapshotHeader, []byte, error) {
+	var h snapshotHeader
+	prefix := len(snapshotMagic) + 8
+	if len(data) < prefix || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return h, nil, errors.New("rwkvlm: not a snapshot file")
+	}
+	size := binary.LittleEndian.Uint64(data[len(snapshotMagic):])
+	if size > uint64(len(data)-prefix) {
+		return h, nil, errors.New("rwkvlm: invalid snapshot: truncated header")
+	}
+	if err := json.Unmarshal(data[prefix:prefix+int(size)], &h); err != nil {
+		return h, nil, fmt.Errorf("rwkvlm: invalid snapshot: %w", err)
+	}
+	if h.Version > SnapshotVersion {
+		return h, nil, fmt.Errorf("rwkvlm: the snapshot has version %d, newer than the supported %d: upgrade verbaflow to read it", h.Version, SnapshotVersion)
+	}
+	if c := h.Config; c.DModel <= 0 || c.NumHiddenLayers < 0 || c.VocabSize <= 0 {
+		return h, nil, fmt.Errorf("rwkvlm: invalid snapshot: invalid configuration %+v", c)
+	}
+	start := alignOffset(int64(prefix)+int64(size), snapshotPageSize)
+	if start > int64(len(data)) {
+		return h, nil, errors.New("rwkvlm: invalid snapshot: truncated tensors")
+	}
+	return h, data[start:], nil
+}
+
+func decodeFloat32s(dst []float32, b []byte) {
+	for i := range dst {
+		dst[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+}
+
+func alignOffset(offset, alignment int64) int64 {
+	return (offset + alignment - 1) / alignment * alignment
+}
+
+// snapshotWriter writes the snapshot, keeping track of its position and of the
+// first error.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	n   int64
+	buf []byte
+	err error
+}
+
+func (w *snapshotWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	var n int
+	n, w.err = w.w.Write(p)
+	w.n += int64(n)
+}
+
+// writeFloat32s writes the values in chunks of at most snapshotPageSize bytes.
+func (w *snapshotWriter) writeFloat32s(data []float32) {
+	if w.buf == nil {
+		w.buf = make([]byte, snapshotPageSize)
+	}
+	for len(data) > 0 && w.err == nil {
+		n := len(data)
+		if n > snapshotPageSize/4 {
+			n = snapshotPageSize / 4
+		}
+		for i, v := range data[:n] {
+			binary.LittleEndian.PutUint32(w.buf[4*i:], math.Float32bits(v))
+		}
+		w.write(w.buf[:4*n])
+		data = data[n:]
+	}
+}
+
+// pad writes zeros up to the next multiple of alignment.
+func (w *snapshotWriter) pad(alignment int64) {
+	w.padTo(alignOffset(w.n, alignment))
+}
+
+// padTo writes zeros up to the given position.
+func (w *snapshotWriter) padTo(offset int64) {
+	if offset > w.n {
+		w.write(make([]byte, offset-w.n))
+	}
+}
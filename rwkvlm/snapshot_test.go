@@ -0,0 +1,49 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package rwkvlm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	emb "github.com/nlpodyssey/spago/embeddings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSnapshotShared(t *testing.T) {
+	require.True(t, canShare, "denseLayout does not match mat.Dense")
+
+	m, repoPath, err := loadForRepo(filepath.Join("..", "testdata", "tiny-rwkv"))
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "tiny.snapshot")
+	err = withEmbeddings(m, repoPath, func(*emb.Model[int]) error {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return WriteSnapshot(f, m, nil)
+	})
+	require.NoError(t, err)
+
+	copied, _, err := LoadSnapshot(path)
+	require.NoError(t, err)
+	shared, _, weights, err := LoadSnapshotShared(path)
+	require.NoError(t, err)
+	defer weights.Close()
+	assert.True(t, shared.sharedWeights)
+	assert.Error(t, shared.SetRescaleLayer(NoRescale))
+
+	// the inference reads the weights only: a write to the read-only mapping would crash
+	ctx, tokens := context.Background(), []int{1, 2, 3, 4}
+	x, _ := copied.Encode(ctx, nil, tokens...)
+	y, _ := shared.Encode(ctx, nil, tokens...)
+	assert.Equal(t, copied.Predict(x).Value().Data().F32(), shared.Predict(y).Value().Data().F32())
+}
@@ -0,0 +1,157 @@
+# Copyright 2023 NLP Odyssey Authors. All rights reserved.
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file.
+
+"""Writes the tiny RWKV-4 checkpoint of the parity test.
+
+The checkpoint has the parameter names and shapes of the official RWKV-4
+checkpoints, with bfloat16 random weights, and is written in the zip format of
+torch.save, so that it goes through the same conversion as the real models.
+PyTorch is not required: the pickled tensors refer to the torch classes by name.
+
+    python3 make_checkpoint.py && python3 reference.py
+"""
+
+import collections
+import io
+import json
+import pickle
+import random
+import struct
+import sys
+import types
+import zipfile
+
+D_MODEL = 8
+NUM_LAYERS = 4
+VOCAB_SIZE = 16
+RESCALE_LAYER = 2
+SEED = 42
+
+
+def _fake_torch():
+    """Returns the stand-ins of torch.BFloat16Storage and torch._utils._rebuild_tensor_v2,
+    registered under their module names so that pickle refers to them as torch does."""
+    torch = types.ModuleType("torch")
+    utils = types.ModuleType("torch._utils")
+
+    class BFloat16Storage:
+        pass
+
+    def _rebuild_tensor_v2(*args):
+        raise NotImplementedError
+
+    BFloat16Storage.__module__ = "torch"
+    BFloat16Storage.__qualname__ = "BFloat16Storage"
+    _rebuild_tensor_v2.__module__ = "torch._utils"
+    _rebuild_tensor_v2.__qualname__ = "_rebuild_tensor_v2"
+    torch.BFloat16Storage = BFloat16Storage
+    torch._utils = utils
+    utils._rebuild_tensor_v2 = _rebuild_tensor_v2
+    sys.modules.setdefault("torch", torch)
+    sys.modules.setdefault("torch._utils", utils)
+    return BFloat16Storage, _rebuild_tensor_v2
+
+
+BFloat16Storage, rebuild_tensor_v2 = _fake_torch()
+
+
+def to_bf16(value):
+    """Returns the bfloat16 encoding of value, rounding to the nearest even."""
+    bits = struct.unpack("<I", struct.pack("<f", value))[0]
+    return (bits + 0x7FFF + ((bits >> 16) & 1)) >> 16
+
+
+class Storage:
+    def __init__(self, key, values):
+        self.key = key
+        self.values = values
+
+
+class Tensor:
+    def __init__(self, storage, shape):
+        self.storage = storage
+        self.shape = shape
+
+    def __reduce__(self):
+        stride, n = [], 1
+        for size in reversed(self.shape):
+            stride.insert(0, n)
+            n *= size
+        args = (self.storage, 0, tuple(self.shape), tuple(stride), False, collections.OrderedDict())
+        return rebuild_tensor_v2, args
+
+
+class Pickler(pickle.Pickler):
+    def persistent_id(self, obj):
+        if isinstance(obj, Storage):
+            return ("storage", BFloat16Storage, obj.key, "cpu", len(obj.values))
+        return None
+
+
+def make_params(rng):
+    d, f = D_MODEL, 4 * D_MODEL
+    shapes = collections.OrderedDict()
+    shapes["emb.weight"] = ([VOCAB_SIZE, d], -1, 1)
+    for i in range(NUM_LAYERS):
+        p = "blocks.%d." % i
+        if i == 0:
+            shapes[p + "ln0.weight"] = ([d], 0.8, 1.2)
+            shapes[p + "ln0.bias"] = ([d], -0.1, 0.1)
+        for ln in ("ln1", "ln2"):
+            shapes[p + ln + ".weight"] = ([d], 0.8, 1.2)
+            shapes[p + ln + ".bias"] = ([d], -0.1, 0.1)
+        shapes[p + "att.time_decay"] = ([d], -1, 1)
+        shapes[p + "att.time_first"] = ([d], -1, 1)
+        for mix in ("k", "v", "r"):
+            shapes[p + "att.time_mix_" + mix] = ([1, 1, d], 0, 1)
+        for w in ("key", "value", "receptance", "output"):
+            shapes[p + "att." + w + ".weight"] = ([d, d], -0.5, 0.5)
+        for mix in ("k", "r"):
+            shapes[p + "ffn.time_mix_" + mix] = ([1, 1, d], 0, 1)
+        shapes[p + "ffn.key.weight"] = ([f, d], -0.5, 0.5)
+        shapes[p + "ffn.receptance.weight"] = ([d, d], -0.5, 0.5)
+        shapes[p + "ffn.value.weight"] = ([d, f], -0.5, 0.5)
+    shapes["ln_out.weight"] = ([d], 0.8, 1.2)
+    shapes["ln_out.bias"] = ([d], -0.1, 0.1)
+    shapes["head.weight"] = ([VOCAB_SIZE, d], -0.5, 0.5)
+
+    params = collections.OrderedDict()
+    for key, (name, (shape, low, high)) in enumerate(shapes.items()):
+        n = 1
+        for size in shape:
+            n *= size
+        values = [to_bf16(rng.uniform(low, high)) for _ in range(n)]
+        params[name] = Tensor(Storage(str(key), values), shape)
+    return params
+
+
+def main():
+    params = make_params(random.Random(SEED))
+    with zipfile.ZipFile("pytorch_model.pt", "w") as zf:
+
+        def write(name, data):
+            # a fixed timestamp keeps the file reproducible
+            zf.writestr(zipfile.ZipInfo("archive/" + name, date_time=(2023, 1, 1, 0, 0, 0)), data)
+
+        data = io.BytesIO()
+        Pickler(data, protocol=2).dump(params)
+        write("data.pkl", data.getvalue())
+        for tensor in params.values():
+            st = tensor.storage
+            write("data/" + st.key, struct.pack("<%dH" % len(st.values), *st.values))
+        write("version", "3\n")
+    config = {
+        "d_model": D_MODEL,
+        "num_hidden_layers": NUM_LAYERS,
+        "vocab_size": VOCAB_SIZE,
+        "rescale_layer": RESCALE_LAYER,
+        "embeddings_store_name": "embeddings",
+    }
+    with open("config.json", "w") as f:
+        json.dump(config, f, indent=2)
+        f.write("\n")
+
+
+if __name__ == "__main__":
+    main()
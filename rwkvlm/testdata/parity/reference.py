@@ -0,0 +1,163 @@
+# Copyright 2023 NLP Odyssey Authors. All rights reserved.
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file.
+
+"""Records the reference outputs of the parity test.
+
+The forward pass is a line-by-line transcription of the RNN mode of the official
+RWKV-4 implementation (BlinkDL's RWKV_in_150_lines.py), in plain Python and in
+double precision, so that it runs without PyTorch. For each token of TOKENS, it
+records the hidden state after each block and the logits, in reference.json.
+
+    python3 make_checkpoint.py && python3 reference.py
+"""
+
+import collections
+import json
+import math
+import pickle
+import struct
+import zipfile
+
+TOKENS = [1, 5, 3, 7, 2, 9, 0, 4, 15, 11]
+
+
+def load_checkpoint(filename):
+    """Loads the bfloat16 tensors of a torch.save zip file as (shape, values) pairs."""
+    zf = zipfile.ZipFile(filename)
+    prefix = zf.namelist()[0].split("/")[0]
+
+    def rebuild_tensor(storage, offset, size, stride, requires_grad, hooks):
+        n = 1
+        for s in size:
+            n *= s
+        return list(size), storage[offset : offset + n]
+
+    class Unpickler(pickle.Unpickler):
+        def find_class(self, module, name):
+            if (module, name) == ("torch._utils", "_rebuild_tensor_v2"):
+                return rebuild_tensor
+            if (module, name) == ("torch", "BFloat16Storage"):
+                return name
+            if (module, name) == ("collections", "OrderedDict"):
+                return collections.OrderedDict
+            raise pickle.UnpicklingError("unexpected class %s.%s" % (module, name))
+
+        def persistent_load(self, pid):
+            _, _, key, _, numel = pid
+            data = zf.read("%s/data/%s" % (prefix, key))
+            halves = struct.unpack("<%dH" % numel, data)
+            return [struct.unpack("<f", struct.pack("<I", h << 16))[0] for h in halves]
+
+    with zf.open(prefix + "/data.pkl") as f:
+        return Unpickler(f).load()
+
+
+class RWKV_RNN:
+    def __init__(self, filename):
+        w = load_checkpoint(filename)
+        self.w = {}
+        for k, (shape, values) in w.items():
+            if ".time_" in k:
+                shape = [shape[-1]]  # squeeze
+            if ".time_decay" in k:
+                values = [-math.exp(v) for v in values]
+            self.w[k] = values if len(shape) == 1 else [values[i * shape[1] : (i + 1) * shape[1]] for i in range(shape[0])]
+        self.n_layer = 1 + max(int(k.split(".")[1]) for k in w if k.startswith("blocks."))
+        self.n_embd = len(self.w["emb.weight"][0])
+
+    def layer_norm(self, x, name):
+        weight, bias = self.w[name + ".weight"], self.w[name + ".bias"]
+        mean = sum(x) / len(x)
+        var = sum((v - mean) ** 2 for v in x) / len(x)
+        return [(v - mean) / math.sqrt(var + 1e-5) * weight[i] + bias[i] for i, v in enumerate(x)]
+
+    def channel_mixing(self, x, state, i, p):
+        w = self.w
+        xk = mix(x, state[5 * i + 0], w[p + "time_mix_k"])
+        xr = mix(x, state[5 * i + 0], w[p + "time_mix_r"])
+        state[5 * i + 0] = x
+        r = [sigmoid(v) for v in matvec(w[p + "receptance.weight"], xr)]
+        k = [max(v, 0) ** 2 for v in matvec(w[p + "key.weight"], xk)]
+        return [a * b for a, b in zip(r, matvec(w[p + "value.weight"], k))]
+
+    def time_mixing(self, x, state, i, p):
+        w = self.w
+        xk = mix(x, state[5 * i + 1], w[p + "time_mix_k"])
+        xv = mix(x, state[5 * i + 1], w[p + "time_mix_v"])
+        xr = mix(x, state[5 * i + 1], w[p + "time_mix_r"])
+        state[5 * i + 1] = x
+
+        r = [sigmoid(v) for v in matvec(w[p + "receptance.weight"], xr)]
+        k = matvec(w[p + "key.weight"], xk)
+        v = matvec(w[p + "value.weight"], xv)
+
+        aa, bb, pp = state[5 * i + 2], state[5 * i + 3], state[5 * i + 4]
+        wkv = []
+        for j in range(self.n_embd):
+            ww = w[p + "time_first"][j] + k[j]
+            qq = max(pp[j], ww)
+            e1, e2 = math.exp(pp[j] - qq), math.exp(ww - qq)
+            a = e1 * aa[j] + e2 * v[j]
+            b = e1 * bb[j] + e2
+            wkv.append(a / b)
+        new_aa, new_bb, new_pp = [], [], []
+        for j in range(self.n_embd):
+            ww = pp[j] + w[p + "time_decay"][j]
+            qq = max(ww, k[j])
+            e1, e2 = math.exp(ww - qq), math.exp(k[j] - qq)
+            new_aa.append(e1 * aa[j] + e2 * v[j])
+            new_bb.append(e1 * bb[j] + e2)
+            new_pp.append(qq)
+        state[5 * i + 2], state[5 * i + 3], state[5 * i + 4] = new_aa, new_bb, new_pp
+
+        return matvec(w[p + "output.weight"], [a * b for a, b in zip(r, wkv)])
+
+    def forward(self, token, state):
+        """Returns the logits, the hidden state after each block, and the new state."""
+        if state is None:
+            state = []
+            for _ in range(self.n_layer):
+                state += [[0.0] * self.n_embd] * 4 + [[-1e30] * self.n_embd]
+
+        x = self.w["emb.weight"][token]
+        x = self.layer_norm(x, "blocks.0.ln0")
+        layers = []
+        for i in range(self.n_layer):
+            p = "blocks.%d." % i
+            att = self.time_mixing(self.layer_norm(x, p + "ln1"), state, i, p + "att.")
+            x = [a + b for a, b in zip(x, att)]
+            ffn = self.channel_mixing(self.layer_norm(x, p + "ln2"), state, i, p + "ffn.")
+            x = [a + b for a, b in zip(x, ffn)]
+            layers.append(x)
+
+        logits = matvec(self.w["head.weight"], self.layer_norm(x, "ln_out"))
+        return logits, layers, state
+
+
+def mix(x, prev, m):
+    return [a * c + b * (1 - c) for a, b, c in zip(x, prev, m)]
+
+
+def sigmoid(v):
+    return 1 / (1 + math.exp(-v))
+
+
+def matvec(m, x):
+    return [sum(a * b for a, b in zip(row, x)) for row in m]
+
+
+def main():
+    model = RWKV_RNN("pytorch_model.pt")
+    state = None
+    steps = []
+    for token in TOKENS:
+        logits, layers, state = model.forward(token, state)
+        steps.append({"layers": layers, "logits": logits})
+    with open("reference.json", "w") as f:
+        json.dump({"tokens": TOKENS, "steps": steps}, f)
+        f.write("\n")
+
+
+if __name__ == "__main__":
+    main()
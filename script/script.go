@@ -0,0 +1,142 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package script runs small user-provided expressions at defined points of a
+// generation, for light customizations without recompiling. The expressions are
+// written in the expr language (https://expr-lang.org).
+package script
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Config contains the expressions of the hooks. An empty expression disables the hook.
+type Config struct {
+	// PrePrompt transforms the prompt before the generation. It receives the variable
+	// "prompt" and returns a string, e.g.:
+	//	"Q: " + trim(prompt) + "\nA:"
+	PrePrompt string
+	// AcceptToken accepts (true) or rejects (false) each selected token; a rejected
+	// token is replaced by the next candidate. It receives the variables "token" (text),
+	// "token_id", "step" and "text" (the completion generated so far), e.g.:
+	//	!(token contains "http")
+	AcceptToken string
+	// PostCompletion transforms the whole completion. It receives the variables "prompt"
+	// and "completion" and returns a string, e.g.:
+	//	replace(completion, "\r", "")
+	PostCompletion string
+}
+
+// PromptEnv contains the variables of the PrePrompt expression.
+type PromptEnv struct {
+	Prompt string `expr:"prompt"`
+}
+
+// TokenEnv contains the variables of the AcceptToken expression.
+type TokenEnv struct {
+	Token   string `expr:"token"`
+	TokenID int    `expr:"token_id"`
+	Step    int    `expr:"step"`
+	Text    string `expr:"text"`
+}
+
+// CompletionEnv contains the variables of the PostCompletion expression.
+type CompletionEnv struct {
+	Prompt     string `expr:"prompt"`
+	Completion string `expr:"completion"`
+}
+
+// Hooks are the compiled expressions of a Config. The nil Hooks have no effect.
+// Hooks are safe for concurrent use.
+type Hooks struct {
+	prePrompt      *vm.Program
+	acceptToken    *vm.Program
+	postCompletion *vm.Program
+}
+
+// Compile compiles the expressions of the config, checking their types.
+// It returns nil if no expression is set.
+func Compile(c Config) (*Hooks, error) {
+	if c == (Config{}) {
+		return nil, nil
+	}
+	h := &Hooks{}
+	var err error
+	if h.prePrompt, err = compile("pre-prompt", c.PrePrompt, PromptEnv{}, expr.AsKind(reflect.String)); err != nil {
+		return nil, err
+	}
+	if h.acceptToken, err = compile("accept-token", c.AcceptToken, TokenEnv{}, expr.AsBool()); err != nil {
+		return nil, err
+	}
+	if h.postCompletion, err = compile("post-completion", c.PostCompletion, CompletionEnv{}, expr.AsKind(reflect.String)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func compile(hook, source string, env any, resultType expr.Option) (*vm.Program, error) {
+	if source == "" {
+		return nil, nil
+	}
+	p, err := expr.Compile(source, expr.Env(env), resultType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s script: %w", hook, err)
+	}
+	return p, nil
+}
+
+// HasPrePrompt reports whether the PrePrompt hook is set.
+func (h *Hooks) HasPrePrompt() bool {
+	return h != nil && h.prePrompt != nil
+}
+
+// HasAcceptToken reports whether the AcceptToken hook is set.
+func (h *Hooks) HasAcceptToken() bool {
+	return h != nil && h.acceptToken != nil
+}
+
+// HasPostCompletion reports whether the PostCompletion hook is set.
+func (h *Hooks) HasPostCompletion() bool {
+	return h != nil && h.postCompletion != nil
+}
+
+// TransformPrompt runs the PrePrompt hook, if set.
+func (h *Hooks) TransformPrompt(prompt string) (string, error) {
+	if h == nil || h.prePrompt == nil {
+		return prompt, nil
+	}
+	out, err := expr.Run(h.prePrompt, PromptEnv{Prompt: prompt})
+	if err != nil {
+		return "", fmt.Errorf("pre-prompt script: %w", err)
+	}
+	return out.(string), nil
+}
+
+// AcceptToken runs the AcceptToken hook, if set.
+func (h *Hooks) AcceptToken(env TokenEnv) (bool, error) {
+	if h == nil || h.acceptToken == nil {
+		return true, nil
+	}
+	out, err := expr.Run(h.acceptToken, env)
+	if err != nil {
+		return false, fmt.Errorf("accept-token script: %w", err)
+	}
+	return out.(bool), nil
+}
+
+// TransformCompletion runs the PostCompletion hook, if set.
+func (h *Hooks) TransformCompletion(prompt, completion string) (string, error) {
+	if h == nil || h.postCompletion == nil {
+		return completion, nil
+	}
+	out, err := expr.Run(h.postCompletion, CompletionEnv{Prompt: prompt, Completion: completion})
+	if err != nil {
+		return "", fmt.Errorf("post-completion script: %w", err)
+	}
+	return out.(string), nil
+}
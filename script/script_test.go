@@ -0,0 +1,53 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	h, err := Compile(Config{
+		PrePrompt:      `"Q: " + trim(prompt) + "\nA:"`,
+		AcceptToken:    `!(token contains "http") && len(text) < 10`,
+		PostCompletion: `upper(completion)`,
+	})
+	require.NoError(t, err)
+
+	prompt, err := h.TransformPrompt("  hello ")
+	require.NoError(t, err)
+	assert.Equal(t, "Q: hello\nA:", prompt)
+
+	ok, err := h.AcceptToken(TokenEnv{Token: " world"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = h.AcceptToken(TokenEnv{Token: " https"})
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = h.AcceptToken(TokenEnv{Token: " world", Text: "long enough text"})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	completion, err := h.TransformCompletion(prompt, "done")
+	require.NoError(t, err)
+	assert.Equal(t, "DONE", completion)
+}
+
+func TestCompile(t *testing.T) {
+	h, err := Compile(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, h)
+	out, err := h.TransformPrompt("unchanged")
+	require.NoError(t, err)
+	assert.Equal(t, "unchanged", out)
+
+	_, err = Compile(Config{AcceptToken: `token + "x"`})
+	assert.Error(t, err, "not a bool")
+	_, err = Compile(Config{PrePrompt: `unknown_variable`})
+	assert.Error(t, err)
+}
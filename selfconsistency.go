@@ -0,0 +1,160 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// AnswerExtractor extracts the answer from a completion, reporting false if
+// the completion has none.
+type AnswerExtractor func(completion string) (string, bool)
+
+// RegexpAnswer returns an AnswerExtractor returning the first match of re, or
+// its first group if it has any, trimmed of the surrounding spaces.
+func RegexpAnswer(re *regexp.Regexp) AnswerExtractor {
+	return func(completion string) (string, bool) {
+		m := re.FindStringSubmatch(completion)
+		if m == nil {
+			return "", false
+		}
+		if len(m) > 1 {
+			return strings.TrimSpace(m[1]), true
+		}
+		return strings.TrimSpace(m[0]), true
+	}
+}
+
+// SelfConsistencyOptions are the options of VerbaFlow.SelfConsistency.
+type SelfConsistencyOptions struct {
+	// Samples is the number of completions to sample.
+	Samples int
+	// Extract extracts the answer from each completion.
+	Extract AnswerExtractor
+	// Parallelism is the number of completions generated at a time (default: 1).
+	// They are also subject to the limit of SetMaxConcurrency.
+	Parallelism int
+}
+
+// Vote is an answer with the number of completions giving it.
+type Vote struct {
+	Answer string `json:"answer"`
+	Count  int    `json:"count"`
+}
+
+// SelfConsistencyResult is the result of VerbaFlow.SelfConsistency.
+type SelfConsistencyResult struct {
+	// Answer is the majority answer, empty if no completion has an answer.
+	Answer string `json:"answer"`
+	// Votes are the answers by decreasing number of votes, the ties in the order
+	// of the completions.
+	Votes []Vote `json:"votes"`
+	// Completions are the sampled completions.
+	Completions []string `json:"completions"`
+}
+
+// Agreement returns the fraction of the completions giving the majority answer.
+func (r SelfConsistencyResult) Agreement() float64 {
+	if len(r.Votes) == 0 {
+		return 0
+	}
+	return float64(r.Votes[0].Count) / float64(len(r.Completions))
+}
+
+// SelfConsistency samples sc.Samples completions of the prompt, extracts their
+// answers with sc.Extract, and returns the majority answer with the vote counts
+// (self-consistency). The completions are always sampled, even if
+// opts.UseSampling is false; if opts.Seed is set, the i-th completion uses
+// opts.Seed+i, so that the result is reproducible.
+//
+// The first failed generation cancels the other ones, and its error is returned.
+func (vf *VerbaFlow) SelfConsistency(ctx context.Context, prompt string, opts decoder.DecodingOptions, sc SelfConsistencyOptions) (SelfConsistencyResult, error) {
+	if sc.Samples <= 0 {
+		return SelfConsistencyResult{}, fmt.Errorf("verbaflow: invalid number of samples %d", sc.Samples)
+	}
+	if sc.Extract == nil {
+		return SelfConsistencyResult{}, fmt.Errorf("verbaflow: no answer extractor")
+	}
+	parallelism := sc.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	completions := make([]string, sc.Samples)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, parallelism)
+	for i := range completions {
+		sopts := opts
+		sopts.UseSampling = true
+		if opts.Seed != 0 {
+			sopts.Seed = opts.Seed + uint64(i)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			var sb strings.Builder
+			err := vf.GenerateText(ctx, prompt, sopts, func(text string) error {
+				sb.WriteString(text)
+				return nil
+			})
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			completions[i] = sb.String()
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return SelfConsistencyResult{}, firstErr
+	}
+	return countVotes(completions, sc.Extract), nil
+}
+
+// countVotes returns the result of the vote of the completions.
+func countVotes(completions []string, extract AnswerExtractor) SelfConsistencyResult {
+	r := SelfConsistencyResult{Completions: completions}
+	index := make(map[string]int)
+	for _, c := range completions {
+		answer, ok := extract(c)
+		if !ok {
+			continue
+		}
+		i, ok := index[answer]
+		if !ok {
+			i = len(r.Votes)
+			index[answer] = i
+			r.Votes = append(r.Votes, Vote{Answer: answer})
+		}
+		r.Votes[i].Count++
+	}
+	sort.SliceStable(r.Votes, func(i, j int) bool {
+		return r.Votes[i].Count > r.Votes[j].Count
+	})
+	if len(r.Votes) > 0 {
+		r.Answer = r.Votes[0].Answer
+	}
+	return r
+}
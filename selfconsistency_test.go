@@ -0,0 +1,66 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountVotes(t *testing.T) {
+	extract := RegexpAnswer(regexp.MustCompile(`answer: (\w+)`))
+	r := countVotes([]string{
+		"the answer: 42",
+		"I think the answer: 7",
+		"no idea",
+		"answer: 7.",
+		"answer: 42",
+		"answer: 3",
+	}, extract)
+	assert.Equal(t, []Vote{{"42", 2}, {"7", 2}, {"3", 1}}, r.Votes)
+	assert.Equal(t, "42", r.Answer)
+	assert.InDelta(t, 2.0/6, r.Agreement(), 1e-9)
+
+	r = countVotes([]string{"none"}, extract)
+	assert.Empty(t, r.Answer)
+	assert.Zero(t, r.Agreement())
+}
+
+func TestVerbaFlow_SelfConsistency(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1, Temp: 1, TopP: 1, Seed: 7}
+	sc := SelfConsistencyOptions{
+		Samples:     6,
+		Extract:     RegexpAnswer(regexp.MustCompile(`^\w`)),
+		Parallelism: 3,
+	}
+	r, err := vf.SelfConsistency(context.Background(), "hello", opts, sc)
+	require.NoError(t, err)
+	require.Len(t, r.Completions, sc.Samples)
+	total := 0
+	for i, v := range r.Votes {
+		total += v.Count
+		if i > 0 {
+			assert.LessOrEqual(t, v.Count, r.Votes[i-1].Count)
+		}
+	}
+	assert.Equal(t, sc.Samples, total)
+	assert.Equal(t, r.Votes[0].Answer, r.Answer)
+
+	// the seeds make the result reproducible
+	again, err := vf.SelfConsistency(context.Background(), "hello", opts, sc)
+	require.NoError(t, err)
+	assert.Equal(t, r, again)
+
+	_, err = vf.SelfConsistency(context.Background(), "hello", opts, SelfConsistencyOptions{Samples: 2})
+	assert.EqualError(t, err, "verbaflow: no answer extractor")
+	_, err = (&VerbaFlow{}).SelfConsistency(context.Background(), "hello", opts, sc)
+	assert.ErrorIs(t, err, ErrModelNotLoaded)
+}
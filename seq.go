@@ -0,0 +1,82 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package verbaflow
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+)
+
+// Token is a generated token.
+type Token struct {
+	// ID is the token ID.
+	ID int
+	// Text is the decoded text of the token.
+	Text string
+	// SumNegLogProbs is the sum of the negative log probabilities up to this token.
+	SumNegLogProbs float64
+	// Timing is the time spent generating the token, when opts.RecordTiming is true.
+	Timing *decoder.TokenTiming
+}
+
+// GenerateSeq generates a text from the given prompt, returning an iterator over the
+// generated tokens, to be used as:
+//
+//	for tok, err := range vf.GenerateSeq(ctx, prompt, opts) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Print(tok.Text)
+//	}
+//
+// If the generation fails, the last pair yielded carries the error.
+// Breaking out of the loop cancels the generation.
+//
+// GenerateSeq only exists when building with Go 1.23 or later, which have the
+// range-over-func loops, although the module supports older versions: with
+// them, use GenerateText or GenerateReader.
+func (vf *VerbaFlow) GenerateSeq(ctx context.Context, prompt string, opts decoder.DecodingOptions) iter.Seq2[Token, error] {
+	return func(yield func(Token, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		chGen := vf.generationChannel(opts)
+		errCh := make(chan error, 1)
+		go func() {
+			// free the computational graph after the generation is finished
+			nt := &ag.NodesTracker{}
+			defer graph.ReleaseNodes(nt)
+			errCh <- vf.Generate(ctx, nt, prompt, chGen, opts)
+		}()
+
+		for gen := range chGen {
+			if gen.TokenID == opts.EndTokenID && opts.SkipEndTokenID {
+				continue
+			}
+			start := time.Now()
+			text, err := vf.TokenByID(gen.TokenID)
+			if err != nil {
+				yield(Token{}, err)
+				return
+			}
+			if gen.Timing != nil {
+				gen.Timing.Detokenize = time.Since(start)
+			}
+			if !yield(Token{ID: gen.TokenID, Text: text, SumNegLogProbs: gen.SumNegLogProbs, Timing: gen.Timing}, nil) {
+				return
+			}
+		}
+		if err := <-errCh; err != nil {
+			yield(Token{}, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package verbaflow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbaFlow_GenerateSeq(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1, Temp: 1, TopP: 1}
+	expected := generateIDs(t, vf, "hello", opts)
+
+	var ids []int
+	for tok, err := range vf.GenerateSeq(context.Background(), "hello", opts) {
+		require.NoError(t, err)
+		text, err := vf.TokenByID(tok.ID)
+		require.NoError(t, err)
+		assert.Equal(t, text, tok.Text)
+		ids = append(ids, tok.ID)
+	}
+	assert.Equal(t, expected, ids)
+}
+
+func TestVerbaFlow_GenerateSeq_Error(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	require.NoError(t, vf.Close())
+
+	var errs []error
+	for _, err := range vf.GenerateSeq(context.Background(), "hello", decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1}) {
+		errs = append(errs, err)
+	}
+	// the error is the last pair yielded
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], ErrClosed)
+}
+
+func TestVerbaFlow_GenerateSeq_Break(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+
+	n := 0
+	for _, err := range vf.GenerateSeq(context.Background(), "hello", decoder.DecodingOptions{MaxLen: 100000, EndTokenID: -1, Temp: 1, TopP: 1}) {
+		require.NoError(t, err)
+		if n++; n == 3 {
+			break
+		}
+	}
+	assert.Equal(t, 3, n)
+
+	// the generation is cancelled: Close doesn't wait for its 100000 tokens
+	closed := make(chan error, 1)
+	go func() { closed <- vf.Close() }()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the generation was not cancelled")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeGenerations are the generations being served, listed and cancelled by
+// the Admin service, and paused, resumed or aborted by their clients.
+type activeGenerations struct {
+	mu   sync.Mutex
+	gens map[string]*activeGeneration
+}
+
+// activeGeneration is a generation being served.
+type activeGeneration struct {
+	id           string
+	apiKey       string
+	started      time.Time
+	promptTokens int
+	// generated is the number of tokens generated so far.
+	generated atomic.Int64
+	cancel    context.CancelCauseFunc
+	// gate pauses and resumes the generation.
+	gate pauseGate
+	// sender, when not nil, sends the notifications of the pauses to the client.
+	sender tokenSender
+}
+
+// start registers the generation with the given ID, returning the context
+// cancelled by cancel, carrying the registration (see activeFromContext), and
+// the registration to be passed to finish.
+func (a *activeGenerations) start(ctx context.Context, id, apiKey string, promptTokens int) (context.Context, *activeGeneration) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	g := &activeGeneration{
+		id:           id,
+		apiKey:       apiKey,
+		started:      time.Now(),
+		promptTokens: promptTokens,
+		cancel:       cancel,
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.gens == nil {
+		a.gens = make(map[string]*activeGeneration)
+	}
+	a.gens[g.id] = g
+	return context.WithValue(ctx, activeKey{}, g), g
+}
+
+// finish removes the generation, releasing its context.
+func (a *activeGenerations) finish(g *activeGeneration) {
+	a.mu.Lock()
+	delete(a.gens, g.id)
+	a.mu.Unlock()
+	g.cancel(nil)
+}
+
+// cancel cancels the generation with the given ID, reporting whether it was found.
+func (a *activeGenerations) cancel(id string) bool {
+	g, ok := a.get(id)
+	if ok {
+		g.cancel(nil)
+	}
+	return ok
+}
+
+// get returns the generation with the given ID.
+func (a *activeGenerations) get(id string) (*activeGeneration, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.gens[id]
+	return g, ok
+}
+
+// list returns the generations by start time.
+func (a *activeGenerations) list() []*activeGeneration {
+	a.mu.Lock()
+	gens := make([]*activeGeneration, 0, len(a.gens))
+	for _, g := range a.gens {
+		gens = append(gens, g)
+	}
+	a.mu.Unlock()
+	sort.Slice(gens, func(i, j int) bool {
+		return gens[i].started.Before(gens[j].started)
+	})
+	return gens
+}
@@ -0,0 +1,349 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/usage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// anonymousKey is the API key assigned to the requests without credentials.
+const anonymousKey = "anonymous"
+
+// apiKey returns the API key sent by the client with the "authorization" ("Bearer <key>")
+// or "x-api-key" metadata. If none is found, it returns anonymousKey.
+func apiKey(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return anonymousKey
+	}
+	if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		return strings.TrimPrefix(v[0], "Bearer ")
+	}
+	if v := md.Get("x-api-key"); len(v) > 0 && v[0] != "" {
+		return v[0]
+	}
+	return anonymousKey
+}
+
+// withMetadata returns the context with md joined to its incoming metadata, for
+// the requests not served over gRPC (the HTTP APIs and the queue jobs) to carry
+// the API key, and the other metadata, as the gRPC ones.
+func withMetadata(ctx context.Context, md metadata.MD) context.Context {
+	if in, ok := metadata.FromIncomingContext(ctx); ok {
+		md = metadata.Join(in, md)
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// knownKey reports whether the API key is accepted: any key is, unless
+// Config.APIKeys are set.
+func (s *Server) knownKey(key string) bool {
+	if len(s.apiKeys) == 0 {
+		return true
+	}
+	_, ok := s.apiKeys[key]
+	return ok
+}
+
+// adminServer implements the Admin service.
+type adminServer struct {
+	api.UnimplementedAdminServer
+	s *Server
+}
+
+// authorize checks that the request carries the admin token.
+func (a *adminServer) authorize(ctx context.Context) error {
+	key := apiKey(ctx)
+	if subtle.ConstantTimeCompare([]byte(key), []byte(a.s.conf.AdminToken)) != 1 {
+		return status.Error(codes.PermissionDenied, "invalid admin token")
+	}
+	return nil
+}
+
+// GetUsage implements the GetUsage method of the Admin service.
+func (a *adminServer) GetUsage(ctx context.Context, req *api.UsageRequest) (*api.UsageReport, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	report := &api.UsageReport{}
+	for _, r := range a.s.usage.Report() {
+		if req.GetApiKey() != "" && r.Key != req.GetApiKey() {
+			continue
+		}
+		report.Keys = append(report.Keys, &api.KeyUsage{
+			ApiKey:  r.Key,
+			Daily:   usageToGRPC(r.Daily),
+			Monthly: usageToGRPC(r.Monthly),
+			Total:   usageToGRPC(r.Total),
+		})
+	}
+	return report, nil
+}
+
+// ListGenerations implements the ListGenerations method of the Admin service.
+func (a *adminServer) ListGenerations(ctx context.Context, req *api.ListGenerationsRequest) (*api.GenerationList, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	list := &api.GenerationList{}
+	now := time.Now()
+	for _, g := range a.s.active.list() {
+		if req.GetApiKey() != "" && g.apiKey != req.GetApiKey() {
+			continue
+		}
+		list.Generations = append(list.Generations, &api.GenerationInfo{
+			Id:              g.id,
+			ApiKey:          g.apiKey,
+			PromptTokens:    int64(g.promptTokens),
+			GeneratedTokens: g.generated.Load(),
+			ElapsedMs:       now.Sub(g.started).Milliseconds(),
+		})
+	}
+	return list, nil
+}
+
+// CancelGeneration implements the CancelGeneration method of the Admin service.
+func (a *adminServer) CancelGeneration(ctx context.Context, req *api.CancelGenerationRequest) (*api.CancelGenerationResponse, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if !a.s.active.cancel(req.GetId()) {
+		return nil, status.Errorf(codes.NotFound, "generation %q not found", req.GetId())
+	}
+	log.Info().Str("generation_id", req.GetId()).Msg("Generation cancelled by the admin.")
+	return &api.CancelGenerationResponse{}, nil
+}
+
+// ListModels implements the ListModels method of the Admin service.
+func (a *adminServer) ListModels(ctx context.Context, _ *api.ListModelsRequest) (*api.ModelList, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	info := a.s.vf.Info()
+	return &api.ModelList{Models: []*api.ModelInfo{{
+		Name:            a.s.modelName(),
+		Architecture:    info.Architecture,
+		DModel:          int64(info.DModel),
+		NumHiddenLayers: int64(info.NumHiddenLayers),
+		VocabSize:       int64(info.VocabSize),
+		MaxConcurrency:  int64(info.MaxConcurrency),
+		MaxPromptTokens: int64(info.MaxPromptTokens),
+	}}}, nil
+}
+
+// ExportSession implements the ExportSession method of the Admin service.
+func (a *adminServer) ExportSession(ctx context.Context, req *api.ExportSessionRequest) (*api.SessionState, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	c, ok := a.s.lookupContinuation(ctx, req.GetApiKey())
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no session to export: its last generation is unknown, expired, or didn't end by itself")
+	}
+	var buf bytes.Buffer
+	if err := a.s.vf.WriteContinuation(&buf, c); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "the session can't be exported: %v", err)
+	}
+	if req.GetForget() {
+		a.s.forgetContinuation(ctx, req.GetApiKey())
+	}
+	return &api.SessionState{State: buf.Bytes()}, nil
+}
+
+// ImportSession implements the ImportSession method of the Admin service.
+func (a *adminServer) ImportSession(ctx context.Context, req *api.ImportSessionRequest) (*api.ImportSessionResponse, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if a.s.conf.ContinuationTTL < 0 {
+		return nil, status.Error(codes.FailedPrecondition, "the continuations are disabled")
+	}
+	c, err := a.s.vf.ReadContinuation(bytes.NewReader(req.GetState()))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid session state: %v", err)
+	}
+	a.s.saveContinuation(ctx, req.GetApiKey(), c)
+	return &api.ImportSessionResponse{}, nil
+}
+
+// GetConfig implements the GetConfig method of the Admin service.
+func (a *adminServer) GetConfig(ctx context.Context, _ *api.ConfigRequest) (*api.ConfigReport, error) {
+	if err := a.authorize(ctx); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(a.s.effectiveConfig())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &api.ConfigReport{Json: string(data)}, nil
+}
+
+// effectiveConfig is the configuration of the server reported by the Admin
+// service: the secrets (the admin token, the API keys and the watermark key) are
+// left out, and the components are reported by whether they are enabled.
+type effectiveConfig struct {
+	ModelName      string                     `json:"model_name"`
+	DryRun         bool                       `json:"dry_run"`
+	Cache          string                     `json:"cache,omitempty"`
+	IdempotencyTTL string                     `json:"idempotency_ttl"`
+	Quota          usage.Quota                `json:"quota"`
+	APIKeys        int                        `json:"api_keys"`
+	AuditLog       bool                       `json:"audit_log"`
+	TranscriptDir  string                     `json:"transcript_dir,omitempty"`
+	SessionStore   string                     `json:"session_store,omitempty"`
+	Moderation     bool                       `json:"moderation"`
+	TextProcessors int                        `json:"text_processors"`
+	Pipeline       []string                   `json:"pipeline"`
+	Sampler        string                     `json:"sampler"`
+	Params         map[string]json.RawMessage `json:"params,omitempty"`
+	Scripts        []string                   `json:"scripts"`
+	Watermark      *watermarkConfig           `json:"watermark,omitempty"`
+	OllamaAddress  string                     `json:"ollama_address"`
+	KoboldAddress  string                     `json:"kobold_address"`
+	DebugAddress   string                     `json:"debug_address"`
+	Limits         limitsConfig               `json:"limits"`
+	SocketMode     string                     `json:"socket_mode"`
+	Heartbeat      string                     `json:"heartbeat_interval"`
+	Backpressure   backpressureConfig         `json:"backpressure"`
+	PauseTimeout   string                     `json:"pause_timeout"`
+	// ContinuationTTL is empty if the continuations are disabled.
+	ContinuationTTL string `json:"continuation_ttl"`
+	HalfStates      bool   `json:"half_states"`
+	ChatFormat      string `json:"chat_format"`
+	// Presets are the names of the presets.
+	Presets       []string `json:"presets"`
+	DefaultPreset string   `json:"default_preset,omitempty"`
+	// GenerationConfig contains the decoding options recommended for the model.
+	GenerationConfig *verbaflow.GenerationConfig `json:"generation_config,omitempty"`
+}
+
+type watermarkConfig struct {
+	Gamma float64 `json:"gamma"`
+	Delta float64 `json:"delta"`
+}
+
+type backpressureConfig struct {
+	Policy       string `json:"policy"`
+	BufferSize   int    `json:"buffer_size"`
+	StallTimeout string `json:"stall_timeout"`
+}
+
+type limitsConfig struct {
+	CORSOrigins          []string `json:"cors_origins"`
+	MaxBodyBytes         int64    `json:"max_body_bytes"`
+	ReadTimeout          string   `json:"read_timeout"`
+	WriteTimeout         string   `json:"write_timeout"`
+	IdleTimeout          string   `json:"idle_timeout"`
+	MaxConcurrentStreams int      `json:"max_concurrent_streams"`
+}
+
+// effectiveConfig returns the configuration of the server, with the defaults.
+func (s *Server) effectiveConfig() effectiveConfig {
+	c := s.conf
+	limits := c.Limits.withDefaults()
+	backpressure := c.Backpressure.withDefaults()
+	heartbeat := c.HeartbeatInterval
+	if heartbeat == 0 {
+		heartbeat = DefaultHeartbeatInterval
+	}
+	pauseTimeout := c.PauseTimeout
+	if pauseTimeout <= 0 {
+		pauseTimeout = DefaultPauseTimeout
+	}
+	socketMode := c.SocketMode
+	if socketMode == 0 {
+		socketMode = DefaultSocketMode
+	}
+	conf := effectiveConfig{
+		ModelName:      s.modelName(),
+		DryRun:         c.DryRun,
+		IdempotencyTTL: c.IdempotencyTTL.String(),
+		Quota:          c.Quota,
+		APIKeys:        len(c.APIKeys),
+		AuditLog:       c.AuditLog != nil,
+		TranscriptDir:  c.TranscriptDir,
+		Moderation:     c.Moderation != nil,
+		TextProcessors: len(c.TextProcessors),
+		Pipeline:       c.Pipeline,
+		Sampler:        c.Sampler,
+		Params:         c.Params,
+		Scripts:        []string{},
+		OllamaAddress:  c.OllamaAddress,
+		KoboldAddress:  c.KoboldAddress,
+		DebugAddress:   c.DebugAddress,
+		Limits: limitsConfig{
+			CORSOrigins:          c.Limits.CORSOrigins,
+			MaxBodyBytes:         limits.MaxBodyBytes,
+			ReadTimeout:          limits.ReadTimeout.String(),
+			WriteTimeout:         limits.WriteTimeout.String(),
+			IdleTimeout:          limits.IdleTimeout.String(),
+			MaxConcurrentStreams: limits.MaxConcurrentStreams,
+		},
+		SocketMode: fmt.Sprintf("%#o", socketMode),
+		Heartbeat:  heartbeat.String(),
+		Backpressure: backpressureConfig{
+			Policy:       backpressure.Policy.String(),
+			BufferSize:   backpressure.BufferSize,
+			StallTimeout: backpressure.StallTimeout.String(),
+		},
+		PauseTimeout:     pauseTimeout.String(),
+		HalfStates:       s.vf.HalfStates,
+		ChatFormat:       s.chatFormat().Name,
+		Presets:          c.Presets.Names(),
+		DefaultPreset:    c.DefaultPreset,
+		GenerationConfig: s.vf.GenerationConfig,
+	}
+	switch ttl := c.ContinuationTTL; {
+	case ttl == 0:
+		conf.ContinuationTTL = DefaultContinuationTTL.String()
+	case ttl > 0:
+		conf.ContinuationTTL = ttl.String()
+	}
+	if c.Cache != nil {
+		conf.Cache = fmt.Sprintf("%T", c.Cache)
+	}
+	if c.SessionStore != nil {
+		conf.SessionStore = fmt.Sprintf("%T", c.SessionStore)
+	}
+	if len(conf.Pipeline) == 0 {
+		conf.Pipeline = decoder.DefaultPipeline
+	}
+	if c.Scripts.HasPrePrompt() {
+		conf.Scripts = append(conf.Scripts, "pre_prompt")
+	}
+	if c.Scripts.HasAcceptToken() {
+		conf.Scripts = append(conf.Scripts, "accept_token")
+	}
+	if c.Scripts.HasPostCompletion() {
+		conf.Scripts = append(conf.Scripts, "post_completion")
+	}
+	if c.Watermark != nil {
+		conf.Watermark = &watermarkConfig{Gamma: c.Watermark.Gamma, Delta: c.Watermark.Delta}
+	}
+	return conf
+}
+
+func usageToGRPC(u usage.Usage) *api.Usage {
+	return &api.Usage{
+		PromptTokens:     int64(u.PromptTokens),
+		CompletionTokens: int64(u.CompletionTokens),
+		TotalTokens:      int64(u.Total()),
+	}
+}
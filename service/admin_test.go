@@ -0,0 +1,156 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/usage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// blockingSender blocks on the first generated token until released.
+type blockingSender struct {
+	first, release chan struct{}
+	sent           bool
+}
+
+func (b *blockingSender) Send(tok *api.GeneratedToken) error {
+	if tok.Token != "" && !b.sent {
+		b.sent = true
+		close(b.first)
+		<-b.release
+	}
+	return nil
+}
+
+func TestAdminServer(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{ModelName: "tiny", AdminToken: "secret"})
+	admin := &adminServer{s: s}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret"))
+
+	_, err = admin.ListGenerations(context.Background(), &api.ListGenerationsRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	sender := &blockingSender{first: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		clientCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "client"))
+		done <- s.serveGeneration(clientCtx, "the weather", decoder.DecodingOptions{MaxLen: 1000, EndTokenID: -1}, sender)
+	}()
+	<-sender.first
+
+	list, err := admin.ListGenerations(ctx, &api.ListGenerationsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Generations, 1)
+	gen := list.Generations[0]
+	assert.Equal(t, "client", gen.ApiKey)
+	assert.Equal(t, int64(1), gen.GeneratedTokens)
+	assert.Positive(t, gen.PromptTokens)
+	list, err = admin.ListGenerations(ctx, &api.ListGenerationsRequest{ApiKey: "other"})
+	require.NoError(t, err)
+	assert.Empty(t, list.Generations)
+
+	_, err = admin.CancelGeneration(ctx, &api.CancelGenerationRequest{Id: "gen-unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = admin.CancelGeneration(ctx, &api.CancelGenerationRequest{Id: gen.Id})
+	require.NoError(t, err)
+	close(sender.release)
+	assert.Equal(t, codes.Canceled, status.Code(<-done))
+
+	list, err = admin.ListGenerations(ctx, &api.ListGenerationsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, list.Generations)
+
+	models, err := admin.ListModels(ctx, &api.ListModelsRequest{})
+	require.NoError(t, err)
+	require.Len(t, models.Models, 1)
+	assert.Equal(t, "tiny", models.Models[0].Name)
+	assert.Equal(t, "rwkv", models.Models[0].Architecture)
+
+	report, err := admin.GetConfig(ctx, &api.ConfigRequest{})
+	require.NoError(t, err)
+	assert.NotContains(t, report.Json, "secret")
+	var conf map[string]any
+	require.NoError(t, json.Unmarshal([]byte(report.Json), &conf))
+	assert.Equal(t, "tiny", conf["model_name"])
+	assert.Equal(t, "0660", conf["socket_mode"])
+}
+
+func TestServer_APIKeys(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{APIKeys: []string{"key-1"}, Quota: usage.Quota{Daily: 100}})
+
+	generate := func(md metadata.MD) error {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		return s.serveGeneration(ctx, "the weather", decoder.DecodingOptions{MaxLen: 2, EndTokenID: -1}, &recordingSender{})
+	}
+	require.NoError(t, generate(metadata.Pairs("authorization", "Bearer key-1")))
+	for _, md := range []metadata.MD{metadata.Pairs("authorization", "Bearer made-up"), metadata.Pairs("x-api-key", "made-up"), {}} {
+		assert.Equal(t, codes.Unauthenticated, status.Code(generate(md)))
+	}
+	// only the configured key is accounted
+	reports := s.usage.Report()
+	require.Len(t, reports, 1)
+	assert.Equal(t, "key-1", reports[0].Key)
+}
+
+func TestServer_APIKeys_HTTP(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{APIKeys: []string{"key-1", "key-2"}})
+	kobold := httptest.NewServer(s.KoboldHandler())
+	defer kobold.Close()
+	ollama := httptest.NewServer(s.OllamaHandler())
+	defer ollama.Close()
+
+	post := func(url, body string, header http.Header) int {
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header = header
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	koboldGenerate := func(header http.Header) int {
+		return post(kobold.URL+"/api/v1/generate", `{"prompt": "the weather", "max_length": 2}`, header)
+	}
+	ollamaGenerate := func(header http.Header) int {
+		return post(ollama.URL+"/api/generate", `{"prompt": "the weather", "stream": false, "options": {"num_predict": 2}}`, header)
+	}
+	for _, generate := range []func(http.Header) int{koboldGenerate, ollamaGenerate} {
+		assert.Equal(t, http.StatusOK, generate(http.Header{"Authorization": {"Bearer key-1"}}))
+		assert.Equal(t, http.StatusOK, generate(http.Header{"X-Api-Key": {"key-2"}}))
+		assert.Equal(t, http.StatusUnauthorized, generate(http.Header{"Authorization": {"Bearer made-up"}}))
+		assert.Equal(t, http.StatusUnauthorized, generate(http.Header{}))
+	}
+	// the generations are accounted to the keys of the headers
+	var keys []string
+	for _, r := range s.usage.Report() {
+		keys = append(keys, r.Key)
+		assert.Equal(t, 4, r.Total.CompletionTokens)
+	}
+	assert.ElementsMatch(t, []string{"key-1", "key-2"}, keys)
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/audit"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/usage"
+	"github.com/rs/zerolog/log"
+)
+
+// audit writes the record of a served request to the audit log, identified by
+// the ID of the generation: the completion are the tokens generated, and sent
+// the text received by the client.
+func (s *Server) audit(id string, started time.Time, prompt string, opts decoder.DecodingOptions, completion []int, sent string, u usage.Usage, reqErr error) {
+	raw, err := s.vf.Tokenizer.ReconstructText(completion)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to reconstruct the completion for the audit log")
+	}
+
+	finished := time.Now()
+	r := audit.Record{
+		RequestID:        id,
+		StartedAt:        started,
+		FinishedAt:       finished,
+		LatencyMs:        finished.Sub(started).Milliseconds(),
+		Prompt:           prompt,
+		Completion:       sent,
+		Options:          opts,
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+	}
+	if raw != sent {
+		r.RawCompletion = raw
+	}
+	if reqErr != nil {
+		r.Error = reqErr.Error()
+	}
+	if err := s.conf.AuditLog.Log(r); err != nil {
+		log.Warn().Err(err).Msg("failed to write the audit log")
+	}
+}
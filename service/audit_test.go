@@ -0,0 +1,60 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/audit"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingLog keeps the records of the audit log in memory.
+type recordingLog struct {
+	records []audit.Record
+}
+
+func (l *recordingLog) Log(r audit.Record) error {
+	l.records = append(l.records, r)
+	return nil
+}
+
+func (l *recordingLog) Close() error { return nil }
+
+// upperCase is the text processor converting the text to upper case.
+type upperCase struct{}
+
+func (upperCase) Process(chunk string) string { return strings.ToUpper(chunk) }
+func (upperCase) Flush() string               { return "" }
+
+func TestServer_AuditLog_SentCompletion(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	var log recordingLog
+	s := NewServer(vf, Config{
+		AuditLog:       &log,
+		TextProcessors: []textproc.Factory{func() textproc.Processor { return upperCase{} }},
+	})
+
+	var rec recordingSender
+	require.NoError(t, s.serveGeneration(context.Background(), "the weather", decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1}, &rec))
+	var sent strings.Builder
+	for _, m := range rec.messages {
+		sent.WriteString(m.Token)
+	}
+	require.Len(t, log.records, 1)
+	r := log.records[0]
+	// the record has the text received by the client, and the one generated
+	assert.Equal(t, sent.String(), r.Completion)
+	assert.Equal(t, strings.ToUpper(r.RawCompletion), r.Completion)
+	assert.NotEqual(t, r.Completion, r.RawCompletion)
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// BackpressurePolicy is what a generation does when its client doesn't keep up
+// with the generated tokens, once the buffer of the tokens to send is full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock pauses the generation until the client catches up.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDrop keeps generating, dropping the tokens the client can't
+	// keep up with: the next token sent carries the number of tokens dropped
+	// before it (api.GeneratedToken.DroppedTokens), and the last message their
+	// total. The completions with dropped tokens are not cached.
+	BackpressureDrop
+	// BackpressureCancel pauses the generation like BackpressureBlock, but
+	// cancels it if the client stalls for longer than the stall timeout.
+	BackpressureCancel
+)
+
+// Defaults of the BackpressureConfig.
+const (
+	DefaultBufferSize   = 64
+	DefaultStallTimeout = 30 * time.Second
+)
+
+var backpressurePolicies = map[BackpressurePolicy]string{
+	BackpressureBlock:  "block",
+	BackpressureDrop:   "drop",
+	BackpressureCancel: "cancel",
+}
+
+func (p BackpressurePolicy) String() string {
+	if name, ok := backpressurePolicies[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("BackpressurePolicy(%d)", int(p))
+}
+
+// ParseBackpressurePolicy returns the policy with the given name: "block",
+// "drop" or "cancel".
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	for p, n := range backpressurePolicies {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backpressure policy %q (expected block, drop or cancel)", name)
+}
+
+// BackpressureConfig configures the buffer between the generation and the
+// sending of the tokens to the client.
+type BackpressureConfig struct {
+	// Policy is applied when the buffer is full.
+	Policy BackpressurePolicy
+	// BufferSize is the number of generated tokens buffered while the client is
+	// slower than the generation (default: DefaultBufferSize).
+	BufferSize int
+	// StallTimeout is how long the client can stall, with the buffer full, before
+	// the generation is cancelled by BackpressureCancel (default: DefaultStallTimeout).
+	StallTimeout time.Duration
+}
+
+// withDefaults returns the configuration with the defaults in place of the zero values.
+func (c BackpressureConfig) withDefaults() BackpressureConfig {
+	if c.BufferSize <= 0 {
+		c.BufferSize = DefaultBufferSize
+	}
+	if c.StallTimeout <= 0 {
+		c.StallTimeout = DefaultStallTimeout
+	}
+	return c
+}
+
+// errClientStalled is the cause of the cancellation of a generation whose client stalled.
+var errClientStalled = errors.New("the client stopped reading the generated tokens")
+
+// bufferedToken is a generated token, with the number of tokens dropped before it.
+// The tokens dropped at the end of the generation are reported by a last
+// bufferedToken with trailing set, not carrying any token.
+type bufferedToken struct {
+	gen      decoder.GeneratedToken
+	dropped  int
+	trailing bool
+}
+
+// buffer forwards the tokens of the decoder, received from in until it is
+// closed, to the returned channel, buffering them and applying the policy when
+// the buffer is full. The stalled generations are cancelled with errClientStalled.
+// The tokens received after the context is done are discarded, so that the
+// decoder never blocks. While the gate, if not nil, is paused, the tokens are
+// not received, pausing the decoder, and the generation is aborted if it stays
+// paused for longer than pauseTimeout.
+func (c BackpressureConfig) buffer(ctx context.Context, cancel context.CancelCauseFunc, in <-chan decoder.GeneratedToken, gate *pauseGate, pauseTimeout time.Duration) <-chan bufferedToken {
+	c = c.withDefaults()
+	out := make(chan bufferedToken, c.BufferSize)
+	go func() {
+		defer close(out)
+		dropped := 0
+		for gen := range in {
+			if gate != nil && !gate.wait(ctx, pauseTimeout) {
+				cancel(errGenerationAborted)
+			}
+			if ctx.Err() != nil {
+				continue
+			}
+			t := bufferedToken{gen: gen, dropped: dropped}
+			select {
+			case out <- t:
+				metrics.Add(metricBufferedTokens, 1)
+				dropped = 0
+				continue
+			default:
+			}
+			// the buffer is full
+			switch c.Policy {
+			case BackpressureDrop:
+				dropped++
+				metrics.Add(metricDroppedTokens, 1)
+				continue
+			case BackpressureCancel:
+				timer := time.NewTimer(c.StallTimeout)
+				select {
+				case out <- t:
+					metrics.Add(metricBufferedTokens, 1)
+				case <-timer.C:
+					metrics.Add(metricStalledGenerations, 1)
+					cancel(errClientStalled)
+				case <-ctx.Done():
+				}
+				timer.Stop()
+			default:
+				select {
+				case out <- t:
+					metrics.Add(metricBufferedTokens, 1)
+				case <-ctx.Done():
+				}
+			}
+		}
+		if dropped > 0 && ctx.Err() == nil {
+			select {
+			case out <- bufferedToken{dropped: dropped, trailing: true}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out
+}
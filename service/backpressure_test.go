@@ -0,0 +1,96 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	for _, p := range []BackpressurePolicy{BackpressureBlock, BackpressureDrop, BackpressureCancel} {
+		parsed, err := ParseBackpressurePolicy(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParseBackpressurePolicy("wait")
+	assert.Error(t, err)
+}
+
+// generateTokens sends n tokens to in, closing it, and reports when it is done.
+func generateTokens(in chan decoder.GeneratedToken, n int) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(in)
+		for i := 0; i < n; i++ {
+			in <- decoder.GeneratedToken{TokenID: i}
+		}
+	}()
+	return done
+}
+
+func TestBackpressureConfig_Block(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	in := make(chan decoder.GeneratedToken)
+	out := BackpressureConfig{BufferSize: 2}.buffer(ctx, cancel, in, nil, 0)
+	done := generateTokens(in, 5)
+
+	select {
+	case <-done:
+		t.Fatal("the generation must wait for the client")
+	case <-time.After(50 * time.Millisecond):
+	}
+	var ids []int
+	for tok := range out {
+		assert.Zero(t, tok.dropped)
+		ids = append(ids, tok.gen.TokenID)
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, ids)
+}
+
+func TestBackpressureConfig_Drop(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	in := make(chan decoder.GeneratedToken)
+	out := BackpressureConfig{Policy: BackpressureDrop, BufferSize: 2}.buffer(ctx, cancel, in, nil, 0)
+	<-generateTokens(in, 5)
+	// the last token is being dropped
+	time.Sleep(20 * time.Millisecond)
+
+	var toks []bufferedToken
+	for tok := range out {
+		toks = append(toks, tok)
+	}
+	// the generation doesn't wait: the tokens beyond the buffer are dropped,
+	// and reported at the end
+	assert.Equal(t, []bufferedToken{
+		{gen: decoder.GeneratedToken{TokenID: 0}},
+		{gen: decoder.GeneratedToken{TokenID: 1}},
+		{dropped: 3, trailing: true},
+	}, toks)
+}
+
+func TestBackpressureConfig_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	in := make(chan decoder.GeneratedToken)
+	out := BackpressureConfig{Policy: BackpressureCancel, BufferSize: 1, StallTimeout: 20 * time.Millisecond}.buffer(ctx, cancel, in, nil, 0)
+	// the tokens sent after the cancellation are discarded
+	<-generateTokens(in, 5)
+
+	assert.Equal(t, errClientStalled, context.Cause(ctx))
+	var ids []int
+	for tok := range out {
+		ids = append(ids, tok.gen.TokenID)
+	}
+	assert.Equal(t, []int{0}, ids)
+}
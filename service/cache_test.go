@@ -0,0 +1,63 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/cache"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Cache_DeadlineAware(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	lru := cache.NewLRU(8)
+	s := NewServer(vf, Config{ModelName: "tiny", Cache: lru})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// the length of the generation depends on the time budget of the request
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1, DeadlineAware: true}
+	require.NoError(t, s.serveGeneration(ctx, "the weather", opts, &recordingSender{}))
+	assert.Zero(t, lru.Len())
+
+	opts.DeadlineAware = false
+	require.NoError(t, s.serveGeneration(ctx, "the weather", opts, &recordingSender{}))
+	assert.Equal(t, 1, lru.Len())
+}
+
+func TestServer_Cache_HTTP(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	lru := cache.NewLRU(8)
+	srv := httptest.NewServer(NewServer(vf, Config{Cache: lru}).KoboldHandler())
+	defer srv.Close()
+
+	generate := func(cacheControl string) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/generate",
+			strings.NewReader(`{"prompt": "the weather", "max_length": 4, "temperature": 0}`))
+		require.NoError(t, err)
+		req.Header.Set("Cache-Control", cacheControl)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	generate("no-store")
+	assert.Zero(t, lru.Len())
+	generate("no-cache")
+	assert.Equal(t, 1, lru.Len())
+}
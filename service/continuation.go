@@ -0,0 +1,210 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+)
+
+// DefaultContinuationTTL is how long the state at the end of the last generation
+// of an API key can be continued (see Config.ContinuationTTL).
+const DefaultContinuationTTL = 10 * time.Minute
+
+// continuations are the states at the end of the last generation of each API
+// key, continued by the requests with the continue flag.
+type continuations struct {
+	mu    sync.Mutex
+	byKey map[string]storedContinuation
+}
+
+type storedContinuation struct {
+	c       *verbaflow.Continuation
+	expires time.Time
+}
+
+// get returns the continuation of the API key, if not expired.
+func (cs *continuations) get(key string) (*verbaflow.Continuation, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.byKey[key]
+	if !ok || time.Now().After(sc.expires) {
+		return nil, false
+	}
+	return sc.c, true
+}
+
+// put sets the continuation of the API key, removing the expired ones.
+func (cs *continuations) put(key string, c *verbaflow.Continuation, ttl time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	now := time.Now()
+	for k, sc := range cs.byKey {
+		if now.After(sc.expires) {
+			delete(cs.byKey, k)
+		}
+	}
+	if cs.byKey == nil {
+		cs.byKey = make(map[string]storedContinuation)
+	}
+	cs.byKey[key] = storedContinuation{c: c, expires: now.Add(ttl)}
+}
+
+// forget removes the continuation of the API key, superseded by a new generation.
+func (cs *continuations) forget(key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.byKey, key)
+}
+
+// continuable reports whether the generations of the API key can be continued:
+// not if the continuations are disabled, nor for the anonymous requests, which
+// would continue the generations of one another.
+func (s *Server) continuable(key string) bool {
+	return s.conf.ContinuationTTL >= 0 && key != anonymousKey
+}
+
+// lookupContinuation returns the continuation of the API key, kept in memory or,
+// if not, read from the SessionStore, if any: the session of the key continues
+// after a restart, or on another instance. It reports false if the generations
+// of the key can't be continued.
+func (s *Server) lookupContinuation(ctx context.Context, key string) (*verbaflow.Continuation, bool) {
+	if !s.continuable(key) {
+		return nil, false
+	}
+	if c, ok := s.continuations.get(key); ok || s.conf.SessionStore == nil {
+		return c, ok
+	}
+	logger := genid.Logger(ctx)
+	b, ok, err := s.conf.SessionStore.LoadState(context.Background(), key)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to load the session state")
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	c, err := s.vf.ReadContinuation(bytes.NewReader(b))
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to read the session state")
+		return nil, false
+	}
+	s.continuations.put(key, c, s.continuationTTL())
+	return c, true
+}
+
+// saveContinuation keeps the continuation of the API key in memory, and in the
+// SessionStore, if any. The failures of the store are logged.
+func (s *Server) saveContinuation(ctx context.Context, key string, c *verbaflow.Continuation) {
+	s.continuations.put(key, c, s.continuationTTL())
+	if s.conf.SessionStore == nil {
+		return
+	}
+	var buf bytes.Buffer
+	err := s.vf.WriteContinuation(&buf, c)
+	if err == nil {
+		// the state is stored even if the client is already gone
+		err = s.conf.SessionStore.SaveState(context.Background(), key, buf.Bytes())
+	}
+	if err != nil {
+		genid.Logger(ctx).Warn().Err(err).Msg("failed to save the session state")
+	}
+}
+
+// finalState returns the decoder.DecodingOptions.FinalState setting next to the
+// continuation of the generation, or nil if the generations of the API key
+// can't be continued.
+func (s *Server) finalState(ctx context.Context, key string, next **verbaflow.Continuation) func(decoder.Input) {
+	if !s.continuable(key) {
+		return nil
+	}
+	return func(input decoder.Input) {
+		c, err := s.vf.NewContinuation(input)
+		if err != nil {
+			genid.Logger(ctx).Debug().Err(err).Msg("the generation can't be continued")
+			return
+		}
+		*next = c
+	}
+}
+
+// saveCachedContinuation saves the continuation of a generation served from the
+// cache, which has no state: the prompt, following from if not nil, and the
+// cached tokens, the end token excluded, are encoded again.
+func (s *Server) saveCachedContinuation(ctx context.Context, key, prompt, text string, from *verbaflow.Continuation, opts decoder.DecodingOptions, generated []decoder.GeneratedToken) {
+	if !s.continuable(key) {
+		return
+	}
+	logger := genid.Logger(ctx)
+	var tokens []int
+	var err error
+	if from != nil {
+		tokens, err = s.vf.Tokenizer.Tokenize(text)
+		tokens = append(append([]int(nil), from.Tokens()...), tokens...)
+	} else {
+		tokens, err = s.vf.Tokenizer.Tokenize(prompt)
+	}
+	if err != nil {
+		logger.Debug().Err(err).Msg("the cached generation can't be continued")
+		return
+	}
+	for i, gen := range generated {
+		if i == len(generated)-1 && gen.TokenID == opts.EndTokenID {
+			// the next token follows the text, not the end token
+			break
+		}
+		tokens = append(tokens, gen.TokenID)
+	}
+	c, err := s.vf.EncodeContinuationTokens(ctx, tokens)
+	if err != nil {
+		logger.Debug().Err(err).Msg("the cached generation can't be continued")
+		return
+	}
+	s.saveContinuation(ctx, key, c)
+}
+
+// forgetContinuation removes the continuation of the API key, superseded by a
+// new generation, from the memory and from the SessionStore, if any.
+func (s *Server) forgetContinuation(ctx context.Context, key string) {
+	s.continuations.forget(key)
+	if s.conf.SessionStore == nil {
+		return
+	}
+	if err := s.conf.SessionStore.DeleteState(context.Background(), key); err != nil {
+		genid.Logger(ctx).Warn().Err(err).Msg("failed to delete the session state")
+	}
+}
+
+// continuationTTL returns how long the continuations are kept in memory.
+func (s *Server) continuationTTL() time.Duration {
+	if s.conf.ContinuationTTL == 0 {
+		return DefaultContinuationTTL
+	}
+	return s.conf.ContinuationTTL
+}
+
+type continueKey struct{}
+
+// withContinue returns the context of a request continuing the last generation
+// of its API key.
+func withContinue(ctx context.Context, cont bool) context.Context {
+	if !cont {
+		return ctx
+	}
+	return context.WithValue(ctx, continueKey{}, true)
+}
+
+// continueRequested reports whether the request continues the last generation
+// of its API key (see withContinue).
+func continueRequested(ctx context.Context) bool {
+	cont, _ := ctx.Value(continueKey{}).(bool)
+	return cont
+}
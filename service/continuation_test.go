@@ -0,0 +1,177 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/cache"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_Continue(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{})
+
+	generate := func(ctx context.Context, prompt string, maxLen int) (string, error) {
+		var rec recordingSender
+		err := s.serveGeneration(ctx, prompt, decoder.DecodingOptions{MaxLen: maxLen, EndTokenID: -1}, &rec)
+		var text strings.Builder
+		for _, m := range rec.messages {
+			text.WriteString(m.Token)
+		}
+		return text.String(), err
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "key-1"))
+	continued := withContinue(ctx, true)
+
+	_, err = generate(continued, "", 3)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	expected, err := generate(ctx, "the weather", 8)
+	require.NoError(t, err)
+	first, err := generate(ctx, "the weather", 5)
+	require.NoError(t, err)
+	second, err := generate(continued, "", 3)
+	require.NoError(t, err)
+	assert.Equal(t, expected, first+second)
+}
+
+func TestServer_Continue_Anonymous(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{})
+	srv := httptest.NewServer(s.KoboldHandler())
+	defer srv.Close()
+
+	generate := func(body string) (int, string) {
+		resp, err := http.Post(srv.URL+"/api/v1/generate", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "key-1"))
+	require.NoError(t, s.serveGeneration(ctx, "the weather", decoder.DecodingOptions{MaxLen: 5, EndTokenID: -1}, &recordingSender{}))
+
+	// two clients without API key share no state: the generation of the first
+	// one can't be continued by the second one, and doesn't supersede the
+	// continuation of an API key
+	code, _ := generate(`{"prompt": "the weather", "max_length": 5}`)
+	require.Equal(t, http.StatusOK, code)
+	code, body := generate(`{"prompt": "", "max_length": 3, "continue": true}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "the continuations require an API key")
+	_, ok := s.continuations.get(anonymousKey)
+	assert.False(t, ok)
+	_, ok = s.continuations.get("key-1")
+	assert.True(t, ok)
+}
+
+func TestServer_Continue_CachedAndIdempotent(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+
+	generate := func(s *Server, ctx context.Context, prompt string, maxLen int) (string, error) {
+		var rec recordingSender
+		err := s.serveGeneration(ctx, prompt, decoder.DecodingOptions{MaxLen: maxLen, EndTokenID: -1}, &rec)
+		var text strings.Builder
+		for _, m := range rec.messages {
+			text.WriteString(m.Token)
+		}
+		return text.String(), err
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "key-1"))
+	expected, err := generate(NewServer(vf, Config{}), ctx, "the weather", 8)
+	require.NoError(t, err)
+
+	t.Run("cached", func(t *testing.T) {
+		s := NewServer(vf, Config{Cache: cache.NewLRU(8)})
+		_, err := generate(s, ctx, "the weather", 5)
+		require.NoError(t, err)
+		// served from the cache, superseding the continuation of the first generation
+		first, err := generate(s, ctx, "the weather", 5)
+		require.NoError(t, err)
+		second, err := generate(s, withContinue(ctx, true), "", 3)
+		require.NoError(t, err)
+		assert.Equal(t, expected, first+second)
+	})
+
+	t.Run("idempotent", func(t *testing.T) {
+		s := NewServer(vf, Config{IdempotencyTTL: time.Minute})
+		ctx := withMetadata(ctx, metadata.Pairs(idempotencyKeyHeader, "req-1"))
+		_, err := generate(s, ctx, "the weather", 5)
+		require.NoError(t, err)
+		// the retry attaches to the completed generation
+		first, err := generate(s, ctx, "the weather", 5)
+		require.NoError(t, err)
+		second, err := generate(s, withContinue(ctx, true), "", 3)
+		require.NoError(t, err)
+		assert.Equal(t, expected, first+second)
+	})
+}
+
+func TestServer_SessionStore(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	store := sessions.NewDir(t.TempDir())
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "key-1"))
+	generate := func(s *Server, ctx context.Context, prompt string, maxLen int) (string, error) {
+		var rec recordingSender
+		err := s.serveGeneration(ctx, prompt, decoder.DecodingOptions{MaxLen: maxLen, EndTokenID: -1}, &rec)
+		var text strings.Builder
+		for _, m := range rec.messages {
+			text.WriteString(m.Token)
+		}
+		return text.String(), err
+	}
+	expected, err := generate(NewServer(vf, Config{}), ctx, "the weather", 8)
+	require.NoError(t, err)
+
+	// the session continues on a new server sharing the store
+	first, err := generate(NewServer(vf, Config{SessionStore: store}), ctx, "the weather", 5)
+	require.NoError(t, err)
+	s := NewServer(vf, Config{SessionStore: store})
+	second, err := generate(s, withContinue(ctx, true), "", 3)
+	require.NoError(t, err)
+	assert.Equal(t, expected, first+second)
+
+	entries, err := store.ReadTranscript(ctx, "key-1")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2+5+2+3)
+
+	// a new generation supersedes the stored state
+	_, err = generate(s, ctx, "the", 2)
+	require.NoError(t, err)
+	b, ok, err := store.LoadState(ctx, "key-1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	c, err := vf.ReadContinuation(bytes.NewReader(b))
+	require.NoError(t, err)
+	prompt, err := vf.Tokenizer.Tokenize("the")
+	require.NoError(t, err)
+	assert.Len(t, c.Tokens(), len(prompt)+2)
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// metrics are the counters published with expvar under the "verbaflow" key.
+var metrics = expvar.NewMap("verbaflow")
+
+const (
+	metricRequests          = "requests"
+	metricGeneratedTokens   = "generated_tokens"
+	metricActiveGenerations = "active_generations"
+	// metricBufferedTokens is the number of generated tokens waiting to be sent
+	// to the clients, across the generations.
+	metricBufferedTokens     = "buffered_tokens"
+	metricDroppedTokens      = "dropped_tokens"
+	metricStalledGenerations = "stalled_generations"
+)
+
+// newDebugHandler returns the handler serving the pprof profiles under /debug/pprof/
+// and the expvar variables under /debug/vars.
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/usage"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// dryRun sends the report of the request in place of the generation, followed
+// by the usage of the prompt (see Config.DryRun).
+func (s *Server) dryRun(prompt string, opts decoder.DecodingOptions, sender tokenSender) error {
+	tokens, err := s.vf.Tokenizer.Tokenize(prompt)
+	if err != nil {
+		return err
+	}
+	endToken, err := s.vf.TokenByID(opts.EndTokenID)
+	if err != nil {
+		return err
+	}
+	report := &api.DryRun{
+		Prompt:         prompt,
+		PromptTokenIds: make([]int32, len(tokens)),
+		PromptTokens:   int64(len(tokens)),
+		MaxLen:         int32(opts.MaxLen),
+		MinLen:         int32(opts.MinLen),
+		EndTokenId:     int32(opts.EndTokenID),
+		EndToken:       endToken,
+		SkipEndTokenId: opts.SkipEndTokenID,
+		StopRegexps:    opts.StopRegexps,
+	}
+	for i, id := range tokens {
+		report.PromptTokenIds[i] = int32(id)
+	}
+	for _, seq := range opts.StopSequencesIDs {
+		ids := make([]int32, len(seq))
+		for i, id := range seq {
+			ids[i] = int32(id)
+		}
+		report.StopSequences = append(report.StopSequences, &api.Sequence{Sequence: ids})
+	}
+	if err := sender.Send(&api.GeneratedToken{DryRun: report}); err != nil {
+		return err
+	}
+	return sender.Send(&api.GeneratedToken{Usage: usageToGRPC(usage.Usage{PromptTokens: len(tokens)})})
+}
+
+// dryRunText returns the report as the text of the responses of the HTTP APIs.
+func dryRunText(report *api.DryRun) string {
+	b, err := protojson.MarshalOptions{Multiline: true}.Marshal(report)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// recordingSender records the messages of a response.
+type recordingSender struct {
+	messages []*api.GeneratedToken
+}
+
+func (r *recordingSender) Send(tok *api.GeneratedToken) error {
+	r.messages = append(r.messages, tok)
+	return nil
+}
+
+func TestServer_DryRun(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{ModelName: "tiny", DryRun: true})
+
+	var rec recordingSender
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: 0, StopSequencesIDs: [][]int{{1, 2}}}
+	require.NoError(t, s.serveGeneration(context.Background(), "the weather", opts, &rec))
+	require.Len(t, rec.messages, 2)
+	// the messages of the stream carry the ID of the generation
+	assert.Regexp(t, `^gen-[0-9a-f]+$`, rec.messages[0].GenerationId)
+	assert.Equal(t, rec.messages[0].GenerationId, rec.messages[1].GenerationId)
+	report := rec.messages[0].DryRun
+	require.NotNil(t, report)
+	tokens, err := vf.Tokenizer.Tokenize("the weather")
+	require.NoError(t, err)
+	assert.Equal(t, "the weather", report.Prompt)
+	assert.Len(t, report.PromptTokenIds, len(tokens))
+	assert.Equal(t, int64(len(tokens)), report.PromptTokens)
+	assert.Equal(t, int32(8), report.MaxLen)
+	require.Len(t, report.StopSequences, 1)
+	assert.Equal(t, []int32{1, 2}, report.StopSequences[0].Sequence)
+	require.NotNil(t, rec.messages[1].Usage)
+	assert.Equal(t, int64(len(tokens)), rec.messages[1].Usage.PromptTokens)
+	assert.Zero(t, rec.messages[1].Usage.CompletionTokens)
+
+	// the HTTP APIs respond with the report as text
+	srv := httptest.NewServer(s.KoboldHandler())
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/api/v1/generate", "application/json",
+		strings.NewReader(`{"prompt": "the weather", "max_length": 6}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var result struct {
+		Results []struct {
+			Text string `json:"text"`
+		} `json:"results"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result.Results, 1)
+	var fromText api.DryRun
+	require.NoError(t, protojson.Unmarshal([]byte(result.Results[0].Text), &fromText))
+	assert.Equal(t, "the weather", fromText.Prompt)
+	assert.Equal(t, int32(6), fromText.MaxLen)
+}
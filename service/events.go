@@ -0,0 +1,112 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+)
+
+// DefaultHeartbeatInterval is the default interval of the heartbeats sent to the
+// clients while no other message is sent (see Config.HeartbeatInterval).
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// heartbeatSender is the tokenSender sending a heartbeat to the client whenever
+// no other message was sent for the interval, e.g. while a long prompt is
+// encoded, so that the proxies don't close the idle connection.
+type heartbeatSender struct {
+	mu       sync.Mutex
+	sender   tokenSender
+	started  time.Time
+	lastSent time.Time
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// newHeartbeatSender returns the heartbeatSender wrapping the sender, to be
+// stopped once the response is complete. A negative interval disables the
+// heartbeats; zero means DefaultHeartbeatInterval.
+func newHeartbeatSender(ctx context.Context, sender tokenSender, interval time.Duration, started time.Time) *heartbeatSender {
+	h := &heartbeatSender{
+		sender:   sender,
+		started:  started,
+		lastSent: time.Now(),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	if interval < 0 {
+		close(h.stopped)
+		return h
+	}
+	go h.run(ctx, interval)
+	return h
+}
+
+func (h *heartbeatSender) run(ctx context.Context, interval time.Duration) {
+	defer close(h.stopped)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.mu.Lock()
+			if now.Sub(h.lastSent) >= interval {
+				// a failure is reported by the sending of the next token
+				_ = h.send(&api.GeneratedToken{
+					Heartbeat: &api.Heartbeat{ElapsedMs: time.Since(h.started).Milliseconds()},
+				})
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *heartbeatSender) Send(tok *api.GeneratedToken) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.send(tok)
+}
+
+func (h *heartbeatSender) send(tok *api.GeneratedToken) error {
+	h.lastSent = time.Now()
+	return h.sender.Send(tok)
+}
+
+// stop stops the heartbeats, waiting for the last one to be sent.
+func (h *heartbeatSender) stop() {
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+	<-h.stopped
+}
+
+type warningsKey struct{}
+
+// withWarnings returns the context carrying the warnings about the request,
+// e.g. its unknown fields, sent to the client at the start of the stream.
+func withWarnings(ctx context.Context, warnings []string) context.Context {
+	if len(warnings) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, warningsKey{}, warnings)
+}
+
+// requestWarnings returns the warnings set by withWarnings.
+func requestWarnings(ctx context.Context) []string {
+	warnings, _ := ctx.Value(warningsKey{}).([]string)
+	return warnings
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatSender(t *testing.T) {
+	var rec recordingSender
+	h := newHeartbeatSender(context.Background(), &rec, 20*time.Millisecond, time.Now())
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, h.Send(&api.GeneratedToken{Token: "a"}))
+	h.stop()
+
+	require.GreaterOrEqual(t, len(rec.messages), 2)
+	for _, m := range rec.messages[:len(rec.messages)-1] {
+		require.NotNil(t, m.Heartbeat)
+		assert.Greater(t, m.Heartbeat.ElapsedMs, int64(0))
+	}
+	assert.Equal(t, "a", rec.messages[len(rec.messages)-1].Token)
+
+	// no heartbeat is sent after stop
+	n := len(rec.messages)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, rec.messages, n)
+}
+
+func TestHeartbeatSender_Disabled(t *testing.T) {
+	var rec recordingSender
+	h := newHeartbeatSender(context.Background(), &rec, -1, time.Now())
+	time.Sleep(20 * time.Millisecond)
+	h.stop()
+	assert.Empty(t, rec.messages)
+}
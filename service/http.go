@@ -0,0 +1,188 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// serveHTTP serves the handler on the given address (see listen) until the
+// context is done, with the timeouts of the limits.
+func serveHTTP(ctx context.Context, name, address string, mode os.FileMode, handler http.Handler, limits LimitsConfig) error {
+	lis, err := listen(address, mode)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	limits.applyTo(srv)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Info().Msgf("%s listening on %s", name, lis.Addr())
+	if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// modelName returns the name of the served model reported by the HTTP APIs.
+func (s *Server) modelName() string {
+	if s.conf.ModelName != "" {
+		return s.conf.ModelName
+	}
+	return "verbaflow"
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// generationIDHeader is the header of the HTTP responses carrying the ID of the
+// generation.
+const generationIDHeader = "X-Generation-Id"
+
+// withGenerationIDHeader returns the context of the request with the ID of its
+// generation, returned to the client in the generationIDHeader.
+func withGenerationIDHeader(w http.ResponseWriter, r *http.Request) context.Context {
+	ctx, id := genid.Ensure(r.Context())
+	w.Header().Set(generationIDHeader, id)
+	return ctx
+}
+
+// metadataHeaders are the headers of the HTTP requests read as the gRPC metadata
+// of the same name: the API key (see apiKey), the idempotency key (see
+// idempotencyKey) and the bypass of the cache (see Server.cachePolicy).
+var metadataHeaders = []string{"authorization", "x-api-key", idempotencyKeyHeader, "cache-control"}
+
+// withHTTPMetadata returns the context with the metadataHeaders of the request
+// as incoming metadata, for the HTTP APIs to be served as the gRPC requests.
+func withHTTPMetadata(ctx context.Context, r *http.Request) context.Context {
+	md := metadata.MD{}
+	for _, h := range metadataHeaders {
+		if v := r.Header.Values(h); len(v) > 0 {
+			md.Append(h, v...)
+		}
+	}
+	return withMetadata(ctx, md)
+}
+
+// httpStatus returns the HTTP status code corresponding to the error
+// returned by a generation.
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorMessage returns the message of the error, without the gRPC status code.
+func errorMessage(err error) string {
+	if st, ok := status.FromError(err); ok {
+		return st.Message()
+	}
+	return err.Error()
+}
+
+// modelDefaults returns the defaults of an HTTP API with the decoding options
+// recommended for the model taking precedence over them (see
+// verbaflow.GenerationConfig).
+func modelDefaults(conf *verbaflow.GenerationConfig, defaults decoder.DecodingOptions) decoder.DecodingOptions {
+	recommended := conf.Defaults(decoder.DecodingOptions{UseSampling: true})
+	if recommended.MaxLen != 0 {
+		defaults.MaxLen = recommended.MaxLen
+	}
+	if recommended.Temp != 0 {
+		defaults.Temp = recommended.Temp
+	}
+	if recommended.TopK != 0 {
+		defaults.TopK = recommended.TopK
+	}
+	if recommended.TopP != 0 {
+		defaults.TopP = recommended.TopP
+	}
+	return defaults
+}
+
+// modelStops returns the stop sequences of a request of an HTTP API, followed by
+// the stop strings recommended for the model, removed from the responses too.
+func modelStops(conf *verbaflow.GenerationConfig, stops []string) []string {
+	if conf == nil || len(conf.StopStrings) == 0 {
+		return stops
+	}
+	return append(append([]string(nil), stops...), conf.StopStrings...)
+}
+
+// stopSequences ends the generations of the HTTP APIs as soon as one of the
+// stop sequences of the request is generated, removing it from the response.
+type stopSequences struct {
+	stops   []string
+	trim    textproc.Processor
+	raw     strings.Builder
+	stopped bool
+}
+
+func newStopSequences(stops []string) *stopSequences {
+	return &stopSequences{stops: stops, trim: textproc.TrimStopSequences(stops...)}
+}
+
+// process returns the text to send for the generated token, and whether the
+// generation must be stopped.
+func (s *stopSequences) process(token string) (string, bool) {
+	if s.stopped {
+		return "", false
+	}
+	s.raw.WriteString(token)
+	text := s.trim.Process(token)
+	for _, stop := range s.stops {
+		if strings.Contains(s.raw.String(), stop) {
+			s.stopped = true
+			break
+		}
+	}
+	return text, s.stopped
+}
+
+// flush returns the text withheld at the end of the generation.
+func (s *stopSequences) flush() string {
+	if s.stopped {
+		return ""
+	}
+	return s.trim.Flush()
+}
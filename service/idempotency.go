@@ -0,0 +1,193 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// idempotencyKeyHeader is the metadata key (or HTTP header) used by the clients to identify
+	// retried requests.
+	idempotencyKeyHeader = "idempotency-key"
+	// detachedFlightGrace is how long a generation keeps running once all its clients are gone,
+	// giving a retried request the chance to attach to it.
+	detachedFlightGrace = 30 * time.Second
+)
+
+// idempotencyKey returns the idempotency key sent by the client, if any.
+func idempotencyKey(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(idempotencyKeyHeader); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// flightKey identifies a flight: the idempotency keys are scoped by API key, so
+// that a client can't attach to the generation of another one.
+type flightKey struct {
+	apiKey         string
+	idempotencyKey string
+}
+
+// flights keeps track of the generations started with an idempotency key,
+// both in progress and recently completed.
+type flights struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[flightKey]*flight
+}
+
+func newFlights(ttl time.Duration) *flights {
+	return &flights{
+		ttl:   ttl,
+		items: make(map[flightKey]*flight),
+	}
+}
+
+// join returns the flight associated with the key, creating it if it doesn't exist.
+// The returned bool is true if the flight was created, in which case the caller
+// is responsible for running the generation and calling finish.
+// The fingerprint identifies the request content: reusing a key for a different
+// request is an error.
+func (fs *flights) join(key flightKey, fingerprint string) (*flight, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if f, ok := fs.items[key]; ok {
+		if f.fingerprint != fingerprint {
+			return nil, false, status.Errorf(codes.FailedPrecondition, "idempotency key %q was already used for a different request", key.idempotencyKey)
+		}
+		f.subscribe()
+		return f, false, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &flight{
+		ctx:         ctx,
+		cancel:      cancel,
+		fingerprint: fingerprint,
+		updated:     make(chan struct{}),
+	}
+	f.subscribe()
+	fs.items[key] = f
+	return f, true, nil
+}
+
+// finish marks the flight as completed and schedules its removal.
+func (fs *flights) finish(key flightKey, f *flight, err error) {
+	f.finish(err)
+	time.AfterFunc(fs.ttl, func() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.items[key] == f {
+			delete(fs.items, key)
+		}
+	})
+}
+
+// flight is a single generation shared among all the requests with the same idempotency key.
+type flight struct {
+	// ctx is the context of the generation, independent of the clients' contexts.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	fingerprint string
+	// continuation is the continuation of the generation, set when it ends by itself,
+	// before finish: it is read once stream returns.
+	continuation *verbaflow.Continuation
+
+	mu          sync.Mutex
+	tokens      []decoder.GeneratedToken
+	done        bool
+	err         error
+	updated     chan struct{} // closed and replaced at each update
+	subscribers int
+	idleTimer   *time.Timer
+}
+
+// append adds a generated token, notifying the subscribers.
+func (f *flight) append(gen decoder.GeneratedToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens = append(f.tokens, gen)
+	close(f.updated)
+	f.updated = make(chan struct{})
+	return nil
+}
+
+func (f *flight) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done = true
+	f.err = err
+	close(f.updated)
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+	}
+	f.cancel()
+}
+
+func (f *flight) subscribe() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers++
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+		f.idleTimer = nil
+	}
+}
+
+// unsubscribe detaches a client. When no clients are left, the generation
+// is cancelled after a grace period.
+func (f *flight) unsubscribe() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers--
+	if f.subscribers == 0 && !f.done {
+		f.idleTimer = time.AfterFunc(detachedFlightGrace, f.cancel)
+	}
+}
+
+// stream calls fn for every token of the flight, from the first one, waiting for
+// new tokens until the generation is completed or ctx is done.
+func (f *flight) stream(ctx context.Context, fn func(decoder.GeneratedToken) error) error {
+	defer f.unsubscribe()
+
+	next := 0
+	for {
+		f.mu.Lock()
+		tokens := f.tokens[next:]
+		done, err, updated := f.done, f.err, f.updated
+		f.mu.Unlock()
+
+		for _, gen := range tokens {
+			if e := fn(gen); e != nil {
+				return e
+			}
+		}
+		next += len(tokens)
+
+		if done {
+			return err
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestFlights_AttachToInFlightGeneration(t *testing.T) {
+	fs := newFlights(time.Minute)
+
+	f, isNew, err := fs.join(flightKey{"tenant", "key"}, "req")
+	require.NoError(t, err)
+	require.True(t, isNew)
+	require.NoError(t, f.append(decoder.GeneratedToken{TokenID: 1}))
+
+	g, isNew, err := fs.join(flightKey{"tenant", "key"}, "req")
+	require.NoError(t, err)
+	require.False(t, isNew)
+	require.Same(t, f, g)
+
+	received := make(chan []int)
+	go func() {
+		var ids []int
+		_ = g.stream(context.Background(), func(gen decoder.GeneratedToken) error {
+			ids = append(ids, gen.TokenID)
+			return nil
+		})
+		received <- ids
+	}()
+
+	require.NoError(t, f.append(decoder.GeneratedToken{TokenID: 2}))
+	fs.finish(flightKey{"tenant", "key"}, f, nil)
+
+	assert.Equal(t, []int{1, 2}, <-received)
+}
+
+func TestFlights_KeyReusedForDifferentRequest(t *testing.T) {
+	fs := newFlights(time.Minute)
+
+	_, _, err := fs.join(flightKey{"tenant", "key"}, "req-1")
+	require.NoError(t, err)
+
+	_, _, err = fs.join(flightKey{"tenant", "key"}, "req-2")
+	assert.Error(t, err)
+}
+
+func TestFlights_ScopedByAPIKey(t *testing.T) {
+	fs := newFlights(time.Minute)
+
+	f, isNew, err := fs.join(flightKey{"tenant-1", "key"}, "req")
+	require.NoError(t, err)
+	require.True(t, isNew)
+
+	// another API key reusing the idempotency key doesn't attach to the flight
+	g, isNew, err := fs.join(flightKey{"tenant-2", "key"}, "req")
+	require.NoError(t, err)
+	assert.True(t, isNew)
+	assert.NotSame(t, f, g)
+	_, _, err = fs.join(flightKey{"tenant-2", "key"}, "req-2")
+	assert.Error(t, err)
+}
+
+func TestServer_Idempotency_CrossTenant(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{IdempotencyTTL: time.Minute})
+
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1}
+	for _, key := range []string{"tenant-1", "tenant-2"} {
+		ctx := metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs(idempotencyKeyHeader, "req-1", "authorization", "Bearer "+key))
+		require.NoError(t, s.serveGeneration(ctx, "the weather", opts, &recordingSender{}))
+	}
+	// each tenant runs, and is accounted for, its own generation
+	usage := make(map[string]int)
+	for _, r := range s.usage.Report() {
+		usage[r.Key] = r.Total.CompletionTokens
+	}
+	assert.Equal(t, map[string]int{"tenant-1": 4, "tenant-2": 4}, usage)
+}
+
+func TestServer_Idempotency_HTTP(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{IdempotencyTTL: time.Minute})
+	srv := httptest.NewServer(s.OllamaHandler())
+	defer srv.Close()
+
+	generate := func(idemKey string) string {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/generate",
+			strings.NewReader(`{"prompt": "the weather", "stream": false, "options": {"num_predict": 4}}`))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer key-1")
+		req.Header.Set("Idempotency-Key", idemKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result ollamaResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return *result.Response
+	}
+	first := generate("req-1")
+	// the retry is served the sampled response of the first request
+	assert.Equal(t, first, generate("req-1"))
+	generate("req-2")
+	reports := s.usage.Report()
+	require.Len(t, reports, 1)
+	assert.Equal(t, 8, reports[0].Total.CompletionTokens)
+}
@@ -0,0 +1,373 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+)
+
+// koboldVersion is the version of the KoboldAI API implemented.
+const koboldVersion = "1.2.5"
+
+// Default decoding options of the KoboldAI API.
+const (
+	koboldDefaultMaxLength   = 80
+	koboldDefaultTemperature = 0.7
+	koboldDefaultTopP        = 0.92
+)
+
+// koboldGenerateRequest is the body of /api/v1/generate. The other settings
+// of the KoboldAI schema (e.g. the sampler order) are ignored.
+type koboldGenerateRequest struct {
+	Prompt       string   `json:"prompt"`
+	MaxLength    int      `json:"max_length"`
+	Temperature  *float64 `json:"temperature"`
+	TopK         int      `json:"top_k"`
+	TopP         *float64 `json:"top_p"`
+	RepPen       float64  `json:"rep_pen"`
+	StopSequence []string `json:"stop_sequence"`
+	SamplerSeed  uint64   `json:"sampler_seed"`
+	// Continue, an extension of VerbaFlow, continues the last generation from
+	// where it stopped, the prompt being encoded after it (see
+	// api.TokenGenerationRequest.Continue).
+	Continue bool `json:"continue"`
+}
+
+func (req koboldGenerateRequest) validate() []invalidParam {
+	var params []invalidParam
+	params = checkMin(params, "max_length", float64(req.MaxLength), 0)
+	if req.Temperature != nil {
+		params = checkRange(params, "temperature", *req.Temperature, 0, 1)
+	}
+	params = checkMin(params, "top_k", float64(req.TopK), 0)
+	if req.TopP != nil {
+		params = checkRange(params, "top_p", *req.TopP, 0, 1)
+	}
+	return checkMin(params, "rep_pen", req.RepPen, 0)
+}
+
+func (koboldGenerateRequest) ignoredFields() []string {
+	return []string{
+		"n", "max_context_length", "rep_pen_range", "rep_pen_slope", "tfs", "top_a", "typical", "min_p",
+		"sampler_order", "use_default_badwordsids", "quiet", "genkey", "trim_stop", "memory", "grammar",
+		"banned_tokens", "dynatemp_range", "mirostat", "mirostat_tau", "mirostat_eta", "singleline",
+		"use_story", "use_memory", "use_authors_note", "use_world_info", "frmttriminc", "frmtrmblln",
+	}
+}
+
+// decodingOptions returns the decoding options of the request, with the
+// defaults of KoboldAI, unless the model recommends others.
+func (req koboldGenerateRequest) decodingOptions(conf *verbaflow.GenerationConfig) decoder.DecodingOptions {
+	opts := modelDefaults(conf, decoder.DecodingOptions{
+		MaxLen:         koboldDefaultMaxLength,
+		EndTokenID:     0,
+		SkipEndTokenID: true,
+		Temp:           koboldDefaultTemperature,
+		TopP:           koboldDefaultTopP,
+	})
+	if req.TopK > 0 {
+		opts.TopK = req.TopK
+	}
+	opts.RepetitionPenalty = req.RepPen
+	opts.Seed = req.SamplerSeed
+	if req.MaxLength > 0 {
+		opts.MaxLen = req.MaxLength
+	}
+	if req.Temperature != nil {
+		opts.Temp = *req.Temperature
+	}
+	if req.TopP != nil {
+		opts.TopP = *req.TopP
+	}
+	opts.UseSampling = opts.Temp > 0
+	return opts
+}
+
+// KoboldHandler returns the handler of the KoboldAI-compatible HTTP API, as
+// also served by text-generation-webui: /api/v1/generate, /api/v1/model and
+// /api/v1/info/version, along with the KoboldCpp extensions for streaming the
+// generation as server-sent events (/api/extra/generate/stream), counting
+// the tokens (/api/extra/tokencount) and aborting a generation (/api/extra/abort),
+// which VerbaFlow extends with /api/extra/pause and /api/extra/resume.
+func (s *Server) KoboldHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/generate", func(w http.ResponseWriter, r *http.Request) {
+		s.koboldGenerate(w, r, false)
+	})
+	mux.HandleFunc("/api/extra/generate/stream", func(w http.ResponseWriter, r *http.Request) {
+		s.koboldGenerate(w, r, true)
+	})
+	mux.HandleFunc("/api/extra/tokencount", s.koboldTokenCount)
+	mux.HandleFunc("/api/extra/abort", func(w http.ResponseWriter, r *http.Request) {
+		s.koboldControl(w, r, s.AbortGeneration)
+	})
+	mux.HandleFunc("/api/extra/pause", func(w http.ResponseWriter, r *http.Request) {
+		s.koboldControl(w, r, s.PauseGeneration)
+	})
+	mux.HandleFunc("/api/extra/resume", func(w http.ResponseWriter, r *http.Request) {
+		s.koboldControl(w, r, s.ResumeGeneration)
+	})
+	mux.HandleFunc("/api/v1/model", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"result": s.modelName()})
+	})
+	mux.HandleFunc("/api/v1/info/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"result": koboldVersion})
+	})
+	mux.HandleFunc("/api/v1/config/max_length", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]int{"value": koboldDefaultMaxLength})
+	})
+	return mux
+}
+
+func (s *Server) koboldGenerate(w http.ResponseWriter, r *http.Request, stream bool) {
+	var req koboldGenerateRequest
+	warnings, ok := decodeKoboldRequest(w, r, &req)
+	if !ok {
+		return
+	}
+	out := &koboldStream{
+		w:      w,
+		stream: stream,
+		opts:   req.decodingOptions(s.generationConfig()),
+		stops:  newStopSequences(modelStops(s.generationConfig(), req.StopSequence)),
+	}
+	// the warnings are also events of the stream, for the clients not reading the headers
+	ctx := withWarnings(withHTTPMetadata(withGenerationIDHeader(w, r), r), warnings)
+	ctx = withContinue(ctx, req.Continue)
+	err := s.serveGeneration(ctx, req.Prompt, out.opts, out)
+	if err == nil {
+		return
+	}
+	genid.Logger(ctx).Debug().Err(err).Msg("KoboldAI request failed.")
+	if out.written {
+		// the status has already been sent, the error is the last event of the stream
+		_ = out.writeEvent("message", map[string]string{"error": errorMessage(err)})
+		return
+	}
+	writeKoboldError(w, httpStatus(err), err)
+}
+
+func (s *Server) koboldTokenCount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prompt string `json:"prompt"`
+	}
+	if _, ok := decodeKoboldRequest(w, r, &req); !ok {
+		return
+	}
+	n, err := s.vf.CountTokens(req.Prompt)
+	if err != nil {
+		writeKoboldError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"value": n})
+}
+
+// decodeKoboldRequest decodes the request, returning the warnings about it and
+// whether it is valid; otherwise, the error has been written.
+// koboldControlRequest is the body of /api/extra/abort, /api/extra/pause and
+// /api/extra/resume, identifying the generation by the ID returned in the
+// X-Generation-Id header.
+type koboldControlRequest struct {
+	GenerationID string `json:"generation_id"`
+}
+
+func (req koboldControlRequest) validate() []invalidParam {
+	if req.GenerationID == "" {
+		return []invalidParam{{Name: "generation_id", Reason: "is required"}}
+	}
+	return nil
+}
+
+func (koboldControlRequest) ignoredFields() []string {
+	return []string{"genkey"}
+}
+
+type koboldControlFunc func(context.Context, *api.GenerationControlRequest) (*api.GenerationControlResponse, error)
+
+func (s *Server) koboldControl(w http.ResponseWriter, r *http.Request, control koboldControlFunc) {
+	var req koboldControlRequest
+	if _, ok := decodeKoboldRequest(w, r, &req); !ok {
+		return
+	}
+	res, err := control(withHTTPMetadata(r.Context(), r), &api.GenerationControlRequest{GenerationId: req.GenerationID})
+	if err != nil {
+		writeKoboldError(w, httpStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":          true,
+		"paused":           res.Paused,
+		"generated_tokens": res.GeneratedTokens,
+	})
+}
+
+func decodeKoboldRequest(w http.ResponseWriter, r *http.Request, req any) ([]string, bool) {
+	if r.Method != http.MethodPost {
+		writeKoboldError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return nil, false
+	}
+	warnings, err := decodeRequest(r, req)
+	writeWarnings(w, warnings)
+	if err != nil {
+		writeProblem(w, requestErrorStatus(err), err, warnings)
+		return nil, false
+	}
+	return warnings, true
+}
+
+// writeKoboldError writes the error in the format of the KoboldAI API.
+func writeKoboldError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]any{
+		"detail": map[string]string{"msg": errorMessage(err), "type": http.StatusText(code)},
+	})
+}
+
+// koboldStream is the tokenSender writing the responses of the KoboldAI API:
+// the whole text at the end of the generation or, when streaming, a "message"
+// event for each chunk of text and a last one with the finish reason, as
+// KoboldCpp does. The stream also carries typed events, ignored by the
+// KoboldCpp clients: "prompt_progress", "heartbeat", "warning", "paused" and
+// "resumed", and "done" with the statistics of the generation, after the last message.
+type koboldStream struct {
+	w       http.ResponseWriter
+	stream  bool
+	opts    decoder.DecodingOptions
+	stops   *stopSequences
+	text    strings.Builder
+	written bool
+}
+
+type koboldEvent struct {
+	Token        string  `json:"token"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type koboldProgressEvent struct {
+	Encoded int64 `json:"encoded"`
+	Total   int64 `json:"total"`
+}
+
+type koboldHeartbeatEvent struct {
+	ElapsedMs int64 `json:"elapsed_ms"`
+}
+
+type koboldWarningEvent struct {
+	Warning string `json:"warning"`
+}
+
+type koboldDoneEvent struct {
+	GenerationID     string  `json:"generation_id"`
+	FinishReason     string  `json:"finish_reason"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	ElapsedMs        int64   `json:"elapsed_ms"`
+	TokensPerSecond  float64 `json:"tokens_per_second"`
+	DroppedTokens    int64   `json:"dropped_tokens,omitempty"`
+}
+
+func (k *koboldStream) Send(tok *api.GeneratedToken) error {
+	if tok.Usage != nil {
+		return k.finish(tok)
+	}
+	switch {
+	case tok.PromptProgress == nil && tok.Heartbeat == nil && tok.Warning == "" && tok.State == "":
+		break
+	case !k.stream:
+		// the warnings are in the headers of the response
+		return nil
+	case tok.PromptProgress != nil:
+		p := tok.PromptProgress
+		return k.writeEvent("prompt_progress", koboldProgressEvent{Encoded: p.EncodedTokens, Total: p.TotalTokens})
+	case tok.Heartbeat != nil:
+		return k.writeEvent("heartbeat", koboldHeartbeatEvent{ElapsedMs: tok.Heartbeat.ElapsedMs})
+	case tok.State != "":
+		// "paused" or "resumed"
+		return k.writeEvent(tok.State, struct{}{})
+	default:
+		return k.writeEvent("warning", koboldWarningEvent{Warning: tok.Warning})
+	}
+	if tok.DryRun != nil {
+		return k.write(dryRunText(tok.DryRun))
+	}
+	text, stop := k.stops.process(tok.Token)
+	if err := k.write(text); err != nil {
+		return err
+	}
+	if stop {
+		return errStopGeneration
+	}
+	return nil
+}
+
+func (k *koboldStream) write(text string) error {
+	if text == "" {
+		return nil
+	}
+	if !k.stream {
+		k.text.WriteString(text)
+		return nil
+	}
+	return k.writeEvent("message", koboldEvent{Token: text})
+}
+
+func (k *koboldStream) finish(tok *api.GeneratedToken) error {
+	u := tok.Usage
+	if err := k.write(k.stops.flush()); err != nil {
+		return err
+	}
+	if !k.stream {
+		k.written = true
+		writeJSON(k.w, http.StatusOK, map[string]any{
+			"results": []map[string]string{{"text": k.text.String()}},
+		})
+		return nil
+	}
+	reason := "stop"
+	if !k.stops.stopped && int(u.CompletionTokens) >= k.opts.MaxLen {
+		reason = "length"
+	}
+	if err := k.writeEvent("message", koboldEvent{FinishReason: &reason}); err != nil {
+		return err
+	}
+	done := koboldDoneEvent{
+		GenerationID:     tok.GenerationId,
+		FinishReason:     reason,
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+	}
+	if tok.Done != nil {
+		done.ElapsedMs, done.TokensPerSecond, done.DroppedTokens = tok.Done.ElapsedMs, tok.Done.TokensPerSecond, tok.Done.DroppedTokens
+	}
+	return k.writeEvent("done", done)
+}
+
+func (k *koboldStream) writeEvent(name string, v any) error {
+	if !k.written {
+		k.w.Header().Set("Content-Type", "text/event-stream")
+		k.w.Header().Set("Cache-Control", "no-cache")
+		k.written = true
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(k.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	if f, ok := k.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
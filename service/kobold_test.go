@@ -0,0 +1,132 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKoboldHandler(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	srv := httptest.NewServer(NewServer(vf, Config{ModelName: "tiny"}).KoboldHandler())
+	defer srv.Close()
+
+	// greedy decoding, see testdata/tiny-rwkv-golden.json
+	resp, err := http.Post(srv.URL+"/api/v1/generate", "application/json",
+		strings.NewReader(`{"prompt": "the weather", "max_length": 6, "temperature": 0}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Regexp(t, `^gen-[0-9a-f]+$`, resp.Header.Get(generationIDHeader))
+	var result struct {
+		Results []struct {
+			Text string `json:"text"`
+		} `json:"results"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result.Results, 1)
+	assert.Equal(t, "&ėĻ&ėĻ", result.Results[0].Text)
+
+	n, err := vf.CountTokens("the weather")
+	require.NoError(t, err)
+	resp, err = http.Post(srv.URL+"/api/extra/generate/stream", "application/json",
+		strings.NewReader(`{"prompt": "the weather", "temperature": 0, "stop_sequence": ["Ļ"], "tempreature": 1}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	var events []koboldEvent
+	var progress []koboldProgressEvent
+	var warnings []koboldWarningEvent
+	var done []koboldDoneEvent
+	var name string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if event, ok := strings.CutPrefix(sc.Text(), "event: "); ok {
+			name = event
+		}
+		if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+			switch name {
+			case "prompt_progress":
+				var p koboldProgressEvent
+				require.NoError(t, json.Unmarshal([]byte(data), &p))
+				progress = append(progress, p)
+				continue
+			case "warning":
+				var w koboldWarningEvent
+				require.NoError(t, json.Unmarshal([]byte(data), &w))
+				warnings = append(warnings, w)
+				continue
+			case "done":
+				var d koboldDoneEvent
+				require.NoError(t, json.Unmarshal([]byte(data), &d))
+				done = append(done, d)
+				continue
+			}
+			var e koboldEvent
+			require.NoError(t, json.Unmarshal([]byte(data), &e))
+			events = append(events, e)
+		}
+	}
+	// the progress is reported before the encoding and after its only chunk
+	assert.Equal(t, []koboldProgressEvent{{Encoded: 0, Total: int64(n)}, {Encoded: int64(n), Total: int64(n)}}, progress)
+	require.Len(t, events, 3)
+	assert.Equal(t, "&", events[0].Token)
+	assert.Equal(t, "ė", events[1].Token)
+	require.NotNil(t, events[2].FinishReason)
+	assert.Equal(t, "stop", *events[2].FinishReason)
+	assert.Equal(t, []koboldWarningEvent{{Warning: `unknown field "tempreature" is ignored, did you mean "temperature"?`}}, warnings)
+	require.Len(t, done, 1)
+	assert.Equal(t, resp.Header.Get(generationIDHeader), done[0].GenerationID)
+	assert.Equal(t, "stop", done[0].FinishReason)
+	assert.Equal(t, int64(n), done[0].PromptTokens)
+	assert.Equal(t, int64(3), done[0].CompletionTokens)
+
+	resp, err = http.Post(srv.URL+"/api/extra/tokencount", "application/json", strings.NewReader(`{"prompt": "the weather"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var count struct {
+		Value int `json:"value"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&count))
+	assert.Equal(t, n, count.Value)
+
+	resp, err = http.Get(srv.URL + "/api/v1/generate")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestKoboldGenerateRequest_DecodingOptions(t *testing.T) {
+	var req koboldGenerateRequest
+	opts := req.decodingOptions(nil)
+	assert.Equal(t, koboldDefaultTemperature, opts.Temp)
+	assert.Equal(t, koboldDefaultTopP, opts.TopP)
+
+	// the options recommended for the model take precedence over the defaults
+	temp, maxNewTokens := 0.4, 32
+	conf := &verbaflow.GenerationConfig{Temperature: &temp, MaxNewTokens: &maxNewTokens}
+	opts = req.decodingOptions(conf)
+	assert.Equal(t, 0.4, opts.Temp)
+	assert.Equal(t, 32, opts.MaxLen)
+	assert.Equal(t, koboldDefaultTopP, opts.TopP)
+
+	// but not over the request
+	zero := 0.0
+	req = koboldGenerateRequest{MaxLength: 10, Temperature: &zero}
+	opts = req.decodingOptions(conf)
+	assert.Equal(t, 10, opts.MaxLen)
+	assert.False(t, opts.UseSampling)
+}
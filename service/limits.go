@@ -0,0 +1,165 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// Default limits of the servers (see LimitsConfig).
+const (
+	DefaultMaxBodyBytes         = 4 << 20
+	DefaultReadTimeout          = 30 * time.Second
+	DefaultWriteTimeout         = 10 * time.Minute
+	DefaultIdleTimeout          = 2 * time.Minute
+	DefaultMaxConcurrentStreams = 100
+)
+
+// corsMaxAge is how long the browsers can cache the response of a preflight request.
+const corsMaxAge = 10 * time.Minute
+
+// LimitsConfig are the limits of the HTTP and gRPC servers. The zero values are
+// replaced by the defaults; a negative value removes the limit.
+type LimitsConfig struct {
+	// CORSOrigins are the origins allowed to call the HTTP APIs from a browser,
+	// or "*" for any origin. When empty, the cross-origin requests are not allowed.
+	CORSOrigins []string
+	// MaxBodyBytes is the maximum size of the body of an HTTP request, and of a
+	// gRPC request message (default: DefaultMaxBodyBytes).
+	MaxBodyBytes int64
+	// ReadTimeout is the maximum duration of the reading of an HTTP request,
+	// including its body (default: DefaultReadTimeout).
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration of an HTTP response, including the
+	// streamed generations (default: DefaultWriteTimeout).
+	WriteTimeout time.Duration
+	// IdleTimeout is how long an idle connection is kept open, over HTTP and gRPC
+	// (default: DefaultIdleTimeout).
+	IdleTimeout time.Duration
+	// MaxConcurrentStreams is the maximum number of concurrent requests of each
+	// HTTP API, the others being answered with 503 Service Unavailable, and of
+	// concurrent streams of each gRPC connection (default: DefaultMaxConcurrentStreams).
+	MaxConcurrentStreams int
+}
+
+// withDefaults returns the limits with the defaults in place of the zero values.
+func (l LimitsConfig) withDefaults() LimitsConfig {
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if l.ReadTimeout == 0 {
+		l.ReadTimeout = DefaultReadTimeout
+	}
+	if l.WriteTimeout == 0 {
+		l.WriteTimeout = DefaultWriteTimeout
+	}
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = DefaultIdleTimeout
+	}
+	if l.MaxConcurrentStreams == 0 {
+		l.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	return l
+}
+
+// timeout returns the duration of the http.Server timeouts, where zero means no timeout.
+func timeout(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// applyTo sets the timeouts of the HTTP server.
+func (l LimitsConfig) applyTo(srv *http.Server) {
+	l = l.withDefaults()
+	srv.ReadTimeout = timeout(l.ReadTimeout)
+	srv.WriteTimeout = timeout(l.WriteTimeout)
+	srv.IdleTimeout = timeout(l.IdleTimeout)
+}
+
+// grpcOptions returns the options of the gRPC server enforcing the limits.
+func (l LimitsConfig) grpcOptions() []grpc.ServerOption {
+	l = l.withDefaults()
+	var opts []grpc.ServerOption
+	if l.MaxBodyBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(l.MaxBodyBytes)))
+	}
+	if l.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(uint32(l.MaxConcurrentStreams)))
+	}
+	if l.IdleTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: l.IdleTimeout}))
+	}
+	return opts
+}
+
+// handler wraps the handler of an HTTP API, answering the CORS requests and
+// limiting the size of the bodies and the concurrent requests.
+func (l LimitsConfig) handler(h http.Handler) http.Handler {
+	l = l.withDefaults()
+	var slots chan struct{}
+	if l.MaxConcurrentStreams > 0 {
+		slots = make(chan struct{}, l.MaxConcurrentStreams)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Add("Vary", "Origin")
+			allowed := l.allowOrigin(origin)
+			if allowed != "" {
+				w.Header().Set("Access-Control-Allow-Origin", allowed)
+			}
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				// preflight request
+				if allowed == "" {
+					writeProblem(w, http.StatusForbidden, errors.New("origin not allowed"), nil)
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				writeProblem(w, http.StatusServiceUnavailable, errors.New("too many concurrent requests"), nil)
+				return
+			}
+		}
+		if l.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodyBytes)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowOrigin returns the value of the Access-Control-Allow-Origin header for the
+// origin, or an empty string if the origin is not allowed.
+func (l LimitsConfig) allowOrigin(origin string) string {
+	for _, o := range l.CORSOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
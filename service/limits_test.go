@@ -0,0 +1,94 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitsConfig_handler(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{})
+	limits := LimitsConfig{CORSOrigins: []string{"https://app.example.com"}, MaxBodyBytes: 64}
+	srv := httptest.NewServer(limits.handler(s.KoboldHandler()))
+	defer srv.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, srv.URL+"/api/extra/tokencount", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := preflight("https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "content-type", resp.Header.Get("Access-Control-Allow-Headers"))
+	resp = preflight("https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp, err = http.Post(srv.URL+"/api/extra/tokencount", "application/json", strings.NewReader(`{"prompt": "the weather"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/api/extra/tokencount", "application/json",
+		strings.NewReader(`{"prompt": "`+strings.Repeat("the weather ", 10)+`"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestLimitsConfig_handlerConcurrency(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := LimitsConfig{MaxConcurrentStreams: 1}.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-started
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestLimitsConfig_withDefaults(t *testing.T) {
+	l := LimitsConfig{WriteTimeout: -1}.withDefaults()
+	assert.Equal(t, int64(DefaultMaxBodyBytes), l.MaxBodyBytes)
+	assert.Equal(t, DefaultMaxConcurrentStreams, l.MaxConcurrentStreams)
+	srv := &http.Server{}
+	LimitsConfig{WriteTimeout: -1}.applyTo(srv)
+	assert.Zero(t, srv.WriteTimeout)
+	assert.Equal(t, DefaultReadTimeout, srv.ReadTimeout)
+}
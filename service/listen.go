@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultSocketMode is the default permissions of the Unix domain sockets the
+// servers listen on: read and write for the owner and the group.
+const DefaultSocketMode os.FileMode = 0o660
+
+// unixScheme is the prefix of the addresses of Unix domain sockets.
+const unixScheme = "unix://"
+
+// SocketPath returns the path of the Unix domain socket of the address, given
+// as "unix:///path/to/socket" (or "unix://relative/path"), and whether the
+// address is a Unix domain socket.
+func SocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, unixScheme), true
+}
+
+// listen listens on the address: a TCP address, or a Unix domain socket (see
+// SocketPath) created with the given permissions (default: DefaultSocketMode).
+// A stale socket left by a previous server is removed, while an error is
+// returned if another server is listening on it.
+func listen(address string, mode os.FileMode) (net.Listener, error) {
+	path, ok := SocketPath(address)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("invalid address %q: missing socket path", address)
+	}
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("failed to set the permissions of %s: %w", path, err)
+	}
+	return lis, nil
+}
+
+// removeStaleSocket removes the socket at path, if no server is listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another server is listening on %s", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketPath(t *testing.T) {
+	path, ok := SocketPath("unix:///run/verbaflow.sock")
+	assert.True(t, ok)
+	assert.Equal(t, "/run/verbaflow.sock", path)
+	_, ok = SocketPath(":50051")
+	assert.False(t, ok)
+}
+
+func TestListen_unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vf.sock")
+	address := "unix://" + path
+
+	lis, err := listen(address, 0o600)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	_, err = listen(address, 0)
+	assert.ErrorContains(t, err, "another server is listening")
+
+	// a socket left by a crashed server is replaced
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, lis.Close())
+	lis, err = listen(address, 0)
+	require.NoError(t, err)
+	defer lis.Close()
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultSocketMode, info.Mode().Perm())
+
+	regular := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(regular, nil, 0o600))
+	_, err = listen("unix://"+regular, 0)
+	assert.ErrorContains(t, err, "not a socket")
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/moderation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// moderatePrompt checks the prompt, returning the (possibly redacted) prompt to use,
+// or an error if the prompt is blocked.
+func (s *Server) moderatePrompt(ctx context.Context, prompt string) (string, error) {
+	if s.conf.Moderation == nil {
+		return prompt, nil
+	}
+	r, err := s.conf.Moderation.ModeratePrompt(ctx, prompt)
+	if err != nil {
+		return "", fmt.Errorf("prompt moderation failed: %w", err)
+	}
+	switch r.Action {
+	case moderation.Block:
+		genid.Logger(ctx).Debug().Str("reason", r.Reason).Msg("Prompt blocked by moderation.")
+		return "", status.Error(codes.PermissionDenied, "the prompt was rejected by the content filter")
+	case moderation.Redact:
+		genid.Logger(ctx).Debug().Str("reason", r.Reason).Msg("Prompt redacted by moderation.")
+		return r.Text, nil
+	default:
+		return prompt, nil
+	}
+}
+
+// moderate checks the completion followed by the token, returning the text to
+// send in its place and whether the generation must be stopped. The end of the
+// completion which could still become a match is withheld (see
+// moderation.Lookahead), and replaced with the rest of the text not sent yet
+// when the completion is redacted.
+func (r *responseStream) moderate(token string) (string, bool, error) {
+	r.text.WriteString(token)
+	completion := r.text.String()
+	res, err := r.s.conf.Moderation.ModerateCompletion(r.ctx, completion)
+	if err != nil {
+		return "", false, fmt.Errorf("completion moderation failed: %w", err)
+	}
+	switch res.Action {
+	case moderation.Block:
+		genid.Logger(r.ctx).Debug().Str("reason", res.Reason).Msg("Completion blocked by moderation.")
+		return "", false, status.Error(codes.PermissionDenied, "the completion was rejected by the content filter")
+	case moderation.Redact:
+		genid.Logger(r.ctx).Debug().Str("reason", res.Reason).Msg("Completion redacted by moderation.")
+		r.released = len(completion)
+		return res.Text, true, nil
+	default:
+		end := len(completion) - moderation.Pending(r.s.conf.Moderation, completion)
+		if end < r.released {
+			end = r.released
+		}
+		text := completion[r.released:end]
+		r.released = end
+		return text, false, nil
+	}
+}
+
+// withheld returns the text withheld by moderate, at the end of the generation.
+func (r *responseStream) withheld() string {
+	if r.s.conf.Moderation == nil {
+		return ""
+	}
+	text := r.text.String()[r.released:]
+	r.released = r.text.Len()
+	return text
+}
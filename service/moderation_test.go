@@ -0,0 +1,49 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/moderation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResponseStream_Moderate(t *testing.T) {
+	newStream := func(action moderation.Action) *responseStream {
+		s := &Server{conf: Config{Moderation: moderation.NewKeywords([]string{"bad words"}, action)}}
+		return &responseStream{ctx: context.Background(), s: s}
+	}
+	// the keyword spans several tokens: none of its text is sent before the match
+	moderate := func(r *responseStream, tokens ...string) ([]string, bool, error) {
+		var sent []string
+		for _, token := range tokens {
+			text, stop, err := r.moderate(token)
+			if err != nil || stop {
+				return append(sent, text), stop, err
+			}
+			sent = append(sent, text)
+		}
+		return append(sent, r.withheld()), false, nil
+	}
+
+	sent, stop, err := moderate(newStream(moderation.Redact), "the ba", "d wo", "rds!")
+	require.NoError(t, err)
+	assert.True(t, stop)
+	assert.Equal(t, []string{"the ", "", "[REDACTED]"}, sent)
+
+	sent, _, err = moderate(newStream(moderation.Block), "the ba", "d wo", "rds!")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, []string{"the ", "", ""}, sent)
+
+	sent, stop, err = moderate(newStream(moderation.Block), "the ba", "d weather", " today")
+	require.NoError(t, err)
+	assert.False(t, stop)
+	assert.Equal(t, []string{"the ", "bad ", "weather ", "today"}, sent)
+}
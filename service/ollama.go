@@ -0,0 +1,370 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/prompts"
+)
+
+// ollamaVersion is the version of Ollama whose API is implemented, reported to
+// the clients checking it.
+const ollamaVersion = "0.1.32"
+
+// Default decoding options of the Ollama API.
+const (
+	ollamaDefaultNumPredict  = 128
+	ollamaDefaultTemperature = 0.8
+	ollamaDefaultTopK        = 40
+	ollamaDefaultTopP        = 0.9
+)
+
+// ollamaOptions are the supported model parameters of the Ollama requests.
+type ollamaOptions struct {
+	NumPredict    *int     `json:"num_predict"`
+	Temperature   *float64 `json:"temperature"`
+	TopK          *int     `json:"top_k"`
+	TopP          *float64 `json:"top_p"`
+	RepeatPenalty float64  `json:"repeat_penalty"`
+	Seed          uint64   `json:"seed"`
+	Stop          []string `json:"stop"`
+}
+
+type ollamaGenerateRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	System  string        `json:"system"`
+	Stream  *bool         `json:"stream"`
+	Options ollamaOptions `json:"options"`
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+// ollamaResponse is a response line of /api/generate (Response) or /api/chat (Message).
+type ollamaResponse struct {
+	Model           string         `json:"model"`
+	CreatedAt       time.Time      `json:"created_at"`
+	Response        *string        `json:"response,omitempty"`
+	Message         *ollamaMessage `json:"message,omitempty"`
+	Done            bool           `json:"done"`
+	DoneReason      string         `json:"done_reason,omitempty"`
+	TotalDuration   int64          `json:"total_duration,omitempty"`
+	PromptEvalCount int            `json:"prompt_eval_count,omitempty"`
+	EvalCount       int            `json:"eval_count,omitempty"`
+}
+
+// OllamaHandler returns the handler of the Ollama-compatible HTTP API:
+// /api/generate and /api/chat (streaming NDJSON), /api/tags and /api/version.
+func (s *Server) OllamaHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/generate", s.ollamaGenerate)
+	mux.HandleFunc("/api/chat", s.ollamaChat)
+	mux.HandleFunc("/api/tags", s.ollamaTags)
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"version": ollamaVersion})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "Ollama is running")
+	})
+	return mux
+}
+
+func (s *Server) ollamaGenerate(w http.ResponseWriter, r *http.Request) {
+	var req ollamaGenerateRequest
+	if !decodeOllamaRequest(w, r, &req) {
+		return
+	}
+	prompt := req.Prompt
+	if req.System != "" {
+		prompt = req.System + "\n\n" + prompt
+	}
+	s.serveOllama(w, r, prompt, req.Options, req.Stream, false)
+}
+
+func (s *Server) ollamaChat(w http.ResponseWriter, r *http.Request) {
+	var req ollamaChatRequest
+	if !decodeOllamaRequest(w, r, &req) {
+		return
+	}
+	format := s.chatFormat()
+	messages := make([]prompts.Message, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = prompts.Message{Role: m.Role, Content: m.Content}
+	}
+	prompt, err := format.Render(messages)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err)
+		return
+	}
+	// the model would go on with the next turn of the user
+	req.Options.Stop = append(req.Options.Stop, format.Stops...)
+	s.serveOllama(w, r, prompt, req.Options, req.Stream, true)
+}
+
+func (s *Server) ollamaTags(w http.ResponseWriter, _ *http.Request) {
+	type model struct {
+		Name       string    `json:"name"`
+		Model      string    `json:"model"`
+		ModifiedAt time.Time `json:"modified_at"`
+		Size       int64     `json:"size"`
+		Digest     string    `json:"digest"`
+		Details    struct {
+			Format string `json:"format"`
+			Family string `json:"family"`
+		} `json:"details"`
+	}
+	m := model{Name: s.modelName(), Model: s.modelName()}
+	m.Details.Format, m.Details.Family = "verbaflow", "rwkv"
+	writeJSON(w, http.StatusOK, map[string][]model{"models": {m}})
+}
+
+func decodeOllamaRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	if r.Method != http.MethodPost {
+		writeOllamaError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	warnings, err := decodeRequest(r, req)
+	writeWarnings(w, warnings)
+	if err != nil {
+		writeProblem(w, requestErrorStatus(err), err, warnings)
+		return false
+	}
+	return true
+}
+
+func (req ollamaGenerateRequest) validate() []invalidParam {
+	return req.Options.validate()
+}
+
+func (ollamaGenerateRequest) ignoredFields() []string {
+	return []string{"suffix", "images", "format", "template", "context", "raw", "keep_alive"}
+}
+
+func (req ollamaChatRequest) validate() []invalidParam {
+	var params []invalidParam
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			params = append(params, invalidParam{
+				Name:   fmt.Sprintf("messages[%d].role", i),
+				Reason: fmt.Sprintf(`must be "system", "user" or "assistant", got %q`, m.Role),
+			})
+		}
+	}
+	return append(params, req.Options.validate()...)
+}
+
+func (ollamaChatRequest) ignoredFields() []string {
+	return []string{"format", "tools", "keep_alive"}
+}
+
+func (ollamaMessage) ignoredFields() []string {
+	return []string{"images", "tool_calls"}
+}
+
+func (o ollamaOptions) validate() []invalidParam {
+	var params []invalidParam
+	if o.Temperature != nil {
+		params = checkRange(params, "options.temperature", *o.Temperature, 0, 1)
+	}
+	if o.TopK != nil {
+		params = checkMin(params, "options.top_k", float64(*o.TopK), 0)
+	}
+	if o.TopP != nil {
+		params = checkRange(params, "options.top_p", *o.TopP, 0, 1)
+	}
+	return checkMin(params, "options.repeat_penalty", o.RepeatPenalty, 0)
+}
+
+func (ollamaOptions) ignoredFields() []string {
+	return []string{
+		"num_ctx", "num_keep", "num_batch", "num_gpu", "main_gpu", "num_thread", "low_vram", "use_mmap",
+		"use_mlock", "numa", "vocab_only", "repeat_last_n", "tfs_z", "typical_p", "min_p", "mirostat",
+		"mirostat_tau", "mirostat_eta", "penalize_newline", "presence_penalty", "frequency_penalty",
+	}
+}
+
+// chatFormat returns the prompt format of the chat messages (see Config.ChatFormat).
+func (s *Server) chatFormat() *prompts.Format {
+	if s.conf.ChatFormat != nil {
+		return s.conf.ChatFormat
+	}
+	// the format is built in
+	f, _ := prompts.LookupFormat("transcript")
+	return f
+}
+
+// decodingOptions returns the decoding options of the request, with the
+// defaults of Ollama, unless the model recommends others.
+func (o ollamaOptions) decodingOptions(conf *verbaflow.GenerationConfig) decoder.DecodingOptions {
+	opts := modelDefaults(conf, decoder.DecodingOptions{
+		MaxLen:         ollamaDefaultNumPredict,
+		EndTokenID:     0,
+		SkipEndTokenID: true,
+		Temp:           ollamaDefaultTemperature,
+		TopK:           ollamaDefaultTopK,
+		TopP:           ollamaDefaultTopP,
+	})
+	opts.RepetitionPenalty = o.RepeatPenalty
+	opts.Seed = o.Seed
+	if o.NumPredict != nil && *o.NumPredict > 0 {
+		opts.MaxLen = *o.NumPredict
+	}
+	if o.Temperature != nil {
+		opts.Temp = *o.Temperature
+	}
+	if o.TopK != nil {
+		opts.TopK = *o.TopK
+	}
+	if o.TopP != nil {
+		opts.TopP = *o.TopP
+	}
+	opts.UseSampling = opts.Temp > 0
+	return opts
+}
+
+// serveOllama serves a generation of the Ollama API, streaming the response
+// as NDJSON unless stream is false.
+func (s *Server) serveOllama(w http.ResponseWriter, r *http.Request, prompt string, options ollamaOptions, stream *bool, chat bool) {
+	out := &ollamaStream{
+		w:       w,
+		model:   s.modelName(),
+		started: time.Now(),
+		stream:  stream == nil || *stream,
+		chat:    chat,
+		stops:   newStopSequences(modelStops(s.generationConfig(), options.Stop)),
+		opts:    options.decodingOptions(s.generationConfig()),
+	}
+	ctx := withHTTPMetadata(withGenerationIDHeader(w, r), r)
+	err := s.serveGeneration(ctx, prompt, out.opts, out)
+	if err == nil {
+		return
+	}
+	genid.Logger(ctx).Debug().Err(err).Msg("Ollama request failed.")
+	if out.written {
+		// the status has already been sent, the error is the last line of the stream
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": errorMessage(err)})
+		return
+	}
+	writeOllamaError(w, httpStatus(err), err)
+}
+
+// ollamaStream is the tokenSender writing the responses of the Ollama API.
+type ollamaStream struct {
+	w       http.ResponseWriter
+	model   string
+	started time.Time
+	stream  bool
+	chat    bool
+	opts    decoder.DecodingOptions
+	stops   *stopSequences
+	// text is the whole response, when not streaming.
+	text    strings.Builder
+	written bool
+}
+
+func (o *ollamaStream) Send(tok *api.GeneratedToken) error {
+	if tok.Usage != nil {
+		return o.finish(tok.Usage)
+	}
+	if tok.PromptProgress != nil || tok.Heartbeat != nil || tok.Warning != "" || tok.State != "" {
+		// not part of the Ollama API, the warnings are in the headers of the response
+		return nil
+	}
+	if tok.DryRun != nil {
+		return o.write(dryRunText(tok.DryRun))
+	}
+	text, stop := o.stops.process(tok.Token)
+	if err := o.write(text); err != nil {
+		return err
+	}
+	if stop {
+		return errStopGeneration
+	}
+	return nil
+}
+
+func (o *ollamaStream) write(text string) error {
+	if text == "" {
+		return nil
+	}
+	if !o.stream {
+		o.text.WriteString(text)
+		return nil
+	}
+	return o.writeLine(o.response(text))
+}
+
+func (o *ollamaStream) finish(u *api.Usage) error {
+	if err := o.write(o.stops.flush()); err != nil {
+		return err
+	}
+	resp := o.response(o.text.String())
+	resp.Done = true
+	resp.DoneReason = "stop"
+	if !o.stops.stopped && int(u.CompletionTokens) >= o.opts.MaxLen {
+		resp.DoneReason = "length"
+	}
+	resp.TotalDuration = time.Since(o.started).Nanoseconds()
+	resp.PromptEvalCount, resp.EvalCount = int(u.PromptTokens), int(u.CompletionTokens)
+	return o.writeLine(resp)
+}
+
+func (o *ollamaStream) response(text string) ollamaResponse {
+	resp := ollamaResponse{Model: o.model, CreatedAt: time.Now().UTC()}
+	if o.chat {
+		resp.Message = &ollamaMessage{Role: "assistant", Content: text}
+	} else {
+		resp.Response = &text
+	}
+	return resp
+}
+
+func (o *ollamaStream) writeLine(resp ollamaResponse) error {
+	if !o.written {
+		if o.stream {
+			o.w.Header().Set("Content-Type", "application/x-ndjson")
+		} else {
+			o.w.Header().Set("Content-Type", "application/json")
+		}
+		o.written = true
+	}
+	if err := json.NewEncoder(o.w).Encode(resp); err != nil {
+		return err
+	}
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func writeOllamaError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": errorMessage(err)})
+}
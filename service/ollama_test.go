@@ -0,0 +1,84 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOllamaHandler(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	srv := httptest.NewServer(NewServer(vf, Config{ModelName: "tiny"}).OllamaHandler())
+	defer srv.Close()
+
+	post := func(path, body string) []ollamaResponse {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var lines []ollamaResponse
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			var line ollamaResponse
+			require.NoError(t, json.Unmarshal(sc.Bytes(), &line))
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	// greedy decoding, see testdata/tiny-rwkv-golden.json
+	lines := post("/api/generate", `{"model": "tiny", "prompt": "the weather", "options": {"temperature": 0, "num_predict": 6}}`)
+	require.Len(t, lines, 7)
+	var text string
+	for _, line := range lines[:6] {
+		require.NotNil(t, line.Response)
+		text += *line.Response
+	}
+	assert.Equal(t, "&ėĻ&ėĻ", text)
+	last := lines[6]
+	assert.True(t, last.Done)
+	assert.Equal(t, "length", last.DoneReason)
+	assert.Equal(t, "tiny", last.Model)
+	assert.Equal(t, 6, last.EvalCount)
+
+	lines = post("/api/generate", `{"prompt": "the weather", "stream": false, "options": {"temperature": 0, "stop": ["Ļ"]}}`)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "&ė", *lines[0].Response)
+	assert.Equal(t, "stop", lines[0].DoneReason)
+
+	lines = post("/api/chat", `{"messages": [{"role": "user", "content": "the weather"}], "stream": false, "options": {"temperature": 0, "num_predict": 3}}`)
+	require.Len(t, lines, 1)
+	require.NotNil(t, lines[0].Message)
+	assert.Equal(t, "assistant", lines[0].Message.Role)
+	assert.True(t, lines[0].Done)
+
+	resp, err := http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(`{"messages": [{"role": "tool"}]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/api/tags")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tags))
+	require.Len(t, tags.Models, 1)
+	assert.Equal(t, "tiny", tags.Models[0].Name)
+}
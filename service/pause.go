@@ -0,0 +1,158 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultPauseTimeout is how long a generation can stay paused before it is
+// aborted (see Config.PauseTimeout).
+const DefaultPauseTimeout = 5 * time.Minute
+
+// errGenerationAborted is the cause of the cancellation of an aborted
+// generation, completed with the tokens generated so far.
+var errGenerationAborted = errors.New("generation aborted")
+
+// pauseGate pauses a generation between two tokens: the decoder waits, keeping
+// its state, until the generation is resumed.
+type pauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+// pause pauses the generation, reporting whether it was running.
+func (p *pauseGate) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused, p.resumed = true, make(chan struct{})
+	return true
+}
+
+// resume resumes the generation, reporting whether it was paused.
+func (p *pauseGate) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	close(p.resumed)
+	return true
+}
+
+func (p *pauseGate) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// wait waits while the generation is paused, until it is resumed or the context
+// is done. It returns false if the generation is still paused after the timeout.
+func (p *pauseGate) wait(ctx context.Context, timeout time.Duration) bool {
+	p.mu.Lock()
+	paused, resumed := p.paused, p.resumed
+	p.mu.Unlock()
+	if !paused {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+type activeKey struct{}
+
+// activeFromContext returns the registration of the generation of the context,
+// if it is served by the Server.
+func activeFromContext(ctx context.Context) *activeGeneration {
+	g, _ := ctx.Value(activeKey{}).(*activeGeneration)
+	return g
+}
+
+// controlledGeneration returns the generation with the given ID started with
+// the API key of the caller; the generations of the other API keys are not found.
+func (s *Server) controlledGeneration(ctx context.Context, id string) (*activeGeneration, error) {
+	g, ok := s.active.get(id)
+	if !ok || g.apiKey != apiKey(ctx) {
+		return nil, status.Errorf(codes.NotFound, "generation %q not found", id)
+	}
+	return g, nil
+}
+
+func controlResponse(g *activeGeneration) *api.GenerationControlResponse {
+	return &api.GenerationControlResponse{
+		Paused:          g.gate.isPaused(),
+		GeneratedTokens: g.generated.Load(),
+	}
+}
+
+// notify sends the new state of the generation to its client.
+func (g *activeGeneration) notify(ctx context.Context, state string) {
+	if g.sender == nil {
+		return
+	}
+	if err := g.sender.Send(&api.GeneratedToken{State: state}); err != nil {
+		genid.Logger(ctx).Debug().Err(err).Msgf("failed to notify the %s generation", state)
+	}
+}
+
+// PauseGeneration implements the PauseGeneration method of the LanguageModel service.
+func (s *Server) PauseGeneration(ctx context.Context, req *api.GenerationControlRequest) (*api.GenerationControlResponse, error) {
+	g, err := s.controlledGeneration(ctx, req.GetGenerationId())
+	if err != nil {
+		return nil, err
+	}
+	if g.gate.pause() {
+		ctx = genid.With(ctx, g.id)
+		genid.Logger(ctx).Debug().Msg("Generation paused.")
+		g.notify(ctx, "paused")
+	}
+	return controlResponse(g), nil
+}
+
+// ResumeGeneration implements the ResumeGeneration method of the LanguageModel service.
+func (s *Server) ResumeGeneration(ctx context.Context, req *api.GenerationControlRequest) (*api.GenerationControlResponse, error) {
+	g, err := s.controlledGeneration(ctx, req.GetGenerationId())
+	if err != nil {
+		return nil, err
+	}
+	if g.gate.resume() {
+		ctx = genid.With(ctx, g.id)
+		genid.Logger(ctx).Debug().Msg("Generation resumed.")
+		g.notify(ctx, "resumed")
+	}
+	return controlResponse(g), nil
+}
+
+// AbortGeneration implements the AbortGeneration method of the LanguageModel service.
+func (s *Server) AbortGeneration(ctx context.Context, req *api.GenerationControlRequest) (*api.GenerationControlResponse, error) {
+	g, err := s.controlledGeneration(ctx, req.GetGenerationId())
+	if err != nil {
+		return nil, err
+	}
+	genid.Logger(genid.With(ctx, g.id)).Debug().Msg("Generation aborted.")
+	g.cancel(errGenerationAborted)
+	return controlResponse(g), nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// syncSender records the messages, sent by concurrent goroutines.
+type syncSender struct {
+	mu       sync.Mutex
+	messages []*api.GeneratedToken
+}
+
+func (s *syncSender) Send(tok *api.GeneratedToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, tok)
+	return nil
+}
+
+// states returns the states notified to the client.
+func (s *syncSender) states() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var states []string
+	for _, m := range s.messages {
+		if m.State != "" {
+			states = append(states, m.State)
+		}
+	}
+	return states
+}
+
+func TestServer_PauseGeneration(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "client"))
+	otherCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "other"))
+
+	var sender syncSender
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serveGeneration(ctx, "the weather", decoder.DecodingOptions{MaxLen: 100000, EndTokenID: -1}, &sender)
+	}()
+	var g *activeGeneration
+	require.Eventually(t, func() bool {
+		gens := s.active.list()
+		if len(gens) == 0 || gens[0].generated.Load() == 0 {
+			return false
+		}
+		g = gens[0]
+		return true
+	}, 5*time.Second, time.Millisecond)
+	req := &api.GenerationControlRequest{GenerationId: g.id}
+
+	// the generations of the other API keys can't be controlled
+	_, err = s.PauseGeneration(otherCtx, req)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	res, err := s.PauseGeneration(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, res.Paused)
+	// the buffered tokens are sent, then the generation waits
+	time.Sleep(50 * time.Millisecond)
+	paused := g.generated.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, paused, g.generated.Load())
+
+	res, err = s.ResumeGeneration(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, res.Paused)
+	require.Eventually(t, func() bool {
+		return g.generated.Load() > paused
+	}, 5*time.Second, time.Millisecond)
+
+	_, err = s.AbortGeneration(ctx, req)
+	require.NoError(t, err)
+	// the aborted generation is completed with the tokens generated so far
+	require.NoError(t, <-done)
+	assert.Equal(t, []string{"paused", "resumed"}, sender.states())
+	last := sender.messages[len(sender.messages)-1]
+	require.NotNil(t, last.Usage)
+	assert.Equal(t, last.Usage.CompletionTokens, g.generated.Load())
+}
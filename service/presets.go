@@ -0,0 +1,46 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/presets"
+)
+
+type presetKey struct{}
+
+// withPreset returns the context of a request selecting a preset by name.
+func withPreset(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, presetKey{}, name)
+}
+
+// preset returns the preset selected by the request (see withPreset), or the
+// default one, or nil if none is.
+func (s *Server) preset(ctx context.Context) (*presets.Preset, error) {
+	name, _ := ctx.Value(presetKey{}).(string)
+	if name == "" {
+		name = s.conf.DefaultPreset
+	}
+	if name == "" {
+		return nil, nil
+	}
+	return s.conf.Presets.Lookup(name)
+}
+
+// generationConfig returns the decoding options recommended for the requests of
+// the HTTP APIs, which select no preset: the ones of the model, with the ones of
+// the default preset taking precedence.
+func (s *Server) generationConfig() *verbaflow.GenerationConfig {
+	p, err := s.preset(context.Background())
+	if err != nil || p == nil {
+		return s.vf.GenerationConfig
+	}
+	return p.GenerationConfig(s.vf.GenerationConfig)
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/presets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_Preset(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	maxLen := 6
+	ps := presets.Presets{
+		"weather": {Name: "weather", System: "the weather", Options: &verbaflow.GenerationConfig{MaxNewTokens: &maxLen}},
+		"cached":  {Name: "cached", System: "the weather", StateFile: filepath.Join(t.TempDir(), "cached.state")},
+	}
+	require.NoError(t, ps["cached"].EncodeState(context.Background(), vf))
+	require.NoError(t, ps.LoadStates(vf))
+	s := NewServer(vf, Config{Presets: ps})
+
+	generate := func(ctx context.Context, prompt string, opts decoder.DecodingOptions) (string, error) {
+		var rec recordingSender
+		err := s.serveGeneration(ctx, prompt, opts, &rec)
+		var text strings.Builder
+		for _, m := range rec.messages {
+			text.WriteString(m.Token)
+		}
+		return text.String(), err
+	}
+	expected, err := generate(context.Background(), "the weather\n\ntoday", decoder.DecodingOptions{MaxLen: maxLen, EndTokenID: -1})
+	require.NoError(t, err)
+
+	// the system prompt precedes the prompt, and the options of the preset are used
+	text, err := generate(withPreset(context.Background(), "weather"), "today", decoder.DecodingOptions{EndTokenID: -1})
+	require.NoError(t, err)
+	assert.Equal(t, expected, text)
+	// the precomputed state follows the system prompt
+	text, err = generate(withPreset(context.Background(), "cached"), "today", decoder.DecodingOptions{MaxLen: maxLen, EndTokenID: -1})
+	require.NoError(t, err)
+	assert.Equal(t, expected, text)
+
+	// the default preset applies to the requests selecting none
+	s.conf.DefaultPreset = "weather"
+	text, err = generate(context.Background(), "today", decoder.DecodingOptions{EndTokenID: -1})
+	require.NoError(t, err)
+	assert.Equal(t, expected, text)
+	assert.Equal(t, maxLen, *s.generationConfig().MaxNewTokens)
+
+	_, err = generate(withPreset(context.Background(), "unknown"), "today", decoder.DecodingOptions{MaxLen: 2})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
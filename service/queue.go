@@ -0,0 +1,179 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/metadata"
+)
+
+// QueueConn is the connection to the message broker the generation jobs are
+// consumed from (see NATSConn).
+type QueueConn interface {
+	// QueueSubscribe calls handler with the messages published to the subject,
+	// each delivered to a single subscriber of the queue group. Handler is
+	// called for a message at a time.
+	QueueSubscribe(subject, queue string, handler func(QueueMessage)) (unsubscribe func() error, err error)
+	// Publish publishes data to the subject.
+	Publish(subject string, data []byte) error
+}
+
+// QueueMessage is a message received from the broker.
+type QueueMessage struct {
+	Data []byte
+	// Reply is the reply subject of the message, if any.
+	Reply string
+}
+
+// QueueJob is a generation job consumed by the worker.
+type QueueJob struct {
+	// ID identifies the job in its results.
+	ID     string `json:"id"`
+	Prompt string `json:"prompt"`
+	// DecodingOptions are the decoding options of the generation.
+	DecodingOptions decoder.DecodingOptions `json:"decoding_options"`
+	// Preset is the name of the preset of the generation (see Config.Presets).
+	Preset string `json:"preset,omitempty"`
+	// APIKey is the API key of the job, accepted and accounted as the one of a
+	// gRPC request (see Config.APIKeys).
+	APIKey string `json:"api_key,omitempty"`
+	// ReplyTo is the subject the results are published to. If empty, the
+	// reply subject of the message is used.
+	ReplyTo string `json:"reply_to,omitempty"`
+}
+
+// QueueResult is a message published with the results of a job: a chunk of
+// the generated text, and a last message with Done set, carrying either the
+// usage or the error.
+type QueueResult struct {
+	ID    string `json:"id"`
+	Text  string `json:"text,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+	// PromptTokens and CompletionTokens are the usage of the generation,
+	// set in the last message.
+	PromptTokens     int `json:"prompt_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+}
+
+// QueueConfig contains the settings of the queue worker.
+type QueueConfig struct {
+	// Subject is the subject of the generation jobs.
+	Subject string
+	// Queue is the queue group shared by the workers, so that each job is
+	// consumed by a single worker.
+	Queue string
+	// Concurrency is the maximum number of jobs run at the same time by the
+	// worker: the following jobs wait in the broker client (default 1), and are
+	// lost if the worker is stopped, as the running ones.
+	Concurrency int
+}
+
+// ServeQueue consumes the generation jobs published to the broker, publishing
+// the streamed results, until the context is done. The jobs are served like
+// the gRPC requests, with the settings of the server.
+func (s *Server) ServeQueue(ctx context.Context, conn QueueConn, conf QueueConfig) error {
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = 1
+	}
+	slots := make(chan struct{}, conf.Concurrency)
+	var wg sync.WaitGroup
+	unsubscribe, err := conn.QueueSubscribe(conf.Subject, conf.Queue, func(msg QueueMessage) {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			s.serveJob(ctx, conn, msg)
+		}()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %q: %w", conf.Subject, err)
+	}
+	log.Info().Msgf("Consuming generation jobs from %q (queue group %q)", conf.Subject, conf.Queue)
+	if s.conf.Readiness != nil {
+		s.conf.Readiness.SetReady(true)
+	}
+
+	<-ctx.Done()
+	if s.conf.Readiness != nil {
+		s.conf.Readiness.SetReady(false)
+	}
+	err = unsubscribe()
+	wg.Wait()
+	return err
+}
+
+// serveJob runs the job of the message, publishing its results.
+func (s *Server) serveJob(ctx context.Context, conn QueueConn, msg QueueMessage) {
+	var job QueueJob
+	if err := json.Unmarshal(msg.Data, &job); err != nil {
+		log.Warn().Err(err).Msg("Discarding invalid generation job.")
+		return
+	}
+	out := &queueStream{conn: conn, id: job.ID, subject: job.ReplyTo}
+	if out.subject == "" {
+		out.subject = msg.Reply
+	}
+	if out.subject == "" {
+		log.Warn().Str("id", job.ID).Msg("Discarding generation job without reply subject.")
+		return
+	}
+	if job.ID != "" {
+		// the logs of the generation are correlated with the job
+		ctx = genid.With(ctx, job.ID)
+	}
+	if job.APIKey != "" {
+		ctx = withMetadata(ctx, metadata.Pairs("x-api-key", job.APIKey))
+	}
+	if err := s.serveGeneration(withPreset(ctx, job.Preset), job.Prompt, job.DecodingOptions, out); err != nil {
+		log.Debug().Err(err).Str("id", job.ID).Msg("Generation job failed.")
+		_ = out.publish(QueueResult{Done: true, Error: errorMessage(err)})
+	}
+}
+
+// queueStream is the tokenSender publishing the results of a job.
+type queueStream struct {
+	conn    QueueConn
+	id      string
+	subject string
+}
+
+func (q *queueStream) Send(tok *api.GeneratedToken) error {
+	if tok.Usage != nil {
+		return q.publish(QueueResult{
+			Done:             true,
+			PromptTokens:     int(tok.Usage.PromptTokens),
+			CompletionTokens: int(tok.Usage.CompletionTokens),
+		})
+	}
+	if tok.PromptProgress != nil || tok.Heartbeat != nil || tok.Warning != "" || tok.State != "" {
+		return nil
+	}
+	return q.publish(QueueResult{Text: tok.Token})
+}
+
+func (q *queueStream) publish(r QueueResult) error {
+	r.ID = q.id
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return q.conn.Publish(q.subject, data)
+}
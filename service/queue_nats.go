@@ -0,0 +1,30 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import "github.com/nats-io/nats.go"
+
+// NATSConn returns the QueueConn of a NATS connection.
+func NATSConn(nc *nats.Conn) QueueConn {
+	return natsConn{nc}
+}
+
+type natsConn struct {
+	nc *nats.Conn
+}
+
+func (c natsConn) QueueSubscribe(subject, queue string, handler func(QueueMessage)) (func() error, error) {
+	sub, err := c.nc.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
+		handler(QueueMessage{Data: msg.Data, Reply: msg.Reply})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub.Unsubscribe, nil
+}
+
+func (c natsConn) Publish(subject string, data []byte) error {
+	return c.nc.Publish(subject, data)
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memQueue is an in-memory QueueConn with a single subscriber.
+type memQueue struct {
+	mu        sync.Mutex
+	handler   func(QueueMessage)
+	published map[string][]QueueResult
+	done      chan string
+}
+
+func (q *memQueue) QueueSubscribe(_, _ string, handler func(QueueMessage)) (func() error, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handler = handler
+	return func() error { return nil }, nil
+}
+
+func (q *memQueue) Publish(subject string, data []byte) error {
+	var r QueueResult
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.published[subject] = append(q.published[subject], r)
+	q.mu.Unlock()
+	if r.Done {
+		q.done <- subject
+	}
+	return nil
+}
+
+func TestServeQueue(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+
+	q := &memQueue{published: map[string][]QueueResult{}, done: make(chan string, 2)}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- NewServer(vf, Config{}).ServeQueue(ctx, q, QueueConfig{Subject: "jobs", Queue: "workers"})
+	}()
+	require.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.handler != nil
+	}, time.Second, time.Millisecond)
+
+	// greedy decoding, see testdata/tiny-rwkv-golden.json
+	q.handler(QueueMessage{Data: []byte(`{"id": "1", "prompt": "the weather", "decoding_options": {"max_len": 6}}`), Reply: "inbox.1"})
+	q.handler(QueueMessage{Data: []byte(`{"id": "2", "prompt": "the weather", "decoding_options": {"max_len": 3}, "reply_to": "results"}`)})
+	assert.Equal(t, "inbox.1", <-q.done)
+	assert.Equal(t, "results", <-q.done)
+	cancel()
+	require.NoError(t, <-errCh)
+
+	var text string
+	results := q.published["inbox.1"]
+	for _, r := range results[:len(results)-1] {
+		assert.Equal(t, "1", r.ID)
+		text += r.Text
+	}
+	assert.Equal(t, "&ėĻ&ėĻ", text)
+	last := results[len(results)-1]
+	assert.Equal(t, QueueResult{ID: "1", Done: true, PromptTokens: last.PromptTokens, CompletionTokens: 6}, last)
+	assert.Len(t, q.published["results"], 4)
+}
+
+func TestServeQueue_APIKey(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+
+	q := &memQueue{published: map[string][]QueueResult{}, done: make(chan string, 2)}
+	s := NewServer(vf, Config{APIKeys: []string{"key-1"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ServeQueue(ctx, q, QueueConfig{Subject: "jobs", Queue: "workers"})
+	}()
+	require.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.handler != nil
+	}, time.Second, time.Millisecond)
+
+	q.handler(QueueMessage{Data: []byte(`{"id": "1", "prompt": "the weather", "decoding_options": {"max_len": 2}, "api_key": "key-1"}`), Reply: "inbox.1"})
+	q.handler(QueueMessage{Data: []byte(`{"id": "2", "prompt": "the weather", "decoding_options": {"max_len": 2}}`), Reply: "inbox.2"})
+	<-q.done
+	<-q.done
+	cancel()
+	require.NoError(t, <-errCh)
+
+	results := q.published["inbox.1"]
+	assert.Equal(t, QueueResult{ID: "1", Done: true, PromptTokens: results[len(results)-1].PromptTokens, CompletionTokens: 2}, results[len(results)-1])
+	assert.Equal(t, []QueueResult{{ID: "2", Done: true, Error: "unknown API key"}}, q.published["inbox.2"])
+	reports := s.usage.Report()
+	require.Len(t, reports, 1)
+	assert.Equal(t, "key-1", reports[0].Key)
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness tracks whether the process is ready to serve requests, for the
+// probes of orchestrators such as Kubernetes. It is not ready until the Server
+// is started, which happens after the model is loaded, and again when the
+// Server is shutting down.
+type Readiness struct {
+	ready atomic.Bool
+}
+
+// SetReady sets whether the process is ready to serve requests.
+func (r *Readiness) SetReady(ready bool) {
+	r.ready.Store(ready)
+}
+
+// Ready reports whether the process is ready to serve requests.
+func (r *Readiness) Ready() bool {
+	return r.ready.Load()
+}
+
+// Handler returns the handler of the probes: /healthz (liveness) always
+// succeeds, /readyz (readiness) fails with 503 Service Unavailable until the
+// process is ready.
+func (r *Readiness) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !r.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// ServeHealth serves the probes of the Readiness on the given address until
+// the context is done. It is meant to be started before loading the model, so
+// that the liveness probes succeed during the load.
+func ServeHealth(ctx context.Context, address string, r *Readiness) error {
+	return serveHTTP(ctx, "Health endpoints", address, DefaultSocketMode, r.Handler(), LimitsConfig{})
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/script"
+)
+
+// acceptToken is the decoder.TokenFilter running the accept-token script.
+func (s *Server) acceptToken(info decoder.StepInfo, tokenID int) (bool, error) {
+	token, err := s.vf.TokenByID(tokenID)
+	if err != nil {
+		return false, err
+	}
+	text, err := s.vf.Tokenizer.ReconstructText(info.Sequence)
+	if err != nil {
+		return false, err
+	}
+	return s.conf.Scripts.AcceptToken(script.TokenEnv{
+		Token:   token,
+		TokenID: tokenID,
+		Step:    info.Step,
+		Text:    text,
+	})
+}
@@ -6,47 +6,221 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"net"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/nlpodyssey/spago/ag"
 	"github.com/nlpodyssey/verbaflow"
 	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/audit"
+	"github.com/nlpodyssey/verbaflow/cache"
 	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/moderation"
+	"github.com/nlpodyssey/verbaflow/presets"
+	"github.com/nlpodyssey/verbaflow/prompts"
+	"github.com/nlpodyssey/verbaflow/script"
+	"github.com/nlpodyssey/verbaflow/sessions"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/nlpodyssey/verbaflow/usage"
+	"github.com/nlpodyssey/verbaflow/verrors"
+	"github.com/nlpodyssey/verbaflow/watermark"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
 	api.UnimplementedLanguageModelServer
 	vf         *verbaflow.VerbaFlow
+	conf       Config
+	flights    *flights
+	apiKeys    map[string]struct{}
+	usage      *usage.Tracker
 	health     *health.Server
 	grpcServer *grpc.Server
+	active     activeGenerations
+	// continuations are the states at the end of the last generations.
+	continuations continuations
 }
 
-func NewServer(vf *verbaflow.VerbaFlow) *Server {
-	return &Server{
+// Config contains the optional settings of the Server.
+type Config struct {
+	// Cache, when not nil, stores the results of deterministic generations
+	// so that identical requests are served without running the model.
+	Cache cache.Cache
+	// IdempotencyTTL is how long a completed generation can be replayed to the clients
+	// retrying a request with the same "idempotency-key" metadata. Requests with the
+	// same key (and API key) received while the generation is in progress attach to the same stream.
+	// Zero disables the support for idempotency keys.
+	IdempotencyTTL time.Duration
+	// Quota limits the tokens that each API key can consume.
+	Quota usage.Quota
+	// APIKeys, when not empty, are the only API keys accepted: the generation
+	// requests with other keys, or without one, are rejected. Otherwise any key
+	// is accepted, and a client can elude the Quota by changing its key.
+	APIKeys []string
+	// AdminToken is the token required to call the Admin service.
+	// When empty, the Admin service is disabled.
+	AdminToken string
+	// AuditLog, when not nil, records every served request.
+	AuditLog audit.Logger
+	// TranscriptDir, when not empty, is the directory of the write-ahead
+	// transcripts of the sessions, one per API key: the prompt of each generation
+	// is written before it, its tokens as they are generated (see the transcript
+	// package).
+	TranscriptDir string
+	// SessionStore, when not nil, stores the state at the end of the last
+	// generation of each API key, which the requests with the continue flag
+	// continue after a restart, or on another instance sharing the store, and
+	// the transcripts, if TranscriptDir is empty.
+	SessionStore sessions.SessionStore
+	// Moderation, when not nil, checks the prompts and the completions.
+	Moderation moderation.Filter
+	// TextProcessors are applied in order to the text of each response before it is sent.
+	TextProcessors []textproc.Factory
+	// Pipeline, when not empty, is the sampler pipeline of all the generations
+	// (see decoder.DecodingOptions.Pipeline).
+	Pipeline []string
+	// Sampler, when not empty, is the custom selection of the next token of all the
+	// generations (see decoder.DecodingOptions.Sampler).
+	Sampler string
+	// Params are the parameters of the custom stages and samplers, by name.
+	Params map[string]json.RawMessage
+	// Scripts, when not nil, are the user-provided expressions run before the
+	// generation, for each token, and on the completion. When the completion is
+	// transformed, the response is sent at the end of the generation.
+	Scripts *script.Hooks
+	// Watermark, when not nil, watermarks all the generations.
+	Watermark *watermark.Config
+	// OllamaAddress, when not empty, is the address serving the Ollama-compatible
+	// HTTP API (see OllamaHandler).
+	OllamaAddress string
+	// KoboldAddress, when not empty, is the address serving the KoboldAI-compatible
+	// HTTP API (see KoboldHandler).
+	KoboldAddress string
+	// ModelName is the name of the served model reported by the HTTP APIs.
+	ModelName string
+	// Readiness, when not nil, is set ready once the server is listening (or
+	// consuming the queue), and not ready when it is shutting down.
+	Readiness *Readiness
+	// DebugAddress, when not empty, is the address serving the pprof profiles
+	// (/debug/pprof/) and the expvar variables (/debug/vars) over HTTP.
+	// It must not be exposed publicly.
+	DebugAddress string
+	// DryRun answers the requests with the report of the prompt, after the
+	// transformations of the server, of its tokens and of the active stop
+	// conditions, without running the model (see api.DryRun). The HTTP APIs
+	// respond with the report as JSON text.
+	DryRun bool
+	// Limits are the limits of the gRPC server and of the HTTP APIs, with safe
+	// defaults.
+	Limits LimitsConfig
+	// SocketMode is the permissions of the Unix domain sockets the servers listen
+	// on, when their address is "unix:///path/to/socket" (default: DefaultSocketMode).
+	SocketMode os.FileMode
+	// HeartbeatInterval is how long a stream can stay idle, e.g. during the
+	// encoding of a long prompt, before a heartbeat is sent to keep the connection
+	// alive (default: DefaultHeartbeatInterval). A negative value disables them.
+	HeartbeatInterval time.Duration
+	// Backpressure is what the generations do when their clients are slower than
+	// the model (default: the generation waits for the client).
+	Backpressure BackpressureConfig
+	// PauseTimeout is how long a generation paused by its client can stay paused
+	// before it is aborted (default: DefaultPauseTimeout).
+	PauseTimeout time.Duration
+	// ContinuationTTL is how long the state at the end of the last generation of
+	// each API key is kept, to be continued by the requests with the continue flag
+	// (default: DefaultContinuationTTL). A negative value disables the continuations.
+	ContinuationTTL time.Duration
+	// HalfStates keeps the states of the continuations and of the presets in
+	// float16, in about 60% of the memory (see verbaflow.VerbaFlow.HalfStates):
+	// NewServer sets it on the model, which must be set before reading the states
+	// of the presets to keep them in float16 too.
+	HalfStates bool
+	// ChatFormat is the prompt format of the chat messages of the Ollama API
+	// (default: the "transcript" format of the prompts package).
+	ChatFormat *prompts.Format
+	// Presets are the presets which the requests can select by name (see
+	// api.TokenGenerationRequest.Preset).
+	Presets presets.Presets
+	// DefaultPreset, when not empty, is the name of the preset of the requests
+	// selecting none.
+	DefaultPreset string
+}
+
+func NewServer(vf *verbaflow.VerbaFlow, conf Config) *Server {
+	s := &Server{
 		vf:         vf,
+		conf:       conf,
+		usage:      usage.NewTracker(conf.Quota),
 		health:     health.NewServer(),
-		grpcServer: grpc.NewServer(),
+		grpcServer: grpc.NewServer(conf.Limits.grpcOptions()...),
+	}
+	if conf.HalfStates {
+		vf.HalfStates = true
+	}
+	if conf.IdempotencyTTL > 0 {
+		s.flights = newFlights(conf.IdempotencyTTL)
+	}
+	if len(conf.APIKeys) > 0 {
+		s.apiKeys = make(map[string]struct{}, len(conf.APIKeys))
+		for _, key := range conf.APIKeys {
+			s.apiKeys[key] = struct{}{}
+		}
 	}
+	return s
 }
 
 func (s *Server) Start(ctx context.Context, address string) error {
-	lis, err := net.Listen("tcp", address)
+	lis, err := listen(address, s.conf.SocketMode)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
 	grpc_health_v1.RegisterHealthServer(s.grpcServer, s.health)
 	api.RegisterLanguageModelServer(s.grpcServer, s)
+	if s.conf.AdminToken != "" {
+		api.RegisterAdminServer(s.grpcServer, &adminServer{s: s})
+	}
 
 	s.health.SetServingStatus(api.LanguageModel_ServiceDesc.ServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
 
+	if s.conf.OllamaAddress != "" {
+		go func() {
+			if err := serveHTTP(ctx, "Ollama API", s.conf.OllamaAddress, s.conf.SocketMode, s.conf.Limits.handler(s.OllamaHandler()), s.conf.Limits); err != nil {
+				log.Err(err).Msg("Ollama API server failed")
+			}
+		}()
+	}
+	if s.conf.KoboldAddress != "" {
+		go func() {
+			if err := serveHTTP(ctx, "KoboldAI API", s.conf.KoboldAddress, s.conf.SocketMode, s.conf.Limits.handler(s.KoboldHandler()), s.conf.Limits); err != nil {
+				log.Err(err).Msg("KoboldAI API server failed")
+			}
+		}()
+	}
+	if s.conf.DebugAddress != "" {
+		go func() {
+			if err := serveHTTP(ctx, "Debug endpoints", s.conf.DebugAddress, s.conf.SocketMode, newDebugHandler(), s.conf.Limits); err != nil {
+				log.Err(err).Msg("debug server failed")
+			}
+		}()
+	}
+
 	go s.shutDownServerWhenContextIsDone(ctx)
+	if s.conf.Readiness != nil {
+		s.conf.Readiness.SetReady(true)
+	}
 	return s.grpcServer.Serve(lis)
 }
 
@@ -54,6 +228,9 @@ func (s *Server) Start(ctx context.Context, address string) error {
 func (s *Server) shutDownServerWhenContextIsDone(ctx context.Context) {
 	<-ctx.Done()
 	log.Info().Msg("context done, shutting down server")
+	if s.conf.Readiness != nil {
+		s.conf.Readiness.SetReady(false)
+	}
 	s.health.Shutdown()
 	s.grpcServer.GracefulStop()
 	log.Info().Msg("server shut down successfully")
@@ -61,64 +238,332 @@ func (s *Server) shutDownServerWhenContextIsDone(ctx context.Context) {
 
 // GenerateTokens implements the GenerateTokens method of the LanguageModel service.
 func (s *Server) GenerateTokens(req *api.TokenGenerationRequest, stream api.LanguageModel_GenerateTokensServer) error {
-	ctx := stream.Context()
-	log.Debug().Msgf("Received request from", ctx.Value("client"))
+	ctx := withPreset(withContinue(stream.Context(), req.GetContinue()), req.GetPreset())
+	return s.serveGeneration(ctx, req.GetPrompt(), grpcToDecodingOptions(req.GetDecodingParameters()), stream)
+}
 
-	opts := grpcToDecodingOptions(req.GetDecodingParameters())
+// serveGeneration serves a generation request of any API, sending the response
+// with sender.
+//
+// A panic is recovered, failing the request alone instead of the whole server.
+func (s *Server) serveGeneration(ctx context.Context, prompt string, opts decoder.DecodingOptions, sender tokenSender) (err error) {
+	// the ID is new, unless the API assigned it to return it to the client
+	ctx, id := genid.Ensure(ctx)
+	sender = idSender{tokenSender: sender, id: id}
+	defer func() {
+		if r := recover(); r != nil {
+			pe := verrors.Recovered(r)
+			genid.Logger(ctx).Error().Str("stack", string(pe.Stack)).Msgf("recovered from panic serving a generation: %v", r)
+			err = generationError(pe)
+		}
+	}()
+	genid.Logger(ctx).Debug().Msgf("Received request from %v", ctx.Value("client"))
+	started := time.Now()
+	metrics.Add(metricRequests, 1)
 
-	// chGen is a channel that will receive the generated tokens
-	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
-	errCh := make(chan error)
-	go func() {
-		// free the computational graph after the generation is finished
-		nt := &ag.NodesTracker{}
-		defer nt.ReleaseNodes()
+	key := apiKey(ctx)
+	if !s.knownKey(key) {
+		return status.Error(codes.Unauthenticated, "unknown API key")
+	}
+	if err := s.usage.Check(key); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
 
-		log.Trace().Msgf("Decoding...")
-		start := time.Now()
-		errCh <- s.vf.Generate(ctx, nt, req.GetPrompt(), chGen, opts)
-		log.Trace().Msgf("Inference time: %.2f seconds", time.Since(start).Seconds())
-	}()
+	preset, err := s.preset(ctx)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if preset != nil {
+		opts = preset.Defaults(opts)
+	}
+	opts.Pipeline, opts.Sampler, opts.Params = s.conf.Pipeline, s.conf.Sampler, s.conf.Params
+	if s.conf.Watermark != nil {
+		opts.LogitsProcessors = append(opts.LogitsProcessors, watermark.NewProcessor(*s.conf.Watermark))
+	}
 
-	checkWriteConditions := func(tokenID int) bool {
-		return !(tokenID == opts.EndTokenID && opts.SkipEndTokenID)
+	prompt, err = s.conf.Scripts.TransformPrompt(prompt)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	warnings := requestWarnings(ctx)
+	moderated, err := s.moderatePrompt(ctx, prompt)
+	if err != nil {
+		return err
+	}
+	if moderated != prompt {
+		warnings = append(warnings, "the prompt was redacted by the content filter")
+		prompt = moderated
+	}
+	if preset != nil && !continueRequested(ctx) {
+		// a continuation already follows the system prompt
+		prompt = preset.Prefix() + prompt
+	}
+	if s.conf.Scripts.HasAcceptToken() {
+		opts.AcceptToken = s.acceptToken
+	}
+	if s.conf.DryRun {
+		return s.dryRun(prompt, opts, sender)
 	}
 
-	for gen := range chGen {
-		if !checkWriteConditions(gen.TokenID) {
-			continue
+	promptTokens, err := s.vf.CountTokens(prompt)
+	if err != nil {
+		return err
+	}
+	// checked before the response is started, to fail with the status of the error
+	if err := s.vf.CheckPromptLength(promptTokens); err != nil {
+		return generationError(err)
+	}
+	// the last generation of the API key is continued, or superseded
+	var from *verbaflow.Continuation
+	continued := continueRequested(ctx)
+	if continued {
+		if key == anonymousKey {
+			return status.Error(codes.FailedPrecondition, "no generation to continue: the continuations require an API key")
+		}
+		var ok bool
+		if from, ok = s.lookupContinuation(ctx, key); !ok {
+			return status.Error(codes.FailedPrecondition, "no generation to continue: the last one is unknown, expired, or didn't end by itself")
 		}
-		token, err := s.vf.TokenByID(gen.TokenID)
+	} else if s.continuable(key) {
+		s.forgetContinuation(ctx, key)
+	}
+	// text is the part of the prompt encoded after from
+	text := prompt
+	if preset != nil && preset.State != nil && !continued {
+		// the system prompt is encoded in the state of the preset
+		from, text = preset.State, strings.TrimPrefix(prompt, preset.Prefix())
+	}
+	ctx, active := s.active.start(ctx, id, key, promptTokens)
+	defer s.active.finish(active)
+	heartbeats := newHeartbeatSender(ctx, sender, s.conf.HeartbeatInterval, started)
+	defer heartbeats.stop()
+	out := newResponseStream(ctx, s, heartbeats, opts, prompt, promptTokens)
+	out.active, out.started = active, started
+	active.sender = heartbeats
+	out.sendWarnings(warnings)
+
+	if s.conf.AuditLog != nil {
+		defer func() {
+			s.audit(id, started, prompt, opts, out.completion, out.sent.String(), out.usage, err)
+		}()
+	}
+
+	cacheKey, readCache, writeCache := s.cachePolicy(ctx, prompt, opts)
+	if continued {
+		// the prompt alone doesn't determine the continuations
+		readCache, writeCache = false, false
+	}
+	if readCache {
+		tokens, ok, err := s.conf.Cache.Get(ctx, cacheKey)
 		if err != nil {
-			return fmt.Errorf("failed to reconstruct text for token ID %d", gen.TokenID)
+			genid.Logger(ctx).Warn().Err(err).Msg("failed to read from cache")
 		}
-		if err = stream.Send(&api.GeneratedToken{
-			Token: token,
-			Score: float32(gen.SumNegLogProbs),
-		}); err != nil {
-			return err
+		if ok {
+			genid.Logger(ctx).Debug().Msg("Serving cached result.")
+			t := s.beginTranscript(ctx, key, id, text, from, continued, opts)
+			defer t.end(nil)
+			for _, gen := range tokens {
+				t.token(gen.TokenID)
+				if err := out.send(gen); err != nil {
+					return out.finish(err)
+				}
+			}
+			s.usage.Record(key, out.usage)
+			s.saveCachedContinuation(ctx, key, prompt, text, from, opts, tokens)
+			return out.finish(nil)
 		}
 	}
 
-	err := <-errCh
+	idemKey := idempotencyKey(ctx)
+	if idemKey == "" || s.flights == nil || continued {
+		// the stream is established before the prompt is encoded, waiting for a free slot
+		out.sendProgress(0, promptTokens)
+		opts.PromptProgress = out.sendProgress
+		var next *verbaflow.Continuation
+		opts.FinalState = s.finalState(ctx, key, &next)
+		t := s.beginTranscript(ctx, key, id, text, from, continued, opts)
+		generated, err := s.generate(ctx, from, text, opts, t, out.sendBuffered)
+		if err == nil && next != nil {
+			s.saveContinuation(ctx, key, next)
+		}
+		s.usage.Record(key, usage.Usage{PromptTokens: promptTokens, CompletionTokens: len(generated) + out.dropped})
+		// a cancelled generation, or one with dropped tokens, is incomplete and must not be cached
+		if err == nil && writeCache && ctx.Err() == nil && out.dropped == 0 {
+			s.storeInCache(ctx, cacheKey, generated)
+		}
+		return out.finish(err)
+	}
+
+	fk := flightKey{apiKey: key, idempotencyKey: idemKey}
+	f, isNew, err := s.flights.join(fk, cache.Key(prompt, opts))
 	if err != nil {
 		return err
 	}
+	if isNew {
+		// the usage is recorded by the generation, which is shared with the retried requests
+		go func() {
+			opts := opts
+			opts.FinalState = s.finalState(f.ctx, key, &f.continuation)
+			t := s.beginTranscript(f.ctx, key, id, text, from, continued, opts)
+			// f.append doesn't block, no token is dropped
+			generated, err := s.generate(f.ctx, from, text, opts, t, func(t bufferedToken) error {
+				if t.trailing {
+					return nil
+				}
+				return f.append(t.gen)
+			})
+			s.usage.Record(key, usage.Usage{PromptTokens: promptTokens, CompletionTokens: len(generated)})
+			if err == nil && writeCache && f.ctx.Err() == nil {
+				s.storeInCache(f.ctx, cacheKey, generated)
+			}
+			s.flights.finish(fk, f, err)
+		}()
+	} else {
+		genid.Logger(ctx).Debug().Str("idempotency_key", idemKey).Msg("Attaching to existing generation.")
+	}
+	err = f.stream(ctx, out.send)
+	if err == nil && f.continuation != nil {
+		// every request of the flight continues the shared generation
+		s.saveContinuation(ctx, key, f.continuation)
+	}
+	return out.finish(err)
+}
+
+// generate runs the generation for the given prompt, continuing from, if not nil, calling
+// fn for each generated token, buffered according to the backpressure policy. It returns
+// the sequence of the tokens passed to fn, which is partial in case of error. The
+// tokens are written to the transcript t, if not nil, as soon as they are generated.
+func (s *Server) generate(ctx context.Context, from *verbaflow.Continuation, prompt string, opts decoder.DecodingOptions, t *sessionTranscript, fn func(bufferedToken) error) (_ []decoder.GeneratedToken, err error) {
+	defer func() { t.end(err) }()
+	// stop the generation as soon as fn fails
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// chGen is a channel that will receive the generated tokens, to be buffered
+	chGen := make(chan decoder.GeneratedToken)
+	var gate *pauseGate
+	if g := activeFromContext(ctx); g != nil {
+		gate = &g.gate
+	}
+	pauseTimeout := s.conf.PauseTimeout
+	if pauseTimeout <= 0 {
+		pauseTimeout = DefaultPauseTimeout
+	}
+	buffered := s.conf.Backpressure.buffer(ctx, cancel, chGen, gate, pauseTimeout)
+	defer func() {
+		// the tokens left when fn fails are released as the decoder stops
+		go func() {
+			for t := range buffered {
+				if !t.trailing {
+					metrics.Add(metricBufferedTokens, -1)
+				}
+			}
+		}()
+	}()
+	errCh := make(chan error, 1)
+	metrics.Add(metricActiveGenerations, 1)
+	go func() {
+		defer metrics.Add(metricActiveGenerations, -1)
+		// free the computational graph after the generation is finished
+		nt := &ag.NodesTracker{}
+		defer graph.ReleaseNodes(nt)
 
-	log.Debug().Msg("Done.")
-	return nil
+		genid.Logger(ctx).Trace().Msgf("Decoding...")
+		start := time.Now()
+		decoded := t.tee(chGen)
+		if from != nil {
+			errCh <- s.vf.GenerateContinuation(ctx, nt, from, prompt, decoded, opts)
+		} else {
+			errCh <- s.vf.Generate(ctx, nt, prompt, decoded, opts)
+		}
+		genid.Logger(ctx).Trace().Msgf("Inference time: %.2f seconds", time.Since(start).Seconds())
+	}()
+
+	var generated []decoder.GeneratedToken
+	for t := range buffered {
+		if !t.trailing {
+			metrics.Add(metricBufferedTokens, -1)
+			generated = append(generated, t.gen)
+			metrics.Add(metricGeneratedTokens, 1)
+		}
+		if err := fn(t); err != nil {
+			return generated, err
+		}
+	}
+
+	err = <-errCh
+	switch context.Cause(ctx) {
+	case errClientStalled:
+		return generated, status.Error(codes.DeadlineExceeded, errClientStalled.Error())
+	case errGenerationAborted:
+		// the generation is completed with the tokens generated so far
+		return generated, errStopGeneration
+	}
+	return generated, err
+}
+
+func (s *Server) storeInCache(ctx context.Context, key string, generated []decoder.GeneratedToken) {
+	if err := s.conf.Cache.Set(ctx, key, generated); err != nil {
+		genid.Logger(ctx).Warn().Err(err).Msg("failed to write to cache")
+	}
+}
+
+// cachePolicy returns the cache key of the request and whether the cache can be read and written.
+// Clients can bypass the cache with the "cache-control" metadata (or HTTP header): "no-cache"
+// skips the lookup, "no-store" prevents the result from being stored.
+func (s *Server) cachePolicy(ctx context.Context, prompt string, opts decoder.DecodingOptions) (key string, read, write bool) {
+	if s.conf.Cache == nil || !cache.IsDeterministic(opts) {
+		return "", false, false
+	}
+	read, write = true, true
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get("cache-control") {
+			switch v {
+			case "no-cache":
+				read = false
+			case "no-store":
+				write = false
+			}
+		}
+	}
+	return cache.Key(prompt, opts), read, write
 }
 
 func grpcToDecodingOptions(dp *api.DecodingParameters) decoder.DecodingOptions {
+	var stopIDs [][]int
+	for _, seq := range dp.GetStopSequences() {
+		if len(seq.GetSequence()) == 0 {
+			continue
+		}
+		ids := make([]int, len(seq.GetSequence()))
+		for i, id := range seq.GetSequence() {
+			ids[i] = int(id)
+		}
+		stopIDs = append(stopIDs, ids)
+	}
+	var stopRegexps []string
+	for _, s := range dp.GetStopStrings() {
+		if s == "" {
+			continue
+		}
+		stopRegexps = append(stopRegexps, regexp.QuoteMeta(s))
+	}
 	return decoder.DecodingOptions{
 		MaxLen:           int(dp.MaxLen),
 		MinLen:           int(dp.MinLen),
-		StopSequencesIDs: nil,
+		StopSequencesIDs: stopIDs,
+		StopRegexps:      stopRegexps,
 		EndTokenID:       int(dp.EndTokenId),
 		SkipEndTokenID:   dp.SkipEndTokenId,
 		Temp:             float64(dp.Temperature),
 		TopK:             int(dp.TopK),
 		TopP:             float64(dp.TopP),
 		UseSampling:      dp.UseSampling,
+		Seed:             dp.Seed,
+		RecordTiming:     dp.RecordTiming,
+		LengthPenalty:    float64(dp.LengthPenalty),
+		DeadlineAware:    dp.DeadlineAware,
+		Choices:          dp.Choices,
+		Regexp:           dp.Regexp,
 	}
 }
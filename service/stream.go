@@ -0,0 +1,285 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/api"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/textproc"
+	"github.com/nlpodyssey/verbaflow/usage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errStopGeneration is returned by responseStream.send to stop the generation
+// without reporting an error to the client.
+var errStopGeneration = errors.New("generation stopped")
+
+// generationError returns the gRPC status error corresponding to the kind of
+// the error of a generation; the other errors are returned as they are.
+func generationError(err error) error {
+	switch {
+	case errors.Is(err, verbaflow.ErrPromptTooLong):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, verbaflow.ErrDecodingAborted):
+		if errors.Is(err, context.DeadlineExceeded) {
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, verbaflow.ErrModelNotLoaded), errors.Is(err, verbaflow.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.As(err, new(*verbaflow.PanicError)):
+		// the details are logged, not disclosed to the client
+		return status.Error(codes.Internal, "internal error during the generation")
+	default:
+		return err
+	}
+}
+
+// tokenSender sends the messages of a response, implemented by the gRPC stream
+// and by the adapters of the HTTP APIs.
+type tokenSender interface {
+	Send(*api.GeneratedToken) error
+}
+
+// idSender is the tokenSender setting the ID of the generation in every message.
+type idSender struct {
+	tokenSender
+	id string
+}
+
+func (s idSender) Send(tok *api.GeneratedToken) error {
+	tok.GenerationId = s.id
+	return s.tokenSender.Send(tok)
+}
+
+// responseStream sends the generated tokens of a request to the client,
+// keeping track of the completion and of its usage.
+type responseStream struct {
+	ctx    context.Context
+	s      *Server
+	stream tokenSender
+	// opts are the options of the generation, with the defaults of the model
+	// (e.g. the MaxLen which truncates the completion).
+	opts  decoder.DecodingOptions
+	usage usage.Usage
+	// completion is the sequence of token IDs sent to the client, and sent the
+	// text of the messages, as transformed before being sent.
+	completion []int
+	sent       strings.Builder
+	// text is the completion text, used for moderation, and released the length
+	// of its beginning sent to the client, the rest being withheld.
+	text     strings.Builder
+	released int
+	// proc transforms the text before it is sent.
+	proc textproc.Processor
+	// prompt is the prompt of the generation, passed to the post-completion script.
+	prompt string
+	// held is the text withheld until the end of the generation, to be transformed
+	// by the post-completion script.
+	held strings.Builder
+	// lastScore is the score of the last generated token.
+	lastScore float32
+	// lastTiming is the timing of the last generated token, if recorded.
+	lastTiming *decoder.TokenTiming
+	// truncated reports whether the generation was stopped by the maximum length.
+	truncated bool
+	// dropped is the number of tokens dropped because the client was too slow
+	// (see BackpressureDrop), and pendingDrops those not reported yet.
+	dropped      int
+	pendingDrops int
+	// active, when not nil, is the registration of the generation with the Admin service.
+	active *activeGeneration
+	// started is when the response was started, and firstToken when the first
+	// token was generated, for the statistics of the last message.
+	started    time.Time
+	firstToken time.Time
+}
+
+func newResponseStream(ctx context.Context, s *Server, stream tokenSender, opts decoder.DecodingOptions, prompt string, promptTokens int) *responseStream {
+	return &responseStream{
+		ctx:     ctx,
+		s:       s,
+		stream:  stream,
+		opts:    s.vf.GenerationConfig.Defaults(opts),
+		prompt:  prompt,
+		usage:   usage.Usage{PromptTokens: promptTokens},
+		proc:    textproc.NewChain(s.conf.TextProcessors),
+		started: time.Now(),
+	}
+}
+
+// sendBuffered sends the token generated after the tokens dropped by the
+// backpressure policy, if any, reporting them in its message.
+func (r *responseStream) sendBuffered(t bufferedToken) error {
+	if t.dropped > 0 {
+		genid.Logger(r.ctx).Debug().Msgf("%d tokens dropped for the slow client", t.dropped)
+		r.dropped += t.dropped
+		r.pendingDrops += t.dropped
+		r.usage.CompletionTokens += t.dropped
+	}
+	if t.trailing {
+		return nil
+	}
+	return r.send(t.gen)
+}
+
+// send sends the generated token to the client, unless it is the end token to be skipped.
+func (r *responseStream) send(gen decoder.GeneratedToken) error {
+	if r.usage.CompletionTokens == 0 {
+		r.firstToken = time.Now()
+	}
+	r.usage.CompletionTokens++
+	if r.active != nil {
+		r.active.generated.Add(1)
+	}
+	r.truncated = r.usage.CompletionTokens >= r.opts.MaxLen && gen.TokenID != r.opts.EndTokenID
+	if gen.TokenID == r.opts.EndTokenID && r.opts.SkipEndTokenID {
+		return nil
+	}
+	r.completion = append(r.completion, gen.TokenID)
+
+	start := time.Now()
+	token, err := r.s.vf.TokenByID(gen.TokenID)
+	if err != nil {
+		return fmt.Errorf("failed to reconstruct text for token ID %d", gen.TokenID)
+	}
+	if gen.Timing != nil {
+		timing := *gen.Timing
+		timing.Detokenize = time.Since(start)
+		r.lastTiming = &timing
+	}
+
+	stop := false
+	if r.s.conf.Moderation != nil {
+		if token, stop, err = r.moderate(token); err != nil {
+			return err
+		}
+	}
+
+	r.lastScore = float32(decoder.NormalizeScore(gen.SumNegLogProbs, r.usage.CompletionTokens, r.opts.LengthPenalty))
+	if err = r.sendText(r.proc.Process(token)); err != nil {
+		return err
+	}
+	if stop {
+		return errStopGeneration
+	}
+	return nil
+}
+
+// sendText sends the (processed) text to the client, skipping empty texts.
+func (r *responseStream) sendText(text string) error {
+	if text == "" {
+		return nil
+	}
+	if r.s.conf.Scripts.HasPostCompletion() {
+		r.held.WriteString(text)
+		return nil
+	}
+	return r.sendMessage(text)
+}
+
+func (r *responseStream) sendMessage(text string) error {
+	if text == "" {
+		return nil
+	}
+	tok := &api.GeneratedToken{
+		Token:         text,
+		Score:         r.lastScore,
+		Timing:        timingToGRPC(r.lastTiming),
+		DroppedTokens: int64(r.pendingDrops),
+	}
+	r.pendingDrops = 0
+	r.sent.WriteString(text)
+	return r.stream.Send(tok)
+}
+
+// sendProgress reports the progress of the encoding of the prompt, so that the
+// client sees some activity before the first token of a long prompt.
+func (r *responseStream) sendProgress(encoded, total int) {
+	err := r.stream.Send(&api.GeneratedToken{
+		PromptProgress: &api.PromptProgress{EncodedTokens: int64(encoded), TotalTokens: int64(total)},
+	})
+	if err != nil {
+		// the failure is reported by the sending of the first token
+		genid.Logger(r.ctx).Debug().Err(err).Msg("failed to send the prompt progress")
+	}
+}
+
+// sendWarnings sends the warnings about the request, each in its own message.
+func (r *responseStream) sendWarnings(warnings []string) {
+	for _, warning := range warnings {
+		if err := r.stream.Send(&api.GeneratedToken{Warning: warning}); err != nil {
+			// the failure is reported by the sending of the first token
+			genid.Logger(r.ctx).Debug().Err(err).Msg("failed to send a warning")
+			return
+		}
+	}
+}
+
+func timingToGRPC(t *decoder.TokenTiming) *api.TokenTiming {
+	if t == nil {
+		return nil
+	}
+	return &api.TokenTiming{
+		EmbeddingUs:  t.Embedding.Microseconds(),
+		EncoderUs:    t.Encoder.Microseconds(),
+		HeadUs:       t.Head.Microseconds(),
+		SamplingUs:   t.Sampling.Microseconds(),
+		DetokenizeUs: t.Detokenize.Microseconds(),
+	}
+}
+
+// finish completes the stream: if err is nil (or errStopGeneration), the final
+// message carrying the usage is sent, otherwise err is returned.
+func (r *responseStream) finish(err error) error {
+	if err != nil && err != errStopGeneration {
+		return generationError(err)
+	}
+	if err := r.sendText(r.proc.Process(r.withheld())); err != nil {
+		return err
+	}
+	if r.truncated && err == nil {
+		textproc.MarkTruncated(r.proc)
+	}
+	if err := r.sendText(r.proc.Flush()); err != nil {
+		return err
+	}
+	if r.s.conf.Scripts.HasPostCompletion() {
+		text, err := r.s.conf.Scripts.TransformCompletion(r.prompt, r.held.String())
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := r.sendMessage(text); err != nil {
+			return err
+		}
+	}
+	genid.Logger(r.ctx).Debug().Msg("Done.")
+	return r.stream.Send(&api.GeneratedToken{Usage: usageToGRPC(r.usage), Done: r.done()})
+}
+
+// done returns the statistics of the completed generation.
+func (r *responseStream) done() *api.Done {
+	d := &api.Done{
+		FinishReason:  "stop",
+		ElapsedMs:     time.Since(r.started).Milliseconds(),
+		DroppedTokens: int64(r.dropped),
+	}
+	if r.truncated {
+		d.FinishReason = "length"
+	}
+	if elapsed := time.Since(r.firstToken).Seconds(); r.usage.CompletionTokens > 0 && elapsed > 0 {
+		d.TokensPerSecond = float64(r.usage.CompletionTokens) / elapsed
+	}
+	return d
+}
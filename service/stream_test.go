@@ -0,0 +1,41 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_FinishReason_DefaultMaxLen(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	maxNewTokens := 6
+	vf.GenerationConfig = &verbaflow.GenerationConfig{MaxNewTokens: &maxNewTokens}
+	s := NewServer(vf, Config{ModelName: "tiny"})
+
+	finishReason := func(opts decoder.DecodingOptions) string {
+		var rec recordingSender
+		require.NoError(t, s.serveGeneration(context.Background(), "the weather", opts, &rec))
+		last := rec.messages[len(rec.messages)-1]
+		require.NotNil(t, last.Done)
+		return last.Done.FinishReason
+	}
+	// MaxLen is left to zero: the generation_config sets it
+	opts := decoder.DecodingOptions{EndTokenID: -1, Temp: 1, TopP: 1}
+	assert.Equal(t, "length", finishReason(opts))
+
+	chGen := make(chan decoder.GeneratedToken, 1)
+	require.NoError(t, vf.Generate(context.Background(), &ag.NodesTracker{}, "the weather", chGen, decoder.DecodingOptions{MaxLen: 1, EndTokenID: -1, Temp: 1, TopP: 1}))
+	opts.StopSequencesIDs = [][]int{{(<-chGen).TokenID}}
+	assert.Equal(t, "stop", finishReason(opts))
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/sessions"
+	"github.com/nlpodyssey/verbaflow/transcript"
+)
+
+// sessionTranscript writes a generation to the transcript of its session, the
+// API key (see Config.TranscriptDir and Config.SessionStore). The failures are
+// logged, once, without affecting the generation. A nil sessionTranscript
+// writes nothing.
+type sessionTranscript struct {
+	ctx      context.Context
+	w        transcriptWriter
+	vf       *verbaflow.VerbaFlow
+	id       string
+	failOnce sync.Once
+
+	mu     sync.Mutex
+	tokens []int
+	// ended is set by end: the tokens generated after it, e.g. once the client
+	// is gone, are not written
+	ended bool
+}
+
+// beginTranscript writes the prompt of the generation to the transcript of the
+// session, before the generation: the text encoded after from, if not nil,
+// which is the state of the previous generation if continued, or the one of a
+// preset, whose tokens begin the prompt. It returns nil if the transcripts are
+// disabled.
+func (s *Server) beginTranscript(ctx context.Context, key, id, text string, from *verbaflow.Continuation, continued bool, opts decoder.DecodingOptions) *sessionTranscript {
+	var w transcriptWriter
+	switch {
+	case s.conf.TranscriptDir != "":
+		f, err := transcript.Open(transcript.Path(s.conf.TranscriptDir, key))
+		if err != nil {
+			genid.Logger(ctx).Warn().Err(err).Msg("failed to open the transcript")
+			return nil
+		}
+		w = f
+	case s.conf.SessionStore != nil:
+		w = storeTranscript{store: s.conf.SessionStore, session: key}
+	default:
+		return nil
+	}
+	t := &sessionTranscript{ctx: ctx, w: w, vf: s.vf, id: id}
+	tokens, err := s.vf.Tokenizer.Tokenize(text)
+	if err != nil {
+		t.fail(err)
+		return t
+	}
+	if from != nil && !continued {
+		tokens = append(append([]int(nil), from.Tokens()...), tokens...)
+		text = ""
+	}
+	t.write(transcript.Entry{
+		Kind:     transcript.KindPrompt,
+		Text:     text,
+		TokenIDs: tokens,
+		Continue: continued,
+		Options:  &opts,
+	})
+	return t
+}
+
+// token writes a generated token.
+func (t *sessionTranscript) token(id int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended {
+		return
+	}
+	t.tokens = append(t.tokens, id)
+	t.write(transcript.Entry{Kind: transcript.KindToken, TokenID: id})
+}
+
+// tee returns the channel of the decoder, whose tokens are written as soon as
+// they are generated, then forwarded to out, which is closed with it.
+func (t *sessionTranscript) tee(out chan decoder.GeneratedToken) chan decoder.GeneratedToken {
+	if t == nil {
+		return out
+	}
+	in := make(chan decoder.GeneratedToken)
+	go func() {
+		defer close(out)
+		for gen := range in {
+			t.token(gen.TokenID)
+			out <- gen
+		}
+	}()
+	return in
+}
+
+// end writes the end of the generation, with the text of the generated tokens or
+// the error, committing the transcript to stable storage.
+func (t *sessionTranscript) end(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended = true
+	e := transcript.Entry{Kind: transcript.KindEnd}
+	if err != nil && !errors.Is(err, errStopGeneration) {
+		e.Error = err.Error()
+	}
+	if text, err := t.vf.Tokenizer.ReconstructText(t.tokens); err == nil {
+		e.Text = text
+	}
+	t.write(e)
+	if err := t.w.Sync(); err != nil {
+		t.fail(err)
+	}
+	if err := t.w.Close(); err != nil {
+		t.fail(err)
+	}
+}
+
+func (t *sessionTranscript) write(e transcript.Entry) {
+	e.GenerationID = t.id
+	if err := t.w.Write(e); err != nil {
+		t.fail(err)
+	}
+}
+
+func (t *sessionTranscript) fail(err error) {
+	t.failOnce.Do(func() {
+		genid.Logger(t.ctx).Warn().Err(err).Msg("failed to write the transcript")
+	})
+}
+
+// transcriptWriter writes the entries of a transcript: a transcript.Writer, or
+// a storeTranscript.
+type transcriptWriter interface {
+	Write(transcript.Entry) error
+	Sync() error
+	Close() error
+}
+
+// storeTranscript writes the entries to the transcript of a session in a
+// SessionStore, each as soon as it is written.
+type storeTranscript struct {
+	store   sessions.SessionStore
+	session string
+}
+
+func (t storeTranscript) Write(e transcript.Entry) error {
+	// the entries are written even if the client is already gone
+	return t.store.AppendTranscript(context.Background(), t.session, e)
+}
+
+func (storeTranscript) Sync() error  { return nil }
+func (storeTranscript) Close() error { return nil }
@@ -0,0 +1,51 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/transcript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestServer_Transcript(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	dir := t.TempDir()
+	s := NewServer(vf, Config{TranscriptDir: dir})
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "key-1"))
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1}
+	require.NoError(t, s.serveGeneration(ctx, "the weather", opts, &recordingSender{}))
+	require.NoError(t, s.serveGeneration(withContinue(ctx, true), " is", opts, &recordingSender{}))
+
+	entries, err := transcript.ReadFile(transcript.Path(dir, "key-1"))
+	require.NoError(t, err)
+	var kinds []string
+	for _, e := range entries {
+		kinds = append(kinds, e.Kind)
+	}
+	turn := []string{"prompt", "token", "token", "token", "token", "end"}
+	assert.Equal(t, append(append([]string(nil), turn...), turn...), kinds)
+
+	prompt, err := vf.Tokenizer.Tokenize("the weather")
+	require.NoError(t, err)
+	assert.Equal(t, prompt, entries[0].TokenIDs)
+	assert.False(t, entries[0].Continue)
+	assert.Equal(t, 4, entries[0].Options.MaxLen)
+	assert.Equal(t, " is", entries[6].Text)
+	assert.True(t, entries[6].Continue)
+	assert.NotEmpty(t, entries[5].Text)
+	assert.Empty(t, entries[5].Error)
+	assert.NotEqual(t, entries[0].GenerationID, entries[6].GenerationID)
+	assert.Equal(t, entries[0].GenerationID, entries[3].GenerationID)
+}
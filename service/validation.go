@@ -0,0 +1,322 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// problem is an error response of the HTTP APIs in the format of RFC 7807
+// (problem details for HTTP APIs).
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	// InvalidParams are the fields of the request failing the validation.
+	InvalidParams []invalidParam `json:"invalid-params,omitempty"`
+	// Warnings are the unknown fields of the request.
+	Warnings []string `json:"warnings,omitempty"`
+	// Error repeats the detail for the clients expecting the errors of Ollama.
+	Error string `json:"error"`
+}
+
+// invalidParam is a field of a request failing the validation.
+type invalidParam struct {
+	// Name is the path of the field, e.g. "options.top_p".
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// requestError is the error of a request failing the validation.
+type requestError struct {
+	// status is the HTTP status of the response (default: 400 Bad Request).
+	status int
+	detail string
+	params []invalidParam
+}
+
+func (e *requestError) Error() string {
+	if len(e.params) == 0 {
+		return e.detail
+	}
+	reasons := make([]string, len(e.params))
+	for i, p := range e.params {
+		reasons[i] = p.Name + " " + p.Reason
+	}
+	return e.detail + ": " + strings.Join(reasons, "; ")
+}
+
+// requestErrorStatus returns the HTTP status of the response to a request
+// failing the validation.
+func requestErrorStatus(err error) int {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) && reqErr.status != 0 {
+		return reqErr.status
+	}
+	return http.StatusBadRequest
+}
+
+// requestValidator is implemented by the requests with constraints on the values
+// of their fields.
+type requestValidator interface {
+	validate() []invalidParam
+}
+
+// ignoredFieldsLister is implemented by the requests (and their nested objects)
+// having fields which are part of the schema of the API, but are ignored by
+// VerbaFlow. They are not reported as unknown fields.
+type ignoredFieldsLister interface {
+	ignoredFields() []string
+}
+
+// decodeRequest decodes the JSON body of the request into req, a pointer to a
+// struct, and validates it. The fields of the body which are not part of the
+// schema of req are returned as warnings, to catch the typos of the clients.
+func decodeRequest(r *http.Request, req any) (warnings []string, err error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, &requestError{
+				status: http.StatusRequestEntityTooLarge,
+				detail: fmt.Sprintf("the request is larger than %d bytes", maxErr.Limit),
+			}
+		}
+		return nil, &requestError{detail: fmt.Sprintf("failed to read the request: %v", err)}
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, jsonError(err)
+	}
+	var raw any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, jsonError(err)
+	}
+	warnings = unknownFields("", raw, reflect.TypeOf(req))
+	if v, ok := req.(requestValidator); ok {
+		if params := v.validate(); len(params) > 0 {
+			return warnings, &requestError{detail: "invalid request", params: params}
+		}
+	}
+	return warnings, nil
+}
+
+// jsonError returns the requestError describing an error decoding a request.
+func jsonError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return &requestError{detail: fmt.Sprintf("malformed JSON at offset %d: %v", syntaxErr.Offset, err)}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return &requestError{
+			detail: "invalid request",
+			params: []invalidParam{{
+				Name:   typeErr.Field,
+				Reason: fmt.Sprintf("must be %s, not %s", jsonTypeName(typeErr.Type), typeErr.Value),
+			}},
+		}
+	default:
+		return &requestError{detail: fmt.Sprintf("invalid request: %v", err)}
+	}
+}
+
+// jsonTypeName returns the name of the JSON type decoded into the Go type.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// unknownFields returns the warnings about the fields of the decoded JSON value
+// which have no corresponding field in the Go type, at the given path.
+func unknownFields(path string, value any, t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var warnings []string
+	switch v := value.(type) {
+	case []any:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil
+		}
+		for i, elem := range v {
+			warnings = append(warnings, unknownFields(path+"["+strconv.Itoa(i)+"]", elem, t.Elem())...)
+		}
+	case map[string]any:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := jsonFields(t)
+		ignored := map[string]bool{}
+		if l, ok := reflect.New(t).Interface().(ignoredFieldsLister); ok {
+			for _, name := range l.ignoredFields() {
+				ignored[name] = true
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field, ok := fields[name]
+			if !ok {
+				if !ignored[name] {
+					warnings = append(warnings, unknownFieldWarning(joinPath(path, name), name, fields))
+				}
+				continue
+			}
+			warnings = append(warnings, unknownFields(joinPath(path, name), v[name], field)...)
+		}
+	}
+	return warnings
+}
+
+// jsonFields returns the types of the fields of the struct by their JSON name.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// maxSuggestionDistance is the maximum edit distance between an unknown field
+// and the known field suggested in its place.
+const maxSuggestionDistance = 2
+
+// unknownFieldWarning returns the warning about an unknown field, suggesting the
+// closest known field, if any.
+func unknownFieldWarning(path, name string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", maxSuggestionDistance+1
+	for known := range fields {
+		if d := editDistance(name, known); d < bestDistance || d == bestDistance && known < best {
+			best, bestDistance = known, d
+		}
+	}
+	if best == "" {
+		return fmt.Sprintf("unknown field %q is ignored", path)
+	}
+	return fmt.Sprintf("unknown field %q is ignored, did you mean %q?", path, best)
+}
+
+// editDistance returns the Levenshtein distance between the strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// checkRange returns the invalidParam of the field if its value is out of the
+// range [min, max].
+func checkRange(params []invalidParam, name string, value, min, max float64) []invalidParam {
+	if value >= min && value <= max {
+		return params
+	}
+	return append(params, invalidParam{Name: name, Reason: fmt.Sprintf("must be between %g and %g, got %g", min, max, value)})
+}
+
+// checkMin returns the invalidParam of the field if its value is less than min.
+func checkMin(params []invalidParam, name string, value, min float64) []invalidParam {
+	if value >= min {
+		return params
+	}
+	return append(params, invalidParam{Name: name, Reason: fmt.Sprintf("must be >= %g, got %g", min, value)})
+}
+
+// writeWarnings sets a Warning header (with the 299 code, for the persistent
+// warnings) for each warning about the request.
+func writeWarnings(w http.ResponseWriter, warnings []string) {
+	for _, warning := range warnings {
+		log.Debug().Msg(warning)
+		w.Header().Add("Warning", "299 verbaflow "+strconv.Quote(warning))
+	}
+}
+
+// writeProblem writes the error as problem details. A requestError is reported
+// with its invalid fields.
+func writeProblem(w http.ResponseWriter, code int, err error, warnings []string) {
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   errorMessage(err),
+		Warnings: warnings,
+		Error:    errorMessage(err),
+	}
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		p.Detail, p.InvalidParams = reqErr.detail, reqErr.params
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestValidation(t *testing.T) {
+	vf, err := verbaflow.Load("../testdata/tiny-rwkv")
+	require.NoError(t, err)
+	defer vf.Close()
+	s := NewServer(vf, Config{ModelName: "tiny"})
+	kobold := httptest.NewServer(s.KoboldHandler())
+	defer kobold.Close()
+	ollama := httptest.NewServer(s.OllamaHandler())
+	defer ollama.Close()
+
+	post := func(t *testing.T, url, body string) (*http.Response, problem) {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var p problem
+		if resp.StatusCode == http.StatusBadRequest {
+			assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+		}
+		return resp, p
+	}
+
+	t.Run("out of range", func(t *testing.T) {
+		resp, p := post(t, kobold.URL+"/api/v1/generate", `{"prompt": "the weather", "temperature": 1.5, "topp": 0.5}`)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, http.StatusBadRequest, p.Status)
+		assert.Equal(t, []invalidParam{{Name: "temperature", Reason: "must be between 0 and 1, got 1.5"}}, p.InvalidParams)
+		assert.Equal(t, []string{`unknown field "topp" is ignored, did you mean "top_p"?`}, p.Warnings)
+		assert.Contains(t, p.Error, "temperature must be between 0 and 1")
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		resp, p := post(t, ollama.URL+"/api/generate", `{"prompt": "the weather", "options": {"top_k": "forty"}}`)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, []invalidParam{{Name: "options.top_k", Reason: "must be an integer, not string"}}, p.InvalidParams)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		resp, p := post(t, ollama.URL+"/api/generate", `{"prompt": `)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, p.Detail, "malformed JSON")
+	})
+
+	t.Run("unknown role", func(t *testing.T) {
+		resp, p := post(t, ollama.URL+"/api/chat", `{"messages": [{"role": "user", "content": "hi"}, {"role": "bot", "content": "hello"}]}`)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Len(t, p.InvalidParams, 1)
+		assert.Equal(t, "messages[1].role", p.InvalidParams[0].Name)
+	})
+
+	t.Run("warnings", func(t *testing.T) {
+		// the fields of the schema of the API ignored by VerbaFlow are not reported
+		resp, _ := post(t, ollama.URL+"/api/generate",
+			`{"prompt": "the weather", "stream": false, "keep_alive": "5m", "options": {"num_predict": 2, "num_ctx": 512, "sed": 1}}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{`299 verbaflow "unknown field \"options.sed\" is ignored, did you mean \"seed\"?"`}, resp.Header.Values("Warning"))
+	})
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("top_p", "top_p"))
+	assert.Equal(t, 1, editDistance("topp", "top_p"))
+	assert.Equal(t, 3, editDistance("kitten", "sitting"))
+	assert.Equal(t, 4, editDistance("", "seed"))
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/nlpodyssey/verbaflow/transcript"
+)
+
+var _ SessionStore = &Dir{}
+
+// Dir is a SessionStore in a directory, e.g. on a volume shared by multiple
+// server instances. The transcripts are the files of transcript.Path, as with
+// the transcript directory of the server, and the states are next to them,
+// with the extension ".state", in the format of the state files.
+type Dir struct {
+	root string
+}
+
+// NewDir returns a SessionStore in the directory, which must exist.
+func NewDir(root string) *Dir {
+	return &Dir{root: root}
+}
+
+func (d *Dir) statePath(session string) string {
+	return filepath.Join(d.root, transcript.SessionHash(session)+".state")
+}
+
+// SaveState satisfies the SessionStore interface, replacing the state file
+// atomically.
+func (d *Dir) SaveState(_ context.Context, session string, state []byte) (err error) {
+	path := d.statePath(session)
+	f, err := os.CreateTemp(d.root, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadState satisfies the SessionStore interface.
+func (d *Dir) LoadState(_ context.Context, session string) ([]byte, bool, error) {
+	b, err := os.ReadFile(d.statePath(session))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// DeleteState satisfies the SessionStore interface.
+func (d *Dir) DeleteState(_ context.Context, session string) error {
+	err := os.Remove(d.statePath(session))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// AppendTranscript satisfies the SessionStore interface. The entries are
+// written to the operating system, surviving a crash of the process, but they
+// are not synced to stable storage.
+func (d *Dir) AppendTranscript(_ context.Context, session string, entries ...transcript.Entry) (err error) {
+	w, err := transcript.Open(transcript.Path(d.root, session))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := w.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	for _, e := range entries {
+		if err := w.Write(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadTranscript satisfies the SessionStore interface.
+func (d *Dir) ReadTranscript(_ context.Context, session string) ([]transcript.Entry, error) {
+	entries, err := transcript.ReadFile(transcript.Path(d.root, session))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return entries, err
+}
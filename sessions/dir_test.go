@@ -0,0 +1,53 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/transcript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	d := NewDir(dir)
+
+	_, ok, err := d.LoadState(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	require.NoError(t, d.SaveState(ctx, "key", []byte("first")))
+	require.NoError(t, d.SaveState(ctx, "key", []byte("second")))
+	state, ok, err := d.LoadState(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "second", string(state))
+	require.NoError(t, d.DeleteState(ctx, "key"))
+	require.NoError(t, d.DeleteState(ctx, "key"))
+	_, ok, err = d.LoadState(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	entries, err := d.ReadTranscript(ctx, "key")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	require.NoError(t, d.AppendTranscript(ctx, "key", transcript.Entry{Kind: transcript.KindPrompt, GenerationID: "a"}))
+	require.NoError(t, d.AppendTranscript(ctx, "key", transcript.Entry{Kind: transcript.KindToken, GenerationID: "a", TokenID: 3}))
+	entries, err = d.ReadTranscript(ctx, "key")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 3, entries[1].TokenID)
+	assert.False(t, entries[1].Time.IsZero())
+
+	// the files, as the ones of the transcript directory, don't disclose the key
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, transcript.Path(dir, "key"), dir+"/"+files[0].Name())
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/transcript"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix is prepended to all the keys written to Redis.
+const redisKeyPrefix = "verbaflow:session:"
+
+var _ SessionStore = &Redis{}
+
+// Redis is a SessionStore backed by a Redis server, which can be shared among
+// multiple server instances. The state of a session is a string, and its
+// transcript a list of JSON entries.
+type Redis struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedis returns a new Redis session store connected to the given address.
+// The sessions expire after ttl since their last write; a zero ttl means no
+// expiration.
+func NewRedis(addr string, ttl time.Duration) *Redis {
+	return &Redis{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		ttl:    ttl,
+	}
+}
+
+func redisKey(session, kind string) string {
+	return redisKeyPrefix + transcript.SessionHash(session) + ":" + kind
+}
+
+// SaveState satisfies the SessionStore interface.
+func (r *Redis) SaveState(ctx context.Context, session string, state []byte) error {
+	if err := r.client.Set(ctx, redisKey(session, "state"), state, r.ttl).Err(); err != nil {
+		return fmt.Errorf("failed to write the session state: %w", err)
+	}
+	return nil
+}
+
+// LoadState satisfies the SessionStore interface.
+func (r *Redis) LoadState(ctx context.Context, session string) ([]byte, bool, error) {
+	b, err := r.client.Get(ctx, redisKey(session, "state")).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read the session state: %w", err)
+	}
+	return b, true, nil
+}
+
+// DeleteState satisfies the SessionStore interface.
+func (r *Redis) DeleteState(ctx context.Context, session string) error {
+	if err := r.client.Del(ctx, redisKey(session, "state")).Err(); err != nil {
+		return fmt.Errorf("failed to delete the session state: %w", err)
+	}
+	return nil
+}
+
+// AppendTranscript satisfies the SessionStore interface, setting the time of
+// the entries without one, as transcript.Writer does.
+func (r *Redis) AppendTranscript(ctx context.Context, session string, entries ...transcript.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	values := make([]any, len(entries))
+	for i, e := range entries {
+		if e.Time.IsZero() {
+			e.Time = time.Now().UTC()
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("failed to encode the transcript entry: %w", err)
+		}
+		values[i] = b
+	}
+	key := redisKey(session, "transcript")
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.RPush(ctx, key, values...)
+		if r.ttl > 0 {
+			p.Expire(ctx, key, r.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write the session transcript: %w", err)
+	}
+	return nil
+}
+
+// ReadTranscript satisfies the SessionStore interface.
+func (r *Redis) ReadTranscript(ctx context.Context, session string) ([]transcript.Entry, error) {
+	values, err := r.client.LRange(ctx, redisKey(session, "transcript"), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the session transcript: %w", err)
+	}
+	entries := make([]transcript.Entry, len(values))
+	for i, v := range values {
+		if err := json.Unmarshal([]byte(v), &entries[i]); err != nil {
+			return nil, fmt.Errorf("failed to decode the transcript entry %d: %w", i+1, err)
+		}
+	}
+	return entries, nil
+}
+
+// Close closes the connection to the Redis server.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
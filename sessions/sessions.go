@@ -0,0 +1,32 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sessions provides storage for the sessions of the server, the states
+// and the transcripts of the API keys, so that several instances of the server
+// can share them, and they survive the restarts.
+package sessions
+
+import (
+	"context"
+
+	"github.com/nlpodyssey/verbaflow/transcript"
+)
+
+// SessionStore is the interface implemented by the session storage backends.
+// The sessions are identified by their keys, e.g. API keys, which the backends
+// don't disclose in the names of their files or of their keys.
+type SessionStore interface {
+	// SaveState stores the state of the session, as written by
+	// verbaflow.VerbaFlow.WriteContinuation, replacing the previous one.
+	SaveState(ctx context.Context, session string, state []byte) error
+	// LoadState returns the state of the session, if any.
+	LoadState(ctx context.Context, session string) ([]byte, bool, error)
+	// DeleteState removes the state of the session, if any.
+	DeleteState(ctx context.Context, session string) error
+	// AppendTranscript appends the entries to the transcript of the session.
+	AppendTranscript(ctx context.Context, session string, entries ...transcript.Entry) error
+	// ReadTranscript returns the entries of the transcript of the session, which
+	// are none if it has no transcript.
+	ReadTranscript(ctx context.Context, session string) ([]transcript.Entry, error)
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !wasip1
+
+package verbaflow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+)
+
+// snapshotFiles are the files of the model directory stored in the snapshots,
+// when present.
+var snapshotFiles = []string{"vocab.json", "merges.txt", "tokenizer.json", GenerationConfigFilename}
+
+// WriteSnapshot loads the model in modelDir, or ".vflow" bundle, with the given
+// options, and writes its snapshot to w (see rwkvlm.WriteSnapshot), along with the
+// tokenizer and the GenerationConfig. LoadWithOptions loads the snapshot file in
+// place of the model directory, much faster than the model itself, since the
+// weights are stored as they are in memory and the embeddings are resolved.
+//
+// The GPT-NeoX models are not supported.
+func WriteSnapshot(w io.Writer, modelDir string, opts LoadOptions) error {
+	vf, err := LoadWithOptions(modelDir, opts)
+	if err != nil {
+		return err
+	}
+	defer vf.Close()
+	if vf.Model == nil {
+		return errors.New("the snapshots are only supported by the RWKV models")
+	}
+	dir := modelDir
+	if vf.tmpDir != "" {
+		dir = vf.tmpDir
+	}
+	files := make(map[string][]byte)
+	for _, name := range snapshotFiles {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		files[name] = data
+	}
+	return rwkvlm.WriteSnapshot(w, vf.Model, files)
+}
+
+// isSnapshot reports whether the path is a snapshot file, see WriteSnapshot.
+func isSnapshot(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return rwkvlm.IsSnapshot(f)
+}
+
+// loadSnapshot loads a model from the snapshot file written by WriteSnapshot.
+// The options are those of LoadWithOptions, but for VerifyKey: the snapshots
+// have no manifest.
+func loadSnapshot(path string, opts LoadOptions) (*VerbaFlow, error) {
+	if opts.VerifyKey != nil {
+		return nil, errors.New("unable to verify a snapshot: verify the model before writing its snapshot")
+	}
+	if opts.SharedWeights {
+		return loadSharedSnapshot(path, opts)
+	}
+	if !opts.SkipMemoryCheck {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		// the weights and the embeddings are loaded in memory, the rest is negligible
+		if err := checkRequiredMemory(uint64(info.Size()), memoryMargin(opts)); err != nil {
+			return nil, err
+		}
+	}
+	model, files, err := rwkvlm.LoadSnapshot(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the snapshot: %w", err)
+	}
+	return newSnapshotVerbaFlow(model, files, opts)
+}
+
+// loadSharedSnapshot loads a model from the snapshot file, sharing its weights with
+// the other processes. The memory check is skipped, since most of the memory is not
+// owned by the process.
+func loadSharedSnapshot(path string, opts LoadOptions) (_ *VerbaFlow, err error) {
+	if opts.RescaleLayer != 0 {
+		return nil, errors.New("unable to change the rescaling of shared weights: write the snapshot with the rescale layer instead")
+	}
+	model, files, weights, err := rwkvlm.LoadSnapshotShared(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the snapshot: %w", err)
+	}
+	vf, err := newSnapshotVerbaFlow(model, files, opts)
+	if err != nil {
+		weights.Close()
+		return nil, err
+	}
+	vf.weights = weights
+	return vf, nil
+}
+
+// newSnapshotVerbaFlow returns the VerbaFlow of the model loaded from a snapshot,
+// with the tokenizer and the GenerationConfig in its files.
+func newSnapshotVerbaFlow(model *rwkvlm.Model, files map[string][]byte, opts LoadOptions) (*VerbaFlow, error) {
+	var err error
+	var tk tokenizer.Tokenizer
+	if vocab, ok := files["vocab.json"]; ok {
+		tk, err = tokenizer.LoadFrom(bytes.NewReader(vocab), bytes.NewReader(files["merges.txt"]))
+	} else if tj, ok := files["tokenizer.json"]; ok {
+		tk, err = tokenizer.LoadTokenizerJSON(bytes.NewReader(tj))
+	} else {
+		err = errors.New("the snapshot has no tokenizer")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTokenizer(tk, model.Config.VocabSize); err != nil {
+		return nil, err
+	}
+	if opts.RescaleLayer != 0 {
+		if err := model.SetRescaleLayer(opts.RescaleLayer); err != nil {
+			return nil, err
+		}
+	}
+	var genConf *GenerationConfig
+	if data, ok := files[GenerationConfigFilename]; ok {
+		if genConf, err = ReadGenerationConfig(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	return &VerbaFlow{
+		Model:            model,
+		Tokenizer:        tk,
+		GenerationConfig: genConf,
+	}, nil
+}
@@ -0,0 +1,327 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+)
+
+// DefaultHeadingFormat is the default template of the heading of each section of
+// GenerateStructured.
+const DefaultHeadingFormat = "## {{.Item}}\n\n"
+
+// DefaultMaxItems is the default maximum number of items of the outline of
+// GenerateStructured.
+const DefaultMaxItems = 10
+
+// StructuredOptions are the options of VerbaFlow.GenerateStructured.
+type StructuredOptions struct {
+	// Outline are the decoding options of the outline. It is a markdown list, one
+	// "- " item per line, ended by a blank line: the tokens breaking the format are
+	// rejected (see decoder.DecodingOptions.AcceptToken).
+	Outline decoder.DecodingOptions
+	// Expand are the decoding options of the expansion of each item. When it has no
+	// StopRegexps, the expansion stops at the next markdown heading.
+	Expand decoder.DecodingOptions
+	// MaxItems is the maximum number of items of the outline (default: DefaultMaxItems).
+	MaxItems int
+	// HeadingFormat is the text/template of the heading preceding the expansion of
+	// each item, executed with a Section (default: DefaultHeadingFormat).
+	HeadingFormat string
+}
+
+// Section is an item of the outline with its expansion.
+type Section struct {
+	// Number is the position of the item in the outline, from 1.
+	Number int    `json:"number"`
+	Item   string `json:"item"`
+	Text   string `json:"text"`
+}
+
+// StructuredResult is the result of VerbaFlow.GenerateStructured.
+type StructuredResult struct {
+	// Outline are the items of the outline.
+	Outline []string `json:"outline"`
+	// Sections are the expansions of the items.
+	Sections []Section `json:"sections"`
+	// Document is the text following the prompt: the outline, then the headings
+	// and the expansions of the items.
+	Document string `json:"document"`
+}
+
+// GenerateStructured generates a long-form text in two phases: an outline of the
+// prompt, constrained to a list, then the expansion of each item of the list, in
+// a separate generation following its heading. The generations share the state of
+// the document, continued after each of them, so that the text is encoded only
+// once and each expansion follows the outline and the previous sections.
+//
+// The whole generation holds a single slot of SetMaxConcurrency, and the limit of
+// SetMaxPromptTokens applies to the prompt.
+func (vf *VerbaFlow) GenerateStructured(ctx context.Context, prompt string, so StructuredOptions) (StructuredResult, error) {
+	format := so.HeadingFormat
+	if format == "" {
+		format = DefaultHeadingFormat
+	}
+	heading, err := template.New("heading").Parse(format)
+	if err != nil {
+		return StructuredResult{}, fmt.Errorf("verbaflow: invalid heading format: %w", err)
+	}
+	maxItems := so.MaxItems
+	if maxItems <= 0 {
+		maxItems = DefaultMaxItems
+	}
+	ctx, _ = genid.Ensure(ctx)
+	model, err := vf.model()
+	if err != nil {
+		return StructuredResult{}, err
+	}
+	tokens, err := vf.Tokenizer.Tokenize(prompt)
+	if err != nil {
+		return StructuredResult{}, err
+	}
+	if err := vf.CheckPromptLength(len(tokens)); err != nil {
+		return StructuredResult{}, err
+	}
+	release, err := vf.acquire(ctx)
+	if err != nil {
+		return StructuredResult{}, err
+	}
+	defer release()
+
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+	input, err := vf.encodePrompt(ctx, nt, tokens, so.Outline)
+	if err != nil {
+		return StructuredResult{}, err
+	}
+	doc := &document{vf: vf, model: model, nt: nt, prompt: prompt, input: input}
+
+	outlineOpts := so.Outline
+	outlineOpts.AcceptToken = listFilter(vf, maxItems, so.Outline.EndTokenID, so.Outline.AcceptToken)
+	outlineOpts.StopRegexps = append(outlineOpts.StopRegexps[:len(outlineOpts.StopRegexps):len(outlineOpts.StopRegexps)], `\n\n`)
+	outline, err := doc.generate(ctx, outlineOpts)
+	if err != nil {
+		return StructuredResult{}, fmt.Errorf("verbaflow: failed to generate the outline: %w", err)
+	}
+	items := parseOutline(outline, maxItems)
+	if len(items) == 0 {
+		return StructuredResult{}, fmt.Errorf("verbaflow: the outline has no items")
+	}
+
+	expandOpts := so.Expand
+	if len(expandOpts.StopRegexps) == 0 {
+		expandOpts.StopRegexps = []string{`\n#{1,6} `}
+	}
+	result := StructuredResult{Outline: items}
+	for i, item := range items {
+		section := Section{Number: i + 1, Item: item}
+		var buf bytes.Buffer
+		if err := heading.Execute(&buf, section); err != nil {
+			return StructuredResult{}, fmt.Errorf("verbaflow: failed to format a heading: %w", err)
+		}
+		if err := doc.extend(ctx, doc.separator()+buf.String()); err != nil {
+			return StructuredResult{}, err
+		}
+		if section.Text, err = doc.generate(ctx, expandOpts); err != nil {
+			return StructuredResult{}, fmt.Errorf("verbaflow: failed to expand item %d: %w", section.Number, err)
+		}
+		result.Sections = append(result.Sections, section)
+	}
+	result.Document = doc.text.String()
+	return result, nil
+}
+
+// document is the text generated by GenerateStructured, with the state of the
+// model after it.
+type document struct {
+	vf     *VerbaFlow
+	model  decoder.Model
+	nt     *ag.NodesTracker
+	prompt string
+	// input is the input of the next generation.
+	input decoder.Input
+	// text is the text after the prompt.
+	text strings.Builder
+}
+
+// generate generates a text following the document, and adds it to the document.
+func (d *document) generate(ctx context.Context, opts decoder.DecodingOptions) (string, error) {
+	opts, err := d.vf.applyOptions(d.prompt, opts)
+	if err != nil {
+		return "", err
+	}
+	rec := &stateRecorder{Model: d.model, state: d.input.State, logits: d.input.Logits}
+	dec, err := decoder.New(rec, opts)
+	if err != nil {
+		return "", err
+	}
+	// the channel holds all the tokens, so that the decoding never blocks
+	chGen := d.vf.generationChannel(opts)
+	if err := dec.Decode(ctx, d.nt, d.input, chGen); err != nil {
+		return "", err
+	}
+	var ids []int
+	for gen := range chGen {
+		ids = append(ids, gen.TokenID)
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	d.input.State = rec.state
+	d.input.Logits = rec.logits
+	last := ids[len(ids)-1]
+	if last == opts.EndTokenID {
+		// the end token is not part of the document
+		ids = ids[:len(ids)-1]
+	} else if d.input.Logits, d.input.State, err = d.model.EncodeNext(ctx, d.nt, rec.state, last); err != nil {
+		return "", err
+	}
+	d.input.Tokens = append(d.input.Tokens[:len(d.input.Tokens):len(d.input.Tokens)], ids...)
+	text, err := d.vf.Tokenizer.ReconstructText(ids)
+	if err != nil {
+		return "", err
+	}
+	d.text.WriteString(text)
+	return text, nil
+}
+
+// extend adds the text to the document, encoding it.
+func (d *document) extend(ctx context.Context, text string) error {
+	tokens, err := d.vf.Tokenizer.Tokenize(text)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if d.input.Logits, d.input.State, err = d.model.EncodeNext(ctx, d.nt, d.input.State, token); err != nil {
+			return err
+		}
+	}
+	d.input.Tokens = append(d.input.Tokens[:len(d.input.Tokens):len(d.input.Tokens)], tokens...)
+	d.text.WriteString(text)
+	return nil
+}
+
+// separator returns the newlines separating the document from the next section
+// with a blank line.
+func (d *document) separator() string {
+	text := d.text.String()
+	n := len(text) - len(strings.TrimRight(text, "\n"))
+	if n >= 2 || len(text) == 0 {
+		return ""
+	}
+	return strings.Repeat("\n", 2-n)
+}
+
+// stateRecorder is a decoder.Model recording the state and the logits after the
+// last token encoded by the decoder.
+type stateRecorder struct {
+	decoder.Model
+	state  decoder.State
+	logits mat.Matrix
+}
+
+// EncodeNext implements decoder.Model.
+func (m *stateRecorder) EncodeNext(ctx context.Context, nt *ag.NodesTracker, state decoder.State, token int) (mat.Matrix, decoder.State, error) {
+	logits, s, err := m.Model.EncodeNext(ctx, nt, state, token)
+	if err == nil {
+		m.logits, m.state = logits, s
+	}
+	return logits, s, err
+}
+
+// listItemMarker is the beginning of each line of the outline.
+const listItemMarker = "- "
+
+// listFilter returns a decoder.TokenFilter accepting the tokens keeping the text
+// generated so far a valid prefix of a list of at most maxItems items (see
+// validListPrefix), and accepted by next, if not nil. The end token is accepted
+// after the first item.
+func listFilter(vf *VerbaFlow, maxItems, endTokenID int, next decoder.TokenFilter) decoder.TokenFilter {
+	// the text of the sequence is extended as the sequence grows
+	var sb strings.Builder
+	n := 0
+	return func(info decoder.StepInfo, tokenID int) (bool, error) {
+		for ; n < len(info.Sequence); n++ {
+			text, err := vf.TokenByID(info.Sequence[n])
+			if err != nil {
+				return false, err
+			}
+			sb.WriteString(text)
+		}
+		text := sb.String()
+		if tokenID == endTokenID {
+			if len(parseOutline(text, maxItems)) == 0 {
+				return false, nil
+			}
+		} else {
+			token, err := vf.TokenByID(tokenID)
+			if err != nil {
+				return false, err
+			}
+			if !validListPrefix(text+token, maxItems) {
+				return false, nil
+			}
+		}
+		if next != nil {
+			return next(info, tokenID)
+		}
+		return true, nil
+	}
+}
+
+// validListPrefix reports whether the text is the beginning of a list of at most
+// maxItems items, optionally preceded by a newline, each line beginning with
+// listItemMarker and having some text. The blank line ending the list must follow
+// an item.
+func validListPrefix(text string, maxItems int) bool {
+	lines := strings.Split(strings.TrimPrefix(text, "\n"), "\n")
+	items := 0
+	for i, line := range lines {
+		last := i == len(lines)-1
+		if line == "" {
+			if last {
+				// the beginning of a line
+				return true
+			}
+			// the blank line ends the list
+			return items > 0 && i == len(lines)-2 && lines[i+1] == ""
+		}
+		if !strings.HasPrefix(line, listItemMarker) {
+			return last && items < maxItems && strings.HasPrefix(listItemMarker, line)
+		}
+		if items == maxItems || !last && strings.TrimSpace(line[len(listItemMarker):]) == "" {
+			return false
+		}
+		items++
+	}
+	return true
+}
+
+// parseOutline returns the items of the outline, at most maxItems.
+func parseOutline(text string, maxItems int) []string {
+	var items []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, listItemMarker) {
+			continue
+		}
+		if item := strings.TrimSpace(line[len(listItemMarker):]); item != "" {
+			items = append(items, item)
+		}
+		if len(items) == maxItems {
+			break
+		}
+	}
+	return items
+}
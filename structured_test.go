@@ -0,0 +1,90 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listTokenizer is a byteTokenizer whose tokens 1 and 2 are the list marker and
+// the newline.
+type listTokenizer struct {
+	byteTokenizer
+}
+
+func (listTokenizer) ReconstructText(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		switch id {
+		case 0:
+		case 1:
+			sb.WriteString(listItemMarker)
+		case 2:
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(byte('a' + id%26))
+		}
+	}
+	return sb.String(), nil
+}
+
+func TestVerbaFlow_GenerateStructured(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.Tokenizer = listTokenizer{}
+	opts := decoder.DecodingOptions{MaxLen: 40, EndTokenID: 0, Temp: 1, TopP: 1, UseSampling: true, Seed: 7}
+	expand := opts
+	expand.MaxLen = 5
+
+	r, err := vf.GenerateStructured(context.Background(), "outline:\n", StructuredOptions{
+		Outline:  opts,
+		Expand:   expand,
+		MaxItems: 3,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, r.Outline)
+	assert.LessOrEqual(t, len(r.Outline), 3)
+	require.Len(t, r.Sections, len(r.Outline))
+	for i, s := range r.Sections {
+		assert.Equal(t, i+1, s.Number)
+		assert.Equal(t, r.Outline[i], s.Item)
+		assert.Contains(t, r.Document, "## "+s.Item+"\n\n"+s.Text)
+	}
+	assert.True(t, strings.HasPrefix(strings.TrimPrefix(r.Document, "\n"), "- "+r.Outline[0]), "%q", r.Document)
+
+	_, err = vf.GenerateStructured(context.Background(), "outline:\n", StructuredOptions{Outline: opts, HeadingFormat: "{{"})
+	assert.ErrorContains(t, err, "invalid heading format")
+}
+
+func TestValidListPrefix(t *testing.T) {
+	for text, want := range map[string]bool{
+		"":                 true,
+		"\n":               true,
+		"-":                true,
+		"- ":               true,
+		"- a\n- b":         true,
+		"- a\n\n":          true,
+		"\n- a\n-":         true,
+		"\n\n":             false,
+		"a":                false,
+		"- a\nb":           false,
+		"- \n":             false,
+		"- a\n\n- b":       false,
+		"- a\n- b\n- c\n":  true,
+		"- a\n- b\n- c\n-": false,
+	} {
+		assert.Equal(t, want, validListPrefix(text, 3), "%q", text)
+	}
+}
+
+func TestParseOutline(t *testing.T) {
+	assert.Equal(t, []string{"a", "b c"}, parseOutline("\n- a\n-  \n- b c \n\nx", 10))
+	assert.Equal(t, []string{"a"}, parseOutline("- a\n- b", 1))
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command gentiny generates the tiny randomly initialized RWKV model used by
+// the golden-output tests. The model is fully determined by the seed, so the
+// files only need to be regenerated when the serialization format changes:
+//
+//	go run ./testdata/gentiny -out testdata/tiny-rwkv
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
+	"github.com/nlpodyssey/spago/initializers"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/rand"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+)
+
+// merges are a handful of BPE merges on top of the byte-level alphabet,
+// so that the tokenizer exercises multi-byte tokens.
+var merges = []string{
+	"h e",
+	"Ġ t",
+	"Ġt he",
+	"i n",
+	"e r",
+	"Ġ a",
+	"o n",
+	"Ġ w",
+}
+
+func main() {
+	out := flag.String("out", "testdata/tiny-rwkv", "output directory")
+	seed := flag.Uint64("seed", 42, "seed of the random initialization")
+	flag.Parse()
+
+	if err := run(*out, *seed); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, seed uint64) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	vocabSize, err := writeTokenizer(dir)
+	if err != nil {
+		return err
+	}
+
+	repo, err := diskstore.NewRepository(filepath.Join(dir, rwkvlm.DefaultEmbeddingRepoPath), diskstore.ReadWriteMode)
+	if err != nil {
+		return err
+	}
+	conf := rwkvlm.Config{
+		DModel:          16,
+		NumHiddenLayers: 2,
+		VocabSize:       vocabSize,
+		RescaleLayer:    6,
+	}
+	m := rwkvlm.New[float32](conf, repo)
+
+	rng := rand.NewLockedRand(seed)
+	nn.ForEachParam(m, func(param nn.Param, _ string, _ nn.ParamsType) {
+		initializers.Uniform(param.Value(), -0.5, 0.5, rng)
+	})
+	for id := 0; id < vocabSize; id++ {
+		e, _ := m.Embeddings.Tokens.Embedding(id)
+		e.ReplaceValue(initializers.Uniform(mat.NewEmptyVecDense[float32](conf.DModel), -0.5, 0.5, rng))
+	}
+	if err := repo.Close(); err != nil {
+		return err
+	}
+	return rwkvlm.Dump(m, filepath.Join(dir, rwkvlm.DefaultOutputFilename))
+}
+
+// writeTokenizer writes a byte-level BPE vocabulary and its merges, returning the vocabulary size.
+func writeTokenizer(dir string) (int, error) {
+	vocab := make(map[string]int)
+	for _, r := range byteLevelAlphabet() {
+		vocab[string(r)] = len(vocab)
+	}
+	for _, merge := range merges {
+		vocab[strings.ReplaceAll(merge, " ", "")] = len(vocab)
+	}
+
+	data, err := json.Marshal(vocab)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "vocab.json"), data, 0644); err != nil {
+		return 0, err
+	}
+	mergesText := "#version: 0.2\n" + strings.Join(merges, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "merges.txt"), []byte(mergesText), 0644); err != nil {
+		return 0, err
+	}
+	return len(vocab), nil
+}
+
+// byteLevelAlphabet returns the 256 characters used by byte-level BPE to
+// represent the bytes, in byte order (the GPT-2 "bytes_to_unicode" mapping).
+func byteLevelAlphabet() []rune {
+	alphabet := make([]rune, 256)
+	n := 0
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF) {
+			alphabet[b] = rune(b)
+		} else {
+			alphabet[b] = rune(256 + n)
+			n++
+		}
+	}
+	return alphabet
+}
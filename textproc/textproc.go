@@ -0,0 +1,276 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package textproc implements processors transforming the decoded text of a
+// generation while it is streamed.
+package textproc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Processor transforms a stream of text.
+// Processors are stateful: a new instance is required for each stream.
+type Processor interface {
+	// Process receives the next chunk of text and returns the text ready to be emitted.
+	// It can withhold part of the text (lookahead), to be returned by later calls.
+	Process(chunk string) string
+	// Flush returns the withheld text at the end of the stream.
+	Flush() string
+}
+
+// Factory creates a new Processor for each stream.
+type Factory func() Processor
+
+// Chain returns a Processor applying the given processors in order, each one
+// receiving the output of the previous one.
+func Chain(processors ...Processor) Processor {
+	return chain(processors)
+}
+
+// NewChain creates a new instance of each factory and chains them.
+func NewChain(factories []Factory) Processor {
+	processors := make([]Processor, len(factories))
+	for i, f := range factories {
+		processors[i] = f()
+	}
+	return Chain(processors...)
+}
+
+type chain []Processor
+
+func (c chain) Process(chunk string) string {
+	for _, p := range c {
+		chunk = p.Process(chunk)
+	}
+	return chunk
+}
+
+func (c chain) Flush() string {
+	var out string
+	for _, p := range c {
+		// the text flushed by a processor goes through the following ones
+		out = p.Process(out) + p.Flush()
+	}
+	return out
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a custom processor available by name to FactoryByName.
+// It panics if the name is already registered, or is that of a built-in processor.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[name]; exists || name == "whitespace" || name == "fences" || name == "tidy" {
+		panic(fmt.Sprintf("textproc: processor %q already registered", name))
+	}
+	registry[name] = factory
+}
+
+// FactoryByName returns the factory of the built-in processors that don't need any
+// parameter: "whitespace" (NormalizeWhitespace), "fences" (BalanceFences) and "tidy"
+// (Tidy), or of the processors added with Register.
+func FactoryByName(name string) (Factory, error) {
+	switch name {
+	case "whitespace":
+		return func() Processor { return NormalizeWhitespace() }, nil
+	case "fences":
+		return func() Processor { return BalanceFences() }, nil
+	case "tidy":
+		return func() Processor { return Tidy() }, nil
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if f, ok := registry[name]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown text processor %q", name)
+}
+
+// NormalizeWhitespace returns a Processor which collapses runs of spaces into a
+// single space, and runs of more than two newlines into two. Trailing whitespace
+// at the end of the stream is removed.
+func NormalizeWhitespace() Processor {
+	return &whitespaceNormalizer{}
+}
+
+type whitespaceNormalizer struct {
+	pending strings.Builder
+}
+
+func (p *whitespaceNormalizer) Process(chunk string) string {
+	var out strings.Builder
+	for _, r := range chunk {
+		if unicode.IsSpace(r) {
+			p.pending.WriteRune(r)
+			continue
+		}
+		if p.pending.Len() > 0 {
+			out.WriteString(normalizeSpaces(p.pending.String()))
+			p.pending.Reset()
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+func (p *whitespaceNormalizer) Flush() string {
+	p.pending.Reset()
+	return ""
+}
+
+func normalizeSpaces(ws string) string {
+	switch n := strings.Count(ws, "\n"); n {
+	case 0:
+		return " "
+	case 1:
+		return "\n"
+	default:
+		return "\n\n"
+	}
+}
+
+// BalanceFences returns a Processor which closes the markdown code fence (```)
+// left open at the end of the stream.
+func BalanceFences() Processor {
+	return &fenceBalancer{}
+}
+
+type fenceBalancer struct {
+	// tail is the end of the text emitted so far, to detect fences split across chunks.
+	tail  string
+	count int
+}
+
+const fence = "```"
+
+func (p *fenceBalancer) Process(chunk string) string {
+	text := p.tail + chunk
+	// fences are counted on the new text only, including the ones starting in the tail
+	p.count += strings.Count(text, fence) - strings.Count(p.tail, fence)
+	if len(text) >= len(fence)-1 {
+		p.tail = text[len(text)-(len(fence)-1):]
+	} else {
+		p.tail = text
+	}
+	return chunk
+}
+
+func (p *fenceBalancer) Flush() string {
+	if p.count%2 == 0 {
+		return ""
+	}
+	if strings.HasSuffix(p.tail, "\n") {
+		return fence
+	}
+	return "\n" + fence
+}
+
+// TrimStopSequences returns a Processor which removes the first occurrence of
+// any of the given sequences, and all the text following it.
+func TrimStopSequences(stops ...string) Processor {
+	return &stopTrimmer{stops: stops}
+}
+
+type stopTrimmer struct {
+	stops   []string
+	pending string
+	stopped bool
+}
+
+func (p *stopTrimmer) Process(chunk string) string {
+	if p.stopped {
+		return ""
+	}
+	text := p.pending + chunk
+	if i := p.firstStop(text); i >= 0 {
+		p.stopped, p.pending = true, ""
+		return text[:i]
+	}
+	// withhold the longest suffix which could be the beginning of a stop sequence
+	keep := 0
+	for _, stop := range p.stops {
+		for n := min(len(stop)-1, len(text)); n > keep; n-- {
+			if strings.HasSuffix(text, stop[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	p.pending = text[len(text)-keep:]
+	return text[:len(text)-keep]
+}
+
+func (p *stopTrimmer) Flush() string {
+	out := p.pending
+	p.pending = ""
+	return out
+}
+
+func (p *stopTrimmer) firstStop(text string) int {
+	first := -1
+	for _, stop := range p.stops {
+		if i := strings.Index(text, stop); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
+
+// MaskWords returns a Processor which replaces the given words (whole words,
+// case-insensitive) with asterisks.
+func MaskWords(words ...string) Processor {
+	set := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		set[strings.ToLower(w)] = struct{}{}
+	}
+	return &wordMasker{words: set}
+}
+
+type wordMasker struct {
+	words map[string]struct{}
+	// word is the current word, withheld until it is complete.
+	word strings.Builder
+}
+
+func (p *wordMasker) Process(chunk string) string {
+	var out strings.Builder
+	for _, r := range chunk {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			p.word.WriteRune(r)
+			continue
+		}
+		out.WriteString(p.flushWord())
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+func (p *wordMasker) Flush() string {
+	return p.flushWord()
+}
+
+func (p *wordMasker) flushWord() string {
+	w := p.word.String()
+	p.word.Reset()
+	if _, ok := p.words[strings.ToLower(w)]; ok {
+		return strings.Repeat("*", utf8.RuneCountInString(w))
+	}
+	return w
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
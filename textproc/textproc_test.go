@@ -0,0 +1,47 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textproc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// run streams the chunks through the processor, returning the whole output.
+func run(p Processor, chunks ...string) string {
+	var sb strings.Builder
+	for _, c := range chunks {
+		sb.WriteString(p.Process(c))
+	}
+	sb.WriteString(p.Flush())
+	return sb.String()
+}
+
+func TestNormalizeWhitespace(t *testing.T) {
+	assert.Equal(t, " Hello world\n\nbye", run(NormalizeWhitespace(), " Hello ", "  world\n", "\n\n\nbye  \n"))
+}
+
+func TestBalanceFences(t *testing.T) {
+	assert.Equal(t, "``", run(BalanceFences(), "``"))
+	assert.Equal(t, "```go\nx := 1\n```", run(BalanceFences(), "``", "`go\nx := 1\n"))
+	assert.Equal(t, "```a``` b", run(BalanceFences(), "```a`", "``", " b"))
+}
+
+func TestTrimStopSequences(t *testing.T) {
+	assert.Equal(t, "The answer", run(TrimStopSequences("\nQ:"), "The answer", "\n", "Q", ": next"))
+	assert.Equal(t, "a\nb", run(TrimStopSequences("\nQ:"), "a\n", "b"))
+	assert.Equal(t, "end\n", run(TrimStopSequences("\nQ:"), "end", "\n"))
+}
+
+func TestMaskWords(t *testing.T) {
+	assert.Equal(t, "a **** day, darned", run(MaskWords("darn"), "a Da", "rn day, darned"))
+}
+
+func TestChain(t *testing.T) {
+	p := Chain(TrimStopSequences("STOP"), NormalizeWhitespace(), BalanceFences())
+	assert.Equal(t, "```x\n```", run(p, "```x  ", "\n\n\n", "STOP more"))
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textproc
+
+import "strings"
+
+// Truncator is implemented by the processors handling differently the text of the
+// generations stopped by the maximum length, which are cut at an arbitrary point.
+type Truncator interface {
+	// Truncated is called before Flush if the generation was stopped by the maximum length.
+	Truncated()
+}
+
+// MarkTruncated notifies the processor, or the processors of a chain, implementing
+// Truncator that the stream was truncated. It is called before Flush.
+func MarkTruncated(p Processor) {
+	if t, ok := p.(Truncator); ok {
+		t.Truncated()
+	}
+}
+
+func (c chain) Truncated() {
+	for _, p := range c {
+		MarkTruncated(p)
+	}
+}
+
+// Tidy returns a Processor which makes the end of the generations usable as
+// markdown: it closes the code fence and the brackets left open at the end of the
+// stream, and removes the partial sentence (or line of code) at the end of a
+// truncated stream (see MarkTruncated). The text after the end of the last
+// sentence is withheld until the following one ends.
+func Tidy() Processor {
+	return &tidier{}
+}
+
+type tidier struct {
+	// pending is the text after the end of the last sentence.
+	pending   string
+	truncated bool
+	// the state of the emitted text
+	inFence bool
+	ticks   int
+	// brackets are the closing brackets of the ones open outside the code blocks.
+	brackets []rune
+	last     rune
+}
+
+// sentenceEnds are the characters ending a sentence, or a line of code.
+const sentenceEnds = ".!?\n"
+
+var closingBrackets = map[rune]rune{'(': ')', '[': ']', '{': '}'}
+
+func (p *tidier) Process(chunk string) string {
+	text := p.pending + chunk
+	i := strings.LastIndexAny(text, sentenceEnds)
+	if i < 0 {
+		p.pending = text
+		return ""
+	}
+	p.pending = text[i+1:]
+	return p.emit(text[:i+1])
+}
+
+func (p *tidier) Truncated() {
+	p.truncated = true
+}
+
+func (p *tidier) Flush() string {
+	var out string
+	if !p.truncated {
+		out = p.emit(p.pending)
+	}
+	p.pending = ""
+	var sb strings.Builder
+	sb.WriteString(out)
+	if p.inFence {
+		if p.last != '\n' && p.last != 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(fence)
+	}
+	for i := len(p.brackets) - 1; i >= 0; i-- {
+		sb.WriteRune(p.brackets[i])
+	}
+	return sb.String()
+}
+
+// emit updates the state with the emitted text, and returns it.
+func (p *tidier) emit(text string) string {
+	for _, r := range text {
+		p.last = r
+		if r == '`' {
+			if p.ticks++; p.ticks == len(fence) {
+				p.inFence = !p.inFence
+				p.ticks = 0
+			}
+			continue
+		}
+		p.ticks = 0
+		if p.inFence {
+			continue
+		}
+		if closing, ok := closingBrackets[r]; ok {
+			p.brackets = append(p.brackets, closing)
+		} else if n := len(p.brackets); n > 0 && p.brackets[n-1] == r {
+			p.brackets = p.brackets[:n-1]
+		}
+	}
+	return text
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textproc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runTruncated is like run, marking the stream as truncated before the end.
+func runTruncated(p Processor, chunks ...string) string {
+	var out string
+	for _, c := range chunks {
+		out += p.Process(c)
+	}
+	MarkTruncated(p)
+	return out + p.Flush()
+}
+
+func TestTidy(t *testing.T) {
+	assert.Equal(t, "Hello world. How are", run(Tidy(), "Hello wor", "ld. How ", "are"))
+	assert.Equal(t, "Hello world.", runTruncated(Tidy(), "Hello wor", "ld. How ", "are"))
+	assert.Equal(t, "See (the list [a, b]) and {c}", run(Tidy(), "See (the list [a, b", "]) and {c"))
+	assert.Equal(t, "See (the list.)", runTruncated(Tidy(), "See (the list. Then [a"))
+
+	// the code is truncated at the last line, the brackets in the code are ignored
+	assert.Equal(t, "Code:\n```go\nf(x)\n```", runTruncated(Tidy(), "Code:\n``", "`go\nf(x)\ng(", "y"))
+	assert.Equal(t, "```\nf(\n```", run(Tidy(), "```\nf("))
+	assert.Equal(t, "1) a\n2) b", run(Tidy(), "1) a\n", "2) b"))
+
+	// in a chain, the truncation reaches the processors implementing Truncator
+	assert.Equal(t, "A b.", runTruncated(Chain(NormalizeWhitespace(), Tidy()), "A  b. C"))
+}
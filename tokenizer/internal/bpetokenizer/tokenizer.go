@@ -5,7 +5,10 @@
 package bpetokenizer
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strings"
 
@@ -66,6 +69,69 @@ func Load(path string, controlTokensIDs ControlTokensIDs) (*BPETokenizer, error)
 		return nil, fmt.Errorf("loading merges from file %s: %w", mergesFilename, err)
 	}
 
+	return newTokenizer(vocab, merges, controlTokensIDs), nil
+}
+
+// LoadFrom returns a BPETokenizer reading the vocabulary (JSON) and the merges
+// from the given readers, in the format of the vocab.json and merges.txt files.
+func LoadFrom(vocabReader, mergesReader io.Reader, controlTokensIDs ControlTokensIDs) (*BPETokenizer, error) {
+	vocab, err := readVocabulary(vocabReader)
+	if err != nil {
+		return nil, fmt.Errorf("loading vocabulary: %w", err)
+	}
+	merges, err := readMerges(mergesReader, vocab, len(defaultContinuingSubwordPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("loading merges: %w", err)
+	}
+	return newTokenizer(vocab, merges, controlTokensIDs), nil
+}
+
+// readVocabulary reads a JSON vocabulary, whose IDs must be contiguous from zero.
+func readVocabulary(r io.Reader) (*vocabulary.Vocabulary, error) {
+	var termToID map[string]int
+	if err := json.NewDecoder(r).Decode(&termToID); err != nil {
+		return nil, err
+	}
+	terms := make([]string, len(termToID))
+	for term, id := range termToID {
+		if id < 0 || id >= len(terms) || terms[id] != "" {
+			return nil, fmt.Errorf("the IDs of the vocabulary are not contiguous")
+		}
+		terms[id] = term
+	}
+	vocab := vocabulary.NewVocabulary()
+	for _, term := range terms {
+		vocab.AddTerm(term)
+	}
+	return vocab, nil
+}
+
+// readMerges reads the merges, as bpemodel.MergeMapFromFile.
+func readMerges(r io.Reader, vocab *vocabulary.Vocabulary, prefixLength int) (*bpemodel.MergeMap, error) {
+	m := bpemodel.NewMergeMap()
+	scanner := bufio.NewScanner(r)
+	for lineCount, rank := 1, 0; scanner.Scan(); lineCount++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#version") {
+			continue
+		}
+		terms := strings.Split(line, " ")
+		if len(terms) != 2 {
+			return nil, fmt.Errorf("line %d: malformed merges", lineCount)
+		}
+		leftID, leftOK := vocab.GetID(terms[0])
+		rightID, rightOK := vocab.GetID(terms[1])
+		mergedID, mergedOK := vocab.GetID(terms[0] + terms[1][prefixLength:])
+		if !leftOK || !rightOK || !mergedOK {
+			return nil, fmt.Errorf("line %d: merge token is out of vocabulary", lineCount)
+		}
+		m.Set(leftID, rightID, bpemodel.MergeValue{Rank: rank, ID: mergedID})
+		rank++
+	}
+	return m, scanner.Err()
+}
+
+func newTokenizer(vocab *vocabulary.Vocabulary, merges *bpemodel.MergeMap, controlTokensIDs ControlTokensIDs) *BPETokenizer {
 	preTokenizer := bytelevelpretokenizer.New(
 		bytelevelpretokenizer.DefaultSplittingRegexp,
 		defaultPrefixSpaceEnabled,
@@ -94,7 +160,12 @@ func Load(path string, controlTokensIDs ControlTokensIDs) (*BPETokenizer, error)
 		t.SetExtraSpecialTokens(controlTokensIDs.ExtraSpecialTokenIDs)
 	}
 
-	return t, nil
+	return t
+}
+
+// VocabSize returns the number of tokens of the vocabulary.
+func (t *BPETokenizer) VocabSize() int {
+	return t.vocab.Size()
 }
 
 func (t *BPETokenizer) SetExtraSpecialTokens(extra map[int]string) {
@@ -5,6 +5,9 @@
 package bpetokenizer
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -17,3 +20,38 @@ func TestNew(t *testing.T) {
 		t.Fatal("expected *BPETokenizer, actual nil")
 	}
 }
+
+func TestLoadFrom(t *testing.T) {
+	const dir = "testdata/dummy-roberta-model"
+	fromFiles, err := Load(dir, ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vocab, err := os.Open(filepath.Join(dir, "vocab.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vocab.Close()
+	merges, err := os.Open(filepath.Join(dir, "merges.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merges.Close()
+	fromReaders, err := LoadFrom(vocab, merges, ControlTokensIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const text = "Hello, world!"
+	expected, err := fromFiles.Tokenize(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := fromReaders.Tokenize(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, actual %v", expected, actual)
+	}
+}
@@ -4,7 +4,17 @@
 
 package tokenizer
 
-import "github.com/nlpodyssey/verbaflow/tokenizer/internal/bpetokenizer"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlpodyssey/verbaflow/tokenizer/internal/bpetokenizer"
+)
 
 // Tokenizer is the interface that wraps the basic tokenizers methods.
 type Tokenizer interface {
@@ -14,11 +24,100 @@ type Tokenizer interface {
 	ReconstructText(ids []int) (string, error)
 }
 
-// Load loads a tokenizer from the given path.
+// Vocabulary returns the text of each token of a vocabulary of the given size,
+// e.g. to compute the properties of the tokens once per model.
+func Vocabulary(tk Tokenizer, size int) ([]string, error) {
+	texts := make([]string, size)
+	for id := range texts {
+		text, err := tk.ReconstructText([]int{id})
+		if err != nil {
+			return nil, fmt.Errorf("failed to reconstruct the text of token %d: %w", id, err)
+		}
+		texts[id] = text
+	}
+	return texts, nil
+}
+
+// Load loads a tokenizer from the given path, from the vocab.json and merges.txt
+// files, or from the tokenizer.json file if they are missing (see LoadTokenizerJSON).
 func Load(path string) (Tokenizer, error) {
+	if _, err := os.Stat(filepath.Join(path, "vocab.json")); os.IsNotExist(err) {
+		if f, err := os.Open(filepath.Join(path, "tokenizer.json")); err == nil {
+			defer f.Close()
+			return LoadTokenizerJSON(f)
+		}
+	}
 	tk, err := bpetokenizer.Load(path, bpetokenizer.ControlTokensIDs{})
 	if err != nil {
 		return nil, err
 	}
 	return tk, nil
 }
+
+// LoadFrom loads a tokenizer reading the contents of the vocab.json and merges.txt
+// files from the given readers, e.g. where there is no file system.
+func LoadFrom(vocab, merges io.Reader) (Tokenizer, error) {
+	tk, err := bpetokenizer.LoadFrom(vocab, merges, bpetokenizer.ControlTokensIDs{})
+	if err != nil {
+		return nil, err
+	}
+	return tk, nil
+}
+
+// LoadTokenizerJSON loads a byte-level BPE tokenizer from the contents of the
+// tokenizer.json file of the Hugging Face tokenizers, as found in the repositories
+// of the GPT-NeoX models. The added tokens missing from the vocabulary of the BPE
+// model are added to it.
+func LoadTokenizerJSON(r io.Reader) (Tokenizer, error) {
+	var tj struct {
+		AddedTokens []struct {
+			ID      int    `json:"id"`
+			Content string `json:"content"`
+		} `json:"added_tokens"`
+		Model struct {
+			Type   string          `json:"type"`
+			Vocab  map[string]int  `json:"vocab"`
+			Merges json.RawMessage `json:"merges"`
+		} `json:"model"`
+	}
+	if err := json.NewDecoder(r).Decode(&tj); err != nil {
+		return nil, fmt.Errorf("failed to read tokenizer.json: %w", err)
+	}
+	if tj.Model.Type != "BPE" {
+		return nil, fmt.Errorf("unsupported tokenizer model %q, expected BPE", tj.Model.Type)
+	}
+	vocab := tj.Model.Vocab
+	for _, t := range tj.AddedTokens {
+		if _, ok := vocab[t.Content]; !ok {
+			vocab[t.Content] = t.ID
+		}
+	}
+	vocabJSON, err := json.Marshal(vocab)
+	if err != nil {
+		return nil, err
+	}
+	merges, err := tokenizerJSONMerges(tj.Model.Merges)
+	if err != nil {
+		return nil, err
+	}
+	return LoadFrom(bytes.NewReader(vocabJSON), strings.NewReader(strings.Join(merges, "\n")))
+}
+
+// tokenizerJSONMerges returns the merges of tokenizer.json in the format of
+// merges.txt: they are either strings with the two parts separated by a space,
+// or pairs in the newer versions of the tokenizers.
+func tokenizerJSONMerges(data json.RawMessage) ([]string, error) {
+	var merges []string
+	if err := json.Unmarshal(data, &merges); err == nil {
+		return merges, nil
+	}
+	var pairs [][2]string
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, fmt.Errorf("failed to read the merges of tokenizer.json: %w", err)
+	}
+	merges = make([]string, len(pairs))
+	for i, p := range pairs {
+		merges[i] = p[0] + " " + p[1]
+	}
+	return merges, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokenizer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testModelDir = "internal/bpetokenizer/testdata/dummy-roberta-model"
+
+func TestLoad_TokenizerJSON(t *testing.T) {
+	expected, err := Load(testModelDir)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(testModelDir, "vocab.json"))
+	require.NoError(t, err)
+	var vocab map[string]int
+	require.NoError(t, json.Unmarshal(data, &vocab))
+	data, err = os.ReadFile(filepath.Join(testModelDir, "merges.txt"))
+	require.NoError(t, err)
+	var merges []string
+	var pairs [][]string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.HasPrefix(line, "#version") {
+			merges = append(merges, line)
+			pairs = append(pairs, strings.Split(line, " "))
+		}
+	}
+	// an added token missing from the vocabulary
+	addedTokens := []map[string]any{{"id": len(vocab), "content": "<|endoftext|>"}}
+
+	for name, m := range map[string]any{"strings": merges, "pairs": pairs} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			data, err := json.Marshal(map[string]any{
+				"added_tokens": addedTokens,
+				"model":        map[string]any{"type": "BPE", "vocab": vocab, "merges": m},
+			})
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "tokenizer.json"), data, 0644))
+
+			tk, err := Load(dir)
+			require.NoError(t, err)
+			require.Equal(t, len(vocab)+1, tk.(interface{ VocabSize() int }).VocabSize())
+			for _, text := range []string{"unrelated", "related", "rated", "under"} {
+				want, err := expected.Tokenize(text)
+				require.NoError(t, err)
+				got, err := tk.Tokenize(text)
+				require.NoError(t, err)
+				require.Equal(t, want, got, text)
+			}
+		})
+	}
+}
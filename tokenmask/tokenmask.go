@@ -0,0 +1,105 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tokenmask selects the tokens of a vocabulary by the Unicode properties
+// of their text, to ban them from the generations.
+package tokenmask
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Predicate reports whether the text of a token is to be banned.
+type Predicate func(text string) bool
+
+// Select returns the IDs of the tokens whose text satisfies the predicate.
+func Select(vocabulary []string, pred Predicate) []int {
+	var ids []int
+	for id, text := range vocabulary {
+		if pred(text) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// emojiRanges are the blocks of the emoji and pictographs.
+var emojiRanges = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x2600, Hi: 0x27bf, Stride: 1}, // miscellaneous symbols, dingbats
+		{Lo: 0x2b50, Hi: 0x2b55, Stride: 1}, // stars and circles
+		{Lo: 0xfe0f, Hi: 0xfe0f, Stride: 1}, // emoji presentation selector
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1faff, Stride: 1}, // pictographs, emoticons, flags...
+	},
+}
+
+// emojiPrefixes are the beginnings of the UTF-8 encodings of the emoji, which
+// the byte-level tokenizers split into several tokens, long enough not to be
+// the ones of other characters.
+var emojiPrefixes = []string{"\xf0\x9f", "\xe2\x98", "\xe2\x99", "\xe2\x9a", "\xe2\x9b", "\xe2\x9c", "\xe2\x9d", "\xe2\x9e"}
+
+// Emoji reports whether the text has an emoji, or ends with the beginning of the
+// encoding of one.
+func Emoji(text string) bool {
+	for _, r := range text {
+		if unicode.Is(emojiRanges, r) {
+			return true
+		}
+	}
+	tail := incompleteSuffix(text)
+	for _, p := range emojiPrefixes {
+		if strings.HasPrefix(tail, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// NonPrintable reports whether the text has control or other non-printable
+// characters, other than the newlines and the tabs. The partial UTF-8 sequences,
+// which make up the characters split across tokens, are not reported.
+func NonPrintable(text string) bool {
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		if r == utf8.RuneError && size == 1 {
+			continue
+		}
+		if r == '\n' || r == '\t' || r == '\r' {
+			continue
+		}
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// NonASCII reports whether the text has bytes out of the ASCII range.
+func NonASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// incompleteSuffix returns the bytes at the end of the text beginning a UTF-8
+// sequence not completed, if any.
+func incompleteSuffix(text string) string {
+	for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(text[i]) {
+			if !utf8.FullRuneInString(text[i:]) {
+				return text[i:]
+			}
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokenmask
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmoji(t *testing.T) {
+	for text, want := range map[string]bool{
+		"hello":         false,
+		"ciao 😀":        true,
+		"★":             true,
+		"☀":             true,
+		"“quoted”":      false,
+		"\xf0\x9f":      true, // beginning of an emoji
+		"a\xf0\x9f\x98": true,
+		"\xf0":          false, // also the beginning of other characters
+		"\x98\x80":      false,
+		"漢字":            false,
+	} {
+		assert.Equal(t, want, Emoji(text), "%q", text)
+	}
+}
+
+func TestNonPrintable(t *testing.T) {
+	for text, want := range map[string]bool{
+		"hello world":  false,
+		"line\n\tnext": false,
+		"\x00":         true,
+		"bell\a":       true,
+		"\u200b":       true,
+		"\xe4\xb8":     false, // partial sequence
+		"è":            false,
+	} {
+		assert.Equal(t, want, NonPrintable(text), "%q", text)
+	}
+}
+
+func TestNonASCII(t *testing.T) {
+	assert.False(t, NonASCII("hello, world!\n"))
+	assert.True(t, NonASCII("caffè"))
+	assert.True(t, NonASCII("\xe4"))
+}
+
+func TestSelect(t *testing.T) {
+	vocabulary := []string{"a", "è", "b", "😀"}
+	assert.Equal(t, []int{1, 3}, Select(vocabulary, NonASCII))
+	assert.Equal(t, []int{3}, Select(vocabulary, Emoji))
+	assert.Nil(t, Select(vocabulary, NonPrintable))
+}
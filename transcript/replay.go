@@ -0,0 +1,84 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcript
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlpodyssey/verbaflow"
+)
+
+// turn is a generation of a transcript.
+type turn struct {
+	prompt Entry
+	tokens []int
+	err    string
+}
+
+// SessionTokens returns the tokens followed by the state at the end of the
+// session of the transcript: the ones of its last turn not continuing the
+// previous one, followed by the continuing turns, each with its prompt and its
+// generated tokens, without the end token.
+//
+// The turns which failed are left out, as they can't be continued, while the
+// ones interrupted before their end, e.g. by a crash, are kept with the tokens
+// generated so far.
+func SessionTokens(entries []Entry) ([]int, error) {
+	var turns []*turn
+	byID := make(map[string]*turn)
+	for i, e := range entries {
+		if e.Kind == KindPrompt {
+			t := &turn{prompt: e}
+			turns = append(turns, t)
+			byID[e.GenerationID] = t
+			continue
+		}
+		t, ok := byID[e.GenerationID]
+		if !ok {
+			return nil, fmt.Errorf("transcript: entry %d of the unknown generation %q", i+1, e.GenerationID)
+		}
+		switch e.Kind {
+		case KindToken:
+			t.tokens = append(t.tokens, e.TokenID)
+		case KindEnd:
+			t.err = e.Error
+		default:
+			return nil, fmt.Errorf("transcript: entry %d of unknown kind %q", i+1, e.Kind)
+		}
+	}
+
+	var tokens []int
+	for _, t := range turns {
+		if t.err != "" {
+			continue
+		}
+		if !t.prompt.Continue {
+			tokens = nil
+		}
+		tokens = append(tokens, t.prompt.TokenIDs...)
+		generated := t.tokens
+		if opts := t.prompt.Options; opts != nil && len(generated) > 0 && generated[len(generated)-1] == opts.EndTokenID {
+			// the next turn follows the text, not the end token
+			generated = generated[:len(generated)-1]
+		}
+		tokens = append(tokens, generated...)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("transcript: no session to replay")
+	}
+	return tokens, nil
+}
+
+// Replay rebuilds the state at the end of the session of the transcript,
+// encoding its tokens (see SessionTokens) with the model, e.g. to continue the
+// session after a restart of the server or on another machine.
+func Replay(ctx context.Context, vf *verbaflow.VerbaFlow, entries []Entry) (*verbaflow.Continuation, error) {
+	tokens, err := SessionTokens(entries)
+	if err != nil {
+		return nil, err
+	}
+	return vf.EncodeContinuationTokens(ctx, tokens)
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcript
+
+import (
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTokens(t *testing.T) {
+	opts := &decoder.DecodingOptions{EndTokenID: 0}
+	entries := []Entry{
+		{Kind: KindPrompt, GenerationID: "a", TokenIDs: []int{9, 9}, Options: opts},
+		{Kind: KindToken, GenerationID: "a", TokenID: 9},
+		{Kind: KindEnd, GenerationID: "a"},
+		// a new session
+		{Kind: KindPrompt, GenerationID: "b", TokenIDs: []int{1, 2}, Options: opts},
+		{Kind: KindToken, GenerationID: "b", TokenID: 3},
+		{Kind: KindToken, GenerationID: "b", TokenID: 0},
+		{Kind: KindEnd, GenerationID: "b"},
+		// a failed turn is left out
+		{Kind: KindPrompt, GenerationID: "c", TokenIDs: []int{8}, Continue: true, Options: opts},
+		{Kind: KindToken, GenerationID: "c", TokenID: 8},
+		{Kind: KindEnd, GenerationID: "c", Error: "canceled"},
+		// an interrupted turn is kept
+		{Kind: KindPrompt, GenerationID: "d", TokenIDs: []int{4}, Continue: true, Options: opts},
+		{Kind: KindToken, GenerationID: "d", TokenID: 5},
+	}
+	tokens, err := SessionTokens(entries)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, tokens)
+
+	_, err = SessionTokens(append(entries, Entry{Kind: KindToken, GenerationID: "e"}))
+	assert.ErrorContains(t, err, "unknown generation")
+	_, err = SessionTokens(append(entries, Entry{Kind: "other", GenerationID: "d"}))
+	assert.ErrorContains(t, err, "unknown kind")
+	_, err = SessionTokens(entries[7:10])
+	assert.ErrorContains(t, err, "no session")
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package transcript implements the write-ahead transcripts of the sessions: an
+// append-only JSONL file per session, where each turn is written as it proceeds,
+// so that a crash doesn't lose it, and from which the state of the session can
+// be rebuilt.
+package transcript
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// The kinds of the entries of a transcript.
+const (
+	// KindPrompt begins a turn, with the text encoded before the generation.
+	KindPrompt = "prompt"
+	// KindToken is a generated token, written as soon as it is generated.
+	KindToken = "token"
+	// KindEnd ends a turn, with its completion or its error.
+	KindEnd = "end"
+)
+
+// Entry is a line of a transcript.
+type Entry struct {
+	Kind         string    `json:"kind"`
+	Time         time.Time `json:"time"`
+	GenerationID string    `json:"generation_id,omitempty"`
+	// Text is the text of the prompt, or the completion.
+	Text string `json:"text,omitempty"`
+	// TokenIDs are the tokens of the prompt, as encoded.
+	TokenIDs []int `json:"token_ids,omitempty"`
+	// Continue reports whether the prompt follows the state at the end of the
+	// previous turn, instead of a new state.
+	Continue bool                     `json:"continue,omitempty"`
+	Options  *decoder.DecodingOptions `json:"options,omitempty"`
+	// TokenID is the generated token.
+	TokenID int    `json:"token_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Writer appends the entries of a transcript to a file. It is safe for
+// concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// Open returns a Writer appending to the file, which is created if it doesn't
+// exist.
+func Open(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("transcript: failed to open %q: %w", path, err)
+	}
+	return &Writer{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends the entry, with the current time if it has none. Each entry is
+// written to the file at once, without buffering.
+func (w *Writer) Write(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(e); err != nil {
+		return fmt.Errorf("transcript: failed to write: %w", err)
+	}
+	return nil
+}
+
+// Sync commits the entries written so far to stable storage, e.g. at the end of
+// each turn, so that they survive the crash of the machine too.
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Sync()
+}
+
+// Close closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// Read reads the entries of a transcript. The last line, if incomplete because
+// the writing was interrupted, is ignored.
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without its newline was not completely written
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("transcript: invalid entry at line %d: %w", n, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// ReadFile reads the entries of the transcript in the file (see Read).
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Path returns the path of the transcript of a session in the directory: the
+// file is named after a hash of the session key, e.g. an API key, which is not
+// disclosed.
+func Path(dir, session string) string {
+	return filepath.Join(dir, SessionHash(session)+".jsonl")
+}
+
+// SessionHash returns the hash naming the files of a session, which doesn't
+// disclose its key.
+func SessionHash(session string) string {
+	sum := sha256.Sum256([]byte(session))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcript
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	dir := t.TempDir()
+	path := Path(dir, "secret-key")
+	assert.NotContains(t, path, "secret-key")
+	assert.Equal(t, dir, filepath.Dir(path))
+
+	w, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(Entry{Kind: KindPrompt, Text: "Hi", TokenIDs: []int{1, 2}, Options: &decoder.DecodingOptions{MaxLen: 3}}))
+	require.NoError(t, w.Write(Entry{Kind: KindToken, TokenID: 0}))
+	require.NoError(t, w.Write(Entry{Kind: KindToken, TokenID: 7}))
+	require.NoError(t, w.Sync())
+	require.NoError(t, w.Close())
+
+	// the file is appended to
+	w, err = Open(path)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(Entry{Kind: KindEnd, Text: "ab"}))
+	require.NoError(t, w.Close())
+
+	entries, err := ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, []int{1, 2}, entries[0].TokenIDs)
+	assert.Equal(t, 3, entries[0].Options.MaxLen)
+	assert.Equal(t, 0, entries[1].TokenID)
+	assert.Equal(t, 7, entries[2].TokenID)
+	assert.Equal(t, KindEnd, entries[3].Kind)
+	assert.False(t, entries[3].Time.IsZero())
+
+	// an interrupted write leaves an incomplete line, which is ignored
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"kind":"tok`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	entries, err = ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usage implements the accounting of the tokens processed for each
+// API key, and the enforcement of daily and monthly quotas.
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when an API key has consumed all the tokens
+// allowed by the quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Usage is the number of tokens processed.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Total returns the sum of prompt and completion tokens.
+func (u Usage) Total() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+func (u Usage) add(other Usage) Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+	}
+}
+
+// Quota is the maximum number of tokens (prompt and completion) that an API key
+// can consume in a period. Zero means unlimited.
+type Quota struct {
+	Daily   int
+	Monthly int
+}
+
+// Report is the usage of a single API key.
+type Report struct {
+	Key     string
+	Daily   Usage
+	Monthly Usage
+	Total   Usage
+}
+
+// AccountTTL is how long the account of an API key is kept without usage: its
+// quotas are reset anyway, and its total usage is forgotten.
+const AccountTTL = 62 * 24 * time.Hour
+
+// Tracker accounts the usage of the API keys in memory.
+// It is safe for concurrent use.
+// An account is created by the first usage recorded for its key, and removed
+// after AccountTTL without usage, so that the keys never used, e.g. the ones
+// made up by the clients, take no memory.
+type Tracker struct {
+	mu       sync.Mutex
+	quota    Quota
+	accounts map[string]*account
+	// pruned is the day of the last removal of the expired accounts.
+	pruned string
+	// now is replaceable for testing purposes.
+	now func() time.Time
+}
+
+type account struct {
+	day     string
+	daily   Usage
+	month   string
+	monthly Usage
+	total   Usage
+	// used is the time of the last usage.
+	used time.Time
+}
+
+// NewTracker returns a new Tracker enforcing the given quota.
+func NewTracker(q Quota) *Tracker {
+	return &Tracker{
+		quota:    q,
+		accounts: make(map[string]*account),
+		now:      time.Now,
+	}
+}
+
+// Check returns ErrQuotaExceeded (wrapped) if the key has no tokens left.
+func (t *Tracker) Check(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.accounts[key]
+	if !ok {
+		return nil
+	}
+	t.reset(a)
+	if t.quota.Daily > 0 && a.daily.Total() >= t.quota.Daily {
+		return fmt.Errorf("%w: daily limit of %d tokens reached", ErrQuotaExceeded, t.quota.Daily)
+	}
+	if t.quota.Monthly > 0 && a.monthly.Total() >= t.quota.Monthly {
+		return fmt.Errorf("%w: monthly limit of %d tokens reached", ErrQuotaExceeded, t.quota.Monthly)
+	}
+	return nil
+}
+
+// Record adds the usage of a request to the key.
+func (t *Tracker) Record(key string, u Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+	a := t.account(key)
+	a.daily = a.daily.add(u)
+	a.monthly = a.monthly.add(u)
+	a.total = a.total.add(u)
+	a.used = t.now()
+}
+
+// Report returns the usage of all the keys, sorted by key.
+func (t *Tracker) Report() []Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reports := make([]Report, 0, len(t.accounts))
+	for key, a := range t.accounts {
+		t.reset(a)
+		reports = append(reports, Report{
+			Key:     key,
+			Daily:   a.daily,
+			Monthly: a.monthly,
+			Total:   a.total,
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Key < reports[j].Key })
+	return reports
+}
+
+// account returns the account of the key, creating it if needed, and resetting
+// the counters of the expired periods.
+func (t *Tracker) account(key string) *account {
+	a, ok := t.accounts[key]
+	if !ok {
+		a = &account{}
+		t.accounts[key] = a
+	}
+	t.reset(a)
+	return a
+}
+
+// reset resets the counters of the expired periods of the account.
+func (t *Tracker) reset(a *account) {
+	now := t.now()
+	if day := now.Format("2006-01-02"); a.day != day {
+		a.day, a.daily = day, Usage{}
+	}
+	if month := now.Format("2006-01"); a.month != month {
+		a.month, a.monthly = month, Usage{}
+	}
+}
+
+// prune removes the accounts without usage for longer than AccountTTL, once a day.
+func (t *Tracker) prune() {
+	now := t.now()
+	if day := now.Format("2006-01-02"); t.pruned != day {
+		t.pruned = day
+		for key, a := range t.accounts {
+			if now.Sub(a.used) > AccountTTL {
+				delete(t.accounts, key)
+			}
+		}
+	}
+}
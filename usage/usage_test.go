@@ -0,0 +1,64 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker_DailyQuota(t *testing.T) {
+	now := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	tr := NewTracker(Quota{Daily: 10, Monthly: 25})
+	tr.now = func() time.Time { return now }
+
+	require.NoError(t, tr.Check("k"))
+	tr.Record("k", Usage{PromptTokens: 4, CompletionTokens: 6})
+	assert.True(t, errors.Is(tr.Check("k"), ErrQuotaExceeded))
+	assert.NoError(t, tr.Check("other"))
+
+	// the daily counter is reset on the next day, the monthly one is not
+	now = now.Add(24 * time.Hour)
+	require.NoError(t, tr.Check("k"))
+	tr.Record("k", Usage{PromptTokens: 5, CompletionTokens: 5})
+	now = now.Add(24 * time.Hour)
+	tr.Record("k", Usage{PromptTokens: 5, CompletionTokens: 0})
+	assert.True(t, errors.Is(tr.Check("k"), ErrQuotaExceeded))
+
+	// checking a key doesn't account it
+	reports := tr.Report()
+	require.Len(t, reports, 1)
+	assert.Equal(t, "k", reports[0].Key)
+	assert.Equal(t, 5, reports[0].Daily.Total())
+	assert.Equal(t, 25, reports[0].Monthly.Total())
+	assert.Equal(t, Usage{PromptTokens: 14, CompletionTokens: 11}, reports[0].Total)
+}
+
+func TestTracker_ExpiredAccounts(t *testing.T) {
+	now := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	tr := NewTracker(Quota{})
+	tr.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, tr.Check(fmt.Sprintf("made-up-%d", i)))
+	}
+	assert.Empty(t, tr.Report())
+
+	tr.Record("old", Usage{PromptTokens: 1})
+	now = now.Add(AccountTTL / 2)
+	tr.Record("recent", Usage{PromptTokens: 1})
+	now = now.Add(AccountTTL/2 + time.Hour)
+	tr.Record("new", Usage{PromptTokens: 1})
+	var keys []string
+	for _, r := range tr.Report() {
+		keys = append(keys, r.Key)
+	}
+	assert.Equal(t, []string{"new", "recent"}, keys)
+}
@@ -6,85 +6,465 @@ package verbaflow
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/nlpodyssey/spago/ag"
-	"github.com/nlpodyssey/spago/embeddings/store/diskstore"
 	"github.com/nlpodyssey/verbaflow/decoder"
 	"github.com/nlpodyssey/verbaflow/encoder"
+	"github.com/nlpodyssey/verbaflow/genid"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/prompts"
 	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/nlpodyssey/verbaflow/textproc"
 	"github.com/nlpodyssey/verbaflow/tokenizer"
-	"github.com/rs/zerolog/log"
+	"github.com/nlpodyssey/verbaflow/verrors"
 )
 
+// ErrClosed is returned when generating with a closed VerbaFlow.
+var ErrClosed = errors.New("verbaflow: model closed")
+
+// The kinds of errors returned by VerbaFlow and by its packages, to be tested
+// with errors.Is. They are defined in the verrors package.
+var (
+	// ErrPromptTooLong is returned when the prompt exceeds the limit set with SetMaxPromptTokens.
+	ErrPromptTooLong = verrors.ErrPromptTooLong
+	// ErrModelNotLoaded is returned when the model files are not found, or when
+	// generating with a VerbaFlow without a model.
+	ErrModelNotLoaded = verrors.ErrModelNotLoaded
+	// ErrDecodingAborted is returned when the generation is interrupted because
+	// the context is done; the error also wraps the error of the context.
+	ErrDecodingAborted = verrors.ErrDecodingAborted
+	// ErrTokenizerMismatch is returned when the tokenizer, or the embeddings, do
+	// not match the vocabulary of the model.
+	ErrTokenizerMismatch = verrors.ErrTokenizerMismatch
+	// ErrUnsupportedArchitecture is returned when the model to download, convert
+	// or load is not a supported RWKV or GPT-NeoX model.
+	ErrUnsupportedArchitecture = verrors.ErrUnsupportedArchitecture
+	// ErrStateMismatch is returned when a continuation read with ReadContinuation
+	// was encoded by another model: ConvertContinuation encodes it again.
+	ErrStateMismatch = verrors.ErrStateMismatch
+)
+
+// PromptTooLongError is the error returned when the prompt exceeds the limit
+// set with SetMaxPromptTokens. It matches ErrPromptTooLong.
+type PromptTooLongError = verrors.PromptTooLongError
+
+// PanicError is the error returned when a generation panics: the panic is
+// recovered, so that it does not crash the process serving other generations.
+type PanicError = verrors.PanicError
+
+// Backend is a language model other than RWKV, driven by the same decoder, such
+// as a gptneox.Model.
+type Backend interface {
+	decoder.Model
+	// EncodePrompt encodes the tokens of the prompt, returning the input of the
+	// decoder after them. The progress function, if not nil, is called with the
+	// number of tokens encoded so far and the total. If ctx is done, it fails with
+	// an error wrapping ErrDecodingAborted.
+	EncodePrompt(ctx context.Context, tokens []int, progress func(encoded, total int)) (decoder.Input, error)
+}
+
 // VerbaFlow is the core struct of the library.
+//
+// A VerbaFlow is safe for concurrent use: multiple goroutines can call Generate
+// (and the functions built on it) at the same time. The weights of the model are
+// shared and only read during the inference, while each generation works on its
+// own model state and computational graph. Use SetMaxConcurrency to limit the number
+// of generations running at once; the other ones wait for a free slot.
+//
+// Close waits for the running generations to complete; the generations started
+// afterwards fail with ErrClosed.
 type VerbaFlow struct {
-	Model          *rwkvlm.Model
-	Tokenizer      tokenizer.Tokenizer
-	embeddingsRepo *diskstore.Repository
+	Model *rwkvlm.Model
+	// Backend is the model used instead of an RWKV one, when Model is nil.
+	Backend   Backend
+	Tokenizer tokenizer.Tokenizer
+	// GenerationConfig, when not nil, contains the decoding options recommended for
+	// the model, read by Load from its directory: each generation uses them for the
+	// options left to zero (see GenerationConfig.Defaults), and stops at their stop
+	// strings and end-of-sequence tokens too.
+	GenerationConfig *GenerationConfig
+	// ChatFormat is the prompt format of the messages of Chat (default: the
+	// format named DefaultChatFormat).
+	ChatFormat *prompts.Format
+	// ChatHistory, when not nil, is how Chat keeps the long conversations within
+	// a number of tokens, summarizing or truncating the older messages.
+	ChatHistory *HistoryPolicy
+	// HalfStates makes the continuations keep their states and their logits in
+	// float16, converted to float32 for the computation, in about 60% of the
+	// memory, e.g. to keep the sessions of many users: the generations following
+	// them can differ slightly, because of the rounding.
+	HalfStates bool
+	// embeddingsRepo is the repository of the embeddings, closed by Close.
+	embeddingsRepo io.Closer
+	// tmpDir, when not empty, contains the files extracted from a bundle.
+	tmpDir string
+	// weights, when not nil, is the mapping of the snapshot with the shared
+	// weights of the model, released by Close.
+	weights io.Closer
+
+	// mu is held for reading by each generation, and for writing by Close.
+	mu     sync.RWMutex
+	closed bool
+	// sem limits the number of concurrent generations, when not nil.
+	sem chan struct{}
+	// maxPromptTokens, when positive, is the maximum number of tokens of a prompt.
+	maxPromptTokens int
+
+	// vocab contains the properties of the tokens, computed once (see vocabulary).
+	vocab     vocabulary
+	vocabOnce sync.Once
+	vocabErr  error
+
+	// chats are the states of the conversations of Chat.
+	chats chatStates
+	// summaries are the summaries of the long conversations of Chat.
+	summaries chatSummaries
 }
 
-// Load loads a VerbaFlow model from the given directory.
-func Load(modelDir string) (*VerbaFlow, error) {
-	tk, err := tokenizer.Load(modelDir)
-	if err != nil {
-		return nil, err
+// Close closes the model resources, waiting for the running generations to complete.
+func (vf *VerbaFlow) Close() error {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	if vf.closed {
+		return nil
 	}
-	model, err := rwkvlm.Load(modelDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("error: unable to find the model file or directory '%s'. Please ensure that the model has been successfully downloaded and converted before trying again", modelDir)
+	vf.closed = true
+	var err error
+	if vf.embeddingsRepo != nil {
+		err = vf.embeddingsRepo.Close()
+	}
+	if vf.tmpDir != "" {
+		if e := os.RemoveAll(vf.tmpDir); e != nil && err == nil {
+			err = e
 		}
-		return nil, err
 	}
-	embeddingsRepo, err := diskstore.NewRepository(filepath.Join(modelDir, rwkvlm.DefaultEmbeddingRepoPath), diskstore.ReadOnlyMode)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load embeddings repository: %w", err)
+	if vf.weights != nil {
+		if e := vf.weights.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
-	err = model.ApplyEmbeddings(embeddingsRepo)
-	if err != nil {
-		return nil, fmt.Errorf("failed to apply embeddings: %w", err)
+	return err
+}
+
+// SetMaxConcurrency limits the number of generations running at the same time.
+// Zero (default) means no limit. It must be called before any generation starts.
+func (vf *VerbaFlow) SetMaxConcurrency(n int) {
+	if n <= 0 {
+		vf.sem = nil
+		return
 	}
-	return &VerbaFlow{
-		Model:          model,
-		Tokenizer:      tk,
-		embeddingsRepo: embeddingsRepo,
-	}, nil
+	vf.sem = make(chan struct{}, n)
 }
 
-// Close closes the model resources.
-func (vf *VerbaFlow) Close() error {
-	return vf.embeddingsRepo.Close()
+// SetMaxPromptTokens limits the number of tokens of the prompts: the longer
+// prompts fail with a *PromptTooLongError. Zero (default) means no limit.
+// It must be called before any generation starts.
+func (vf *VerbaFlow) SetMaxPromptTokens(n int) {
+	vf.maxPromptTokens = n
+}
+
+// CheckPromptLength returns a *PromptTooLongError if a prompt of the given
+// number of tokens exceeds the limit of SetMaxPromptTokens, to fail a request
+// before starting its generation.
+func (vf *VerbaFlow) CheckPromptLength(tokens int) error {
+	if vf.maxPromptTokens > 0 && tokens > vf.maxPromptTokens {
+		return &PromptTooLongError{Tokens: tokens, MaxTokens: vf.maxPromptTokens}
+	}
+	return nil
+}
+
+// acquire reserves a generation slot, waiting for one to be free if the
+// concurrency is limited. The returned function releases the slot.
+func (vf *VerbaFlow) acquire(ctx context.Context) (func(), error) {
+	vf.mu.RLock()
+	if vf.closed {
+		vf.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	if vf.sem == nil {
+		return vf.mu.RUnlock, nil
+	}
+	select {
+	case vf.sem <- struct{}{}:
+		return func() {
+			<-vf.sem
+			vf.mu.RUnlock()
+		}, nil
+	case <-ctx.Done():
+		vf.mu.RUnlock()
+		return nil, ctx.Err()
+	}
 }
 
 // Generate generates a text from the given prompt.
-// The "out" channel is used to stream the generated text.
-// The generated text will be at most `maxTokens` long (in addition to the prompt).
+// The "chGen" channel is used to stream the generated tokens, and it is always closed
+// when Generate returns.
+// The generated text will be at most `opts.MaxLen` tokens long (in addition to the prompt).
+// A panic during the generation is recovered and returned as a *PanicError.
+//
+// The generation is identified by the ID of ctx (see WithGenerationID), or by a
+// new one, added to its log lines.
 func (vf *VerbaFlow) Generate(ctx context.Context, nt *ag.NodesTracker, prompt string, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
-	log.Trace().Msgf("Tokenizing prompt: %q", prompt)
-	tokenized, err := vf.Tokenizer.Tokenize(prompt)
+	ctx, _ = genid.Ensure(ctx)
+	release, err := vf.acquire(ctx)
 	if err != nil {
+		close(chGen)
 		return err
 	}
+	defer release()
 
-	log.Trace().Msgf("Preprocessing %d token IDs: %v", len(tokenized), tokenized)
-	start := time.Now()
-	encoderOutput, err := encoder.New(vf.Model).Encode(ctx, tokenized)
+	d, input, err := vf.prepare(ctx, nt, []string{prompt}, opts)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	return d.Decode(ctx, nt, input, chGen)
+}
+
+// GenerateEnsemble is like Generate, but decodes multiple variants of the same
+// prompt together (mixture of prompts), e.g. differently worded questions: at
+// each step, the next token is selected from the pooling of their predictions,
+// set with opts.EnsemblePooling (see decoder.Ensemble). The limit of
+// SetMaxPromptTokens applies to each prompt, and opts.PromptProgress reports the
+// encoding of all of them.
+func (vf *VerbaFlow) GenerateEnsemble(ctx context.Context, nt *ag.NodesTracker, prompts []string, chGen chan decoder.GeneratedToken, opts decoder.DecodingOptions) error {
+	if len(prompts) == 0 {
+		close(chGen)
+		return fmt.Errorf("verbaflow: no prompts to generate from")
+	}
+	ctx, _ = genid.Ensure(ctx)
+	release, err := vf.acquire(ctx)
 	if err != nil {
+		close(chGen)
 		return err
 	}
-	log.Trace().Msgf("Preprocessing took %s", time.Since(start))
+	defer release()
+
+	d, input, err := vf.prepare(ctx, nt, prompts, opts)
+	if err != nil {
+		close(chGen)
+		return err
+	}
+	return d.Decode(ctx, nt, input, chGen)
+}
+
+// model returns the model driven by the decoder: the RWKV one, or the Backend.
+func (vf *VerbaFlow) model() (decoder.Model, error) {
+	switch {
+	case vf.Model != nil:
+		return vf.Model, nil
+	case vf.Backend != nil:
+		return vf.Backend, nil
+	default:
+		return nil, ErrModelNotLoaded
+	}
+}
+
+// prepare tokenizes and encodes the prompts, returning the decoder of the generation
+// and its input; multiple prompts are decoded with a decoder.Ensemble. A panic is
+// recovered and returned as a *PanicError, like in the decoding.
+func (vf *VerbaFlow) prepare(ctx context.Context, nt *ag.NodesTracker, prompts []string, opts decoder.DecodingOptions) (_ *decoder.Decoder, _ decoder.Input, err error) {
+	logger := genid.Logger(ctx)
+	defer func() {
+		if r := recover(); r != nil {
+			pe := verrors.Recovered(r)
+			logger.Error().Str("stack", string(pe.Stack)).Msgf("recovered from panic while preparing the generation: %v", r)
+			err = pe
+		}
+	}()
+	model, err := vf.model()
+	if err != nil {
+		return nil, decoder.Input{}, err
+	}
+	if opts, err = vf.applyOptions(prompts[0], opts); err != nil {
+		return nil, decoder.Input{}, err
+	}
+	var ensemble *decoder.Ensemble
+	if len(prompts) > 1 {
+		if ensemble, err = decoder.NewEnsemble(model, opts.EnsemblePooling); err != nil {
+			return nil, decoder.Input{}, err
+		}
+		model = ensemble
+	}
+
+	tokenized := make([][]int, len(prompts))
+	total := 0
+	for i, prompt := range prompts {
+		logger.Trace().Msgf("Tokenizing prompt: %q", prompt)
+		if tokenized[i], err = vf.Tokenizer.Tokenize(prompt); err != nil {
+			return nil, decoder.Input{}, err
+		}
+		if err := vf.CheckPromptLength(len(tokenized[i])); err != nil {
+			return nil, decoder.Input{}, err
+		}
+		total += len(tokenized[i])
+	}
+
+	// the decoder is set up while the prompt is encoded, so that the generation
+	// starts as soon as the encoding is done
+	type setup struct {
+		d   *decoder.Decoder
+		err error
+	}
+	chSetup := make(chan setup, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				pe := verrors.Recovered(r)
+				logger.Error().Str("stack", string(pe.Stack)).Msgf("recovered from panic while setting up the decoder: %v", r)
+				chSetup <- setup{err: pe}
+			}
+		}()
+		d, err := decoder.New(model, opts)
+		chSetup <- setup{d: d, err: err}
+	}()
+
+	start := time.Now()
+	inputs := make([]decoder.Input, len(tokenized))
+	encoded := 0
+	for i, tokens := range tokenized {
+		logger.Trace().Msgf("Preprocessing %d token IDs: %v", len(tokens), tokens)
+		popts := opts
+		if progress := opts.PromptProgress; progress != nil && len(tokenized) > 1 {
+			offset := encoded
+			popts.PromptProgress = func(n, _ int) { progress(offset+n, total) }
+		}
+		if inputs[i], err = vf.encodePrompt(ctx, nt, tokens, popts); err != nil {
+			break
+		}
+		encoded += len(tokens)
+	}
+	su := <-chSetup
+	if err != nil {
+		return nil, decoder.Input{}, err
+	}
+	logger.Trace().Msgf("Preprocessing took %s", time.Since(start))
+	if su.err != nil {
+		return nil, decoder.Input{}, su.err
+	}
+
+	input := inputs[0]
+	if ensemble != nil {
+		if input, err = ensemble.Input(inputs); err != nil {
+			return nil, decoder.Input{}, err
+		}
+	}
+	logger.Trace().Msg("Generating...")
+	return su.d, input, nil
+}
 
-	log.Trace().Msg("Generating...")
-	d, err := decoder.New(vf.Model, opts)
+// applyOptions returns the options with the defaults of the GenerationConfig,
+// and with the ones applied by VerbaFlow turned into the logits processors, the
+// banned tokens and the token texts used by the decoder.
+func (vf *VerbaFlow) applyOptions(prompt string, opts decoder.DecodingOptions) (decoder.DecodingOptions, error) {
+	opts = vf.GenerationConfig.withStops(vf.GenerationConfig.Defaults(opts))
+	opts, err := vf.withScriptGate(prompt, opts)
 	if err != nil {
+		return opts, err
+	}
+	if opts, err = vf.withTokenMasks(opts); err != nil {
+		return opts, err
+	}
+	if opts, err = vf.withChoices(opts); err != nil {
+		return opts, err
+	}
+	if opts, err = vf.withRegexp(opts); err != nil {
+		return opts, err
+	}
+	if (len(opts.StopRegexps) > 0 || opts.DeadlineAware) && opts.TokenText == nil {
+		opts.TokenText = vf.TokenByID
+	}
+	return opts, nil
+}
+
+// encodePrompt encodes the tokens of the prompt with the RWKV model, or with the Backend.
+func (vf *VerbaFlow) encodePrompt(ctx context.Context, nt *ag.NodesTracker, tokens []int, opts decoder.DecodingOptions) (decoder.Input, error) {
+	if vf.Model == nil {
+		return vf.Backend.EncodePrompt(ctx, tokens, opts.PromptProgress)
+	}
+	encoderOutput, err := encoder.NewWithOptions(vf.Model, rwkvlm.EncodeOptions{
+		ChunkSize:  opts.PromptChunkSize,
+		Progress:   opts.PromptProgress,
+		Sequential: opts.SequentialPrompt,
+	}).Encode(ctx, tokens)
+	if err != nil {
+		return decoder.Input{}, err
+	}
+	return encoderOutput.DecoderInput(vf.Model, nt), nil
+}
+
+// GenerateText generates a text from the given prompt, calling fn with each chunk of
+// decoded text as soon as it is available. The text goes through the given processors,
+// in order, before being passed to fn; they are notified with textproc.MarkTruncated
+// if the generation is stopped by opts.MaxLen.
+func (vf *VerbaFlow) GenerateText(ctx context.Context, prompt string, opts decoder.DecodingOptions, fn func(text string) error, processors ...textproc.Processor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maxLen := vf.GenerationConfig.Defaults(opts).MaxLen
+	chGen := vf.generationChannel(opts)
+	errCh := make(chan error, 1)
+	go func() {
+		// free the computational graph after the generation is finished
+		nt := &ag.NodesTracker{}
+		defer graph.ReleaseNodes(nt)
+		errCh <- vf.Generate(ctx, nt, prompt, chGen, opts)
+	}()
+
+	proc := textproc.Chain(processors...)
+	generated, last := 0, opts.EndTokenID
+	for gen := range chGen {
+		generated, last = generated+1, gen.TokenID
+		if gen.TokenID == opts.EndTokenID && opts.SkipEndTokenID {
+			continue
+		}
+		token, err := vf.TokenByID(gen.TokenID)
+		if err != nil {
+			return err
+		}
+		if text := proc.Process(token); text != "" {
+			if err := fn(text); err != nil {
+				return err
+			}
+		}
+	}
+	if err := <-errCh; err != nil {
 		return err
 	}
+	if generated >= maxLen && last != opts.EndTokenID {
+		textproc.MarkTruncated(proc)
+	}
+	if text := proc.Flush(); text != "" {
+		return fn(text)
+	}
+	return nil
+}
 
-	return d.Decode(ctx, nt, encoderOutput, chGen)
+// generationChannel returns the channel of the tokens generated with the given
+// options, buffered to hold all of them, so that the decoding does not wait for
+// their consumer. The buffer follows the MaxLen of the options with the defaults
+// of the GenerationConfig, as the decoder, which generates a token at least.
+func (vf *VerbaFlow) generationChannel(opts decoder.DecodingOptions) chan decoder.GeneratedToken {
+	n := vf.GenerationConfig.Defaults(opts).MaxLen
+	if n < 1 {
+		n = 1
+	}
+	return make(chan decoder.GeneratedToken, n)
+}
+
+// CountTokens returns the number of tokens of the given text.
+func (vf *VerbaFlow) CountTokens(text string) (int, error) {
+	tokenized, err := vf.Tokenizer.Tokenize(text)
+	if err != nil {
+		return 0, err
+	}
+	return len(tokenized), nil
 }
 
 // TokenByID returns the token string for the given token ID.
@@ -0,0 +1,349 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlpodyssey/spago/ag"
+	"github.com/nlpodyssey/spago/embeddings/store/memstore"
+	"github.com/nlpodyssey/spago/initializers"
+	"github.com/nlpodyssey/spago/mat"
+	"github.com/nlpodyssey/spago/mat/rand"
+	"github.com/nlpodyssey/spago/nn"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/gptneox"
+	"github.com/nlpodyssey/verbaflow/internal/graph"
+	"github.com/nlpodyssey/verbaflow/rwkvlm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testVocabSize = 32
+
+// byteTokenizer is a trivial tokenizer mapping each byte to a token ID.
+type byteTokenizer struct{}
+
+func (byteTokenizer) Tokenize(text string) ([]int, error) {
+	ids := make([]int, len(text))
+	for i := 0; i < len(text); i++ {
+		ids[i] = int(text[i]) % testVocabSize
+	}
+	return ids, nil
+}
+
+func (byteTokenizer) ReconstructText(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteByte(byte('a' + id%26))
+	}
+	return sb.String(), nil
+}
+
+// newTestVerbaFlow returns a VerbaFlow with a tiny randomly initialized model.
+func newTestVerbaFlow(t *testing.T) *VerbaFlow {
+	t.Helper()
+
+	repo := memstore.NewRepository()
+	m := rwkvlm.New[float32](rwkvlm.Config{
+		DModel:              8,
+		NumHiddenLayers:     2,
+		VocabSize:           testVocabSize,
+		RescaleLayer:        6,
+		EmbeddingsStoreName: "test",
+	}, repo)
+
+	rng := rand.NewLockedRand(42)
+	nn.ForEachParam(m, func(param nn.Param, _ string, _ nn.ParamsType) {
+		initializers.Uniform(param.Value(), -0.5, 0.5, rng)
+	})
+	for id := 0; id < testVocabSize; id++ {
+		e, _ := m.Embeddings.Tokens.Embedding(id)
+		e.ReplaceValue(initializers.Uniform(mat.NewEmptyVecDense[float32](8), -0.5, 0.5, rng))
+	}
+
+	return &VerbaFlow{
+		Model:     m,
+		Tokenizer: byteTokenizer{},
+	}
+}
+
+func generateIDs(t *testing.T, vf *VerbaFlow, prompt string, opts decoder.DecodingOptions) []int {
+	nt := &ag.NodesTracker{}
+	defer graph.ReleaseNodes(nt)
+
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- vf.Generate(context.Background(), nt, prompt, chGen, opts)
+	}()
+	var ids []int
+	for gen := range chGen {
+		ids = append(ids, gen.TokenID)
+	}
+	assert.NoError(t, <-errCh)
+	return ids
+}
+
+func TestVerbaFlow_ConcurrentGenerate(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.SetMaxConcurrency(3)
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1, TopP: 1, Temp: 1}
+
+	prompts := []string{"hello", "world", "concurrent", "generations"}
+	expected := make([][]int, len(prompts))
+	for i, p := range prompts {
+		expected[i] = generateIDs(t, vf, p, opts)
+		require.Len(t, expected[i], opts.MaxLen)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		for i, p := range prompts {
+			wg.Add(1)
+			go func(i int, p string) {
+				defer wg.Done()
+				assert.Equal(t, expected[i], generateIDs(t, vf, p, opts))
+			}(i, p)
+		}
+	}
+	wg.Wait()
+}
+
+func TestVerbaFlow_GenerateAfterClose(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	require.NoError(t, vf.Close())
+
+	chGen := make(chan decoder.GeneratedToken, 1)
+	err := vf.Generate(context.Background(), &ag.NodesTracker{}, "hello", chGen, decoder.DecodingOptions{MaxLen: 1})
+	assert.ErrorIs(t, err, ErrClosed)
+	_, open := <-chGen
+	assert.False(t, open)
+}
+
+func TestVerbaFlow_Errors(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.SetMaxPromptTokens(4)
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1, TopP: 1, Temp: 1}
+
+	err := vf.GenerateText(context.Background(), "hello", opts, func(string) error { return nil })
+	assert.ErrorIs(t, err, ErrPromptTooLong)
+	var tooLong *PromptTooLongError
+	require.ErrorAs(t, err, &tooLong)
+	assert.Equal(t, PromptTooLongError{Tokens: 5, MaxTokens: 4}, *tooLong)
+	assert.ErrorIs(t, vf.CheckPromptLength(5), ErrPromptTooLong)
+	assert.NoError(t, vf.CheckPromptLength(4))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = vf.GenerateText(ctx, "hi", opts, func(string) error {
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrDecodingAborted)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	vf.Model = nil
+	assert.ErrorIs(t, vf.GenerateText(context.Background(), "hi", opts, func(string) error { return nil }), ErrModelNotLoaded)
+}
+
+func TestVerbaFlow_ConcurrentCancellations(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 16, EndTokenID: -1, Temp: 1, TopP: 1}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs[i] = vf.GenerateText(ctx, "hello", opts, func(string) error {
+				cancel()
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.ErrorIs(t, err, ErrDecodingAborted)
+	}
+	assert.NoError(t, vf.Close())
+}
+
+func TestVerbaFlow_RecoversPanics(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.SetMaxConcurrency(1)
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1, TopP: 1, Temp: 1}
+	expected := generateIDs(t, vf, "hello", opts)
+
+	panicking := opts
+	panicking.LogitsProcessors = []decoder.LogitsProcessor{decoder.LogitsProcessorFunc(func(step int, _ []int, logits []float32) []float32 {
+		if step == 2 {
+			_ = logits[len(logits)]
+		}
+		return logits
+	})}
+	var generated int
+	err := vf.GenerateText(context.Background(), "hello", panicking, func(string) error {
+		generated++
+		return nil
+	})
+	var pe *PanicError
+	require.ErrorAs(t, err, &pe)
+	assert.NotEmpty(t, pe.Stack)
+	assert.Equal(t, 2, generated)
+
+	// the slot is released, and the other generations are not affected
+	assert.Equal(t, expected, generateIDs(t, vf, "hello", opts))
+}
+
+func TestVerbaFlow_RecordTiming(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 4, EndTokenID: -1, TopP: 1, Temp: 1, RecordTiming: true}
+
+	chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+	require.NoError(t, vf.Generate(context.Background(), &ag.NodesTracker{}, "hello", chGen, opts))
+
+	var n int
+	for gen := range chGen {
+		require.NotNil(t, gen.Timing)
+		assert.Positive(t, gen.Timing.Encoder)
+		assert.Positive(t, gen.Timing.Head)
+		n++
+	}
+	assert.Equal(t, opts.MaxLen, n)
+
+	opts.RecordTiming = false
+	chGen = make(chan decoder.GeneratedToken, opts.MaxLen)
+	require.NoError(t, vf.Generate(context.Background(), &ag.NodesTracker{}, "hello", chGen, opts))
+	for gen := range chGen {
+		assert.Nil(t, gen.Timing)
+	}
+}
+
+func TestVerbaFlow_Backend(t *testing.T) {
+	m := gptneox.New[float32](gptneox.Config{
+		HiddenSize:        8,
+		NumAttentionHeads: 2,
+		NumHiddenLayers:   2,
+		IntermediateSize:  32,
+		VocabSize:         testVocabSize,
+		RotaryPct:         0.5,
+		RotaryEmbBase:     10000,
+		LayerNormEps:      1e-5,
+	})
+	rng := rand.NewLockedRand(42)
+	nn.ForEachParam(m, func(param nn.Param, _ string, _ nn.ParamsType) {
+		initializers.Uniform(param.Value(), -0.5, 0.5, rng)
+	})
+	vf := &VerbaFlow{Backend: m, Tokenizer: byteTokenizer{}}
+
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1}
+	ids := generateIDs(t, vf, "hello", opts)
+
+	// the greedy decoding, driving the model directly
+	prompt, err := vf.Tokenizer.Tokenize("hello")
+	require.NoError(t, err)
+	in, err := m.EncodePrompt(context.Background(), prompt, nil)
+	require.NoError(t, err)
+	logits, s := in.Logits, in.State
+	var want []int
+	for len(want) < opts.MaxLen {
+		id := logits.ArgMax()
+		want = append(want, id)
+		logits, s, err = m.EncodeNext(context.Background(), nil, s, id)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, want, ids)
+}
+
+func TestVerbaFlow_GenerateEnsemble(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1}
+	want := generateIDs(t, vf, "hello", opts)
+
+	generate := func(prompts []string, opts decoder.DecodingOptions) []int {
+		chGen := make(chan decoder.GeneratedToken, opts.MaxLen)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- vf.GenerateEnsemble(context.Background(), &ag.NodesTracker{}, prompts, chGen, opts)
+		}()
+		var ids []int
+		for gen := range chGen {
+			ids = append(ids, gen.TokenID)
+		}
+		require.NoError(t, <-errCh)
+		return ids
+	}
+
+	// the pooling of the same predictions does not change them
+	var progress [][2]int
+	opts.PromptProgress = func(encoded, total int) {
+		progress = append(progress, [2]int{encoded, total})
+	}
+	for _, pooling := range []string{decoder.PoolMean, decoder.PoolMax} {
+		opts.EnsemblePooling = pooling
+		assert.Equal(t, want, generate([]string{"hello", "hello"}, opts), pooling)
+	}
+	assert.Equal(t, [][2]int{{5, 10}, {10, 10}}, progress[:2])
+
+	assert.Len(t, generate([]string{"hello", "Hi! How are you?"}, opts), opts.MaxLen)
+
+	opts.EnsemblePooling = "median"
+	err := vf.GenerateEnsemble(context.Background(), &ag.NodesTracker{}, []string{"a", "b"}, make(chan decoder.GeneratedToken), opts)
+	assert.ErrorContains(t, err, "unknown ensemble pooling")
+}
+
+// truncationRecorder is a processor recording whether the stream was truncated.
+type truncationRecorder struct {
+	truncated bool
+}
+
+func (p *truncationRecorder) Process(chunk string) string { return chunk }
+func (p *truncationRecorder) Flush() string               { return "" }
+func (p *truncationRecorder) Truncated()                  { p.truncated = true }
+
+func TestVerbaFlow_GenerateText_DefaultMaxLen(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	maxNewTokens := 6
+	vf.GenerationConfig = &GenerationConfig{MaxNewTokens: &maxNewTokens}
+	// MaxLen is left to zero, as by the gRPC clients: the GenerationConfig sets it
+	opts := decoder.DecodingOptions{EndTokenID: -1, Temp: 1, TopP: 1}
+	generate := func(opts decoder.DecodingOptions, fn func(string) error) (bool, error) {
+		rec := &truncationRecorder{}
+		err := vf.GenerateText(context.Background(), "hello", opts, fn, rec)
+		return rec.truncated, err
+	}
+
+	truncated, err := generate(opts, func(string) error { return nil })
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	first := generateIDs(t, vf, "hello", decoder.DecodingOptions{MaxLen: 1, EndTokenID: -1, Temp: 1, TopP: 1})[0]
+
+	stopped := opts
+	stopped.StopSequencesIDs = [][]int{{first}}
+	truncated, err = generate(stopped, func(string) error { return nil })
+	require.NoError(t, err)
+	assert.False(t, truncated)
+
+	// the consumer stopping early does not leave the decoding blocked
+	errStop := errors.New("stop")
+	_, err = generate(opts, func(string) error { return errStop })
+	assert.ErrorIs(t, err, errStop)
+	closed := make(chan error, 1)
+	go func() { closed <- vf.Close() }()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package verrors defines the kinds of errors returned by the VerbaFlow packages,
+// so that the embedders can branch on them with errors.Is, whichever package
+// returns them. The errors are wrapped with the details of each occurrence.
+//
+// The verbaflow package re-exports them, and it is the usual way to refer to them.
+package verrors
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+var (
+	// ErrPromptTooLong is returned when the prompt exceeds the maximum number of tokens.
+	// The error is a *PromptTooLongError.
+	ErrPromptTooLong = errors.New("verbaflow: prompt too long")
+	// ErrModelNotLoaded is returned when the model is missing, either because its
+	// files are not found or because it was not loaded at all.
+	ErrModelNotLoaded = errors.New("verbaflow: model not loaded")
+	// ErrDecodingAborted is returned when the decoding is interrupted before its end,
+	// because the context is done. The error also wraps the error of the context.
+	ErrDecodingAborted = errors.New("verbaflow: decoding aborted")
+	// ErrTokenizerMismatch is returned when the tokenizer, or the embeddings, do not
+	// match the vocabulary of the model.
+	ErrTokenizerMismatch = errors.New("verbaflow: tokenizer does not match the model")
+	// ErrUnsupportedArchitecture is returned when the model is not an RWKV or GPT-NeoX model
+	// in the supported format.
+	ErrUnsupportedArchitecture = errors.New("verbaflow: unsupported model architecture")
+	// ErrStateMismatch is returned when a saved state, e.g. a continuation, was
+	// encoded by another model, or by a model of another shape.
+	ErrStateMismatch = errors.New("verbaflow: state does not match the model")
+)
+
+// PromptTooLongError is the error returned when the prompt exceeds the maximum
+// number of tokens. It matches ErrPromptTooLong.
+type PromptTooLongError struct {
+	// Tokens is the number of tokens of the prompt.
+	Tokens int
+	// MaxTokens is the maximum number of tokens allowed.
+	MaxTokens int
+}
+
+func (e *PromptTooLongError) Error() string {
+	return fmt.Sprintf("%v: %d tokens, the maximum is %d", ErrPromptTooLong, e.Tokens, e.MaxTokens)
+}
+
+// Unwrap returns ErrPromptTooLong.
+func (e *PromptTooLongError) Unwrap() error {
+	return ErrPromptTooLong
+}
+
+// PanicError is the error returned when a generation panics, e.g. for a numerical
+// edge case or a bug, so that the failure of a request does not crash the process
+// serving the other ones.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+// Recovered returns the PanicError of the value returned by recover, with the
+// current stack trace: it must be called by the deferred function recovering.
+func Recovered(v any) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("verbaflow: panic during the generation: %v", e.Value)
+}
+
+// Unwrap returns the value passed to panic, if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/verbaflow/constraint"
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/nlpodyssey/verbaflow/language"
+	"github.com/nlpodyssey/verbaflow/tokenizer"
+	"github.com/nlpodyssey/verbaflow/tokenmask"
+)
+
+// vocabulary contains the properties of the tokens of the model, used by the
+// logits processors working on the text of the tokens.
+type vocabulary struct {
+	texts   []string
+	scripts []language.Script
+	// the IDs of the tokens banned by the masks of the DecodingOptions
+	emoji        []int
+	nonPrintable []int
+	nonASCII     []int
+}
+
+// vocabulary returns the properties of the tokens of the model, computed the
+// first time they are needed.
+func (vf *VerbaFlow) vocabulary() (*vocabulary, error) {
+	vf.vocabOnce.Do(func() {
+		size, err := vf.vocabSize()
+		if err != nil {
+			vf.vocabErr = err
+			return
+		}
+		texts, err := tokenizer.Vocabulary(vf.Tokenizer, size)
+		if err != nil {
+			vf.vocabErr = err
+			return
+		}
+		vf.vocab = vocabulary{
+			texts:        texts,
+			scripts:      language.TokenScripts(texts),
+			emoji:        tokenmask.Select(texts, tokenmask.Emoji),
+			nonPrintable: tokenmask.Select(texts, tokenmask.NonPrintable),
+			nonASCII:     tokenmask.Select(texts, tokenmask.NonASCII),
+		}
+	})
+	if vf.vocabErr != nil {
+		return nil, vf.vocabErr
+	}
+	return &vf.vocab, nil
+}
+
+// vocabSize returns the size of the vocabulary of the model.
+func (vf *VerbaFlow) vocabSize() (int, error) {
+	switch {
+	case vf.Model != nil:
+		return vf.Model.Config.VocabSize, nil
+	case vf.Backend != nil:
+		if sizer, ok := vf.Backend.(interface{ VocabSize() int }); ok {
+			return sizer.VocabSize(), nil
+		}
+		return 0, fmt.Errorf("verbaflow: the size of the vocabulary of the backend is unknown")
+	default:
+		return 0, ErrModelNotLoaded
+	}
+}
+
+// withScriptGate returns the options with the language.Gate of opts.Script
+// appended to the logits processors, if the script is set; the "auto" script is
+// the one detected in the prompt, if any.
+func (vf *VerbaFlow) withScriptGate(prompt string, opts decoder.DecodingOptions) (decoder.DecodingOptions, error) {
+	if opts.Script == "" {
+		return opts, nil
+	}
+	target := language.Detect(prompt)
+	if opts.Script != language.Auto {
+		var err error
+		if target, err = language.ParseScript(opts.Script); err != nil {
+			return opts, err
+		}
+	}
+	if target == language.Unknown {
+		return opts, nil
+	}
+	vocab, err := vf.vocabulary()
+	if err != nil {
+		return opts, err
+	}
+	gate := language.NewGate(vocab.scripts, target, opts.ScriptPenalty)
+	opts.LogitsProcessors = append(opts.LogitsProcessors[:len(opts.LogitsProcessors):len(opts.LogitsProcessors)], gate)
+	return opts, nil
+}
+
+// withTokenMasks returns the options with the tokens of the masks set in opts
+// (NoEmoji, PrintableOnly and ASCIIOnly) added to the banned ones. The end token
+// is never banned.
+func (vf *VerbaFlow) withTokenMasks(opts decoder.DecodingOptions) (decoder.DecodingOptions, error) {
+	if !opts.NoEmoji && !opts.PrintableOnly && !opts.ASCIIOnly {
+		return opts, nil
+	}
+	vocab, err := vf.vocabulary()
+	if err != nil {
+		return opts, err
+	}
+	banned := append([]int(nil), opts.BannedTokenIDs...)
+	add := func(ids []int) {
+		for _, id := range ids {
+			if id != opts.EndTokenID {
+				banned = append(banned, id)
+			}
+		}
+	}
+	if opts.NoEmoji {
+		add(vocab.emoji)
+	}
+	if opts.PrintableOnly {
+		add(vocab.nonPrintable)
+	}
+	if opts.ASCIIOnly {
+		add(vocab.nonASCII)
+	}
+	opts.BannedTokenIDs = banned
+	return opts, nil
+}
+
+// withRegexp returns the options with the constraint.Processor of opts.Regexp
+// appended to the logits processors, if the expression is set.
+func (vf *VerbaFlow) withRegexp(opts decoder.DecodingOptions) (decoder.DecodingOptions, error) {
+	if opts.Regexp == "" {
+		return opts, nil
+	}
+	re, err := constraint.Compile(opts.Regexp)
+	if err != nil {
+		return opts, err
+	}
+	vocab, err := vf.vocabulary()
+	if err != nil {
+		return opts, err
+	}
+	if opts.EndTokenID < 0 || opts.EndTokenID >= len(vocab.texts) {
+		return opts, fmt.Errorf("verbaflow: the regexp requires a valid end token, got %d", opts.EndTokenID)
+	}
+	// the end token can't be delayed
+	opts.MinLen = 0
+	processor := constraint.NewProcessor(re, vocab.texts, opts.EndTokenID)
+	opts.LogitsProcessors = append(opts.LogitsProcessors[:len(opts.LogitsProcessors):len(opts.LogitsProcessors)], processor)
+	return opts, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package verbaflow
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptTokenizer is a byteTokenizer whose odd tokens are Cyrillic letters.
+type scriptTokenizer struct {
+	byteTokenizer
+}
+
+func (scriptTokenizer) ReconstructText(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		if id%2 == 1 {
+			sb.WriteRune('а' + rune(id/2))
+			continue
+		}
+		sb.WriteByte(byte('a' + id/2))
+	}
+	return sb.String(), nil
+}
+
+func TestVerbaFlow_Script(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.Tokenizer = scriptTokenizer{}
+	opts := decoder.DecodingOptions{MaxLen: 8, EndTokenID: -1, Temp: 1, TopP: 1, UseSampling: true, Seed: 3}
+
+	for _, tc := range []struct {
+		prompt, script string
+		parity         int
+	}{
+		{"hello", "cyrillic", 1},
+		{"hello", "auto", 0},
+		{"привет", "auto", 1},
+	} {
+		opts.Script = tc.script
+		for _, id := range generateIDs(t, vf, tc.prompt, opts) {
+			require.Equal(t, tc.parity, id%2, "%s %q", tc.script, tc.prompt)
+		}
+	}
+
+	opts.Script = "klingon"
+	_, _, err := vf.prepare(context.Background(), nil, []string{"hello"}, opts)
+	assert.ErrorContains(t, err, "unknown script")
+}
+
+// maskTokenizer is a byteTokenizer whose tokens multiple of 3 are emoji, and the
+// ones multiple of 5 are accented letters.
+type maskTokenizer struct {
+	byteTokenizer
+}
+
+func (maskTokenizer) ReconstructText(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		switch {
+		case id%3 == 0:
+			sb.WriteRune('😀' + rune(id))
+		case id%5 == 0:
+			sb.WriteRune('à' + rune(id))
+		default:
+			sb.WriteByte(byte('a' + id%26))
+		}
+	}
+	return sb.String(), nil
+}
+
+func TestVerbaFlow_TokenMasks(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	vf.Tokenizer = maskTokenizer{}
+	opts := decoder.DecodingOptions{MaxLen: 16, EndTokenID: 0, Temp: 1, TopP: 1, UseSampling: true, Seed: 5}
+
+	opts.NoEmoji = true
+	for _, id := range generateIDs(t, vf, "hello", opts) {
+		assert.True(t, id == 0 || id%3 != 0, "token %d", id)
+	}
+	opts.NoEmoji, opts.ASCIIOnly = false, true
+	for _, id := range generateIDs(t, vf, "hello", opts) {
+		assert.True(t, id == 0 || (id%3 != 0 && id%5 != 0), "token %d", id)
+	}
+
+	opts.BannedTokenIDs = []int{1}
+	masked, err := vf.withTokenMasks(opts)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, opts.BannedTokenIDs)
+	assert.Contains(t, masked.BannedTokenIDs, 1)
+	assert.Contains(t, masked.BannedTokenIDs, 5)
+	assert.NotContains(t, masked.BannedTokenIDs, 0, "the end token is never banned")
+}
+
+func TestVerbaFlow_Regexp(t *testing.T) {
+	vf := newTestVerbaFlow(t)
+	pattern := `[b-e]{2}f?`
+	ids := generateIDs(t, vf, "Hello", decoder.DecodingOptions{MaxLen: 8, EndTokenID: 0, Regexp: pattern})
+	require.NotEmpty(t, ids)
+	assert.Equal(t, 0, ids[len(ids)-1], "the generation ends once the text matches")
+	var text strings.Builder
+	for _, id := range ids[:len(ids)-1] {
+		token, err := vf.TokenByID(id)
+		require.NoError(t, err)
+		text.WriteString(token)
+	}
+	assert.Regexp(t, regexp.MustCompile("^"+pattern+"$"), text.String())
+
+	_, err := vf.applyOptions("Hello", decoder.DecodingOptions{EndTokenID: -1, Regexp: pattern})
+	assert.Error(t, err)
+	_, err = vf.applyOptions("Hello", decoder.DecodingOptions{EndTokenID: 0, Regexp: "("})
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package watermark implements the statistical "green list" watermark of
+// Kirchenbauer et al. (2023), "A Watermark for Large Language Models".
+//
+// At each step, the vocabulary is pseudo-randomly split into a green and a red
+// list, seeded by a secret key and the previous token; the logits of the green
+// tokens are increased by a small bias. Watermarked texts contain many more green
+// tokens than expected by chance, which can be tested without the model, knowing
+// only the key and the tokenizer.
+package watermark
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/verbaflow/decoder"
+)
+
+// Default values of the Config fields.
+const (
+	DefaultGamma     = 0.25
+	DefaultDelta     = 2.0
+	DefaultThreshold = 4.0
+)
+
+// Config contains the watermark parameters. The same Key and Gamma must be used
+// for generation and detection.
+type Config struct {
+	// Key is the secret seeding the green lists.
+	Key uint64
+	// Gamma is the fraction of the vocabulary in the green list (default: DefaultGamma).
+	Gamma float64
+	// Delta is the bias added to the logits of the green tokens (default: DefaultDelta).
+	Delta float64
+	// Threshold is the z-score above which a text is considered watermarked (default: DefaultThreshold).
+	Threshold float64
+}
+
+// KeyFromSecret derives a Key from a secret string.
+func KeyFromSecret(secret string) uint64 {
+	sum := sha256.Sum256([]byte(secret))
+	return binary.LittleEndian.Uint64(sum[:8])
+}
+
+func (c Config) withDefaults() Config {
+	if c.Gamma == 0 {
+		c.Gamma = DefaultGamma
+	}
+	if c.Delta == 0 {
+		c.Delta = DefaultDelta
+	}
+	if c.Threshold == 0 {
+		c.Threshold = DefaultThreshold
+	}
+	return c
+}
+
+// Validate checks the parameters.
+func (c Config) Validate() error {
+	c = c.withDefaults()
+	if c.Gamma <= 0 || c.Gamma >= 1 {
+		return fmt.Errorf("watermark: invalid gamma value: %f. Must be between 0 and 1 (excluded)", c.Gamma)
+	}
+	if c.Delta < 0 {
+		return fmt.Errorf("watermark: invalid delta value: %f. Must be >= 0", c.Delta)
+	}
+	return nil
+}
+
+// isGreen reports whether the token is in the green list seeded by the previous token.
+func (c Config) isGreen(prev, token int) bool {
+	h := mix(c.Key ^ mix(uint64(prev)+1) ^ mix(uint64(token)<<32|0x9e37))
+	return float64(h>>11)/(1<<53) < c.Gamma
+}
+
+// mix is the finalizer of SplitMix64.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// NewProcessor returns a logits processor that watermarks the generation.
+// The first generated token is seeded by the last prompt token.
+func NewProcessor(c Config) decoder.LogitsProcessor {
+	c = c.withDefaults()
+	delta := float32(c.Delta)
+	return decoder.LogitsProcessorFunc(func(_ int, inputIDs []int, logits []float32) []float32 {
+		if len(inputIDs) == 0 {
+			return logits
+		}
+		prev := inputIDs[len(inputIDs)-1]
+		for id := range logits {
+			if c.isGreen(prev, id) {
+				logits[id] += delta
+			}
+		}
+		return logits
+	})
+}
+
+// Result is the outcome of a watermark detection.
+type Result struct {
+	// Tokens is the number of scored tokens.
+	Tokens int `json:"tokens"`
+	// Green is the number of scored tokens in their green list.
+	Green int `json:"green"`
+	// ZScore measures how much the green tokens exceed the expected fraction Gamma.
+	ZScore float64 `json:"z_score"`
+	// PValue is the probability of observing at least as many green tokens in a text without watermark.
+	PValue float64 `json:"p_value"`
+	// Watermarked reports whether ZScore exceeds the threshold.
+	Watermarked bool `json:"watermarked"`
+}
+
+// Detect tests the tokenized text for the watermark. Each token is scored against
+// the green list seeded by the preceding one, so the first token is not scored.
+func Detect(c Config, tokenIDs []int) (Result, error) {
+	if err := c.Validate(); err != nil {
+		return Result{}, err
+	}
+	c = c.withDefaults()
+	if len(tokenIDs) < 2 {
+		return Result{}, fmt.Errorf("watermark: at least two tokens are required")
+	}
+
+	var r Result
+	for i := 1; i < len(tokenIDs); i++ {
+		r.Tokens++
+		if c.isGreen(tokenIDs[i-1], tokenIDs[i]) {
+			r.Green++
+		}
+	}
+	t := float64(r.Tokens)
+	r.ZScore = (float64(r.Green) - c.Gamma*t) / math.Sqrt(t*c.Gamma*(1-c.Gamma))
+	r.PValue = 0.5 * math.Erfc(r.ZScore/math.Sqrt2)
+	r.Watermarked = r.ZScore > c.Threshold
+	return r, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 NLP Odyssey Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package watermark
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const vocabSize = 1000
+
+// generate samples a sequence from uniform logits, processed by the watermark if wm is true.
+func generate(c Config, n int, wm bool, seed int64) []int {
+	rng := rand.New(rand.NewSource(seed))
+	p := NewProcessor(c)
+	ids := []int{rng.Intn(vocabSize)}
+	for step := 0; step < n; step++ {
+		logits := make([]float32, vocabSize)
+		if wm {
+			logits = p.Process(step, ids, logits)
+		}
+		ids = append(ids, sample(rng, logits))
+	}
+	return ids
+}
+
+func sample(rng *rand.Rand, logits []float32) int {
+	weights := make([]float64, len(logits))
+	var sum float64
+	for i, l := range logits {
+		weights[i] = math.Exp(float64(l))
+		sum += weights[i]
+	}
+	r := rng.Float64() * sum
+	for i, w := range weights {
+		if r -= w; r < 0 {
+			return i
+		}
+	}
+	return len(logits) - 1
+}
+
+func TestDetect(t *testing.T) {
+	c := Config{Key: KeyFromSecret("secret")}
+
+	r, err := Detect(c, generate(c, 200, true, 1))
+	require.NoError(t, err)
+	assert.True(t, r.Watermarked, "z-score: %f", r.ZScore)
+	assert.Less(t, r.PValue, 1e-4)
+
+	r, err = Detect(c, generate(c, 200, false, 2))
+	require.NoError(t, err)
+	assert.False(t, r.Watermarked, "z-score: %f", r.ZScore)
+
+	other := Config{Key: KeyFromSecret("other")}
+	r, err = Detect(other, generate(c, 200, true, 3))
+	require.NoError(t, err)
+	assert.False(t, r.Watermarked, "z-score: %f", r.ZScore)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.Error(t, Config{Gamma: 1}.Validate())
+	assert.Error(t, Config{Delta: -1}.Validate())
+
+	_, err := Detect(Config{}, []int{1})
+	assert.Error(t, err)
+}